@@ -0,0 +1,161 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The audit package records an append-only trail of the changes that Felix
+// makes to the dataplane, for compliance purposes.  Each change to a chain,
+// IP set or route produces a Record, which holds hashes of the object's
+// contents before and after the change, and the latest datastore revision
+// that Felix had received when it made the change.
+//
+// Records are written to one or more Sinks, for example a file of JSON
+// lines or syslog.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	KindChain = "chain"
+	KindIPSet = "ipset"
+	KindRoute = "route"
+
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+
+	// HashLength is the length of the content hashes in a Record.
+	HashLength = 16
+)
+
+// Record describes a single change to the dataplane.
+type Record struct {
+	Time time.Time `json:"time"`
+	// Kind is the kind of object that changed; one of the Kind constants.
+	Kind string `json:"kind"`
+	// Op is one of the Op constants.
+	Op   string `json:"op"`
+	Name string `json:"name"`
+	// Table and IPVersion are only set for chains.
+	Table     string `json:"table,omitempty"`
+	IPVersion uint8  `json:"ipVersion,omitempty"`
+	// Before and After are hashes of the object's contents; Before is
+	// empty for a create and After is empty for a delete.
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+	// Revision is the latest datastore revision that Felix had received
+	// when the change was made.
+	Revision string `json:"revision,omitempty"`
+}
+
+// NewRecord returns a record of a change to the named object, whose contents
+// changed from before to after.  A nil slice means that the object didn't
+// exist (for before) or has been deleted (for after).  The time and revision
+// are filled in by the Log.
+func NewRecord(kind, name string, before, after []string) *Record {
+	rec := &Record{
+		Kind: kind,
+		Name: name,
+		Op:   OpUpdate,
+	}
+	if before == nil {
+		rec.Op = OpCreate
+	} else {
+		rec.Before = Hash(before)
+	}
+	if after == nil {
+		rec.Op = OpDelete
+	} else {
+		rec.After = Hash(after)
+	}
+	return rec
+}
+
+func (r *Record) String() string {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// Hash returns a hash of the given lines, which are the contents of an
+// object, in order.
+func Hash(lines []string) string {
+	hasher := sha256.New224()
+	for _, line := range lines {
+		hasher.Write([]byte(line))
+		hasher.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))[:HashLength]
+}
+
+type Sink interface {
+	Export(records []*Record) error
+}
+
+// Log stamps records with the time and the current datastore revision and
+// passes them to its sinks.  It is safe for concurrent use.
+type Log struct {
+	mutex    sync.Mutex
+	sinks    []Sink
+	revision string
+	now      func() time.Time
+}
+
+func New(sinks ...Sink) *Log {
+	return NewWithClock(time.Now, sinks...)
+}
+
+// NewWithClock is a test constructor that allows the clock to be replaced.
+func NewWithClock(now func() time.Time, sinks ...Sink) *Log {
+	return &Log{
+		sinks: sinks,
+		now:   now,
+	}
+}
+
+// SetRevision records the latest datastore revision that Felix has
+// received.
+func (l *Log) SetRevision(revision string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.revision = revision
+}
+
+// Record writes the given records to each of the sinks.  A failure to write
+// to a sink is logged but doesn't stop the dataplane from being programmed.
+func (l *Log) Record(records ...*Record) {
+	if len(records) == 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	for _, rec := range records {
+		rec.Time = now
+		rec.Revision = l.revision
+	}
+	for _, sink := range l.sinks {
+		if err := sink.Export(records); err != nil {
+			log.WithError(err).WithField("numRecords", len(records)).Error(
+				"Failed to write audit records")
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/audit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+// recordingSink is a Sink that keeps the records that it is given.
+type recordingSink struct {
+	records []*Record
+}
+
+func (s *recordingSink) Export(records []*Record) error {
+	s.records = append(s.records, records...)
+	return nil
+}
+
+var _ = Describe("NewRecord", func() {
+	It("should record a create", func() {
+		rec := NewRecord(KindIPSet, "s1", nil, []string{"10.0.0.1"})
+		Expect(rec.Op).To(Equal(OpCreate))
+		Expect(rec.Before).To(BeEmpty())
+		Expect(rec.After).To(Equal(Hash([]string{"10.0.0.1"})))
+	})
+	It("should record a delete", func() {
+		rec := NewRecord(KindIPSet, "s1", []string{"10.0.0.1"}, nil)
+		Expect(rec.Op).To(Equal(OpDelete))
+		Expect(rec.Before).To(Equal(Hash([]string{"10.0.0.1"})))
+		Expect(rec.After).To(BeEmpty())
+	})
+	It("should record an update, including to an empty object", func() {
+		rec := NewRecord(KindIPSet, "s1", []string{"10.0.0.1"}, []string{})
+		Expect(rec.Op).To(Equal(OpUpdate))
+		Expect(rec.Before).To(Equal(Hash([]string{"10.0.0.1"})))
+		Expect(rec.After).To(Equal(Hash([]string{})))
+		Expect(rec.After).NotTo(BeEmpty())
+	})
+})
+
+var _ = Describe("Hash", func() {
+	It("should depend on the order and boundaries of the lines", func() {
+		Expect(Hash([]string{"a", "b"})).NotTo(Equal(Hash([]string{"b", "a"})))
+		Expect(Hash([]string{"ab"})).NotTo(Equal(Hash([]string{"a", "b"})))
+		Expect(Hash([]string{"a", "b"})).To(HaveLen(HashLength))
+	})
+})
+
+var _ = Describe("Log", func() {
+	var sink1, sink2 *recordingSink
+	var auditLog *Log
+	now := time.Unix(1500000000, 0)
+
+	BeforeEach(func() {
+		sink1 = &recordingSink{}
+		sink2 = &recordingSink{}
+		auditLog = NewWithClock(func() time.Time { return now }, sink1, sink2)
+	})
+
+	It("should stamp the records and pass them to every sink", func() {
+		auditLog.SetRevision("1234")
+		auditLog.Record(NewRecord(KindRoute, "10.0.0.1/32", nil, []string{"cali1"}))
+		Expect(sink1.records).To(HaveLen(1))
+		Expect(sink1.records[0].Time).To(Equal(now))
+		Expect(sink1.records[0].Revision).To(Equal("1234"))
+		Expect(sink2.records).To(Equal(sink1.records))
+	})
+	It("should leave out the revision before one is known", func() {
+		auditLog.Record(NewRecord(KindRoute, "10.0.0.1/32", nil, []string{"cali1"}))
+		Expect(sink1.records[0].String()).NotTo(ContainSubstring("revision"))
+	})
+	It("should do nothing for no records", func() {
+		auditLog.Record()
+		Expect(sink1.records).To(BeNil())
+	})
+})
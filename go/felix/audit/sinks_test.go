@@ -0,0 +1,62 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/audit"
+
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+var _ = Describe("FileSink", func() {
+	var dir string
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "audit")
+		Expect(err).NotTo(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should append one JSON object per record", func() {
+		file := path.Join(dir, "audit.log")
+		sink := NewFileSink(file)
+		rec := NewRecord(KindIPSet, "s1", nil, []string{"10.0.0.1"})
+		Expect(sink.Export([]*Record{rec})).To(Succeed())
+		Expect(sink.Export([]*Record{rec, rec})).To(Succeed())
+
+		data, err := ioutil.ReadFile(file)
+		Expect(err).NotTo(HaveOccurred())
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		Expect(lines).To(HaveLen(3))
+		var decoded Record
+		Expect(json.Unmarshal([]byte(lines[2]), &decoded)).To(Succeed())
+		Expect(decoded.Kind).To(Equal(KindIPSet))
+		Expect(decoded.Op).To(Equal(OpCreate))
+		Expect(decoded.After).To(Equal(rec.After))
+	})
+	It("should return an error if the file can't be opened", func() {
+		sink := NewFileSink(path.Join(dir, "missing", "audit.log"))
+		rec := NewRecord(KindIPSet, "s1", nil, []string{})
+		Expect(sink.Export([]*Record{rec})).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,144 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/set"
+	"sort"
+)
+
+// UpdateAuditor records the changes to IP sets and routes that the
+// calculation graph sends to the dataplane driver.  It tracks the contents
+// of each IP set and the routes of each local workload so that it can hash
+// them before and after each update.  It is not safe for concurrent use.
+type UpdateAuditor struct {
+	log            *Log
+	ipSets         map[string]set.Set
+	endpointRoutes map[proto.WorkloadEndpointID]map[string]string
+}
+
+func NewUpdateAuditor(log *Log) *UpdateAuditor {
+	return &UpdateAuditor{
+		log:            log,
+		ipSets:         map[string]set.Set{},
+		endpointRoutes: map[proto.WorkloadEndpointID]map[string]string{},
+	}
+}
+
+// OnUpdate records the changes made by a message that is being sent to the
+// dataplane driver.  Messages that don't change IP sets or routes are
+// ignored.
+func (a *UpdateAuditor) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.IPSetUpdate:
+		before := a.ipSetMembers(msg.Id)
+		members := set.New()
+		for _, m := range msg.Members {
+			members.Add(m)
+		}
+		a.ipSets[msg.Id] = members
+		a.recordChange(NewRecord(KindIPSet, msg.Id, before, a.ipSetMembers(msg.Id)))
+	case *proto.IPSetDeltaUpdate:
+		before := a.ipSetMembers(msg.Id)
+		members := a.ipSets[msg.Id]
+		if members == nil {
+			members = set.New()
+			a.ipSets[msg.Id] = members
+		}
+		for _, m := range msg.AddedMembers {
+			members.Add(m)
+		}
+		for _, m := range msg.RemovedMembers {
+			members.Discard(m)
+		}
+		a.recordChange(NewRecord(KindIPSet, msg.Id, before, a.ipSetMembers(msg.Id)))
+	case *proto.IPSetRemove:
+		if before := a.ipSetMembers(msg.Id); before != nil {
+			delete(a.ipSets, msg.Id)
+			a.log.Record(NewRecord(KindIPSet, msg.Id, before, nil))
+		}
+	case *proto.WorkloadEndpointUpdate:
+		routes := map[string]string{}
+		for _, nets := range [][]string{msg.Endpoint.Ipv4Nets, msg.Endpoint.Ipv6Nets} {
+			for _, dst := range nets {
+				routes[dst] = msg.Endpoint.Name
+			}
+		}
+		a.updateRoutes(*msg.Id, routes)
+	case *proto.WorkloadEndpointRemove:
+		a.updateRoutes(*msg.Id, nil)
+	}
+}
+
+// ipSetMembers returns the sorted members of the IP set, or nil if it
+// doesn't exist.
+func (a *UpdateAuditor) ipSetMembers(id string) []string {
+	members := a.ipSets[id]
+	if members == nil {
+		return nil
+	}
+	sorted := []string{}
+	members.Iter(func(item interface{}) error {
+		sorted = append(sorted, item.(string))
+		return nil
+	})
+	sort.Strings(sorted)
+	return sorted
+}
+
+// updateRoutes replaces the routes of the given endpoint, recording a change
+// for each route that was added, removed or moved to another interface.
+func (a *UpdateAuditor) updateRoutes(id proto.WorkloadEndpointID, routes map[string]string) {
+	oldRoutes := a.endpointRoutes[id]
+	dsts := []string{}
+	for dst := range oldRoutes {
+		dsts = append(dsts, dst)
+	}
+	for dst := range routes {
+		if _, ok := oldRoutes[dst]; !ok {
+			dsts = append(dsts, dst)
+		}
+	}
+	sort.Strings(dsts)
+	var records []*Record
+	for _, dst := range dsts {
+		var before, after []string
+		if iface, ok := oldRoutes[dst]; ok {
+			before = []string{iface}
+		}
+		if iface, ok := routes[dst]; ok {
+			after = []string{iface}
+		}
+		if rec := NewRecord(KindRoute, dst, before, after); rec.Before != rec.After {
+			records = append(records, rec)
+		}
+	}
+	if routes == nil {
+		delete(a.endpointRoutes, id)
+	} else {
+		a.endpointRoutes[id] = routes
+	}
+	a.log.Record(records...)
+}
+
+// recordChange records the change unless the update left the object as it
+// was.
+func (a *UpdateAuditor) recordChange(rec *Record) {
+	if rec.Before == rec.After {
+		return
+	}
+	a.log.Record(rec)
+}
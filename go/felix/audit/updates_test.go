@@ -0,0 +1,124 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/audit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/proto"
+)
+
+var _ = Describe("UpdateAuditor", func() {
+	var sink *recordingSink
+	var auditor *UpdateAuditor
+
+	// ops returns the kind, op and name of each record, and forgets the
+	// records.
+	ops := func() []string {
+		ops := []string{}
+		for _, rec := range sink.records {
+			ops = append(ops, rec.Kind+" "+rec.Op+" "+rec.Name)
+		}
+		sink.records = nil
+		return ops
+	}
+
+	endpointID := &proto.WorkloadEndpointID{
+		OrchestratorId: "k8s",
+		WorkloadId:     "pod1",
+		EndpointId:     "eth0",
+	}
+
+	BeforeEach(func() {
+		sink = &recordingSink{}
+		auditor = NewUpdateAuditor(New(sink))
+	})
+
+	It("should record IP set changes", func() {
+		auditor.OnUpdate(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1"}})
+		Expect(ops()).To(Equal([]string{"ipset create s1"}))
+
+		auditor.OnUpdate(&proto.IPSetDeltaUpdate{Id: "s1", AddedMembers: []string{"10.0.0.2"}})
+		auditor.OnUpdate(&proto.IPSetDeltaUpdate{Id: "s1", RemovedMembers: []string{"10.0.0.2"}})
+		Expect(sink.records[0].After).To(Equal(Hash([]string{"10.0.0.1", "10.0.0.2"})))
+		Expect(sink.records[1].After).To(Equal(Hash([]string{"10.0.0.1"})))
+		Expect(ops()).To(Equal([]string{"ipset update s1", "ipset update s1"}))
+
+		auditor.OnUpdate(&proto.IPSetRemove{Id: "s1"})
+		Expect(ops()).To(Equal([]string{"ipset delete s1"}))
+	})
+	It("should hash IP set members independently of their order", func() {
+		auditor.OnUpdate(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.2", "10.0.0.1"}})
+		Expect(sink.records[0].After).To(Equal(Hash([]string{"10.0.0.1", "10.0.0.2"})))
+	})
+	It("should ignore updates that don't change an IP set", func() {
+		auditor.OnUpdate(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1"}})
+		auditor.OnUpdate(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1"}})
+		auditor.OnUpdate(&proto.IPSetDeltaUpdate{Id: "s1", AddedMembers: []string{"10.0.0.1"}})
+		auditor.OnUpdate(&proto.IPSetRemove{Id: "s2"})
+		Expect(ops()).To(Equal([]string{"ipset create s1"}))
+	})
+	It("should record route changes", func() {
+		auditor.OnUpdate(&proto.WorkloadEndpointUpdate{
+			Id: endpointID,
+			Endpoint: &proto.WorkloadEndpoint{
+				Name:     "cali1",
+				Ipv4Nets: []string{"10.0.0.1/32", "10.0.0.2/32"},
+				Ipv6Nets: []string{"fd00::1/128"},
+			},
+		})
+		Expect(ops()).To(Equal([]string{
+			"route create 10.0.0.1/32",
+			"route create 10.0.0.2/32",
+			"route create fd00::1/128",
+		}))
+
+		auditor.OnUpdate(&proto.WorkloadEndpointUpdate{
+			Id: endpointID,
+			Endpoint: &proto.WorkloadEndpoint{
+				Name:     "cali2",
+				Ipv4Nets: []string{"10.0.0.1/32", "10.0.0.3/32"},
+				Ipv6Nets: []string{"fd00::1/128"},
+			},
+		})
+		Expect(ops()).To(Equal([]string{
+			"route update 10.0.0.1/32",
+			"route delete 10.0.0.2/32",
+			"route create 10.0.0.3/32",
+			"route update fd00::1/128",
+		}))
+
+		auditor.OnUpdate(&proto.WorkloadEndpointRemove{Id: endpointID})
+		Expect(ops()).To(Equal([]string{
+			"route delete 10.0.0.1/32",
+			"route delete 10.0.0.3/32",
+			"route delete fd00::1/128",
+		}))
+	})
+	It("should ignore endpoint updates that don't change the routes", func() {
+		update := &proto.WorkloadEndpointUpdate{
+			Id: endpointID,
+			Endpoint: &proto.WorkloadEndpoint{
+				Name:     "cali1",
+				Ipv4Nets: []string{"10.0.0.1/32"},
+			},
+		}
+		auditor.OnUpdate(update)
+		auditor.OnUpdate(update)
+		Expect(ops()).To(Equal([]string{"route create 10.0.0.1/32"}))
+	})
+})
@@ -0,0 +1,218 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The backoff package paces the retries of dataplane updates that fail.
+//
+// A dataplane applier, such as the iptables Table or the BPF dataplane,
+// wraps each independent update, for example one table or one endpoint, in
+// Manager.Apply.  If an update fails repeatedly, the Manager makes it wait
+// exponentially longer between attempts so that a persistent failure doesn't
+// hog the CPU or flood the log, while the applier carries on with its other
+// updates.  A panic in an update is turned into a failure of that update
+// rather than taking down the whole of Felix.
+//
+// If a health aggregator is supplied, the Manager reports itself not ready
+// while any update has failed too many times in a row.  It doesn't affect
+// liveness: restarting Felix wouldn't fix a bad update.
+package backoff
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/health"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInitialDelay = 100 * time.Millisecond
+	defaultMaxDelay     = 30 * time.Second
+	defaultUnreadyAfter = 5
+)
+
+// ErrBackingOff is returned by Apply if the update failed recently and isn't
+// due to be retried yet.
+var ErrBackingOff = errors.New("backing off after failure")
+
+type Config struct {
+	// InitialDelay is the delay after the first failure; it doubles with
+	// each further failure.  Defaults to 100ms.
+	InitialDelay time.Duration
+	// MaxDelay caps the delay.  Defaults to 30s.
+	MaxDelay time.Duration
+	// UnreadyAfter is the number of consecutive failures of one update
+	// after which the Manager reports that it's not ready.  Defaults to 5.
+	UnreadyAfter int
+}
+
+type failureState struct {
+	numFailures int
+	nextAttempt time.Time
+}
+
+// Manager tracks the failures of a set of updates, identified by keys.  It
+// is safe for concurrent use.
+type Manager struct {
+	name             string
+	config           Config
+	healthAggregator *health.HealthAggregator
+
+	mutex    sync.Mutex
+	failures map[string]*failureState
+}
+
+// NewManager creates a Manager.  name identifies the Manager in the log and,
+// if healthAggregator is non-nil, in the health reports.
+func NewManager(name string, config Config, healthAggregator *health.HealthAggregator) *Manager {
+	if config.InitialDelay <= 0 {
+		config.InitialDelay = defaultInitialDelay
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = defaultMaxDelay
+	}
+	if config.UnreadyAfter <= 0 {
+		config.UnreadyAfter = defaultUnreadyAfter
+	}
+	m := &Manager{
+		name:             name,
+		config:           config,
+		healthAggregator: healthAggregator,
+		failures:         map[string]*failureState{},
+	}
+	if healthAggregator != nil {
+		healthAggregator.RegisterReporter(name, &health.HealthReport{Ready: true}, 0)
+		m.reportHealthLocked()
+	}
+	return m
+}
+
+// Apply calls apply, unless the update with the given key has failed and
+// isn't due to be retried, in which case it returns ErrBackingOff.  If apply
+// panics, the panic is logged and returned as an error.
+func (m *Manager) Apply(key string, apply func() error) error {
+	now := time.Now()
+	m.mutex.Lock()
+	if state := m.failures[key]; state != nil && now.Before(state.nextAttempt) {
+		m.mutex.Unlock()
+		return ErrBackingOff
+	}
+	m.mutex.Unlock()
+
+	err := callWithRecover(apply)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err == nil {
+		if m.failures[key] != nil {
+			log.WithFields(log.Fields{
+				"manager": m.name,
+				"key":     key,
+			}).Info("Update succeeded after earlier failures")
+			delete(m.failures, key)
+			m.reportHealthLocked()
+		}
+		return nil
+	}
+	state := m.failures[key]
+	if state == nil {
+		state = &failureState{}
+		m.failures[key] = state
+	}
+	state.numFailures++
+	delay := m.delay(state.numFailures)
+	state.nextAttempt = time.Now().Add(delay)
+	log.WithError(err).WithFields(log.Fields{
+		"manager":     m.name,
+		"key":         key,
+		"numFailures": state.numFailures,
+		"retryIn":     delay,
+	}).Warn("Update failed, backing off")
+	if state.numFailures == m.config.UnreadyAfter {
+		m.reportHealthLocked()
+	}
+	return err
+}
+
+// delay calculates the delay after the given number of consecutive failures.
+func (m *Manager) delay(numFailures int) time.Duration {
+	delay := m.config.InitialDelay
+	for i := 1; i < numFailures && delay < m.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > m.config.MaxDelay {
+		delay = m.config.MaxDelay
+	}
+	return delay
+}
+
+// Forget discards the failures of the given update, for example because it
+// is no longer needed.
+func (m *Manager) Forget(key string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.failures[key] != nil {
+		delete(m.failures, key)
+		m.reportHealthLocked()
+	}
+}
+
+// NextRetry returns the time at which the next failed update is due to be
+// retried.  It returns false if there are no failed updates.
+func (m *Manager) NextRetry() (time.Time, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var next time.Time
+	found := false
+	for _, state := range m.failures {
+		if !found || state.nextAttempt.Before(next) {
+			next = state.nextAttempt
+			found = true
+		}
+	}
+	return next, found
+}
+
+// NumFailing returns the number of updates whose last attempt failed.
+func (m *Manager) NumFailing() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.failures)
+}
+
+func (m *Manager) reportHealthLocked() {
+	if m.healthAggregator == nil {
+		return
+	}
+	ready := true
+	for _, state := range m.failures {
+		if state.numFailures >= m.config.UnreadyAfter {
+			ready = false
+			break
+		}
+	}
+	m.healthAggregator.Report(m.name, &health.HealthReport{Live: true, Ready: ready})
+}
+
+func callWithRecover(apply func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithField("panic", r).Errorf("Recovered from panic during update:\n%s",
+				debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return apply()
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backoff_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/backoff"
+
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/health"
+	"time"
+)
+
+var _ = Describe("Manager", func() {
+	var manager *Manager
+	var aggregator *health.HealthAggregator
+	var numCalls int
+	errFailed := errors.New("failed")
+
+	failing := func() error {
+		numCalls++
+		return errFailed
+	}
+	succeeding := func() error {
+		numCalls++
+		return nil
+	}
+
+	BeforeEach(func() {
+		numCalls = 0
+		aggregator = health.NewHealthAggregator()
+		manager = NewManager("test", Config{
+			InitialDelay: 20 * time.Millisecond,
+			MaxDelay:     80 * time.Millisecond,
+			UnreadyAfter: 3,
+		}, aggregator)
+	})
+
+	It("should start ready", func() {
+		Expect(aggregator.Summary().Ready).To(BeTrue())
+		_, found := manager.NextRetry()
+		Expect(found).To(BeFalse())
+	})
+	It("should call a succeeding update every time", func() {
+		Expect(manager.Apply("a", succeeding)).To(Succeed())
+		Expect(manager.Apply("a", succeeding)).To(Succeed())
+		Expect(numCalls).To(Equal(2))
+	})
+	It("should convert a panic into an error", func() {
+		err := manager.Apply("a", func() error { panic("bad chain") })
+		Expect(err).To(MatchError("panic: bad chain"))
+		Expect(manager.NumFailing()).To(Equal(1))
+	})
+
+	Describe("after a failure", func() {
+		var failTime time.Time
+
+		BeforeEach(func() {
+			failTime = time.Now()
+			Expect(manager.Apply("a", failing)).To(Equal(errFailed))
+		})
+
+		It("should back off", func() {
+			Expect(manager.Apply("a", failing)).To(Equal(ErrBackingOff))
+			Expect(numCalls).To(Equal(1))
+			next, found := manager.NextRetry()
+			Expect(found).To(BeTrue())
+			Expect(next).To(BeTemporally("~", failTime.Add(20*time.Millisecond), 10*time.Millisecond))
+		})
+		It("should not hold up other updates", func() {
+			Expect(manager.Apply("b", succeeding)).To(Succeed())
+			Expect(numCalls).To(Equal(2))
+		})
+		It("should retry once the delay has passed", func() {
+			time.Sleep(25 * time.Millisecond)
+			Expect(manager.Apply("a", succeeding)).To(Succeed())
+			Expect(manager.NumFailing()).To(Equal(0))
+		})
+		It("should double the delay up to the maximum", func() {
+			var delays []time.Duration
+			for i := 0; i < 4; i++ {
+				next, _ := manager.NextRetry()
+				time.Sleep(next.Sub(time.Now()) + time.Millisecond)
+				before := time.Now()
+				Expect(manager.Apply("a", failing)).To(Equal(errFailed))
+				next, _ = manager.NextRetry()
+				delays = append(delays, next.Sub(before))
+			}
+			Expect(delays[0]).To(BeNumerically("~", 40*time.Millisecond, 10*time.Millisecond))
+			Expect(delays[1]).To(BeNumerically("~", 80*time.Millisecond, 10*time.Millisecond))
+			Expect(delays[2]).To(BeNumerically("~", 80*time.Millisecond, 10*time.Millisecond))
+			Expect(delays[3]).To(BeNumerically("~", 80*time.Millisecond, 10*time.Millisecond))
+		})
+		It("should report not ready after repeated failures, until it succeeds", func() {
+			for i := 0; i < 2; i++ {
+				Expect(aggregator.Summary().Ready).To(BeTrue())
+				next, _ := manager.NextRetry()
+				time.Sleep(next.Sub(time.Now()) + time.Millisecond)
+				Expect(manager.Apply("a", failing)).To(Equal(errFailed))
+			}
+			Expect(aggregator.Summary().Ready).To(BeFalse())
+			Expect(aggregator.Summary().Live).To(BeTrue())
+			next, _ := manager.NextRetry()
+			time.Sleep(next.Sub(time.Now()) + time.Millisecond)
+			Expect(manager.Apply("a", succeeding)).To(Succeed())
+			Expect(aggregator.Summary().Ready).To(BeTrue())
+		})
+		It("should forget the failure", func() {
+			manager.Forget("a")
+			Expect(manager.NumFailing()).To(Equal(0))
+			Expect(manager.Apply("a", succeeding)).To(Succeed())
+		})
+	})
+
+	It("should work without a health aggregator", func() {
+		manager = NewManager("test", Config{}, nil)
+		Expect(manager.Apply("a", failing)).To(Equal(errFailed))
+		Expect(manager.Apply("a", failing)).To(Equal(ErrBackingOff))
+	})
+})
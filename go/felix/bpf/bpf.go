@@ -0,0 +1,45 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The bpf package contains the building blocks of the experimental BPF
+// dataplane: a compiler from Felix's policy rules to the fixed-format rules
+// that are evaluated by our TC programs (see c/tc_policy.c), a compiler from
+// untracked deny rules to the deny-list of our XDP program (c/xdp_deny.c),
+// the encoding of the BPF map keys and values, access to the pinned BPF maps
+// and attachment of the programs to interfaces, using the tc and ip
+// binaries.
+package bpf
+
+const (
+	// The TC programs pin their maps in tc's global namespace.
+	PolicyMapPath      = "/sys/fs/bpf/tc/globals/cali_pol"
+	NATFrontendMapPath = "/sys/fs/bpf/tc/globals/cali_nat_fe"
+	NATBackendMapPath  = "/sys/fs/bpf/tc/globals/cali_nat_be"
+
+	// The XDP program pins its maps in ip's global namespace.
+	XDPDenyMapPath     = "/sys/fs/bpf/xdp/globals/cali_xdp_deny"
+	XDPFailsafeMapPath = "/sys/fs/bpf/xdp/globals/cali_xdp_fsafe"
+
+	// ELF sections of the programs in the object file.
+	SectionFromWorkload = "calico_from_wep"
+	SectionToWorkload   = "calico_to_wep"
+	SectionFromHost     = "calico_from_hep"
+	SectionToHost       = "calico_to_hep"
+	SectionXDPDeny      = "calico_xdp_deny"
+
+	// MaxRulesPerDirection is the number of rules that the TC program
+	// evaluates for each interface and direction.  It must match MAX_RULES
+	// in the C code.
+	MaxRulesPerDirection = 64
+)
@@ -0,0 +1,67 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Definitions that are shared by our BPF programs.  The helper functions are
+// declared here, rather than taken from a library, because the kernel's
+// headers only define their IDs.
+
+#ifndef __CALICO_BPF_HELPERS_H__
+#define __CALICO_BPF_HELPERS_H__
+
+#include <linux/bpf.h>
+
+#define SEC(name) __attribute__((section(name), used))
+#define INLINE inline __attribute__((always_inline))
+
+#if __BYTE_ORDER__ == __ORDER_LITTLE_ENDIAN__
+#define bpf_htons(x) __builtin_bswap16(x)
+#define bpf_ntohs(x) __builtin_bswap16(x)
+#define bpf_ntohl(x) __builtin_bswap32(x)
+#else
+#define bpf_htons(x) (x)
+#define bpf_ntohs(x) (x)
+#define bpf_ntohl(x) (x)
+#endif
+
+static void *(*bpf_map_lookup_elem)(void *map, const void *key) =
+	(void *)BPF_FUNC_map_lookup_elem;
+static int (*bpf_skb_load_bytes)(const struct __sk_buff *skb, __u32 off,
+				 void *to, __u32 len) =
+	(void *)BPF_FUNC_skb_load_bytes;
+static int (*bpf_skb_store_bytes)(struct __sk_buff *skb, __u32 off,
+				  const void *from, __u32 len, __u64 flags) =
+	(void *)BPF_FUNC_skb_store_bytes;
+static int (*bpf_l3_csum_replace)(struct __sk_buff *skb, __u32 off,
+				  __u64 from, __u64 to, __u64 flags) =
+	(void *)BPF_FUNC_l3_csum_replace;
+static int (*bpf_l4_csum_replace)(struct __sk_buff *skb, __u32 off,
+				  __u64 from, __u64 to, __u64 flags) =
+	(void *)BPF_FUNC_l4_csum_replace;
+
+// Map definition format that is understood by iproute2's ELF loader, which
+// is used by both tc and ip.
+struct bpf_elf_map {
+	__u32 type;
+	__u32 size_key;
+	__u32 size_value;
+	__u32 max_elem;
+	__u32 flags;
+	__u32 id;
+	__u32 pinning;
+};
+
+#define PIN_GLOBAL_NS 2
+
+#endif /* __CALICO_BPF_HELPERS_H__ */
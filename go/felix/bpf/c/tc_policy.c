@@ -0,0 +1,347 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// TC classifier programs for Felix's experimental BPF dataplane.  Build with
+//
+//     clang -O2 -Wall -target bpf -c tc_policy.c -o tc_policy.o
+//
+// The programs are loaded with tc in direct-action mode, which creates the
+// maps and pins them under /sys/fs/bpf/tc/globals, where Felix updates them.
+// The layout of the map keys and values must be kept in sync with the
+// encoding in the bpf Go package.
+//
+// The programs only act on IPv4; everything else is passed through to the
+// iptables rules, which remain in place.
+
+#include <linux/bpf.h>
+#include <linux/if_ether.h>
+#include <linux/in.h>
+#include <linux/ip.h>
+#include <linux/pkt_cls.h>
+#include <linux/tcp.h>
+#include <linux/udp.h>
+#include <stddef.h>
+
+#include "bpf_helpers.h"
+
+// Must match bpf.MaxRulesPerDirection.
+#define MAX_RULES 64
+
+#define DIR_INBOUND 0
+#define DIR_OUTBOUND 1
+
+#define ACTION_ALLOW 1
+#define ACTION_DENY 2
+
+#define IP_FRAG_OFFSET_MASK 0x1fff
+
+// policy_key identifies one rule in an interface's rule list.  The rules for
+// each interface and direction are stored at consecutive indexes, starting
+// from 0.
+struct policy_key {
+	__u32 ifindex;
+	__u16 index;
+	__u8 direction;
+	__u8 pad;
+};
+
+// policy_rule is a single compiled rule.  Nets are in network byte order;
+// ports are in host byte order and a max port of 0 means "any port".  A
+// protocol of 0 means "any protocol".
+struct policy_rule {
+	__u8 action;
+	__u8 protocol;
+	__u8 src_prefix_len;
+	__u8 dst_prefix_len;
+	__be32 src_net;
+	__be32 dst_net;
+	__u16 src_port_min;
+	__u16 src_port_max;
+	__u16 dst_port_min;
+	__u16 dst_port_max;
+};
+
+// nat_addr is used for both the keys and the values of the NAT maps.  The
+// address and port are in network byte order.  The protocol is only
+// significant in keys.
+struct nat_addr {
+	__be32 addr;
+	__be16 port;
+	__u8 protocol;
+	__u8 pad;
+};
+
+struct bpf_elf_map SEC("maps") cali_pol = {
+	.type = BPF_MAP_TYPE_HASH,
+	.size_key = sizeof(struct policy_key),
+	.size_value = sizeof(struct policy_rule),
+	.max_elem = 65536,
+	.pinning = PIN_GLOBAL_NS,
+};
+
+// cali_nat_fe maps from a port forward's external IP and port to the
+// workload's IP and port.
+struct bpf_elf_map SEC("maps") cali_nat_fe = {
+	.type = BPF_MAP_TYPE_HASH,
+	.size_key = sizeof(struct nat_addr),
+	.size_value = sizeof(struct nat_addr),
+	.max_elem = 16384,
+	.pinning = PIN_GLOBAL_NS,
+};
+
+// cali_nat_be is the reverse of cali_nat_fe; it is used to rewrite the
+// source of the workload's responses.
+struct bpf_elf_map SEC("maps") cali_nat_be = {
+	.type = BPF_MAP_TYPE_HASH,
+	.size_key = sizeof(struct nat_addr),
+	.size_value = sizeof(struct nat_addr),
+	.max_elem = 16384,
+	.pinning = PIN_GLOBAL_NS,
+};
+
+struct flow {
+	__be32 saddr;
+	__be32 daddr;
+	__u16 sport;
+	__u16 dport;
+	__u32 l4_off;
+	__u8 protocol;
+	__u8 has_ports;
+	__u8 is_syn;
+};
+
+// parse_flow extracts the IPv4 flow from the packet.  Returns -1 if the
+// packet isn't IPv4 or is truncated.
+static INLINE int parse_flow(struct __sk_buff *skb, struct flow *flow)
+{
+	struct iphdr iph;
+	struct tcphdr tcph;
+	struct udphdr udph;
+
+	if (skb->protocol != bpf_htons(ETH_P_IP)) {
+		return -1;
+	}
+	if (bpf_skb_load_bytes(skb, ETH_HLEN, &iph, sizeof(iph)) < 0) {
+		return -1;
+	}
+	flow->saddr = iph.saddr;
+	flow->daddr = iph.daddr;
+	flow->protocol = iph.protocol;
+	flow->l4_off = ETH_HLEN + iph.ihl * 4;
+	flow->sport = 0;
+	flow->dport = 0;
+	flow->has_ports = 0;
+	flow->is_syn = 0;
+
+	if (iph.frag_off & bpf_htons(IP_FRAG_OFFSET_MASK)) {
+		// Non-initial fragment, there's no L4 header.
+		return 0;
+	}
+	switch (iph.protocol) {
+	case IPPROTO_TCP:
+		if (bpf_skb_load_bytes(skb, flow->l4_off, &tcph, sizeof(tcph)) < 0) {
+			return -1;
+		}
+		flow->sport = bpf_ntohs(tcph.source);
+		flow->dport = bpf_ntohs(tcph.dest);
+		flow->has_ports = 1;
+		flow->is_syn = tcph.syn && !tcph.ack;
+		break;
+	case IPPROTO_UDP:
+	case IPPROTO_UDPLITE:
+	case IPPROTO_SCTP:
+		// UDP-Lite has the same header layout as UDP and SCTP's
+		// common header, which is longer, starts with the ports too.
+		if (bpf_skb_load_bytes(skb, flow->l4_off, &udph, sizeof(udph)) < 0) {
+			return -1;
+		}
+		flow->sport = bpf_ntohs(udph.source);
+		flow->dport = bpf_ntohs(udph.dest);
+		flow->has_ports = 1;
+		break;
+	}
+	return 0;
+}
+
+static INLINE int net_matches(__be32 addr, __be32 net, __u8 prefix_len)
+{
+	if (prefix_len == 0) {
+		return 1;
+	}
+	return ((bpf_ntohl(addr) ^ bpf_ntohl(net)) >> (32 - prefix_len)) == 0;
+}
+
+static INLINE int port_matches(struct flow *flow, __u16 port,
+			       __u16 min, __u16 max)
+{
+	if (max == 0) {
+		return 1;
+	}
+	return flow->has_ports && port >= min && port <= max;
+}
+
+static INLINE int rule_matches(struct policy_rule *rule, struct flow *flow)
+{
+	return (rule->protocol == 0 || rule->protocol == flow->protocol) &&
+	       net_matches(flow->saddr, rule->src_net, rule->src_prefix_len) &&
+	       net_matches(flow->daddr, rule->dst_net, rule->dst_prefix_len) &&
+	       port_matches(flow, flow->sport, rule->src_port_min, rule->src_port_max) &&
+	       port_matches(flow, flow->dport, rule->dst_port_min, rule->dst_port_max);
+}
+
+// apply_policy evaluates the interface's rules against a packet.
+//
+// The programs have no connection tracking, so they can't tell a response
+// from a new flow in general.  Hence, they only evaluate policy for TCP SYNs,
+// and only act on a "deny" verdict, dropping the connection attempt before
+// it reaches iptables.  All other packets, including those that policy
+// allows, are passed on to the iptables rules, which remain authoritative.
+// An interface with no rules in the map passes all traffic to iptables; this
+// is how Felix falls back for endpoints whose policy can't be compiled.
+static INLINE int apply_policy(struct __sk_buff *skb, __u8 direction)
+{
+	struct flow flow;
+	struct policy_key key = {
+		.ifindex = skb->ifindex,
+		.direction = direction,
+	};
+	struct policy_rule *rule;
+	int i;
+
+	if (parse_flow(skb, &flow) < 0 || !flow.is_syn) {
+		return TC_ACT_OK;
+	}
+
+#pragma unroll
+	for (i = 0; i < MAX_RULES; i++) {
+		key.index = i;
+		rule = bpf_map_lookup_elem(&cali_pol, &key);
+		if (!rule) {
+			return TC_ACT_OK;
+		}
+		if (rule_matches(rule, &flow)) {
+			return rule->action == ACTION_DENY ? TC_ACT_SHOT : TC_ACT_OK;
+		}
+	}
+	return TC_ACT_OK;
+}
+
+// nat_rewrite rewrites the source or destination address and port of a TCP or
+// UDP packet, updating the checksums.
+static INLINE int nat_rewrite(struct __sk_buff *skb, struct flow *flow,
+			      int rewrite_dst, struct nat_addr *to)
+{
+	__u32 addr_off, port_off, csum_off;
+	__u64 csum_flags = 0;
+	__be32 old_addr;
+	__be16 old_port;
+
+	if (rewrite_dst) {
+		addr_off = ETH_HLEN + offsetof(struct iphdr, daddr);
+		port_off = flow->l4_off + offsetof(struct tcphdr, dest);
+		old_addr = flow->daddr;
+		old_port = bpf_htons(flow->dport);
+	} else {
+		addr_off = ETH_HLEN + offsetof(struct iphdr, saddr);
+		port_off = flow->l4_off + offsetof(struct tcphdr, source);
+		old_addr = flow->saddr;
+		old_port = bpf_htons(flow->sport);
+	}
+	if (flow->protocol == IPPROTO_TCP) {
+		csum_off = flow->l4_off + offsetof(struct tcphdr, check);
+	} else {
+		// A UDP checksum of 0 means "no checksum"; leave it alone.
+		csum_off = flow->l4_off + offsetof(struct udphdr, check);
+		csum_flags = BPF_F_MARK_MANGLED_0;
+	}
+
+	if (bpf_l4_csum_replace(skb, csum_off, old_addr, to->addr,
+				csum_flags | BPF_F_PSEUDO_HDR | sizeof(to->addr)) < 0 ||
+	    bpf_l4_csum_replace(skb, csum_off, old_port, to->port,
+				csum_flags | sizeof(to->port)) < 0 ||
+	    bpf_l3_csum_replace(skb, ETH_HLEN + offsetof(struct iphdr, check),
+				old_addr, to->addr, sizeof(to->addr)) < 0 ||
+	    bpf_skb_store_bytes(skb, addr_off, &to->addr, sizeof(to->addr), 0) < 0 ||
+	    bpf_skb_store_bytes(skb, port_off, &to->port, sizeof(to->port), 0) < 0) {
+		return -1;
+	}
+	return 0;
+}
+
+// apply_nat looks up the packet's source or destination in the given NAT map
+// and, if there's a match, rewrites it.
+static INLINE int apply_nat(struct __sk_buff *skb, void *map, int use_dst)
+{
+	struct flow flow;
+	struct nat_addr key = {};
+	struct nat_addr *to;
+
+	if (parse_flow(skb, &flow) < 0 || !flow.has_ports) {
+		return TC_ACT_OK;
+	}
+	if (flow.protocol != IPPROTO_TCP && flow.protocol != IPPROTO_UDP) {
+		return TC_ACT_OK;
+	}
+	key.protocol = flow.protocol;
+	if (use_dst) {
+		key.addr = flow.daddr;
+		key.port = bpf_htons(flow.dport);
+	} else {
+		key.addr = flow.saddr;
+		key.port = bpf_htons(flow.sport);
+	}
+	to = bpf_map_lookup_elem(map, &key);
+	if (!to) {
+		return TC_ACT_OK;
+	}
+	if (nat_rewrite(skb, &flow, use_dst, to) < 0) {
+		return TC_ACT_SHOT;
+	}
+	return TC_ACT_OK;
+}
+
+// Attached to the ingress hook of a workload's interface: traffic from the
+// workload.
+SEC("calico_from_wep")
+int calico_from_wep(struct __sk_buff *skb)
+{
+	return apply_policy(skb, DIR_OUTBOUND);
+}
+
+// Attached to the egress hook of a workload's interface: traffic to the
+// workload.
+SEC("calico_to_wep")
+int calico_to_wep(struct __sk_buff *skb)
+{
+	return apply_policy(skb, DIR_INBOUND);
+}
+
+// Attached to the ingress hook of a host interface: DNATs port-forwarded
+// traffic to the workload before routing.
+SEC("calico_from_hep")
+int calico_from_hep(struct __sk_buff *skb)
+{
+	return apply_nat(skb, &cali_nat_fe, 1);
+}
+
+// Attached to the egress hook of a host interface: reverses the DNAT on the
+// workload's responses.  Since this runs after conntrack, conntrack sees the
+// untranslated flow in both directions.
+SEC("calico_to_hep")
+int calico_to_hep(struct __sk_buff *skb)
+{
+	return apply_nat(skb, &cali_nat_be, 0);
+}
+
+char _license[] SEC("license") = "GPL";
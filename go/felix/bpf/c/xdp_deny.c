@@ -0,0 +1,112 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// XDP program that drops IPv4 traffic from denied source CIDRs before it
+// reaches the network stack.  Build with
+//
+//     clang -O2 -Wall -target bpf -c xdp_deny.c -o xdp_deny.o
+//
+// The program is loaded with "ip link set dev <iface> xdp...", which creates
+// the maps and pins them under /sys/fs/bpf/xdp/globals.  The maps are shared
+// by all interfaces; the deny-list's keys include the interface index.  The
+// key layout must be kept in sync with bpf.XDPDenyKey.
+
+#include <linux/bpf.h>
+#include <linux/if_ether.h>
+#include <linux/in.h>
+#include <linux/ip.h>
+#include <linux/tcp.h>
+#include <stddef.h>
+
+#include "bpf_helpers.h"
+
+// deny_key is a key in the LPM trie.  The prefix length covers the ifindex
+// as well as the address, so it is 32 more than the CIDR's prefix length.
+struct deny_key {
+	__u32 prefixlen;
+	__u32 ifindex;
+	__be32 addr;
+};
+
+// cali_xdp_deny maps from interface and source CIDR to a count of the
+// packets that have been dropped.
+struct bpf_elf_map SEC("maps") cali_xdp_deny = {
+	.type = BPF_MAP_TYPE_LPM_TRIE,
+	.size_key = sizeof(struct deny_key),
+	.size_value = sizeof(__u64),
+	.max_elem = 65536,
+	.flags = BPF_F_NO_PREALLOC,
+	.pinning = PIN_GLOBAL_NS,
+};
+
+// cali_xdp_fsafe contains the failsafe TCP ports, in host byte order.
+// Traffic to these ports is never dropped, so that the host stays reachable
+// even if its policy denies the administrator's address.
+struct bpf_elf_map SEC("maps") cali_xdp_fsafe = {
+	.type = BPF_MAP_TYPE_HASH,
+	.size_key = sizeof(__u16),
+	.size_value = sizeof(__u8),
+	.max_elem = 256,
+	.pinning = PIN_GLOBAL_NS,
+};
+
+static INLINE int is_failsafe(struct iphdr *iph, void *data_end)
+{
+	struct tcphdr *tcph;
+	__u16 port;
+
+	if (iph->protocol != IPPROTO_TCP) {
+		return 0;
+	}
+	tcph = (void *)iph + iph->ihl * 4;
+	if ((void *)(tcph + 1) > data_end) {
+		return 0;
+	}
+	port = bpf_ntohs(tcph->dest);
+	return bpf_map_lookup_elem(&cali_xdp_fsafe, &port) != NULL;
+}
+
+SEC("calico_xdp_deny")
+int calico_xdp_deny(struct xdp_md *ctx)
+{
+	void *data = (void *)(long)ctx->data;
+	void *data_end = (void *)(long)ctx->data_end;
+	struct ethhdr *eth = data;
+	struct iphdr *iph;
+	struct deny_key key;
+	__u64 *drops;
+
+	if ((void *)(eth + 1) > data_end) {
+		return XDP_PASS;
+	}
+	if (eth->h_proto != bpf_htons(ETH_P_IP)) {
+		return XDP_PASS;
+	}
+	iph = (void *)(eth + 1);
+	if ((void *)(iph + 1) > data_end) {
+		return XDP_PASS;
+	}
+
+	key.prefixlen = 64;
+	key.ifindex = ctx->ingress_ifindex;
+	key.addr = iph->saddr;
+	drops = bpf_map_lookup_elem(&cali_xdp_deny, &key);
+	if (!drops || is_failsafe(iph, data_end)) {
+		return XDP_PASS;
+	}
+	__sync_fetch_and_add(drops, 1);
+	return XDP_DROP;
+}
+
+char _license[] SEC("license") = "GPL";
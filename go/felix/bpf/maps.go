@@ -0,0 +1,116 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"unsafe"
+)
+
+// Map is a BPF map with keys and values that are encoded as byte slices.
+type Map interface {
+	Update(key, value []byte) error
+	Delete(key []byte) error
+}
+
+// Maps holds the maps that are shared by the BPF programs.
+type Maps struct {
+	Policy      Map
+	NATFrontend Map
+	NATBackend  Map
+	XDPDeny     Map
+	XDPFailsafe Map
+}
+
+// nativeEndian is the byte order of the host, which the BPF programs use for
+// fields that aren't in network byte order.
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// PolicyKey identifies a rule in the policy map.  Must match struct
+// policy_key in the C code.
+type PolicyKey struct {
+	Ifindex   uint32
+	Direction Direction
+	Index     uint16
+}
+
+func (k PolicyKey) AsBytes() []byte {
+	b := make([]byte, 8)
+	nativeEndian.PutUint32(b[0:4], k.Ifindex)
+	nativeEndian.PutUint16(b[4:6], k.Index)
+	b[6] = uint8(k.Direction)
+	return b
+}
+
+// AsBytes encodes the rule as a policy map value.  Must match struct
+// policy_rule in the C code.
+func (r PolicyRule) AsBytes() []byte {
+	b := make([]byte, 20)
+	b[0] = uint8(r.Action)
+	b[1] = r.Protocol
+	b[2] = prefixLen(r.SrcNet)
+	b[3] = prefixLen(r.DstNet)
+	copy(b[4:8], netIP(r.SrcNet))
+	copy(b[8:12], netIP(r.DstNet))
+	nativeEndian.PutUint16(b[12:14], r.SrcPorts.Min)
+	nativeEndian.PutUint16(b[14:16], r.SrcPorts.Max)
+	nativeEndian.PutUint16(b[16:18], r.DstPorts.Min)
+	nativeEndian.PutUint16(b[18:20], r.DstPorts.Max)
+	return b
+}
+
+func prefixLen(n net.IPNet) uint8 {
+	if n.IP == nil {
+		return 0
+	}
+	ones, _ := n.Mask.Size()
+	return uint8(ones)
+}
+
+func netIP(n net.IPNet) net.IP {
+	if n.IP == nil {
+		return net.IPv4zero.To4()
+	}
+	return n.IP.To4().Mask(n.Mask)
+}
+
+// NATAddr is an IPv4 address, port and protocol, as used for the keys and
+// values of the NAT maps.  Must match struct nat_addr in the C code.
+type NATAddr struct {
+	IP       net.IP
+	Port     uint16
+	Protocol uint8
+}
+
+func (a NATAddr) String() string {
+	return fmt.Sprintf("%d:%v:%d", a.Protocol, a.IP, a.Port)
+}
+
+func (a NATAddr) AsBytes() []byte {
+	b := make([]byte, 8)
+	copy(b[0:4], a.IP.To4())
+	binary.BigEndian.PutUint16(b[4:6], a.Port)
+	b[6] = a.Protocol
+	return b
+}
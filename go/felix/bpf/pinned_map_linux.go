@@ -0,0 +1,115 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"unsafe"
+)
+
+// Commands for the bpf() syscall, from linux/bpf.h.
+const (
+	bpfMapUpdateElem = 2
+	bpfMapDeleteElem = 3
+	bpfObjGet        = 7
+)
+
+// PinnedMap accesses a BPF map that has been pinned to the BPF filesystem.
+// Since tc and ip create the maps when they first load the programs, the map
+// is opened lazily, on first use.
+type PinnedMap struct {
+	Path string
+	fd   int
+}
+
+func NewPinnedMap(path string) *PinnedMap {
+	return &PinnedMap{Path: path, fd: -1}
+}
+
+// NewPinnedMaps returns the maps that are pinned by our TC and XDP programs.
+func NewPinnedMaps() Maps {
+	return Maps{
+		Policy:      NewPinnedMap(PolicyMapPath),
+		NATFrontend: NewPinnedMap(NATFrontendMapPath),
+		NATBackend:  NewPinnedMap(NATBackendMapPath),
+		XDPDeny:     NewPinnedMap(XDPDenyMapPath),
+		XDPFailsafe: NewPinnedMap(XDPFailsafeMapPath),
+	}
+}
+
+func (m *PinnedMap) open() error {
+	if m.fd >= 0 {
+		return nil
+	}
+	path, err := unix.BytePtrFromString(m.Path)
+	if err != nil {
+		return err
+	}
+	attr := struct {
+		pathname uint64
+		bpfFD    uint32
+		flags    uint32
+	}{
+		pathname: uint64(uintptr(unsafe.Pointer(path))),
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, bpfObjGet,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return errno
+	}
+	log.WithField("path", m.Path).Info("Opened pinned BPF map")
+	m.fd = int(fd)
+	return nil
+}
+
+func (m *PinnedMap) Update(key, value []byte) error {
+	return m.elemCmd(bpfMapUpdateElem, key, value)
+}
+
+// Delete removes the given key from the map.  Deleting a key that isn't in
+// the map is a no-op.
+func (m *PinnedMap) Delete(key []byte) error {
+	err := m.elemCmd(bpfMapDeleteElem, key, nil)
+	if err == unix.ENOENT {
+		return nil
+	}
+	return err
+}
+
+func (m *PinnedMap) elemCmd(cmd uintptr, key, value []byte) error {
+	if err := m.open(); err != nil {
+		return err
+	}
+	attr := struct {
+		mapFD uint32
+		pad   uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{
+		mapFD: uint32(m.fd),
+		key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+	}
+	if value != nil {
+		attr.value = uint64(uintptr(unsafe.Pointer(&value[0])))
+	}
+	_, _, errno := unix.Syscall(unix.SYS_BPF, cmd,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/set"
+	"net"
+	"sort"
+)
+
+var ErrTooManyRules = errors.New("policy needs more rules than the BPF program supports")
+
+type Action uint8
+
+const (
+	ActionAllow Action = 1
+	ActionDeny  Action = 2
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionAllow:
+		return "allow"
+	case ActionDeny:
+		return "deny"
+	}
+	return fmt.Sprintf("Action(%d)", uint8(a))
+}
+
+// Direction is the direction of traffic, relative to the endpoint.
+type Direction uint8
+
+const (
+	DirInbound  Direction = 0
+	DirOutbound Direction = 1
+)
+
+var protocolNameToNumber = map[string]uint8{
+	"icmp":    1,
+	"tcp":     6,
+	"udp":     17,
+	"gre":     47,
+	"esp":     50,
+	"ah":      51,
+	"sctp":    132,
+	"udplite": 136,
+}
+
+// portProtocols holds the protocols whose ports the program parses.
+var portProtocols = map[uint8]bool{
+	protocolNameToNumber["tcp"]:     true,
+	protocolNameToNumber["udp"]:     true,
+	protocolNameToNumber["sctp"]:    true,
+	protocolNameToNumber["udplite"]: true,
+}
+
+// PortRange is an inclusive range of ports.  The zero value matches any port.
+type PortRange struct {
+	Min, Max uint16
+}
+
+// PolicyRule is a single rule in the format that the TC program evaluates.
+// Unlike a proto.Rule, it can only match a single CIDR and port range for
+// each of the source and destination.  The zero value of each field matches
+// anything.
+type PolicyRule struct {
+	Action   Action
+	Protocol uint8
+	SrcNet   net.IPNet
+	DstNet   net.IPNet
+	SrcPorts PortRange
+	DstPorts PortRange
+}
+
+func (r PolicyRule) String() string {
+	return fmt.Sprintf("%v proto=%d src=%s:%d-%d dst=%s:%d-%d", r.Action, r.Protocol,
+		netString(r.SrcNet), r.SrcPorts.Min, r.SrcPorts.Max,
+		netString(r.DstNet), r.DstPorts.Min, r.DstPorts.Max)
+}
+
+func netString(n net.IPNet) string {
+	if n.IP == nil {
+		return "any"
+	}
+	return n.String()
+}
+
+// IPSetLookup returns the members of the IP set with the given ID, or false
+// if the IP set is not known.
+type IPSetLookup func(id string) (set.Set, bool)
+
+// CompileRules compiles a list of rules, which are evaluated in order, into
+// the equivalent list of BPF policy rules.  A rule that matches several
+// CIDRs or port ranges is expanded into one PolicyRule for each combination;
+// IP sets are expanded into their members.  Rules that can't match any IPv4
+// traffic are dropped.
+//
+// Returns an error if any rule uses a feature that the BPF program doesn't
+// support, or if the result would be too long.  In that case, the endpoint's
+// policy can only be enforced by iptables.
+func CompileRules(rules []*proto.Rule, ipSets IPSetLookup) ([]PolicyRule, error) {
+	var compiled []PolicyRule
+	for _, rule := range rules {
+		bpfRules, err := compileRule(rule, ipSets, MaxRulesPerDirection-len(compiled))
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, bpfRules...)
+	}
+	return compiled, nil
+}
+
+func compileRule(rule *proto.Rule, ipSets IPSetLookup, maxRules int) ([]PolicyRule, error) {
+	logCxt := log.WithField("rule", rule)
+	if rule.IpVersion == proto.IPVersion_IPV6 {
+		logCxt.Debug("Skipping IPv6 rule")
+		return nil, nil
+	}
+	if rule.NotProtocol != nil ||
+		rule.NotSrcNet != "" || rule.NotDstNet != "" ||
+		len(rule.NotSrcPorts) > 0 || len(rule.NotDstPorts) > 0 ||
+		len(rule.NotSrcIpSetIds) > 0 || len(rule.NotDstIpSetIds) > 0 {
+		return nil, errors.New("negated matches are not supported")
+	}
+	if rule.Icmp != nil || rule.NotIcmp != nil {
+		return nil, errors.New("ICMP type matches are not supported")
+	}
+
+	var template PolicyRule
+	switch rule.Action {
+	case "", "allow":
+		template.Action = ActionAllow
+	case "deny":
+		template.Action = ActionDeny
+	default:
+		return nil, fmt.Errorf("action %q is not supported", rule.Action)
+	}
+
+	if rule.Protocol != nil {
+		switch p := rule.Protocol.NumberOrName.(type) {
+		case *proto.Protocol_Number:
+			if p.Number <= 0 || p.Number > 255 {
+				return nil, fmt.Errorf("invalid protocol number %d", p.Number)
+			}
+			template.Protocol = uint8(p.Number)
+		case *proto.Protocol_Name:
+			num, ok := protocolNameToNumber[p.Name]
+			if !ok {
+				return nil, fmt.Errorf("unknown protocol %q", p.Name)
+			}
+			template.Protocol = num
+		}
+	}
+	if (len(rule.SrcPorts) > 0 || len(rule.DstPorts) > 0) &&
+		!portProtocols[template.Protocol] {
+		// The program only parses the ports of these protocols.
+		return nil, errors.New(
+			"port matches are only supported for TCP, UDP, UDP-Lite and SCTP")
+	}
+
+	srcNets, ok := netsForMatch(rule.SrcNet, rule.SrcIpSetIds, ipSets)
+	if !ok {
+		logCxt.Debug("Skipping rule that can't match any IPv4 source")
+		return nil, nil
+	}
+	dstNets, ok := netsForMatch(rule.DstNet, rule.DstIpSetIds, ipSets)
+	if !ok {
+		logCxt.Debug("Skipping rule that can't match any IPv4 destination")
+		return nil, nil
+	}
+	srcPorts := portRanges(rule.SrcPorts)
+	dstPorts := portRanges(rule.DstPorts)
+
+	if len(srcNets)*len(dstNets)*len(srcPorts)*len(dstPorts) > maxRules {
+		return nil, ErrTooManyRules
+	}
+	var bpfRules []PolicyRule
+	for _, srcNet := range srcNets {
+		for _, dstNet := range dstNets {
+			for _, srcPortRange := range srcPorts {
+				for _, dstPortRange := range dstPorts {
+					bpfRule := template
+					bpfRule.SrcNet = srcNet
+					bpfRule.DstNet = dstNet
+					bpfRule.SrcPorts = srcPortRange
+					bpfRule.DstPorts = dstPortRange
+					bpfRules = append(bpfRules, bpfRule)
+				}
+			}
+		}
+	}
+	return bpfRules, nil
+}
+
+// netsForMatch calculates the list of CIDRs that are matched by a CIDR match
+// combined with a list of IP set matches.  Since the program has no IP sets,
+// the IP sets are expanded into their members, which are filtered to those
+// that are in all the IP sets and the CIDR.  A list containing only the zero
+// IPNet matches everything.  Returns false if no IPv4 address can match.
+func netsForMatch(cidr string, ipSetIDs []string, ipSets IPSetLookup) ([]net.IPNet, bool) {
+	var ipNet *net.IPNet
+	if cidr != "" {
+		var err error
+		_, ipNet, err = net.ParseCIDR(cidr)
+		if err != nil || ipNet.IP.To4() == nil {
+			return nil, false
+		}
+		ipNet = v4Net(ipNet)
+	}
+	if len(ipSetIDs) == 0 {
+		if ipNet == nil {
+			return []net.IPNet{{}}, true
+		}
+		return []net.IPNet{*ipNet}, true
+	}
+
+	members := make([]set.Set, len(ipSetIDs))
+	for i, id := range ipSetIDs {
+		var ok bool
+		members[i], ok = ipSets(id)
+		if !ok {
+			log.WithField("id", id).Warn("Rule references unknown IP set")
+			return nil, false
+		}
+	}
+	var memberStrs []string
+	members[0].Iter(func(item interface{}) error {
+		member := item.(string)
+		for _, otherMembers := range members[1:] {
+			if !otherMembers.Contains(member) {
+				return nil
+			}
+		}
+		memberStrs = append(memberStrs, member)
+		return nil
+	})
+	sort.Strings(memberStrs)
+
+	var nets []net.IPNet
+	for _, member := range memberStrs {
+		memberNet := parseMember(member)
+		if memberNet == nil {
+			continue
+		}
+		if ipNet != nil {
+			memberNet = intersectNets(ipNet, memberNet)
+			if memberNet == nil {
+				continue
+			}
+		}
+		nets = append(nets, *memberNet)
+	}
+	if len(nets) == 0 {
+		return nil, false
+	}
+	return nets, true
+}
+
+// parseMember parses an IP set member, which may be an IP or a CIDR.
+// Returns nil if it isn't IPv4.
+func parseMember(member string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(member)
+	if err != nil {
+		ip := net.ParseIP(member)
+		if ip == nil {
+			return nil
+		}
+		ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+	}
+	if ipNet.IP.To4() == nil {
+		return nil
+	}
+	return v4Net(ipNet)
+}
+
+func v4Net(ipNet *net.IPNet) *net.IPNet {
+	ones, _ := ipNet.Mask.Size()
+	return &net.IPNet{IP: ipNet.IP.To4(), Mask: net.CIDRMask(ones, 32)}
+}
+
+// intersectNets returns the smaller of the two CIDRs if one contains the
+// other; otherwise, the CIDRs are disjoint and it returns nil.
+func intersectNets(a, b *net.IPNet) *net.IPNet {
+	aOnes, _ := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	if aOnes <= bOnes && a.Contains(b.IP) {
+		return b
+	}
+	if bOnes <= aOnes && b.Contains(a.IP) {
+		return a
+	}
+	return nil
+}
+
+func portRanges(ranges []*proto.PortRange) []PortRange {
+	if len(ranges) == 0 {
+		return []PortRange{{}}
+	}
+	result := make([]PortRange, len(ranges))
+	for i, r := range ranges {
+		result[i] = PortRange{Min: uint16(r.First), Max: uint16(r.Last)}
+	}
+	return result
+}
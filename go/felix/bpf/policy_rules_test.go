@@ -0,0 +1,215 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/bpf"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/set"
+	"net"
+)
+
+func mustParseNet(cidr string) net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return net.IPNet{IP: ipNet.IP.To4(), Mask: ipNet.Mask}
+}
+
+func setOf(members ...string) set.Set {
+	s := set.New()
+	for _, m := range members {
+		s.Add(m)
+	}
+	return s
+}
+
+func tcp() *proto.Protocol {
+	return &proto.Protocol{NumberOrName: &proto.Protocol_Name{Name: "tcp"}}
+}
+
+var _ = Describe("CompileRules", func() {
+	var ipSets map[string]set.Set
+	lookup := func(id string) (set.Set, bool) {
+		s, ok := ipSets[id]
+		return s, ok
+	}
+	BeforeEach(func() {
+		ipSets = map[string]set.Set{
+			"set-a": setOf("10.0.0.1", "10.0.0.2", "10.1.0.0/16", "feed::1"),
+			"set-b": setOf("10.0.0.2", "10.0.0.3"),
+		}
+	})
+	compile := func(rules ...*proto.Rule) ([]PolicyRule, error) {
+		return CompileRules(rules, lookup)
+	}
+
+	It("should compile an empty rule to allow-all", func() {
+		Expect(compile(&proto.Rule{})).To(Equal([]PolicyRule{
+			{Action: ActionAllow},
+		}))
+	})
+	It("should compile a deny with protocol and CIDRs", func() {
+		Expect(compile(&proto.Rule{
+			Action:   "deny",
+			Protocol: &proto.Protocol{NumberOrName: &proto.Protocol_Number{Number: 17}},
+			SrcNet:   "10.0.0.0/8",
+			DstNet:   "192.168.1.1/24",
+		})).To(Equal([]PolicyRule{{
+			Action:   ActionDeny,
+			Protocol: 17,
+			SrcNet:   mustParseNet("10.0.0.0/8"),
+			DstNet:   mustParseNet("192.168.1.0/24"),
+		}}))
+	})
+	It("should expand multiple port ranges", func() {
+		rules, err := compile(&proto.Rule{
+			Protocol: tcp(),
+			SrcPorts: []*proto.PortRange{{First: 1000, Last: 2000}},
+			DstPorts: []*proto.PortRange{{First: 80, Last: 80}, {First: 443, Last: 443}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(Equal([]PolicyRule{
+			{
+				Action:   ActionAllow,
+				Protocol: 6,
+				SrcPorts: PortRange{1000, 2000},
+				DstPorts: PortRange{80, 80},
+			},
+			{
+				Action:   ActionAllow,
+				Protocol: 6,
+				SrcPorts: PortRange{1000, 2000},
+				DstPorts: PortRange{443, 443},
+			},
+		}))
+	})
+	DescribeTable("port matches on other protocols",
+		func(protocol *proto.Protocol, expectedNum uint8) {
+			Expect(compile(&proto.Rule{
+				Protocol: protocol,
+				DstPorts: []*proto.PortRange{{First: 2905, Last: 2905}},
+			})).To(Equal([]PolicyRule{{
+				Action:   ActionAllow,
+				Protocol: expectedNum,
+				DstPorts: PortRange{2905, 2905},
+			}}))
+		},
+		Entry("SCTP", &proto.Protocol{NumberOrName: &proto.Protocol_Name{Name: "sctp"}}, uint8(132)),
+		Entry("SCTP by number", &proto.Protocol{NumberOrName: &proto.Protocol_Number{Number: 132}}, uint8(132)),
+		Entry("UDP-Lite", &proto.Protocol{NumberOrName: &proto.Protocol_Name{Name: "udplite"}}, uint8(136)),
+	)
+	It("should expand an IP set, skipping IPv6 members", func() {
+		rules, err := compile(&proto.Rule{SrcIpSetIds: []string{"set-a"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(Equal([]PolicyRule{
+			{Action: ActionAllow, SrcNet: mustParseNet("10.0.0.1/32")},
+			{Action: ActionAllow, SrcNet: mustParseNet("10.0.0.2/32")},
+			{Action: ActionAllow, SrcNet: mustParseNet("10.1.0.0/16")},
+		}))
+	})
+	It("should intersect IP sets with each other", func() {
+		Expect(compile(&proto.Rule{
+			DstIpSetIds: []string{"set-a", "set-b"},
+		})).To(Equal([]PolicyRule{
+			{Action: ActionAllow, DstNet: mustParseNet("10.0.0.2/32")},
+		}))
+	})
+	It("should intersect IP sets with the CIDR", func() {
+		Expect(compile(&proto.Rule{
+			SrcNet:      "10.1.2.0/24",
+			SrcIpSetIds: []string{"set-a"},
+		})).To(Equal([]PolicyRule{
+			{Action: ActionAllow, SrcNet: mustParseNet("10.1.2.0/24")},
+		}))
+	})
+	It("should drop rules that can't match IPv4", func() {
+		Expect(compile(
+			&proto.Rule{IpVersion: proto.IPVersion_IPV6},
+			&proto.Rule{SrcNet: "feed::/64"},
+			&proto.Rule{SrcNet: "11.0.0.0/8", SrcIpSetIds: []string{"set-b"}},
+			&proto.Rule{DstIpSetIds: []string{"unknown"}},
+			&proto.Rule{Action: "deny"},
+		)).To(Equal([]PolicyRule{
+			{Action: ActionDeny},
+		}))
+	})
+	It("should give up when there are too many rules", func() {
+		rule := &proto.Rule{
+			Protocol: tcp(),
+			DstPorts: []*proto.PortRange{{First: 80, Last: 80}, {First: 443, Last: 443}},
+		}
+		var rules []*proto.Rule
+		for i := 0; i < MaxRulesPerDirection/2; i++ {
+			rules = append(rules, rule)
+		}
+		_, err := compile(rules...)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = compile(append(rules, &proto.Rule{})...)
+		Expect(err).To(Equal(ErrTooManyRules))
+	})
+	DescribeTable("unsupported rules",
+		func(rule *proto.Rule) {
+			_, err := compile(&proto.Rule{}, rule)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("next-tier", &proto.Rule{Action: "next-tier"}),
+		Entry("log", &proto.Rule{Action: "log"}),
+		Entry("negated protocol", &proto.Rule{NotProtocol: tcp()}),
+		Entry("negated net", &proto.Rule{NotSrcNet: "10.0.0.0/8"}),
+		Entry("negated ports", &proto.Rule{Protocol: tcp(),
+			NotDstPorts: []*proto.PortRange{{First: 80, Last: 80}}}),
+		Entry("negated IP set", &proto.Rule{NotDstIpSetIds: []string{"set-a"}}),
+		Entry("ICMP type", &proto.Rule{Icmp: &proto.Rule_IcmpType{IcmpType: 8}}),
+		Entry("unknown protocol", &proto.Rule{
+			Protocol: &proto.Protocol{NumberOrName: &proto.Protocol_Name{Name: "foo"}}}),
+		Entry("ports without protocol", &proto.Rule{
+			DstPorts: []*proto.PortRange{{First: 80, Last: 80}}}),
+		Entry("ICMP ports", &proto.Rule{
+			Protocol: &proto.Protocol{NumberOrName: &proto.Protocol_Name{Name: "icmp"}},
+			DstPorts: []*proto.PortRange{{First: 80, Last: 80}}}),
+	)
+})
+
+var _ = Describe("map encoding", func() {
+	It("should encode a policy key", func() {
+		key := PolicyKey{Ifindex: 0x01020304, Direction: DirOutbound, Index: 0x0506}
+		Expect(key.AsBytes()).To(Equal([]byte{4, 3, 2, 1, 6, 5, 1, 0}))
+	})
+	It("should encode a policy rule", func() {
+		rule := PolicyRule{
+			Action:   ActionDeny,
+			Protocol: 6,
+			SrcNet:   mustParseNet("10.0.1.0/24"),
+			DstPorts: PortRange{80, 0x0102},
+		}
+		Expect(rule.AsBytes()).To(Equal([]byte{
+			2, 6, 24, 0,
+			10, 0, 1, 0,
+			0, 0, 0, 0,
+			0, 0, 0, 0,
+			80, 0, 2, 1,
+		}))
+	})
+	It("should encode a NAT address in network order", func() {
+		addr := NATAddr{IP: net.ParseIP("10.0.0.1"), Port: 8080, Protocol: 17}
+		Expect(addr.AsBytes()).To(Equal([]byte{10, 0, 0, 1, 0x1f, 0x90, 17, 0}))
+	})
+})
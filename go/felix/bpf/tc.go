@@ -0,0 +1,112 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"net"
+	"strings"
+)
+
+// TC attaches our programs to interfaces using the tc binary.  The programs
+// are attached in direct-action mode to the ingress and egress hooks of a
+// clsact qdisc, which we add to the interface.
+type TC struct {
+	objFile string
+	newCmd  cmdshim.NewCmd
+}
+
+func NewTC(objFile string) *TC {
+	return NewTCWithCmdShim(objFile, cmdshim.NewRealCmd)
+}
+
+// NewTCWithCmdShim is a test constructor that allows for shimming exec.Command.
+func NewTCWithCmdShim(objFile string, shim cmdshim.NewCmd) *TC {
+	return &TC{
+		objFile: objFile,
+		newCmd:  shim,
+	}
+}
+
+// AttachWorkloadPrograms attaches the policy programs to a workload
+// interface.
+func (t *TC) AttachWorkloadPrograms(iface string) error {
+	return t.attach(iface, SectionFromWorkload, SectionToWorkload)
+}
+
+// AttachHostPrograms attaches the NAT programs to a host interface.
+func (t *TC) AttachHostPrograms(iface string) error {
+	return t.attach(iface, SectionFromHost, SectionToHost)
+}
+
+func (t *TC) attach(iface, ingressSection, egressSection string) error {
+	log.WithFields(log.Fields{
+		"iface":   iface,
+		"ingress": ingressSection,
+		"egress":  egressSection,
+	}).Info("Attaching BPF programs")
+	// "replace" makes each of these commands idempotent.
+	if err := t.run("qdisc", "replace", "dev", iface, "clsact"); err != nil {
+		return err
+	}
+	for _, hook := range []struct{ name, section string }{
+		{"ingress", ingressSection},
+		{"egress", egressSection},
+	} {
+		err := t.run("filter", "replace", "dev", iface, hook.name,
+			"pref", "1", "handle", "1",
+			"bpf", "direct-action", "obj", t.objFile, "sec", hook.section)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemovePrograms removes our programs from the interface, by removing the
+// clsact qdisc.  It is not an error if the interface no longer exists or
+// has no programs attached.
+func (t *TC) RemovePrograms(iface string) error {
+	log.WithField("iface", iface).Info("Removing BPF programs")
+	err := t.run("qdisc", "del", "dev", iface, "clsact")
+	if err != nil && (strings.Contains(err.Error(), "Cannot find device") ||
+		strings.Contains(err.Error(), "No such file or directory") ||
+		strings.Contains(err.Error(), "Invalid handle")) {
+		log.WithField("iface", iface).Debug("No BPF programs to remove")
+		return nil
+	}
+	return err
+}
+
+// InterfaceIndex returns the index of the interface, which is used to key
+// the interface's rules in the policy map.
+func (t *TC) InterfaceIndex(iface string) (int, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return 0, err
+	}
+	return netIface.Index, nil
+}
+
+func (t *TC) run(args ...string) error {
+	output, err := t.newCmd("tc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tc %s failed: %v: %s",
+			strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
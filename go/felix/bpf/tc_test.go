@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/bpf"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+)
+
+var _ = Describe("TC", func() {
+	var tc *TC
+	var cmdRec *cmdshim.Recorder
+	BeforeEach(func() {
+		cmdRec = &cmdshim.Recorder{}
+		tc = NewTCWithCmdShim("/tmp/prog.o", cmdRec.NewCmd)
+	})
+
+	It("should attach the workload programs", func() {
+		Expect(tc.AttachWorkloadPrograms("cali1234")).To(Succeed())
+		Expect(cmdRec.Commands()).To(Equal([]string{
+			"tc qdisc replace dev cali1234 clsact",
+			"tc filter replace dev cali1234 ingress pref 1 handle 1 bpf direct-action obj /tmp/prog.o sec calico_from_wep",
+			"tc filter replace dev cali1234 egress pref 1 handle 1 bpf direct-action obj /tmp/prog.o sec calico_to_wep",
+		}))
+	})
+	It("should attach the host programs", func() {
+		Expect(tc.AttachHostPrograms("eth0")).To(Succeed())
+		Expect(cmdRec.Commands()).To(ContainElement(
+			"tc filter replace dev eth0 ingress pref 1 handle 1 bpf direct-action obj /tmp/prog.o sec calico_from_hep"))
+		Expect(cmdRec.Commands()).To(ContainElement(
+			"tc filter replace dev eth0 egress pref 1 handle 1 bpf direct-action obj /tmp/prog.o sec calico_to_hep"))
+	})
+	It("should stop and report the output on failure", func() {
+		cmdRec.NumFailures = 1
+		cmdRec.Output = "RTNETLINK answers: Operation not permitted\n"
+		err := tc.AttachWorkloadPrograms("cali1234")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Operation not permitted"))
+		Expect(cmdRec.Commands()).To(HaveLen(1))
+	})
+	It("should remove the programs", func() {
+		Expect(tc.RemovePrograms("cali1234")).To(Succeed())
+		Expect(cmdRec.Commands()).To(Equal([]string{"tc qdisc del dev cali1234 clsact"}))
+	})
+	It("should ignore a missing device on removal", func() {
+		cmdRec.NumFailures = 1
+		cmdRec.Output = "Cannot find device \"cali1234\"\n"
+		Expect(tc.RemovePrograms("cali1234")).To(Succeed())
+	})
+	It("should report other failures on removal", func() {
+		cmdRec.NumFailures = 1
+		cmdRec.Output = "RTNETLINK answers: Operation not permitted\n"
+		Expect(tc.RemovePrograms("cali1234")).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,182 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"net"
+	"strings"
+)
+
+var ErrXDPNotSupported = errors.New("XDP is not supported by the interface or kernel")
+
+// XDPMode is the mode that an XDP program is attached in; it is the
+// corresponding "ip link" option.
+type XDPMode string
+
+const (
+	// XDPModeDriver runs the program in the NIC driver, before the kernel
+	// allocates an skb.  It requires driver support.
+	XDPModeDriver XDPMode = "xdpdrv"
+	// XDPModeGeneric runs the program in the kernel's receive path; it
+	// works with any NIC but is slower.
+	XDPModeGeneric XDPMode = "xdpgeneric"
+)
+
+// xdpModes lists the modes that we try, in order of preference.
+var xdpModes = []XDPMode{XDPModeDriver, XDPModeGeneric}
+
+// XDP attaches the deny-list program to interfaces using the ip binary.
+type XDP struct {
+	objFile string
+	newCmd  cmdshim.NewCmd
+}
+
+func NewXDP(objFile string) *XDP {
+	return NewXDPWithCmdShim(objFile, cmdshim.NewRealCmd)
+}
+
+// NewXDPWithCmdShim is a test constructor that allows for shimming exec.Command.
+func NewXDPWithCmdShim(objFile string, shim cmdshim.NewCmd) *XDP {
+	return &XDP{
+		objFile: objFile,
+		newCmd:  shim,
+	}
+}
+
+// AttachDenyProgram attaches the deny-list program to the interface, in the
+// best mode that the NIC and kernel support.  Returns ErrXDPNotSupported if
+// the program can't be attached in any mode.
+func (x *XDP) AttachDenyProgram(iface string) (XDPMode, error) {
+	logCxt := log.WithField("iface", iface)
+	for _, mode := range xdpModes {
+		err := x.run("link", "set", "dev", iface, string(mode),
+			"obj", x.objFile, "sec", SectionXDPDeny)
+		if err == nil {
+			logCxt.WithField("mode", mode).Info("Attached XDP program")
+			return mode, nil
+		}
+		logCxt.WithError(err).WithField("mode", mode).Info(
+			"Failed to attach XDP program in this mode")
+	}
+	return "", ErrXDPNotSupported
+}
+
+// RemoveDenyProgram removes the deny-list program from the interface, in
+// whichever mode it was attached.
+func (x *XDP) RemoveDenyProgram(iface string) error {
+	log.WithField("iface", iface).Info("Removing XDP program")
+	var lastErr error
+	for _, mode := range xdpModes {
+		err := x.run("link", "set", "dev", iface, string(mode), "off")
+		if err != nil && !strings.Contains(err.Error(), "Cannot find device") {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (x *XDP) run(args ...string) error {
+	output, err := x.newCmd("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s failed: %v: %s",
+			strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// XDPDenyKey is a key in the XDP deny-list map.  Must match struct deny_key
+// in the C code.
+type XDPDenyKey struct {
+	Ifindex uint32
+	Net     net.IPNet
+}
+
+func (k XDPDenyKey) AsBytes() []byte {
+	b := make([]byte, 12)
+	// The LPM trie's prefix covers the ifindex too.
+	nativeEndian.PutUint32(b[0:4], 32+uint32(prefixLen(k.Net)))
+	nativeEndian.PutUint32(b[4:8], k.Ifindex)
+	copy(b[8:12], netIP(k.Net))
+	return b
+}
+
+// XDPDenyValue is the initial value of a deny-list entry: the count of
+// dropped packets.
+func XDPDenyValue() []byte {
+	return make([]byte, 8)
+}
+
+// XDPFailsafeKey is the key in the XDP failsafe map for the given TCP port.
+func XDPFailsafeKey(port uint16) []byte {
+	b := make([]byte, 2)
+	nativeEndian.PutUint16(b, port)
+	return b
+}
+
+// XDPFailsafeValue is the value for all entries in the XDP failsafe map.
+func XDPFailsafeValue() []byte {
+	return []byte{1}
+}
+
+// CompileXDPDenyList calculates the source CIDRs whose inbound traffic can be
+// dropped by the XDP program, given the untracked rules that apply to a host
+// endpoint.
+//
+// Since the program runs before any other policy, it can only implement the
+// leading run of deny rules, which would be evaluated before any other rule,
+// and then only if they match on source CIDR or source IP set alone.  The
+// remaining rules are left to iptables.  Returns nil if no rules can be
+// implemented.
+func CompileXDPDenyList(rules []*proto.Rule, ipSets IPSetLookup) []net.IPNet {
+	var nets []net.IPNet
+	for _, rule := range rules {
+		if rule.IpVersion == proto.IPVersion_IPV6 {
+			// Can't match the IPv4 traffic that the program sees so it
+			// can be skipped.
+			continue
+		}
+		if rule.Action != "deny" || !isSourceOnlyRule(rule) {
+			break
+		}
+		ruleNets, ok := netsForMatch(rule.SrcNet, rule.SrcIpSetIds, ipSets)
+		if !ok {
+			continue
+		}
+		if ruleNets[0].IP == nil {
+			// Denies all traffic, which isn't what an XDP deny-list is
+			// for; leave it to iptables.
+			break
+		}
+		nets = append(nets, ruleNets...)
+	}
+	return nets
+}
+
+// isSourceOnlyRule returns true if the rule only matches on source CIDR and
+// source IP sets.
+func isSourceOnlyRule(rule *proto.Rule) bool {
+	return rule.Protocol == nil && rule.NotProtocol == nil &&
+		len(rule.SrcPorts) == 0 && len(rule.NotSrcPorts) == 0 &&
+		rule.DstNet == "" && rule.NotDstNet == "" &&
+		len(rule.DstPorts) == 0 && len(rule.NotDstPorts) == 0 &&
+		len(rule.DstIpSetIds) == 0 && len(rule.NotDstIpSetIds) == 0 &&
+		rule.NotSrcNet == "" && len(rule.NotSrcIpSetIds) == 0 &&
+		rule.Icmp == nil && rule.NotIcmp == nil
+}
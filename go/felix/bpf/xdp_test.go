@@ -0,0 +1,120 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/bpf"
+
+	"encoding/binary"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/set"
+	"net"
+)
+
+var _ = Describe("XDP", func() {
+	var xdp *XDP
+	var cmdRec *cmdshim.Recorder
+	BeforeEach(func() {
+		cmdRec = &cmdshim.Recorder{}
+		xdp = NewXDPWithCmdShim("/tmp/xdp.o", cmdRec.NewCmd)
+	})
+
+	It("should attach the program in driver mode if possible", func() {
+		Expect(xdp.AttachDenyProgram("eth0")).To(Equal(XDPModeDriver))
+		Expect(cmdRec.Commands()).To(Equal([]string{
+			"ip link set dev eth0 xdpdrv obj /tmp/xdp.o sec calico_xdp_deny",
+		}))
+	})
+	It("should fall back to generic mode", func() {
+		cmdRec.NumFailures = 1
+		cmdRec.Output = "Error: Underlying driver does not support XDP in native mode.\n"
+		Expect(xdp.AttachDenyProgram("eth0")).To(Equal(XDPModeGeneric))
+		Expect(cmdRec.Commands()).To(Equal([]string{
+			"ip link set dev eth0 xdpdrv obj /tmp/xdp.o sec calico_xdp_deny",
+			"ip link set dev eth0 xdpgeneric obj /tmp/xdp.o sec calico_xdp_deny",
+		}))
+	})
+	It("should report lack of support if no mode works", func() {
+		cmdRec.NumFailures = 2
+		cmdRec.Output = "Error: unknown option \"xdpgeneric\".\n"
+		_, err := xdp.AttachDenyProgram("eth0")
+		Expect(err).To(Equal(ErrXDPNotSupported))
+	})
+	It("should remove the program in both modes", func() {
+		Expect(xdp.RemoveDenyProgram("eth0")).To(Succeed())
+		Expect(cmdRec.Commands()).To(Equal([]string{
+			"ip link set dev eth0 xdpdrv off",
+			"ip link set dev eth0 xdpgeneric off",
+		}))
+	})
+	It("should ignore a missing device on removal", func() {
+		cmdRec.NumFailures = 2
+		cmdRec.Output = "Cannot find device \"eth0\"\n"
+		Expect(xdp.RemoveDenyProgram("eth0")).To(Succeed())
+	})
+})
+
+var _ = Describe("XDP deny-list key", func() {
+	It("should encode the prefix length, ifindex and address", func() {
+		b := XDPDenyKey{Ifindex: 2, Net: mustParseNet("10.1.0.0/16")}.AsBytes()
+		Expect(b).To(HaveLen(12))
+		Expect(binary.LittleEndian.Uint32(b[0:4])).To(BeNumerically("==", 48))
+		Expect(binary.LittleEndian.Uint32(b[4:8])).To(BeNumerically("==", 2))
+		Expect(b[8:12]).To(Equal([]byte{10, 1, 0, 0}))
+	})
+})
+
+var _ = Describe("CompileXDPDenyList", func() {
+	ipSets := func(id string) (set.Set, bool) {
+		if id == "set-a" {
+			return setOf("10.0.0.1", "10.2.0.0/16"), true
+		}
+		return nil, false
+	}
+
+	It("should compile leading source denies", func() {
+		Expect(CompileXDPDenyList([]*proto.Rule{
+			{Action: "deny", SrcNet: "192.168.0.0/16"},
+			{Action: "deny", SrcIpSetIds: []string{"set-a"}},
+			{Action: "allow"},
+			{Action: "deny", SrcNet: "172.16.0.0/12"},
+		}, ipSets)).To(Equal([]net.IPNet{
+			mustParseNet("192.168.0.0/16"),
+			mustParseNet("10.0.0.1/32"),
+			mustParseNet("10.2.0.0/16"),
+		}))
+	})
+	It("should stop at a rule that matches on more than the source", func() {
+		Expect(CompileXDPDenyList([]*proto.Rule{
+			{Action: "deny", SrcNet: "192.168.0.0/16"},
+			{Action: "deny", SrcNet: "172.16.0.0/12", DstPorts: []*proto.PortRange{{First: 22, Last: 22}}},
+			{Action: "deny", SrcNet: "10.0.0.0/8"},
+		}, ipSets)).To(Equal([]net.IPNet{mustParseNet("192.168.0.0/16")}))
+	})
+	It("should skip IPv6 rules", func() {
+		Expect(CompileXDPDenyList([]*proto.Rule{
+			{Action: "deny", IpVersion: proto.IPVersion_IPV6, SrcNet: "feed::/64"},
+			{Action: "deny", SrcNet: "192.168.0.0/16"},
+		}, ipSets)).To(Equal([]net.IPNet{mustParseNet("192.168.0.0/16")}))
+	})
+	It("should leave a deny-all to iptables", func() {
+		Expect(CompileXDPDenyList([]*proto.Rule{
+			{Action: "deny"},
+		}, ipSets)).To(BeNil())
+	})
+})
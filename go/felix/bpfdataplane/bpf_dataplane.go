@@ -0,0 +1,791 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The bpfdataplane package implements the experimental BPF dataplane mode.
+//
+// The BPF dataplane wraps the iptables dataplane driver: every update is
+// passed through to the iptables driver, which remains responsible for the
+// complete policy, and, in addition, the BPF dataplane attaches TC programs
+// to workload and host interfaces.  The programs drop connection attempts
+// that policy denies before they reach iptables and handle port forwarding
+// NAT using BPF maps.
+//
+// Endpoints with policy that uses features that the programs don't support
+// get no BPF rules, so their traffic falls back to iptables alone.
+//
+// Optionally, the BPF dataplane also attaches an XDP program to host
+// endpoint interfaces that have untracked deny rules for source CIDRs, so
+// that floods from those sources are dropped before they reach the network
+// stack.  If the NIC or kernel doesn't support XDP, those rules are enforced
+// by iptables alone.
+package bpfdataplane
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/backoff"
+	"github.com/projectcalico/felix/go/felix/bpf"
+	"github.com/projectcalico/felix/go/felix/health"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"github.com/projectcalico/felix/go/felix/set"
+	"net"
+	"time"
+)
+
+// driver is the interface of the wrapped dataplane driver; it matches
+// dataplane.DataplaneDriver.
+type driver interface {
+	SendMessage(msg interface{}) error
+	RecvMessage() (msg interface{}, err error)
+}
+
+// TCAPI is the interface to the kernel that is used to manage the TC
+// programs.  It is implemented by bpf.TC.
+type TCAPI interface {
+	AttachWorkloadPrograms(iface string) error
+	AttachHostPrograms(iface string) error
+	RemovePrograms(iface string) error
+	InterfaceIndex(iface string) (int, error)
+}
+
+// XDPAPI is the interface to the kernel that is used to manage the XDP
+// programs.  It is implemented by bpf.XDP.
+type XDPAPI interface {
+	AttachDenyProgram(iface string) (bpf.XDPMode, error)
+	RemoveDenyProgram(iface string) error
+}
+
+const (
+	// backoffName identifies the BPF dataplane's backoff manager in the
+	// log and health reports.
+	backoffName = "bpf_dataplane"
+
+	// wildcardIfaceName is the host endpoint name that covers all host
+	// interfaces.
+	wildcardIfaceName = "*"
+
+	// portForwardsKey is the key of the NAT map updates in the backoff
+	// manager.
+	portForwardsKey = "port_forwards"
+)
+
+type Config struct {
+	// RetryInterval is the interval at which we check for failed updates
+	// to retry.  Each update is only retried once its backoff has expired.
+	RetryInterval time.Duration
+	// Backoff controls the backoff of failed updates.  The initial delay
+	// defaults to RetryInterval.
+	Backoff backoff.Config
+	// HealthAggregator, if non-nil, receives the health of the updates.
+	HealthAggregator *health.HealthAggregator
+
+	// TCEnabled enables the TC policy and NAT programs.
+	TCEnabled bool
+	// XDPEnabled enables the XDP deny-list program for host endpoints.
+	XDPEnabled bool
+	// FailsafeInboundHostPorts are the TCP ports that the XDP program
+	// never blocks.
+	FailsafeInboundHostPorts []uint16
+}
+
+// ifaceState records what we've programmed for an interface.
+type ifaceState struct {
+	ifindex  int
+	numRules map[bpf.Direction]int
+}
+
+// xdpState records what we've programmed for an interface's XDP deny-list.
+type xdpState struct {
+	ifindex int
+	mode    bpf.XDPMode
+	// nets maps from the string form of each CIDR to the CIDR.
+	nets map[string]net.IPNet
+}
+
+// natMapping is a port forward in the form that is stored in the NAT maps.
+type natMapping struct {
+	frontend, backend bpf.NATAddr
+}
+
+// portForwardsUpdate is queued, like the updates from Felix, to pass the
+// new port forwards to the dataplane goroutine.
+type portForwardsUpdate struct {
+	forwards []rules.PortForward
+}
+
+type BPFDataplane struct {
+	inner   driver
+	updates chan interface{}
+
+	config Config
+	tc     TCAPI
+	xdp    XDPAPI
+	maps   bpf.Maps
+
+	workloadEndpoints map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint
+	hostEndpoints     map[proto.HostEndpointID]*proto.HostEndpoint
+	policies          map[proto.PolicyID]*proto.Policy
+	profiles          map[proto.ProfileID]*proto.Profile
+	ipSets            map[string]set.Set
+
+	// dirtyEndpoints contains the IDs of workload and host endpoints that
+	// need to be reprogrammed, including those that have been removed.
+	dirtyEndpoints set.Set
+	// endpointIfaces maps from endpoint ID to the interface that we
+	// attached programs to for the endpoint.
+	endpointIfaces map[interface{}]string
+	ifaces         map[string]*ifaceState
+
+	// xdpEndpointIfaces maps from host endpoint ID to the interface that
+	// we attached the XDP program to for the endpoint.
+	xdpEndpointIfaces map[proto.HostEndpointID]string
+	xdpIfaces         map[string]*xdpState
+	// xdpUnsupportedIfaces contains the names of interfaces that we failed
+	// to attach the XDP program to in any mode.
+	xdpUnsupportedIfaces set.Set
+	xdpFailsafesDone     bool
+
+	// portForwards and programmedForwards map from the string form of the
+	// frontend address to the NAT mapping.
+	portForwards        map[string]natMapping
+	programmedForwards  map[string]natMapping
+	portForwardsChanged bool
+
+	datastoreInSync bool
+
+	backoffs *backoff.Manager
+}
+
+func NewBPFDataplaneDriver(inner driver, tc TCAPI, xdp XDPAPI, maps bpf.Maps, config Config) *BPFDataplane {
+	backoffConfig := config.Backoff
+	if backoffConfig.InitialDelay == 0 {
+		backoffConfig.InitialDelay = config.RetryInterval
+	}
+	return &BPFDataplane{
+		inner:                inner,
+		updates:              make(chan interface{}, 100),
+		config:               config,
+		tc:                   tc,
+		xdp:                  xdp,
+		maps:                 maps,
+		workloadEndpoints:    map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint{},
+		hostEndpoints:        map[proto.HostEndpointID]*proto.HostEndpoint{},
+		policies:             map[proto.PolicyID]*proto.Policy{},
+		profiles:             map[proto.ProfileID]*proto.Profile{},
+		ipSets:               map[string]set.Set{},
+		dirtyEndpoints:       set.New(),
+		endpointIfaces:       map[interface{}]string{},
+		ifaces:               map[string]*ifaceState{},
+		xdpEndpointIfaces:    map[proto.HostEndpointID]string{},
+		xdpIfaces:            map[string]*xdpState{},
+		xdpUnsupportedIfaces: set.New(),
+		portForwards:         map[string]natMapping{},
+		programmedForwards:   map[string]natMapping{},
+		backoffs:             backoff.NewManager(backoffName, backoffConfig, config.HealthAggregator),
+	}
+}
+
+func (d *BPFDataplane) Start() {
+	go d.loop()
+}
+
+// SendMessage passes the update to the wrapped driver and queues it for the
+// BPF dataplane.
+func (d *BPFDataplane) SendMessage(msg interface{}) error {
+	if err := d.inner.SendMessage(msg); err != nil {
+		return err
+	}
+	d.updates <- msg
+	return nil
+}
+
+// RecvMessage returns the wrapped driver's status reports.
+func (d *BPFDataplane) RecvMessage() (interface{}, error) {
+	return d.inner.RecvMessage()
+}
+
+// SetPortForwards replaces the set of port forwards that are handled by the
+// NAT programs.  Invalid port forwards are skipped.
+func (d *BPFDataplane) SetPortForwards(forwards []rules.PortForward) {
+	d.updates <- portForwardsUpdate{forwards: forwards}
+}
+
+func (d *BPFDataplane) loop() {
+	log.Info("BPF dataplane running")
+	retryTicker := time.NewTicker(d.config.RetryInterval)
+	for {
+		select {
+		case msg := <-d.updates:
+			d.onUpdate(msg)
+			// Process any other pending updates before we apply, so that
+			// we batch up changes.
+		batchLoop:
+			for {
+				select {
+				case msg := <-d.updates:
+					d.onUpdate(msg)
+				default:
+					break batchLoop
+				}
+			}
+			if d.datastoreInSync {
+				d.apply()
+			}
+		case <-retryTicker.C:
+			if d.datastoreInSync && (d.dirtyEndpoints.Len() > 0 || d.portForwardsChanged) {
+				log.Info("Retrying failed BPF dataplane updates")
+				d.apply()
+			}
+		}
+	}
+}
+
+func (d *BPFDataplane) onUpdate(msg interface{}) {
+	log.WithField("msg", msg).Debug("BPF dataplane update")
+	switch msg := msg.(type) {
+	case *proto.InSync:
+		log.Info("Datastore in sync, applying BPF dataplane updates")
+		d.datastoreInSync = true
+	case *proto.IPSetUpdate:
+		members := set.New()
+		for _, m := range msg.Members {
+			members.Add(m)
+		}
+		d.ipSets[msg.Id] = members
+		d.markEndpointsDirty(func(rule *proto.Rule) bool { return ruleUsesIPSet(rule, msg.Id) })
+	case *proto.IPSetDeltaUpdate:
+		members := d.ipSets[msg.Id]
+		if members == nil {
+			log.WithField("id", msg.Id).Panic("Delta update for unknown IP set")
+		}
+		for _, m := range msg.AddedMembers {
+			members.Add(m)
+		}
+		for _, m := range msg.RemovedMembers {
+			members.Discard(m)
+		}
+		d.markEndpointsDirty(func(rule *proto.Rule) bool { return ruleUsesIPSet(rule, msg.Id) })
+	case *proto.IPSetRemove:
+		delete(d.ipSets, msg.Id)
+	case *proto.ActivePolicyUpdate:
+		d.policies[*msg.Id] = msg.Policy
+		d.markPolicyUsersDirty(*msg.Id)
+	case *proto.ActivePolicyRemove:
+		delete(d.policies, *msg.Id)
+		d.markPolicyUsersDirty(*msg.Id)
+	case *proto.ActiveProfileUpdate:
+		d.profiles[*msg.Id] = msg.Profile
+		d.markProfileUsersDirty(*msg.Id)
+	case *proto.ActiveProfileRemove:
+		delete(d.profiles, *msg.Id)
+		d.markProfileUsersDirty(*msg.Id)
+	case *proto.WorkloadEndpointUpdate:
+		d.workloadEndpoints[*msg.Id] = msg.Endpoint
+		d.markEndpointDirty(*msg.Id)
+	case *proto.WorkloadEndpointRemove:
+		delete(d.workloadEndpoints, *msg.Id)
+		d.markEndpointDirty(*msg.Id)
+	case *proto.HostEndpointUpdate:
+		d.hostEndpoints[*msg.Id] = msg.Endpoint
+		d.markEndpointDirty(*msg.Id)
+	case *proto.HostEndpointRemove:
+		delete(d.hostEndpoints, *msg.Id)
+		d.markEndpointDirty(*msg.Id)
+	case portForwardsUpdate:
+		d.onPortForwardsUpdate(msg.forwards)
+	}
+}
+
+func (d *BPFDataplane) onPortForwardsUpdate(forwards []rules.PortForward) {
+	d.portForwards = map[string]natMapping{}
+	for _, f := range forwards {
+		if err := f.Validate(); err != nil {
+			log.WithError(err).WithField("forward", f).Warn("Skipping invalid port forward")
+			continue
+		}
+		protocol := uint8(6)
+		if f.Protocol == "udp" {
+			protocol = 17
+		}
+		mapping := natMapping{
+			frontend: bpf.NATAddr{Protocol: protocol, IP: net.ParseIP(f.ExternalIP), Port: f.ExternalPort},
+			backend:  bpf.NATAddr{Protocol: protocol, IP: net.ParseIP(f.WorkloadIP), Port: f.WorkloadPort},
+		}
+		d.portForwards[mapping.frontend.String()] = mapping
+	}
+	d.portForwardsChanged = true
+	d.backoffs.Forget(portForwardsKey)
+}
+
+func (d *BPFDataplane) markPolicyUsersDirty(id proto.PolicyID) {
+	for epID, ep := range d.workloadEndpoints {
+		if tiersUsePolicy(ep.Tiers, id) {
+			d.markEndpointDirty(epID)
+		}
+	}
+	for epID, ep := range d.hostEndpoints {
+		if tiersUsePolicy(ep.UntrackedTiers, id) {
+			d.markEndpointDirty(epID)
+		}
+	}
+}
+
+func tiersUsePolicy(tiers []*proto.TierInfo, id proto.PolicyID) bool {
+	for _, tier := range tiers {
+		for _, name := range tier.Policies {
+			if tier.Name == id.Tier && name == id.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (d *BPFDataplane) markProfileUsersDirty(id proto.ProfileID) {
+	for epID, ep := range d.workloadEndpoints {
+		for _, name := range ep.ProfileIds {
+			if name == id.Name {
+				d.markEndpointDirty(epID)
+			}
+		}
+	}
+}
+
+// markEndpointsDirty marks dirty any endpoint that uses a policy or
+// profile with a rule that matches the given predicate.
+func (d *BPFDataplane) markEndpointsDirty(pred func(rule *proto.Rule) bool) {
+	anyMatch := func(ruleLists ...[]*proto.Rule) bool {
+		for _, rules := range ruleLists {
+			for _, rule := range rules {
+				if pred(rule) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for id, policy := range d.policies {
+		if anyMatch(policy.InboundRules, policy.OutboundRules) {
+			d.markPolicyUsersDirty(id)
+		}
+	}
+	for id, profile := range d.profiles {
+		if anyMatch(profile.InboundRules, profile.OutboundRules) {
+			d.markProfileUsersDirty(id)
+		}
+	}
+}
+
+func ruleUsesIPSet(rule *proto.Rule, id string) bool {
+	for _, ids := range [][]string{
+		rule.SrcIpSetIds, rule.DstIpSetIds,
+		rule.NotSrcIpSetIds, rule.NotDstIpSetIds,
+	} {
+		for _, ipSetID := range ids {
+			if ipSetID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// markEndpointDirty queues the endpoint to be reprogrammed.  Since the
+// endpoint has changed, any backoff from an earlier failure no longer applies.
+func (d *BPFDataplane) markEndpointDirty(id interface{}) {
+	d.dirtyEndpoints.Add(id)
+	d.backoffs.Forget(endpointKey(id))
+}
+
+// endpointKey returns the key of the endpoint's updates in the backoff
+// manager.
+func endpointKey(id interface{}) string {
+	return fmt.Sprintf("%#v", id)
+}
+
+// apply programs the dirty endpoints and any changed port forwards.
+// Endpoints that fail are left dirty so that they are retried once their
+// backoff expires.
+func (d *BPFDataplane) apply() {
+	failedEndpoints := set.New()
+	d.dirtyEndpoints.Iter(func(item interface{}) error {
+		err := d.backoffs.Apply(endpointKey(item), func() error {
+			switch id := item.(type) {
+			case proto.WorkloadEndpointID:
+				return d.applyWorkloadEndpoint(id)
+			case proto.HostEndpointID:
+				return d.applyHostEndpoint(id)
+			}
+			return nil
+		})
+		if err != nil {
+			if err != backoff.ErrBackingOff {
+				log.WithError(err).WithField("id", item).Warn(
+					"Failed to update BPF dataplane for endpoint, will retry")
+			}
+			failedEndpoints.Add(item)
+		}
+		return nil
+	})
+	d.dirtyEndpoints = failedEndpoints
+
+	if d.portForwardsChanged {
+		if err := d.backoffs.Apply(portForwardsKey, d.applyPortForwards); err != nil {
+			if err != backoff.ErrBackingOff {
+				log.WithError(err).Warn("Failed to update BPF NAT maps, will retry")
+			}
+		} else {
+			d.portForwardsChanged = false
+		}
+	}
+}
+
+func (d *BPFDataplane) applyWorkloadEndpoint(id proto.WorkloadEndpointID) error {
+	if !d.config.TCEnabled {
+		return nil
+	}
+	ep := d.workloadEndpoints[id]
+	newIface := ""
+	if ep != nil {
+		newIface = ep.Name
+	}
+	if err := d.removeStaleIface(id, newIface); err != nil {
+		return err
+	}
+	if ep == nil {
+		return nil
+	}
+
+	logCxt := log.WithFields(log.Fields{"id": id, "iface": ep.Name})
+	if _, ok := d.ifaces[ep.Name]; !ok {
+		ifindex, err := d.tc.InterfaceIndex(ep.Name)
+		if err != nil {
+			return err
+		}
+		if err := d.tc.AttachWorkloadPrograms(ep.Name); err != nil {
+			return err
+		}
+		d.ifaces[ep.Name] = &ifaceState{ifindex: ifindex, numRules: map[bpf.Direction]int{}}
+		d.endpointIfaces[id] = ep.Name
+	}
+
+	inRules, outRules, err := d.compileEndpointPolicy(ep)
+	if err != nil {
+		logCxt.WithError(err).Info(
+			"Endpoint's policy not supported by BPF programs, falling back to iptables")
+		inRules, outRules = nil, nil
+	}
+	if err := d.programRules(ep.Name, bpf.DirInbound, inRules); err != nil {
+		return err
+	}
+	return d.programRules(ep.Name, bpf.DirOutbound, outRules)
+}
+
+func (d *BPFDataplane) applyHostEndpoint(id proto.HostEndpointID) error {
+	ep := d.hostEndpoints[id]
+	newIface := ""
+	if ep != nil && ep.Name != wildcardIfaceName {
+		// Host endpoints that are matched by IP have no name and wildcard
+		// host endpoints have no single interface; we only handle those with
+		// an explicit interface.  Any further interfaces in InterfaceNames
+		// are left to iptables.
+		newIface = ep.Name
+	}
+	if d.config.TCEnabled {
+		if err := d.applyHostTC(id, newIface); err != nil {
+			return err
+		}
+	}
+	if d.config.XDPEnabled {
+		return d.applyHostXDP(id, ep, newIface)
+	}
+	return nil
+}
+
+func (d *BPFDataplane) applyHostTC(id proto.HostEndpointID, newIface string) error {
+	if err := d.removeStaleIface(id, newIface); err != nil {
+		return err
+	}
+	if newIface == "" {
+		return nil
+	}
+	if _, ok := d.ifaces[newIface]; ok {
+		return nil
+	}
+	if err := d.tc.AttachHostPrograms(newIface); err != nil {
+		return err
+	}
+	// Host interfaces have no BPF policy so we don't need the ifindex.
+	d.ifaces[newIface] = &ifaceState{numRules: map[bpf.Direction]int{}}
+	d.endpointIfaces[id] = newIface
+	return nil
+}
+
+// applyHostXDP brings the XDP deny-list for the host endpoint's interface in
+// sync with its untracked policy.  The program is only attached while the
+// deny-list is non-empty.
+func (d *BPFDataplane) applyHostXDP(id proto.HostEndpointID, ep *proto.HostEndpoint, newIface string) error {
+	var nets []net.IPNet
+	if newIface != "" {
+		nets = bpf.CompileXDPDenyList(d.untrackedInboundRules(ep), d.lookupIPSet)
+	}
+	if oldIface, ok := d.xdpEndpointIfaces[id]; ok && (oldIface != newIface || len(nets) == 0) {
+		if err := d.removeXDP(oldIface); err != nil {
+			return err
+		}
+		delete(d.xdpEndpointIfaces, id)
+	}
+	if len(nets) == 0 || d.xdpUnsupportedIfaces.Contains(newIface) {
+		return nil
+	}
+
+	logCxt := log.WithFields(log.Fields{"id": id, "iface": newIface})
+	state := d.xdpIfaces[newIface]
+	if state == nil {
+		ifindex, err := d.tc.InterfaceIndex(newIface)
+		if err != nil {
+			return err
+		}
+		mode, err := d.xdp.AttachDenyProgram(newIface)
+		if err == bpf.ErrXDPNotSupported {
+			logCxt.Warn("Interface doesn't support XDP, untracked deny rules " +
+				"will be enforced by iptables only")
+			d.xdpUnsupportedIfaces.Add(newIface)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		state = &xdpState{ifindex: ifindex, mode: mode, nets: map[string]net.IPNet{}}
+		d.xdpIfaces[newIface] = state
+		d.xdpEndpointIfaces[id] = newIface
+	}
+	// The failsafe map must be populated before we block anything.
+	if err := d.programXDPFailsafes(); err != nil {
+		return err
+	}
+	logCxt.WithFields(log.Fields{
+		"numCIDRs": len(nets),
+		"mode":     state.mode,
+	}).Info("Updating XDP deny-list")
+	return d.programXDPDenyList(state, nets)
+}
+
+// untrackedInboundRules returns the untracked inbound rules for the host
+// endpoint, in order.  Only the first untracked tier with policies can be
+// handled by the XDP program, since the end of that tier drops all traffic
+// that wasn't allowed.
+func (d *BPFDataplane) untrackedInboundRules(ep *proto.HostEndpoint) []*proto.Rule {
+	var rules []*proto.Rule
+	for _, tier := range ep.UntrackedTiers {
+		if len(tier.Policies) == 0 {
+			continue
+		}
+		for _, name := range tier.Policies {
+			policy := d.policies[proto.PolicyID{Tier: tier.Name, Name: name}]
+			if policy == nil {
+				continue
+			}
+			rules = append(rules, policy.InboundRules...)
+		}
+		break
+	}
+	return rules
+}
+
+func (d *BPFDataplane) programXDPFailsafes() error {
+	if d.xdpFailsafesDone {
+		return nil
+	}
+	for _, port := range d.config.FailsafeInboundHostPorts {
+		err := d.maps.XDPFailsafe.Update(bpf.XDPFailsafeKey(port), bpf.XDPFailsafeValue())
+		if err != nil {
+			return err
+		}
+	}
+	d.xdpFailsafesDone = true
+	return nil
+}
+
+func (d *BPFDataplane) programXDPDenyList(state *xdpState, nets []net.IPNet) error {
+	desired := map[string]net.IPNet{}
+	for _, n := range nets {
+		desired[n.String()] = n
+	}
+	for key, n := range state.nets {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		mapKey := bpf.XDPDenyKey{Ifindex: uint32(state.ifindex), Net: n}
+		if err := d.maps.XDPDeny.Delete(mapKey.AsBytes()); err != nil {
+			return err
+		}
+		delete(state.nets, key)
+	}
+	for key, n := range desired {
+		if _, ok := state.nets[key]; ok {
+			// Already programmed; don't reset its drop counter.
+			continue
+		}
+		mapKey := bpf.XDPDenyKey{Ifindex: uint32(state.ifindex), Net: n}
+		if err := d.maps.XDPDeny.Update(mapKey.AsBytes(), bpf.XDPDenyValue()); err != nil {
+			return err
+		}
+		state.nets[key] = n
+	}
+	return nil
+}
+
+// removeXDP removes the deny-list entries for the interface and then
+// detaches the XDP program.
+func (d *BPFDataplane) removeXDP(iface string) error {
+	state := d.xdpIfaces[iface]
+	if err := d.programXDPDenyList(state, nil); err != nil {
+		return err
+	}
+	if err := d.xdp.RemoveDenyProgram(iface); err != nil {
+		return err
+	}
+	delete(d.xdpIfaces, iface)
+	return nil
+}
+
+// removeStaleIface cleans up the interface that we previously programmed for
+// the endpoint, if the endpoint has been removed or has moved to a new
+// interface.
+func (d *BPFDataplane) removeStaleIface(id interface{}, newIface string) error {
+	oldIface, ok := d.endpointIfaces[id]
+	if !ok || oldIface == newIface {
+		return nil
+	}
+	// Remove the rules first, since the interface index may be reused.
+	for _, dir := range []bpf.Direction{bpf.DirInbound, bpf.DirOutbound} {
+		if err := d.programRules(oldIface, dir, nil); err != nil {
+			return err
+		}
+	}
+	if err := d.tc.RemovePrograms(oldIface); err != nil {
+		return err
+	}
+	delete(d.ifaces, oldIface)
+	delete(d.endpointIfaces, id)
+	return nil
+}
+
+// compileEndpointPolicy calculates the BPF rules for the endpoint.  As with
+// the iptables rules, if any tier has policies, the first such tier applies,
+// followed by an implicit deny; otherwise, the endpoint's profiles apply,
+// followed by an implicit deny.
+func (d *BPFDataplane) compileEndpointPolicy(ep *proto.WorkloadEndpoint) (in, out []bpf.PolicyRule, err error) {
+	var inRules, outRules []*proto.Rule
+	usedTier := false
+	for _, tier := range ep.Tiers {
+		if len(tier.Policies) == 0 {
+			continue
+		}
+		for _, name := range tier.Policies {
+			policy := d.policies[proto.PolicyID{Tier: tier.Name, Name: name}]
+			if policy == nil {
+				continue
+			}
+			inRules = append(inRules, policy.InboundRules...)
+			outRules = append(outRules, policy.OutboundRules...)
+		}
+		usedTier = true
+		break
+	}
+	if !usedTier {
+		for _, name := range ep.ProfileIds {
+			profile := d.profiles[proto.ProfileID{Name: name}]
+			if profile == nil {
+				continue
+			}
+			inRules = append(inRules, profile.InboundRules...)
+			outRules = append(outRules, profile.OutboundRules...)
+		}
+	}
+	denyAll := &proto.Rule{Action: "deny"}
+	in, err = bpf.CompileRules(append(inRules, denyAll), d.lookupIPSet)
+	if err != nil {
+		return
+	}
+	out, err = bpf.CompileRules(append(outRules, denyAll), d.lookupIPSet)
+	return
+}
+
+func (d *BPFDataplane) lookupIPSet(id string) (set.Set, bool) {
+	members, ok := d.ipSets[id]
+	return members, ok
+}
+
+// programRules writes the rules for one direction of an interface to the
+// policy map and removes any excess rules from the previous version.  The
+// update isn't atomic; a packet that arrives during the update may see a mix
+// of old and new rules.
+func (d *BPFDataplane) programRules(iface string, dir bpf.Direction, policyRules []bpf.PolicyRule) error {
+	state := d.ifaces[iface]
+	if state == nil {
+		return nil
+	}
+	for i, rule := range policyRules {
+		key := bpf.PolicyKey{Ifindex: uint32(state.ifindex), Direction: dir, Index: uint16(i)}
+		if err := d.maps.Policy.Update(key.AsBytes(), rule.AsBytes()); err != nil {
+			return err
+		}
+		if i >= state.numRules[dir] {
+			state.numRules[dir] = i + 1
+		}
+	}
+	for i := state.numRules[dir] - 1; i >= len(policyRules); i-- {
+		key := bpf.PolicyKey{Ifindex: uint32(state.ifindex), Direction: dir, Index: uint16(i)}
+		if err := d.maps.Policy.Delete(key.AsBytes()); err != nil {
+			return err
+		}
+		state.numRules[dir] = i
+	}
+	return nil
+}
+
+// applyPortForwards brings the NAT maps in sync with the desired port
+// forwards.
+func (d *BPFDataplane) applyPortForwards() error {
+	for key, mapping := range d.programmedForwards {
+		if newMapping, ok := d.portForwards[key]; ok &&
+			newMapping.backend.String() == mapping.backend.String() {
+			continue
+		}
+		if err := d.maps.NATFrontend.Delete(mapping.frontend.AsBytes()); err != nil {
+			return err
+		}
+		if err := d.maps.NATBackend.Delete(mapping.backend.AsBytes()); err != nil {
+			return err
+		}
+		delete(d.programmedForwards, key)
+	}
+	for key, mapping := range d.portForwards {
+		if _, ok := d.programmedForwards[key]; ok {
+			continue
+		}
+		err := d.maps.NATFrontend.Update(mapping.frontend.AsBytes(), mapping.backend.AsBytes())
+		if err != nil {
+			return err
+		}
+		err = d.maps.NATBackend.Update(mapping.backend.AsBytes(), mapping.frontend.AsBytes())
+		if err != nil {
+			return err
+		}
+		d.programmedForwards[key] = mapping
+	}
+	return nil
+}
@@ -0,0 +1,542 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpfdataplane_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/bpfdataplane"
+
+	"errors"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/backoff"
+	"github.com/projectcalico/felix/go/felix/bpf"
+	"github.com/projectcalico/felix/go/felix/health"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"net"
+	"sync"
+	"time"
+)
+
+type mockDriver struct {
+	lock sync.Mutex
+	sent []interface{}
+}
+
+func (d *mockDriver) SendMessage(msg interface{}) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.sent = append(d.sent, msg)
+	return nil
+}
+
+func (d *mockDriver) RecvMessage() (interface{}, error) {
+	return &proto.ProcessStatusUpdate{}, nil
+}
+
+type mockTC struct {
+	lock       sync.Mutex
+	attached   map[string]string
+	ifindexes  map[string]int
+	failAttach bool
+	// panicAttach makes the next attach panic.
+	panicAttach bool
+}
+
+func (t *mockTC) AttachWorkloadPrograms(iface string) error {
+	return t.attach(iface, "workload")
+}
+
+func (t *mockTC) AttachHostPrograms(iface string) error {
+	return t.attach(iface, "host")
+}
+
+func (t *mockTC) attach(iface, kind string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.failAttach {
+		return errors.New("tc failure")
+	}
+	if t.panicAttach {
+		t.panicAttach = false
+		panic("tc panic")
+	}
+	t.attached[iface] = kind
+	return nil
+}
+
+func (t *mockTC) RemovePrograms(iface string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.attached, iface)
+	return nil
+}
+
+func (t *mockTC) InterfaceIndex(iface string) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	idx, ok := t.ifindexes[iface]
+	if !ok {
+		return 0, fmt.Errorf("no such interface %q", iface)
+	}
+	return idx, nil
+}
+
+func (t *mockTC) Attached() map[string]string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	attached := map[string]string{}
+	for k, v := range t.attached {
+		attached[k] = v
+	}
+	return attached
+}
+
+type mockXDP struct {
+	lock        sync.Mutex
+	attached    map[string]bpf.XDPMode
+	unsupported bool
+}
+
+func (x *mockXDP) AttachDenyProgram(iface string) (bpf.XDPMode, error) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	if x.unsupported {
+		return "", bpf.ErrXDPNotSupported
+	}
+	x.attached[iface] = bpf.XDPModeGeneric
+	return bpf.XDPModeGeneric, nil
+}
+
+func (x *mockXDP) RemoveDenyProgram(iface string) error {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	delete(x.attached, iface)
+	return nil
+}
+
+func (x *mockXDP) Attached() map[string]bpf.XDPMode {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	attached := map[string]bpf.XDPMode{}
+	for k, v := range x.attached {
+		attached[k] = v
+	}
+	return attached
+}
+
+type mockMap struct {
+	lock     sync.Mutex
+	contents map[string]string
+	failNext bool
+}
+
+func newMockMap() *mockMap {
+	return &mockMap{contents: map[string]string{}}
+}
+
+func (m *mockMap) Update(key, value []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.failNext {
+		m.failNext = false
+		return errors.New("map failure")
+	}
+	m.contents[string(key)] = string(value)
+	return nil
+}
+
+func (m *mockMap) Delete(key []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.contents, string(key))
+	return nil
+}
+
+func (m *mockMap) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.contents)
+}
+
+func (m *mockMap) Get(key []byte) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.contents[string(key)]
+}
+
+var (
+	wlEPID = proto.WorkloadEndpointID{
+		OrchestratorId: "k8s",
+		WorkloadId:     "pod-1",
+		EndpointId:     "eth0",
+	}
+	hostEPID = proto.HostEndpointID{EndpointId: "eth0"}
+	polID    = proto.PolicyID{Tier: "default", Name: "pol-1"}
+)
+
+var _ = Describe("BPFDataplane", func() {
+	var inner *mockDriver
+	var tc *mockTC
+	var xdp *mockXDP
+	var policyMap, natFEMap, natBEMap, xdpDenyMap, xdpFailsafeMap *mockMap
+	var dp *BPFDataplane
+	var healthAggregator *health.HealthAggregator
+
+	BeforeEach(func() {
+		inner = &mockDriver{}
+		tc = &mockTC{
+			attached:  map[string]string{},
+			ifindexes: map[string]int{"cali1": 10, "cali2": 11, "eth0": 2},
+		}
+		xdp = &mockXDP{attached: map[string]bpf.XDPMode{}}
+		healthAggregator = health.NewHealthAggregator()
+		policyMap = newMockMap()
+		natFEMap = newMockMap()
+		natBEMap = newMockMap()
+		xdpDenyMap = newMockMap()
+		xdpFailsafeMap = newMockMap()
+		dp = NewBPFDataplaneDriver(inner, tc, xdp, bpf.Maps{
+			Policy:      policyMap,
+			NATFrontend: natFEMap,
+			NATBackend:  natBEMap,
+			XDPDeny:     xdpDenyMap,
+			XDPFailsafe: xdpFailsafeMap,
+		}, Config{
+			RetryInterval:            10 * time.Millisecond,
+			Backoff:                  backoff.Config{UnreadyAfter: 2},
+			HealthAggregator:         healthAggregator,
+			TCEnabled:                true,
+			XDPEnabled:               true,
+			FailsafeInboundHostPorts: []uint16{22},
+		})
+		dp.Start()
+	})
+
+	wlUpdate := func(iface string, policies ...string) *proto.WorkloadEndpointUpdate {
+		return &proto.WorkloadEndpointUpdate{
+			Id: &wlEPID,
+			Endpoint: &proto.WorkloadEndpoint{
+				Name:  iface,
+				Tiers: []*proto.TierInfo{{Name: "default", Policies: policies}},
+			},
+		}
+	}
+	rule := func(ifindex int, dir bpf.Direction, idx int) func() string {
+		return func() string {
+			key := bpf.PolicyKey{Ifindex: uint32(ifindex), Direction: dir, Index: uint16(idx)}
+			return policyMap.Get(key.AsBytes())
+		}
+	}
+	denyAll := string(bpf.PolicyRule{Action: bpf.ActionDeny}.AsBytes())
+	allowAll := string(bpf.PolicyRule{Action: bpf.ActionAllow}.AsBytes())
+
+	It("should pass updates through to the inner driver", func() {
+		msg := &proto.InSync{}
+		Expect(dp.SendMessage(msg)).To(Succeed())
+		Expect(inner.sent).To(Equal([]interface{}{msg}))
+		Expect(dp.RecvMessage()).To(Equal(&proto.ProcessStatusUpdate{}))
+	})
+
+	It("should not program anything before in-sync", func() {
+		dp.SendMessage(wlUpdate("cali1"))
+		Consistently(tc.Attached, "50ms").Should(BeEmpty())
+	})
+
+	Describe("after in-sync, with a policy", func() {
+		BeforeEach(func() {
+			dp.SendMessage(&proto.ActivePolicyUpdate{
+				Id: &polID,
+				Policy: &proto.Policy{
+					InboundRules: []*proto.Rule{
+						{Action: "allow", SrcNet: "10.0.0.0/8"},
+					},
+				},
+			})
+			dp.SendMessage(&proto.InSync{})
+		})
+
+		It("should attach programs and program the rules", func() {
+			dp.SendMessage(wlUpdate("cali1", "pol-1"))
+			Eventually(tc.Attached).Should(Equal(map[string]string{"cali1": "workload"}))
+			Eventually(policyMap.Len).Should(Equal(3))
+			Expect(rule(10, bpf.DirInbound, 0)()).To(Equal(string(bpf.PolicyRule{
+				Action: bpf.ActionAllow,
+				SrcNet: net.IPNet{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+			}.AsBytes())))
+			Expect(rule(10, bpf.DirInbound, 1)()).To(Equal(denyAll))
+			Expect(rule(10, bpf.DirOutbound, 0)()).To(Equal(denyAll))
+		})
+		It("should use profiles if there are no policies", func() {
+			dp.SendMessage(&proto.ActiveProfileUpdate{
+				Id: &proto.ProfileID{Name: "prof-1"},
+				Profile: &proto.Profile{
+					OutboundRules: []*proto.Rule{{Action: "allow"}},
+				},
+			})
+			dp.SendMessage(&proto.WorkloadEndpointUpdate{
+				Id: &wlEPID,
+				Endpoint: &proto.WorkloadEndpoint{
+					Name:       "cali1",
+					ProfileIds: []string{"prof-1"},
+				},
+			})
+			Eventually(policyMap.Len).Should(Equal(3))
+			Expect(rule(10, bpf.DirOutbound, 0)()).To(Equal(allowAll))
+		})
+		It("should fall back to iptables for unsupported policy", func() {
+			dp.SendMessage(&proto.ActivePolicyUpdate{
+				Id: &polID,
+				Policy: &proto.Policy{
+					InboundRules: []*proto.Rule{{Action: "next-tier"}},
+				},
+			})
+			dp.SendMessage(wlUpdate("cali1", "pol-1"))
+			Eventually(tc.Attached).Should(HaveKey("cali1"))
+			Consistently(policyMap.Len, "50ms").Should(Equal(0))
+		})
+		It("should retry if attaching fails", func() {
+			tc.lock.Lock()
+			tc.failAttach = true
+			tc.lock.Unlock()
+			dp.SendMessage(wlUpdate("cali1", "pol-1"))
+			Consistently(tc.Attached, "50ms").Should(BeEmpty())
+			tc.lock.Lock()
+			tc.failAttach = false
+			tc.lock.Unlock()
+			Eventually(tc.Attached).Should(HaveKey("cali1"))
+			Eventually(policyMap.Len).Should(Equal(3))
+		})
+		It("should report not ready while attaching keeps failing", func() {
+			Expect(healthAggregator.Summary().Ready).To(BeTrue())
+			tc.lock.Lock()
+			tc.failAttach = true
+			tc.lock.Unlock()
+			dp.SendMessage(wlUpdate("cali1", "pol-1"))
+			Eventually(func() bool {
+				return healthAggregator.Summary().Ready
+			}).Should(BeFalse())
+			tc.lock.Lock()
+			tc.failAttach = false
+			tc.lock.Unlock()
+			Eventually(func() bool {
+				return healthAggregator.Summary().Ready
+			}).Should(BeTrue())
+			Expect(tc.Attached()).To(HaveKey("cali1"))
+		})
+		It("should survive a panic while attaching, and retry", func() {
+			tc.lock.Lock()
+			tc.panicAttach = true
+			tc.lock.Unlock()
+			dp.SendMessage(wlUpdate("cali1", "pol-1"))
+			Eventually(tc.Attached).Should(HaveKey("cali1"))
+			Eventually(policyMap.Len).Should(Equal(3))
+		})
+
+		Describe("with a programmed endpoint", func() {
+			BeforeEach(func() {
+				dp.SendMessage(wlUpdate("cali1", "pol-1"))
+				Eventually(policyMap.Len).Should(Equal(3))
+			})
+
+			It("should remove excess rules when the policy shrinks", func() {
+				dp.SendMessage(&proto.ActivePolicyUpdate{Id: &polID, Policy: &proto.Policy{}})
+				Eventually(policyMap.Len).Should(Equal(2))
+				Expect(rule(10, bpf.DirInbound, 0)()).To(Equal(denyAll))
+			})
+			It("should clean up when the endpoint is removed", func() {
+				dp.SendMessage(&proto.WorkloadEndpointRemove{Id: &wlEPID})
+				Eventually(policyMap.Len).Should(Equal(0))
+				Eventually(tc.Attached).Should(BeEmpty())
+			})
+			It("should move to a new interface", func() {
+				dp.SendMessage(wlUpdate("cali2", "pol-1"))
+				Eventually(tc.Attached).Should(Equal(map[string]string{"cali2": "workload"}))
+				Eventually(rule(11, bpf.DirOutbound, 0)).Should(Equal(denyAll))
+				Expect(rule(10, bpf.DirOutbound, 0)()).To(BeEmpty())
+				Expect(policyMap.Len()).To(Equal(3))
+			})
+			It("should retry a failed map update", func() {
+				policyMap.lock.Lock()
+				policyMap.failNext = true
+				policyMap.lock.Unlock()
+				dp.SendMessage(&proto.ActivePolicyUpdate{Id: &polID, Policy: &proto.Policy{}})
+				Eventually(policyMap.Len).Should(Equal(2))
+				Expect(rule(10, bpf.DirInbound, 0)()).To(Equal(denyAll))
+			})
+		})
+
+		It("should attach the NAT programs to host endpoint interfaces", func() {
+			dp.SendMessage(&proto.HostEndpointUpdate{
+				Id:       &hostEPID,
+				Endpoint: &proto.HostEndpoint{Name: "eth0"},
+			})
+			Eventually(tc.Attached).Should(Equal(map[string]string{"eth0": "host"}))
+			dp.SendMessage(&proto.HostEndpointRemove{Id: &hostEPID})
+			Eventually(tc.Attached).Should(BeEmpty())
+		})
+		It("should ignore host endpoints without an interface name", func() {
+			dp.SendMessage(&proto.HostEndpointUpdate{
+				Id: &hostEPID,
+				Endpoint: &proto.HostEndpoint{
+					ExpectedIpv4Addrs: []string{"10.0.0.1"},
+				},
+			})
+			Consistently(tc.Attached, "50ms").Should(BeEmpty())
+		})
+		It("should ignore wildcard host endpoints", func() {
+			dp.SendMessage(&proto.HostEndpointUpdate{
+				Id:       &hostEPID,
+				Endpoint: &proto.HostEndpoint{Name: "*"},
+			})
+			Consistently(tc.Attached, "50ms").Should(BeEmpty())
+		})
+
+		Describe("with untracked host endpoint policy", func() {
+			untrackedPolID := proto.PolicyID{Tier: "untracked", Name: "pol-u"}
+			hepUpdate := func() *proto.HostEndpointUpdate {
+				return &proto.HostEndpointUpdate{
+					Id: &hostEPID,
+					Endpoint: &proto.HostEndpoint{
+						Name: "eth0",
+						UntrackedTiers: []*proto.TierInfo{
+							{Name: "untracked", Policies: []string{"pol-u"}},
+						},
+					},
+				}
+			}
+			denyKey := func(cidr string) []byte {
+				_, n, err := net.ParseCIDR(cidr)
+				Expect(err).NotTo(HaveOccurred())
+				return bpf.XDPDenyKey{Ifindex: 2, Net: *n}.AsBytes()
+			}
+
+			BeforeEach(func() {
+				dp.SendMessage(&proto.ActivePolicyUpdate{
+					Id: &untrackedPolID,
+					Policy: &proto.Policy{
+						InboundRules: []*proto.Rule{
+							{Action: "deny", SrcNet: "192.168.0.0/16"},
+							{Action: "deny", SrcNet: "172.16.1.1/32"},
+							{Action: "allow"},
+						},
+					},
+				})
+			})
+
+			It("should attach the XDP program and program the deny-list", func() {
+				dp.SendMessage(hepUpdate())
+				Eventually(xdp.Attached).Should(Equal(map[string]bpf.XDPMode{"eth0": bpf.XDPModeGeneric}))
+				Eventually(xdpDenyMap.Len).Should(Equal(2))
+				Expect(xdpDenyMap.Get(denyKey("192.168.0.0/16"))).To(Equal(string(bpf.XDPDenyValue())))
+				Expect(xdpDenyMap.Get(denyKey("172.16.1.1/32"))).To(Equal(string(bpf.XDPDenyValue())))
+				Expect(xdpFailsafeMap.Get(bpf.XDPFailsafeKey(22))).To(Equal(string(bpf.XDPFailsafeValue())))
+			})
+			It("should update the deny-list when the policy changes", func() {
+				dp.SendMessage(hepUpdate())
+				Eventually(xdpDenyMap.Len).Should(Equal(2))
+				dp.SendMessage(&proto.ActivePolicyUpdate{
+					Id: &untrackedPolID,
+					Policy: &proto.Policy{
+						InboundRules: []*proto.Rule{
+							{Action: "deny", SrcNet: "192.168.0.0/16"},
+						},
+					},
+				})
+				Eventually(xdpDenyMap.Len).Should(Equal(1))
+				Expect(xdpDenyMap.Get(denyKey("192.168.0.0/16"))).NotTo(BeEmpty())
+			})
+			It("should detach the program when the deny-list becomes empty", func() {
+				dp.SendMessage(hepUpdate())
+				Eventually(xdp.Attached).Should(HaveKey("eth0"))
+				dp.SendMessage(&proto.ActivePolicyUpdate{
+					Id: &untrackedPolID,
+					Policy: &proto.Policy{
+						InboundRules: []*proto.Rule{{Action: "allow"}},
+					},
+				})
+				Eventually(xdp.Attached).Should(BeEmpty())
+				Expect(xdpDenyMap.Len()).To(Equal(0))
+			})
+			It("should clean up when the host endpoint is removed", func() {
+				dp.SendMessage(hepUpdate())
+				Eventually(xdpDenyMap.Len).Should(Equal(2))
+				dp.SendMessage(&proto.HostEndpointRemove{Id: &hostEPID})
+				Eventually(xdp.Attached).Should(BeEmpty())
+				Expect(xdpDenyMap.Len()).To(Equal(0))
+			})
+			It("should fall back to iptables if XDP is not supported", func() {
+				xdp.lock.Lock()
+				xdp.unsupported = true
+				xdp.lock.Unlock()
+				dp.SendMessage(hepUpdate())
+				Eventually(tc.Attached).Should(HaveKey("eth0"))
+				Consistently(xdpDenyMap.Len, "50ms").Should(Equal(0))
+				Expect(xdpFailsafeMap.Len()).To(Equal(0))
+			})
+		})
+
+		Describe("with port forwards", func() {
+			fwd1 := rules.PortForward{
+				Protocol:     "tcp",
+				ExternalIP:   "172.16.0.1",
+				ExternalPort: 80,
+				WorkloadIP:   "10.0.0.1",
+				WorkloadPort: 8080,
+			}
+			fwd2 := rules.PortForward{
+				Protocol:     "udp",
+				ExternalIP:   "172.16.0.1",
+				ExternalPort: 53,
+				WorkloadIP:   "10.0.0.2",
+				WorkloadPort: 53,
+			}
+			frontend1 := bpf.NATAddr{IP: net.ParseIP("172.16.0.1"), Port: 80, Protocol: 6}
+			backend1 := bpf.NATAddr{IP: net.ParseIP("10.0.0.1"), Port: 8080, Protocol: 6}
+
+			BeforeEach(func() {
+				dp.SetPortForwards([]rules.PortForward{fwd1, fwd2})
+				Eventually(natFEMap.Len).Should(Equal(2))
+			})
+
+			It("should program both NAT maps", func() {
+				Expect(natFEMap.Get(frontend1.AsBytes())).To(Equal(string(backend1.AsBytes())))
+				Expect(natBEMap.Len()).To(Equal(2))
+				Expect(natBEMap.Get(backend1.AsBytes())).To(Equal(string(frontend1.AsBytes())))
+			})
+			It("should remove stale forwards", func() {
+				dp.SetPortForwards([]rules.PortForward{fwd2})
+				Eventually(natFEMap.Len).Should(Equal(1))
+				Expect(natBEMap.Len()).To(Equal(1))
+				Expect(natFEMap.Get(frontend1.AsBytes())).To(BeEmpty())
+			})
+			It("should update a changed backend", func() {
+				fwd1.WorkloadIP = "10.0.0.3"
+				dp.SetPortForwards([]rules.PortForward{fwd1, fwd2})
+				backend := bpf.NATAddr{IP: net.ParseIP("10.0.0.3"), Port: 8080, Protocol: 6}
+				Eventually(func() string {
+					return natFEMap.Get(frontend1.AsBytes())
+				}).Should(Equal(string(backend.AsBytes())))
+				Expect(natBEMap.Get(backend1.AsBytes())).To(BeEmpty())
+			})
+			It("should skip invalid forwards", func() {
+				fwd1.Protocol = "sctp"
+				dp.SetPortForwards([]rules.PortForward{fwd1, fwd2})
+				Eventually(natFEMap.Len).Should(Equal(1))
+			})
+		})
+	})
+})
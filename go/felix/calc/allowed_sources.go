@@ -0,0 +1,78 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calc
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"strings"
+)
+
+// AllowedSourcePrefixesLabel lists, comma-separated, the extra CIDRs that a
+// workload may source traffic from, on top of its own addresses.  It
+// supports virtual IP failover schemes, such as VRRP or keepalived, where
+// the workload that currently owns a shared address sources traffic from it.
+const AllowedSourcePrefixesLabel = "projectcalico.org/allowed-source-prefixes"
+
+// ParseAllowedSourcePrefixes parses the value of the
+// AllowedSourcePrefixesLabel.  A bare address is taken as a single-address
+// CIDR.  The CIDRs are returned in canonical form, with duplicates removed,
+// in the order they were given.  Invalid entries are logged and skipped so
+// that one typo doesn't cut the workload off from its other prefixes.
+func ParseAllowedSourcePrefixes(value string) []string {
+	var prefixes []string
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				log.WithField("prefix", entry).Warn("Ignoring invalid allowed source prefix")
+				continue
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.WithError(err).WithField("prefix", entry).Warn(
+				"Ignoring invalid allowed source prefix")
+			continue
+		}
+		prefix := cidr.String()
+		if seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// AllowedSourcePrefixesFromLabels returns the allowed source prefixes that
+// the endpoint's labels ask for, if any.
+func AllowedSourcePrefixesFromLabels(labels map[string]string) []string {
+	value, ok := labels[AllowedSourcePrefixesLabel]
+	if !ok {
+		return nil
+	}
+	return ParseAllowedSourcePrefixes(value)
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calc_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/calc"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("ParseAllowedSourcePrefixes",
+	func(input string, expected []string) {
+		Expect(ParseAllowedSourcePrefixes(input)).To(Equal(expected))
+	},
+	Entry("empty", "", []string(nil)),
+	Entry("single CIDR", "10.0.0.100/32", []string{"10.0.0.100/32"}),
+	Entry("bare addresses", "10.0.0.100, fd00::100", []string{"10.0.0.100/32", "fd00::100/128"}),
+	Entry("canonical form", "10.1.2.3/16,FD00:0::0/64", []string{"10.1.0.0/16", "fd00::/64"}),
+	Entry("duplicates", "10.0.0.100,10.0.0.100/32", []string{"10.0.0.100/32"}),
+	Entry("invalid entries", "bad,10.0.0.100,10.0.0.0/33,", []string{"10.0.0.100/32"}),
+)
+
+var _ = Describe("AllowedSourcePrefixesFromLabels", func() {
+	It("should parse the label", func() {
+		Expect(AllowedSourcePrefixesFromLabels(map[string]string{
+			AllowedSourcePrefixesLabel: "10.0.0.100",
+			"app":                      "web",
+		})).To(Equal([]string{"10.0.0.100/32"}))
+	})
+	It("should return nil without the label", func() {
+		Expect(AllowedSourcePrefixesFromLabels(map[string]string{"app": "web"})).To(BeNil())
+	})
+})
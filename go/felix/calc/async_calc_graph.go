@@ -15,10 +15,14 @@
 package calc
 
 import (
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/projectcalico/felix/go/felix/config"
+	"github.com/projectcalico/felix/go/felix/convergence"
 	"github.com/projectcalico/felix/go/felix/dispatcher"
+	"github.com/projectcalico/felix/go/felix/health"
 	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/watchdog"
 	"github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/prometheus/client_golang/prometheus"
 	"time"
@@ -27,6 +31,12 @@ import (
 const (
 	tickInterval    = 10 * time.Millisecond
 	leakyBucketSize = 10
+
+	// The calculation graph reports its health periodically from its main
+	// loop; if the loop gets wedged, the reports stop and the report
+	// expires.
+	healthName     = "async_calc_graph"
+	healthInterval = 10 * time.Second
 )
 
 var (
@@ -61,18 +71,47 @@ type AsyncCalcGraph struct {
 	flushTicks       <-chan time.Time
 	flushLeakyBucket int
 	dirty            bool
+
+	// latestRevision is the latest datastore revision that the graph has
+	// processed, and when; markedRevision is the latest that it has sent
+	// a RevisionMarker for.
+	latestRevision     string
+	latestRevisionTime time.Time
+	markedRevision     string
+
+	healthAggregator *health.HealthAggregator
+	healthTicks      <-chan time.Time
+
+	// WatchdogLoop, if set, is checked in with every time round the main
+	// loop, which the flush ticks keep turning even when there are no
+	// updates.  It must be set before Start() is called.
+	WatchdogLoop *watchdog.Loop
 }
 
-func NewAsyncCalcGraph(conf *config.Config, outputEvents chan<- interface{}) *AsyncCalcGraph {
+// NewAsyncCalcGraph creates the calculation graph.  If healthAggregator is
+// non-nil, the graph reports its liveness to it, and its readiness, which
+// requires the datastore to be in sync.
+func NewAsyncCalcGraph(
+	conf *config.Config,
+	outputEvents chan<- interface{},
+	healthAggregator *health.HealthAggregator,
+) *AsyncCalcGraph {
 	eventBuffer := NewEventBuffer(conf)
 	dispatcher := NewCalculationGraph(eventBuffer, conf.FelixHostname)
 	g := &AsyncCalcGraph{
-		inputEvents:  make(chan interface{}, 10),
-		outputEvents: outputEvents,
-		Dispatcher:   dispatcher,
-		eventBuffer:  eventBuffer,
+		inputEvents:      make(chan interface{}, 10),
+		outputEvents:     outputEvents,
+		Dispatcher:       dispatcher,
+		eventBuffer:      eventBuffer,
+		healthAggregator: healthAggregator,
 	}
 	eventBuffer.Callback = g.onEvent
+	if healthAggregator != nil {
+		healthAggregator.RegisterReporter(healthName, &health.HealthReport{
+			Live:  true,
+			Ready: true,
+		}, healthInterval*2)
+	}
 	return g
 }
 
@@ -90,8 +129,15 @@ func (acg *AsyncCalcGraph) OnStatusUpdated(status api.SyncStatus) {
 	}
 }
 
+// QueueLen returns the number of batches of updates that are queued for the
+// graph.
+func (acg *AsyncCalcGraph) QueueLen() int {
+	return len(acg.inputEvents)
+}
+
 func (acg *AsyncCalcGraph) loop() {
 	log.Info("AsyncCalcGraph running")
+	acg.reportHealth()
 	for {
 		select {
 		case update := <-acg.inputEvents:
@@ -100,6 +146,7 @@ func (acg *AsyncCalcGraph) loop() {
 				// Update; send it to the dispatcher.
 				log.Debug("Pulled []KVPair off channel")
 				acg.Dispatcher.OnUpdates(update)
+				acg.recordRevision(update)
 			case api.SyncStatus:
 				// Sync status changed, check if we're now in-sync.
 				log.WithField("status", update).Debug(
@@ -124,8 +171,11 @@ func (acg *AsyncCalcGraph) loop() {
 			if acg.flushLeakyBucket < leakyBucketSize {
 				acg.flushLeakyBucket++
 			}
+		case <-acg.healthTicks:
+			acg.reportHealth()
 		}
 		acg.maybeFlush()
+		acg.WatchdogLoop.CheckIn()
 	}
 }
 
@@ -138,10 +188,20 @@ func (acg *AsyncCalcGraph) maybeFlush() {
 		log.Debug("Not throttled: flushing event buffer")
 		acg.flushLeakyBucket--
 		acg.eventBuffer.Flush()
+		if acg.latestRevision != acg.markedRevision {
+			// Mark the point in the output after which the dataplane
+			// reflects the revision.
+			acg.onEvent(&convergence.RevisionMarker{
+				Revision:    acg.latestRevision,
+				ProcessedAt: acg.latestRevisionTime,
+			})
+			acg.markedRevision = acg.latestRevision
+		}
 		if acg.needToSendInSync {
 			log.Info("First flush after becoming in sync, sending InSync message.")
 			acg.onEvent(&proto.InSync{})
 			acg.needToSendInSync = false
+			acg.reportHealth()
 		}
 		acg.dirty = false
 	} else {
@@ -149,6 +209,30 @@ func (acg *AsyncCalcGraph) maybeFlush() {
 	}
 }
 
+// reportHealth reports that the graph is live and, once the datastore is in
+// sync and the dataplane has been told about it, ready.
+func (acg *AsyncCalcGraph) reportHealth() {
+	if acg.healthAggregator == nil {
+		return
+	}
+	acg.healthAggregator.Report(healthName, &health.HealthReport{
+		Live:  true,
+		Ready: acg.beenInSync && !acg.needToSendInSync,
+	})
+}
+
+// recordRevision records the revision of the last update in the batch that
+// has one.
+func (acg *AsyncCalcGraph) recordRevision(updates []api.Update) {
+	for i := len(updates) - 1; i >= 0; i-- {
+		if updates[i].Revision != nil {
+			acg.latestRevision = fmt.Sprint(updates[i].Revision)
+			acg.latestRevisionTime = time.Now()
+			return
+		}
+	}
+}
+
 func (acg *AsyncCalcGraph) onEvent(event interface{}) {
 	log.Debug("Sending output event on channel")
 	acg.outputEvents <- event
@@ -158,5 +242,8 @@ func (acg *AsyncCalcGraph) onEvent(event interface{}) {
 func (acg *AsyncCalcGraph) Start() {
 	log.Info("Starting AsyncCalcGraph")
 	acg.flushTicks = time.Tick(tickInterval)
+	if acg.healthAggregator != nil {
+		acg.healthTicks = time.Tick(healthInterval)
+	}
 	go acg.loop()
 }
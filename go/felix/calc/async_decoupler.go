@@ -15,7 +15,9 @@
 package calc
 
 import (
+	"github.com/projectcalico/felix/go/felix/watchdog"
 	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"time"
 )
 
 func NewSyncerCallbacksDecoupler() *SyncerCallbacksDecoupler {
@@ -26,6 +28,10 @@ func NewSyncerCallbacksDecoupler() *SyncerCallbacksDecoupler {
 
 type SyncerCallbacksDecoupler struct {
 	c chan interface{}
+
+	// WatchdogLoop, if set, is checked in with as SendTo passes on each
+	// update and, periodically, while there are none.
+	WatchdogLoop *watchdog.Loop
 }
 
 func (a *SyncerCallbacksDecoupler) OnStatusUpdated(status api.SyncStatus) {
@@ -37,12 +43,24 @@ func (a *SyncerCallbacksDecoupler) OnUpdates(updates []api.Update) {
 }
 
 func (a *SyncerCallbacksDecoupler) SendTo(sink api.SyncerCallbacks) {
-	for obj := range a.c {
-		switch obj := obj.(type) {
-		case api.SyncStatus:
-			sink.OnStatusUpdated(obj)
-		case []api.Update:
-			sink.OnUpdates(obj)
+	var idleTicks <-chan time.Time
+	if interval := a.WatchdogLoop.IdleInterval(); interval > 0 {
+		idleTicks = time.Tick(interval)
+	}
+	for {
+		select {
+		case obj, ok := <-a.c:
+			if !ok {
+				return
+			}
+			switch obj := obj.(type) {
+			case api.SyncStatus:
+				sink.OnStatusUpdated(obj)
+			case []api.Update:
+				sink.OnUpdates(obj)
+			}
+		case <-idleTicks:
 		}
+		a.WatchdogLoop.CheckIn()
 	}
 }
@@ -0,0 +1,44 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calc
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"strconv"
+	"strings"
+)
+
+// ConntrackZoneLabel assigns a workload to a conntrack zone, between 1 and
+// 65535.  Workloads of different tenants that use overlapping IP ranges
+// should be given different zones, so that their connections don't collide
+// in the connection tracking table.
+const ConntrackZoneLabel = "projectcalico.org/conntrack-zone"
+
+// ConntrackZoneFromLabels returns the conntrack zone that the endpoint's
+// labels ask for, or 0, the default zone, if none.  An invalid zone is
+// logged and ignored.
+func ConntrackZoneFromLabels(labels map[string]string) uint32 {
+	value, ok := labels[ConntrackZoneLabel]
+	if !ok {
+		return 0
+	}
+	zone, err := strconv.ParseUint(strings.TrimSpace(value), 10, 16)
+	if err != nil {
+		log.WithError(err).WithField("label", ConntrackZoneLabel).Warn(
+			"Ignoring invalid conntrack zone")
+		return 0
+	}
+	return uint32(zone)
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calc_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/calc"
+
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("ConntrackZoneFromLabels",
+	func(labels map[string]string, expected uint32) {
+		Expect(ConntrackZoneFromLabels(labels)).To(Equal(expected))
+	},
+	Entry("no label", map[string]string{"app": "web"}, uint32(0)),
+	Entry("zone", map[string]string{ConntrackZoneLabel: "10"}, uint32(10)),
+	Entry("whitespace", map[string]string{ConntrackZoneLabel: " 10 "}, uint32(10)),
+	Entry("max zone", map[string]string{ConntrackZoneLabel: "65535"}, uint32(65535)),
+	Entry("too big", map[string]string{ConntrackZoneLabel: "65536"}, uint32(0)),
+	Entry("not a number", map[string]string{ConntrackZoneLabel: "tenant-a"}, uint32(0)),
+)
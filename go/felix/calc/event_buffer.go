@@ -20,6 +20,7 @@ import (
 	"github.com/projectcalico/felix/go/felix/ip"
 	"github.com/projectcalico/felix/go/felix/multidict"
 	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/qos"
 	"github.com/projectcalico/felix/go/felix/set"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	"github.com/projectcalico/libcalico-go/lib/net"
@@ -266,6 +267,11 @@ func (buf *EventBuffer) OnEndpointTierUpdate(endpointKey model.Key,
 		if ep.Mac != nil {
 			mac = ep.Mac.String()
 		}
+		ingressBandwidth, egressBandwidth := qos.LimitsFromLabels(ep.Labels)
+		var dscp *proto.DSCP
+		if value, ok := qos.DSCPFromLabels(ep.Labels); ok {
+			dscp = &proto.DSCP{Value: uint32(value)}
+		}
 		buf.pendingUpdates = append(buf.pendingUpdates,
 			&proto.WorkloadEndpointUpdate{
 				Id: &proto.WorkloadEndpointID{
@@ -275,13 +281,19 @@ func (buf *EventBuffer) OnEndpointTierUpdate(endpointKey model.Key,
 				},
 
 				Endpoint: &proto.WorkloadEndpoint{
-					State:      ep.State,
-					Name:       ep.Name,
-					Mac:        mac,
-					ProfileIds: ep.ProfileIDs,
-					Ipv4Nets:   netsToStrings(ep.IPv4Nets),
-					Ipv6Nets:   netsToStrings(ep.IPv6Nets),
-					Tiers:      tiers,
+					State:                 ep.State,
+					Name:                  ep.Name,
+					Mac:                   mac,
+					ProfileIds:            ep.ProfileIDs,
+					Ipv4Nets:              netsToStrings(ep.IPv4Nets),
+					Ipv6Nets:              netsToStrings(ep.IPv6Nets),
+					Tiers:                 tiers,
+					IngressBandwidth:      ingressBandwidth,
+					EgressBandwidth:       egressBandwidth,
+					Dscp:                  dscp,
+					AllowedSourcePrefixes: AllowedSourcePrefixesFromLabels(ep.Labels),
+					MaxConnectionRate:     qos.ConnectionRateFromLabels(ep.Labels),
+					ConntrackZone:         ConntrackZoneFromLabels(ep.Labels),
 				},
 			})
 	case model.HostEndpointKey:
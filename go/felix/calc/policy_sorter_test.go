@@ -17,8 +17,10 @@ package calc_test
 import (
 	. "github.com/projectcalico/felix/go/felix/calc"
 
+	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 )
 
@@ -38,3 +40,38 @@ var _ = DescribeTable("PolKV should stringify correctly",
 		PolKV{Key: model.PolicyKey{"name"}, Value: &model.Policy{Order: &tenPointFive}},
 		"name(10.5)"),
 )
+
+var _ = Describe("PolicySorter", func() {
+	one := 1.0
+	two := 2.0
+
+	sortedNames := func(keys []string) []string {
+		sorter := NewPolicySorter()
+		for _, name := range keys {
+			var policy model.Policy
+			switch name {
+			case "x", "y":
+				policy.Order = &one
+			case "z":
+				policy.Order = &two
+			}
+			sorter.OnUpdate(api.Update{
+				KVPair: model.KVPair{Key: model.PolicyKey{Name: name}, Value: &policy},
+			})
+		}
+		var names []string
+		for _, kv := range sorter.Sorted().OrderedPolicies {
+			names = append(names, kv.Key.Name)
+		}
+		return names
+	}
+
+	It("should sort by order, then name, with missing orders last", func() {
+		Expect(sortedNames([]string{"a", "z", "y", "b", "x"})).To(Equal(
+			[]string{"x", "y", "z", "a", "b"}))
+	})
+	It("should give the same order whatever order the policies arrive in", func() {
+		Expect(sortedNames([]string{"b", "x", "a", "y", "z"})).To(Equal(
+			sortedNames([]string{"z", "a", "y", "x", "b"})))
+	})
+})
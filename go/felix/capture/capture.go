@@ -0,0 +1,257 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The capture package implements on-demand packet captures, for debugging
+// the policy that applies to an endpoint.  A capture temporarily inserts an
+// NFLOG rule at the top of an endpoint or policy chain, writes the packets
+// that the rule copies to userspace to a pcap file and then removes the
+// rule again.
+//
+// The rule is inserted with the iptables binaries, behind the back of the
+// code that owns the chain.  If the chain is rewritten during the capture,
+// the rule is lost and the capture sees no more packets; that's acceptable
+// for a short-lived debugging aid.
+package capture
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxSnaplen is the largest number of bytes of each packet that can be
+// captured, which is also the default.
+const MaxSnaplen = 0xffff
+
+var (
+	ErrCaptureInProgress = errors.New("another capture is in progress")
+	ErrNotSupported      = errors.New("packet capture is not supported on this platform")
+)
+
+// iptablesBinaries are the binaries that the capture rule is inserted with.
+// A chain typically exists for only one of the IP versions, so the capture
+// only fails if it can't be inserted with either of them.
+var iptablesBinaries = []string{"iptables", "ip6tables"}
+
+type Config struct {
+	// Dir is the directory that the pcap files are written to.
+	Dir string
+	// MaxDuration bounds the duration of each capture.
+	MaxDuration time.Duration
+}
+
+// Request describes one capture.
+type Request struct {
+	// Chain is the name of the filter-table chain to capture the packets
+	// of.
+	Chain string
+	// Snaplen is the number of bytes of each packet to capture; zero
+	// means MaxSnaplen.
+	Snaplen uint32
+	// Duration is how long to capture for.
+	Duration time.Duration
+}
+
+// Result describes a capture that completed.
+type Result struct {
+	File    string `json:"file"`
+	Packets int    `json:"packets"`
+}
+
+// Capturer runs captures, one at a time, since they all share the NFLOG
+// group.
+type Capturer struct {
+	config    Config
+	newCmd    cmdshim.NewCmd
+	readNflog nflogReader
+
+	mutex   sync.Mutex
+	running bool
+}
+
+func New(config Config) *Capturer {
+	return NewWithShims(config, cmdshim.NewRealCmd, readNflog)
+}
+
+// NewWithShims is a test constructor that allows for shimming exec.Command
+// and the NFLOG reader.
+func NewWithShims(config Config, cmdShim cmdshim.NewCmd, readerShim nflogReader) *Capturer {
+	return &Capturer{
+		config:    config,
+		newCmd:    cmdShim,
+		readNflog: readerShim,
+	}
+}
+
+// nflogReader binds the given NFLOG group and passes the payload of each
+// packet to the handler until the stop channel is closed or it fails.
+type nflogReader func(group uint16, copyRange uint32, stop <-chan struct{}, handle func(payload []byte)) error
+
+// Capture runs the given capture to completion, which takes the requested
+// duration, and returns the file that it wrote.  It returns
+// ErrCaptureInProgress if another capture is running.
+func (c *Capturer) Capture(req Request) (*Result, error) {
+	if err := c.validate(&req); err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	if c.running {
+		c.mutex.Unlock()
+		return nil, ErrCaptureInProgress
+	}
+	c.running = true
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		c.running = false
+		c.mutex.Unlock()
+	}()
+
+	logCxt := log.WithFields(log.Fields{
+		"chain":    req.Chain,
+		"snaplen":  req.Snaplen,
+		"duration": req.Duration,
+	})
+	if err := os.MkdirAll(c.config.Dir, 0700); err != nil {
+		return nil, err
+	}
+	fileName := filepath.Join(c.config.Dir, fmt.Sprintf("%s-%s.pcap",
+		req.Chain, time.Now().UTC().Format("20060102T150405.000")))
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	writer, err := NewPcapWriter(file, req.Snaplen)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start listening before the rule is inserted so that we don't miss
+	// the first packets.  The handler is only called from the reader's
+	// goroutine, which has finished by the time we read the count.
+	stop := make(chan struct{})
+	readerDone := make(chan error, 1)
+	packets := 0
+	go func() {
+		readerDone <- c.readNflog(rules.NflogCaptureGroup, req.Snaplen, stop, func(payload []byte) {
+			if err := writer.WritePacket(time.Now(), payload); err != nil {
+				logCxt.WithError(err).Warn("Failed to write captured packet")
+				return
+			}
+			packets++
+		})
+	}()
+
+	binaries, err := c.insertRule(req.Chain)
+	if err != nil {
+		close(stop)
+		<-readerDone
+		os.Remove(fileName)
+		return nil, err
+	}
+	logCxt.Info("Started packet capture")
+
+	var readerErr error
+	select {
+	case <-time.After(req.Duration):
+		c.removeRule(req.Chain, binaries)
+		close(stop)
+		readerErr = <-readerDone
+	case readerErr = <-readerDone:
+		// The reader failed early; still remove the rule.
+		c.removeRule(req.Chain, binaries)
+		close(stop)
+	}
+	if readerErr != nil {
+		logCxt.WithError(readerErr).Error("Packet capture failed")
+		return nil, readerErr
+	}
+	logCxt.WithField("packets", packets).Info("Finished packet capture")
+	return &Result{File: fileName, Packets: packets}, nil
+}
+
+func (c *Capturer) validate(req *Request) error {
+	// The chain name is passed to iptables as an argument; make sure it
+	// can't be mistaken for an option.
+	if req.Chain == "" || strings.HasPrefix(req.Chain, "-") {
+		return fmt.Errorf("invalid chain name %q", req.Chain)
+	}
+	if req.Duration <= 0 || req.Duration > c.config.MaxDuration {
+		return fmt.Errorf("duration must be positive and at most %v", c.config.MaxDuration)
+	}
+	if req.Snaplen == 0 || req.Snaplen > MaxSnaplen {
+		req.Snaplen = MaxSnaplen
+	}
+	return nil
+}
+
+// insertRule inserts the capture rule at the top of the chain, with each
+// binary that knows the chain.  It returns the binaries that succeeded.
+func (c *Capturer) insertRule(chain string) ([]string, error) {
+	var binaries []string
+	var lastErr error
+	for _, binary := range iptablesBinaries {
+		output, err := c.newCmd(binary, captureRuleArgs("--insert", chain)...).CombinedOutput()
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"binary": binary,
+				"chain":  chain,
+				"output": string(output),
+			}).Debug("Failed to insert capture rule")
+			lastErr = fmt.Errorf("failed to insert capture rule into %s: %v: %s",
+				chain, err, strings.TrimSpace(string(output)))
+			continue
+		}
+		binaries = append(binaries, binary)
+	}
+	if len(binaries) == 0 {
+		return nil, lastErr
+	}
+	return binaries, nil
+}
+
+func (c *Capturer) removeRule(chain string, binaries []string) {
+	for _, binary := range binaries {
+		output, err := c.newCmd(binary, captureRuleArgs("--delete", chain)...).CombinedOutput()
+		if err != nil {
+			// Most likely, the chain was rewritten, which removed the
+			// rule anyway.
+			log.WithError(err).WithFields(log.Fields{
+				"binary": binary,
+				"chain":  chain,
+				"output": string(output),
+			}).Warn("Failed to remove capture rule")
+		}
+	}
+}
+
+func captureRuleArgs(op, chain string) []string {
+	return []string{
+		"--wait",
+		"--table", "filter",
+		op, chain,
+		"--jump", "NFLOG",
+		"--nflog-group", strconv.Itoa(int(rules.NflogCaptureGroup)),
+		"--nflog-prefix", rules.NflogCapturePrefix,
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/capture"
+
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	insertV4 = "iptables --wait --table filter --insert cali-tw-eth0 --jump NFLOG --nflog-group 4 --nflog-prefix CAPTURE"
+	insertV6 = "ip6tables --wait --table filter --insert cali-tw-eth0 --jump NFLOG --nflog-group 4 --nflog-prefix CAPTURE"
+	deleteV4 = "iptables --wait --table filter --delete cali-tw-eth0 --jump NFLOG --nflog-group 4 --nflog-prefix CAPTURE"
+)
+
+var _ = Describe("Capturer", func() {
+	var dir string
+	var capturer *Capturer
+	var cmdRec *cmdshim.Recorder
+	var reader *fakeReader
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-capture")
+		Expect(err).NotTo(HaveOccurred())
+		cmdRec = &cmdshim.Recorder{FailingCmds: map[string]bool{}}
+		reader = &fakeReader{packets: [][]byte{ipv4Packet(60, 60), ipv4Packet(1500, 100)}}
+		capturer = NewWithShims(Config{
+			Dir:         dir,
+			MaxDuration: time.Second,
+		}, cmdRec.NewCmd, reader.read)
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should capture packets to a pcap file", func() {
+		cmdRec.FailingCmds[insertV6] = true
+		result, err := capturer.Capture(Request{
+			Chain:    "cali-tw-eth0",
+			Snaplen:  64,
+			Duration: 10 * time.Millisecond,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Packets).To(Equal(2))
+		Expect(filepath.Dir(result.File)).To(Equal(dir))
+		Expect(filepath.Base(result.File)).To(HavePrefix("cali-tw-eth0-"))
+		data, err := ioutil.ReadFile(result.File)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(HaveLen(24 + 16 + 60 + 16 + 64))
+
+		Expect(reader.group).To(BeEquivalentTo(4))
+		Expect(reader.copyRange).To(BeEquivalentTo(64))
+		// The rule is only removed with the binary that inserted it.
+		Expect(cmdRec.Commands()).To(Equal([]string{insertV4, insertV6, deleteV4}))
+	})
+	It("should fail if the rule can't be inserted", func() {
+		cmdRec.FailingCmds[insertV4] = true
+		cmdRec.FailingCmds[insertV6] = true
+		_, err := capturer.Capture(Request{Chain: "cali-tw-eth0", Duration: 10 * time.Millisecond})
+		Expect(err).To(HaveOccurred())
+		Expect(cmdRec.Commands()).To(Equal([]string{insertV4, insertV6}))
+		files, _ := ioutil.ReadDir(dir)
+		Expect(files).To(BeEmpty())
+	})
+	It("should remove the rule if the reader fails", func() {
+		reader.err = errors.New("bind failed")
+		_, err := capturer.Capture(Request{Chain: "cali-tw-eth0", Duration: time.Second})
+		Expect(err).To(MatchError("bind failed"))
+		Expect(cmdRec.Commands()).To(ContainElement(deleteV4))
+	})
+	It("should default the snaplen", func() {
+		_, err := capturer.Capture(Request{Chain: "cali-tw-eth0", Duration: 10 * time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reader.copyRange).To(BeEquivalentTo(MaxSnaplen))
+	})
+	It("should reject a concurrent capture", func() {
+		reader.started = make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			capturer.Capture(Request{Chain: "cali-tw-eth0", Duration: 200 * time.Millisecond})
+		}()
+		<-reader.started
+		_, err := capturer.Capture(Request{Chain: "cali-tw-eth0", Duration: 10 * time.Millisecond})
+		Expect(err).To(Equal(ErrCaptureInProgress))
+		<-done
+	})
+	It("should reject a duration over the maximum", func() {
+		_, err := capturer.Capture(Request{Chain: "cali-tw-eth0", Duration: time.Minute})
+		Expect(err).To(HaveOccurred())
+		Expect(cmdRec.Commands()).To(BeEmpty())
+	})
+	It("should reject a chain name that looks like an option", func() {
+		_, err := capturer.Capture(Request{Chain: "--flush", Duration: 10 * time.Millisecond})
+		Expect(err).To(HaveOccurred())
+		Expect(cmdRec.Commands()).To(BeEmpty())
+	})
+})
+
+type fakeReader struct {
+	packets [][]byte
+	err     error
+	started chan struct{}
+
+	group     uint16
+	copyRange uint32
+}
+
+func (r *fakeReader) read(group uint16, copyRange uint32, stop <-chan struct{}, handle func([]byte)) error {
+	r.group = group
+	r.copyRange = copyRange
+	if r.started != nil {
+		close(r.started)
+	}
+	if r.err != nil {
+		return r.err
+	}
+	for _, pkt := range r.packets {
+		handle(pkt)
+	}
+	<-stop
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+const (
+	pcapMagic        = 0xa1b2c3d4
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+	// linkTypeRaw is the pcap link type of packets that start at their IP
+	// header, which is what NFLOG delivers.
+	linkTypeRaw = 101
+
+	pcapRecordHeaderLen = 16
+)
+
+// PcapWriter writes packets to a file in the classic pcap format, which
+// tcpdump and wireshark read.
+type PcapWriter struct {
+	w       io.Writer
+	snaplen uint32
+}
+
+// NewPcapWriter writes the pcap file header to w and returns a writer for the
+// packets.  Packets longer than snaplen should already be truncated.
+func NewPcapWriter(w io.Writer, snaplen uint32) (*PcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:6], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(header[6:8], pcapVersionMinor)
+	// The time zone offset and timestamp accuracy are always zero.
+	binary.LittleEndian.PutUint32(header[16:20], snaplen)
+	binary.LittleEndian.PutUint32(header[20:24], linkTypeRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w, snaplen: snaplen}, nil
+}
+
+// WritePacket writes one packet, which starts at its IP header, with the
+// given capture time.  The packet's original length is taken from its IP
+// header, so that readers can tell when it was truncated.
+func (p *PcapWriter) WritePacket(ts time.Time, data []byte) error {
+	if uint32(len(data)) > p.snaplen {
+		data = data[:p.snaplen]
+	}
+	record := make([]byte, pcapRecordHeaderLen, pcapRecordHeaderLen+len(data))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(originalLength(data)))
+	record = append(record, data...)
+	_, err := p.w.Write(record)
+	return err
+}
+
+// originalLength returns the length of the packet before it was truncated,
+// according to its IP header.  If the header is truncated or isn't IP, it
+// returns the length of the data.
+func originalLength(data []byte) int {
+	length := 0
+	if len(data) >= 4 && data[0]>>4 == 4 {
+		length = int(binary.BigEndian.Uint16(data[2:4]))
+	} else if len(data) >= 6 && data[0]>>4 == 6 {
+		length = 40 + int(binary.BigEndian.Uint16(data[4:6]))
+	}
+	if length < len(data) {
+		return len(data)
+	}
+	return length
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/capture"
+
+	"bytes"
+	"encoding/binary"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+// ipv4Packet returns an IPv4 packet with the given total length in its
+// header, truncated to dataLen bytes.
+func ipv4Packet(totalLen, dataLen int) []byte {
+	pkt := make([]byte, dataLen)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(totalLen))
+	return pkt
+}
+
+var _ = Describe("PcapWriter", func() {
+	var buf *bytes.Buffer
+	var writer *PcapWriter
+	ts := time.Unix(1500000000, 123456000)
+	BeforeEach(func() {
+		buf = &bytes.Buffer{}
+		var err error
+		writer, err = NewPcapWriter(buf, 64)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should write the file header", func() {
+		header := buf.Bytes()
+		Expect(header).To(HaveLen(24))
+		Expect(binary.LittleEndian.Uint32(header[0:4])).To(BeEquivalentTo(0xa1b2c3d4))
+		Expect(binary.LittleEndian.Uint16(header[4:6])).To(BeEquivalentTo(2))
+		Expect(binary.LittleEndian.Uint16(header[6:8])).To(BeEquivalentTo(4))
+		Expect(binary.LittleEndian.Uint32(header[16:20])).To(BeEquivalentTo(64))
+		Expect(binary.LittleEndian.Uint32(header[20:24])).To(BeEquivalentTo(101))
+	})
+	It("should record the original length of a truncated packet", func() {
+		Expect(writer.WritePacket(ts, ipv4Packet(1500, 40))).To(Succeed())
+		record := buf.Bytes()[24:]
+		Expect(record).To(HaveLen(16 + 40))
+		Expect(binary.LittleEndian.Uint32(record[0:4])).To(BeEquivalentTo(1500000000))
+		Expect(binary.LittleEndian.Uint32(record[4:8])).To(BeEquivalentTo(123456))
+		Expect(binary.LittleEndian.Uint32(record[8:12])).To(BeEquivalentTo(40))
+		Expect(binary.LittleEndian.Uint32(record[12:16])).To(BeEquivalentTo(1500))
+	})
+	It("should truncate packets to the snaplen", func() {
+		Expect(writer.WritePacket(ts, ipv4Packet(100, 100))).To(Succeed())
+		record := buf.Bytes()[24:]
+		Expect(record).To(HaveLen(16 + 64))
+		Expect(binary.LittleEndian.Uint32(record[8:12])).To(BeEquivalentTo(64))
+		Expect(binary.LittleEndian.Uint32(record[12:16])).To(BeEquivalentTo(100))
+	})
+	It("should take the length of an IPv6 packet from its payload length", func() {
+		pkt := make([]byte, 48)
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:6], 1000)
+		Expect(writer.WritePacket(ts, pkt)).To(Succeed())
+		Expect(binary.LittleEndian.Uint32(buf.Bytes()[24+12 : 24+16])).To(BeEquivalentTo(1040))
+	})
+	It("should use the data length for non-IP data", func() {
+		Expect(writer.WritePacket(ts, []byte{1, 2, 3})).To(Succeed())
+		Expect(binary.LittleEndian.Uint32(buf.Bytes()[24+12 : 24+16])).To(BeEquivalentTo(3))
+	})
+})
@@ -0,0 +1,336 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The check package compares the live state of the kernel with the state
+// that Felix intends to program, as reported by its debug server, for
+// "calico-felix check".
+//
+// It checks the endpoint chains in the filter table, the members of the IP
+// sets, which it looks for under the names that the dataplane driver gives
+// them, and the routes to local workloads.  Other chains, sets and routes
+// are ignored, since Felix doesn't own them.
+package check
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/debugserver"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"io"
+	"net"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	// IP sets are named by the dataplane driver with a per-family prefix
+	// followed by the IP set ID, truncated so that the name fits in the
+	// kernel's limit.
+	ipSetPrefixV4    = "felix-4-"
+	ipSetPrefixV6    = "felix-6-"
+	maxIPSetIDLength = 24
+	kindChain        = "chain"
+	kindIPSet        = "ipset"
+	kindRoute        = "route"
+)
+
+// Discrepancy is a difference between the live and the intended state.
+type Discrepancy struct {
+	// Kind is "chain", "ipset" or "route".
+	Kind   string
+	Name   string
+	Detail string
+}
+
+func (d Discrepancy) String() string {
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Name, d.Detail)
+}
+
+type Config struct {
+	// IPv6 enables checking of the IPv6 chains, IP sets and routes.
+	IPv6 bool
+	// NewCmdOverride, if non-nil, is used in place of exec.Command.
+	NewCmdOverride func(name string, arg ...string) iptables.CmdIface
+}
+
+type Checker struct {
+	ipVersions []uint8
+	newCmd     func(name string, arg ...string) iptables.CmdIface
+}
+
+func New(config Config) *Checker {
+	c := &Checker{
+		ipVersions: []uint8{4},
+		newCmd:     config.NewCmdOverride,
+	}
+	if config.IPv6 {
+		c.ipVersions = append(c.ipVersions, 6)
+	}
+	if c.newCmd == nil {
+		c.newCmd = func(name string, arg ...string) iptables.CmdIface {
+			return cmdAdapter{exec.Command(name, arg...)}
+		}
+	}
+	return c
+}
+
+type cmdAdapter struct {
+	*exec.Cmd
+}
+
+func (c cmdAdapter) SetStdin(r io.Reader) {
+	c.Stdin = r
+}
+
+// Check reads the live state and returns its differences from intent, sorted
+// by kind and name.  It returns an error if it fails to read the live state.
+func (c *Checker) Check(intent *debugserver.StateDump) ([]Discrepancy, error) {
+	var discrepancies []Discrepancy
+	for _, ipVersion := range c.ipVersions {
+		intent := intent.ForIPVersion(ipVersion)
+		chains, err := c.checkChains(ipVersion, intent)
+		if err != nil {
+			return nil, err
+		}
+		discrepancies = append(discrepancies, chains...)
+		ipSets, err := c.checkIPSets(ipVersion, intent)
+		if err != nil {
+			return nil, err
+		}
+		discrepancies = append(discrepancies, ipSets...)
+		routes, err := c.checkRoutes(ipVersion, intent)
+		if err != nil {
+			return nil, err
+		}
+		discrepancies = append(discrepancies, routes...)
+	}
+	sort.Stable(byKindAndName(discrepancies))
+	return discrepancies, nil
+}
+
+type byKindAndName []Discrepancy
+
+func (d byKindAndName) Len() int { return len(d) }
+func (d byKindAndName) Less(i, j int) bool {
+	if d[i].Kind != d[j].Kind {
+		return d[i].Kind < d[j].Kind
+	}
+	return d[i].Name < d[j].Name
+}
+func (d byKindAndName) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+
+func (c *Checker) run(name string, arg ...string) ([]byte, error) {
+	out, err := c.newCmd(name, arg...).Output()
+	if err != nil {
+		log.WithError(err).WithField("cmd", name).Warn("Failed to read live state")
+		return nil, fmt.Errorf("%s failed: %v", name, err)
+	}
+	return out, nil
+}
+
+func (c *Checker) checkChains(ipVersion uint8, intent *debugserver.StateDump) ([]Discrepancy, error) {
+	cmd := "iptables-save"
+	if ipVersion == 6 {
+		cmd = "ip6tables-save"
+	}
+	out, err := c.run(cmd, "-t", "filter")
+	if err != nil {
+		return nil, err
+	}
+	live := map[string][]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, ":") {
+			name := strings.Fields(line[1:])[0]
+			live[name] = []string{}
+		} else if strings.HasPrefix(line, "-A ") {
+			fields := strings.Fields(line)
+			live[fields[1]] = append(live[fields[1]], line)
+		}
+	}
+
+	var discrepancies []Discrepancy
+	for chainName, rules := range intent.Chains {
+		name := fmt.Sprintf("%s (IPv%d)", chainName, ipVersion)
+		liveRules, ok := live[chainName]
+		if !ok {
+			discrepancies = append(discrepancies, Discrepancy{kindChain, name, "missing"})
+			continue
+		}
+		for i := 0; i < len(rules) || i < len(liveRules); i++ {
+			var detail string
+			switch {
+			case i >= len(liveRules):
+				detail = fmt.Sprintf("rule %d missing: %s", i+1, rules[i])
+			case i >= len(rules):
+				detail = fmt.Sprintf("unexpected rule %d: %s", i+1, liveRules[i])
+			case !rulesEquivalent(rules[i], liveRules[i]):
+				detail = fmt.Sprintf("rule %d differs: expected %s, found %s",
+					i+1, rules[i], liveRules[i])
+			default:
+				continue
+			}
+			discrepancies = append(discrepancies, Discrepancy{kindChain, name, detail})
+		}
+	}
+	return discrepancies, nil
+}
+
+// rulesEquivalent compares an intended rule with a live one.  The live rule
+// may carry a hash comment, which the intended one never does.
+func rulesEquivalent(intended, live string) bool {
+	a, err := iptables.ParseRule(intended)
+	if err != nil {
+		return false
+	}
+	b, err := iptables.ParseRule(live)
+	if err != nil {
+		return false
+	}
+	return a.Chain == b.Chain && reflect.DeepEqual(a.Comment, b.Comment) &&
+		reflect.DeepEqual(iptables.CanonicalArgs(a.Args), iptables.CanonicalArgs(b.Args))
+}
+
+func (c *Checker) checkIPSets(ipVersion uint8, intent *debugserver.StateDump) ([]Discrepancy, error) {
+	out, err := c.run("ipset", "list")
+	if err != nil {
+		return nil, err
+	}
+	live := parseIPSetList(out)
+
+	prefix := ipSetPrefixV4
+	if ipVersion == 6 {
+		prefix = ipSetPrefixV6
+	}
+	var discrepancies []Discrepancy
+	for id, members := range intent.IPSets {
+		if len(id) > maxIPSetIDLength {
+			id = id[:maxIPSetIDLength]
+		}
+		name := prefix + id
+		liveMembers, ok := live[name]
+		if !ok {
+			discrepancies = append(discrepancies, Discrepancy{kindIPSet, name, "missing"})
+			continue
+		}
+		expected := map[string]bool{}
+		for _, member := range members {
+			expected[member] = true
+		}
+		var missing, unexpected []string
+		for member := range expected {
+			if !liveMembers[member] {
+				missing = append(missing, member)
+			}
+		}
+		for member := range liveMembers {
+			if !expected[member] {
+				unexpected = append(unexpected, member)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			discrepancies = append(discrepancies, Discrepancy{kindIPSet, name,
+				"missing members: " + strings.Join(missing, " ")})
+		}
+		if len(unexpected) > 0 {
+			sort.Strings(unexpected)
+			discrepancies = append(discrepancies, Discrepancy{kindIPSet, name,
+				"unexpected members: " + strings.Join(unexpected, " ")})
+		}
+	}
+	return discrepancies, nil
+}
+
+// parseIPSetList parses the output of "ipset list" into the members of each
+// set.
+func parseIPSetList(out []byte) map[string]map[string]bool {
+	sets := map[string]map[string]bool{}
+	var members map[string]bool
+	inMembers := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "Name:"):
+			members = map[string]bool{}
+			sets[strings.TrimSpace(line[len("Name:"):])] = members
+			inMembers = false
+		case line == "Members:":
+			inMembers = true
+		case line == "":
+			inMembers = false
+		case inMembers:
+			// Members may be followed by options such as a timeout.
+			members[strings.Fields(line)[0]] = true
+		}
+	}
+	return sets
+}
+
+func (c *Checker) checkRoutes(ipVersion uint8, intent *debugserver.StateDump) ([]Discrepancy, error) {
+	out, err := c.run("ip", fmt.Sprintf("-%d", ipVersion), "route", "show")
+	if err != nil {
+		return nil, err
+	}
+	live := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] == "default" {
+			continue
+		}
+		for i := 1; i < len(fields)-1; i++ {
+			if fields[i] == "dev" {
+				live[canonicalDst(fields[0])] = fields[i+1]
+				break
+			}
+		}
+	}
+
+	var discrepancies []Discrepancy
+	for _, route := range intent.Routes {
+		dst := canonicalDst(route.Dst)
+		iface, ok := live[dst]
+		switch {
+		case !ok:
+			discrepancies = append(discrepancies, Discrepancy{kindRoute, dst,
+				"missing route via " + route.Interface})
+		case iface != route.Interface:
+			discrepancies = append(discrepancies, Discrepancy{kindRoute, dst,
+				fmt.Sprintf("goes via %s, expected %s", iface, route.Interface)})
+		}
+	}
+	return discrepancies, nil
+}
+
+// canonicalDst converts a route destination to CIDR form; "ip route" omits
+// the prefix length of host routes.
+func canonicalDst(dst string) string {
+	if _, ipNet, err := net.ParseCIDR(dst); err == nil {
+		return ipNet.String()
+	}
+	if ip := net.ParseIP(dst); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32"
+		}
+		return ip.String() + "/128"
+	}
+	return dst
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package check_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/check"
+
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/debugserver"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"io"
+	"strings"
+)
+
+type fakeCmd struct {
+	output string
+	err    error
+}
+
+func (c *fakeCmd) SetStdin(r io.Reader) {}
+
+func (c *fakeCmd) Output() ([]byte, error) {
+	return []byte(c.output), c.err
+}
+
+func (c *fakeCmd) CombinedOutput() ([]byte, error) {
+	return c.Output()
+}
+
+const (
+	iptablesSave = `# Generated by iptables-save
+*filter
+:INPUT ACCEPT [0:0]
+:cali-tw-cali1234 - [0:0]
+:cali-fw-cali1234 - [0:0]
+-A cali-tw-cali1234 -m comment --comment "cali:abcd" -m mark --mark 0x8/0x8 -j RETURN
+-A cali-tw-cali1234 -j DROP
+COMMIT
+`
+	ipsetList = `Name: felix-4-s1
+Type: hash:ip
+Header: family inet hashsize 1024 maxelem 1048576
+Members:
+10.0.0.1
+10.0.0.4
+
+Name: felix-4-s2
+Type: hash:ip
+Members:
+10.0.0.5 timeout 0
+`
+	ipRoute = `default via 192.168.0.1 dev eth0
+10.0.0.1 dev cali1234 scope link
+10.0.0.2 dev eth0 scope link
+`
+)
+
+var _ = Describe("Checker", func() {
+	var outputs map[string]*fakeCmd
+	var cmds []string
+	var checker *Checker
+	var intent *debugserver.StateDump
+
+	BeforeEach(func() {
+		outputs = map[string]*fakeCmd{
+			"iptables-save -t filter": {output: iptablesSave},
+			"ipset list":              {output: ipsetList},
+			"ip -4 route show":        {output: ipRoute},
+		}
+		cmds = nil
+		checker = New(Config{
+			NewCmdOverride: func(name string, arg ...string) iptables.CmdIface {
+				cmd := strings.Join(append([]string{name}, arg...), " ")
+				cmds = append(cmds, cmd)
+				return outputs[cmd]
+			},
+		})
+		intent = &debugserver.StateDump{
+			Chains: map[string][]string{
+				"cali-tw-cali1234": {
+					"-A cali-tw-cali1234 --match mark --mark 0x8/0x8 --jump RETURN",
+					"-A cali-tw-cali1234 --jump DROP",
+				},
+				"cali-fw-cali1234": {},
+			},
+			IPSets: map[string][]string{
+				"s1": {"10.0.0.1", "10.0.0.4", "fd00::1"},
+				"s2": {"10.0.0.5"},
+			},
+			Routes: []debugserver.Route{
+				{Dst: "10.0.0.1/32", Interface: "cali1234"},
+				{Dst: "fd00::1/128", Interface: "cali1234"},
+			},
+		}
+	})
+
+	It("should find no discrepancies if the state matches", func() {
+		Expect(checker.Check(intent)).To(BeEmpty())
+		Expect(cmds).To(Equal([]string{
+			"iptables-save -t filter",
+			"ipset list",
+			"ip -4 route show",
+		}))
+	})
+
+	It("should report missing and differing state", func() {
+		intent.Chains["cali-tw-cali1234"] = []string{
+			"-A cali-tw-cali1234 --jump ACCEPT",
+		}
+		intent.Chains["cali-tw-cali5678"] = []string{}
+		intent.IPSets["s1"] = []string{"10.0.0.1", "10.0.0.3"}
+		intent.IPSets["s3"] = []string{}
+		intent.Routes = append(intent.Routes,
+			debugserver.Route{Dst: "10.0.0.2/32", Interface: "cali5678"},
+			debugserver.Route{Dst: "10.0.0.3/32", Interface: "cali5678"},
+		)
+		Expect(checker.Check(intent)).To(Equal([]Discrepancy{
+			{Kind: "chain", Name: "cali-tw-cali1234 (IPv4)", Detail: "rule 1 differs: expected " +
+				"-A cali-tw-cali1234 --jump ACCEPT, found " +
+				`-A cali-tw-cali1234 -m comment --comment "cali:abcd" -m mark --mark 0x8/0x8 -j RETURN`},
+			{Kind: "chain", Name: "cali-tw-cali1234 (IPv4)", Detail: "unexpected rule 2: -A cali-tw-cali1234 -j DROP"},
+			{Kind: "chain", Name: "cali-tw-cali5678 (IPv4)", Detail: "missing"},
+			{Kind: "ipset", Name: "felix-4-s1", Detail: "missing members: 10.0.0.3"},
+			{Kind: "ipset", Name: "felix-4-s1", Detail: "unexpected members: 10.0.0.4"},
+			{Kind: "ipset", Name: "felix-4-s3", Detail: "missing"},
+			{Kind: "route", Name: "10.0.0.2/32", Detail: "goes via eth0, expected cali5678"},
+			{Kind: "route", Name: "10.0.0.3/32", Detail: "missing route via cali5678"},
+		}))
+	})
+
+	It("should check IPv6 if enabled", func() {
+		checker = New(Config{
+			IPv6: true,
+			NewCmdOverride: func(name string, arg ...string) iptables.CmdIface {
+				cmd := strings.Join(append([]string{name}, arg...), " ")
+				cmds = append(cmds, cmd)
+				if cmd == "ip -6 route show" {
+					return &fakeCmd{output: "fd00::1 dev cali1234 metric 1024\n"}
+				}
+				if cmd == "ip6tables-save -t filter" {
+					return outputs["iptables-save -t filter"]
+				}
+				return outputs[cmd]
+			},
+		})
+		Expect(checker.Check(intent)).To(Equal([]Discrepancy{
+			{Kind: "ipset", Name: "felix-6-s1", Detail: "missing"},
+			{Kind: "ipset", Name: "felix-6-s2", Detail: "missing"},
+		}))
+		Expect(cmds).To(ContainElement("ip6tables-save -t filter"))
+	})
+
+	It("should return an error if a command fails", func() {
+		outputs["ipset list"] = &fakeCmd{err: errors.New("not found")}
+		_, err := checker.Check(intent)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,201 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The cmderrors package classifies the failures of the commands that
+// program the dataplane, such as iptables-restore, ipset and ip, and
+// exports them as metrics, so that a host whose dataplane is persistently
+// broken can be alerted on.
+//
+// Each failure is counted, labelled by command and class, in
+// felix_command_failures, and felix_command_consecutive_failures tracks the
+// number of failures of each command since it last succeeded, per target,
+// such as the table that an iptables-restore was writing.
+package cmderrors
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Class is the class of a command failure.
+type Class string
+
+const (
+	// ClassLock is a failure to get the xtables lock, or an ipset
+	// resource that's busy, which usually clears up on retry.
+	ClassLock Class = "lock"
+	// ClassSyntax is input or arguments that the command rejected, which
+	// usually points at a bug or a missing kernel module.
+	ClassSyntax Class = "syntax"
+	// ClassMissingChain is a reference to a chain, target, match, IP set
+	// or device that doesn't exist.
+	ClassMissingChain Class = "missing-chain"
+	// ClassTimeout is a command that timed out or was killed.
+	ClassTimeout Class = "timeout"
+	// ClassOther is any other failure.
+	ClassOther Class = "other"
+)
+
+// classPatterns maps from lower-case substrings of the commands' output to
+// the class of failure that they indicate.  They're checked in order since,
+// for example, iptables-restore reports a missing chain as well as the line
+// that failed.
+var classPatterns = []struct {
+	pattern string
+	class   Class
+}{
+	{"xtables lock", ClassLock},
+	{"resource temporarily unavailable", ClassLock},
+	{"it is in use", ClassLock},
+	{"no chain/target/match by that name", ClassMissingChain},
+	{"does not exist", ClassMissingChain},
+	{"couldn't load target", ClassMissingChain},
+	{"couldn't load match", ClassMissingChain},
+	{"cannot find device", ClassMissingChain},
+	{"signal: killed", ClassTimeout},
+	{"timed out", ClassTimeout},
+	{"bad argument", ClassSyntax},
+	{"syntax error", ClassSyntax},
+	{"unknown option", ClassSyntax},
+	{"unknown arg", ClassSyntax},
+	{"invalid", ClassSyntax},
+	{": line ", ClassSyntax},
+}
+
+var (
+	countFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_command_failures",
+		Help: "Number of failures of the commands that program the dataplane, by command and class of failure.",
+	}, []string{"command", "class"})
+	gaugeConsecutiveFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "felix_command_consecutive_failures",
+		Help: "Number of failures of each command that programs the dataplane since it last succeeded, by command and target.",
+	}, []string{"command", "target"})
+)
+
+func init() {
+	prometheus.MustRegister(countFailures)
+	prometheus.MustRegister(gaugeConsecutiveFailures)
+}
+
+type commandTarget struct {
+	command string
+	target  string
+}
+
+var (
+	consecutiveLock     sync.Mutex
+	consecutiveFailures = map[commandTarget]int{}
+)
+
+// Error is a classified command failure.  Its message is that of the
+// underlying error, so it can be returned in place of it.
+type Error struct {
+	Command string
+	Class   Class
+	Output  string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Timeout returns true for a failure of class ClassTimeout.
+func (e *Error) Timeout() bool {
+	return e.Class == ClassTimeout
+}
+
+// ClassOf returns the class of the given error, or "" if it isn't an Error.
+func ClassOf(err error) Class {
+	if e, ok := err.(*Error); ok {
+		return e.Class
+	}
+	return ""
+}
+
+// Classify works out the class of a failure from the command's output and
+// error, including the stderr captured by exec.Cmd.Output.  An error that
+// has a Timeout() method returning true, like a net.Error, is a timeout.
+func Classify(output []byte, err error) Class {
+	if t, ok := err.(interface {
+		Timeout() bool
+	}); ok && t.Timeout() {
+		return ClassTimeout
+	}
+	text := string(output) + "\n" + err.Error()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		text += "\n" + string(exitErr.Stderr)
+	}
+	text = strings.ToLower(text)
+	for _, p := range classPatterns {
+		if strings.Contains(text, p.pattern) {
+			return p.class
+		}
+	}
+	return ClassOther
+}
+
+// Record records the result of running the named command against the
+// given target, with the given output.  If err is nil, it resets the
+// consecutive failures of the command and target and returns nil.
+// Otherwise, it counts the failure and returns it as an *Error.
+func Record(command, target string, output []byte, err error) error {
+	key := commandTarget{filepath.Base(command), target}
+	consecutiveLock.Lock()
+	defer consecutiveLock.Unlock()
+	if err == nil {
+		if consecutiveFailures[key] > 0 {
+			log.WithFields(log.Fields{
+				"command": key.command,
+				"target":  key.target,
+			}).Info("Command succeeded after failures")
+			delete(consecutiveFailures, key)
+			gaugeConsecutiveFailures.WithLabelValues(key.command, key.target).Set(0)
+		}
+		return nil
+	}
+	cmdErr, ok := err.(*Error)
+	if !ok {
+		cmdErr = &Error{
+			Command: key.command,
+			Class:   Classify(output, err),
+			Output:  string(output),
+			Err:     err,
+		}
+	}
+	consecutiveFailures[key]++
+	countFailures.WithLabelValues(key.command, string(cmdErr.Class)).Inc()
+	gaugeConsecutiveFailures.WithLabelValues(key.command, key.target).Set(
+		float64(consecutiveFailures[key]))
+	log.WithFields(log.Fields{
+		"command":             key.command,
+		"target":              key.target,
+		"class":               cmdErr.Class,
+		"consecutiveFailures": consecutiveFailures[key],
+	}).Debug("Recorded command failure")
+	return cmdErr
+}
+
+// ConsecutiveFailures returns the number of times that the named command
+// has failed against the target since it last succeeded.
+func ConsecutiveFailures(command, target string) int {
+	consecutiveLock.Lock()
+	defer consecutiveLock.Unlock()
+	return consecutiveFailures[commandTarget{filepath.Base(command), target}]
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmderrors_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/cmderrors"
+
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string { return "i/o timeout" }
+func (timeoutErr) Timeout() bool { return true }
+
+var exitErr = errors.New("exit status 1")
+
+var _ = DescribeTable("Classify",
+	func(output string, err error, expected Class) {
+		Expect(Classify([]byte(output), err)).To(Equal(expected))
+	},
+	Entry("xtables lock",
+		"Another app is currently holding the xtables lock. Perhaps you want to use the -w option?",
+		exitErr, ClassLock),
+	Entry("missing chain",
+		"iptables-restore: line 3 failed\niptables: No chain/target/match by that name.",
+		exitErr, ClassMissingChain),
+	Entry("missing IP set",
+		"ipset v6.29: The set with the given name does not exist",
+		exitErr, ClassMissingChain),
+	Entry("missing device",
+		"Cannot find device \"eth9\"",
+		exitErr, ClassMissingChain),
+	Entry("bad argument",
+		"Bad argument `--foo'\nTry `iptables-restore -h' or 'iptables-restore --help' for more information.",
+		exitErr, ClassSyntax),
+	Entry("failed line",
+		"iptables-restore: line 7 failed",
+		exitErr, ClassSyntax),
+	Entry("ipset syntax error",
+		"ipset v6.29: Syntax error: 'foo' is invalid as number",
+		exitErr, ClassSyntax),
+	Entry("killed", "", errors.New("signal: killed"), ClassTimeout),
+	Entry("timeout error", "", timeoutErr{}, ClassTimeout),
+	Entry("anything else", "out of memory", exitErr, ClassOther),
+)
+
+var _ = Describe("Record", func() {
+	It("should return nil on success", func() {
+		Expect(Record("ipset", "test-success", nil, nil)).To(BeNil())
+		Expect(ConsecutiveFailures("ipset", "test-success")).To(Equal(0))
+	})
+
+	It("should return a classified error with the same message", func() {
+		err := Record("/sbin/iptables-restore", "test-error",
+			[]byte("iptables-restore: line 2 failed"), exitErr)
+		Expect(err).To(MatchError("exit status 1"))
+		Expect(err).To(BeAssignableToTypeOf(&Error{}))
+		Expect(err.(*Error).Command).To(Equal("iptables-restore"))
+		Expect(err.(*Error).Output).To(Equal("iptables-restore: line 2 failed"))
+		Expect(ClassOf(err)).To(Equal(ClassSyntax))
+	})
+
+	It("should count consecutive failures per command and target until a success", func() {
+		Record("ipset", "test-consecutive", nil, exitErr)
+		Record("ipset", "test-consecutive", nil, exitErr)
+		Record("ipset", "test-other", nil, nil)
+		Expect(ConsecutiveFailures("ipset", "test-consecutive")).To(Equal(2))
+		Record("ipset", "test-consecutive", nil, nil)
+		Expect(ConsecutiveFailures("ipset", "test-consecutive")).To(Equal(0))
+	})
+
+	It("should keep the class of an error that's already classified", func() {
+		err := Record("ip", "test-reclassify", nil, &Error{Class: ClassLock, Err: exitErr})
+		Expect(ClassOf(err)).To(Equal(ClassLock))
+	})
+})
+
+var _ = Describe("ClassOf", func() {
+	It("should return empty for an unclassified error", func() {
+		Expect(ClassOf(exitErr)).To(Equal(Class("")))
+	})
+})
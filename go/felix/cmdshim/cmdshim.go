@@ -0,0 +1,46 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// The cmdshim package lets the packages that shell out to the dataplane's
+// command-line tools, such as conntrack, ipset and ip, replace the commands
+// in their tests.  Each package takes a NewCmd in its test constructor and
+// uses NewRealCmd otherwise; Recorder is a fake NewCmd for the tests.
+package cmdshim
+
+import (
+	"io"
+	"os/exec"
+)
+
+// Cmd is the subset of exec.Cmd that the packages use.
+type Cmd interface {
+	SetStdin(r io.Reader)
+	Output() ([]byte, error)
+	CombinedOutput() ([]byte, error)
+}
+
+// NewCmd creates a command, like exec.Command.
+type NewCmd func(name string, arg ...string) Cmd
+
+// NewRealCmd is the NewCmd that runs the commands with exec.Command.
+func NewRealCmd(name string, arg ...string) Cmd {
+	return cmdAdapter{exec.Command(name, arg...)}
+}
+
+type cmdAdapter struct {
+	*exec.Cmd
+}
+
+func (c cmdAdapter) SetStdin(r io.Reader) {
+	c.Stdin = r
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmdshim
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// ErrExitStatus is the error that the Recorder's failing commands return.
+var ErrExitStatus = errors.New("exit status 1")
+
+// Recorder is a fake NewCmd for tests.  It records the command line of each
+// command that it creates, and the input of each command that reads its
+// stdin, and gives each command a canned output.  It's safe to use from
+// several goroutines, but the fields should only be set while no commands
+// are being created.
+type Recorder struct {
+	// Output is the output of every command, unless Outputs has an entry
+	// for its command line.
+	Output  string
+	Outputs map[string]string
+	// FailAll fails every command.  Otherwise, the next NumFailures
+	// commands fail, as do the command lines in FailingCmds.  A failing
+	// command still has its output.
+	FailAll     bool
+	NumFailures int
+	FailingCmds map[string]bool
+
+	lock     sync.Mutex
+	cmdLines []string
+	stdins   []string
+}
+
+// NewCmd records the command line and returns a fake command.  Pass it, as
+// a method value, to the package's test constructor.
+func (r *Recorder) NewCmd(name string, arg ...string) Cmd {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	cmdLine := name + " " + strings.Join(arg, " ")
+	r.cmdLines = append(r.cmdLines, cmdLine)
+	cmd := &fakeCmd{recorder: r, output: r.Output}
+	if output, ok := r.Outputs[cmdLine]; ok {
+		cmd.output = output
+	}
+	switch {
+	case r.FailAll, r.FailingCmds[cmdLine]:
+		cmd.err = ErrExitStatus
+	case r.NumFailures > 0:
+		r.NumFailures--
+		cmd.err = ErrExitStatus
+	}
+	return cmd
+}
+
+// Commands returns the command lines of the commands that have been created
+// since the Recorder was created or last reset.
+func (r *Recorder) Commands() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.cmdLines...)
+}
+
+// Stdins returns the input of each successful command that read its stdin.
+func (r *Recorder) Stdins() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.stdins...)
+}
+
+// Reset forgets the recorded commands and inputs.
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cmdLines = nil
+	r.stdins = nil
+}
+
+type fakeCmd struct {
+	recorder *Recorder
+	output   string
+	err      error
+	stdin    io.Reader
+}
+
+func (c *fakeCmd) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+func (c *fakeCmd) Output() ([]byte, error) {
+	return c.CombinedOutput()
+}
+
+func (c *fakeCmd) CombinedOutput() ([]byte, error) {
+	if c.stdin != nil && c.err == nil {
+		input, _ := ioutil.ReadAll(c.stdin)
+		c.recorder.lock.Lock()
+		c.recorder.stdins = append(c.recorder.stdins, string(input))
+		c.recorder.lock.Unlock()
+	}
+	return []byte(c.output), c.err
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cmdshim_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/cmdshim"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strings"
+)
+
+var _ = Describe("Recorder", func() {
+	var recorder *Recorder
+
+	BeforeEach(func() {
+		recorder = &Recorder{}
+	})
+
+	It("should record the command lines", func() {
+		recorder.NewCmd("ip", "-4", "rule", "show")
+		recorder.NewCmd("nfacct", "list")
+		Expect(recorder.Commands()).To(Equal([]string{"ip -4 rule show", "nfacct list"}))
+		recorder.Reset()
+		Expect(recorder.Commands()).To(BeEmpty())
+	})
+
+	It("should give each command its output", func() {
+		recorder.Output = "default"
+		recorder.Outputs = map[string]string{"ipset list s1": "Members:\n"}
+		output, err := recorder.NewCmd("ipset", "list", "s1").CombinedOutput()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(output)).To(Equal("Members:\n"))
+		output, err = recorder.NewCmd("ipset", "list", "s2").Output()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(output)).To(Equal("default"))
+	})
+
+	It("should fail the next NumFailures commands", func() {
+		recorder.NumFailures = 2
+		recorder.Output = "0 flow entries have been deleted."
+		for i := 0; i < 2; i++ {
+			output, err := recorder.NewCmd("conntrack", "--delete").CombinedOutput()
+			Expect(err).To(Equal(ErrExitStatus))
+			Expect(string(output)).To(Equal("0 flow entries have been deleted."))
+		}
+		_, err := recorder.NewCmd("conntrack", "--delete").CombinedOutput()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should fail the FailingCmds every time", func() {
+		recorder.FailingCmds = map[string]bool{"tc qdisc add": true}
+		for i := 0; i < 2; i++ {
+			_, err := recorder.NewCmd("tc", "qdisc", "add").CombinedOutput()
+			Expect(err).To(HaveOccurred())
+		}
+		_, err := recorder.NewCmd("tc", "qdisc", "del").CombinedOutput()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should fail every command if FailAll is set", func() {
+		recorder.FailAll = true
+		_, err := recorder.NewCmd("ip", "rule", "show").CombinedOutput()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should record the input of successful commands", func() {
+		cmd := recorder.NewCmd("ipset", "restore")
+		cmd.SetStdin(strings.NewReader("create s1 hash:ip\n"))
+		Expect(cmd.CombinedOutput()).To(BeEmpty())
+		recorder.FailAll = true
+		cmd = recorder.NewCmd("ipset", "restore")
+		cmd.SetStdin(strings.NewReader("create s2 hash:ip\n"))
+		cmd.CombinedOutput()
+		Expect(recorder.Stdins()).To(Equal([]string{"create s1 hash:ip\n"}))
+	})
+})
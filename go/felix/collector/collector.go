@@ -0,0 +1,315 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The collector package implements flow logs.  When flow logs are enabled,
+// the endpoint chains send each packet that receives a policy verdict to
+// NFLOG (see the rules package).  The Collector aggregates those packets,
+// along with the conntrack destroy events that carry the final counters of
+// allowed flows, into per-flow records, which it periodically exports to
+// one or more Sinks.
+//
+// Allowed flows are only logged for their first packet, so their packet and
+// byte counts come from conntrack, which requires conntrack accounting
+// (net.netfilter.nf_conntrack_acct) to be enabled.  Without it, allowed
+// flows are reported with the counts of their first packet only.
+//
+// The aggregation table is bounded by Config.MaxFlows; once it is full, new
+// flows are counted, and reported in the log, but not recorded.
+package collector
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"net"
+	"time"
+)
+
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// FlowKey identifies a flow by its protocol, addresses and ports.  IPv4
+// addresses are stored in their 16-byte form.
+type FlowKey struct {
+	Protocol uint8
+	SrcIP    [16]byte
+	DstIP    [16]byte
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+func NewFlowKey(protocol uint8, srcIP, dstIP net.IP, srcPort, dstPort uint16) FlowKey {
+	k := FlowKey{
+		Protocol: protocol,
+		SrcPort:  srcPort,
+		DstPort:  dstPort,
+	}
+	copy(k.SrcIP[:], srcIP.To16())
+	copy(k.DstIP[:], dstIP.To16())
+	return k
+}
+
+func (k FlowKey) String() string {
+	return fmt.Sprintf("%d:%v:%d->%v:%d",
+		k.Protocol, net.IP(k.SrcIP[:]), k.SrcPort, net.IP(k.DstIP[:]), k.DstPort)
+}
+
+// PacketInfo is a packet that was reported by the NFLOG rules.
+type PacketInfo struct {
+	Key       FlowKey
+	Direction string
+	Action    string
+	Rule      string
+	Bytes     uint64
+}
+
+// ConntrackInfo is a conntrack entry that has been destroyed.  Its counters
+// cover both directions of the flow.
+type ConntrackInfo struct {
+	// OrigKey is the flow as sent by the initiator; ReplyKey is the reply
+	// direction, which differs from the reverse of OrigKey if the flow was
+	// NATted.
+	OrigKey  FlowKey
+	ReplyKey FlowKey
+	Packets  uint64
+	Bytes    uint64
+}
+
+// FlowLog is the exported record of a flow over a reporting interval.
+type FlowLog struct {
+	Protocol  uint8     `json:"protocol"`
+	SrcIP     net.IP    `json:"src_ip"`
+	DstIP     net.IP    `json:"dst_ip"`
+	SrcPort   uint16    `json:"src_port"`
+	DstPort   uint16    `json:"dst_port"`
+	Direction string    `json:"direction"`
+	Action    string    `json:"action"`
+	Rule      string    `json:"rule"`
+	Packets   uint64    `json:"packets"`
+	Bytes     uint64    `json:"bytes"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+func (f *FlowLog) String() string {
+	return fmt.Sprintf("protocol=%d src=%v:%d dst=%v:%d direction=%s action=%s rule=%s packets=%d bytes=%d",
+		f.Protocol, f.SrcIP, f.SrcPort, f.DstIP, f.DstPort,
+		f.Direction, f.Action, f.Rule, f.Packets, f.Bytes)
+}
+
+// Sink is a destination for flow logs.
+type Sink interface {
+	Export(flows []*FlowLog) error
+}
+
+type Config struct {
+	// FlushInterval is the interval at which flows are exported.
+	FlushInterval time.Duration
+	// MaxFlows is the maximum number of flows that are tracked at once.
+	MaxFlows int
+	// IdleTimeout is the time after which an allowed flow that hasn't been
+	// seen again, and whose conntrack entry hasn't been destroyed, is
+	// forgotten.
+	IdleTimeout time.Duration
+}
+
+// flowID is the key of the aggregation table.  A flow between two local
+// endpoints is seen in both directions, so the direction is part of the
+// key.
+type flowID struct {
+	key       FlowKey
+	direction string
+}
+
+type flowEntry struct {
+	action string
+	rule   string
+
+	// Counts over the lifetime of the flow and the counts that have
+	// already been exported.
+	packets         uint64
+	bytes           uint64
+	exportedPackets uint64
+	exportedBytes   uint64
+
+	lastSeen time.Time
+	// ended is set once the flow's conntrack entry has been destroyed.
+	ended bool
+}
+
+// Collector aggregates the PacketInfos and ConntrackInfos that are sent to
+// its channels and exports them to its sinks.
+type Collector struct {
+	PacketInfoC    chan *PacketInfo
+	ConntrackInfoC chan *ConntrackInfo
+
+	config Config
+	sinks  []Sink
+
+	flows         map[flowID]*flowEntry
+	intervalStart time.Time
+	// numFlowsDropped is the number of flows that we didn't record in the
+	// current interval because the table was full.
+	numFlowsDropped int
+}
+
+func New(config Config, sinks ...Sink) *Collector {
+	return &Collector{
+		PacketInfoC:    make(chan *PacketInfo, 1000),
+		ConntrackInfoC: make(chan *ConntrackInfo, 1000),
+		config:         config,
+		sinks:          sinks,
+		flows:          map[flowID]*flowEntry{},
+	}
+}
+
+func (c *Collector) Start() {
+	go c.loop()
+}
+
+func (c *Collector) loop() {
+	c.intervalStart = time.Now()
+	flushTicker := time.NewTicker(c.config.FlushInterval)
+	defer flushTicker.Stop()
+	for {
+		select {
+		case pkt := <-c.PacketInfoC:
+			c.onPacket(pkt, time.Now())
+		case ct := <-c.ConntrackInfoC:
+			c.onConntrackDestroy(ct, time.Now())
+		case <-flushTicker.C:
+			c.flush(time.Now())
+		}
+	}
+}
+
+func (c *Collector) onPacket(pkt *PacketInfo, now time.Time) {
+	id := flowID{key: pkt.Key, direction: pkt.Direction}
+	entry := c.flows[id]
+	if entry == nil {
+		if len(c.flows) >= c.config.MaxFlows {
+			c.numFlowsDropped++
+			return
+		}
+		entry = &flowEntry{}
+		c.flows[id] = entry
+	}
+	// The verdict may change if policy changes; report the latest one.
+	entry.action = pkt.Action
+	entry.rule = pkt.Rule
+	entry.packets++
+	entry.bytes += pkt.Bytes
+	entry.lastSeen = now
+	entry.ended = false
+}
+
+func (c *Collector) onConntrackDestroy(ct *ConntrackInfo, now time.Time) {
+	// NFLOG sees packets to a workload after DNAT, so the flow may be
+	// recorded under the original source and the NATted destination,
+	// which is the source of the reply.
+	natKey := ct.OrigKey
+	natKey.DstIP = ct.ReplyKey.SrcIP
+	natKey.DstPort = ct.ReplyKey.SrcPort
+	for _, key := range []FlowKey{ct.OrigKey, natKey} {
+		for _, dir := range []string{DirectionIn, DirectionOut} {
+			entry := c.flows[flowID{key: key, direction: dir}]
+			if entry == nil || entry.ended {
+				continue
+			}
+			// The NFLOG rules may have seen more than just the first
+			// packet; never let the counters go backwards.
+			if ct.Packets > entry.packets {
+				entry.packets = ct.Packets
+			}
+			if ct.Bytes > entry.bytes {
+				entry.bytes = ct.Bytes
+			}
+			entry.lastSeen = now
+			entry.ended = true
+		}
+	}
+}
+
+// flush exports the flows that have been active in the current interval and
+// then forgets any flows that have finished.  Denied flows have no conntrack
+// entry, so they are forgotten as soon as they've been exported.
+func (c *Collector) flush(now time.Time) {
+	var logs []*FlowLog
+	for id, entry := range c.flows {
+		if entry.packets > entry.exportedPackets {
+			logs = append(logs, &FlowLog{
+				Protocol:  id.key.Protocol,
+				SrcIP:     net.IP(append([]byte(nil), id.key.SrcIP[:]...)),
+				DstIP:     net.IP(append([]byte(nil), id.key.DstIP[:]...)),
+				SrcPort:   id.key.SrcPort,
+				DstPort:   id.key.DstPort,
+				Direction: id.direction,
+				Action:    entry.action,
+				Rule:      entry.rule,
+				Packets:   entry.packets - entry.exportedPackets,
+				Bytes:     entry.bytes - entry.exportedBytes,
+				StartTime: c.intervalStart,
+				EndTime:   now,
+			})
+			entry.exportedPackets = entry.packets
+			entry.exportedBytes = entry.bytes
+		}
+		if entry.ended || entry.action == ActionDeny ||
+			now.Sub(entry.lastSeen) > c.config.IdleTimeout {
+			delete(c.flows, id)
+		}
+	}
+	if c.numFlowsDropped > 0 {
+		log.WithFields(log.Fields{
+			"numDropped": c.numFlowsDropped,
+			"maxFlows":   c.config.MaxFlows,
+		}).Warn("Flow log table was full, some flows were not logged")
+		c.numFlowsDropped = 0
+	}
+	c.intervalStart = now
+
+	if len(logs) == 0 {
+		return
+	}
+	log.WithField("numFlows", len(logs)).Debug("Exporting flow logs")
+	for _, sink := range c.sinks {
+		if err := sink.Export(logs); err != nil {
+			// Flow logs are best-effort; we don't retry since the
+			// next interval's logs would pile up behind them.
+			log.WithError(err).Warn("Failed to export flow logs")
+		}
+	}
+}
+
+// packetInfoFromPrefix fills in the verdict of a packet from its NFLOG
+// prefix.  Returns false if the prefix isn't one of ours.
+func packetInfoFromPrefix(pkt *PacketInfo, prefix string) bool {
+	action, rule, ok := rules.ParseNflogPrefix(prefix)
+	if !ok {
+		return false
+	}
+	switch action {
+	case rules.NflogActionAllow:
+		pkt.Action = ActionAllow
+	case rules.NflogActionDeny:
+		pkt.Action = ActionDeny
+	}
+	pkt.Rule = rule
+	return true
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/collector"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"sync"
+	"time"
+)
+
+type recordingSink struct {
+	lock  sync.Mutex
+	flows []*FlowLog
+}
+
+func (s *recordingSink) Export(flows []*FlowLog) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flows = append(s.flows, flows...)
+	return nil
+}
+
+// Flows returns and clears the flows that have been exported so far.
+func (s *recordingSink) Flows() []*FlowLog {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	flows := s.flows
+	s.flows = nil
+	return flows
+}
+
+var (
+	clientIP   = net.ParseIP("10.0.0.1")
+	workloadIP = net.ParseIP("10.0.0.2")
+	serviceIP  = net.ParseIP("172.16.0.1")
+
+	flowKey = NewFlowKey(6, clientIP, workloadIP, 32000, 80)
+)
+
+var _ = Describe("Collector", func() {
+	var sink *recordingSink
+	var collector *Collector
+
+	startCollector := func(maxFlows int) {
+		sink = &recordingSink{}
+		collector = New(Config{
+			FlushInterval: 20 * time.Millisecond,
+			MaxFlows:      maxFlows,
+			IdleTimeout:   time.Hour,
+		}, sink)
+		collector.Start()
+	}
+	allowed := func(key FlowKey) *PacketInfo {
+		return &PacketInfo{
+			Key:       key,
+			Direction: DirectionIn,
+			Action:    ActionAllow,
+			Rule:      "policy/default/pol1",
+			Bytes:     60,
+		}
+	}
+	denied := func(key FlowKey) *PacketInfo {
+		return &PacketInfo{
+			Key:       key,
+			Direction: DirectionIn,
+			Action:    ActionDeny,
+			Rule:      "tier/default",
+			Bytes:     100,
+		}
+	}
+	// flowsEventually waits for the next non-empty export.
+	flowsEventually := func() []*FlowLog {
+		var flows []*FlowLog
+		Eventually(func() []*FlowLog {
+			flows = sink.Flows()
+			return flows
+		}).ShouldNot(BeEmpty())
+		return flows
+	}
+
+	BeforeEach(func() {
+		startCollector(100)
+	})
+
+	It("should export an allowed flow", func() {
+		collector.PacketInfoC <- allowed(flowKey)
+		flows := flowsEventually()
+		Expect(flows).To(HaveLen(1))
+		Expect(flows[0].Protocol).To(BeNumerically("==", 6))
+		Expect(flows[0].SrcIP.Equal(clientIP)).To(BeTrue())
+		Expect(flows[0].DstIP.Equal(workloadIP)).To(BeTrue())
+		Expect(flows[0].SrcPort).To(BeNumerically("==", 32000))
+		Expect(flows[0].DstPort).To(BeNumerically("==", 80))
+		Expect(flows[0].Direction).To(Equal(DirectionIn))
+		Expect(flows[0].Action).To(Equal(ActionAllow))
+		Expect(flows[0].Rule).To(Equal("policy/default/pol1"))
+		Expect(flows[0].Packets).To(BeNumerically("==", 1))
+		Expect(flows[0].Bytes).To(BeNumerically("==", 60))
+		Expect(flows[0].EndTime).To(BeTemporally(">", flows[0].StartTime))
+	})
+	It("should aggregate denied packets", func() {
+		collector.PacketInfoC <- denied(flowKey)
+		collector.PacketInfoC <- denied(flowKey)
+		flows := flowsEventually()
+		if len(flows) == 1 && flows[0].Packets == 1 {
+			// Raced with a flush.
+			flows = append(flows, flowsEventually()...)
+		}
+		var packets, bytes uint64
+		for _, flow := range flows {
+			Expect(flow.Action).To(Equal(ActionDeny))
+			packets += flow.Packets
+			bytes += flow.Bytes
+		}
+		Expect(packets).To(BeNumerically("==", 2))
+		Expect(bytes).To(BeNumerically("==", 200))
+	})
+	It("should export the remaining counts when conntrack reports the end of a flow", func() {
+		collector.PacketInfoC <- allowed(flowKey)
+		Expect(flowsEventually()[0].Packets).To(BeNumerically("==", 1))
+		collector.ConntrackInfoC <- &ConntrackInfo{
+			OrigKey:  flowKey,
+			ReplyKey: NewFlowKey(6, workloadIP, clientIP, 80, 32000),
+			Packets:  10,
+			Bytes:    5000,
+		}
+		flows := flowsEventually()
+		Expect(flows).To(HaveLen(1))
+		Expect(flows[0].Packets).To(BeNumerically("==", 9))
+		Expect(flows[0].Bytes).To(BeNumerically("==", 4940))
+		// The flow is then forgotten.
+		collector.ConntrackInfoC <- &ConntrackInfo{OrigKey: flowKey, Packets: 20}
+		Consistently(sink.Flows, "60ms").Should(BeEmpty())
+	})
+	It("should match conntrack events for NATted flows", func() {
+		// The client connected to the service IP, which was DNATted
+		// to the workload.
+		collector.PacketInfoC <- allowed(flowKey)
+		Expect(flowsEventually()[0].Packets).To(BeNumerically("==", 1))
+		collector.ConntrackInfoC <- &ConntrackInfo{
+			OrigKey:  NewFlowKey(6, clientIP, serviceIP, 32000, 8080),
+			ReplyKey: NewFlowKey(6, workloadIP, clientIP, 80, 32000),
+			Packets:  10,
+			Bytes:    5000,
+		}
+		Expect(flowsEventually()[0].Packets).To(BeNumerically("==", 9))
+	})
+	It("should ignore conntrack events for unknown flows", func() {
+		collector.ConntrackInfoC <- &ConntrackInfo{OrigKey: flowKey, Packets: 20}
+		Consistently(sink.Flows, "60ms").Should(BeEmpty())
+	})
+
+	Describe("with a full table", func() {
+		BeforeEach(func() {
+			startCollector(1)
+		})
+
+		It("should drop new flows", func() {
+			collector.PacketInfoC <- allowed(flowKey)
+			collector.PacketInfoC <- allowed(NewFlowKey(17, clientIP, workloadIP, 53, 53))
+			flows := flowsEventually()
+			Expect(flows).To(HaveLen(1))
+			Expect(flows[0].Protocol).To(BeNumerically("==", 6))
+		})
+	})
+})
@@ -0,0 +1,228 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/projectcalico/felix/go/felix/nfnetlink"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"net"
+)
+
+// Conntrack netlink constants, from the linux/netfilter/nfnetlink_conntrack.h
+// header.
+const (
+	ctDeleteMsgType = nfnetlink.SubsysCTNetlink<<8 | 2
+
+	// ctDestroyGroups is the netlink multicast group mask for conntrack
+	// destroy events (NFNLGRP_CONNTRACK_DESTROY).
+	ctDestroyGroups = 1 << (3 - 1)
+
+	ctaTupleOrig     = 1
+	ctaTupleReply    = 2
+	ctaCountersOrig  = 9
+	ctaCountersReply = 10
+	ctaTupleIP       = 1
+	ctaTupleProto    = 2
+	ctaIPv4Src       = 1
+	ctaIPv4Dst       = 2
+	ctaIPv6Src       = 3
+	ctaIPv6Dst       = 4
+	ctaProtoNum      = 1
+	ctaProtoSrcPort  = 2
+	ctaProtoDstPort  = 3
+	ctaCountersPkts  = 1
+	ctaCountersBytes = 2
+
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+)
+
+var (
+	ErrTruncated     = nfnetlink.ErrTruncated
+	ErrMissingAttr   = nfnetlink.ErrMissingAttr
+	ErrUnknownGroup  = errors.New("NFLOG group isn't one of Felix's")
+	ErrUnknownPrefix = errors.New("NFLOG prefix isn't one of Felix's")
+	ErrNotIP         = errors.New("packet isn't IPv4 or IPv6")
+)
+
+// ParseNflogPacket parses an NFLOG packet message, without its netlink
+// header, into a PacketInfo.
+func ParseNflogPacket(data []byte) (*PacketInfo, error) {
+	nflogPkt, err := nfnetlink.ParseNflogPacket(data)
+	if err != nil {
+		return nil, err
+	}
+	return packetInfoFromNflog(nflogPkt)
+}
+
+func packetInfoFromNflog(nflogPkt *nfnetlink.NflogPacket) (*PacketInfo, error) {
+	pkt := &PacketInfo{}
+	switch nflogPkt.Group {
+	case rules.NflogInboundGroup:
+		pkt.Direction = DirectionIn
+	case rules.NflogOutboundGroup:
+		pkt.Direction = DirectionOut
+	default:
+		return nil, ErrUnknownGroup
+	}
+	if !packetInfoFromPrefix(pkt, nflogPkt.Prefix) {
+		return nil, ErrUnknownPrefix
+	}
+	var err error
+	pkt.Key, pkt.Bytes, err = parseIPHeaders(nflogPkt.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// parseIPHeaders extracts the flow key and the length of the packet from
+// the start of an IP packet.  NFLOG may only give us the first few bytes of
+// the packet so the length comes from the IP header.
+func parseIPHeaders(b []byte) (key FlowKey, length uint64, err error) {
+	if len(b) < 1 {
+		err = ErrTruncated
+		return
+	}
+	var protocol uint8
+	var srcIP, dstIP net.IP
+	var l4 []byte
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			err = ErrTruncated
+			return
+		}
+		headerLen := int(b[0]&0xf) * 4
+		if headerLen < 20 || len(b) < headerLen {
+			err = ErrTruncated
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(b[2:4]))
+		protocol = b[9]
+		srcIP = net.IP(b[12:16])
+		dstIP = net.IP(b[16:20])
+		l4 = b[headerLen:]
+	case 6:
+		if len(b) < 40 {
+			err = ErrTruncated
+			return
+		}
+		// We don't follow extension headers, so flows that use them
+		// are logged without ports.
+		length = uint64(binary.BigEndian.Uint16(b[4:6])) + 40
+		protocol = b[6]
+		srcIP = net.IP(b[8:24])
+		dstIP = net.IP(b[24:40])
+		l4 = b[40:]
+	default:
+		err = ErrNotIP
+		return
+	}
+	var srcPort, dstPort uint16
+	if (protocol == ipProtoTCP || protocol == ipProtoUDP) && len(l4) >= 4 {
+		srcPort = binary.BigEndian.Uint16(l4[0:2])
+		dstPort = binary.BigEndian.Uint16(l4[2:4])
+	}
+	key = NewFlowKey(protocol, srcIP, dstIP, srcPort, dstPort)
+	return
+}
+
+// ParseConntrackDestroy parses a conntrack destroy event, without its
+// netlink header, into a ConntrackInfo.
+func ParseConntrackDestroy(data []byte) (*ConntrackInfo, error) {
+	if len(data) < nfnetlink.GenMsgLen {
+		return nil, ErrTruncated
+	}
+	attrs, err := nfnetlink.ParseAttrs(data[nfnetlink.GenMsgLen:])
+	if err != nil {
+		return nil, err
+	}
+	info := &ConntrackInfo{}
+	if info.OrigKey, err = parseTuple(attrs[ctaTupleOrig]); err != nil {
+		return nil, err
+	}
+	if info.ReplyKey, err = parseTuple(attrs[ctaTupleReply]); err != nil {
+		return nil, err
+	}
+	// The counters are only present if conntrack accounting is enabled.
+	for _, attrType := range []uint16{ctaCountersOrig, ctaCountersReply} {
+		counters, ok := attrs[attrType]
+		if !ok {
+			continue
+		}
+		counterAttrs, err := nfnetlink.ParseAttrs(counters)
+		if err != nil {
+			return nil, err
+		}
+		info.Packets += uint64Attr(counterAttrs[ctaCountersPkts])
+		info.Bytes += uint64Attr(counterAttrs[ctaCountersBytes])
+	}
+	return info, nil
+}
+
+func parseTuple(b []byte) (key FlowKey, err error) {
+	if b == nil {
+		err = ErrMissingAttr
+		return
+	}
+	attrs, err := nfnetlink.ParseAttrs(b)
+	if err != nil {
+		return
+	}
+	ipAttrs, err := nfnetlink.ParseAttrs(attrs[ctaTupleIP])
+	if err != nil {
+		return
+	}
+	protoAttrs, err := nfnetlink.ParseAttrs(attrs[ctaTupleProto])
+	if err != nil {
+		return
+	}
+	srcIP, dstIP := ipAttrs[ctaIPv4Src], ipAttrs[ctaIPv4Dst]
+	if srcIP == nil {
+		srcIP, dstIP = ipAttrs[ctaIPv6Src], ipAttrs[ctaIPv6Dst]
+	}
+	protocol := protoAttrs[ctaProtoNum]
+	if srcIP == nil || dstIP == nil || len(protocol) != 1 {
+		err = ErrMissingAttr
+		return
+	}
+	key = NewFlowKey(
+		protocol[0],
+		net.IP(srcIP),
+		net.IP(dstIP),
+		uint16Attr(protoAttrs[ctaProtoSrcPort]),
+		uint16Attr(protoAttrs[ctaProtoDstPort]),
+	)
+	return
+}
+
+// uint16Attr decodes a big-endian attribute, returning 0 if it's missing.
+func uint16Attr(b []byte) uint16 {
+	if len(b) != 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// uint64Attr decodes a big-endian attribute, returning 0 if it's missing.
+func uint64Attr(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
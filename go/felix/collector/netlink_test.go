@@ -0,0 +1,214 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/collector"
+
+	"encoding/binary"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+)
+
+// attr encodes a netlink attribute.  The tests assume a little-endian host.
+func attr(attrType uint16, value []byte) []byte {
+	b := make([]byte, 4, 4+len(value)+3)
+	binary.LittleEndian.PutUint16(b[0:2], uint16(4+len(value)))
+	binary.LittleEndian.PutUint16(b[2:4], attrType)
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func nested(attrType uint16, attrs ...[]byte) []byte {
+	var value []byte
+	for _, a := range attrs {
+		value = append(value, a...)
+	}
+	return attr(attrType, value)
+}
+
+func nfGenMsg(family uint8, resID uint16) []byte {
+	return []byte{family, 0, byte(resID >> 8), byte(resID)}
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func be64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func message(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// ipv4TCPHeaders returns the IP and TCP headers of a 1000-byte packet from
+// 10.0.0.1:32000 to 10.0.0.2:80.
+func ipv4TCPHeaders() []byte {
+	b := make([]byte, 40)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], 1000)
+	b[9] = 6
+	copy(b[12:16], []byte{10, 0, 0, 1})
+	copy(b[16:20], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(b[20:22], 32000)
+	binary.BigEndian.PutUint16(b[22:24], 80)
+	return b
+}
+
+var _ = Describe("ParseNflogPacket", func() {
+	const (
+		nfulaPacketHdr = 1
+		nfulaPayload   = 9
+		nfulaPrefix    = 10
+	)
+
+	It("should parse an IPv4 TCP packet", func() {
+		pkt, err := ParseNflogPacket(message(
+			nfGenMsg(2, 1),
+			attr(nfulaPacketHdr, []byte{0x08, 0x00, 1, 0}),
+			attr(nfulaPrefix, []byte("A|policy/default/pol1\x00")),
+			attr(nfulaPayload, ipv4TCPHeaders()),
+		))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*pkt).To(Equal(PacketInfo{
+			Key:       NewFlowKey(6, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 32000, 80),
+			Direction: DirectionIn,
+			Action:    ActionAllow,
+			Rule:      "policy/default/pol1",
+			Bytes:     1000,
+		}))
+	})
+	It("should parse an IPv6 UDP packet", func() {
+		payload := make([]byte, 48)
+		payload[0] = 0x60
+		binary.BigEndian.PutUint16(payload[4:6], 60)
+		payload[6] = 17
+		copy(payload[8:24], net.ParseIP("fd00::1"))
+		copy(payload[24:40], net.ParseIP("fd00::2"))
+		binary.BigEndian.PutUint16(payload[40:42], 5353)
+		binary.BigEndian.PutUint16(payload[42:44], 53)
+		pkt, err := ParseNflogPacket(message(
+			nfGenMsg(10, 2),
+			attr(nfulaPrefix, []byte("D|profiles\x00")),
+			attr(nfulaPayload, payload),
+		))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*pkt).To(Equal(PacketInfo{
+			Key:       NewFlowKey(17, net.ParseIP("fd00::1"), net.ParseIP("fd00::2"), 5353, 53),
+			Direction: DirectionOut,
+			Action:    ActionDeny,
+			Rule:      "profiles",
+			Bytes:     100,
+		}))
+	})
+	It("should reject other groups", func() {
+		_, err := ParseNflogPacket(message(
+			nfGenMsg(2, 5),
+			attr(nfulaPrefix, []byte("A|profiles\x00")),
+			attr(nfulaPayload, ipv4TCPHeaders()),
+		))
+		Expect(err).To(Equal(ErrUnknownGroup))
+	})
+	It("should reject other prefixes", func() {
+		_, err := ParseNflogPacket(message(
+			nfGenMsg(2, 1),
+			attr(nfulaPrefix, []byte("calico-drop\x00")),
+			attr(nfulaPayload, ipv4TCPHeaders()),
+		))
+		Expect(err).To(Equal(ErrUnknownPrefix))
+	})
+	It("should reject a missing payload", func() {
+		_, err := ParseNflogPacket(message(
+			nfGenMsg(2, 1),
+			attr(nfulaPrefix, []byte("A|profiles\x00")),
+		))
+		Expect(err).To(Equal(ErrMissingAttr))
+	})
+	It("should reject a truncated payload", func() {
+		_, err := ParseNflogPacket(message(
+			nfGenMsg(2, 1),
+			attr(nfulaPrefix, []byte("A|profiles\x00")),
+			attr(nfulaPayload, ipv4TCPHeaders()[:10]),
+		))
+		Expect(err).To(Equal(ErrTruncated))
+	})
+	It("should reject a truncated attribute", func() {
+		msg := message(
+			nfGenMsg(2, 1),
+			attr(nfulaPrefix, []byte("A|profiles\x00")),
+		)
+		_, err := ParseNflogPacket(msg[:len(msg)-4])
+		Expect(err).To(Equal(ErrTruncated))
+	})
+})
+
+var _ = Describe("ParseConntrackDestroy", func() {
+	tuple := func(attrType uint16, src, dst net.IP, srcPort, dstPort uint16) []byte {
+		return nested(attrType,
+			nested(1, attr(1, src.To4()), attr(2, dst.To4())),
+			nested(2, attr(1, []byte{6}), attr(2, be16(srcPort)), attr(3, be16(dstPort))),
+		)
+	}
+	clientIP := net.ParseIP("10.0.0.1")
+	serviceIP := net.ParseIP("172.16.0.1")
+	workloadIP := net.ParseIP("10.0.0.2")
+
+	It("should parse the tuples and sum the counters", func() {
+		info, err := ParseConntrackDestroy(message(
+			nfGenMsg(2, 0),
+			tuple(1, clientIP, serviceIP, 32000, 8080),
+			tuple(2, workloadIP, clientIP, 80, 32000),
+			nested(9, attr(1, be64(6)), attr(2, be64(600))),
+			nested(10, attr(1, be64(4)), attr(2, be64(4000))),
+		))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*info).To(Equal(ConntrackInfo{
+			OrigKey:  NewFlowKey(6, clientIP, serviceIP, 32000, 8080),
+			ReplyKey: NewFlowKey(6, workloadIP, clientIP, 80, 32000),
+			Packets:  10,
+			Bytes:    4600,
+		}))
+	})
+	It("should handle missing counters", func() {
+		info, err := ParseConntrackDestroy(message(
+			nfGenMsg(2, 0),
+			tuple(1, clientIP, workloadIP, 32000, 80),
+			tuple(2, workloadIP, clientIP, 80, 32000),
+		))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Packets).To(BeZero())
+	})
+	It("should reject a missing tuple", func() {
+		_, err := ParseConntrackDestroy(message(
+			nfGenMsg(2, 0),
+			tuple(1, clientIP, workloadIP, 32000, 80),
+		))
+		Expect(err).To(Equal(ErrMissingAttr))
+	})
+})
@@ -0,0 +1,45 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import "errors"
+
+var ErrNotSupported = errors.New("flow logs are only supported on Linux")
+
+// NflogReader reads the packets that the NFLOG rules send to the given
+// groups and sends them, as PacketInfos, to its output channel.
+type NflogReader struct {
+	groups []uint16
+	output chan<- *PacketInfo
+}
+
+func NewNflogReader(groups []uint16, output chan<- *PacketInfo) *NflogReader {
+	return &NflogReader{
+		groups: groups,
+		output: output,
+	}
+}
+
+// ConntrackReader reads conntrack destroy events and sends them, as
+// ConntrackInfos, to its output channel.
+type ConntrackReader struct {
+	output chan<- *ConntrackInfo
+}
+
+func NewConntrackReader(output chan<- *ConntrackInfo) *ConntrackReader {
+	return &ConntrackReader{
+		output: output,
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/nfnetlink"
+)
+
+// nflogCopyRange is the number of bytes of each packet that we ask NFLOG
+// for; enough for the IPv6 header and the ports.
+const nflogCopyRange = 128
+
+// Run binds the NFLOG groups and then reads packets until it fails.
+func (r *NflogReader) Run() error {
+	return nfnetlink.ReadNflog(r.groups, nflogCopyRange, func(nflogPkt *nfnetlink.NflogPacket) {
+		pkt, err := packetInfoFromNflog(nflogPkt)
+		if err != nil {
+			log.WithError(err).Debug("Ignoring NFLOG packet")
+			return
+		}
+		r.output <- pkt
+	})
+}
+
+// Run subscribes to conntrack destroy events and then reads them until it
+// fails.
+func (r *ConntrackReader) Run() error {
+	sock, err := nfnetlink.OpenSocket(ctDestroyGroups)
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+	log.Info("Listening for conntrack destroy events")
+
+	return sock.Receive(func(msgType uint16, data []byte) {
+		if msgType != ctDeleteMsgType {
+			return
+		}
+		info, err := ParseConntrackDestroy(data)
+		if err != nil {
+			log.WithError(err).Debug("Ignoring conntrack event")
+			return
+		}
+		r.output <- info
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"os"
+	"time"
+)
+
+// grpcExportTimeout is the time allowed for each report to the gRPC
+// collector.
+const grpcExportTimeout = 10 * time.Second
+
+// FileSink appends flow logs to a file, as one JSON object per line.  The
+// file is reopened for each export so that it can be rotated.
+type FileSink struct {
+	path string
+}
+
+func NewFileSink(path string) *FileSink {
+	return &FileSink{
+		path: path,
+	}
+}
+
+func (s *FileSink) Export(flows []*FlowLog) (err error) {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, flow := range flows {
+		if err = encoder.Encode(flow); err != nil {
+			return
+		}
+	}
+	err = w.Flush()
+	return
+}
+
+// GRPCSink reports flow logs to a remote collector that implements the
+// FlowLogs gRPC service.
+type GRPCSink struct {
+	hostname string
+	client   proto.FlowLogsClient
+}
+
+func NewGRPCSink(addr, hostname string) (*GRPCSink, error) {
+	// Dial doesn't block; if the collector isn't up yet, the connection
+	// is retried in the background.
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		log.WithError(err).WithField("addr", addr).Error(
+			"Failed to create flow log collector client")
+		return nil, err
+	}
+	return NewGRPCSinkWithClient(proto.NewFlowLogsClient(conn), hostname), nil
+}
+
+// NewGRPCSinkWithClient is a test constructor that allows for shimming the
+// gRPC client.
+func NewGRPCSinkWithClient(client proto.FlowLogsClient, hostname string) *GRPCSink {
+	return &GRPCSink{
+		hostname: hostname,
+		client:   client,
+	}
+}
+
+func (s *GRPCSink) Export(flows []*FlowLog) error {
+	report := &proto.FlowLogReport{
+		Hostname: s.hostname,
+		Flows:    make([]*proto.FlowLog, len(flows)),
+	}
+	for i, flow := range flows {
+		report.Flows[i] = &proto.FlowLog{
+			Protocol:  int32(flow.Protocol),
+			SrcIp:     flow.SrcIP.String(),
+			DstIp:     flow.DstIP.String(),
+			SrcPort:   int32(flow.SrcPort),
+			DstPort:   int32(flow.DstPort),
+			Direction: flow.Direction,
+			Action:    flow.Action,
+			Rule:      flow.Rule,
+			Packets:   flow.Packets,
+			Bytes:     flow.Bytes,
+			StartTime: flow.StartTime.Unix(),
+			EndTime:   flow.EndTime.Unix(),
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grpcExportTimeout)
+	defer cancel()
+	_, err := s.client.Report(ctx, report)
+	return err
+}
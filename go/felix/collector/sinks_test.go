@@ -0,0 +1,115 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/collector"
+
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var testFlow = &FlowLog{
+	Protocol:  6,
+	SrcIP:     net.ParseIP("10.0.0.1"),
+	DstIP:     net.ParseIP("10.0.0.2"),
+	SrcPort:   32000,
+	DstPort:   80,
+	Direction: DirectionIn,
+	Action:    ActionAllow,
+	Rule:      "policy/default/pol1",
+	Packets:   10,
+	Bytes:     5000,
+	StartTime: time.Unix(1000, 0),
+	EndTime:   time.Unix(1300, 0),
+}
+
+var _ = Describe("FileSink", func() {
+	var dir string
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "flowlogs")
+		Expect(err).NotTo(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should append one JSON object per flow", func() {
+		file := path.Join(dir, "flows.log")
+		sink := NewFileSink(file)
+		Expect(sink.Export([]*FlowLog{testFlow})).To(Succeed())
+		Expect(sink.Export([]*FlowLog{testFlow})).To(Succeed())
+
+		data, err := ioutil.ReadFile(file)
+		Expect(err).NotTo(HaveOccurred())
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		Expect(lines).To(HaveLen(2))
+		var decoded map[string]interface{}
+		Expect(json.Unmarshal([]byte(lines[0]), &decoded)).To(Succeed())
+		Expect(decoded["src_ip"]).To(Equal("10.0.0.1"))
+		Expect(decoded["dst_port"]).To(BeNumerically("==", 80))
+		Expect(decoded["action"]).To(Equal("allow"))
+		Expect(decoded["bytes"]).To(BeNumerically("==", 5000))
+	})
+	It("should fail if the directory doesn't exist", func() {
+		sink := NewFileSink(path.Join(dir, "missing", "flows.log"))
+		Expect(sink.Export([]*FlowLog{testFlow})).NotTo(Succeed())
+	})
+})
+
+type mockFlowLogsClient struct {
+	reports []*proto.FlowLogReport
+}
+
+func (c *mockFlowLogsClient) Report(ctx context.Context, in *proto.FlowLogReport, opts ...grpc.CallOption) (*proto.FlowLogReportResult, error) {
+	c.reports = append(c.reports, in)
+	return &proto.FlowLogReportResult{}, nil
+}
+
+var _ = Describe("GRPCSink", func() {
+	It("should report the flows", func() {
+		client := &mockFlowLogsClient{}
+		sink := NewGRPCSinkWithClient(client, "host1")
+		Expect(sink.Export([]*FlowLog{testFlow})).To(Succeed())
+		Expect(client.reports).To(Equal([]*proto.FlowLogReport{{
+			Hostname: "host1",
+			Flows: []*proto.FlowLog{{
+				Protocol:  6,
+				SrcIp:     "10.0.0.1",
+				DstIp:     "10.0.0.2",
+				SrcPort:   32000,
+				DstPort:   80,
+				Direction: "in",
+				Action:    "allow",
+				Rule:      "policy/default/pol1",
+				Packets:   10,
+				Bytes:     5000,
+				StartTime: 1000,
+				EndTime:   1300,
+			}},
+		}}))
+	})
+})
@@ -31,10 +31,37 @@ import (
 )
 
 var (
-	IfaceListRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,15}(,[a-zA-Z0-9_-]{1,15})*$`)
-	AuthorityRegexp = regexp.MustCompile(`^[^:/]+:\d+$`)
-	HostnameRegexp  = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
-	StringRegexp    = regexp.MustCompile(`^.*$`)
+	IfaceListRegexp     = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,15}(,[a-zA-Z0-9_-]{1,15})*$`)
+	AuthorityRegexp     = regexp.MustCompile(`^[^:/]+:\d+$`)
+	AuthorityListRegexp = regexp.MustCompile(`^[^:/,]+:\d+(,[^:/,]+:\d+)*$`)
+	HostnameRegexp      = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	StringRegexp        = regexp.MustCompile(`^.*$`)
+	// IfacePatternListRegexp matches a list of interface names, each of
+	// which may end in "+" to match any interface with that prefix, as in
+	// iptables.
+	IfacePatternListRegexp = regexp.MustCompile(
+		`^[a-zA-Z0-9_.-]{1,15}\+?(,[a-zA-Z0-9_.-]{1,15}\+?)*$`)
+	// LogLevelOverridesRegexp matches a list of <component>=<level> pairs,
+	// for example "iptables=DEBUG,calc=INFO".
+	LogLevelOverridesRegexp = regexp.MustCompile(
+		`^(?i)[a-z0-9_]+=(DEBUG|INFO|WARNING|ERROR|CRITICAL)(,[a-z0-9_]+=(DEBUG|INFO|WARNING|ERROR|CRITICAL))*$`)
+	// ThreatFeedListRegexp matches a list of <name>=<source> pairs, for
+	// example "spamhaus=https://example.com/drop.txt,local=/etc/deny.txt".
+	// Names are short enough for the IP set names that embed them.
+	ThreatFeedListRegexp = regexp.MustCompile(`^[a-z0-9-]{1,18}=[^,\s]+(,[a-z0-9-]{1,18}=[^,\s]+)*$`)
+	// NfacctClassListRegexp matches a list of <name>=<CIDR> pairs.  Names
+	// are short enough for the nfacct object names that embed them.
+	NfacctClassListRegexp = regexp.MustCompile(`^[a-z0-9-]{1,26}=[0-9a-fA-F.:]+/\d+(,[a-z0-9-]{1,26}=[0-9a-fA-F.:]+/\d+)*$`)
+	// PortForwardListRegexp matches a list of
+	// <protocol>:<external IP>:<port>=<workload IP>:<port> entries, for
+	// example "tcp:203.0.113.5:80=10.65.0.2:8080".
+	PortForwardListRegexp = regexp.MustCompile(`^(tcp|udp):[0-9.]+:\d+=[0-9.]+:\d+(,(tcp|udp):[0-9.]+:\d+=[0-9.]+:\d+)*$`)
+	// FilterHookListRegexp matches a list of the filter table's hooks, as
+	// in "input,forward".
+	FilterHookListRegexp = regexp.MustCompile(`^(?i)(input|output|forward)(,\s*(input|output|forward))*$`)
+	// UserChainHookListRegexp matches a list of <hook>:<position>:<chain>
+	// entries, as in "input:after:admin-in".
+	UserChainHookListRegexp = regexp.MustCompile(`^(input|output|forward):(before|after):[^\s,:]{1,28}(,\s*(input|output|forward):(before|after):[^\s,:]{1,28})*$`)
 )
 
 const (
@@ -90,7 +117,16 @@ type Config struct {
 
 	DataplaneDriver string `config:"file(must-exist,executable);calico-iptables-plugin;non-zero,die-on-fail,skip-default-validation"`
 
-	DatastoreType string `config:"oneof(kubernetes,etcdv2);etcdv2;non-zero,die-on-fail"`
+	// RenderOnlyDir, if set, puts Felix in render-only mode: instead of
+	// starting the dataplane driver, Felix writes the chains and IP sets
+	// that it would program to files in this directory, in iptables-save
+	// and ipset restore format, and doesn't tear anything down when it
+	// stops.  Provided that the optional subsystems that read from the
+	// kernel, such as flow logs, are left disabled, it doesn't need any
+	// privileges in this mode.
+	RenderOnlyDir string `config:"file;"`
+
+	DatastoreType string `config:"oneof(kubernetes,etcdv2,etcdv3);etcdv2;non-zero,die-on-fail"`
 
 	FelixHostname string `config:"hostname;;local,non-zero"`
 
@@ -101,46 +137,320 @@ type Config struct {
 	EtcdCaFile    string   `config:"file(must-exist);;local"`
 	EtcdEndpoints []string `config:"endpoint-list;;local"`
 
+	// Connection to the Kubernetes API, for the kubernetes datastore.  If
+	// not set, the libcalico-go defaults and environment variables apply.
+	KubeconfigFile string `config:"file(must-exist);;local"`
+	K8sAPIEndpoint string `config:"string;;local"`
+	K8sKeyFile     string `config:"file(must-exist);;local"`
+	K8sCertFile    string `config:"file(must-exist);;local"`
+	K8sCAFile      string `config:"file(must-exist);;local"`
+	K8sAPIToken    string `config:"string;;local"`
+
+	// SyncProxyAddrs is a comma-separated list of sync proxy servers.  If
+	// set, Felix gets its datastore updates from one of the servers,
+	// instead of watching the datastore itself.
+	SyncProxyAddrs string `config:"authority-list;;local"`
+
 	Ipv6Support    bool `config:"bool;true"`
 	IgnoreLooseRPF bool `config:"bool;false"`
 
 	StartupCleanupDelay       int `config:"int;30"`
-	PeriodicResyncInterval    int `config:"int;3600"`
+	PeriodicResyncInterval    int `config:"int;3600;live"`
 	HostInterfacePollInterval int `config:"int;10"`
-
-	IptablesRefreshInterval int `config:"int;60"`
+	// NeighborGCInterval is how often, in seconds, the dataplane removes
+	// the permanent ARP entries on workload interfaces that no endpoint
+	// wants, and restores the missing ones.  Zero disables it.
+	NeighborGCInterval int `config:"int;600"`
+
+	IptablesRefreshInterval int `config:"int;60;live"`
+
+	// DataplaneUpdateRateLimit is the sustained number of updates per
+	// second that each endpoint or IP set may send to the dataplane before
+	// its updates are coalesced; zero disables the limit.
+	DataplaneUpdateRateLimit float64 `config:"float;0"`
+	DataplaneUpdateBurst     int     `config:"int;10;non-zero"`
+	// DataplaneUpdatePrioritization sends the updates that revoke access,
+	// such as endpoint removals and IP set member removals, to the
+	// dataplane ahead of normal and bulk updates that are still queued.
+	DataplaneUpdatePrioritization bool `config:"bool;true"`
 
 	MetadataAddr string `config:"hostname;127.0.0.1;die-on-fail"`
 	MetadataPort int    `config:"int(0,65535);8775;die-on-fail"`
 
 	InterfacePrefix string `config:"iface-list;cali;non-zero,die-on-fail"`
+	// InterfaceExclude lists the interfaces that the dataplane must never
+	// manage or insert rules for, even if they match InterfacePrefix; for
+	// example, "docker+" or an interface owned by another CNI plugin.
+	InterfaceExclude string `config:"iface-pattern-list;"`
+
+	// DropInvalidConntrack lists the hooks of the filter table at which
+	// the dataplane drops packets that conntrack classifies as INVALID.
+	// Hosts with asymmetric routing, where conntrack only sees one
+	// direction of a flow, need to set it to "none".
+	DropInvalidConntrack string `config:"filter-hook-list;input,output,forward"`
+
+	// ChainAcceptAction is what the top-level chains do with traffic that
+	// they allow: ACCEPT it, or set the accept mark and RETURN it to the
+	// kernel chain so that other iptables users can also see it.
+	ChainAcceptAction string `config:"oneof(ACCEPT,RETURN);ACCEPT;non-zero,die-on-fail"`
+
+	// DropWorkloadRouterAdvertisements and DropWorkloadDHCPServers drop
+	// IPv6 router advertisements and DHCP/DHCPv6 server messages from
+	// workload interfaces, so that a workload can't hijack the addressing
+	// of the host or the other workloads.  The host's own are allowed.
+	DropWorkloadRouterAdvertisements bool `config:"bool;false"`
+	DropWorkloadDHCPServers          bool `config:"bool;false"`
+
+	// UserChainHooks lists chains that the dataplane jumps to from the
+	// kernel chains, before or after the jump to its own chain, as
+	// <hook>:<position>:<chain> entries.  It creates them if they don't
+	// exist but never touches their rules, which belong to the
+	// administrator.
+	UserChainHooks string `config:"user-chain-hook-list;"`
 
 	ChainInsertMode             string `config:"oneof(insert,append);insert;non-zero,die-on-fail"`
 	DefaultEndpointToHostAction string `config:"oneof(DROP,RETURN,ACCEPT);DROP;non-zero,die-on-fail"`
 	DropActionOverride          string `config:"oneof(DROP,ACCEPT,LOG-and-DROP,LOG-and-ACCEPT);DROP;non-zero,die-on-fail"`
 	LogPrefix                   string `config:"string;calico-drop"`
+	// ConntrackBypassEnabled accepts the packets of established workload
+	// flows without checking policy again.  It's on by default, as the
+	// Python driver has always bypassed policy for established flows.
+	ConntrackBypassEnabled bool `config:"bool;true"`
+	VerdictCacheEnabled    bool `config:"bool;false"`
+	// AntiSpoofingEnabled drops traffic from a workload whose source
+	// address isn't one of the workload's own addresses, in addition to
+	// the kernel's reverse path filter.
+	AntiSpoofingEnabled bool `config:"bool;false"`
+
+	// ShutdownTeardownMode controls what happens to our iptables chains
+	// when Felix is stopped by a signal: "none" leaves them in place, so
+	// that traffic isn't disrupted while Felix restarts; "chains" flushes
+	// and deletes our chains, leaving any that the kernel chains still
+	// jump to in place but empty; "all" also removes our rules from the
+	// kernel chains, leaving no trace.  Felix doesn't tear anything down
+	// when it restarts after a failure or a config change.
+	ShutdownTeardownMode string `config:"oneof(none,chains,all);none"`
 
 	LogFilePath           string `config:"file;/var/log/calico/felix.log;die-on-fail"`
 	EtcdDriverLogFilePath string `config:"file;/var/log/calico/felix-etcd.log"`
 
-	LogSeverityFile   string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);INFO"`
-	LogSeverityScreen string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);INFO"`
-	LogSeveritySys    string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);INFO"`
+	// By default, the log file is left to an external logrotate.  If
+	// either of these limits is set, Felix rotates it itself, keeping
+	// LogFileMaxBackups old files.
+	LogFileMaxSizeMB   int `config:"int;0"`
+	LogFileMaxAgeHours int `config:"int;0"`
+	LogFileMaxBackups  int `config:"int;5"`
+
+	// LogSyslogAddr is the address of a remote syslog server; if not set,
+	// Felix logs to the local syslog daemon.
+	LogSyslogAddr    string `config:"authority;"`
+	LogSyslogNetwork string `config:"oneof(udp,tcp);udp"`
+
+	LogSeverityFile   string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);INFO;live"`
+	LogSeverityScreen string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);INFO;live"`
+	LogSeveritySys    string `config:"oneof(DEBUG,INFO,WARNING,ERROR,CRITICAL);INFO;live"`
+
+	// LogSeverityOverrides sets the log level of individual components,
+	// named after their Go package, for example "iptables=DEBUG,calc=INFO",
+	// in place of the levels above.  Overriding a component to DEBUG means
+	// that every debug log is built and annotated before it is filtered,
+	// which costs some CPU, but far less than logging everything at DEBUG.
+	LogSeverityOverrides string `config:"log-level-overrides;;live"`
 
 	IpInIpEnabled    bool   `config:"bool;false"`
 	IpInIpMtu        int    `config:"int;1440;non-zero"`
 	IpInIpTunnelAddr net.IP `config:"ipv4;"`
 
+	// RouteAggregationThreshold, if non-zero, replaces the routes to the
+	// workloads of an IPAM block with a single route to the block once
+	// that many of them go to the same interface.  The other routes of the
+	// block stay as more-specific exceptions.  RouteAggregationBlockSizeV4
+	// and RouteAggregationBlockSizeV6 are the prefix lengths of the IPAM
+	// blocks; zero disables aggregation for that IP version.
+	RouteAggregationThreshold   int `config:"int(0,1000000);0"`
+	RouteAggregationBlockSizeV4 int `config:"int(0,32);26"`
+	RouteAggregationBlockSizeV6 int `config:"int(0,128);122"`
+
 	ReportingIntervalSecs int `config:"int;30"`
 	ReportingTTLSecs      int `config:"int;90"`
 
 	EndpointReportingEnabled   bool    `config:"bool;false"`
 	EndpointReportingDelaySecs float64 `config:"float;1.0"`
 
+	PolicySyncSocket string `config:"file;"`
+
+	BPFEnabled    bool   `config:"bool;false"`
+	BPFObjectFile string `config:"file;/usr/lib/calico/bpf/tc_policy.o"`
+	XDPEnabled    bool   `config:"bool;false"`
+	XDPObjectFile string `config:"file;/usr/lib/calico/bpf/xdp_deny.o"`
+
+	FlowLogsEnabled           bool   `config:"bool;false"`
+	FlowLogsFlushIntervalSecs int    `config:"int;300;non-zero"`
+	FlowLogsMaxFlows          int    `config:"int;100000;non-zero"`
+	FlowLogsFile              string `config:"file;/var/log/calico/flows.log"`
+	FlowLogsSyslogEnabled     bool   `config:"bool;false"`
+	FlowLogsCollectorAddr     string `config:"authority;"`
+
+	// AuditLogFile, if set, is the file to which Felix appends a JSON
+	// record of each change that it makes to a chain, IP set or route.
+	// AuditLogSyslogEnabled sends the same records to syslog.
+	AuditLogFile          string `config:"file;"`
+	AuditLogSyslogEnabled bool   `config:"bool;false"`
+
+	DNSPolicyEnabled    bool     `config:"bool;false"`
+	DNSTrustedServers   []string `config:"ip-list;"`
+	DNSPolicyMinTTLSecs int      `config:"int;30"`
+
 	MaxIpsetSize int `config:"int;1048576;non-zero"`
 
 	IptablesMarkMask uint32 `config:"mark-bitmask;0xff000000;non-zero,die-on-fail"`
 
+	// PortForwards maps external IPs and ports, such as floating IPs, onto
+	// ports of local workloads.  Only IPv4 is supported.
+	PortForwards string `config:"port-forward-list;"`
+
+	// KubeProxyReplacementEnabled has Felix program the Kubernetes
+	// services, which it watches through the connection to the Kubernetes
+	// API above, in place of kube-proxy.  Traffic to the host on the node
+	// port range, from KubeNodePortRangeMin to KubeNodePortRangeMax, that
+	// isn't for one of the node ports is dropped.
+	KubeProxyReplacementEnabled bool `config:"bool;false"`
+	KubeNodePortRangeMin        int  `config:"int(1,65535);30000"`
+	KubeNodePortRangeMax        int  `config:"int(1,65535);32767"`
+
+	// ServiceDSREnabled reserves the mark bits that are left after the
+	// other features have taken theirs for direct server return, which
+	// routes service traffic to the host that runs the chosen endpoint
+	// so that its replies go straight back to the client.  Each remote
+	// host's DSR traffic uses a routing table, numbered from
+	// ServiceDSRRouteTableBase+1; the base is above 255 to stay clear of
+	// the kernel's reserved tables.  DSR applies to the services that
+	// have the projectcalico.org/dsr annotation and needs
+	// KubeProxyReplacementEnabled and the IPIP tunnel.
+	ServiceDSREnabled        bool `config:"bool;false"`
+	ServiceDSRRouteTableBase int  `config:"int(256,2000000000);1000"`
+
+	// NAT64Enabled lets IPv6-only workloads reach IPv4 services through
+	// the host.  A translator, such as TAYGA, owns NAT64Device; it maps
+	// the IPv4 addresses embedded in NAT64Prefix (RFC 6052) to themselves
+	// and the workloads' IPv6 addresses to NAT64IPv4Pool, which Felix then
+	// masquerades to the host's address.
+	NAT64Enabled  bool   `config:"bool;false"`
+	NAT64Prefix   string `config:"cidr(6);64:ff9b::/96"`
+	NAT64IPv4Pool string `config:"cidr(4);192.168.255.0/24"`
+	NAT64Device   string `config:"iface-list;nat64"`
+
+	// EgressGatewayRole steers the external traffic of the workloads in
+	// EgressGatewaySourceCIDRs through the egress gateway host at
+	// EgressGatewayAddr, which SNATs it to its own address, so that it
+	// leaves the cluster from a single, whitelistable, IP.  Traffic to
+	// EgressGatewayExcludedCIDRs, such as the cluster's own pools, isn't
+	// external.  "client" hosts route the traffic to the gateway, using
+	// routing table EgressGatewayRouteTable, and skip their own SNAT; the
+	// "gateway" host does the SNAT.
+	EgressGatewayRole          string   `config:"oneof(none,client,gateway);none"`
+	EgressGatewayAddr          net.IP   `config:"ipv4;"`
+	EgressGatewaySourceCIDRs   []string `config:"cidr-list;"`
+	EgressGatewayExcludedCIDRs []string `config:"cidr-list;"`
+	EgressGatewayRouteTable    int      `config:"int(256,2000000000);999"`
+
+	// SynFloodProtectionInterfaces are the internet-facing host
+	// interfaces on which SYNs are limited to SynFloodRateLimit per second
+	// per source, after a burst of SynFloodBurst.  If
+	// SynFloodSynproxyEnabled is set, and the kernel supports it, SYNPROXY
+	// completes the handshakes on the host's behalf.
+	SynFloodProtectionInterfaces string `config:"iface-list;"`
+	SynFloodRateLimit            int    `config:"int(1,1000000);100"`
+	SynFloodBurst                int    `config:"int(1,1000000);200"`
+	SynFloodSynproxyEnabled      bool   `config:"bool;false"`
+
+	// PortScanInterfaces are the internet-facing host interfaces on which
+	// sources that open new connections to closed ports faster than
+	// PortScanRateLimit per second, after a burst of PortScanBurst, are
+	// banned for PortScanBanSecs.  At most MaxIpsetSize sources are banned
+	// at once.
+	PortScanInterfaces string `config:"iface-list;"`
+	PortScanRateLimit  int    `config:"int(1,1000000);5"`
+	PortScanBurst      int    `config:"int(1,1000000);20"`
+	PortScanBanSecs    int    `config:"int(1,2147483);600"`
+
+	// ThreatFeeds is a list of name=source pairs of feeds of IPs and CIDRs
+	// to deny, ahead of any policy, in both directions.  A source is an
+	// HTTP(S) URL or an absolute file path.  The feeds are re-fetched every
+	// ThreatFeedRefreshSecs and at most ThreatFeedMaxEntries entries of
+	// each IP version are used from each feed.
+	ThreatFeeds           string `config:"threat-feed-list;"`
+	ThreatFeedRefreshSecs int    `config:"int(10,86400);300"`
+	ThreatFeedMaxEntries  int    `config:"int(1,1048576);65536"`
+
+	// NfacctClasses is a list of name=CIDR pairs of classes of traffic, to
+	// or from the CIDR, that are each accounted to an nfacct object.  The
+	// objects' counts are exported as metrics every NfacctPollSecs.
+	NfacctClasses  string `config:"nfacct-class-list;"`
+	NfacctPollSecs int    `config:"int(1,3600);10"`
+
+	// ConntrackMonitorEnabled enables the export of the conntrack table's
+	// size, limit and per-protocol entries as metrics, every
+	// ConntrackMonitorPollSecs.  A warning is logged when the table is
+	// more than ConntrackWarningThresholdPercent full.  If
+	// ConntrackMaxEntries is non-zero, the nf_conntrack_max sysctl is
+	// raised to it at start of day; a higher limit is left alone.
+	ConntrackMonitorEnabled          bool `config:"bool;false"`
+	ConntrackMonitorPollSecs         int  `config:"int(1,3600);30"`
+	ConntrackWarningThresholdPercent int  `config:"int(1,100);80"`
+	ConntrackMaxEntries              int  `config:"int(0,2147483647);0"`
+
+	HealthEnabled bool `config:"bool;false"`
+	HealthPort    int  `config:"int(0,65535);9099"`
+
+	// WatchdogEnabled makes the syncer, calculation graph and dataplane
+	// loops check in with a watchdog, which logs the goroutine stacks and
+	// reports Felix not ready if any of them goes WatchdogTimeoutSecs
+	// without making progress.  If WatchdogExitOnWedge is set, Felix also
+	// exits, so that it's restarted.
+	WatchdogEnabled     bool `config:"bool;false"`
+	WatchdogTimeoutSecs int  `config:"int(1,3600);60"`
+	WatchdogExitOnWedge bool `config:"bool;false"`
+
+	// SubsystemMaxRestarts is the number of times in a row that an
+	// optional subsystem, such as the port scan monitor or the flow log
+	// readers, is restarted after failing before Felix gives up on it and
+	// shuts down.  Zero means that the subsystems are restarted forever.
+	SubsystemMaxRestarts int `config:"int(0,1000000);10"`
+
+	// StateCacheFile, if set, is the path of a file in which Felix caches
+	// state that is expensive to work out, such as the features that the
+	// dataplane supports, so that it can skip working it out again after
+	// a restart.  The cache is ignored after a reboot or an upgrade.
+	StateCacheFile string `config:"file;"`
+
+	// SnapshotFile, if set, is the path of a file in which Felix keeps a
+	// compressed snapshot of the datastore state.  After a restart, Felix
+	// programs the dataplane from the snapshot while it resyncs with the
+	// datastore, rather than waiting for the resync.
+	SnapshotFile string `config:"file;"`
+	// SnapshotMaxAgeSecs is the age beyond which a snapshot is ignored.
+	// Zero means that a snapshot is used however old it is.
+	SnapshotMaxAgeSecs int `config:"int(0,604800);3600"`
+	// SnapshotSaveIntervalSecs is the minimum time between saves of the
+	// snapshot.
+	SnapshotSaveIntervalSecs int `config:"int(1,3600);10"`
+
+	DebugServerEnabled bool   `config:"bool;false"`
+	DebugServerAddr    string `config:"authority;127.0.0.1:6060"`
+
+	// The debug server's /debug/capture endpoint writes its pcap files to
+	// DebugCaptureDir and caps each capture at DebugCaptureMaxSecs.  Its
+	// /debug/trace endpoint caps each trace at DebugTraceMaxSecs.
+	DebugCaptureDir     string `config:"file;/var/log/calico/captures"`
+	DebugCaptureMaxSecs int    `config:"int(1,3600);60"`
+	DebugTraceMaxSecs   int    `config:"int(1,3600);300"`
+
+	// DebugStateSocket, if set, is the path of a unix socket on which
+	// Felix serves the calculation graph's output, as JSON, whether or
+	// not the debug server is enabled.
+	DebugStateSocket string `config:"file;"`
+
 	PrometheusMetricsEnabled             bool `config:"bool;false"`
 	PrometheusMetricsPort                int  `config:"int(0,65535);9091"`
 	DataplaneDriverPrometheusMetricsPort int  `config:"int(0,65535);9092"`
@@ -260,6 +570,14 @@ func (config *Config) EndpointReportingDelay() time.Duration {
 	return time.Duration(config.EndpointReportingDelaySecs*1000000) * time.Microsecond
 }
 
+func (config *Config) FlowLogsFlushInterval() time.Duration {
+	return time.Duration(config.FlowLogsFlushIntervalSecs) * time.Second
+}
+
+func (config *Config) DNSPolicyMinTTL() time.Duration {
+	return time.Duration(config.DNSPolicyMinTTLSecs) * time.Second
+}
+
 func (config *Config) DatastoreConfig() api.CalicoAPIConfig {
 	if config.DatastoreType == "kubernetes" {
 		// Create a new Client.  The client will be configured
@@ -268,16 +586,18 @@ func (config *Config) DatastoreConfig() api.CalicoAPIConfig {
 		if err != nil {
 			log.WithError(err).Panic("Failed to create empty config")
 		}
+		cfg.Spec.DatastoreType = api.Kubernetes
+		// Our own config parameters take precedence.
+		overrideIfSet(&cfg.Spec.Kubeconfig, config.KubeconfigFile)
+		overrideIfSet(&cfg.Spec.K8sAPIEndpoint, config.K8sAPIEndpoint)
+		overrideIfSet(&cfg.Spec.K8sKeyFile, config.K8sKeyFile)
+		overrideIfSet(&cfg.Spec.K8sCertFile, config.K8sCertFile)
+		overrideIfSet(&cfg.Spec.K8sCAFile, config.K8sCAFile)
+		overrideIfSet(&cfg.Spec.K8sAPIToken, config.K8sAPIToken)
 		return *cfg
 	} else {
-		var etcdEndpoints string
-		if len(config.EtcdEndpoints) == 0 {
-			etcdEndpoints = config.EtcdScheme + "://" + config.EtcdAddr
-		} else {
-			etcdEndpoints = strings.Join(config.EtcdEndpoints, ",")
-		}
 		etcdCfg := etcd.EtcdConfig{
-			EtcdEndpoints:  etcdEndpoints,
+			EtcdEndpoints:  strings.Join(config.EtcdEndpointURLs(), ","),
 			EtcdKeyFile:    config.EtcdKeyFile,
 			EtcdCertFile:   config.EtcdCertFile,
 			EtcdCACertFile: config.EtcdCaFile,
@@ -292,12 +612,81 @@ func (config *Config) DatastoreConfig() api.CalicoAPIConfig {
 }
 
 // Validate() performs cross-field validation.
+// EtcdEndpointURLs returns the etcd endpoints, falling back to EtcdScheme
+// and EtcdAddr if EtcdEndpoints isn't set.
+func (config *Config) EtcdEndpointURLs() []string {
+	if len(config.EtcdEndpoints) == 0 {
+		return []string{config.EtcdScheme + "://" + config.EtcdAddr}
+	}
+	return config.EtcdEndpoints
+}
+
+func (config *Config) SyncProxyAddrList() []string {
+	if config.SyncProxyAddrs == "" {
+		return nil
+	}
+	return strings.Split(config.SyncProxyAddrs, ",")
+}
+
+// ThreatFeedSpecs returns the names and sources of the ThreatFeeds, in the
+// order they were configured.
+func (config *Config) ThreatFeedSpecs() (names, sources []string) {
+	return splitPairs(config.ThreatFeeds)
+}
+
+// NfacctClassSpecs returns the names and CIDRs of the NfacctClasses, in the
+// order they were configured.
+func (config *Config) NfacctClassSpecs() (names, cidrs []string) {
+	return splitPairs(config.NfacctClasses)
+}
+
+// PortForwardSpecs returns the frontends, in the form
+// <protocol>:<IP>:<port>, and backends, in the form <IP>:<port>, of the
+// PortForwards, in the order they were configured.
+func (config *Config) PortForwardSpecs() (frontends, backends []string) {
+	return splitPairs(config.PortForwards)
+}
+
+// checkPortForwardAddr checks the <IP>:<port> at the end of a port
+// forward's frontend or backend.
+func checkPortForwardAddr(addr string) error {
+	parts := strings.Split(addr, ":")
+	if net.ParseIP(parts[len(parts)-2]).To4() == nil {
+		return errors.New("invalid IPv4 address")
+	}
+	if port, err := strconv.ParseUint(parts[len(parts)-1], 10, 16); err != nil || port == 0 {
+		return errors.New("invalid port")
+	}
+	return nil
+}
+
+// splitPairs splits a comma-separated list of key=value pairs, which has
+// already been validated.
+func splitPairs(list string) (keys, values []string) {
+	if list == "" {
+		return nil, nil
+	}
+	for _, pair := range strings.Split(list, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		keys = append(keys, parts[0])
+		values = append(values, parts[1])
+	}
+	return
+}
+
+func overrideIfSet(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
+
 func (config *Config) Validate() (err error) {
 	if config.FelixHostname == "" {
 		err = errors.New("Failed to determine hostname")
 	}
 
-	if config.DatastoreType == "etcdv2" && len(config.EtcdEndpoints) == 0 {
+	if (config.DatastoreType == "etcdv2" || config.DatastoreType == "etcdv3") &&
+		len(config.EtcdEndpoints) == 0 {
 		if config.EtcdScheme == "" {
 			err = errors.New("EtcdEndpoints and EtcdScheme both missing")
 		}
@@ -306,12 +695,69 @@ func (config *Config) Validate() (err error) {
 		}
 	}
 
+	if config.NAT64Enabled {
+		_, prefix, _ := net.ParseCIDR(config.NAT64Prefix)
+		if prefix == nil || config.NAT64IPv4Pool == "" {
+			err = errors.New("NAT64 needs NAT64Prefix and NAT64IPv4Pool")
+		} else if ones, _ := prefix.Mask.Size(); !nat64PrefixLens[ones] {
+			err = errors.New("NAT64Prefix length must be 32, 40, 48, 56, 64 or 96")
+		}
+	}
+
+	if config.KubeNodePortRangeMin > config.KubeNodePortRangeMax {
+		err = errors.New("KubeNodePortRangeMin is above KubeNodePortRangeMax")
+	}
+
+	if config.EgressGatewayRole != "none" {
+		if config.EgressGatewayAddr == nil || len(config.EgressGatewaySourceCIDRs) == 0 {
+			err = errors.New("Egress gateway needs EgressGatewayAddr and EgressGatewaySourceCIDRs")
+		}
+		// The egress gateway is IPv4-only, like its address.
+		for _, cidrs := range [][]string{
+			config.EgressGatewaySourceCIDRs,
+			config.EgressGatewayExcludedCIDRs,
+		} {
+			for _, cidr := range cidrs {
+				if strings.Contains(cidr, ":") {
+					err = errors.New("Egress gateway CIDRs must be IPv4")
+				}
+			}
+		}
+	}
+
+	_, feedSources := config.ThreatFeedSpecs()
+	for _, source := range feedSources {
+		if !strings.HasPrefix(source, "http://") &&
+			!strings.HasPrefix(source, "https://") &&
+			!strings.HasPrefix(source, "/") {
+			err = errors.New("ThreatFeeds sources must be HTTP(S) URLs or absolute paths")
+		}
+	}
+
+	_, classCIDRs := config.NfacctClassSpecs()
+	for _, cidr := range classCIDRs {
+		if _, _, parseErr := net.ParseCIDR(cidr); parseErr != nil {
+			err = errors.New("NfacctClasses has an invalid CIDR: " + cidr)
+		}
+	}
+
+	frontends, backends := config.PortForwardSpecs()
+	for _, addr := range append(frontends, backends...) {
+		if checkErr := checkPortForwardAddr(addr); checkErr != nil {
+			err = errors.New("PortForwards has an invalid address: " + addr)
+		}
+	}
+
 	if err != nil {
 		config.Err = err
 	}
 	return
 }
 
+// nat64PrefixLens are the prefix lengths that RFC 6052 allows for the
+// NAT64 prefix.
+var nat64PrefixLens = map[int]bool{32: true, 40: true, 48: true, 56: true, 64: true, 96: true}
+
 var knownParams map[string]param
 
 func loadParams() {
@@ -365,6 +811,9 @@ func loadParams() {
 		case "iface-list":
 			param = &RegexpParam{Regexp: IfaceListRegexp,
 				Msg: "invalid Linux interface name"}
+		case "iface-pattern-list":
+			param = &RegexpParam{Regexp: IfacePatternListRegexp,
+				Msg: "invalid Linux interface name or pattern"}
 		case "file":
 			param = &FileParam{
 				MustExist:  strings.Contains(kindParams, "must-exist"),
@@ -373,12 +822,43 @@ func loadParams() {
 		case "authority":
 			param = &RegexpParam{Regexp: AuthorityRegexp,
 				Msg: "invalid URL authority"}
+		case "log-level-overrides":
+			param = &RegexpParam{Regexp: LogLevelOverridesRegexp,
+				Msg: "invalid list of component=level pairs"}
+		case "threat-feed-list":
+			param = &RegexpParam{Regexp: ThreatFeedListRegexp,
+				Msg: "invalid list of name=source pairs"}
+		case "nfacct-class-list":
+			param = &RegexpParam{Regexp: NfacctClassListRegexp,
+				Msg: "invalid list of name=CIDR pairs"}
+		case "port-forward-list":
+			param = &RegexpParam{Regexp: PortForwardListRegexp,
+				Msg: "invalid list of port forwards"}
+		case "filter-hook-list":
+			param = &RegexpParam{Regexp: FilterHookListRegexp,
+				Msg: "invalid list of filter table hooks"}
+		case "user-chain-hook-list":
+			param = &RegexpParam{Regexp: UserChainHookListRegexp,
+				Msg: "invalid list of user chain hooks"}
+		case "authority-list":
+			param = &RegexpParam{Regexp: AuthorityListRegexp,
+				Msg: "invalid list of URL authorities"}
 		case "ipv4":
 			param = &Ipv4Param{}
+		case "cidr-list":
+			param = &CIDRListParam{}
+		case "cidr":
+			version, err := strconv.Atoi(kindParams)
+			if err != nil || (version != 4 && version != 6) {
+				log.Panicf("Invalid IP version for %v", field.Name)
+			}
+			param = &CIDRParam{Version: version}
 		case "endpoint-list":
 			param = &EndpointListParam{}
 		case "port-list":
 			param = &PortListParam{}
+		case "ip-list":
+			param = &IPListParam{}
 		case "hostname":
 			param = &RegexpParam{Regexp: HostnameRegexp,
 				Msg: "invalid hostname"}
@@ -409,6 +889,9 @@ func loadParams() {
 		if strings.Index(flags, "local") > -1 {
 			metadata.Local = true
 		}
+		if strings.Index(flags, "live") > -1 {
+			metadata.Live = true
+		}
 
 		if defaultStr != "" {
 			if strings.Index(flags, "skip-default-validation") > -1 {
@@ -433,6 +916,40 @@ func (config *Config) RawValues() map[string]string {
 	return config.rawValues
 }
 
+// RestartRequired returns true if moving from one set of raw config values
+// (as returned by RawValues()) to another changes any parameter that can't
+// be applied without restarting Felix.  Only parameters that are flagged as
+// "live", such as the log levels, can be changed on the fly.
+func RestartRequired(oldRawValues, newRawValues map[string]string) bool {
+	if knownParams == nil {
+		loadParams()
+	}
+	names := make(map[string]bool)
+	for name := range oldRawValues {
+		names[name] = true
+	}
+	for name := range newRawValues {
+		names[name] = true
+	}
+	for name := range names {
+		oldValue, oldOK := oldRawValues[name]
+		newValue, newOK := newRawValues[name]
+		if oldOK == newOK && oldValue == newValue {
+			continue
+		}
+		param, ok := knownParams[strings.ToLower(name)]
+		if !ok || !param.GetMetadata().Live {
+			log.WithFields(log.Fields{
+				"name":     name,
+				"oldValue": oldValue,
+				"newValue": newValue,
+			}).Info("Config parameter changed; restart required")
+			return true
+		}
+	}
+	return false
+}
+
 func New() *Config {
 	if knownParams == nil {
 		loadParams()
@@ -17,6 +17,7 @@ package config_test
 import (
 	. "github.com/projectcalico/felix/go/felix/config"
 
+	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	"net"
@@ -38,6 +39,8 @@ var _ = DescribeTable("Config parsing",
 	Entry("FelixHostname FQDN", "FelixHostname", "hostname.foo.bar.com", "hostname.foo.bar.com"),
 	Entry("FelixHostname as IP", "FelixHostname", "1.2.3.4", "1.2.3.4"),
 
+	Entry("DatastoreType etcdv3", "DatastoreType", "etcdv3", "etcdv3"),
+
 	Entry("EtcdAddr IP", "EtcdAddr", "10.0.0.1:1234", "10.0.0.1:1234"),
 	Entry("EtcdAddr host", "EtcdAddr", "host:1234", "host:1234"),
 	Entry("EtcdScheme", "EtcdScheme", "https", "https"),
@@ -51,17 +54,39 @@ var _ = DescribeTable("Config parsing",
 		"https://127.0.0.1:1234/, https://host:2345",
 		[]string{"https://127.0.0.1:1234/", "https://host:2345/"}),
 
+	// Kubernetes key files will be tested for existence, skipping for now.
+	Entry("K8sAPIEndpoint", "K8sAPIEndpoint",
+		"https://10.0.0.1:6443", "https://10.0.0.1:6443"),
+	Entry("K8sAPIToken", "K8sAPIToken", "abcdef", "abcdef"),
+
+	Entry("SyncProxyAddrs", "SyncProxyAddrs",
+		"10.0.0.1:5473,sync-proxy:5473", "10.0.0.1:5473,sync-proxy:5473"),
+
 	Entry("StartupCleanupDelay 12", "StartupCleanupDelay", "12", int(12)),
 	Entry("StartupCleanupDelay 0", "StartupCleanupDelay", "0", int(0)),
 	Entry("PeriodicResyncInterval 1500", "PeriodicResyncInterval", "1500", int(1500)),
 	Entry("PeriodicResyncInterval 0", "PeriodicResyncInterval", "0", int(0)),
 	Entry("HostInterfacePollInterval", "HostInterfacePollInterval", "11", int(11)),
 	Entry("HostInterfacePollInterval", "HostInterfacePollInterval", "0", int(0)),
+	Entry("NeighborGCInterval", "NeighborGCInterval", "60", int(60)),
+	Entry("DataplaneUpdatePrioritization", "DataplaneUpdatePrioritization", "false", false),
 
 	Entry("InterfacePrefix", "InterfacePrefix", "tap", "tap"),
 	Entry("InterfacePrefix list", "InterfacePrefix", "tap,cali", "tap,cali"),
+	Entry("InterfaceExclude", "InterfaceExclude", "docker+,veth1234", "docker+,veth1234"),
+
+	Entry("RenderOnlyDir", "RenderOnlyDir", "/tmp/felix-render", "/tmp/felix-render"),
 
+	Entry("DropInvalidConntrack", "DropInvalidConntrack", "input,forward", "input,forward"),
+	Entry("DropInvalidConntrack none", "DropInvalidConntrack", "none", ""),
+	Entry("DropWorkloadRouterAdvertisements", "DropWorkloadRouterAdvertisements", "true", true),
+	Entry("DropWorkloadDHCPServers", "DropWorkloadDHCPServers", "true", true),
+	Entry("UserChainHooks", "UserChainHooks",
+		"input:after:admin-in, forward:before:admin-fwd",
+		"input:after:admin-in, forward:before:admin-fwd"),
 	Entry("ChainInsertMode append", "ChainInsertMode", "append", "append"),
+	Entry("ChainAcceptAction RETURN", "ChainAcceptAction", "RETURN", "RETURN"),
+	Entry("ShutdownTeardownMode all", "ShutdownTeardownMode", "all", "all"),
 
 	Entry("DefaultEndpointToHostAction", "DefaultEndpointToHostAction",
 		"RETURN", "RETURN"),
@@ -79,6 +104,10 @@ var _ = DescribeTable("Config parsing",
 	Entry("DropActionOverride log-and-drop", "DropActionOverride",
 		"log-and-drop", "LOG-and-DROP"),
 
+	Entry("ConntrackBypassEnabled", "ConntrackBypassEnabled", "false", false),
+	Entry("VerdictCacheEnabled", "VerdictCacheEnabled", "true", true),
+	Entry("AntiSpoofingEnabled", "AntiSpoofingEnabled", "true", true),
+
 	Entry("LogFilePath", "LogFilePath", "/tmp/felix.log", "/tmp/felix.log"),
 
 	Entry("LogSeverityFile", "LogSeverityFile", "debug", "DEBUG"),
@@ -96,6 +125,9 @@ var _ = DescribeTable("Config parsing",
 	Entry("LogSeveritySys", "LogSeveritySys", "error", "ERROR"),
 	Entry("LogSeveritySys", "LogSeveritySys", "critical", "CRITICAL"),
 
+	Entry("LogSeverityOverrides", "LogSeverityOverrides",
+		"iptables=DEBUG,calc=info", "iptables=DEBUG,calc=info"),
+
 	Entry("IpInIpEnabled", "IpInIpEnabled", "true", true),
 	Entry("IpInIpEnabled", "IpInIpEnabled", "y", true),
 	Entry("IpInIpEnabled", "IpInIpEnabled", "True", true),
@@ -104,6 +136,10 @@ var _ = DescribeTable("Config parsing",
 	Entry("IpInIpTunnelAddr", "IpInIpTunnelAddr",
 		"10.0.0.1", net.ParseIP("10.0.0.1")),
 
+	Entry("RouteAggregationThreshold", "RouteAggregationThreshold", "16", int(16)),
+	Entry("RouteAggregationBlockSizeV4", "RouteAggregationBlockSizeV4", "24", int(24)),
+	Entry("RouteAggregationBlockSizeV6", "RouteAggregationBlockSizeV6", "120", int(120)),
+
 	Entry("ReportingIntervalSecs", "ReportingIntervalSecs", "31", int(31)),
 	Entry("ReportingTTLSecs", "ReportingTTLSecs", "91", int(91)),
 
@@ -114,8 +150,86 @@ var _ = DescribeTable("Config parsing",
 	Entry("EndpointReportingDelaySecs", "EndpointReportingDelaySecs",
 		"10", float64(10)),
 
+	Entry("PolicySyncSocket", "PolicySyncSocket",
+		"/var/run/calico/policysync.sock", "/var/run/calico/policysync.sock"),
+
+	Entry("BPFEnabled", "BPFEnabled", "true", true),
+	Entry("BPFObjectFile", "BPFObjectFile", "/tmp/tc_policy.o", "/tmp/tc_policy.o"),
+	Entry("XDPEnabled", "XDPEnabled", "true", true),
+	Entry("XDPObjectFile", "XDPObjectFile", "/tmp/xdp_deny.o", "/tmp/xdp_deny.o"),
+	Entry("FlowLogsEnabled", "FlowLogsEnabled", "true", true),
+	Entry("FlowLogsFlushIntervalSecs", "FlowLogsFlushIntervalSecs", "60", 60),
+	Entry("FlowLogsMaxFlows", "FlowLogsMaxFlows", "1000", 1000),
+	Entry("FlowLogsFile", "FlowLogsFile", "/tmp/flows.log", "/tmp/flows.log"),
+	Entry("FlowLogsSyslogEnabled", "FlowLogsSyslogEnabled", "true", true),
+	Entry("FlowLogsCollectorAddr", "FlowLogsCollectorAddr", "collector:5000", "collector:5000"),
+	Entry("AuditLogFile", "AuditLogFile", "/var/log/calico/audit.log", "/var/log/calico/audit.log"),
+	Entry("AuditLogSyslogEnabled", "AuditLogSyslogEnabled", "true", true),
+	Entry("DNSPolicyEnabled", "DNSPolicyEnabled", "true", true),
+	Entry("DNSTrustedServers", "DNSTrustedServers", "10.0.0.53,fd00::53", []string{"10.0.0.53", "fd00::53"}),
+	Entry("DNSPolicyMinTTLSecs", "DNSPolicyMinTTLSecs", "60", 60),
+
 	Entry("MaxIpsetSize", "MaxIpsetSize", "12345", int(12345)),
 	Entry("IptablesMarkMask", "IptablesMarkMask", "0xf0f0", uint32(0xf0f0)),
+	Entry("KubeProxyReplacementEnabled", "KubeProxyReplacementEnabled", "true", true),
+	Entry("KubeNodePortRangeMin", "KubeNodePortRangeMin", "20000", int(20000)),
+	Entry("KubeNodePortRangeMax", "KubeNodePortRangeMax", "22767", int(22767)),
+	Entry("ServiceDSREnabled", "ServiceDSREnabled", "true", true),
+	Entry("ServiceDSRRouteTableBase", "ServiceDSRRouteTableBase", "2000", int(2000)),
+	Entry("NAT64Enabled", "NAT64Enabled", "true", true),
+	Entry("NAT64Prefix", "NAT64Prefix", "2001:db8:64::/96", "2001:db8:64::/96"),
+	Entry("NAT64IPv4Pool", "NAT64IPv4Pool", "10.64.0.0/16", "10.64.0.0/16"),
+	Entry("NAT64Device", "NAT64Device", "tayga", "tayga"),
+	Entry("EgressGatewayRole", "EgressGatewayRole", "client", "client"),
+	Entry("EgressGatewayAddr", "EgressGatewayAddr", "10.0.0.254", net.ParseIP("10.0.0.254")),
+	Entry("EgressGatewaySourceCIDRs", "EgressGatewaySourceCIDRs", "10.65.0.0/16", []string{"10.65.0.0/16"}),
+	Entry("EgressGatewayExcludedCIDRs", "EgressGatewayExcludedCIDRs", "10.64.0.0/10,10.96.0.0/12",
+		[]string{"10.64.0.0/10", "10.96.0.0/12"}),
+	Entry("EgressGatewayRouteTable", "EgressGatewayRouteTable", "300", int(300)),
+
+	Entry("PortForwards", "PortForwards", "tcp:203.0.113.5:80=10.65.0.2:8080,udp:203.0.113.5:53=10.65.0.3:53",
+		"tcp:203.0.113.5:80=10.65.0.2:8080,udp:203.0.113.5:53=10.65.0.3:53"),
+
+	Entry("SynFloodProtectionInterfaces", "SynFloodProtectionInterfaces", "eth0,eth1", "eth0,eth1"),
+	Entry("SynFloodRateLimit", "SynFloodRateLimit", "50", int(50)),
+	Entry("SynFloodBurst", "SynFloodBurst", "500", int(500)),
+	Entry("SynFloodSynproxyEnabled", "SynFloodSynproxyEnabled", "true", true),
+	Entry("PortScanInterfaces", "PortScanInterfaces", "eth0", "eth0"),
+	Entry("PortScanRateLimit", "PortScanRateLimit", "10", int(10)),
+	Entry("PortScanBurst", "PortScanBurst", "50", int(50)),
+	Entry("PortScanBanSecs", "PortScanBanSecs", "3600", int(3600)),
+	Entry("ThreatFeeds", "ThreatFeeds", "drop=https://example.com/drop.txt,local=/etc/deny.txt",
+		"drop=https://example.com/drop.txt,local=/etc/deny.txt"),
+	Entry("ThreatFeedRefreshSecs", "ThreatFeedRefreshSecs", "60", int(60)),
+	Entry("ThreatFeedMaxEntries", "ThreatFeedMaxEntries", "1000", int(1000)),
+	Entry("NfacctClasses", "NfacctClasses", "pods=10.65.0.0/16,pods-v6=fd00:65::/64",
+		"pods=10.65.0.0/16,pods-v6=fd00:65::/64"),
+	Entry("NfacctPollSecs", "NfacctPollSecs", "30", int(30)),
+	Entry("ConntrackMonitorEnabled", "ConntrackMonitorEnabled", "true", true),
+	Entry("ConntrackMonitorPollSecs", "ConntrackMonitorPollSecs", "60", int(60)),
+	Entry("ConntrackWarningThresholdPercent", "ConntrackWarningThresholdPercent", "90", int(90)),
+	Entry("ConntrackMaxEntries", "ConntrackMaxEntries", "1048576", int(1048576)),
+
+	Entry("HealthEnabled", "HealthEnabled", "true", true),
+	Entry("HealthPort", "HealthPort", "1234", int(1234)),
+	Entry("WatchdogEnabled", "WatchdogEnabled", "true", true),
+	Entry("WatchdogTimeoutSecs", "WatchdogTimeoutSecs", "120", int(120)),
+	Entry("WatchdogExitOnWedge", "WatchdogExitOnWedge", "true", true),
+	Entry("SubsystemMaxRestarts", "SubsystemMaxRestarts", "0", int(0)),
+	Entry("StateCacheFile", "StateCacheFile",
+		"/var/lib/calico/felix-state.json", "/var/lib/calico/felix-state.json"),
+	Entry("SnapshotFile", "SnapshotFile",
+		"/var/lib/calico/felix-snapshot.gz", "/var/lib/calico/felix-snapshot.gz"),
+	Entry("SnapshotMaxAgeSecs", "SnapshotMaxAgeSecs", "0", int(0)),
+	Entry("SnapshotSaveIntervalSecs", "SnapshotSaveIntervalSecs", "60", int(60)),
+
+	Entry("DebugServerEnabled", "DebugServerEnabled", "true", true),
+	Entry("DebugServerAddr", "DebugServerAddr", "localhost:1234", "localhost:1234"),
+	Entry("DebugCaptureDir", "DebugCaptureDir", "/tmp/captures", "/tmp/captures"),
+	Entry("DebugCaptureMaxSecs", "DebugCaptureMaxSecs", "300", 300),
+	Entry("DebugTraceMaxSecs", "DebugTraceMaxSecs", "60", 60),
+	Entry("DebugStateSocket", "DebugStateSocket",
+		"/var/run/calico/felix-state.sock", "/var/run/calico/felix-state.sock"),
 
 	Entry("PrometheusMetricsEnabled", "PrometheusMetricsEnabled", "true", true),
 	Entry("PrometheusMetricsPort", "PrometheusMetricsPort", "1234", int(1234)),
@@ -123,3 +237,90 @@ var _ = DescribeTable("Config parsing",
 	Entry("FailsafeInboundHostPorts", "FailsafeInboundHostPorts", "1,2,3,4", []int{1, 2, 3, 4}),
 	Entry("FailsafeOutboundHostPorts", "FailsafeOutboundHostPorts", "1,2,3,4", []int{1, 2, 3, 4}),
 )
+
+var _ = DescribeTable("Restart required",
+	func(oldRaw, newRaw map[string]string, expected bool) {
+		Expect(RestartRequired(oldRaw, newRaw)).To(Equal(expected))
+	},
+
+	Entry("no change", map[string]string{"InterfacePrefix": "cali"},
+		map[string]string{"InterfacePrefix": "cali"}, false),
+	Entry("log level changed", map[string]string{"LogSeverityScreen": "INFO"},
+		map[string]string{"LogSeverityScreen": "DEBUG"}, false),
+	Entry("log level added", map[string]string{},
+		map[string]string{"LogSeverityFile": "DEBUG"}, false),
+	Entry("log level override added", map[string]string{},
+		map[string]string{"LogSeverityOverrides": "iptables=DEBUG"}, false),
+	Entry("refresh interval removed", map[string]string{"IptablesRefreshInterval": "10"},
+		map[string]string{}, false),
+	Entry("resync interval changed", map[string]string{"PeriodicResyncInterval": "10"},
+		map[string]string{"PeriodicResyncInterval": "20"}, false),
+	Entry("dataplane param changed", map[string]string{"InterfacePrefix": "cali"},
+		map[string]string{"InterfacePrefix": "tap"}, true),
+	Entry("dataplane param added", map[string]string{},
+		map[string]string{"IpInIpEnabled": "true"}, true),
+	Entry("live and dataplane params changed",
+		map[string]string{"LogSeverityScreen": "INFO", "IpInIpEnabled": "false"},
+		map[string]string{"LogSeverityScreen": "DEBUG", "IpInIpEnabled": "true"}, true),
+	Entry("unknown param changed", map[string]string{"PluginParam": "a"},
+		map[string]string{"PluginParam": "b"}, true),
+)
+
+var _ = Describe("ThreatFeedSpecs", func() {
+	It("should split the feeds into names and sources, in order", func() {
+		config := New()
+		config.UpdateFrom(map[string]string{
+			"ThreatFeeds": "drop=https://example.com/drop.txt?fmt=plain,local=/etc/deny.txt",
+		}, EnvironmentVariable)
+		names, sources := config.ThreatFeedSpecs()
+		Expect(names).To(Equal([]string{"drop", "local"}))
+		Expect(sources).To(Equal([]string{"https://example.com/drop.txt?fmt=plain", "/etc/deny.txt"}))
+	})
+	It("should return nothing if no feeds are configured", func() {
+		names, sources := New().ThreatFeedSpecs()
+		Expect(names).To(BeEmpty())
+		Expect(sources).To(BeEmpty())
+	})
+})
+
+var _ = Describe("PortForwardSpecs", func() {
+	It("should split the forwards into frontends and backends, in order", func() {
+		config := New()
+		config.UpdateFrom(map[string]string{
+			"PortForwards": "tcp:203.0.113.5:80=10.65.0.2:8080,udp:203.0.113.6:53=10.65.0.3:53",
+		}, EnvironmentVariable)
+		frontends, backends := config.PortForwardSpecs()
+		Expect(frontends).To(Equal([]string{"tcp:203.0.113.5:80", "udp:203.0.113.6:53"}))
+		Expect(backends).To(Equal([]string{"10.65.0.2:8080", "10.65.0.3:53"}))
+	})
+	It("should reject an invalid address", func() {
+		config := New()
+		config.UpdateFrom(map[string]string{
+			"FelixHostname": "hostname",
+			"PortForwards":  "tcp:203.0.113.5:80=10.65.0.300:8080",
+		}, EnvironmentVariable)
+		Expect(config.Err).NotTo(HaveOccurred())
+		Expect(config.Validate()).To(HaveOccurred())
+	})
+	It("should reject a zero port", func() {
+		config := New()
+		config.UpdateFrom(map[string]string{
+			"FelixHostname": "hostname",
+			"PortForwards":  "tcp:203.0.113.5:0=10.65.0.3:8080",
+		}, EnvironmentVariable)
+		Expect(config.Validate()).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("KubeNodePortRange", func() {
+	It("should reject a range that ends before it starts", func() {
+		config := New()
+		config.UpdateFrom(map[string]string{
+			"FelixHostname":        "hostname",
+			"KubeNodePortRangeMin": "32767",
+			"KubeNodePortRangeMax": "30000",
+		}, EnvironmentVariable)
+		Expect(config.Err).NotTo(HaveOccurred())
+		Expect(config.Validate()).To(HaveOccurred())
+	})
+})
@@ -32,4 +32,19 @@
 //     DatastorePerHost     // Per-host overrides from the datastore.
 //     ConfigFile           // The local config file.
 //     EnvironmentVariable  // Environment variables.
+//
+// Parameters flagged as "local" (such as those needed to connect to the
+// datastore) are only accepted from the config file and environment
+// variables.  Those local sources are only read at start of day.
+//
+// Live update
+//
+// Config from the datastore is monitored for changes after start of day.
+// Parameters flagged as "live", such as the log levels and the resync/refresh
+// intervals, are applied on the fly.  A change to any other parameter may
+// affect the dataplane so Felix restarts cleanly to pick it up.  Use
+//
+//    config.RestartRequired(oldRawValues, newRawValues)
+//
+// to decide which applies to a change.
 package config
@@ -40,6 +40,7 @@ type Metadata struct {
 	NonZero           bool
 	DieOnParseFailure bool
 	Local             bool
+	Live              bool
 }
 
 func (m *Metadata) GetMetadata() *Metadata {
@@ -205,6 +206,47 @@ func (p *Ipv4Param) Parse(raw string) (result interface{}, err error) {
 	return
 }
 
+// CIDRParam parses a CIDR of the given IP version, returning it in
+// canonical form, with the host bits cleared.
+type CIDRParam struct {
+	Metadata
+	Version int
+}
+
+func (p *CIDRParam) Parse(raw string) (interface{}, error) {
+	_, ipNet, err := net.ParseCIDR(raw)
+	if err != nil {
+		return nil, p.parseFailed(raw, "invalid CIDR")
+	}
+	if (ipNet.IP.To4() != nil) != (p.Version == 4) {
+		return nil, p.parseFailed(raw, fmt.Sprintf("not an IPv%d CIDR", p.Version))
+	}
+	return ipNet.String(), nil
+}
+
+// CIDRListParam parses a comma-separated list of CIDRs of either IP
+// version.
+type CIDRListParam struct {
+	Metadata
+}
+
+func (p *CIDRListParam) Parse(raw string) (interface{}, error) {
+	result := []string{}
+	for _, cidrStr := range strings.Split(raw, ",") {
+		cidrStr = strings.Trim(cidrStr, " ")
+		if len(cidrStr) == 0 {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidrStr)
+		if err != nil {
+			return nil, p.parseFailed(raw,
+				fmt.Sprintf("%v is not a valid CIDR", cidrStr))
+		}
+		result = append(result, ipNet.String())
+	}
+	return result, nil
+}
+
 type PortListParam struct {
 	Metadata
 }
@@ -226,6 +268,27 @@ func (p *PortListParam) Parse(raw string) (interface{}, error) {
 	return result, nil
 }
 
+type IPListParam struct {
+	Metadata
+}
+
+func (p *IPListParam) Parse(raw string) (interface{}, error) {
+	result := []string{}
+	for _, ipStr := range strings.Split(raw, ",") {
+		ipStr = strings.Trim(ipStr, " ")
+		if len(ipStr) == 0 {
+			continue
+		}
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return nil, p.parseFailed(raw,
+				fmt.Sprintf("%v is not a valid IP", ipStr))
+		}
+		result = append(result, ip.String())
+	}
+	return result, nil
+}
+
 type EndpointListParam struct {
 	Metadata
 }
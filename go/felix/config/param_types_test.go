@@ -38,3 +38,61 @@ var _ = DescribeTable("Endpoint list parameter parsing",
 	Entry("Two URLs extra commas", ",http://etcd:1234,,http://etcd2:2345,",
 		[]string{"http://etcd:1234/", "http://etcd2:2345/"}),
 )
+
+var _ = DescribeTable("IP list parameter parsing",
+	func(raw string, expected interface{}) {
+		p := IPListParam{Metadata{
+			Name: "IPs",
+		}}
+		actual, err := p.Parse(raw)
+		Expect(err).To(BeNil())
+		Expect(actual).To(Equal(expected))
+	},
+	Entry("Empty", "", []string{}),
+	Entry("Single IP", "10.0.0.1", []string{"10.0.0.1"}),
+	Entry("Mixed families", "10.0.0.1, FD00::1", []string{"10.0.0.1", "fd00::1"}),
+	Entry("Extra commas", ",10.0.0.1,,10.0.0.2,", []string{"10.0.0.1", "10.0.0.2"}),
+)
+
+var _ = DescribeTable("IP list parameter parsing failures",
+	func(raw string) {
+		p := IPListParam{Metadata{
+			Name: "IPs",
+		}}
+		_, err := p.Parse(raw)
+		Expect(err).To(HaveOccurred())
+	},
+	Entry("Hostname", "dns.example.com"),
+	Entry("CIDR", "10.0.0.0/24"),
+)
+
+var _ = DescribeTable("CIDR parameter parsing",
+	func(version int, raw string, expected interface{}) {
+		p := CIDRParam{Metadata: Metadata{Name: "CIDR"}, Version: version}
+		actual, err := p.Parse(raw)
+		if expected == nil {
+			Expect(err).To(HaveOccurred())
+			return
+		}
+		Expect(err).To(BeNil())
+		Expect(actual).To(Equal(expected))
+	},
+	Entry("IPv4", 4, "10.0.0.0/8", "10.0.0.0/8"),
+	Entry("IPv6 with host bits", 6, "64:FF9B::1/96", "64:ff9b::/96"),
+	Entry("Wrong version", 4, "64:ff9b::/96", nil),
+	Entry("Address", 6, "fd00::1", nil),
+)
+
+var _ = DescribeTable("CIDR list parameter parsing",
+	func(raw string, expected interface{}) {
+		p := CIDRListParam{Metadata{
+			Name: "CIDRs",
+		}}
+		actual, err := p.Parse(raw)
+		Expect(err).To(BeNil())
+		Expect(actual).To(Equal(expected))
+	},
+	Entry("Empty", "", []string{}),
+	Entry("Mixed families", "10.0.0.1/8, FD00::/64", []string{"10.0.0.0/8", "fd00::/64"}),
+	Entry("Extra commas", ",10.0.0.0/8,,", []string{"10.0.0.0/8"}),
+)
@@ -0,0 +1,206 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The conntrack package removes conntrack entries from the kernel, using the
+// conntrack binary.  Once a flow has an entry in the conntrack table, the
+// kernel typically lets its packets through without re-evaluating the full
+// policy; removing the entries for an endpoint's IPs ensures that existing
+// flows are cut off when the endpoint is removed or when a policy change
+// newly denies its traffic.
+//
+// Removals are queued and then executed in a batch by Flush(), which allows
+// the caller to defer the (relatively expensive) removal until after it has
+// programmed the rules that block the traffic.  Otherwise, a packet could
+// recreate the entry in the window between the removal and the update of
+// the rules.
+//
+// Flows can also be removed by their conntrack mark.  That's used to
+// invalidate the verdicts that the endpoint chains cache in the connmark:
+// after a policy change, the marked flows are removed so that their next
+// packet is checked against the new policy.
+package conntrack
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"github.com/projectcalico/felix/go/felix/set"
+	"net"
+	"sort"
+	"strings"
+)
+
+const numRetries = 3
+
+// directions lists the conntrack options that select flows with the IP in each
+// possible position.
+var directions = []string{
+	"--orig-src",
+	"--orig-dst",
+	"--reply-src",
+	"--reply-dst",
+}
+
+type Conntrack struct {
+	newCmd       cmdshim.NewCmd
+	pendingIPv4  set.Set
+	pendingIPv6  set.Set
+	pendingMarks set.Set
+}
+
+func New() *Conntrack {
+	return NewWithCmdShim(cmdshim.NewRealCmd)
+}
+
+// NewWithCmdShim is a test constructor that allows for shimming exec.Command.
+func NewWithCmdShim(shim cmdshim.NewCmd) *Conntrack {
+	return &Conntrack{
+		newCmd:       shim,
+		pendingIPv4:  set.New(),
+		pendingIPv6:  set.New(),
+		pendingMarks: set.New(),
+	}
+}
+
+// QueueFlowRemoval queues the removal of all conntrack entries that involve
+// the given IP.  The removal happens on the next call to Flush().  Queuing the
+// same IP more than once is a no-op.
+func (c *Conntrack) QueueFlowRemoval(ipAddr net.IP) {
+	if ipv4 := ipAddr.To4(); ipv4 != nil {
+		c.pendingIPv4.Add(ipv4.String())
+	} else {
+		c.pendingIPv6.Add(ipAddr.String())
+	}
+}
+
+// QueueMarkedFlowRemoval queues the removal of all conntrack entries, of
+// both IP versions, whose mark has all the bits of the given mark set.  The
+// removal happens on the next call to Flush().
+func (c *Conntrack) QueueMarkedFlowRemoval(mark uint32) {
+	c.pendingMarks.Add(mark)
+}
+
+// NumPendingRemovals returns the number of IPs and marks that are queued for
+// removal.
+func (c *Conntrack) NumPendingRemovals() int {
+	return c.pendingIPv4.Len() + c.pendingIPv6.Len() + c.pendingMarks.Len()
+}
+
+// Flush executes all the queued removals.  Failures are logged but otherwise
+// ignored: the removal is best-effort and retrying indefinitely would block
+// the dataplane.
+func (c *Conntrack) Flush() {
+	if c.NumPendingRemovals() == 0 {
+		return
+	}
+	log.WithField("numRemovals", c.NumPendingRemovals()).Info(
+		"Removing queued conntrack flows")
+	for _, ip := range sortedIPs(c.pendingIPv4) {
+		c.removeConntrackFlows(4, ip)
+	}
+	for _, ip := range sortedIPs(c.pendingIPv6) {
+		c.removeConntrackFlows(6, ip)
+	}
+	for _, mark := range sortedMarks(c.pendingMarks) {
+		c.removeMarkedFlows(mark)
+	}
+	c.pendingIPv4 = set.New()
+	c.pendingIPv6 = set.New()
+	c.pendingMarks = set.New()
+}
+
+// RemoveConntrackFlows immediately removes all conntrack entries that
+// involve the given IP.
+func (c *Conntrack) RemoveConntrackFlows(ipVersion uint8, ipAddr net.IP) {
+	c.removeConntrackFlows(ipVersion, ipAddr.String())
+}
+
+func (c *Conntrack) removeConntrackFlows(ipVersion uint8, ipAddr string) {
+	family := ipFamily(ipVersion)
+	log.WithField("ip", ipAddr).Info("Removing conntrack flows")
+	for _, direction := range directions {
+		logCxt := log.WithFields(log.Fields{"ip": ipAddr, "direction": direction})
+		c.runWithRetries(logCxt, "--family", family, "--delete", direction, ipAddr)
+	}
+}
+
+func (c *Conntrack) removeMarkedFlows(mark uint32) {
+	markArg := fmt.Sprintf("%#x/%#x", mark, mark)
+	log.WithField("mark", markArg).Info("Removing marked conntrack flows")
+	for _, ipVersion := range []uint8{4, 6} {
+		family := ipFamily(ipVersion)
+		logCxt := log.WithFields(log.Fields{"mark": markArg, "family": family})
+		c.runWithRetries(logCxt, "--family", family, "--delete", "--mark", markArg)
+	}
+}
+
+func (c *Conntrack) runWithRetries(logCxt *log.Entry, args ...string) {
+	// Retry a few times because the conntrack command seems to fail at
+	// random.
+	for retry := 0; retry <= numRetries; retry += 1 {
+		cmd := c.newCmd("conntrack", args...)
+		output, err := cmd.CombinedOutput()
+		if err == nil {
+			logCxt.Debug("Successfully removed conntrack flows.")
+			break
+		}
+		if strings.Contains(string(output), "0 flow entries") {
+			// Success, there were no flows.
+			logCxt.Debug("No matching flows in conntrack")
+			break
+		}
+		if retry == numRetries {
+			logCxt.WithError(err).Error("Failed to remove conntrack flows after retries.")
+		} else {
+			logCxt.WithError(err).Warn("Failed to remove conntrack flows, will retry...")
+		}
+	}
+}
+
+func ipFamily(ipVersion uint8) string {
+	switch ipVersion {
+	case 4:
+		return "ipv4"
+	case 6:
+		return "ipv6"
+	}
+	log.WithField("version", ipVersion).Panic("Unknown IP version")
+	return ""
+}
+
+func sortedIPs(ips set.Set) []string {
+	sorted := make([]string, 0, ips.Len())
+	ips.Iter(func(item interface{}) error {
+		sorted = append(sorted, item.(string))
+		return nil
+	})
+	sort.Strings(sorted)
+	return sorted
+}
+
+func sortedMarks(marks set.Set) []uint32 {
+	sorted := make([]uint32, 0, marks.Len())
+	marks.Iter(func(item interface{}) error {
+		sorted = append(sorted, item.(uint32))
+		return nil
+	})
+	sort.Sort(marksByValue(sorted))
+	return sorted
+}
+
+type marksByValue []uint32
+
+func (m marksByValue) Len() int           { return len(m) }
+func (m marksByValue) Less(i, j int) bool { return m[i] < m[j] }
+func (m marksByValue) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
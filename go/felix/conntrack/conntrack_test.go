@@ -0,0 +1,131 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conntrack_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/conntrack"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"net"
+)
+
+var _ = Describe("Conntrack", func() {
+	var conntrack *Conntrack
+	var cmdRec *cmdshim.Recorder
+	BeforeEach(func() {
+		cmdRec = &cmdshim.Recorder{}
+		conntrack = NewWithCmdShim(cmdRec.NewCmd)
+	})
+
+	It("should remove flows for an IPv4 address in all directions", func() {
+		conntrack.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+		Expect(cmdRec.Commands()).To(Equal([]string{
+			"conntrack --family ipv4 --delete --orig-src 10.0.0.1",
+			"conntrack --family ipv4 --delete --orig-dst 10.0.0.1",
+			"conntrack --family ipv4 --delete --reply-src 10.0.0.1",
+			"conntrack --family ipv4 --delete --reply-dst 10.0.0.1",
+		}))
+	})
+	It("should remove flows for an IPv6 address", func() {
+		conntrack.RemoveConntrackFlows(6, net.ParseIP("fe80::1"))
+		Expect(cmdRec.Commands()).To(ContainElement(
+			"conntrack --family ipv6 --delete --orig-src fe80::1"))
+		Expect(cmdRec.Commands()).To(HaveLen(4))
+	})
+	It("should panic on an unknown IP version", func() {
+		Expect(func() {
+			conntrack.RemoveConntrackFlows(5, net.ParseIP("10.0.0.1"))
+		}).To(Panic())
+	})
+	It("should treat a no-flows error as success", func() {
+		cmdRec.NumFailures = 1
+		cmdRec.Output = "0 flow entries have been deleted."
+		conntrack.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+		Expect(cmdRec.Commands()).To(HaveLen(4))
+	})
+	It("should retry a failed removal", func() {
+		cmdRec.NumFailures = 2
+		conntrack.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+		Expect(cmdRec.Commands()).To(HaveLen(6))
+	})
+	It("should give up after retries", func() {
+		cmdRec.NumFailures = 100
+		conntrack.RemoveConntrackFlows(4, net.ParseIP("10.0.0.1"))
+		Expect(cmdRec.Commands()).To(HaveLen(16))
+	})
+
+	Describe("with queued removals", func() {
+		BeforeEach(func() {
+			conntrack.QueueFlowRemoval(net.ParseIP("10.0.0.2"))
+			conntrack.QueueFlowRemoval(net.ParseIP("fe80::1"))
+			conntrack.QueueFlowRemoval(net.ParseIP("10.0.0.1"))
+			conntrack.QueueFlowRemoval(net.ParseIP("10.0.0.2"))
+		})
+
+		It("should dedupe the queue", func() {
+			Expect(conntrack.NumPendingRemovals()).To(Equal(3))
+		})
+		It("should not run any commands until flushed", func() {
+			Expect(cmdRec.Commands()).To(BeEmpty())
+		})
+		It("should remove the flows in order on flush", func() {
+			conntrack.Flush()
+			Expect(cmdRec.Commands()).To(HaveLen(12))
+			Expect(cmdRec.Commands()[0]).To(Equal(
+				"conntrack --family ipv4 --delete --orig-src 10.0.0.1"))
+			Expect(cmdRec.Commands()[4]).To(Equal(
+				"conntrack --family ipv4 --delete --orig-src 10.0.0.2"))
+			Expect(cmdRec.Commands()[8]).To(Equal(
+				"conntrack --family ipv6 --delete --orig-src fe80::1"))
+			Expect(conntrack.NumPendingRemovals()).To(Equal(0))
+		})
+		It("should do nothing on a second flush", func() {
+			conntrack.Flush()
+			cmdRec.Reset()
+			conntrack.Flush()
+			Expect(cmdRec.Commands()).To(BeEmpty())
+		})
+	})
+
+	Describe("with queued mark removals", func() {
+		BeforeEach(func() {
+			conntrack.QueueMarkedFlowRemoval(0x40)
+			conntrack.QueueMarkedFlowRemoval(0x20)
+			conntrack.QueueMarkedFlowRemoval(0x40)
+		})
+
+		It("should dedupe the queue", func() {
+			Expect(conntrack.NumPendingRemovals()).To(Equal(2))
+		})
+		It("should remove the marked flows of both IP versions on flush", func() {
+			conntrack.Flush()
+			Expect(cmdRec.Commands()).To(Equal([]string{
+				"conntrack --family ipv4 --delete --mark 0x20/0x20",
+				"conntrack --family ipv6 --delete --mark 0x20/0x20",
+				"conntrack --family ipv4 --delete --mark 0x40/0x40",
+				"conntrack --family ipv6 --delete --mark 0x40/0x40",
+			}))
+			Expect(conntrack.NumPendingRemovals()).To(Equal(0))
+		})
+		It("should retry a failed removal", func() {
+			cmdRec.NumFailures = 1
+			conntrack.Flush()
+			Expect(cmdRec.Commands()).To(HaveLen(5))
+			Expect(cmdRec.Commands()[1]).To(Equal(cmdRec.Commands()[0]))
+		})
+	})
+})
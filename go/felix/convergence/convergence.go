@@ -0,0 +1,121 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The convergence package tracks which datastore revision the dataplane has
+// caught up with, so that operators can measure how long a policy change
+// takes to propagate from the datastore to the dataplane.
+//
+// After each flush, the calculation graph emits a RevisionMarker with the
+// latest datastore revision that it has processed.  The marker travels down
+// the same pipeline as the dataplane updates, behind the updates that the
+// revision caused; when it comes out of the end, the Tracker records that
+// the dataplane is in sync up to that revision.  Since nothing overtakes a
+// marker, and the throttle holds a marker back until it has released the
+// updates that it's holding, the revision is never ahead of the dataplane.
+//
+// With the external dataplane driver, the end of the pipeline is the pipe
+// to the driver, which applies the updates in order but doesn't acknowledge
+// them, so the recorded time is when the updates were handed to the driver.
+package convergence
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	gaugeRevision = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_dataplane_in_sync_revision",
+		Help: "Datastore revision that the dataplane is in sync up to, if the revision is numeric.",
+	})
+	gaugeRevisionTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_dataplane_in_sync_timestamp_seconds",
+		Help: "Time at which the dataplane caught up with felix_dataplane_in_sync_revision.",
+	})
+	summaryPropagation = prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "felix_dataplane_propagation_latency_seconds",
+		Help: "Time from Felix processing a datastore revision to the dataplane being in sync with it.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(gaugeRevision)
+	prometheus.MustRegister(gaugeRevisionTime)
+	prometheus.MustRegister(summaryPropagation)
+}
+
+// RevisionMarker marks the point in the stream of dataplane updates after
+// which the dataplane reflects the given datastore revision.  It's not
+// passed to the dataplane driver.
+type RevisionMarker struct {
+	Revision string
+	// ProcessedAt is the time at which the calculation graph processed the
+	// revision.
+	ProcessedAt time.Time
+}
+
+// Status is the convergence status of the dataplane.
+type Status struct {
+	// Revision is the latest datastore revision that the dataplane is in
+	// sync with, and Time is when it caught up.
+	Revision string    `json:"revision"`
+	Time     time.Time `json:"time"`
+	// ProcessedAt is when the calculation graph processed the revision, so
+	// Time - ProcessedAt is how long it took to propagate.
+	ProcessedAt time.Time `json:"processedAt"`
+}
+
+// Tracker records the revision that the dataplane is in sync up to.  It is
+// safe for concurrent use.
+type Tracker struct {
+	lock   sync.Mutex
+	status Status
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{}
+}
+
+// OnMarker records that the dataplane has caught up with the marker's
+// revision at time now.
+func (t *Tracker) OnMarker(marker *RevisionMarker, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.status = Status{
+		Revision:    marker.Revision,
+		Time:        now,
+		ProcessedAt: marker.ProcessedAt,
+	}
+	latency := now.Sub(marker.ProcessedAt)
+	log.WithFields(log.Fields{
+		"revision": marker.Revision,
+		"latency":  latency,
+	}).Debug("Dataplane in sync with revision")
+	if revision, err := strconv.ParseFloat(marker.Revision, 64); err == nil {
+		gaugeRevision.Set(revision)
+	}
+	gaugeRevisionTime.Set(float64(now.UnixNano()) / float64(time.Second))
+	summaryPropagation.Observe(latency.Seconds())
+}
+
+// Status returns the latest revision that the dataplane is in sync with, or
+// a zero Status if there isn't one yet.
+func (t *Tracker) Status() Status {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.status
+}
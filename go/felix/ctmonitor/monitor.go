@@ -0,0 +1,226 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The ctmonitor package monitors the size of the kernel's conntrack table.
+// Once the table is full, the kernel drops the packets of new flows, so the
+// Monitor exports the number of entries, the limit and the entries of each
+// IP protocol as metrics, and warns when the table passes a threshold.  It
+// can also raise the limit, the nf_conntrack_max sysctl, at start of day.
+package ctmonitor
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxEntriesFile = "/proc/sys/net/netfilter/nf_conntrack_max"
+
+var (
+	gaugeEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_conntrack_entries",
+		Help: "Number of entries in the conntrack table.",
+	})
+	gaugeMaxEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_conntrack_max_entries",
+		Help: "Size limit of the conntrack table.",
+	})
+	gaugeProtocolEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "felix_conntrack_protocol_entries",
+		Help: "Number of entries in the conntrack table for each IP protocol.",
+	}, []string{"protocol"})
+)
+
+func init() {
+	prometheus.MustRegister(gaugeEntries)
+	prometheus.MustRegister(gaugeMaxEntries)
+	prometheus.MustRegister(gaugeProtocolEntries)
+}
+
+// protocolNames maps from IP protocol number to the name that the metrics
+// use; other protocols are counted as "other".
+var protocolNames = map[uint8]string{
+	1:   "icmp",
+	6:   "tcp",
+	17:  "udp",
+	58:  "icmpv6",
+	132: "sctp",
+}
+
+// Stats are the conntrack table's statistics.
+type Stats struct {
+	Entries    uint32
+	MaxEntries uint32
+	// ProtocolEntries maps from protocol name to the number of entries of
+	// that protocol.
+	ProtocolEntries map[string]uint32
+}
+
+// Config holds the tunable parameters of the Monitor.
+type Config struct {
+	// PollInterval is how often the table is read.
+	PollInterval time.Duration
+	// WarningThresholdPercent is how full, as a percentage of its limit,
+	// the table may get before the Monitor logs a warning.
+	WarningThresholdPercent int
+	// MaxEntries, if non-zero, is the lowest limit for the table; the
+	// Monitor raises the nf_conntrack_max sysctl to it if it's lower.
+	// A higher limit is left alone.
+	MaxEntries uint32
+
+	// ReadStatsOverride, if non-nil, is used in place of reading the stats
+	// from the kernel.
+	ReadStatsOverride func() (*Stats, error)
+	// ReadFileOverride, if non-nil, is used in place of ioutil.ReadFile.
+	ReadFileOverride func(filename string) ([]byte, error)
+	// WriteFileOverride, if non-nil, is used in place of ioutil.WriteFile.
+	WriteFileOverride func(filename string, data []byte) error
+}
+
+type Monitor struct {
+	config    Config
+	readStats func() (*Stats, error)
+	readFile  func(filename string) ([]byte, error)
+	writeFile func(filename string, data []byte) error
+
+	// overThreshold is true if the table was over the warning threshold
+	// at the last poll; we only warn when it first crosses the threshold.
+	overThreshold bool
+}
+
+func New(config Config) *Monitor {
+	m := &Monitor{
+		config:    config,
+		readStats: config.ReadStatsOverride,
+		readFile:  config.ReadFileOverride,
+		writeFile: config.WriteFileOverride,
+	}
+	if m.readStats == nil {
+		m.readStats = readKernelStats
+	}
+	if m.readFile == nil {
+		m.readFile = ioutil.ReadFile
+	}
+	if m.writeFile == nil {
+		m.writeFile = func(filename string, data []byte) error {
+			return ioutil.WriteFile(filename, data, 0644)
+		}
+	}
+	return m
+}
+
+// EnsureMaxEntries raises the nf_conntrack_max sysctl to the configured
+// MaxEntries, if it's lower.
+func (m *Monitor) EnsureMaxEntries() error {
+	if m.config.MaxEntries == 0 {
+		return nil
+	}
+	data, err := m.readFile(maxEntriesFile)
+	if err != nil {
+		log.WithError(err).Warn("Failed to read conntrack table limit")
+		return err
+	}
+	current, err := parseMaxEntries(data)
+	if err != nil {
+		log.WithError(err).Warn("Failed to parse conntrack table limit")
+		return err
+	}
+	if current >= m.config.MaxEntries {
+		log.WithField("limit", current).Debug("Conntrack table limit is high enough")
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"from": current,
+		"to":   m.config.MaxEntries,
+	}).Info("Raising conntrack table limit")
+	err = m.writeFile(maxEntriesFile, []byte(strconv.FormatUint(uint64(m.config.MaxEntries), 10)))
+	if err != nil {
+		log.WithError(err).Error("Failed to raise conntrack table limit")
+	}
+	return err
+}
+
+// UpdateMetrics reads the stats into the metrics and warns if the table has
+// passed the warning threshold.
+func (m *Monitor) UpdateMetrics() error {
+	stats, err := m.readStats()
+	if err != nil {
+		log.WithError(err).Warn("Failed to read conntrack table stats")
+		return err
+	}
+	gaugeEntries.Set(float64(stats.Entries))
+	gaugeMaxEntries.Set(float64(stats.MaxEntries))
+	// Reset the protocols' gauges so that protocols that no longer have
+	// any entries don't keep their old counts.
+	gaugeProtocolEntries.Reset()
+	for protocol, entries := range stats.ProtocolEntries {
+		gaugeProtocolEntries.WithLabelValues(protocol).Set(float64(entries))
+	}
+	m.checkThreshold(stats)
+	return nil
+}
+
+func (m *Monitor) checkThreshold(stats *Stats) {
+	if stats.MaxEntries == 0 {
+		return
+	}
+	logCxt := log.WithFields(log.Fields{
+		"entries":    stats.Entries,
+		"maxEntries": stats.MaxEntries,
+	})
+	over := uint64(stats.Entries)*100 >= uint64(stats.MaxEntries)*uint64(m.config.WarningThresholdPercent)
+	if over && !m.overThreshold {
+		logCxt.WithField("protocolEntries", stats.ProtocolEntries).Warn(
+			"Conntrack table is nearly full, new flows will be dropped once it's full")
+	} else if !over && m.overThreshold {
+		logCxt.Info("Conntrack table is no longer nearly full")
+	}
+	m.overThreshold = over
+}
+
+// OverThreshold returns true if the table was over the warning threshold at
+// the last poll.
+func (m *Monitor) OverThreshold() bool {
+	return m.overThreshold
+}
+
+// Run raises the table's limit, if required, and then updates the metrics
+// every interval.  It never returns.
+func (m *Monitor) Run() error {
+	m.EnsureMaxEntries()
+	ticker := time.NewTicker(m.config.PollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.UpdateMetrics()
+	}
+	return nil
+}
+
+// countProtocol adds an entry of the given IP protocol to the counts.
+func countProtocol(counts map[string]uint32, protocol uint8) {
+	name, ok := protocolNames[protocol]
+	if !ok {
+		name = "other"
+	}
+	counts[name]++
+}
+
+// parseMaxEntries parses the content of the nf_conntrack_max sysctl.
+func parseMaxEntries(data []byte) (uint32, error) {
+	maxEntries, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	return uint32(maxEntries), err
+}
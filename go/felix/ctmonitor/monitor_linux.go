@@ -0,0 +1,47 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ctmonitor
+
+import (
+	"github.com/projectcalico/felix/go/felix/nfnetlink"
+	"io/ioutil"
+)
+
+// readKernelStats reads the stats over netlink.  Older kernels don't report
+// the table's limit, so it falls back to the sysctl.
+func readKernelStats() (*Stats, error) {
+	protocolEntries := map[string]uint32{}
+	ctStats, err := nfnetlink.ReadConntrackStats(func(protocol uint8) {
+		countProtocol(protocolEntries, protocol)
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{
+		Entries:         ctStats.Entries,
+		MaxEntries:      ctStats.MaxEntries,
+		ProtocolEntries: protocolEntries,
+	}
+	if stats.MaxEntries == 0 {
+		data, err := ioutil.ReadFile(maxEntriesFile)
+		if err != nil {
+			return nil, err
+		}
+		if stats.MaxEntries, err = parseMaxEntries(data); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ctmonitor_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/ctmonitor"
+
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+const maxEntriesFile = "/proc/sys/net/netfilter/nf_conntrack_max"
+
+var _ = Describe("Monitor", func() {
+	var monitor *Monitor
+	var config Config
+	var stats *Stats
+	var statsErr error
+	var files map[string]string
+	var writes []string
+
+	BeforeEach(func() {
+		stats = &Stats{
+			Entries:         100,
+			MaxEntries:      1000,
+			ProtocolEntries: map[string]uint32{"tcp": 90, "udp": 10},
+		}
+		statsErr = nil
+		files = map[string]string{maxEntriesFile: "65536\n"}
+		writes = nil
+		config = Config{
+			PollInterval:            time.Second,
+			WarningThresholdPercent: 80,
+			ReadStatsOverride: func() (*Stats, error) {
+				return stats, statsErr
+			},
+			ReadFileOverride: func(filename string) ([]byte, error) {
+				data, ok := files[filename]
+				if !ok {
+					return nil, errors.New("no such file")
+				}
+				return []byte(data), nil
+			},
+			WriteFileOverride: func(filename string, data []byte) error {
+				writes = append(writes, filename+"="+string(data))
+				return nil
+			},
+		}
+	})
+	JustBeforeEach(func() {
+		monitor = New(config)
+	})
+
+	It("should update the metrics", func() {
+		Expect(monitor.UpdateMetrics()).To(Succeed())
+		Expect(monitor.OverThreshold()).To(BeFalse())
+	})
+	It("should report a failure to read the stats", func() {
+		statsErr = errors.New("netlink failure")
+		Expect(monitor.UpdateMetrics()).NotTo(Succeed())
+	})
+	It("should track the warning threshold", func() {
+		stats.Entries = 800
+		Expect(monitor.UpdateMetrics()).To(Succeed())
+		Expect(monitor.OverThreshold()).To(BeTrue())
+		stats.Entries = 799
+		Expect(monitor.UpdateMetrics()).To(Succeed())
+		Expect(monitor.OverThreshold()).To(BeFalse())
+	})
+	It("should ignore the threshold if the limit is unknown", func() {
+		stats.MaxEntries = 0
+		Expect(monitor.UpdateMetrics()).To(Succeed())
+		Expect(monitor.OverThreshold()).To(BeFalse())
+	})
+
+	It("should leave the limit alone by default", func() {
+		Expect(monitor.EnsureMaxEntries()).To(Succeed())
+		Expect(writes).To(BeEmpty())
+	})
+
+	Describe("with a configured limit", func() {
+		BeforeEach(func() {
+			config.MaxEntries = 262144
+		})
+
+		It("should raise a lower limit", func() {
+			Expect(monitor.EnsureMaxEntries()).To(Succeed())
+			Expect(writes).To(Equal([]string{maxEntriesFile + "=262144"}))
+		})
+		It("should leave a higher limit alone", func() {
+			files[maxEntriesFile] = "1048576\n"
+			Expect(monitor.EnsureMaxEntries()).To(Succeed())
+			Expect(writes).To(BeEmpty())
+		})
+		It("should report a failure to read the limit", func() {
+			delete(files, maxEntriesFile)
+			Expect(monitor.EnsureMaxEntries()).NotTo(Succeed())
+			Expect(writes).To(BeEmpty())
+		})
+		It("should report an unparseable limit", func() {
+			files[maxEntriesFile] = "lots"
+			Expect(monitor.EnsureMaxEntries()).NotTo(Succeed())
+			Expect(writes).To(BeEmpty())
+		})
+	})
+})
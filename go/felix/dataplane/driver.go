@@ -0,0 +1,38 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The dataplane package defines the interface between Felix's policy
+// calculation engine and the dataplane driver that programs the host.
+//
+// The calculation graph emits protobuf messages (ipset, active policy and
+// profile, and endpoint updates), which the driver is responsible for
+// rendering into the dataplane, for example as iptables chains, ipsets and
+// routes.  In the other direction, the driver reports process and endpoint
+// status back as protobuf messages.  Since the interface is purely
+// message-based, a driver can be implemented in-process or as an external
+// process that speaks the same protocol over a pair of pipes (see the
+// extdataplane package).
+package dataplane
+
+// DataplaneDriver is implemented by each dataplane driver.
+type DataplaneDriver interface {
+	// SendMessage queues the given update for the dataplane.  Updates are
+	// pointers to the message types in the proto package; for example,
+	// *proto.IPSetUpdate or *proto.WorkloadEndpointRemove.
+	SendMessage(msg interface{}) error
+	// RecvMessage blocks until the dataplane has a status update for Felix,
+	// such as a *proto.ProcessStatusUpdate or
+	// *proto.WorkloadEndpointStatusUpdate.
+	RecvMessage() (msg interface{}, err error)
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package dataplane
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/bpf"
+	"github.com/projectcalico/felix/go/felix/bpfdataplane"
+	"github.com/projectcalico/felix/go/felix/config"
+	"github.com/projectcalico/felix/go/felix/conntrack"
+	"github.com/projectcalico/felix/go/felix/extdataplane"
+	"github.com/projectcalico/felix/go/felix/health"
+	"github.com/projectcalico/felix/go/felix/hostdataplane"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/policyrouting"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bpfRetryInterval is the interval at which the BPF dataplane retries
+// failed updates.  Updates that keep failing back off from there.
+const bpfRetryInterval = 10 * time.Second
+
+// hostRetryInterval is the interval at which the host dataplane retries
+// failed updates.
+const hostRetryInterval = 10 * time.Second
+
+// conntrackFlushDelay is how long the host dataplane gives the driver to
+// program an endpoint's chains before it removes the endpoint's flows.
+const conntrackFlushDelay = time.Second
+
+// StartDataplaneDriver starts the configured dataplane driver, wrapped by
+// the host dataplane, which programs the chains that the renderer renders
+// for the host as a whole and, if policyRouting and services are non-nil,
+// applies the policy routing and programs the services.  If the driver
+// runs as a separate process, the returned Cmd can be used to monitor and
+// stop it; otherwise, the Cmd is nil.
+func StartDataplaneDriver(
+	configParams *config.Config,
+	renderer rules.RuleRenderer,
+	policyRouting *policyrouting.Manager,
+	services *hostdataplane.Services,
+	healthAggregator *health.HealthAggregator,
+) (DataplaneDriver, *exec.Cmd) {
+	log.WithField("driver", configParams.DataplaneDriver).Info(
+		"Starting external dataplane driver.")
+	extDriver, cmd := extdataplane.StartExtDataplaneDriver(configParams.DataplaneDriver)
+	hostConfig := hostdataplane.Config{
+		IPv6Enabled:         configParams.Ipv6Support,
+		RetryInterval:       hostRetryInterval,
+		RefreshInterval:     time.Duration(configParams.IptablesRefreshInterval) * time.Second,
+		HealthAggregator:    healthAggregator,
+		PortForwards:        parsePortForwards(configParams),
+		DNSPolicyEnabled:    configParams.DNSPolicyEnabled,
+		Services:            services,
+		Conntrack:           conntrack.New(),
+		ConntrackFlushDelay: conntrackFlushDelay,
+	}
+	if policyRouting != nil {
+		// Avoid a non-nil interface that holds a nil pointer.
+		hostConfig.PolicyRouting = policyRouting
+	}
+	hostDP := hostdataplane.NewHostDataplaneDriver(
+		extDriver,
+		renderer,
+		func(name string, ipVersion uint8) hostdataplane.Table {
+			return iptables.NewTable(name, ipVersion, iptables.TableOptions{
+				ChainNamePrefix: rules.ChainNamePrefix,
+			})
+		},
+		hostConfig,
+	)
+	hostDP.Start()
+	if !configParams.BPFEnabled && !configParams.XDPEnabled {
+		return hostDP, cmd
+	}
+
+	// The BPF dataplane is experimental; it runs alongside the iptables
+	// driver, which still programs the full policy.
+	log.WithFields(log.Fields{
+		"tcEnabled":  configParams.BPFEnabled,
+		"tcObjFile":  configParams.BPFObjectFile,
+		"xdpEnabled": configParams.XDPEnabled,
+		"xdpObjFile": configParams.XDPObjectFile,
+	}).Info("BPF dataplane enabled, attaching programs to interfaces.")
+	var failsafePorts []uint16
+	for _, port := range configParams.FailsafeInboundHostPorts {
+		failsafePorts = append(failsafePorts, uint16(port))
+	}
+	bpfDP := bpfdataplane.NewBPFDataplaneDriver(
+		hostDP,
+		bpf.NewTC(configParams.BPFObjectFile),
+		bpf.NewXDP(configParams.XDPObjectFile),
+		bpf.NewPinnedMaps(),
+		bpfdataplane.Config{
+			RetryInterval:            bpfRetryInterval,
+			HealthAggregator:         healthAggregator,
+			TCEnabled:                configParams.BPFEnabled,
+			XDPEnabled:               configParams.XDPEnabled,
+			FailsafeInboundHostPorts: failsafePorts,
+		},
+	)
+	bpfDP.Start()
+	return bpfDP, cmd
+}
+
+// parsePortForwards parses the PortForwards, which Config.Validate() has
+// already checked.
+func parsePortForwards(configParams *config.Config) []rules.PortForward {
+	var forwards []rules.PortForward
+	frontends, backends := configParams.PortForwardSpecs()
+	for i, frontend := range frontends {
+		parts := strings.SplitN(frontend, ":", 2)
+		extIP, extPort := splitHostPort(parts[1])
+		wlIP, wlPort := splitHostPort(backends[i])
+		forwards = append(forwards, rules.PortForward{
+			Protocol:     parts[0],
+			ExternalIP:   extIP,
+			ExternalPort: extPort,
+			WorkloadIP:   wlIP,
+			WorkloadPort: wlPort,
+		})
+	}
+	return forwards
+}
+
+func splitHostPort(addr string) (string, uint16) {
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	return host, uint16(port)
+}
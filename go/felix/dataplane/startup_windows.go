@@ -0,0 +1,51 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package dataplane
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/config"
+	"github.com/projectcalico/felix/go/felix/health"
+	"github.com/projectcalico/felix/go/felix/hostdataplane"
+	"github.com/projectcalico/felix/go/felix/policyrouting"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"github.com/projectcalico/felix/go/felix/windataplane"
+	"os/exec"
+	"time"
+)
+
+// StartDataplaneDriver starts the Windows dataplane driver, which runs
+// in-process so the returned Cmd is always nil.  The driver doesn't use
+// iptables or policy routing, so the renderer, policyRouting and services
+// are ignored.
+func StartDataplaneDriver(
+	configParams *config.Config,
+	renderer rules.RuleRenderer,
+	policyRouting *policyrouting.Manager,
+	services *hostdataplane.Services,
+	healthAggregator *health.HealthAggregator,
+) (DataplaneDriver, *exec.Cmd) {
+	log.Info("Starting Windows HNS dataplane driver.")
+	dpConfig := windataplane.Config{
+		ReportingInterval: time.Duration(configParams.ReportingIntervalSecs) * time.Second,
+		HealthAggregator:  healthAggregator,
+	}
+	winDP := windataplane.NewWinDataplaneDriver(windataplane.NewHNS(), dpConfig)
+	winDP.Start()
+	return winDP, nil
+}
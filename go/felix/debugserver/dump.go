@@ -0,0 +1,142 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const fetchTimeout = 10 * time.Second
+
+// StateDump is a snapshot of the whole of the intended dataplane state, as
+// served at /debug/state.
+type StateDump struct {
+	// Chains maps the name of each IPv4 endpoint chain to its rules, in
+	// iptables-save format, and IPv6Chains does the same for IPv6.
+	Chains     map[string][]string `json:"chains"`
+	IPv6Chains map[string][]string `json:"ipv6_chains,omitempty"`
+	IPSets     map[string][]string `json:"ipsets"`
+	Routes     []Route             `json:"routes"`
+}
+
+// Dump returns a snapshot of the intended dataplane state.
+func (s *DataplaneState) Dump() *StateDump {
+	return &StateDump{
+		Chains:     dumpChains(s.chainsForIPVersion(4)),
+		IPv6Chains: dumpChains(s.chainsForIPVersion(6)),
+		IPSets:     s.IPSets(),
+		Routes:     s.Routes(),
+	}
+}
+
+func dumpChains(chains []*iptables.Chain) map[string][]string {
+	dumped := map[string][]string{}
+	for _, chain := range chains {
+		rules := []string{}
+		for _, rule := range chain.Rules {
+			var buf bytes.Buffer
+			rule.RenderAppendTo(&buf, chain.Name, "")
+			rules = append(rules, buf.String())
+		}
+		dumped[chain.Name] = rules
+	}
+	return dumped
+}
+
+// WriteText writes the dump in a human-readable form.
+func (d *StateDump) WriteText(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString("Chains:\n")
+	for _, name := range sortedKeys(d.Chains) {
+		fmt.Fprintf(&buf, "-N %s\n", name)
+		for _, rule := range d.Chains[name] {
+			buf.WriteString(rule)
+			buf.WriteByte('\n')
+		}
+	}
+	buf.WriteString("\nIP sets:\n")
+	for _, id := range sortedKeys(d.IPSets) {
+		fmt.Fprintf(&buf, "%s: %s\n", id, strings.Join(d.IPSets[id], " "))
+	}
+	buf.WriteString("\nRoutes:\n")
+	for _, route := range d.Routes {
+		fmt.Fprintf(&buf, "%s dev %s\n", route.Dst, route.Interface)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// FetchState queries the debug server at addr for its dump of the intended
+// dataplane state.
+func FetchState(addr string) (*StateDump, error) {
+	dump := &StateDump{}
+	if err := fetchJSON(addr, "/debug/state", dump); err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+// FetchExplanations asks the debug server at addr to explain a name seen in
+// the dataplane.
+func FetchExplanations(addr, name string) ([]*Explanation, error) {
+	var explanations []*Explanation
+	err := fetchJSON(addr, "/debug/explain?name="+url.QueryEscape(name), &explanations)
+	if err != nil {
+		return nil, err
+	}
+	return explanations, nil
+}
+
+// FetchChainGraph asks the debug server at addr for the graph of the chains
+// of the given endpoint, or of all endpoints if ifaceName is empty.
+func FetchChainGraph(addr, ifaceName string) (*iptables.ChainGraph, error) {
+	graph := &iptables.ChainGraph{}
+	err := fetchJSON(addr, "/debug/graph?endpoint="+url.QueryEscape(ifaceName), graph)
+	if err != nil {
+		return nil, err
+	}
+	return graph, nil
+}
+
+func fetchJSON(addr, path string, value interface{}) error {
+	client := &http.Client{Timeout: fetchTimeout}
+	rsp, err := client.Get("http://" + addr + path)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("debug server returned %v", rsp.Status)
+	}
+	return json.NewDecoder(rsp.Body).Decode(value)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"sort"
+	"strings"
+)
+
+const (
+	KindEndpointChain = "endpoint-chain"
+	KindPolicyChain   = "policy-chain"
+	KindProfileChain  = "profile-chain"
+	KindRule          = "rule"
+	KindNflogPrefix   = "nflog-prefix"
+	KindComment       = "comment"
+
+	DirectionInbound  = "inbound"
+	DirectionOutbound = "outbound"
+)
+
+// Explanation maps a name seen in the dataplane, such as a chain name, a
+// rule hash or an NFLOG prefix, back to the object that it came from.
+type Explanation struct {
+	// Kind is what the name turned out to be; one of the Kind* constants.
+	Kind  string `json:"kind"`
+	Chain string `json:"chain,omitempty"`
+	// RuleIndex is the 1-based position of the rule in its chain, as
+	// reported by "iptables -L --line-numbers".
+	RuleIndex int    `json:"rule_index,omitempty"`
+	Rule      string `json:"rule,omitempty"`
+	// Direction is relative to the endpoint: inbound traffic is going to
+	// it.
+	Direction string                    `json:"direction,omitempty"`
+	Endpoint  *proto.WorkloadEndpointID `json:"endpoint,omitempty"`
+	// Policy, Tier and Profile identify the policy, tier or profile that
+	// the chain belongs to, or that the rule jumps to or logs for.
+	Policy  *proto.PolicyID `json:"policy,omitempty"`
+	Tier    string          `json:"tier,omitempty"`
+	Profile string          `json:"profile,omitempty"`
+	// Action is the verdict that an NFLOG prefix reports.
+	Action string `json:"action,omitempty"`
+	Note   string `json:"note,omitempty"`
+}
+
+func (e *Explanation) String() string {
+	var what string
+	switch e.Kind {
+	case KindRule:
+		what = fmt.Sprintf("rule %d of chain %s", e.RuleIndex, e.Chain)
+	case KindNflogPrefix:
+		what = "NFLOG prefix for " + e.Action
+	case KindComment:
+		what = "rule comment"
+	default:
+		what = strings.Replace(e.Kind, "-", " ", -1) + " " + e.Chain
+	}
+	s := strings.Join(append([]string{what}, e.sourceParts()...), ", ")
+	if e.Rule != "" {
+		s += "\n  " + e.Rule
+	}
+	return s
+}
+
+// sourceParts describes where the chain or rule came from.
+func (e *Explanation) sourceParts() []string {
+	var parts []string
+	if e.Direction != "" {
+		parts = append(parts, e.Direction)
+	}
+	if e.Endpoint != nil {
+		parts = append(parts, fmt.Sprintf("workload endpoint %s/%s/%s",
+			e.Endpoint.OrchestratorId, e.Endpoint.WorkloadId, e.Endpoint.EndpointId))
+	}
+	if e.Policy != nil {
+		parts = append(parts, fmt.Sprintf("policy %s/%s", e.Policy.Tier, e.Policy.Name))
+	} else if e.Tier != "" && e.Kind == KindComment {
+		parts = append(parts, "start of tier "+e.Tier)
+	} else if e.Tier != "" {
+		parts = append(parts, "end of tier "+e.Tier)
+	}
+	if e.Profile != "" {
+		parts = append(parts, "profile "+e.Profile)
+	}
+	if e.Note != "" {
+		parts = append(parts, e.Note)
+	}
+	return parts
+}
+
+// Explain looks up a chain name, a rule hash (with or without its "cali:"
+// prefix), an NFLOG prefix or a rule comment, which may have had a long
+// name truncated to fit (see rules.NameComment), in the intended state.  It
+// returns nil if the name isn't recognised.
+func (s *DataplaneState) Explain(name string) []*Explanation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var explanations []*Explanation
+	hash := strings.TrimPrefix(name, iptables.HashCommentPrefix)
+	cache := iptables.NewRenderCache()
+	for id, ep := range s.endpoints {
+		id := id
+		chains := s.renderer.WorkloadEndpointToIptablesChains(
+			ep.Name,
+			ep.Mac,
+			ep.Tiers,
+			ep.ProfileIds,
+			rules.ConntrackBypassDefault,
+			false,
+		)
+		for i, chain := range chains {
+			// The renderer returns the to-endpoint chain first.
+			direction := DirectionInbound
+			if i > 0 {
+				direction = DirectionOutbound
+			}
+			if chain.Name == name {
+				explanations = append(explanations, &Explanation{
+					Kind:      KindEndpointChain,
+					Chain:     chain.Name,
+					Direction: direction,
+					Endpoint:  &id,
+				})
+			}
+			for j, ruleHash := range cache.RuleHashes(chain) {
+				if ruleHash != hash {
+					continue
+				}
+				rule := chain.Rules[j]
+				var buf bytes.Buffer
+				rule.RenderAppendTo(&buf, chain.Name, "")
+				e := &Explanation{
+					Kind:      KindRule,
+					Chain:     chain.Name,
+					RuleIndex: j + 1,
+					Rule:      buf.String(),
+					Direction: direction,
+					Endpoint:  &id,
+				}
+				s.explainRuleTarget(e, rule)
+				explanations = append(explanations, e)
+			}
+		}
+	}
+	if e := s.explainChainName(name); e != nil {
+		explanations = append(explanations, e)
+	}
+	if e := s.explainNflogPrefix(name); e != nil {
+		explanations = append(explanations, e)
+	}
+	if e := s.explainComment(name); e != nil {
+		explanations = append(explanations, e)
+	}
+	sort.Sort(explanationsByChain(explanations))
+	return explanations
+}
+
+type explanationsByChain []*Explanation
+
+func (e explanationsByChain) Len() int { return len(e) }
+func (e explanationsByChain) Less(i, j int) bool {
+	if e[i].Chain != e[j].Chain {
+		return e[i].Chain < e[j].Chain
+	}
+	return e[i].RuleIndex < e[j].RuleIndex
+}
+func (e explanationsByChain) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+// explainRuleTarget fills in the policy or profile that a rule jumps to or
+// logs for.
+func (s *DataplaneState) explainRuleTarget(e *Explanation, rule iptables.Rule) {
+	var target *Explanation
+	switch action := rule.Action.(type) {
+	case iptables.JumpAction:
+		target = s.explainChainName(action.Target)
+	case iptables.NflogAction:
+		target = s.explainNflogPrefix(action.Prefix)
+	}
+	if target != nil {
+		e.Policy = target.Policy
+		e.Tier = target.Tier
+		e.Profile = target.Profile
+	}
+}
+
+func (s *DataplaneState) explainChainName(name string) *Explanation {
+	for id := range s.policies {
+		id := id
+		for prefix, direction := range map[rules.PolicyChainNamePrefix]string{
+			rules.PolicyInboundPfx:  DirectionInbound,
+			rules.PolicyOutboundPfx: DirectionOutbound,
+		} {
+			if rules.PolicyChainName(prefix, &id) == name {
+				return &Explanation{
+					Kind:      KindPolicyChain,
+					Chain:     name,
+					Direction: direction,
+					Policy:    &id,
+				}
+			}
+		}
+	}
+	for profile := range s.profiles {
+		for prefix, direction := range map[rules.ProfileChainNamePrefix]string{
+			rules.ProfileInboundPfx:  DirectionInbound,
+			rules.ProfileOutboundPfx: DirectionOutbound,
+		} {
+			if rules.ProfileChainName(prefix, &proto.ProfileID{Name: profile}) == name {
+				return &Explanation{
+					Kind:      KindProfileChain,
+					Chain:     name,
+					Direction: direction,
+					Profile:   profile,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *DataplaneState) explainNflogPrefix(prefix string) *Explanation {
+	action, _, ok := rules.ParseNflogPrefix(prefix)
+	if !ok {
+		return nil
+	}
+	e := &Explanation{Kind: KindNflogPrefix, Action: "allow"}
+	if action == rules.NflogActionDeny {
+		e.Action = "deny"
+	}
+	// Long rule IDs are hashed, so compare the rendered prefixes rather
+	// than parsing the rule ID.
+	if rules.NflogPrefix(action, rules.NflogNoProfileRule) == prefix {
+		e.Note = "no profile accepted the packet"
+		return e
+	}
+	for id := range s.policies {
+		id := id
+		if rules.NflogPrefix(action, rules.NflogPolicyRule(id.Tier, id.Name)) == prefix {
+			e.Policy = &id
+			return e
+		}
+		if rules.NflogPrefix(action, rules.NflogTierRule(id.Tier)) == prefix {
+			e.Tier = id.Tier
+			return e
+		}
+	}
+	for profile := range s.profiles {
+		if rules.NflogPrefix(action, rules.NflogProfileRule(profile)) == prefix {
+			e.Profile = profile
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *DataplaneState) explainComment(comment string) *Explanation {
+	tiers := map[string]bool{}
+	for id := range s.policies {
+		tiers[id.Tier] = true
+	}
+	for _, ep := range s.endpoints {
+		for _, tier := range ep.Tiers {
+			tiers[tier.Name] = true
+		}
+	}
+	for tier := range tiers {
+		if rules.TierStartComment(tier) == comment {
+			return &Explanation{Kind: KindComment, Tier: tier}
+		}
+	}
+	return nil
+}
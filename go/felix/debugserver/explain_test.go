@@ -0,0 +1,182 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/debugserver"
+
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+var _ = Describe("Explain", func() {
+	var state *DataplaneState
+	wepID := proto.WorkloadEndpointID{
+		OrchestratorId: "k8s",
+		WorkloadId:     "pod1",
+		EndpointId:     "eth0",
+	}
+	polID := proto.PolicyID{Tier: "default", Name: "a"}
+
+	BeforeEach(func() {
+		state = NewDataplaneState(rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+			IptablesMarkAccept:    0x8,
+			IptablesMarkNextTier:  0x10,
+			FlowLogsEnabled:       true,
+		}))
+		state.OnUpdate(&proto.ActivePolicyUpdate{Id: &polID})
+		state.OnUpdate(&proto.ActiveProfileUpdate{Id: &proto.ProfileID{Name: "prof1"}})
+		state.OnUpdate(&proto.WorkloadEndpointUpdate{
+			Id: &wepID,
+			Endpoint: &proto.WorkloadEndpoint{
+				Name:       "cali1234",
+				Tiers:      []*proto.TierInfo{{Name: "default", Policies: []string{"a"}}},
+				ProfileIds: []string{"prof1"},
+			},
+		})
+	})
+
+	It("should explain an endpoint chain", func() {
+		Expect(state.Explain("cali-tw-cali1234")).To(Equal([]*Explanation{{
+			Kind:      KindEndpointChain,
+			Chain:     "cali-tw-cali1234",
+			Direction: DirectionInbound,
+			Endpoint:  &wepID,
+		}}))
+	})
+
+	It("should explain a policy chain", func() {
+		Expect(state.Explain("cali-po-default/a")).To(Equal([]*Explanation{{
+			Kind:      KindPolicyChain,
+			Chain:     "cali-po-default/a",
+			Direction: DirectionOutbound,
+			Policy:    &polID,
+		}}))
+	})
+
+	It("should explain a profile chain", func() {
+		Expect(state.Explain("cali-pri-prof1")).To(Equal([]*Explanation{{
+			Kind:      KindProfileChain,
+			Chain:     "cali-pri-prof1",
+			Direction: DirectionInbound,
+			Profile:   "prof1",
+		}}))
+	})
+
+	It("should explain a rule hash", func() {
+		var chain *iptables.Chain
+		for _, c := range state.Chains() {
+			if c.Name == "cali-fw-cali1234" {
+				chain = c
+			}
+		}
+		hash := iptables.NewRenderCache().RuleHashes(chain)[2]
+		expected := []*Explanation{{
+			Kind:      KindRule,
+			Chain:     "cali-fw-cali1234",
+			RuleIndex: 3,
+			Rule:      "-A cali-fw-cali1234 -m mark --mark 0/0x10 --jump cali-po-default/a",
+			Direction: DirectionOutbound,
+			Endpoint:  &wepID,
+			Policy:    &polID,
+		}}
+		Expect(state.Explain(hash)).To(Equal(expected))
+		Expect(state.Explain(iptables.HashCommentPrefix + hash)).To(Equal(expected))
+	})
+
+	It("should explain NFLOG prefixes", func() {
+		Expect(state.Explain("A|policy/default/a")).To(Equal([]*Explanation{{
+			Kind:   KindNflogPrefix,
+			Action: "allow",
+			Policy: &polID,
+		}}))
+		Expect(state.Explain("D|tier/default")).To(Equal([]*Explanation{{
+			Kind:   KindNflogPrefix,
+			Action: "deny",
+			Tier:   "default",
+		}}))
+		Expect(state.Explain("D|profiles")[0].Note).To(Equal("no profile accepted the packet"))
+	})
+
+	It("should explain a truncated tier comment", func() {
+		tier := strings.Repeat("t", 300)
+		state.OnUpdate(&proto.ActivePolicyUpdate{Id: &proto.PolicyID{Tier: tier, Name: "b"}})
+		comment := rules.TierStartComment(tier)
+		Expect(comment).NotTo(ContainSubstring(tier))
+		Expect(state.Explain(comment)).To(Equal([]*Explanation{{
+			Kind: KindComment,
+			Tier: tier,
+		}}))
+		Expect(state.Explain(comment)[0].String()).To(Equal(
+			"rule comment, start of tier " + tier))
+	})
+
+	It("should not explain an unknown name", func() {
+		Expect(state.Explain("cali-tw-cali5678")).To(BeNil())
+	})
+
+	It("should describe an explanation", func() {
+		Expect(state.Explain("cali-tw-cali1234")[0].String()).To(Equal(
+			"endpoint chain cali-tw-cali1234, inbound, workload endpoint k8s/pod1/eth0"))
+	})
+
+	Describe("over HTTP", func() {
+		var httpServer *httptest.Server
+
+		BeforeEach(func() {
+			httpServer = httptest.NewServer(New(state))
+		})
+		AfterEach(func() {
+			httpServer.Close()
+		})
+
+		It("should fetch explanations", func() {
+			addr := strings.TrimPrefix(httpServer.URL, "http://")
+			explanations, err := FetchExplanations(addr, "A|policy/default/a")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(explanations).To(Equal(state.Explain("A|policy/default/a")))
+			explanations, err = FetchExplanations(addr, "unknown")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(explanations).To(BeEmpty())
+		})
+		It("should reject a request without a name", func() {
+			rsp, err := http.Get(httpServer.URL + "/debug/explain")
+			Expect(err).NotTo(HaveOccurred())
+			rsp.Body.Close()
+			Expect(rsp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+		It("should serve JSON", func() {
+			rsp, err := http.Get(httpServer.URL + "/debug/explain?name=cali-pri-prof1")
+			Expect(err).NotTo(HaveOccurred())
+			defer rsp.Body.Close()
+			var decoded []map[string]interface{}
+			Expect(json.NewDecoder(rsp.Body).Decode(&decoded)).To(Succeed())
+			Expect(decoded).To(Equal([]map[string]interface{}{{
+				"kind":      "profile-chain",
+				"chain":     "cali-pri-prof1",
+				"direction": "inbound",
+				"profile":   "prof1",
+			}}))
+		})
+	})
+})
@@ -0,0 +1,66 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver
+
+import (
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"strings"
+)
+
+// ChainGraph returns the graph of the endpoint chains and the policy and
+// profile chains that they jump to, with each chain labelled with the
+// object that it belongs to.  If ifaceName is non-empty, the graph is
+// limited to the chains that the packets to and from that endpoint may
+// traverse.  The policy and profile chains themselves are programmed by the
+// dataplane driver, so they appear as external nodes.
+func (s *DataplaneState) ChainGraph(ifaceName string) *iptables.ChainGraph {
+	chains := s.Chains()
+
+	s.mutex.Lock()
+	graph := iptables.NewChainGraph(chains, s.chainLabel)
+	s.mutex.Unlock()
+
+	if ifaceName == "" {
+		return graph
+	}
+	return graph.ReachableFrom(
+		rules.EndpointChainName(rules.WorkloadToEndpointPfx, ifaceName),
+		rules.EndpointChainName(rules.WorkloadFromEndpointPfx, ifaceName),
+	)
+}
+
+// chainLabel describes the object that a chain belongs to.  It must be
+// called with the mutex held.
+func (s *DataplaneState) chainLabel(name string) string {
+	e := s.explainChainName(name)
+	if e == nil {
+		for id, ep := range s.endpoints {
+			id := id
+			for prefix, direction := range map[string]string{
+				rules.WorkloadToEndpointPfx:   DirectionInbound,
+				rules.WorkloadFromEndpointPfx: DirectionOutbound,
+			} {
+				if rules.EndpointChainName(prefix, ep.Name) == name {
+					e = &Explanation{Direction: direction, Endpoint: &id}
+				}
+			}
+		}
+	}
+	if e == nil {
+		return ""
+	}
+	return strings.Join(e.sourceParts(), ", ")
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/debugserver"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"net/http/httptest"
+	"strings"
+)
+
+var _ = Describe("Chain graph", func() {
+	var state *DataplaneState
+
+	BeforeEach(func() {
+		state = NewDataplaneState(rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+			IptablesMarkAccept:    0x8,
+			IptablesMarkNextTier:  0x10,
+		}))
+		state.OnUpdate(&proto.ActivePolicyUpdate{Id: &proto.PolicyID{Tier: "default", Name: "a"}})
+		state.OnUpdate(&proto.ActiveProfileUpdate{Id: &proto.ProfileID{Name: "prof1"}})
+		for _, name := range []string{"cali1234", "cali5678"} {
+			state.OnUpdate(&proto.WorkloadEndpointUpdate{
+				Id: &proto.WorkloadEndpointID{
+					OrchestratorId: "k8s",
+					WorkloadId:     name,
+					EndpointId:     "eth0",
+				},
+				Endpoint: &proto.WorkloadEndpoint{
+					Name:       name,
+					Tiers:      []*proto.TierInfo{{Name: "default", Policies: []string{"a"}}},
+					ProfileIds: []string{"prof1"},
+				},
+			})
+		}
+	})
+
+	nodeLabels := func(graph *iptables.ChainGraph) map[string]string {
+		labels := map[string]string{}
+		for _, node := range graph.Nodes {
+			labels[node.Name] = node.Label
+		}
+		return labels
+	}
+
+	It("should graph all the endpoints", func() {
+		Expect(nodeLabels(state.ChainGraph(""))).To(HaveLen(8))
+	})
+
+	It("should graph one endpoint, with labels", func() {
+		graph := state.ChainGraph("cali1234")
+		Expect(nodeLabels(graph)).To(Equal(map[string]string{
+			"cali-fw-cali1234":  "outbound, workload endpoint k8s/cali1234/eth0",
+			"cali-tw-cali1234":  "inbound, workload endpoint k8s/cali1234/eth0",
+			"cali-pi-default/a": "inbound, policy default/a",
+			"cali-po-default/a": "outbound, policy default/a",
+			"cali-pri-prof1":    "inbound, profile prof1",
+			"cali-pro-prof1":    "outbound, profile prof1",
+		}))
+		Expect(graph.Edges).To(HaveLen(4))
+	})
+
+	It("should serve the graph", func() {
+		httpServer := httptest.NewServer(New(state))
+		defer httpServer.Close()
+		addr := strings.TrimPrefix(httpServer.URL, "http://")
+		graph, err := FetchChainGraph(addr, "cali5678")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(graph).To(Equal(state.ChainGraph("cali5678")))
+
+		rsp := httptest.NewRecorder()
+		New(state).ServeHTTP(rsp, httptest.NewRequest("GET", "/debug/graph?format=dot", nil))
+		Expect(rsp.Body.String()).To(HavePrefix("digraph chains {\n"))
+		Expect(rsp.Body.String()).To(ContainSubstring(
+			`"cali-tw-cali5678" -> "cali-pri-prof1" [label="6"];`))
+	})
+})
@@ -0,0 +1,149 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"sort"
+)
+
+// RouteAggregation configures the aggregation of the routes to local
+// workloads by IPAM block.
+//
+// IPAM hands out addresses a block at a time, so most of the addresses of a
+// block that holds local workloads belong to this host.  If enough of them
+// are routed to the same interface, as with a bridge or a VM that hosts many
+// workloads, we route the whole block to that interface instead, plus a
+// more-specific route for each address of the block that goes elsewhere, so
+// the FIB holds one route rather than one per address.  The unused addresses
+// of the block are then routed to that interface too, rather than being
+// unreachable, which is harmless since nothing answers for them.  Addresses
+// of the block that another host borrowed are still reached through that
+// host's more-specific routes.
+type RouteAggregation struct {
+	// Threshold is the number of routes to the same interface, within one
+	// block, at which they are aggregated.  Zero disables aggregation.
+	Threshold int
+	// BlockSizeV4 and BlockSizeV6 are the prefix lengths of the IPAM
+	// blocks of each IP version.  Zero disables aggregation for that IP
+	// version.
+	BlockSizeV4 int
+	BlockSizeV6 int
+}
+
+// SetRouteAggregation enables aggregation of the routes returned by Routes.
+// The routes are recalculated from the endpoints each time, so the
+// aggregation follows the endpoints as they churn.
+func (s *DataplaneState) SetRouteAggregation(agg RouteAggregation) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.routeAggregation = agg
+}
+
+// AggregateRoutes aggregates the single-address routes that fall in an IPAM
+// block; see RouteAggregation.  Only blocks that lie inside one of the given
+// IPAM pools are aggregated.  If several interfaces reach the threshold in a
+// block, the one with the most routes, then the first by name, gets the
+// block route.  The result is sorted by destination.
+func AggregateRoutes(routes []Route, pools []string, agg RouteAggregation) []Route {
+	if agg.Threshold <= 0 {
+		return routes
+	}
+	poolNets := []*net.IPNet{}
+	for _, pool := range pools {
+		_, poolNet, err := net.ParseCIDR(pool)
+		if err != nil {
+			log.WithError(err).WithField("pool", pool).Warn("Ignoring invalid IPAM pool")
+			continue
+		}
+		poolNets = append(poolNets, poolNet)
+	}
+
+	// Group the routes by block, then by interface.
+	byBlock := map[string]map[string][]int{}
+	for i, route := range routes {
+		block := routeBlock(route.Dst, poolNets, agg)
+		if block == "" {
+			continue
+		}
+		if byBlock[block] == nil {
+			byBlock[block] = map[string][]int{}
+		}
+		byBlock[block][route.Interface] = append(byBlock[block][route.Interface], i)
+	}
+
+	aggregated := map[int]bool{}
+	result := []Route{}
+	for block, byIface := range byBlock {
+		bestIface := ""
+		for iface, indexes := range byIface {
+			best := byIface[bestIface]
+			if len(indexes) > len(best) || len(indexes) == len(best) && iface < bestIface {
+				bestIface = iface
+			}
+		}
+		if len(byIface[bestIface]) < agg.Threshold {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"block":     block,
+			"interface": bestIface,
+			"routes":    len(byIface[bestIface]),
+		}).Debug("Aggregating routes into block route")
+		for _, i := range byIface[bestIface] {
+			aggregated[i] = true
+		}
+		result = append(result, Route{Dst: block, Interface: bestIface})
+	}
+	for i, route := range routes {
+		if !aggregated[i] {
+			result = append(result, route)
+		}
+	}
+	sort.Sort(routesByDst(result))
+	return result
+}
+
+// routeBlock returns the IPAM block that the destination of a route falls
+// in, or "" if it isn't a single address in a block of one of the pools.
+func routeBlock(dst string, pools []*net.IPNet, agg RouteAggregation) string {
+	_, dstNet, err := net.ParseCIDR(dst)
+	if err != nil {
+		return ""
+	}
+	ones, bits := dstNet.Mask.Size()
+	if ones != bits {
+		return ""
+	}
+	blockSize := agg.BlockSizeV4
+	if bits == 8*net.IPv6len {
+		blockSize = agg.BlockSizeV6
+	}
+	if blockSize <= 0 || blockSize > bits {
+		return ""
+	}
+	block := &net.IPNet{
+		IP:   dstNet.IP.Mask(net.CIDRMask(blockSize, bits)),
+		Mask: net.CIDRMask(blockSize, bits),
+	}
+	for _, pool := range pools {
+		poolOnes, poolBits := pool.Mask.Size()
+		if poolBits == bits && poolOnes <= blockSize && pool.Contains(block.IP) {
+			return block.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/debugserver"
+
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+)
+
+var _ = Describe("Route aggregation", func() {
+	agg := RouteAggregation{Threshold: 3, BlockSizeV4: 26, BlockSizeV6: 122}
+	pools := []string{"10.0.0.0/16", "fd00::/64"}
+
+	It("should replace the routes to one interface with a block route plus exceptions", func() {
+		routes := []Route{
+			{Dst: "10.0.0.1/32", Interface: "cali1"},
+			{Dst: "10.0.0.2/32", Interface: "cali1"},
+			{Dst: "10.0.0.3/32", Interface: "cali1"},
+			{Dst: "10.0.0.4/32", Interface: "cali2"},
+			{Dst: "10.0.0.65/32", Interface: "cali1"},
+		}
+		Expect(AggregateRoutes(routes, pools, agg)).To(Equal([]Route{
+			{Dst: "10.0.0.0/26", Interface: "cali1"},
+			{Dst: "10.0.0.4/32", Interface: "cali2"},
+			{Dst: "10.0.0.65/32", Interface: "cali1"},
+		}))
+	})
+	It("should aggregate IPv6 blocks", func() {
+		routes := []Route{
+			{Dst: "fd00::1/128", Interface: "cali1"},
+			{Dst: "fd00::2/128", Interface: "cali1"},
+			{Dst: "fd00::3/128", Interface: "cali1"},
+		}
+		Expect(AggregateRoutes(routes, pools, agg)).To(Equal([]Route{
+			{Dst: "fd00::/122", Interface: "cali1"},
+		}))
+	})
+	It("should leave the routes alone below the threshold, outside the pools or if disabled", func() {
+		routes := []Route{
+			{Dst: "10.0.0.1/32", Interface: "cali1"},
+			{Dst: "10.0.0.2/32", Interface: "cali1"},
+			{Dst: "10.1.0.1/32", Interface: "cali2"},
+			{Dst: "10.1.0.2/32", Interface: "cali2"},
+			{Dst: "10.1.0.3/32", Interface: "cali2"},
+		}
+		Expect(AggregateRoutes(routes, []string{"10.0.0.0/16"}, agg)).To(Equal(routes))
+		Expect(AggregateRoutes(routes, pools, RouteAggregation{})).To(Equal(routes))
+	})
+	It("should break ties by interface name", func() {
+		routes := []Route{
+			{Dst: "10.0.0.1/32", Interface: "cali2"},
+			{Dst: "10.0.0.2/32", Interface: "cali2"},
+			{Dst: "10.0.0.3/32", Interface: "cali2"},
+			{Dst: "10.0.0.4/32", Interface: "cali1"},
+			{Dst: "10.0.0.5/32", Interface: "cali1"},
+			{Dst: "10.0.0.6/32", Interface: "cali1"},
+		}
+		Expect(AggregateRoutes(routes, pools, agg)).To(Equal([]Route{
+			{Dst: "10.0.0.0/26", Interface: "cali1"},
+			{Dst: "10.0.0.1/32", Interface: "cali2"},
+			{Dst: "10.0.0.2/32", Interface: "cali2"},
+			{Dst: "10.0.0.3/32", Interface: "cali2"},
+		}))
+	})
+	It("should recalculate the aggregation as the endpoints churn", func() {
+		state := NewDataplaneState(rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+		}))
+		state.SetRouteAggregation(agg)
+		state.OnUpdate(&proto.IPAMPoolUpdate{Id: "10.0.0.0-16", Pool: &proto.IPAMPool{Cidr: "10.0.0.0/16"}})
+		id := func(i int) *proto.WorkloadEndpointID {
+			return &proto.WorkloadEndpointID{OrchestratorId: "k8s", WorkloadId: fmt.Sprint("pod", i), EndpointId: "eth0"}
+		}
+		for i := 1; i <= 3; i++ {
+			state.OnUpdate(&proto.WorkloadEndpointUpdate{
+				Id:       id(i),
+				Endpoint: &proto.WorkloadEndpoint{Name: "br0", Ipv4Nets: []string{fmt.Sprintf("10.0.0.%d/32", i)}},
+			})
+		}
+		Expect(state.Routes()).To(Equal([]Route{{Dst: "10.0.0.0/26", Interface: "br0"}}))
+
+		state.OnUpdate(&proto.WorkloadEndpointRemove{Id: id(3)})
+		Expect(state.Routes()).To(Equal([]Route{
+			{Dst: "10.0.0.1/32", Interface: "br0"},
+			{Dst: "10.0.0.2/32", Interface: "br0"},
+		}))
+	})
+})
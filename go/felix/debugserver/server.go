@@ -0,0 +1,297 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The debugserver package implements Felix's opt-in debug HTTP server, which
+// helps with debugging in the field without having to modify code.  It
+// serves:
+//
+//	/debug/pprof/  the standard Go profiling endpoints.
+//	/debug/chains  the endpoint chains that Felix intends to program, in
+//	               iptables-save format.
+//	/debug/ipsets  the intended IP set members, as JSON.
+//	/debug/routes  the intended routes to local workloads, as JSON.
+//	/debug/state   the chains, IP sets and routes together, as JSON; this
+//	               is what "calico-felix dump-state" prints.
+//	/debug/explain?name=<name>
+//	               maps a chain name, rule hash, NFLOG prefix or truncated
+//	               rule comment back to the endpoint, policy, profile or
+//	               tier that it came from, as JSON.
+//	/debug/graph[?endpoint=<iface>][&format=dot]
+//	               the graph of jumps between the chains, optionally
+//	               limited to one endpoint's chains, as JSON or in
+//	               Graphviz's DOT language.
+//	/debug/queues  the lengths of the queues between Felix's subsystems, as
+//	               JSON.  A queue that stays full points at a subsystem that
+//	               can't keep up.
+//	/debug/convergence
+//	               the latest datastore revision that the dataplane is in
+//	               sync with and when it caught up, as JSON.  Only enabled
+//	               by EnableConvergence.
+//	/debug/capture?endpoint=<iface>|policy=<tier>/<name>|chain=<chain>
+//	               [&direction=in|out][&snaplen=<bytes>][&duration=<d>]
+//	               captures the packets that reach an endpoint's or a
+//	               policy's chain to a pcap file and returns its path, as
+//	               JSON.  It blocks for the duration of the capture, which
+//	               defaults to 10s.  Only enabled by EnableCapture.
+//	/debug/trace[?proto=<p>][&src=<ip>][&dst=<ip>][&sport=<port>]
+//	               [&dport=<port>][&duration=<d>]
+//	               with any tuple parameters, inserts raw-table TRACE
+//	               rules for the matching packets, which are removed
+//	               after the duration (by default, 1m); otherwise lists the
+//	               active traces, as JSON.  ?stop=<id> stops a trace early.
+//	               Only enabled by EnableTrace.
+//
+// The profiling endpoints can expose sensitive data and are expensive to
+// use, so the server should only listen on a loopback address.
+package debugserver
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/capture"
+	"github.com/projectcalico/felix/go/felix/convergence"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCaptureDuration is the duration of a capture that doesn't specify
+// one.
+const defaultCaptureDuration = 10 * time.Second
+
+// Capturer runs packet captures; it's implemented by capture.Capturer.
+type Capturer interface {
+	Capture(req capture.Request) (*capture.Result, error)
+}
+
+// ConvergenceTracker reports the revision that the dataplane is in sync
+// with; it's implemented by convergence.Tracker.
+type ConvergenceTracker interface {
+	Status() convergence.Status
+}
+
+type Server struct {
+	state *DataplaneState
+
+	queuesMutex sync.Mutex
+	queueLens   map[string]func() int
+
+	capturer    Capturer
+	tracer      Tracer
+	convergence ConvergenceTracker
+
+	mux *http.ServeMux
+}
+
+func New(state *DataplaneState) *Server {
+	s := &Server{
+		state:     state,
+		queueLens: map[string]func() int{},
+		mux:       http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	s.mux.HandleFunc("/debug/chains", s.serveChains)
+	s.mux.HandleFunc("/debug/ipsets", s.serveIPSets)
+	s.mux.HandleFunc("/debug/routes", s.serveRoutes)
+	s.mux.HandleFunc("/debug/state", s.serveState)
+	s.mux.HandleFunc("/debug/explain", s.serveExplain)
+	s.mux.HandleFunc("/debug/graph", s.serveGraph)
+	s.mux.HandleFunc("/debug/queues", s.serveQueues)
+	s.mux.HandleFunc("/debug/convergence", s.serveConvergence)
+	s.mux.HandleFunc("/debug/capture", s.serveCapture)
+	s.mux.HandleFunc("/debug/trace", s.serveTrace)
+	return s
+}
+
+// EnableCapture enables the /debug/capture endpoint, which runs its
+// captures with the given Capturer.  It must be called before the server
+// starts serving.
+func (s *Server) EnableCapture(capturer Capturer) {
+	s.capturer = capturer
+}
+
+// EnableConvergence enables the /debug/convergence endpoint, which reports
+// the tracker's status.  It must be called before the server starts
+// serving.
+func (s *Server) EnableConvergence(tracker ConvergenceTracker) {
+	s.convergence = tracker
+}
+
+// RegisterQueue adds a queue to the /debug/queues output.  lenFn is called
+// to get the length of the queue; typically, it returns len() of a channel.
+func (s *Server) RegisterQueue(name string, lenFn func() int) {
+	s.queuesMutex.Lock()
+	defer s.queuesMutex.Unlock()
+	s.queueLens[name] = lenFn
+}
+
+func (s *Server) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(rsp, req)
+}
+
+// ListenAndServe serves the debug endpoints on the given address.  Like
+// http.ListenAndServe, it only returns on failure.
+func (s *Server) ListenAndServe(addr string) error {
+	log.WithField("addr", addr).Info("Starting debug server")
+	return http.ListenAndServe(addr, s)
+}
+
+func (s *Server) serveChains(rsp http.ResponseWriter, req *http.Request) {
+	rsp.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(rsp, renderChains(s.state.Chains()))
+}
+
+func (s *Server) serveIPSets(rsp http.ResponseWriter, req *http.Request) {
+	writeJSON(rsp, s.state.IPSets())
+}
+
+func (s *Server) serveRoutes(rsp http.ResponseWriter, req *http.Request) {
+	writeJSON(rsp, s.state.Routes())
+}
+
+func (s *Server) serveState(rsp http.ResponseWriter, req *http.Request) {
+	writeJSON(rsp, s.state.Dump())
+}
+
+func (s *Server) serveExplain(rsp http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(rsp, "missing name parameter", http.StatusBadRequest)
+		return
+	}
+	explanations := s.state.Explain(name)
+	if explanations == nil {
+		explanations = []*Explanation{}
+	}
+	writeJSON(rsp, explanations)
+}
+
+func (s *Server) serveGraph(rsp http.ResponseWriter, req *http.Request) {
+	graph := s.state.ChainGraph(req.URL.Query().Get("endpoint"))
+	if req.URL.Query().Get("format") == "dot" {
+		rsp.Header().Set("Content-Type", "text/vnd.graphviz")
+		graph.WriteDot(rsp)
+		return
+	}
+	writeJSON(rsp, graph)
+}
+
+func (s *Server) serveQueues(rsp http.ResponseWriter, req *http.Request) {
+	s.queuesMutex.Lock()
+	lens := map[string]int{}
+	for name, lenFn := range s.queueLens {
+		lens[name] = lenFn()
+	}
+	s.queuesMutex.Unlock()
+	writeJSON(rsp, lens)
+}
+
+func (s *Server) serveConvergence(rsp http.ResponseWriter, req *http.Request) {
+	if s.convergence == nil {
+		http.Error(rsp, "convergence tracking is not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(rsp, s.convergence.Status())
+}
+
+func (s *Server) serveCapture(rsp http.ResponseWriter, req *http.Request) {
+	if s.capturer == nil {
+		http.Error(rsp, "packet capture is not enabled", http.StatusNotFound)
+		return
+	}
+	captureReq, err := parseCaptureRequest(req)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := s.capturer.Capture(captureReq)
+	if err == capture.ErrCaptureInProgress {
+		http.Error(rsp, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(rsp, result)
+}
+
+// parseCaptureRequest maps the parameters of a /debug/capture request to the
+// chain to capture and the capture's limits.
+func parseCaptureRequest(req *http.Request) (capture.Request, error) {
+	query := req.URL.Query()
+	captureReq := capture.Request{Duration: defaultCaptureDuration}
+	inbound := true
+	switch query.Get("direction") {
+	case "", "in":
+	case "out":
+		inbound = false
+	default:
+		return captureReq, fmt.Errorf("direction must be in or out")
+	}
+	if iface := query.Get("endpoint"); iface != "" {
+		captureReq.Chain = rules.CaptureChainName(iface, inbound)
+	} else if policy := query.Get("policy"); policy != "" {
+		parts := strings.SplitN(policy, "/", 2)
+		if len(parts) != 2 {
+			return captureReq, fmt.Errorf("policy must be of the form <tier>/<name>")
+		}
+		prefix := rules.PolicyInboundPfx
+		if !inbound {
+			prefix = rules.PolicyOutboundPfx
+		}
+		captureReq.Chain = rules.PolicyChainName(prefix,
+			&proto.PolicyID{Tier: parts[0], Name: parts[1]})
+	} else if chain := query.Get("chain"); chain != "" {
+		captureReq.Chain = chain
+	} else {
+		return captureReq, fmt.Errorf("missing endpoint, policy or chain parameter")
+	}
+	if snaplen := query.Get("snaplen"); snaplen != "" {
+		value, err := strconv.ParseUint(snaplen, 10, 32)
+		if err != nil {
+			return captureReq, fmt.Errorf("invalid snaplen: %v", err)
+		}
+		captureReq.Snaplen = uint32(value)
+	}
+	if duration := query.Get("duration"); duration != "" {
+		value, err := time.ParseDuration(duration)
+		if err != nil {
+			return captureReq, fmt.Errorf("invalid duration: %v", err)
+		}
+		captureReq.Duration = value
+	}
+	return captureReq, nil
+}
+
+func writeJSON(rsp http.ResponseWriter, value interface{}) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.WithError(err).Error("Failed to marshal debug output")
+		http.Error(rsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rsp.Header().Set("Content-Type", "application/json")
+	rsp.Write(data)
+	rsp.Write([]byte("\n"))
+}
@@ -0,0 +1,341 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/debugserver"
+
+	"bytes"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/capture"
+	"github.com/projectcalico/felix/go/felix/convergence"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Debug server", func() {
+	var state *DataplaneState
+	var server *Server
+
+	BeforeEach(func() {
+		state = NewDataplaneState(rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+			IptablesMarkAccept:    0x8,
+			IptablesMarkNextTier:  0x10,
+		}))
+		server = New(state)
+
+		state.OnUpdate(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.2", "10.0.0.1"}})
+		state.OnUpdate(&proto.IPSetUpdate{Id: "s2", Members: []string{"10.0.0.3"}})
+		state.OnUpdate(&proto.IPSetDeltaUpdate{
+			Id:             "s1",
+			AddedMembers:   []string{"10.0.0.4"},
+			RemovedMembers: []string{"10.0.0.2"},
+		})
+		state.OnUpdate(&proto.IPSetRemove{Id: "s2"})
+		state.OnUpdate(&proto.WorkloadEndpointUpdate{
+			Id: &proto.WorkloadEndpointID{
+				OrchestratorId: "k8s",
+				WorkloadId:     "pod1",
+				EndpointId:     "eth0",
+			},
+			Endpoint: &proto.WorkloadEndpoint{
+				Name:       "cali1234",
+				ProfileIds: []string{"prof1"},
+				Ipv4Nets:   []string{"10.0.0.1/32"},
+				Ipv6Nets:   []string{"fd00::1/128"},
+			},
+		})
+		state.OnUpdate(&proto.WorkloadEndpointUpdate{
+			Id: &proto.WorkloadEndpointID{
+				OrchestratorId: "k8s",
+				WorkloadId:     "pod2",
+				EndpointId:     "eth0",
+			},
+			Endpoint: &proto.WorkloadEndpoint{
+				Name:     "cali5678",
+				Ipv4Nets: []string{"10.0.0.4/32"},
+			},
+		})
+		state.OnUpdate(&proto.WorkloadEndpointRemove{
+			Id: &proto.WorkloadEndpointID{
+				OrchestratorId: "k8s",
+				WorkloadId:     "pod2",
+				EndpointId:     "eth0",
+			},
+		})
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rsp := httptest.NewRecorder()
+		server.ServeHTTP(rsp, httptest.NewRequest("GET", path, nil))
+		return rsp
+	}
+
+	It("should track IP sets", func() {
+		Expect(state.IPSets()).To(Equal(map[string][]string{
+			"s1": {"10.0.0.1", "10.0.0.4"},
+		}))
+		rsp := get("/debug/ipsets")
+		Expect(rsp.Code).To(Equal(http.StatusOK))
+		var ipSets map[string][]string
+		Expect(json.Unmarshal(rsp.Body.Bytes(), &ipSets)).To(Succeed())
+		Expect(ipSets).To(Equal(state.IPSets()))
+	})
+
+	It("should track routes", func() {
+		Expect(state.Routes()).To(Equal([]Route{
+			{Dst: "10.0.0.1/32", Interface: "cali1234"},
+			{Dst: "fd00::1/128", Interface: "cali1234"},
+		}))
+		rsp := get("/debug/routes")
+		Expect(rsp.Code).To(Equal(http.StatusOK))
+		var routes []Route
+		Expect(json.Unmarshal(rsp.Body.Bytes(), &routes)).To(Succeed())
+		Expect(routes).To(Equal(state.Routes()))
+	})
+
+	It("should fan the dual-stack state out to each IP version", func() {
+		state.OnUpdate(&proto.IPSetUpdate{Id: "s3", Members: []string{"10.0.0.5", "fd00::5,tcp:80"}})
+		stacks := state.Stacks(4, 6)
+		Expect(stacks).To(HaveLen(2))
+		Expect(stacks[0].IPVersion).To(Equal(uint8(4)))
+		Expect(stacks[0].IPSets).To(Equal(map[string][]string{
+			"s1": {"10.0.0.1", "10.0.0.4"},
+			"s3": {"10.0.0.5"},
+		}))
+		Expect(stacks[0].Routes).To(Equal([]Route{{Dst: "10.0.0.1/32", Interface: "cali1234"}}))
+		Expect(stacks[1].IPVersion).To(Equal(uint8(6)))
+		Expect(stacks[1].IPSets).To(Equal(map[string][]string{
+			"s1": {},
+			"s3": {"fd00::5,tcp:80"},
+		}))
+		Expect(stacks[1].Routes).To(Equal([]Route{{Dst: "fd00::1/128", Interface: "cali1234"}}))
+		Expect(stacks[0].Chains).To(Equal(state.Chains()))
+		Expect(stacks[1].Chains).To(Equal(state.Chains()))
+
+		dump := state.Dump().ForIPVersion(6)
+		Expect(dump.IPSets).To(Equal(stacks[1].IPSets))
+		Expect(dump.Routes).To(Equal(stacks[1].Routes))
+	})
+
+	It("should render each IP version's source chains if anti-spoofing is enabled", func() {
+		state = NewDataplaneState(rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+			AntiSpoofingEnabled:   true,
+		}))
+		state.OnUpdate(&proto.WorkloadEndpointUpdate{
+			Id: &proto.WorkloadEndpointID{
+				OrchestratorId: "k8s",
+				WorkloadId:     "pod1",
+				EndpointId:     "eth0",
+			},
+			Endpoint: &proto.WorkloadEndpoint{
+				Name:     "cali1234",
+				Ipv4Nets: []string{"10.0.0.1/32"},
+				Ipv6Nets: []string{"fd00::1/128"},
+			},
+		})
+		dump := state.Dump()
+		Expect(dump.Chains["cali-fs-cali1234"]).To(ContainElement(
+			"-A cali-fs-cali1234 --source 10.0.0.1/32 --jump RETURN"))
+		Expect(dump.ForIPVersion(6).Chains["cali-fs-cali1234"]).To(ContainElement(
+			"-A cali-fs-cali1234 --source fd00::1/128 --jump RETURN"))
+		Expect(state.Stacks(6)[0].Chains).To(HaveLen(3))
+	})
+
+	It("should route and allow each endpoint's allowed source prefixes", func() {
+		state = NewDataplaneState(rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+			AntiSpoofingEnabled:   true,
+		}))
+		for _, ep := range []*proto.WorkloadEndpoint{
+			{Name: "cali2", Ipv4Nets: []string{"10.0.0.2/32"}, AllowedSourcePrefixes: []string{"10.0.0.100/32"}},
+			{Name: "cali1", Ipv4Nets: []string{"10.0.0.1/32"}, AllowedSourcePrefixes: []string{"10.0.0.100/32", "10.0.0.2/32"}},
+		} {
+			state.OnUpdate(&proto.WorkloadEndpointUpdate{
+				Id:       &proto.WorkloadEndpointID{OrchestratorId: "k8s", WorkloadId: ep.Name, EndpointId: "eth0"},
+				Endpoint: ep,
+			})
+		}
+		// The shared address goes to the first interface by name, and
+		// cali2's own address stays with cali2.
+		Expect(state.Routes()).To(Equal([]Route{
+			{Dst: "10.0.0.1/32", Interface: "cali1"},
+			{Dst: "10.0.0.100/32", Interface: "cali1"},
+			{Dst: "10.0.0.2/32", Interface: "cali2"},
+		}))
+		dump := state.Dump()
+		Expect(dump.Chains["cali-fs-cali2"]).To(ContainElement(
+			"-A cali-fs-cali2 --source 10.0.0.100/32 --jump RETURN"))
+		Expect(dump.Chains["cali-fs-cali1"]).To(ContainElement(
+			"-A cali-fs-cali1 --source 10.0.0.2/32 --jump RETURN"))
+	})
+
+	It("should render the endpoint chains", func() {
+		chains := state.Chains()
+		Expect(chains).To(HaveLen(2))
+		Expect(chains[0].Name).To(Equal("cali-fw-cali1234"))
+		Expect(chains[1].Name).To(Equal("cali-tw-cali1234"))
+		rsp := get("/debug/chains")
+		Expect(rsp.Code).To(Equal(http.StatusOK))
+		Expect(rsp.Body.String()).To(ContainSubstring("-N cali-fw-cali1234\n"))
+		Expect(rsp.Body.String()).To(ContainSubstring("-A cali-tw-cali1234 --jump cali-pri-prof1\n"))
+	})
+
+	It("should dump the whole state", func() {
+		rsp := get("/debug/state")
+		Expect(rsp.Code).To(Equal(http.StatusOK))
+		var dump StateDump
+		Expect(json.Unmarshal(rsp.Body.Bytes(), &dump)).To(Succeed())
+		Expect(dump.IPSets).To(Equal(state.IPSets()))
+		Expect(dump.Routes).To(Equal(state.Routes()))
+		Expect(dump.Chains).To(HaveLen(2))
+		Expect(dump.Chains["cali-tw-cali1234"]).To(ContainElement(
+			"-A cali-tw-cali1234 --jump cali-pri-prof1"))
+	})
+
+	It("should fetch and print the state", func() {
+		httpServer := httptest.NewServer(server)
+		defer httpServer.Close()
+		dump, err := FetchState(strings.TrimPrefix(httpServer.URL, "http://"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dump).To(Equal(state.Dump()))
+
+		var buf bytes.Buffer
+		Expect(dump.WriteText(&buf)).To(Succeed())
+		Expect(buf.String()).To(ContainSubstring("Chains:\n-N cali-fw-cali1234\n"))
+		Expect(buf.String()).To(ContainSubstring("\nIP sets:\ns1: 10.0.0.1 10.0.0.4\n"))
+		Expect(buf.String()).To(HaveSuffix(
+			"\nRoutes:\n10.0.0.1/32 dev cali1234\nfd00::1/128 dev cali1234\n"))
+	})
+
+	It("should fail to fetch the state from a missing server", func() {
+		httpServer := httptest.NewServer(http.NotFoundHandler())
+		defer httpServer.Close()
+		_, err := FetchState(strings.TrimPrefix(httpServer.URL, "http://"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should report queue lengths", func() {
+		c := make(chan int, 10)
+		c <- 1
+		c <- 2
+		server.RegisterQueue("test", func() int { return len(c) })
+		rsp := get("/debug/queues")
+		Expect(rsp.Code).To(Equal(http.StatusOK))
+		var lens map[string]int
+		Expect(json.Unmarshal(rsp.Body.Bytes(), &lens)).To(Succeed())
+		Expect(lens).To(Equal(map[string]int{"test": 2}))
+	})
+
+	It("should report convergence", func() {
+		tracker := convergence.NewTracker()
+		processed := time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+		tracker.OnMarker(&convergence.RevisionMarker{
+			Revision:    "1234",
+			ProcessedAt: processed,
+		}, processed.Add(time.Second))
+		server.EnableConvergence(tracker)
+		rsp := get("/debug/convergence")
+		Expect(rsp.Code).To(Equal(http.StatusOK))
+		var status convergence.Status
+		Expect(json.Unmarshal(rsp.Body.Bytes(), &status)).To(Succeed())
+		Expect(status).To(Equal(convergence.Status{
+			Revision:    "1234",
+			Time:        processed.Add(time.Second),
+			ProcessedAt: processed,
+		}))
+	})
+
+	It("should not report convergence unless enabled", func() {
+		rsp := get("/debug/convergence")
+		Expect(rsp.Code).To(Equal(http.StatusNotFound))
+	})
+
+	Describe("with capture enabled", func() {
+		var capturer *fakeCapturer
+		BeforeEach(func() {
+			capturer = &fakeCapturer{}
+			server.EnableCapture(capturer)
+		})
+
+		It("should capture an endpoint's inbound traffic", func() {
+			rsp := get("/debug/capture?endpoint=cali1234&snaplen=128&duration=5s")
+			Expect(rsp.Code).To(Equal(http.StatusOK))
+			Expect(capturer.req).To(Equal(capture.Request{
+				Chain:    "cali-tw-cali1234",
+				Snaplen:  128,
+				Duration: 5 * time.Second,
+			}))
+			var result capture.Result
+			Expect(json.Unmarshal(rsp.Body.Bytes(), &result)).To(Succeed())
+			Expect(result).To(Equal(capture.Result{File: "/tmp/x.pcap", Packets: 3}))
+		})
+		It("should capture a policy's outbound traffic", func() {
+			rsp := get("/debug/capture?policy=default/allow-web&direction=out")
+			Expect(rsp.Code).To(Equal(http.StatusOK))
+			Expect(capturer.req.Chain).To(Equal("cali-po-default/allow-web"))
+			Expect(capturer.req.Duration).To(Equal(10 * time.Second))
+		})
+		It("should capture a named chain", func() {
+			rsp := get("/debug/capture?chain=cali-pri-prof1")
+			Expect(rsp.Code).To(Equal(http.StatusOK))
+			Expect(capturer.req.Chain).To(Equal("cali-pri-prof1"))
+		})
+		It("should reject a request without a target", func() {
+			rsp := get("/debug/capture?duration=5s")
+			Expect(rsp.Code).To(Equal(http.StatusBadRequest))
+		})
+		It("should reject a bad direction", func() {
+			rsp := get("/debug/capture?endpoint=cali1234&direction=sideways")
+			Expect(rsp.Code).To(Equal(http.StatusBadRequest))
+		})
+		It("should report a capture in progress", func() {
+			capturer.err = capture.ErrCaptureInProgress
+			rsp := get("/debug/capture?endpoint=cali1234")
+			Expect(rsp.Code).To(Equal(http.StatusConflict))
+		})
+	})
+
+	It("should not capture unless enabled", func() {
+		rsp := get("/debug/capture?endpoint=cali1234")
+		Expect(rsp.Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should serve pprof", func() {
+		rsp := get("/debug/pprof/")
+		Expect(rsp.Code).To(Equal(http.StatusOK))
+	})
+})
+
+type fakeCapturer struct {
+	req capture.Request
+	err error
+}
+
+func (c *fakeCapturer) Capture(req capture.Request) (*capture.Result, error) {
+	c.req = req
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &capture.Result{File: "/tmp/x.pcap", Packets: 3}, nil
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The state socket speaks a line-based protocol: the client sends one of
+// the following requests, terminated by a newline, and the server replies
+// with newline-delimited JSON.
+//
+//	state  the calculation graph's output as an IntendedState, after which
+//	       the server closes the connection.
+//	watch  the IntendedState, followed by a StateUpdate for each update
+//	       that the calculation graph sends afterwards, until the client
+//	       closes the connection.  A client that falls behind is
+//	       disconnected.
+//
+// An invalid request gets a StateError.  For example,
+//
+//	echo state | socat - UNIX-CONNECT:/var/run/calico/felix-state.sock
+const (
+	RequestState = "state"
+	RequestWatch = "watch"
+)
+
+const (
+	// watchQueueLen is the number of updates that may be queued for a
+	// watcher before it's considered to have fallen behind.
+	watchQueueLen = 1000
+	// requestTimeout limits how long we wait for the client's request.
+	requestTimeout = 10 * time.Second
+)
+
+// IntendedState is a snapshot of the calculation graph's output, as served
+// over the state socket.
+type IntendedState struct {
+	Endpoints []*EndpointState           `json:"endpoints"`
+	Policies  []*PolicyState             `json:"policies"`
+	Profiles  map[string]*proto.Profile  `json:"profiles"`
+	IPSets    map[string][]string        `json:"ipsets"`
+	IPAMPools map[string]*proto.IPAMPool `json:"ipam_pools"`
+}
+
+type EndpointState struct {
+	Id       proto.WorkloadEndpointID `json:"id"`
+	Endpoint *proto.WorkloadEndpoint  `json:"endpoint"`
+}
+
+type PolicyState struct {
+	Id     proto.PolicyID `json:"id"`
+	Policy *proto.Policy  `json:"policy"`
+}
+
+// StateUpdate is an update from the calculation graph, as streamed to a
+// watcher.  Type is the name of the update's message type, for example
+// "IPSetDeltaUpdate".
+type StateUpdate struct {
+	Type   string      `json:"type"`
+	Update interface{} `json:"update"`
+}
+
+type StateError struct {
+	Error string `json:"error"`
+}
+
+// IntendedState returns a snapshot of the calculation graph's output.
+func (s *DataplaneState) IntendedState() *IntendedState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.intendedStateLocked()
+}
+
+func (s *DataplaneState) intendedStateLocked() *IntendedState {
+	state := &IntendedState{
+		Endpoints: []*EndpointState{},
+		Policies:  []*PolicyState{},
+		Profiles:  map[string]*proto.Profile{},
+		IPSets:    s.ipSetsLocked(),
+		IPAMPools: map[string]*proto.IPAMPool{},
+	}
+	for id, ep := range s.endpoints {
+		state.Endpoints = append(state.Endpoints, &EndpointState{Id: id, Endpoint: ep})
+	}
+	sort.Sort(endpointsByName(state.Endpoints))
+	for id, policy := range s.policies {
+		state.Policies = append(state.Policies, &PolicyState{Id: id, Policy: policy})
+	}
+	sort.Sort(policiesByID(state.Policies))
+	for name, profile := range s.profiles {
+		state.Profiles[name] = profile
+	}
+	for id, pool := range s.ipamPools {
+		state.IPAMPools[id] = pool
+	}
+	return state
+}
+
+type endpointsByName []*EndpointState
+
+func (e endpointsByName) Len() int           { return len(e) }
+func (e endpointsByName) Less(i, j int) bool { return e[i].Endpoint.Name < e[j].Endpoint.Name }
+func (e endpointsByName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+type policiesByID []*PolicyState
+
+func (p policiesByID) Len() int { return len(p) }
+func (p policiesByID) Less(i, j int) bool {
+	if p[i].Id.Tier != p[j].Id.Tier {
+		return p[i].Id.Tier < p[j].Id.Tier
+	}
+	return p[i].Id.Name < p[j].Id.Name
+}
+func (p policiesByID) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// Watch returns a snapshot of the calculation graph's output and a channel
+// that receives each update that changes it from then on.  The channel is
+// closed if the watcher falls behind.  The caller must call cancel once it
+// has finished watching.
+func (s *DataplaneState) Watch() (state *IntendedState, updates <-chan interface{}, cancel func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := make(chan interface{}, watchQueueLen)
+	s.watchers[c] = true
+	cancel = func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.watchers[c] {
+			delete(s.watchers, c)
+			close(c)
+		}
+	}
+	return s.intendedStateLocked(), c, cancel
+}
+
+// SocketServer serves the intended state over a unix socket, so that
+// support tooling can capture it without enabling the debug HTTP server.
+type SocketServer struct {
+	state *DataplaneState
+}
+
+func NewSocketServer(state *DataplaneState) *SocketServer {
+	return &SocketServer{state: state}
+}
+
+// ListenAndServe serves the state socket at the given path, replacing any
+// stale socket.  The socket is only accessible to root.  Like
+// http.ListenAndServe, it only returns on failure.
+func (s *SocketServer) ListenAndServe(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	log.WithField("path", path).Info("Serving intended state on unix socket")
+	return s.Serve(listener)
+}
+
+// Serve handles the connections on the given listener.
+func (s *SocketServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *SocketServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	request, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		log.WithError(err).Debug("Failed to read state socket request")
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	encoder := json.NewEncoder(conn)
+	switch strings.TrimSpace(request) {
+	case RequestState:
+		encoder.Encode(s.state.IntendedState())
+	case RequestWatch:
+		s.watch(conn, encoder)
+	default:
+		encoder.Encode(&StateError{
+			Error: fmt.Sprintf("unknown request %q, expected %q or %q",
+				strings.TrimSpace(request), RequestState, RequestWatch),
+		})
+	}
+}
+
+// watch streams the state and then its updates to the client, until the
+// client goes away or falls behind.
+func (s *SocketServer) watch(conn net.Conn, encoder *json.Encoder) {
+	state, updates, cancel := s.state.Watch()
+	defer cancel()
+	if err := encoder.Encode(state); err != nil {
+		return
+	}
+	// The client doesn't send anything else; a read only returns when it
+	// closes the connection.
+	closedC := make(chan bool)
+	go func() {
+		conn.Read(make([]byte, 1))
+		close(closedC)
+	}()
+	for {
+		select {
+		case msg, ok := <-updates:
+			if !ok {
+				encoder.Encode(&StateError{Error: "fell behind, watch again"})
+				return
+			}
+			err := encoder.Encode(&StateUpdate{
+				Type:   reflect.TypeOf(msg).Elem().Name(),
+				Update: msg,
+			})
+			if err != nil {
+				log.WithError(err).Debug("State watcher went away")
+				return
+			}
+		case <-closedC:
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/debugserver"
+
+	"bufio"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("State socket", func() {
+	var state *DataplaneState
+	var dir, path string
+
+	BeforeEach(func() {
+		state = NewDataplaneState(rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+		}))
+		state.OnUpdate(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.2", "10.0.0.1"}})
+		state.OnUpdate(&proto.ActivePolicyUpdate{
+			Id:     &proto.PolicyID{Tier: "default", Name: "allow-web"},
+			Policy: &proto.Policy{InboundRules: []*proto.Rule{{Action: "allow"}}},
+		})
+		state.OnUpdate(&proto.WorkloadEndpointUpdate{
+			Id: &proto.WorkloadEndpointID{
+				OrchestratorId: "k8s",
+				WorkloadId:     "pod1",
+				EndpointId:     "eth0",
+			},
+			Endpoint: &proto.WorkloadEndpoint{Name: "cali1234"},
+		})
+
+		var err error
+		dir, err = ioutil.TempDir("", "felix-state")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "state.sock")
+		go NewSocketServer(state).ListenAndServe(path)
+		Eventually(func() error {
+			_, err := os.Stat(path)
+			return err
+		}).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	request := func(req string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("unix", path)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = conn.Write([]byte(req + "\n"))
+		Expect(err).NotTo(HaveOccurred())
+		return conn, bufio.NewReader(conn)
+	}
+
+	It("should serve the intended state", func() {
+		conn, reader := request("state")
+		defer conn.Close()
+		line, err := reader.ReadBytes('\n')
+		Expect(err).NotTo(HaveOccurred())
+		var intended IntendedState
+		Expect(json.Unmarshal(line, &intended)).To(Succeed())
+		Expect(intended.IPSets).To(Equal(map[string][]string{"s1": {"10.0.0.1", "10.0.0.2"}}))
+		Expect(intended.Endpoints).To(HaveLen(1))
+		Expect(intended.Endpoints[0].Id.WorkloadId).To(Equal("pod1"))
+		Expect(intended.Endpoints[0].Endpoint.Name).To(Equal("cali1234"))
+		Expect(intended.Policies).To(HaveLen(1))
+		Expect(intended.Policies[0].Id).To(Equal(proto.PolicyID{Tier: "default", Name: "allow-web"}))
+		Expect(intended.Policies[0].Policy.InboundRules[0].Action).To(Equal("allow"))
+	})
+
+	It("should stream updates to a watcher", func() {
+		conn, reader := request("watch")
+		defer conn.Close()
+		_, err := reader.ReadBytes('\n')
+		Expect(err).NotTo(HaveOccurred())
+
+		state.OnUpdate(&proto.IPSetRemove{Id: "s1"})
+		line, err := reader.ReadBytes('\n')
+		Expect(err).NotTo(HaveOccurred())
+		var update struct {
+			Type   string
+			Update proto.IPSetRemove
+		}
+		Expect(json.Unmarshal(line, &update)).To(Succeed())
+		Expect(update.Type).To(Equal("IPSetRemove"))
+		Expect(update.Update.Id).To(Equal("s1"))
+		Expect(state.IntendedState().IPSets).To(BeEmpty())
+	})
+
+	It("should reject an unknown request", func() {
+		conn, reader := request("frobnicate")
+		defer conn.Close()
+		line, err := reader.ReadBytes('\n')
+		Expect(err).NotTo(HaveOccurred())
+		var stateErr StateError
+		Expect(json.Unmarshal(line, &stateErr)).To(Succeed())
+		Expect(stateErr.Error).To(ContainSubstring("frobnicate"))
+	})
+})
+
+var _ = Describe("State watch", func() {
+	It("should drop a watcher that falls behind", func() {
+		state := NewDataplaneState(rules.NewRenderer(rules.Config{}))
+		_, updates, cancel := state.Watch()
+		defer cancel()
+		for i := 0; i < 1001; i++ {
+			state.OnUpdate(&proto.IPSetRemove{Id: "s1"})
+		}
+		for range updates {
+		}
+		Expect(updates).To(BeClosed())
+	})
+})
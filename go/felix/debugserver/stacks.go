@@ -0,0 +1,111 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver
+
+import (
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"net"
+	"strings"
+)
+
+// Stack is the intended state of the dataplane of one IP version.
+//
+// The model is dual-stack: an endpoint carries both its IPv4 and IPv6
+// addresses and an IP set holds members of both versions.  Stacks fans the
+// model out to each IP version so that the users of the state don't each
+// have to split it, and can't disagree about how to.
+type Stack struct {
+	IPVersion uint8
+	// Chains are the endpoint chains.  An endpoint's chains exist in both
+	// stacks, even if it only has addresses of one version, so that its
+	// traffic is always policed; only its source chain, which lists its
+	// addresses of this version, differs between the stacks.
+	Chains []*iptables.Chain
+	// IPSets holds every IP set, with only the members of this IP version.
+	IPSets map[string][]string
+	// Routes holds the routes to addresses of this IP version.
+	Routes []Route
+}
+
+// Stacks returns the intended state of each of the given IP versions.
+func (s *DataplaneState) Stacks(ipVersions ...uint8) []*Stack {
+	ipSets := s.IPSets()
+	routes := s.Routes()
+	stacks := make([]*Stack, len(ipVersions))
+	for i, ipVersion := range ipVersions {
+		stacks[i] = &Stack{
+			IPVersion: ipVersion,
+			Chains:    s.chainsForIPVersion(ipVersion),
+			IPSets:    ipSetsOfVersion(ipSets, ipVersion),
+			Routes:    routesOfVersion(routes, ipVersion),
+		}
+	}
+	return stacks
+}
+
+// ForIPVersion returns the part of the dump that applies to the given IP
+// version; see Stack.
+func (d *StateDump) ForIPVersion(ipVersion uint8) *StateDump {
+	chains := d.Chains
+	if ipVersion == 6 && d.IPv6Chains != nil {
+		chains = d.IPv6Chains
+	}
+	return &StateDump{
+		Chains: chains,
+		IPSets: ipSetsOfVersion(d.IPSets, ipVersion),
+		Routes: routesOfVersion(d.Routes, ipVersion),
+	}
+}
+
+// IPVersionOf returns the IP version of an address, a CIDR or an IP set
+// member, which may be followed by ",<protocol>:<port>", or 0 if it can't
+// be parsed.
+func IPVersionOf(addr string) uint8 {
+	addr = strings.SplitN(addr, ",", 2)[0]
+	addr = strings.SplitN(addr, "/", 2)[0]
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return 0
+	case ip.To4() != nil:
+		return 4
+	default:
+		return 6
+	}
+}
+
+func ipSetsOfVersion(ipSets map[string][]string, ipVersion uint8) map[string][]string {
+	result := map[string][]string{}
+	for id, members := range ipSets {
+		filtered := []string{}
+		for _, member := range members {
+			if IPVersionOf(member) == ipVersion {
+				filtered = append(filtered, member)
+			}
+		}
+		result[id] = filtered
+	}
+	return result
+}
+
+func routesOfVersion(routes []Route, ipVersion uint8) []Route {
+	result := []Route{}
+	for _, route := range routes {
+		if IPVersionOf(route.Dst) == ipVersion {
+			result = append(result, route)
+		}
+	}
+	return result
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver
+
+import (
+	"bytes"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"github.com/projectcalico/felix/go/felix/set"
+	"sort"
+	"sync"
+)
+
+// Route is a route that the dataplane driver should program for a local
+// workload.
+type Route struct {
+	Dst       string `json:"dst"`
+	Interface string `json:"interface"`
+}
+
+// DataplaneState tracks the state that the calculation graph has asked the
+// dataplane driver to program, by observing the same stream of updates as
+// the driver.  It is safe for concurrent use.
+type DataplaneState struct {
+	mutex     sync.Mutex
+	renderer  rules.RuleRenderer
+	ipSets    map[string]set.Set
+	endpoints map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint
+	policies  map[proto.PolicyID]*proto.Policy
+	profiles  map[string]*proto.Profile
+	ipamPools map[string]*proto.IPAMPool
+
+	// routeAggregation configures Routes; see SetRouteAggregation.
+	routeAggregation RouteAggregation
+
+	// watchers receive a copy of each update, see Watch().
+	watchers map[chan interface{}]bool
+}
+
+func NewDataplaneState(renderer rules.RuleRenderer) *DataplaneState {
+	return &DataplaneState{
+		renderer:  renderer,
+		ipSets:    map[string]set.Set{},
+		endpoints: map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint{},
+		policies:  map[proto.PolicyID]*proto.Policy{},
+		profiles:  map[string]*proto.Profile{},
+		ipamPools: map[string]*proto.IPAMPool{},
+		watchers:  map[chan interface{}]bool{},
+	}
+}
+
+// OnUpdate records a message that was sent to the dataplane driver.
+// Messages that don't affect the tracked state are ignored.
+func (s *DataplaneState) OnUpdate(msg interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch msg := msg.(type) {
+	case *proto.IPSetUpdate:
+		members := set.New()
+		for _, m := range msg.Members {
+			members.Add(m)
+		}
+		s.ipSets[msg.Id] = members
+	case *proto.IPSetDeltaUpdate:
+		members := s.ipSets[msg.Id]
+		if members == nil {
+			members = set.New()
+			s.ipSets[msg.Id] = members
+		}
+		for _, m := range msg.AddedMembers {
+			members.Add(m)
+		}
+		for _, m := range msg.RemovedMembers {
+			members.Discard(m)
+		}
+	case *proto.IPSetRemove:
+		delete(s.ipSets, msg.Id)
+	case *proto.WorkloadEndpointUpdate:
+		s.endpoints[*msg.Id] = msg.Endpoint
+	case *proto.WorkloadEndpointRemove:
+		delete(s.endpoints, *msg.Id)
+	case *proto.ActivePolicyUpdate:
+		s.policies[*msg.Id] = msg.Policy
+	case *proto.ActivePolicyRemove:
+		delete(s.policies, *msg.Id)
+	case *proto.ActiveProfileUpdate:
+		s.profiles[msg.Id.Name] = msg.Profile
+	case *proto.ActiveProfileRemove:
+		delete(s.profiles, msg.Id.Name)
+	case *proto.IPAMPoolUpdate:
+		s.ipamPools[msg.Id] = msg.Pool
+	case *proto.IPAMPoolRemove:
+		delete(s.ipamPools, msg.Id)
+	default:
+		return
+	}
+	for c := range s.watchers {
+		select {
+		case c <- msg:
+		default:
+			// The watcher has fallen behind; rather than block the
+			// dataplane updates, drop it.  It can watch again, starting
+			// from a fresh snapshot.
+			log.Warn("Debug state watcher fell behind, dropping it")
+			delete(s.watchers, c)
+			close(c)
+		}
+	}
+}
+
+// IPSets returns the members of each IP set, sorted.
+func (s *DataplaneState) IPSets() map[string][]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ipSetsLocked()
+}
+
+func (s *DataplaneState) ipSetsLocked() map[string][]string {
+	result := map[string][]string{}
+	for id, members := range s.ipSets {
+		sorted := []string{}
+		members.Iter(func(item interface{}) error {
+			sorted = append(sorted, item.(string))
+			return nil
+		})
+		sort.Strings(sorted)
+		result[id] = sorted
+	}
+	return result
+}
+
+// Routes returns the routes to the local workloads, sorted by destination,
+// aggregated by IPAM block if SetRouteAggregation enabled it.
+func (s *DataplaneState) Routes() []Route {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	routes := []Route{}
+	routed := map[string]bool{}
+	for _, ep := range s.endpoints {
+		for _, nets := range [][]string{ep.Ipv4Nets, ep.Ipv6Nets} {
+			for _, dst := range nets {
+				routes = append(routes, Route{Dst: dst, Interface: ep.Name})
+				routed[dst] = true
+			}
+		}
+	}
+	// An allowed source prefix, such as a virtual IP, may be shared by
+	// several workloads for failover, but it can only be routed to one of
+	// them.  We pick the first interface by name, so that the route
+	// doesn't depend on the order of the updates.  A workload's own address
+	// takes precedence over another's allowed prefix.
+	vipIfaces := map[string]string{}
+	for _, ep := range s.endpoints {
+		for _, dst := range ep.AllowedSourcePrefixes {
+			if routed[dst] {
+				continue
+			}
+			if iface, ok := vipIfaces[dst]; !ok || ep.Name < iface {
+				vipIfaces[dst] = ep.Name
+			}
+		}
+	}
+	for dst, iface := range vipIfaces {
+		routes = append(routes, Route{Dst: dst, Interface: iface})
+	}
+	sort.Sort(routesByDst(routes))
+	pools := []string{}
+	for _, pool := range s.ipamPools {
+		pools = append(pools, pool.Cidr)
+	}
+	return AggregateRoutes(routes, pools, s.routeAggregation)
+}
+
+type routesByDst []Route
+
+func (r routesByDst) Len() int           { return len(r) }
+func (r routesByDst) Less(i, j int) bool { return r[i].Dst < r[j].Dst }
+func (r routesByDst) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// Chains renders the endpoint chains of the local workloads, sorted by
+// name.  The policy and profile chains that they jump to are rendered by
+// the dataplane driver.  The chains are those of IPv4; the IPv6 chains only
+// differ in the workloads' source chains, see Stacks.
+func (s *DataplaneState) Chains() []*iptables.Chain {
+	return s.chainsForIPVersion(4)
+}
+
+func (s *DataplaneState) chainsForIPVersion(ipVersion uint8) []*iptables.Chain {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	chains := []*iptables.Chain{}
+	for _, ep := range s.endpoints {
+		chains = append(chains, s.renderer.WorkloadEndpointToIptablesChains(
+			ep.Name,
+			ep.Mac,
+			ep.Tiers,
+			ep.ProfileIds,
+			rules.ConntrackBypassDefault,
+			false,
+		)...)
+		sourceNets := append(append([]string(nil), ep.Ipv4Nets...), ep.Ipv6Nets...)
+		sourceNets = append(sourceNets, ep.AllowedSourcePrefixes...)
+		if chain := s.renderer.WorkloadSourceChain(ep.Name, sourceNets, ipVersion); chain != nil {
+			chains = append(chains, chain)
+		}
+	}
+	sort.Sort(chainsByName(chains))
+	return chains
+}
+
+type chainsByName []*iptables.Chain
+
+func (c chainsByName) Len() int           { return len(c) }
+func (c chainsByName) Less(i, j int) bool { return c[i].Name < c[j].Name }
+func (c chainsByName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// renderChains renders chains in the format used by iptables-save.
+func renderChains(chains []*iptables.Chain) string {
+	var buf bytes.Buffer
+	for _, chain := range chains {
+		buf.WriteString("-N ")
+		buf.WriteString(chain.Name)
+		buf.WriteByte('\n')
+		for _, rule := range chain.Rules {
+			rule.RenderAppendTo(&buf, chain.Name, "")
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver
+
+import (
+	"fmt"
+	"github.com/projectcalico/felix/go/felix/trace"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultTraceDuration is the duration of a trace that doesn't specify one.
+const defaultTraceDuration = time.Minute
+
+// Tracer runs packet traces; it's implemented by trace.Tracer.
+type Tracer interface {
+	Start(tuple trace.Tuple, duration time.Duration) (*trace.Trace, error)
+	Stop(id int) error
+	Active() []*trace.Trace
+}
+
+// EnableTrace enables the /debug/trace endpoint, which runs its traces with
+// the given Tracer.  It must be called before the server starts serving.
+func (s *Server) EnableTrace(tracer Tracer) {
+	s.tracer = tracer
+}
+
+// serveTrace starts a trace if the request has any tuple parameters, stops
+// one if it has a stop parameter and otherwise lists the active traces.
+func (s *Server) serveTrace(rsp http.ResponseWriter, req *http.Request) {
+	if s.tracer == nil {
+		http.Error(rsp, "packet tracing is not enabled", http.StatusNotFound)
+		return
+	}
+	query := req.URL.Query()
+	if stop := query.Get("stop"); stop != "" {
+		id, err := strconv.Atoi(stop)
+		if err != nil {
+			http.Error(rsp, "invalid trace ID", http.StatusBadRequest)
+			return
+		}
+		if err := s.tracer.Stop(id); err == trace.ErrUnknownTrace {
+			http.Error(rsp, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(rsp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rsp, s.tracer.Active())
+		return
+	}
+	tuple, duration, err := parseTraceRequest(req)
+	if err != nil {
+		http.Error(rsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tuple == (trace.Tuple{}) {
+		writeJSON(rsp, s.tracer.Active())
+		return
+	}
+	started, err := s.tracer.Start(tuple, duration)
+	if err == trace.ErrTooManyTraces {
+		http.Error(rsp, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(rsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(rsp, started)
+}
+
+func parseTraceRequest(req *http.Request) (trace.Tuple, time.Duration, error) {
+	query := req.URL.Query()
+	tuple := trace.Tuple{
+		Protocol: strings.ToLower(query.Get("proto")),
+		SrcIP:    query.Get("src"),
+		DstIP:    query.Get("dst"),
+	}
+	for param, port := range map[string]*uint16{"sport": &tuple.SrcPort, "dport": &tuple.DstPort} {
+		if value := query.Get(param); value != "" {
+			parsed, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return tuple, 0, fmt.Errorf("invalid %s: %v", param, err)
+			}
+			*port = uint16(parsed)
+		}
+	}
+	duration := defaultTraceDuration
+	if value := query.Get("duration"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return tuple, 0, fmt.Errorf("invalid duration: %v", err)
+		}
+		duration = parsed
+	}
+	return tuple, duration, nil
+}
+
+// TraceStep is a TRACE event together with the explanations of its chain.
+// Chains that Felix doesn't render, such as the built-in ones, have no
+// explanations.
+type TraceStep struct {
+	*trace.Event
+	Explanations []*Explanation `json:"explanations,omitempty"`
+}
+
+func (t *TraceStep) String() string {
+	s := fmt.Sprintf("%s:%s %s %d", t.Table, t.Chain, t.Type, t.RuleNum)
+	for _, e := range t.Explanations {
+		s += "\n  " + strings.Replace(e.String(), "\n", "\n  ", -1)
+	}
+	return s
+}
+
+// ExplainTrace explains the chain of each of the events.
+func (s *DataplaneState) ExplainTrace(events []*trace.Event) []*TraceStep {
+	steps, _ := explainTrace(events, func(chain string) ([]*Explanation, error) {
+		return s.Explain(chain), nil
+	})
+	return steps
+}
+
+// FetchTraceExplanations asks the debug server at addr to explain the chain
+// of each of the events.
+func FetchTraceExplanations(addr string, events []*trace.Event) ([]*TraceStep, error) {
+	return explainTrace(events, func(chain string) ([]*Explanation, error) {
+		return FetchExplanations(addr, chain)
+	})
+}
+
+func explainTrace(events []*trace.Event, explain func(chain string) ([]*Explanation, error)) ([]*TraceStep, error) {
+	// A traced packet typically hits the same chains many times.
+	cache := map[string][]*Explanation{}
+	steps := []*TraceStep{}
+	for _, event := range events {
+		explanations, ok := cache[event.Chain]
+		if !ok {
+			var err error
+			explanations, err = explain(event.Chain)
+			if err != nil {
+				return nil, err
+			}
+			cache[event.Chain] = explanations
+		}
+		steps = append(steps, &TraceStep{Event: event, Explanations: explanations})
+	}
+	return steps, nil
+}
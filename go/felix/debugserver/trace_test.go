@@ -0,0 +1,153 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugserver_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/debugserver"
+
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"github.com/projectcalico/felix/go/felix/trace"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Trace", func() {
+	var state *DataplaneState
+	var server *Server
+	var tracer *fakeTracer
+	wepID := proto.WorkloadEndpointID{
+		OrchestratorId: "k8s",
+		WorkloadId:     "pod1",
+		EndpointId:     "eth0",
+	}
+
+	BeforeEach(func() {
+		state = NewDataplaneState(rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+			IptablesMarkAccept:    0x8,
+			IptablesMarkNextTier:  0x10,
+		}))
+		state.OnUpdate(&proto.WorkloadEndpointUpdate{
+			Id:       &wepID,
+			Endpoint: &proto.WorkloadEndpoint{Name: "cali1234"},
+		})
+		server = New(state)
+		tracer = &fakeTracer{}
+	})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rsp := httptest.NewRecorder()
+		server.ServeHTTP(rsp, httptest.NewRequest("GET", path, nil))
+		return rsp
+	}
+
+	It("should not trace unless enabled", func() {
+		Expect(get("/debug/trace").Code).To(Equal(http.StatusNotFound))
+	})
+
+	Describe("with tracing enabled", func() {
+		BeforeEach(func() {
+			server.EnableTrace(tracer)
+		})
+
+		It("should start a trace", func() {
+			rsp := get("/debug/trace?proto=TCP&src=10.0.0.2&dst=10.0.0.1&dport=80&duration=30s")
+			Expect(rsp.Code).To(Equal(http.StatusOK))
+			Expect(tracer.tuple).To(Equal(trace.Tuple{
+				Protocol: "tcp",
+				SrcIP:    "10.0.0.2",
+				DstIP:    "10.0.0.1",
+				DstPort:  80,
+			}))
+			Expect(tracer.duration).To(Equal(30 * time.Second))
+			var started trace.Trace
+			Expect(json.Unmarshal(rsp.Body.Bytes(), &started)).To(Succeed())
+			Expect(started.ID).To(Equal(1))
+		})
+		It("should default the duration", func() {
+			Expect(get("/debug/trace?dst=10.0.0.1").Code).To(Equal(http.StatusOK))
+			Expect(tracer.duration).To(Equal(time.Minute))
+		})
+		It("should list the active traces", func() {
+			rsp := get("/debug/trace")
+			Expect(rsp.Code).To(Equal(http.StatusOK))
+			Expect(tracer.tuple).To(Equal(trace.Tuple{}))
+			Expect(strings.TrimSpace(rsp.Body.String())).To(Equal("[]"))
+		})
+		It("should stop a trace", func() {
+			Expect(get("/debug/trace?stop=3").Code).To(Equal(http.StatusOK))
+			Expect(tracer.stopped).To(Equal(3))
+			Expect(get("/debug/trace?stop=x").Code).To(Equal(http.StatusBadRequest))
+			tracer.err = trace.ErrUnknownTrace
+			Expect(get("/debug/trace?stop=4").Code).To(Equal(http.StatusNotFound))
+		})
+		It("should reject a bad port", func() {
+			Expect(get("/debug/trace?proto=tcp&dport=70000").Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	It("should explain the chains of TRACE events", func() {
+		events, err := trace.ReadEvents(strings.NewReader(
+			"TRACE: raw:PREROUTING:policy:2 IN=eth0 OUT=\n" +
+				"TRACE: filter:cali-tw-cali1234:rule:1 IN=eth0 OUT=cali1234\n" +
+				"TRACE: filter:cali-tw-cali1234:return:3 IN=eth0 OUT=cali1234\n"))
+		Expect(err).NotTo(HaveOccurred())
+		steps := state.ExplainTrace(events)
+		Expect(steps).To(HaveLen(3))
+		Expect(steps[0].Explanations).To(BeEmpty())
+		Expect(steps[1].Explanations).To(Equal(state.Explain("cali-tw-cali1234")))
+		Expect(steps[1].String()).To(HavePrefix(
+			"filter:cali-tw-cali1234 rule 1\n  endpoint chain cali-tw-cali1234, inbound"))
+		Expect(steps[2].Explanations).To(Equal(steps[1].Explanations))
+	})
+
+	It("should fetch the explanations of TRACE events", func() {
+		httpServer := httptest.NewServer(server)
+		defer httpServer.Close()
+		event, _ := trace.ParseEvent("TRACE: filter:cali-tw-cali1234:rule:1 IN=eth0 OUT=cali1234")
+		steps, err := FetchTraceExplanations(strings.TrimPrefix(httpServer.URL, "http://"),
+			[]*trace.Event{event})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(steps).To(Equal(state.ExplainTrace([]*trace.Event{event})))
+	})
+})
+
+type fakeTracer struct {
+	tuple    trace.Tuple
+	duration time.Duration
+	stopped  int
+	err      error
+}
+
+func (t *fakeTracer) Start(tuple trace.Tuple, duration time.Duration) (*trace.Trace, error) {
+	t.tuple = tuple
+	t.duration = duration
+	return &trace.Trace{ID: 1, Tuple: tuple}, t.err
+}
+
+func (t *fakeTracer) Stop(id int) error {
+	t.stopped = id
+	return t.err
+}
+
+func (t *fakeTracer) Active() []*trace.Trace {
+	return []*trace.Trace{}
+}
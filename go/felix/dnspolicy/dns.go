@@ -0,0 +1,237 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dnspolicy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dnsHeaderLen  = 12
+	udpHeaderLen  = 8
+	ipProtoUDP    = 17
+	dnsTypeA      = 1
+	dnsTypeCNAME  = 5
+	dnsTypeAAAA   = 28
+	dnsClassIN    = 1
+	dnsFlagQR     = 0x8000
+	dnsRCodeMask  = 0xf
+	maxNameJumps  = 32
+	maxCNAMEDepth = 16
+)
+
+var (
+	ErrTruncated   = errors.New("truncated packet")
+	ErrNotUDP      = errors.New("packet isn't IPv4 or IPv6 UDP")
+	ErrNotResponse = errors.New("DNS message isn't a response")
+	ErrBadName     = errors.New("malformed DNS name")
+)
+
+// Resolution is an address that a DNS response resolved a domain name to.
+type Resolution struct {
+	Domain string
+	IP     net.IP
+	TTL    time.Duration
+}
+
+// ParseDNSPacket parses an IP packet that contains a DNS response over UDP.
+func ParseDNSPacket(packet []byte) ([]Resolution, error) {
+	udp, err := udpPayload(packet)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDNSResponse(udp)
+}
+
+// udpPayload returns the payload of a UDP packet.
+func udpPayload(b []byte) ([]byte, error) {
+	if len(b) < 1 {
+		return nil, ErrTruncated
+	}
+	var l4 []byte
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return nil, ErrTruncated
+		}
+		headerLen := int(b[0]&0xf) * 4
+		if b[9] != ipProtoUDP {
+			return nil, ErrNotUDP
+		}
+		if headerLen < 20 || len(b) < headerLen {
+			return nil, ErrTruncated
+		}
+		l4 = b[headerLen:]
+	case 6:
+		if len(b) < 40 {
+			return nil, ErrTruncated
+		}
+		if b[6] != ipProtoUDP {
+			return nil, ErrNotUDP
+		}
+		l4 = b[40:]
+	default:
+		return nil, ErrNotUDP
+	}
+	if len(l4) < udpHeaderLen {
+		return nil, ErrTruncated
+	}
+	return l4[udpHeaderLen:], nil
+}
+
+// ParseDNSResponse extracts the A and AAAA records from a DNS response.
+// Addresses that were reached through CNAMEs are also reported for each
+// alias in the chain, with the lowest TTL along the way.  Domain names are
+// returned in lower case without the trailing dot.
+func ParseDNSResponse(msg []byte) ([]Resolution, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, ErrTruncated
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&dnsFlagQR == 0 {
+		return nil, ErrNotResponse
+	}
+	if flags&dnsRCodeMask != 0 {
+		// Failed lookup; no answers to report.
+		return nil, nil
+	}
+	numQuestions := int(binary.BigEndian.Uint16(msg[4:6]))
+	numAnswers := int(binary.BigEndian.Uint16(msg[6:8]))
+
+	offset := dnsHeaderLen
+	for i := 0; i < numQuestions; i++ {
+		var err error
+		if _, offset, err = readName(msg, offset); err != nil {
+			return nil, err
+		}
+		// Skip the type and class.
+		offset += 4
+		if offset > len(msg) {
+			return nil, ErrTruncated
+		}
+	}
+
+	type cname struct {
+		alias string
+		ttl   time.Duration
+	}
+	// aliases maps from the target of each CNAME record to its aliases.
+	aliases := map[string][]cname{}
+	var addrs []Resolution
+	for i := 0; i < numAnswers; i++ {
+		name, next, err := readName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(msg) {
+			return nil, ErrTruncated
+		}
+		rrType := binary.BigEndian.Uint16(msg[next : next+2])
+		rrClass := binary.BigEndian.Uint16(msg[next+2 : next+4])
+		ttl := time.Duration(binary.BigEndian.Uint32(msg[next+4:next+8])) * time.Second
+		dataLen := int(binary.BigEndian.Uint16(msg[next+8 : next+10]))
+		dataStart := next + 10
+		offset = dataStart + dataLen
+		if offset > len(msg) {
+			return nil, ErrTruncated
+		}
+		if rrClass != dnsClassIN {
+			continue
+		}
+		switch rrType {
+		case dnsTypeA, dnsTypeAAAA:
+			if (rrType == dnsTypeA && dataLen != 4) || (rrType == dnsTypeAAAA && dataLen != 16) {
+				return nil, ErrTruncated
+			}
+			ip := make(net.IP, dataLen)
+			copy(ip, msg[dataStart:offset])
+			addrs = append(addrs, Resolution{Domain: name, IP: ip, TTL: ttl})
+		case dnsTypeCNAME:
+			target, _, err := readName(msg, dataStart)
+			if err != nil {
+				return nil, err
+			}
+			aliases[target] = append(aliases[target], cname{alias: name, ttl: ttl})
+		}
+	}
+
+	var resolutions []Resolution
+	for _, addr := range addrs {
+		resolutions = append(resolutions, addr)
+		// Walk back up the CNAME chain.  The depth limit protects
+		// against loops.
+		todo := []Resolution{addr}
+		for depth := 0; len(todo) > 0 && depth < maxCNAMEDepth; depth++ {
+			var next []Resolution
+			for _, r := range todo {
+				for _, c := range aliases[r.Domain] {
+					ttl := r.TTL
+					if c.ttl < ttl {
+						ttl = c.ttl
+					}
+					next = append(next, Resolution{Domain: c.alias, IP: r.IP, TTL: ttl})
+				}
+			}
+			resolutions = append(resolutions, next...)
+			todo = next
+		}
+	}
+	return resolutions, nil
+}
+
+// readName reads a possibly-compressed domain name starting at offset.
+// Returns the name and the offset of the first byte after it.
+func readName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, ErrTruncated
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case length&0xc0 == 0xc0:
+			// Compression pointer to an earlier name.
+			if offset+2 > len(msg) {
+				return "", 0, ErrTruncated
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			jumps++
+			if jumps > maxNameJumps {
+				return "", 0, ErrBadName
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:offset+2]) & 0x3fff)
+		case length&0xc0 != 0:
+			return "", 0, ErrBadName
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, ErrTruncated
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dnspolicy_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/dnspolicy"
+
+	"encoding/binary"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"strings"
+	"time"
+)
+
+// name encodes an uncompressed domain name.
+func name(domain string) []byte {
+	var b []byte
+	for _, label := range strings.Split(domain, ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// pointer encodes a compression pointer to the given offset.
+func pointer(offset int) []byte {
+	return []byte{0xc0 | byte(offset>>8), byte(offset)}
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func header(flags uint16, numQuestions, numAnswers uint16) []byte {
+	b := be16(0x1234)
+	b = append(b, be16(flags)...)
+	b = append(b, be16(numQuestions)...)
+	b = append(b, be16(numAnswers)...)
+	return append(b, 0, 0, 0, 0)
+}
+
+func question(owner []byte, rrType uint16) []byte {
+	return append(append(append([]byte{}, owner...), be16(rrType)...), be16(1)...)
+}
+
+func answer(owner []byte, rrType uint16, ttl uint32, data []byte) []byte {
+	b := append([]byte{}, owner...)
+	b = append(b, be16(rrType)...)
+	b = append(b, be16(1)...)
+	b = append(b, be32(ttl)...)
+	b = append(b, be16(uint16(len(data)))...)
+	return append(b, data...)
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+const responseFlags = 0x8180
+
+var _ = Describe("ParseDNSResponse", func() {
+	It("should parse A and AAAA records with compressed names", func() {
+		// The question's name starts just after the header.
+		msg := concat(
+			header(responseFlags, 1, 2),
+			question(name("Example.COM"), 1),
+			answer(pointer(12), 1, 300, net.ParseIP("10.0.0.1").To4()),
+			answer(pointer(12), 28, 60, net.ParseIP("fd00::1")),
+		)
+		Expect(ParseDNSResponse(msg)).To(Equal([]Resolution{
+			{Domain: "example.com", IP: net.ParseIP("10.0.0.1").To4(), TTL: 300 * time.Second},
+			{Domain: "example.com", IP: net.ParseIP("fd00::1"), TTL: 60 * time.Second},
+		}))
+	})
+	It("should attribute addresses to CNAME aliases with the lowest TTL", func() {
+		msg := concat(
+			header(responseFlags, 1, 3),
+			question(name("www.example.com"), 1),
+			answer(name("www.example.com"), 5, 30, name("cdn.example.net")),
+			answer(name("cdn.example.net"), 5, 600, name("edge.example.org")),
+			answer(name("edge.example.org"), 1, 120, net.ParseIP("10.0.0.2").To4()),
+		)
+		ip := net.ParseIP("10.0.0.2").To4()
+		Expect(ParseDNSResponse(msg)).To(Equal([]Resolution{
+			{Domain: "edge.example.org", IP: ip, TTL: 120 * time.Second},
+			{Domain: "cdn.example.net", IP: ip, TTL: 120 * time.Second},
+			{Domain: "www.example.com", IP: ip, TTL: 30 * time.Second},
+		}))
+	})
+	It("should not loop forever on a CNAME loop", func() {
+		msg := concat(
+			header(responseFlags, 0, 3),
+			answer(name("a.example.com"), 5, 30, name("b.example.com")),
+			answer(name("b.example.com"), 5, 30, name("a.example.com")),
+			answer(name("a.example.com"), 1, 30, net.ParseIP("10.0.0.3").To4()),
+		)
+		_, err := ParseDNSResponse(msg)
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("should return nothing for a failed lookup", func() {
+		msg := concat(header(responseFlags|3, 1, 0), question(name("nx.example.com"), 1))
+		Expect(ParseDNSResponse(msg)).To(BeEmpty())
+	})
+	It("should reject a query", func() {
+		msg := concat(header(0x0100, 1, 0), question(name("example.com"), 1))
+		_, err := ParseDNSResponse(msg)
+		Expect(err).To(Equal(ErrNotResponse))
+	})
+	It("should reject a compression pointer loop", func() {
+		msg := concat(header(responseFlags, 1, 0), pointer(12))
+		_, err := ParseDNSResponse(msg)
+		Expect(err).To(Equal(ErrBadName))
+	})
+	It("should reject a truncated answer", func() {
+		msg := concat(
+			header(responseFlags, 0, 1),
+			answer(name("example.com"), 1, 30, net.ParseIP("10.0.0.1").To4()),
+		)
+		_, err := ParseDNSResponse(msg[:len(msg)-1])
+		Expect(err).To(Equal(ErrTruncated))
+	})
+})
+
+var _ = Describe("ParseDNSPacket", func() {
+	msg := concat(
+		header(responseFlags, 0, 1),
+		answer(name("example.com"), 1, 30, net.ParseIP("10.0.0.1").To4()),
+	)
+	expected := []Resolution{
+		{Domain: "example.com", IP: net.ParseIP("10.0.0.1").To4(), TTL: 30 * time.Second},
+	}
+	udpHeader := concat(be16(53), be16(40000), be16(uint16(8+len(msg))), be16(0))
+
+	It("should parse an IPv4 packet", func() {
+		ipHeader := make([]byte, 20)
+		ipHeader[0] = 0x45
+		ipHeader[9] = 17
+		Expect(ParseDNSPacket(concat(ipHeader, udpHeader, msg))).To(Equal(expected))
+	})
+	It("should parse an IPv6 packet", func() {
+		ipHeader := make([]byte, 40)
+		ipHeader[0] = 0x60
+		ipHeader[6] = 17
+		Expect(ParseDNSPacket(concat(ipHeader, udpHeader, msg))).To(Equal(expected))
+	})
+	It("should reject a TCP packet", func() {
+		ipHeader := make([]byte, 20)
+		ipHeader[0] = 0x45
+		ipHeader[9] = 6
+		_, err := ParseDNSPacket(concat(ipHeader, udpHeader, msg))
+		Expect(err).To(Equal(ErrNotUDP))
+	})
+})
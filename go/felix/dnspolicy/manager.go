@@ -0,0 +1,392 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The dnspolicy package implements egress policy by domain name.  The
+// Snooper reads copies of the DNS responses that the host and its workloads
+// receive (sent to NFLOG by the rules.DNSSnoopChain), and the Manager turns
+// the resolved addresses into IP sets that the policy rules match on.
+//
+// Only responses over UDP are snooped.  Since the address only reaches
+// the IP set after the client has seen the response, the client's first
+// packets to it may be dropped.  Most clients retry quickly enough that this
+// isn't noticeable.
+package dnspolicy
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/hash"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config holds the tunable parameters of the Manager.
+type Config struct {
+	// MinTTL is the minimum time for which we keep a resolved address in
+	// the IP sets.  DNS servers often hand out very short TTLs but clients
+	// keep using the address for a while after it expires.
+	MinTTL time.Duration
+	// MaxIPSetSize limits the number of addresses in each domain IP set.
+	MaxIPSetSize int
+	// ExpiryInterval is how often we check for expired addresses.
+	ExpiryInterval time.Duration
+}
+
+// domainSet is an IP set that contains the addresses of a list of domains.
+type domainSet struct {
+	id      string
+	domains []string
+	members map[string]bool
+	users   map[interface{}]bool
+}
+
+// Manager implements egress policy by domain name.  It sits between the
+// calculation graph and the dataplane driver, rewriting each rule that has
+// destination domains to match on a dynamic IP set instead.  It then keeps
+// those IP sets up to date with the addresses that the Resolutions sent to
+// ResolutionsC report, expiring them after their TTL.
+//
+// IP sets are shared by all rules that match on the same list of domains.
+// An IP set is sent to the dataplane before the first policy or profile that
+// uses it and removed after the last one goes away.
+type Manager struct {
+	// Input receives the messages from the calculation graph.
+	Input chan interface{}
+	// ResolutionsC receives the DNS resolutions from the snooper.
+	ResolutionsC chan []Resolution
+
+	output chan<- interface{}
+	config Config
+
+	// sets maps from IP set ID to the set.
+	sets map[string]*domainSet
+	// setIDsByUser maps from PolicyID or ProfileID to the IDs of the IP sets
+	// that its rules use.
+	setIDsByUser map[interface{}][]string
+	// setIDsByDomain maps from domain name to the IDs of the IP sets that
+	// contain its addresses.
+	setIDsByDomain map[string]map[string]bool
+	// expiries maps from domain name and IP address to the time at which
+	// the address expires.  Only domains that are in use are recorded.
+	expiries map[string]map[string]time.Time
+}
+
+func NewManager(output chan<- interface{}, config Config) *Manager {
+	return &Manager{
+		Input:          make(chan interface{}),
+		ResolutionsC:   make(chan []Resolution, 100),
+		output:         output,
+		config:         config,
+		sets:           map[string]*domainSet{},
+		setIDsByUser:   map[interface{}][]string{},
+		setIDsByDomain: map[string]map[string]bool{},
+		expiries:       map[string]map[string]time.Time{},
+	}
+}
+
+func (m *Manager) Start() {
+	go m.loop()
+}
+
+func (m *Manager) loop() {
+	expiryTicker := time.NewTicker(m.config.ExpiryInterval)
+	defer expiryTicker.Stop()
+	for {
+		select {
+		case msg := <-m.Input:
+			m.OnUpdate(msg)
+		case resolutions := <-m.ResolutionsC:
+			m.OnResolutions(resolutions, time.Now())
+		case <-expiryTicker.C:
+			m.Expire(time.Now())
+		}
+	}
+}
+
+// OnUpdate processes a message from the calculation graph, passing it on
+// to the output.
+func (m *Manager) OnUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.ActivePolicyUpdate:
+		policy := *msg.Policy
+		setIDs := map[string]bool{}
+		policy.InboundRules = m.rewriteRules(policy.InboundRules, setIDs)
+		policy.OutboundRules = m.rewriteRules(policy.OutboundRules, setIDs)
+		m.updateUser(*msg.Id, setIDs, &proto.ActivePolicyUpdate{
+			Id:     msg.Id,
+			Policy: &policy,
+		})
+	case *proto.ActivePolicyRemove:
+		m.updateUser(*msg.Id, nil, msg)
+	case *proto.ActiveProfileUpdate:
+		profile := *msg.Profile
+		setIDs := map[string]bool{}
+		profile.InboundRules = m.rewriteRules(profile.InboundRules, setIDs)
+		profile.OutboundRules = m.rewriteRules(profile.OutboundRules, setIDs)
+		m.updateUser(*msg.Id, setIDs, &proto.ActiveProfileUpdate{
+			Id:      msg.Id,
+			Profile: &profile,
+		})
+	case *proto.ActiveProfileRemove:
+		m.updateUser(*msg.Id, nil, msg)
+	default:
+		m.output <- msg
+	}
+}
+
+// rewriteRules returns a copy of the rules in which the destination domains
+// have been replaced by the corresponding IP sets, creating the sets if
+// needed.  Adds the IDs of the sets to setIDs.
+func (m *Manager) rewriteRules(rules []*proto.Rule, setIDs map[string]bool) []*proto.Rule {
+	var rewritten []*proto.Rule
+	for _, rule := range rules {
+		if len(rule.DstDomains) == 0 {
+			rewritten = append(rewritten, rule)
+			continue
+		}
+		domains := normaliseDomains(rule.DstDomains)
+		setID := hash.MakeUniqueID("d", strings.Join(domains, ","))
+		if m.sets[setID] == nil {
+			m.addSet(setID, domains)
+		}
+		setIDs[setID] = true
+
+		ruleCopy := *rule
+		ruleCopy.DstDomains = nil
+		ruleCopy.DstIpSetIds = append(append([]string(nil), rule.DstIpSetIds...), setID)
+		rewritten = append(rewritten, &ruleCopy)
+	}
+	return rewritten
+}
+
+// updateUser records the IP sets that a policy or profile now uses, sends
+// the message and then removes any IP sets that are no longer used.
+func (m *Manager) updateUser(user interface{}, setIDs map[string]bool, msg interface{}) {
+	oldSetIDs := m.setIDsByUser[user]
+	var newSetIDs []string
+	for setID := range setIDs {
+		set := m.sets[setID]
+		if len(set.users) == 0 {
+			// New set; the dataplane needs to hear about it before the
+			// rules that reference it.
+			m.output <- &proto.IPSetUpdate{
+				Id:      setID,
+				Members: sortedKeys(set.members),
+			}
+		}
+		set.users[user] = true
+		newSetIDs = append(newSetIDs, setID)
+	}
+	if len(newSetIDs) > 0 {
+		m.setIDsByUser[user] = newSetIDs
+	} else {
+		delete(m.setIDsByUser, user)
+	}
+
+	m.output <- msg
+
+	for _, setID := range oldSetIDs {
+		if setIDs[setID] {
+			continue
+		}
+		set := m.sets[setID]
+		delete(set.users, user)
+		if len(set.users) == 0 {
+			m.removeSet(set)
+		}
+	}
+}
+
+func (m *Manager) addSet(setID string, domains []string) {
+	log.WithFields(log.Fields{
+		"setID":   setID,
+		"domains": domains,
+	}).Info("Domain IP set now in use")
+	set := &domainSet{
+		id:      setID,
+		domains: domains,
+		members: map[string]bool{},
+		users:   map[interface{}]bool{},
+	}
+	m.sets[setID] = set
+	for _, domain := range domains {
+		if m.setIDsByDomain[domain] == nil {
+			m.setIDsByDomain[domain] = map[string]bool{}
+		}
+		m.setIDsByDomain[domain][setID] = true
+	}
+	set.members = m.calculateMembers(set)
+}
+
+func (m *Manager) removeSet(set *domainSet) {
+	log.WithField("setID", set.id).Info("Domain IP set no longer in use")
+	delete(m.sets, set.id)
+	for _, domain := range set.domains {
+		delete(m.setIDsByDomain[domain], set.id)
+		if len(m.setIDsByDomain[domain]) == 0 {
+			delete(m.setIDsByDomain, domain)
+			delete(m.expiries, domain)
+		}
+	}
+	m.output <- &proto.IPSetRemove{Id: set.id}
+}
+
+// OnResolutions records the addresses of the domains that are in use and
+// sends updates for the IP sets that change as a result.
+func (m *Manager) OnResolutions(resolutions []Resolution, now time.Time) {
+	dirtySetIDs := map[string]bool{}
+	for _, r := range resolutions {
+		setIDs := m.setIDsByDomain[r.Domain]
+		if len(setIDs) == 0 {
+			continue
+		}
+		ttl := r.TTL
+		if ttl < m.config.MinTTL {
+			ttl = m.config.MinTTL
+		}
+		expiry := now.Add(ttl)
+		ip := r.IP.String()
+		if m.expiries[r.Domain] == nil {
+			m.expiries[r.Domain] = map[string]time.Time{}
+		}
+		oldExpiry, known := m.expiries[r.Domain][ip]
+		if known && !expiry.After(oldExpiry) {
+			continue
+		}
+		m.expiries[r.Domain][ip] = expiry
+		if known {
+			// Only the expiry time changed.
+			continue
+		}
+		log.WithFields(log.Fields{
+			"domain": r.Domain,
+			"ip":     ip,
+			"ttl":    ttl,
+		}).Debug("New address for domain")
+		for setID := range setIDs {
+			dirtySetIDs[setID] = true
+		}
+	}
+	m.updateSets(dirtySetIDs)
+}
+
+// Expire removes the addresses that have expired and sends updates for the
+// IP sets that change as a result.
+func (m *Manager) Expire(now time.Time) {
+	dirtySetIDs := map[string]bool{}
+	for domain, ips := range m.expiries {
+		for ip, expiry := range ips {
+			if expiry.After(now) {
+				continue
+			}
+			log.WithFields(log.Fields{
+				"domain": domain,
+				"ip":     ip,
+			}).Debug("Address for domain expired")
+			delete(ips, ip)
+			for setID := range m.setIDsByDomain[domain] {
+				dirtySetIDs[setID] = true
+			}
+		}
+		if len(ips) == 0 {
+			delete(m.expiries, domain)
+		}
+	}
+	m.updateSets(dirtySetIDs)
+}
+
+// updateSets recalculates the members of the given IP sets and sends the
+// differences to the dataplane.
+func (m *Manager) updateSets(setIDs map[string]bool) {
+	for _, setID := range sortedKeys(setIDs) {
+		set := m.sets[setID]
+		newMembers := m.calculateMembers(set)
+		var added, removed []string
+		for ip := range newMembers {
+			if !set.members[ip] {
+				added = append(added, ip)
+			}
+		}
+		for ip := range set.members {
+			if !newMembers[ip] {
+				removed = append(removed, ip)
+			}
+		}
+		set.members = newMembers
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		sort.Strings(added)
+		sort.Strings(removed)
+		m.output <- &proto.IPSetDeltaUpdate{
+			Id:             setID,
+			AddedMembers:   added,
+			RemovedMembers: removed,
+		}
+	}
+}
+
+// calculateMembers returns the addresses of the set's domains, up to the
+// maximum size of the set.  Addresses that are already in the set are kept in
+// preference to new ones so that established flows aren't disrupted.
+func (m *Manager) calculateMembers(set *domainSet) map[string]bool {
+	current := map[string]bool{}
+	candidates := map[string]bool{}
+	for _, domain := range set.domains {
+		for ip := range m.expiries[domain] {
+			if set.members[ip] {
+				current[ip] = true
+			} else {
+				candidates[ip] = true
+			}
+		}
+	}
+	members := map[string]bool{}
+	numDropped := 0
+	for _, ip := range append(sortedKeys(current), sortedKeys(candidates)...) {
+		if len(members) >= m.config.MaxIPSetSize {
+			numDropped++
+			continue
+		}
+		members[ip] = true
+	}
+	if numDropped > 0 {
+		log.WithFields(log.Fields{
+			"setID":      set.id,
+			"domains":    set.domains,
+			"numDropped": numDropped,
+		}).Warn("Domain IP set is full, ignoring some addresses")
+	}
+	return members
+}
+
+// normaliseDomains returns the sorted, de-duplicated list of domains, in
+// lower case and without trailing dots, to match the output of the parser.
+func normaliseDomains(domains []string) []string {
+	set := map[string]bool{}
+	for _, domain := range domains {
+		set[strings.TrimSuffix(strings.ToLower(domain), ".")] = true
+	}
+	return sortedKeys(set)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
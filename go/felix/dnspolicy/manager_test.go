@@ -0,0 +1,198 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dnspolicy_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/dnspolicy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/hash"
+	"net"
+	"time"
+)
+
+var _ = Describe("Manager", func() {
+	var (
+		output  chan interface{}
+		manager *Manager
+		now     time.Time
+	)
+	setID := hash.MakeUniqueID("d", "api.example.com,example.com")
+	polID := proto.PolicyID{Tier: "default", Name: "pol1"}
+	profID := proto.ProfileID{Name: "prof1"}
+	domainRule := func() *proto.Rule {
+		return &proto.Rule{
+			Action:      "allow",
+			DstIpSetIds: []string{"t:existing"},
+			DstDomains:  []string{"Example.com.", "api.example.com", "example.com"},
+		}
+	}
+	rewrittenRule := &proto.Rule{
+		Action:      "allow",
+		DstIpSetIds: []string{"t:existing", setID},
+	}
+	plainRule := &proto.Rule{Action: "deny"}
+	policyUpdate := func(rules ...*proto.Rule) *proto.ActivePolicyUpdate {
+		return &proto.ActivePolicyUpdate{
+			Id:     &polID,
+			Policy: &proto.Policy{InboundRules: []*proto.Rule{plainRule}, OutboundRules: rules},
+		}
+	}
+	resolution := func(domain, ip string, ttl time.Duration) Resolution {
+		return Resolution{Domain: domain, IP: net.ParseIP(ip), TTL: ttl}
+	}
+	expectOutput := func(msgs ...interface{}) {
+		for _, msg := range msgs {
+			Expect(<-output).To(Equal(msg))
+		}
+		Expect(output).To(BeEmpty())
+	}
+
+	BeforeEach(func() {
+		output = make(chan interface{}, 100)
+		manager = NewManager(output, Config{
+			MinTTL:         30 * time.Second,
+			MaxIPSetSize:   3,
+			ExpiryInterval: time.Second,
+		})
+		now = time.Now()
+	})
+
+	It("should pass through other messages", func() {
+		manager.OnUpdate(&proto.InSync{})
+		expectOutput(&proto.InSync{})
+	})
+	It("should pass through policies without domains", func() {
+		manager.OnUpdate(policyUpdate(plainRule))
+		expectOutput(policyUpdate(plainRule))
+	})
+	It("should ignore resolutions of domains that aren't in use", func() {
+		manager.OnResolutions([]Resolution{resolution("example.com", "10.0.0.1", time.Minute)}, now)
+		expectOutput()
+	})
+
+	Describe("with a policy that uses domains", func() {
+		var input *proto.ActivePolicyUpdate
+		BeforeEach(func() {
+			input = policyUpdate(domainRule())
+			manager.OnUpdate(input)
+		})
+
+		It("should send the IP set and then the rewritten policy", func() {
+			expectOutput(
+				&proto.IPSetUpdate{Id: setID, Members: []string{}},
+				policyUpdate(rewrittenRule),
+			)
+		})
+		It("should not modify the input", func() {
+			Expect(input).To(Equal(policyUpdate(domainRule())))
+		})
+
+		Describe("after resolutions", func() {
+			BeforeEach(func() {
+				<-output
+				<-output
+				manager.OnResolutions([]Resolution{
+					resolution("example.com", "10.0.0.1", time.Minute),
+					resolution("api.example.com", "fd00::1", 10*time.Second),
+					resolution("other.example.com", "10.0.0.9", time.Minute),
+				}, now)
+			})
+
+			It("should add the addresses to the IP set", func() {
+				expectOutput(&proto.IPSetDeltaUpdate{
+					Id:           setID,
+					AddedMembers: []string{"10.0.0.1", "fd00::1"},
+				})
+			})
+			It("should not resend known addresses", func() {
+				<-output
+				manager.OnResolutions([]Resolution{resolution("example.com", "10.0.0.1", time.Minute)}, now)
+				expectOutput()
+			})
+			It("should apply the minimum TTL", func() {
+				<-output
+				manager.Expire(now.Add(20 * time.Second))
+				expectOutput()
+				manager.Expire(now.Add(30 * time.Second))
+				expectOutput(&proto.IPSetDeltaUpdate{
+					Id:             setID,
+					RemovedMembers: []string{"fd00::1"},
+				})
+			})
+			It("should extend the expiry on a new resolution", func() {
+				<-output
+				manager.OnResolutions([]Resolution{resolution("example.com", "10.0.0.1", time.Minute)}, now.Add(50*time.Second))
+				manager.Expire(now.Add(time.Minute))
+				expectOutput(&proto.IPSetDeltaUpdate{
+					Id:             setID,
+					RemovedMembers: []string{"fd00::1"},
+				})
+			})
+			It("should limit the size of the IP set, keeping existing members", func() {
+				<-output
+				manager.OnResolutions([]Resolution{
+					resolution("example.com", "10.0.0.0", time.Minute),
+					resolution("example.com", "10.0.0.2", time.Minute),
+				}, now)
+				expectOutput(&proto.IPSetDeltaUpdate{
+					Id:           setID,
+					AddedMembers: []string{"10.0.0.0"},
+				})
+			})
+			It("should send the current members to a profile that starts using the set", func() {
+				<-output
+				manager.OnUpdate(&proto.ActiveProfileUpdate{
+					Id:      &profID,
+					Profile: &proto.Profile{OutboundRules: []*proto.Rule{domainRule()}},
+				})
+				expectOutput(&proto.ActiveProfileUpdate{
+					Id:      &profID,
+					Profile: &proto.Profile{OutboundRules: []*proto.Rule{rewrittenRule}},
+				})
+			})
+			It("should remove the IP set after the policy", func() {
+				<-output
+				manager.OnUpdate(&proto.ActivePolicyRemove{Id: &polID})
+				expectOutput(
+					&proto.ActivePolicyRemove{Id: &polID},
+					&proto.IPSetRemove{Id: setID},
+				)
+			})
+			It("should forget the addresses when the IP set is removed", func() {
+				<-output
+				manager.OnUpdate(policyUpdate(plainRule))
+				expectOutput(policyUpdate(plainRule), &proto.IPSetRemove{Id: setID})
+				manager.OnUpdate(policyUpdate(domainRule()))
+				expectOutput(
+					&proto.IPSetUpdate{Id: setID, Members: []string{}},
+					policyUpdate(rewrittenRule),
+				)
+			})
+			It("should keep the IP set while a profile still uses it", func() {
+				<-output
+				manager.OnUpdate(&proto.ActiveProfileUpdate{
+					Id:      &profID,
+					Profile: &proto.Profile{OutboundRules: []*proto.Rule{domainRule()}},
+				})
+				<-output
+				manager.OnUpdate(&proto.ActivePolicyRemove{Id: &polID})
+				expectOutput(&proto.ActivePolicyRemove{Id: &polID})
+			})
+		})
+	})
+})
@@ -0,0 +1,33 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dnspolicy
+
+import "errors"
+
+var ErrNotSupported = errors.New("DNS policy is only supported on Linux")
+
+// Snooper reads the DNS responses that the snoop chain's NFLOG rules copy
+// to the given group and sends their Resolutions to its output channel.
+type Snooper struct {
+	group  uint16
+	output chan<- []Resolution
+}
+
+func NewSnooper(group uint16, output chan<- []Resolution) *Snooper {
+	return &Snooper{
+		group:  group,
+		output: output,
+	}
+}
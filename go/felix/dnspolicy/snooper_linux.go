@@ -0,0 +1,39 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dnspolicy
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/nfnetlink"
+)
+
+// snoopCopyRange is the number of bytes of each packet that we ask NFLOG
+// for; the largest UDP DNS response.
+const snoopCopyRange = 0xffff
+
+// Run binds the NFLOG group and then reads DNS responses until it fails.
+func (s *Snooper) Run() error {
+	return nfnetlink.ReadNflog([]uint16{s.group}, snoopCopyRange, func(pkt *nfnetlink.NflogPacket) {
+		resolutions, err := ParseDNSPacket(pkt.Payload)
+		if err != nil {
+			log.WithError(err).Debug("Ignoring snooped DNS packet")
+			return
+		}
+		if len(resolutions) == 0 {
+			return
+		}
+		s.output <- resolutions
+	})
+}
@@ -0,0 +1,321 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv3
+
+import (
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/pkg/transport"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	"golang.org/x/net/context"
+	"time"
+)
+
+const (
+	dialTimeout    = 10 * time.Second
+	requestTimeout = 10 * time.Second
+)
+
+// Config is the etcd connection configuration.
+type Config struct {
+	Endpoints []string
+	KeyFile   string
+	CertFile  string
+	CAFile    string
+}
+
+// Client is a libcalico-go backend client for etcd v3.  It stores the same
+// keys and values as libcalico-go's etcd v2 client, in the v3 keyspace.
+type Client struct {
+	etcd *clientv3.Client
+}
+
+var _ api.Client = (*Client)(nil)
+
+func NewClient(config Config) (*Client, error) {
+	etcdConfig := clientv3.Config{
+		Endpoints:   config.Endpoints,
+		DialTimeout: dialTimeout,
+	}
+	if config.CertFile != "" || config.KeyFile != "" || config.CAFile != "" {
+		tlsInfo := transport.TLSInfo{
+			CertFile:      config.CertFile,
+			KeyFile:       config.KeyFile,
+			TrustedCAFile: config.CAFile,
+		}
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		etcdConfig.TLS = tlsConfig
+	}
+	etcd, err := clientv3.New(etcdConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{etcd: etcd}, nil
+}
+
+// EnsureInitialized sets the Ready flag, if it isn't already set.
+func (c *Client) EnsureInitialized() error {
+	_, err := c.Create(&model.KVPair{Key: model.ReadyFlagKey{}, Value: true})
+	if _, ok := err.(errors.ErrorResourceAlreadyExists); ok {
+		return nil
+	}
+	return err
+}
+
+// Create creates the key, failing if it already exists.
+func (c *Client) Create(kv *model.KVPair) (*model.KVPair, error) {
+	path, value, opts, err := c.prepare(kv)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := c.etcd.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(path), "=", 0)).
+		Then(clientv3.OpPut(path, value, opts...)).
+		Commit()
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: kv.Key}
+	}
+	if !resp.Succeeded {
+		return nil, errors.ErrorResourceAlreadyExists{Identifier: kv.Key}
+	}
+	return withRevision(kv, resp.Header.Revision), nil
+}
+
+// Update updates the key, failing if it doesn't exist or, if the KVPair has
+// a Revision, if the key has been modified since that revision.
+func (c *Client) Update(kv *model.KVPair) (*model.KVPair, error) {
+	path, value, opts, err := c.prepare(kv)
+	if err != nil {
+		return nil, err
+	}
+	cmp := clientv3.Compare(clientv3.CreateRevision(path), "!=", 0)
+	if kv.Revision != nil {
+		cmp = clientv3.Compare(clientv3.ModRevision(path), "=", kv.Revision.(int64))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := c.etcd.Txn(ctx).If(cmp).Then(clientv3.OpPut(path, value, opts...)).Commit()
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: kv.Key}
+	}
+	if !resp.Succeeded {
+		if kv.Revision != nil {
+			return nil, errors.ErrorResourceUpdateConflict{Identifier: kv.Key}
+		}
+		return nil, errors.ErrorResourceDoesNotExist{Identifier: kv.Key}
+	}
+	return withRevision(kv, resp.Header.Revision), nil
+}
+
+// Apply creates or updates the key.
+func (c *Client) Apply(kv *model.KVPair) (*model.KVPair, error) {
+	path, value, opts, err := c.prepare(kv)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := c.etcd.Put(ctx, path, value, opts...)
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: kv.Key}
+	}
+	return withRevision(kv, resp.Header.Revision), nil
+}
+
+// Delete deletes the key, failing if it doesn't exist or, if the KVPair has
+// a Revision, if the key has been modified since that revision.
+func (c *Client) Delete(kv *model.KVPair) error {
+	path, err := model.KeyToDefaultPath(kv.Key)
+	if err != nil {
+		return err
+	}
+	cmp := clientv3.Compare(clientv3.CreateRevision(path), "!=", 0)
+	if kv.Revision != nil {
+		cmp = clientv3.Compare(clientv3.ModRevision(path), "=", kv.Revision.(int64))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := c.etcd.Txn(ctx).If(cmp).Then(clientv3.OpDelete(path)).Commit()
+	if err != nil {
+		return errors.ErrorDatastoreError{Err: err, Identifier: kv.Key}
+	}
+	if !resp.Succeeded {
+		if kv.Revision != nil {
+			return errors.ErrorResourceUpdateConflict{Identifier: kv.Key}
+		}
+		return errors.ErrorResourceDoesNotExist{Identifier: kv.Key}
+	}
+	return nil
+}
+
+func (c *Client) Get(key model.Key) (*model.KVPair, error) {
+	path, err := model.KeyToDefaultPath(key)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := c.etcd.Get(ctx, path)
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: key}
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, errors.ErrorResourceDoesNotExist{Identifier: key}
+	}
+	value, err := model.ParseValue(key, resp.Kvs[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	return &model.KVPair{
+		Key:      key,
+		Value:    value,
+		Revision: resp.Kvs[0].ModRevision,
+	}, nil
+}
+
+// List returns the keys that match the list options.  Keys with values that
+// fail to parse are skipped.
+func (c *Client) List(list model.ListInterface) ([]*model.KVPair, error) {
+	prefix := model.ListOptionsToDefaultPathRoot(list)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := c.etcd.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.ErrorDatastoreError{Err: err, Identifier: list}
+	}
+	kvs := []*model.KVPair{}
+	for _, etcdKV := range resp.Kvs {
+		key := list.KeyFromDefaultPath(string(etcdKV.Key))
+		if key == nil {
+			continue
+		}
+		value, err := model.ParseValue(key, etcdKV.Value)
+		if err != nil {
+			continue
+		}
+		kvs = append(kvs, &model.KVPair{
+			Key:      key,
+			Value:    value,
+			Revision: etcdKV.ModRevision,
+		})
+	}
+	return kvs, nil
+}
+
+func (c *Client) Syncer(callbacks api.SyncerCallbacks) api.Syncer {
+	return NewSyncer(NewKV(c.etcd), callbacks)
+}
+
+// prepare returns the etcd key and value for the KVPair and the options for
+// writing it, attaching a lease if the KVPair has a TTL.
+func (c *Client) prepare(kv *model.KVPair) (string, string, []clientv3.OpOption, error) {
+	path, err := model.KeyToDefaultPath(kv.Key)
+	if err != nil {
+		return "", "", nil, err
+	}
+	value, err := model.SerializeValue(kv)
+	if err != nil {
+		return "", "", nil, err
+	}
+	var opts []clientv3.OpOption
+	if kv.TTL != 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		lease, err := c.etcd.Grant(ctx, int64(kv.TTL.Seconds()))
+		if err != nil {
+			return "", "", nil, errors.ErrorDatastoreError{Err: err, Identifier: kv.Key}
+		}
+		opts = append(opts, clientv3.WithLease(lease.ID))
+	}
+	return path, string(value), opts, nil
+}
+
+func withRevision(kv *model.KVPair, revision int64) *model.KVPair {
+	kvCopy := *kv
+	kvCopy.Revision = revision
+	return &kvCopy
+}
+
+// clientKV adapts the etcd v3 client to the KV interface.
+type clientKV struct {
+	etcd *clientv3.Client
+}
+
+func NewKV(etcd *clientv3.Client) KV {
+	return &clientKV{etcd: etcd}
+}
+
+func (c *clientKV) List(ctx context.Context, prefix string) ([]KeyValue, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := c.etcd.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	kvs := make([]KeyValue, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		kvs[i] = KeyValue{
+			Key:         string(kv.Key),
+			Value:       kv.Value,
+			ModRevision: kv.ModRevision,
+		}
+	}
+	return kvs, resp.Header.Revision, nil
+}
+
+func (c *clientKV) Watch(ctx context.Context, prefix string, startRevision int64) <-chan WatchResponse {
+	out := make(chan WatchResponse)
+	go func() {
+		defer close(out)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		watchC := c.etcd.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(startRevision))
+		for etcdResp := range watchC {
+			var resp WatchResponse
+			if etcdResp.CompactRevision != 0 {
+				resp.Compacted = true
+				resp.Err = etcdResp.Err()
+			} else if err := etcdResp.Err(); err != nil {
+				resp.Err = err
+			} else {
+				for _, ev := range etcdResp.Events {
+					resp.Events = append(resp.Events, Event{
+						KeyValue: KeyValue{
+							Key:         string(ev.Kv.Key),
+							Value:       ev.Kv.Value,
+							ModRevision: ev.Kv.ModRevision,
+						},
+						Deleted: ev.Type == clientv3.EventTypeDelete,
+					})
+				}
+			}
+			select {
+			case out <- resp:
+			case <-ctx.Done():
+				return
+			}
+			if resp.Err != nil || resp.Compacted {
+				return
+			}
+		}
+	}()
+	return out
+}
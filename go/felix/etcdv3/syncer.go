@@ -0,0 +1,264 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv3
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"golang.org/x/net/context"
+	"sort"
+	"time"
+)
+
+const (
+	// calicoPrefix is the root of the keys that the Syncer watches.
+	calicoPrefix = "/calico/v1/"
+
+	// maxUpdatesPerBatch limits the size of the batches that the Syncer
+	// passes to its callbacks during a snapshot.
+	maxUpdatesPerBatch = 1000
+
+	defaultRetryInterval = time.Second
+)
+
+// KeyValue is a key in the etcd v3 store.
+type KeyValue struct {
+	Key         string
+	Value       []byte
+	ModRevision int64
+}
+
+// Event is a change to a key, as reported by a watch.
+type Event struct {
+	KeyValue
+	Deleted bool
+}
+
+// WatchResponse is a batch of events from a watch.  The watch has failed if
+// Err is set; if the failure was because the watch's start revision has
+// been compacted, Compacted is also set.
+type WatchResponse struct {
+	Events    []Event
+	Compacted bool
+	Err       error
+}
+
+// KV is the subset of the etcd v3 API that the Syncer uses.  NewKV adapts
+// the etcd client to it.
+type KV interface {
+	// List returns the keys with the given prefix and the revision of the
+	// store at which they were read.
+	List(ctx context.Context, prefix string) ([]KeyValue, int64, error)
+	// Watch watches the keys with the given prefix, from the given
+	// revision onwards.  The channel is closed after the watch fails.
+	Watch(ctx context.Context, prefix string, startRevision int64) <-chan WatchResponse
+}
+
+// Syncer implements the libcalico-go Syncer API on top of etcd v3 watches.
+//
+// It starts with a snapshot of the Calico keys and then watches from the
+// revision of the snapshot.  If the watch is interrupted, for example
+// because we lost our connection to etcd, the Syncer resumes the watch from
+// the revision after the last event that it saw, so it doesn't need to
+// re-read the whole datastore.  Only if that revision has been compacted
+// away does it take a new snapshot, which it compares with the keys that
+// it has already reported in order to send deletions for keys that were
+// removed in the meantime.
+type Syncer struct {
+	kv            KV
+	callbacks     api.SyncerCallbacks
+	retryInterval time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// modRevisions maps from etcd key to the revision of the last value
+	// that we reported for that key.
+	modRevisions map[string]int64
+	// revision is the revision of the store that we've reported up to.
+	revision int64
+}
+
+func NewSyncer(kv KV, callbacks api.SyncerCallbacks) *Syncer {
+	return NewSyncerWithRetryInterval(kv, callbacks, defaultRetryInterval)
+}
+
+// NewSyncerWithRetryInterval is a test constructor that allows for a short
+// retry interval.
+func NewSyncerWithRetryInterval(kv KV, callbacks api.SyncerCallbacks, retryInterval time.Duration) *Syncer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Syncer{
+		kv:            kv,
+		callbacks:     callbacks,
+		retryInterval: retryInterval,
+		ctx:           ctx,
+		cancel:        cancel,
+		modRevisions:  map[string]int64{},
+	}
+}
+
+func (s *Syncer) Start() {
+	go s.loop()
+}
+
+// Stop stops the Syncer's background thread.  It is only used by the tests.
+func (s *Syncer) Stop() {
+	s.cancel()
+}
+
+func (s *Syncer) loop() {
+	s.callbacks.OnStatusUpdated(api.WaitForDatastore)
+	for s.ctx.Err() == nil {
+		if !s.snapshot() {
+			continue
+		}
+		s.watch()
+	}
+}
+
+// snapshot reads all the Calico keys and reports the differences from what
+// we've already reported.  Returns false if it failed.
+func (s *Syncer) snapshot() bool {
+	kvs, revision, err := s.kv.List(s.ctx, calicoPrefix)
+	if err != nil {
+		log.WithError(err).Warn("Failed to read snapshot from etcd, will retry")
+		s.sleep()
+		return false
+	}
+	log.WithFields(log.Fields{
+		"revision": revision,
+		"numKeys":  len(kvs),
+	}).Info("Read snapshot from etcd")
+	s.callbacks.OnStatusUpdated(api.ResyncInProgress)
+
+	var updates []api.Update
+	seen := map[string]bool{}
+	for _, kv := range kvs {
+		seen[kv.Key] = true
+		if oldRev, known := s.modRevisions[kv.Key]; known && oldRev == kv.ModRevision {
+			continue
+		}
+		if update, ok := s.updateForEvent(Event{KeyValue: kv}); ok {
+			updates = append(updates, update)
+		}
+		if len(updates) >= maxUpdatesPerBatch {
+			s.callbacks.OnUpdates(updates)
+			updates = nil
+		}
+	}
+	var deletedKeys []string
+	for key := range s.modRevisions {
+		if !seen[key] {
+			deletedKeys = append(deletedKeys, key)
+		}
+	}
+	sort.Strings(deletedKeys)
+	for _, key := range deletedKeys {
+		if update, ok := s.updateForEvent(Event{KeyValue: KeyValue{Key: key}, Deleted: true}); ok {
+			updates = append(updates, update)
+		}
+	}
+	if len(updates) > 0 {
+		s.callbacks.OnUpdates(updates)
+	}
+	s.revision = revision
+	s.callbacks.OnStatusUpdated(api.InSync)
+	return true
+}
+
+// watch watches for changes after the current revision, resuming the watch
+// after transient failures.  Returns when a new snapshot is needed.
+func (s *Syncer) watch() {
+	for s.ctx.Err() == nil {
+		logCxt := log.WithField("revision", s.revision+1)
+		logCxt.Info("Starting etcd watch")
+		for resp := range s.kv.Watch(s.ctx, calicoPrefix, s.revision+1) {
+			if resp.Compacted {
+				logCxt.Warn("etcd watch revision was compacted, taking a new snapshot")
+				return
+			}
+			if resp.Err != nil {
+				logCxt.WithError(resp.Err).Warn("etcd watch failed, will resume")
+				break
+			}
+			var updates []api.Update
+			for _, event := range resp.Events {
+				if update, ok := s.updateForEvent(event); ok {
+					updates = append(updates, update)
+				}
+				if event.ModRevision > s.revision {
+					s.revision = event.ModRevision
+				}
+			}
+			if len(updates) > 0 {
+				s.callbacks.OnUpdates(updates)
+			}
+			logCxt = log.WithField("revision", s.revision+1)
+		}
+		s.sleep()
+	}
+}
+
+// updateForEvent converts an etcd event into an Update, recording the key's
+// revision.  Returns false if the key isn't one that we understand or if
+// the deletion is of a key that we never reported.
+func (s *Syncer) updateForEvent(event Event) (api.Update, bool) {
+	key := model.KeyFromDefaultPath(event.Key)
+	if key == nil {
+		log.WithField("key", event.Key).Debug("Ignoring unknown key")
+		return api.Update{}, false
+	}
+	_, known := s.modRevisions[event.Key]
+	if event.Deleted {
+		if !known {
+			return api.Update{}, false
+		}
+		delete(s.modRevisions, event.Key)
+		return api.Update{
+			KVPair:     model.KVPair{Key: key},
+			UpdateType: api.UpdateTypeKVDeleted,
+		}, true
+	}
+
+	value, err := model.ParseValue(key, event.Value)
+	if err != nil || value == nil {
+		// Matches the behaviour of the etcd v2 syncer: a bad value is
+		// treated as a deletion.
+		log.WithError(err).WithField("key", event.Key).Warn(
+			"Failed to parse value, treating as deletion")
+		return s.updateForEvent(Event{KeyValue: KeyValue{Key: event.Key}, Deleted: true})
+	}
+	s.modRevisions[event.Key] = event.ModRevision
+	updateType := api.UpdateTypeKVNew
+	if known {
+		updateType = api.UpdateTypeKVUpdated
+	}
+	return api.Update{
+		KVPair: model.KVPair{
+			Key:      key,
+			Value:    value,
+			Revision: event.ModRevision,
+		},
+		UpdateType: updateType,
+	}, true
+}
+
+func (s *Syncer) sleep() {
+	select {
+	case <-s.ctx.Done():
+	case <-time.After(s.retryInterval):
+	}
+}
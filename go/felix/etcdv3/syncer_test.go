@@ -0,0 +1,284 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdv3_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/etcdv3"
+
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Syncer", func() {
+	var (
+		kv        *mockKV
+		callbacks *mockCallbacks
+		syncer    *Syncer
+	)
+
+	configKV := func(name, value string, rev int64) KeyValue {
+		return KeyValue{Key: "/calico/v1/config/" + name, Value: []byte(value), ModRevision: rev}
+	}
+	configUpdate := func(name, value string, rev int64, updateType api.UpdateType) api.Update {
+		return api.Update{
+			KVPair: model.KVPair{
+				Key:      model.GlobalConfigKey{Name: name},
+				Value:    value,
+				Revision: rev,
+			},
+			UpdateType: updateType,
+		}
+	}
+	configDeletion := func(name string) api.Update {
+		return api.Update{
+			KVPair:     model.KVPair{Key: model.GlobalConfigKey{Name: name}},
+			UpdateType: api.UpdateTypeKVDeleted,
+		}
+	}
+
+	BeforeEach(func() {
+		kv = newMockKV()
+		kv.snapshots = []snapshot{{
+			kvs: []KeyValue{
+				configKV("A", "a1", 5),
+				configKV("B", "b1", 6),
+				{Key: "/calico/v1/unknown/key", Value: []byte("x"), ModRevision: 7},
+			},
+			revision: 10,
+		}}
+		callbacks = &mockCallbacks{}
+		syncer = NewSyncerWithRetryInterval(kv, callbacks, time.Millisecond)
+		syncer.Start()
+	})
+	AfterEach(func() {
+		syncer.Stop()
+	})
+
+	It("should send the snapshot and then watch from the next revision", func() {
+		Eventually(kv.watchRevisions).Should(Equal([]int64{11}))
+		Expect(callbacks.getStatuses()).To(Equal([]api.SyncStatus{
+			api.WaitForDatastore, api.ResyncInProgress, api.InSync,
+		}))
+		Expect(callbacks.getUpdates()).To(Equal([]api.Update{
+			configUpdate("A", "a1", 5, api.UpdateTypeKVNew),
+			configUpdate("B", "b1", 6, api.UpdateTypeKVNew),
+		}))
+	})
+
+	Describe("after the snapshot", func() {
+		BeforeEach(func() {
+			Eventually(kv.watchRevisions).Should(HaveLen(1))
+			callbacks.reset()
+		})
+
+		It("should send watch events", func() {
+			kv.send(WatchResponse{Events: []Event{
+				{KeyValue: configKV("A", "a2", 11)},
+				{KeyValue: configKV("C", "c1", 12)},
+				{KeyValue: KeyValue{Key: "/calico/v1/config/B", ModRevision: 13}, Deleted: true},
+				{KeyValue: KeyValue{Key: "/calico/v1/config/D", ModRevision: 14}, Deleted: true},
+			}})
+			Eventually(callbacks.getUpdates).Should(Equal([]api.Update{
+				configUpdate("A", "a2", 11, api.UpdateTypeKVUpdated),
+				configUpdate("C", "c1", 12, api.UpdateTypeKVNew),
+				configDeletion("B"),
+			}))
+		})
+		It("should treat a bad value as a deletion", func() {
+			kv.send(WatchResponse{Events: []Event{
+				{KeyValue: KeyValue{Key: "/calico/v1/Ready", Value: []byte("true"), ModRevision: 11}},
+				{KeyValue: KeyValue{Key: "/calico/v1/Ready", Value: []byte("bad"), ModRevision: 12}},
+			}})
+			Eventually(callbacks.getUpdates).Should(Equal([]api.Update{
+				{
+					KVPair:     model.KVPair{Key: model.ReadyFlagKey{}, Value: true, Revision: int64(11)},
+					UpdateType: api.UpdateTypeKVNew,
+				},
+				{
+					KVPair:     model.KVPair{Key: model.ReadyFlagKey{}},
+					UpdateType: api.UpdateTypeKVDeleted,
+				},
+			}))
+		})
+		It("should resume the watch after an error without a new snapshot", func() {
+			kv.send(WatchResponse{Events: []Event{{KeyValue: configKV("A", "a2", 15)}}})
+			kv.send(WatchResponse{Err: errors.New("connection lost")})
+			Eventually(kv.watchRevisions).Should(Equal([]int64{11, 16}))
+			Expect(kv.getNumLists()).To(Equal(1))
+			Expect(callbacks.getStatuses()).To(BeEmpty())
+		})
+		It("should take a new snapshot and send the differences after compaction", func() {
+			kv.setSnapshot(snapshot{
+				kvs: []KeyValue{
+					configKV("A", "a1", 5),
+					configKV("C", "c1", 20),
+					configKV("B", "b2", 21),
+				},
+				revision: 30,
+			})
+			kv.send(WatchResponse{Compacted: true, Err: errors.New("compacted")})
+			Eventually(kv.watchRevisions).Should(Equal([]int64{11, 31}))
+			Expect(kv.getNumLists()).To(Equal(2))
+			Expect(callbacks.getStatuses()).To(Equal([]api.SyncStatus{
+				api.ResyncInProgress, api.InSync,
+			}))
+			Expect(callbacks.getUpdates()).To(Equal([]api.Update{
+				configUpdate("C", "c1", 20, api.UpdateTypeKVNew),
+				configUpdate("B", "b2", 21, api.UpdateTypeKVUpdated),
+			}))
+		})
+		It("should send deletions for keys that went away during compaction", func() {
+			kv.setSnapshot(snapshot{
+				kvs:      []KeyValue{configKV("B", "b1", 6)},
+				revision: 30,
+			})
+			kv.send(WatchResponse{Compacted: true})
+			Eventually(kv.watchRevisions).Should(HaveLen(2))
+			Expect(callbacks.getUpdates()).To(Equal([]api.Update{configDeletion("A")}))
+		})
+	})
+
+	Describe("with a failing datastore", func() {
+		BeforeEach(func() {
+			syncer.Stop()
+			kv = newMockKV()
+			kv.listErrs = []error{errors.New("dial failed"), errors.New("dial failed")}
+			kv.snapshots = []snapshot{{kvs: []KeyValue{configKV("A", "a1", 5)}, revision: 10}}
+			callbacks = &mockCallbacks{}
+			syncer = NewSyncerWithRetryInterval(kv, callbacks, time.Millisecond)
+			syncer.Start()
+		})
+
+		It("should retry until it gets a snapshot", func() {
+			Eventually(kv.watchRevisions).Should(Equal([]int64{11}))
+			Expect(kv.getNumLists()).To(Equal(3))
+			Expect(callbacks.getStatuses()).To(Equal([]api.SyncStatus{
+				api.WaitForDatastore, api.ResyncInProgress, api.InSync,
+			}))
+		})
+	})
+})
+
+type snapshot struct {
+	kvs      []KeyValue
+	revision int64
+}
+
+type mockKV struct {
+	mutex     sync.Mutex
+	listErrs  []error
+	snapshots []snapshot
+	numLists  int
+	revisions []int64
+	watchC    chan WatchResponse
+}
+
+func newMockKV() *mockKV {
+	return &mockKV{}
+}
+
+func (m *mockKV) List(ctx context.Context, prefix string) ([]KeyValue, int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	Expect(prefix).To(Equal("/calico/v1/"))
+	m.numLists++
+	if len(m.listErrs) > 0 {
+		err := m.listErrs[0]
+		m.listErrs = m.listErrs[1:]
+		return nil, 0, err
+	}
+	s := m.snapshots[0]
+	return s.kvs, s.revision, nil
+}
+
+func (m *mockKV) Watch(ctx context.Context, prefix string, startRevision int64) <-chan WatchResponse {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.revisions = append(m.revisions, startRevision)
+	// Each watch ends after a failure, so a new channel is needed.
+	m.watchC = make(chan WatchResponse, 10)
+	return m.watchC
+}
+
+// send sends a response on the current watch, closing it after a failure.
+func (m *mockKV) send(resp WatchResponse) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.watchC <- resp
+	if resp.Err != nil || resp.Compacted {
+		close(m.watchC)
+	}
+}
+
+func (m *mockKV) setSnapshot(s snapshot) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.snapshots = []snapshot{s}
+}
+
+func (m *mockKV) watchRevisions() []int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]int64(nil), m.revisions...)
+}
+
+func (m *mockKV) getNumLists() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.numLists
+}
+
+type mockCallbacks struct {
+	mutex    sync.Mutex
+	statuses []api.SyncStatus
+	updates  []api.Update
+}
+
+func (c *mockCallbacks) OnStatusUpdated(status api.SyncStatus) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.statuses = append(c.statuses, status)
+}
+
+func (c *mockCallbacks) OnUpdates(updates []api.Update) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.updates = append(c.updates, updates...)
+}
+
+func (c *mockCallbacks) getStatuses() []api.SyncStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]api.SyncStatus(nil), c.statuses...)
+}
+
+func (c *mockCallbacks) getUpdates() []api.Update {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]api.Update(nil), c.updates...)
+}
+
+func (c *mockCallbacks) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.statuses = nil
+	c.updates = nil
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The extdataplane package implements the connection to an external
+// dataplane driver process.
+//
+// The driver is started as a sub-process and passed two pipes as extra file
+// descriptors: FD 3 carries messages from Felix to the driver and FD 4 carries
+// messages back from the driver to Felix.  Each message is a protobuf
+// (proto.ToDataplane or proto.FromDataplane) preceded by its length, encoded
+// as an 8-byte little-endian integer.
+package extdataplane
+
+import (
+	"encoding/binary"
+	log "github.com/Sirupsen/logrus"
+	pb "github.com/gogo/protobuf/proto"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// StartExtDataplaneDriver starts the given external dataplane driver and
+// returns a connection to it, along with the driver's Cmd, which can be
+// used to monitor and stop the process.
+func StartExtDataplaneDriver(driverFilename string) (*ExtDataplaneConn, *exec.Cmd) {
+	// Create a pair of pipes, one for sending messages to the dataplane
+	// driver, the other for receiving.
+	toDriverR, toDriverW, err := os.Pipe()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to open pipe for dataplane driver")
+	}
+	fromDriverR, fromDriverW, err := os.Pipe()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to open pipe for dataplane driver")
+	}
+
+	cmd := exec.Command(driverFilename)
+	driverOut, err := cmd.StdoutPipe()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create pipe for dataplane driver")
+	}
+	driverErr, err := cmd.StderrPipe()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create pipe for dataplane driver")
+	}
+	go io.Copy(os.Stdout, driverOut)
+	go io.Copy(os.Stderr, driverErr)
+	cmd.ExtraFiles = []*os.File{toDriverR, fromDriverW}
+	if err := cmd.Start(); err != nil {
+		log.WithError(err).Fatal("Failed to start dataplane driver")
+	}
+
+	// Now the sub-process is running, close our copy of the file handles
+	// for the child's end of the pipes.
+	if err := toDriverR.Close(); err != nil {
+		cmd.Process.Kill()
+		log.WithError(err).Fatal("Failed to close parent's copy of pipe")
+	}
+	if err := fromDriverW.Close(); err != nil {
+		cmd.Process.Kill()
+		log.WithError(err).Fatal("Failed to close parent's copy of pipe")
+	}
+
+	return NewExtDataplaneConn(toDriverW, fromDriverR), cmd
+}
+
+// ExtDataplaneConn sends and receives length-prefixed protobuf messages
+// to/from an external dataplane driver.
+type ExtDataplaneConn struct {
+	toDataplane   io.Writer
+	fromDataplane io.Reader
+	nextSeqNumber uint64
+}
+
+func NewExtDataplaneConn(toDataplane io.Writer, fromDataplane io.Reader) *ExtDataplaneConn {
+	return &ExtDataplaneConn{
+		toDataplane:   toDataplane,
+		fromDataplane: fromDataplane,
+	}
+}
+
+// RecvMessage blocks until it reads the next message from the driver, then
+// returns the message, unwrapped from its proto.FromDataplane envelope.
+func (fc *ExtDataplaneConn) RecvMessage() (msg interface{}, err error) {
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(fc.fromDataplane, buf)
+	if err != nil {
+		return
+	}
+	length := binary.LittleEndian.Uint64(buf)
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(fc.fromDataplane, data)
+	if err != nil {
+		return
+	}
+
+	envelope := proto.FromDataplane{}
+	err = pb.Unmarshal(data, &envelope)
+	if err != nil {
+		return
+	}
+	log.WithField("envelope", envelope).Debug("Received message from dataplane.")
+
+	switch payload := envelope.Payload.(type) {
+	case *proto.FromDataplane_ProcessStatusUpdate:
+		msg = payload.ProcessStatusUpdate
+	case *proto.FromDataplane_WorkloadEndpointStatusUpdate:
+		msg = payload.WorkloadEndpointStatusUpdate
+	case *proto.FromDataplane_WorkloadEndpointStatusRemove:
+		msg = payload.WorkloadEndpointStatusRemove
+	case *proto.FromDataplane_HostEndpointStatusUpdate:
+		msg = payload.HostEndpointStatusUpdate
+	case *proto.FromDataplane_HostEndpointStatusRemove:
+		msg = payload.HostEndpointStatusRemove
+	default:
+		log.WithField("payload", payload).Warn("Ignoring unknown message from dataplane")
+	}
+	return
+}
+
+// SendMessage wraps the given message in a proto.ToDataplane envelope and
+// writes it to the driver.
+func (fc *ExtDataplaneConn) SendMessage(msg interface{}) error {
+	log.Debugf("Writing msg (%v) to dataplane driver: %#v", fc.nextSeqNumber, msg)
+
+	envelope := &proto.ToDataplane{
+		SequenceNumber: fc.nextSeqNumber,
+	}
+	fc.nextSeqNumber += 1
+	switch msg := msg.(type) {
+	case *proto.ConfigUpdate:
+		envelope.Payload = &proto.ToDataplane_ConfigUpdate{msg}
+	case *proto.InSync:
+		envelope.Payload = &proto.ToDataplane_InSync{msg}
+	case *proto.IPSetUpdate:
+		envelope.Payload = &proto.ToDataplane_IpsetUpdate{msg}
+	case *proto.IPSetDeltaUpdate:
+		envelope.Payload = &proto.ToDataplane_IpsetDeltaUpdate{msg}
+	case *proto.IPSetRemove:
+		envelope.Payload = &proto.ToDataplane_IpsetRemove{msg}
+	case *proto.ActivePolicyUpdate:
+		envelope.Payload = &proto.ToDataplane_ActivePolicyUpdate{msg}
+	case *proto.ActivePolicyRemove:
+		envelope.Payload = &proto.ToDataplane_ActivePolicyRemove{msg}
+	case *proto.ActiveProfileUpdate:
+		envelope.Payload = &proto.ToDataplane_ActiveProfileUpdate{msg}
+	case *proto.ActiveProfileRemove:
+		envelope.Payload = &proto.ToDataplane_ActiveProfileRemove{msg}
+	case *proto.HostEndpointUpdate:
+		envelope.Payload = &proto.ToDataplane_HostEndpointUpdate{msg}
+	case *proto.HostEndpointRemove:
+		envelope.Payload = &proto.ToDataplane_HostEndpointRemove{msg}
+	case *proto.WorkloadEndpointUpdate:
+		envelope.Payload = &proto.ToDataplane_WorkloadEndpointUpdate{msg}
+	case *proto.WorkloadEndpointRemove:
+		envelope.Payload = &proto.ToDataplane_WorkloadEndpointRemove{msg}
+	case *proto.HostMetadataUpdate:
+		envelope.Payload = &proto.ToDataplane_HostMetadataUpdate{msg}
+	case *proto.HostMetadataRemove:
+		envelope.Payload = &proto.ToDataplane_HostMetadataRemove{msg}
+	case *proto.IPAMPoolUpdate:
+		envelope.Payload = &proto.ToDataplane_IpamPoolUpdate{msg}
+	case *proto.IPAMPoolRemove:
+		envelope.Payload = &proto.ToDataplane_IpamPoolRemove{msg}
+	default:
+		log.WithField("msg", msg).Panic("Unknown message type")
+	}
+	data, err := pb.Marshal(envelope)
+	if err != nil {
+		log.WithError(err).WithField("msg", msg).Panic(
+			"Failed to marshal data to front end")
+	}
+
+	lengthBuffer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(lengthBuffer, uint64(len(data)))
+
+	numBytes, err := fc.toDataplane.Write(lengthBuffer)
+	if err != nil || numBytes != len(lengthBuffer) {
+		log.WithError(err).WithField("bytesWritten", numBytes).Error(
+			"Failed to write to dataplane driver")
+		return shortWriteErr(err)
+	}
+	numBytes, err = fc.toDataplane.Write(data)
+	if err != nil || numBytes != len(data) {
+		log.WithError(err).WithField("bytesWritten", numBytes).Error(
+			"Failed to write to dataplane driver")
+		return shortWriteErr(err)
+	}
+	return nil
+}
+
+func shortWriteErr(err error) error {
+	if err == nil {
+		return io.ErrShortWrite
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extdataplane_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/extdataplane"
+
+	"bytes"
+	"encoding/binary"
+	"errors"
+	pb "github.com/gogo/protobuf/proto"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"io"
+)
+
+var _ = Describe("ExtDataplaneConn", func() {
+	var toDataplane, fromDataplane *bytes.Buffer
+	var conn *ExtDataplaneConn
+
+	BeforeEach(func() {
+		toDataplane = &bytes.Buffer{}
+		fromDataplane = &bytes.Buffer{}
+		conn = NewExtDataplaneConn(toDataplane, fromDataplane)
+	})
+
+	// readEnvelope decodes the next length-prefixed message written by
+	// the connection.
+	readEnvelope := func() *proto.ToDataplane {
+		var length uint64
+		Expect(binary.Read(toDataplane, binary.LittleEndian, &length)).To(Succeed())
+		data := make([]byte, length)
+		_, err := io.ReadFull(toDataplane, data)
+		Expect(err).NotTo(HaveOccurred())
+		envelope := &proto.ToDataplane{}
+		Expect(pb.Unmarshal(data, envelope)).To(Succeed())
+		return envelope
+	}
+
+	// writeEnvelope writes a length-prefixed message as the driver would.
+	writeEnvelope := func(envelope *proto.FromDataplane) {
+		data, err := pb.Marshal(envelope)
+		Expect(err).NotTo(HaveOccurred())
+		binary.Write(fromDataplane, binary.LittleEndian, uint64(len(data)))
+		fromDataplane.Write(data)
+	}
+
+	It("should wrap sent messages with sequence numbers", func() {
+		Expect(conn.SendMessage(&proto.InSync{})).To(Succeed())
+		Expect(conn.SendMessage(&proto.IPSetRemove{Id: "foo"})).To(Succeed())
+
+		envelope := readEnvelope()
+		Expect(envelope.SequenceNumber).To(Equal(uint64(0)))
+		Expect(envelope.Payload).To(Equal(&proto.ToDataplane_InSync{&proto.InSync{}}))
+		envelope = readEnvelope()
+		Expect(envelope.SequenceNumber).To(Equal(uint64(1)))
+		Expect(envelope.Payload).To(Equal(&proto.ToDataplane_IpsetRemove{
+			&proto.IPSetRemove{Id: "foo"},
+		}))
+		Expect(toDataplane.Len()).To(BeZero())
+	})
+	It("should panic on an unknown message type", func() {
+		Expect(func() { conn.SendMessage("foo") }).To(Panic())
+	})
+	It("should return write errors", func() {
+		conn = NewExtDataplaneConn(failingWriter{}, fromDataplane)
+		Expect(conn.SendMessage(&proto.InSync{})).To(HaveOccurred())
+	})
+	It("should unwrap received messages", func() {
+		update := &proto.WorkloadEndpointStatusUpdate{
+			Id: &proto.WorkloadEndpointID{
+				OrchestratorId: "orch",
+				WorkloadId:     "wl",
+				EndpointId:     "ep",
+			},
+			Status: &proto.EndpointStatus{Status: "up"},
+		}
+		writeEnvelope(&proto.FromDataplane{
+			SequenceNumber: 10,
+			Payload:        &proto.FromDataplane_WorkloadEndpointStatusUpdate{update},
+		})
+		msg, err := conn.RecvMessage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg).To(Equal(update))
+	})
+	It("should return EOF when the driver closes its end", func() {
+		_, err := conn.RecvMessage()
+		Expect(err).To(Equal(io.EOF))
+	})
+	It("should return an error on a truncated message", func() {
+		binary.Write(fromDataplane, binary.LittleEndian, uint64(100))
+		fromDataplane.Write([]byte{1, 2, 3})
+		_, err := conn.RecvMessage()
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("pipe closed")
+}
@@ -15,31 +15,61 @@
 package main
 
 import (
-	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/docopt/docopt-go"
-	pb "github.com/gogo/protobuf/proto"
+	"github.com/projectcalico/felix/go/felix/audit"
 	"github.com/projectcalico/felix/go/felix/buildinfo"
 	"github.com/projectcalico/felix/go/felix/calc"
+	"github.com/projectcalico/felix/go/felix/capture"
+	"github.com/projectcalico/felix/go/felix/check"
+	"github.com/projectcalico/felix/go/felix/collector"
 	"github.com/projectcalico/felix/go/felix/config"
 	_ "github.com/projectcalico/felix/go/felix/config"
+	"github.com/projectcalico/felix/go/felix/convergence"
+	"github.com/projectcalico/felix/go/felix/ctmonitor"
+	"github.com/projectcalico/felix/go/felix/dataplane"
+	"github.com/projectcalico/felix/go/felix/debugserver"
+	"github.com/projectcalico/felix/go/felix/dnspolicy"
+	"github.com/projectcalico/felix/go/felix/etcdv3"
+	"github.com/projectcalico/felix/go/felix/health"
+	"github.com/projectcalico/felix/go/felix/hostdataplane"
 	"github.com/projectcalico/felix/go/felix/ip"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/k8swatch"
 	"github.com/projectcalico/felix/go/felix/logutils"
+	"github.com/projectcalico/felix/go/felix/markbits"
+	"github.com/projectcalico/felix/go/felix/nfacct"
+	"github.com/projectcalico/felix/go/felix/policyrouting"
+	"github.com/projectcalico/felix/go/felix/policysync"
+	"github.com/projectcalico/felix/go/felix/portscan"
+	"github.com/projectcalico/felix/go/felix/priority"
 	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/renderdataplane"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"github.com/projectcalico/felix/go/felix/services"
+	"github.com/projectcalico/felix/go/felix/snapshot"
+	"github.com/projectcalico/felix/go/felix/statecache"
 	"github.com/projectcalico/felix/go/felix/statusrep"
+	"github.com/projectcalico/felix/go/felix/supervisor"
+	"github.com/projectcalico/felix/go/felix/syncclient"
+	"github.com/projectcalico/felix/go/felix/threatfeed"
+	"github.com/projectcalico/felix/go/felix/throttle"
+	"github.com/projectcalico/felix/go/felix/trace"
 	"github.com/projectcalico/felix/go/felix/usagerep"
+	"github.com/projectcalico/felix/go/felix/watchdog"
 	"github.com/projectcalico/libcalico-go/lib/backend"
 	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"io"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"reflect"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -48,10 +78,33 @@ const usage = `Felix, the Calico per-host daemon.
 
 Usage:
   calico-felix [-c <config>]
+  calico-felix dump-state [--json] [--debug-server-addr=<addr>]
+  calico-felix check [--ipv6] [--debug-server-addr=<addr>]
+  calico-felix explain <name> [--json] [--debug-server-addr=<addr>]
+  calico-felix graph [--endpoint=<iface>] [--json] [--debug-server-addr=<addr>]
+  calico-felix decode-trace [<log-file>] [--json] [--debug-server-addr=<addr>]
 
 Options:
-  -c --config-file=<config>  Config file to load [default: /etc/calico/felix.cfg].
-  --version                  Print the version and exit.
+  -c --config-file=<config>    Config file to load [default: /etc/calico/felix.cfg].
+  --json                       Print the output as JSON.
+  --ipv6                       Also check the IPv6 state.
+  --endpoint=<iface>           Only graph the chains of this workload interface.
+  --debug-server-addr=<addr>   Debug server to query [default: 127.0.0.1:6060].
+  --version                    Print the version and exit.
+
+The dump-state command prints the chains, IP sets and routes that a running
+Felix intends to program.  The check command compares them with the live
+state of the kernel and prints any discrepancies; it exits with status 1 if
+it finds any and 2 if it fails to read the state.  The explain command maps
+a chain name, rule hash or NFLOG prefix, as seen in iptables-save or the
+kernel log, back to the endpoint, policy or profile that it came from; it
+exits with status 1 if the name isn't recognised.  The graph command prints
+the graph of jumps between the chains, in Graphviz's DOT language by default;
+for example, pipe it to "dot -Tsvg".  The decode-trace command reads the
+kernel log lines written by the TRACE rules that the debug server's
+/debug/trace endpoint inserts, from the file or from stdin, and prints the
+endpoint, policy or profile of each chain that the packet passed through.
+These commands require that Felix's debug server is enabled.
 `
 
 // main is the entry point to the calico-felix binary.
@@ -71,7 +124,8 @@ Options:
 // Starting the background processing goroutines, which load and keep in sync with the
 // state from the datastore, the "calculation graph".
 //
-// Starting the usage reporting and prometheus metrics endpoint threads (if configured).
+// Starting the usage reporting, health and prometheus metrics endpoint threads (if
+// configured).
 //
 // Then, it defers to monitorAndManageShutdown(), which blocks until one of the components
 // fails, then attempts a graceful shutdown.  At that point, all the processing is in
@@ -79,7 +133,8 @@ Options:
 //
 // To avoid having to maintain rarely-used code paths, Felix handles updates to its
 // main config parameters by exiting and allowing itself to be restarted by the init
-// daemon.
+// daemon.  Only a few "live" parameters, such as the log levels, are updated on the
+// fly.
 func main() {
 	// Special-case handling for environment variable-configured logging:
 	// Initialise early so we can trace out config parsing.
@@ -94,6 +149,27 @@ func main() {
 		println(usage)
 		log.Fatalf("Failed to parse usage, exiting: %v", err)
 	}
+	if arguments["dump-state"] == true {
+		dumpState(arguments["--debug-server-addr"].(string), arguments["--json"] == true)
+		return
+	}
+	if arguments["check"] == true {
+		os.Exit(checkState(arguments["--debug-server-addr"].(string), arguments["--ipv6"] == true))
+	}
+	if arguments["graph"] == true {
+		endpoint, _ := arguments["--endpoint"].(string)
+		graphChains(arguments["--debug-server-addr"].(string), endpoint, arguments["--json"] == true)
+		return
+	}
+	if arguments["explain"] == true {
+		os.Exit(explainName(arguments["--debug-server-addr"].(string),
+			arguments["<name>"].(string), arguments["--json"] == true))
+	}
+	if arguments["decode-trace"] == true {
+		logFile, _ := arguments["<log-file>"].(string)
+		os.Exit(decodeTrace(arguments["--debug-server-addr"].(string), logFile,
+			arguments["--json"] == true))
+	}
 	buildInfoLogCxt := log.WithFields(log.Fields{
 		"version":   buildinfo.GitVersion,
 		"buildDate": buildinfo.BuildDate,
@@ -141,8 +217,7 @@ configRetry:
 
 		// We should now have enough config to connect to the datastore
 		// so we can load the remainder of the config.
-		datastoreConfig := configParams.DatastoreConfig()
-		datastore, err = backend.NewClient(datastoreConfig)
+		datastore, err = newDatastoreClient(configParams)
 		if err != nil {
 			log.WithError(err).Error("Failed to connect to datastore")
 			time.Sleep(1 * time.Second)
@@ -170,49 +245,151 @@ configRetry:
 	buildInfoLogCxt.WithField("config", configParams).Info(
 		"Successfully loaded configuration.")
 
-	// Create a pair of pipes, one for sending messages to the dataplane
-	// driver, the other for receiving.
-	toDriverR, toDriverW, err := os.Pipe()
-	if err != nil {
-		log.WithError(err).Fatal("Failed to open pipe for dataplane driver")
-	}
-	fromDriverR, fromDriverW, err := os.Pipe()
-	if err != nil {
-		log.WithError(err).Fatal("Failed to open pipe for dataplane driver")
+	// Background threads report fatal failures on this channel, which
+	// triggers a graceful shutdown.
+	failureReportChan := make(chan string)
+
+	// If health reporting is enabled, the subsystems report their health to
+	// the aggregator, which serves the liveness and readiness endpoints.
+	var healthAggregator *health.HealthAggregator
+	if configParams.HealthEnabled {
+		log.WithField("port", configParams.HealthPort).Info(
+			"Health enabled.  Starting server.")
+		healthAggregator = health.NewHealthAggregator()
+		go func() {
+			err := healthAggregator.ListenAndServe(configParams.HealthPort)
+			log.WithError(err).Error("Health endpoint failed")
+			failureReportChan <- "health endpoint failed"
+		}()
 	}
 
-	cmd := exec.Command(configParams.DataplaneDriver)
-	driverOut, err := cmd.StdoutPipe()
-	if err != nil {
-		log.WithError(err).Fatal("Failed to create pipe for dataplane driver")
+	// If the watchdog is enabled, the long-running loops check in with it
+	// so that it can tell if one of them gets wedged.
+	var loopWatchdog *watchdog.Watchdog
+	if configParams.WatchdogEnabled {
+		log.WithField("timeoutSecs", configParams.WatchdogTimeoutSecs).Info(
+			"Watchdog enabled.")
+		var onWedged func(name string)
+		if configParams.WatchdogExitOnWedge {
+			onWedged = func(name string) {
+				failureReportChan <- name + " wedged"
+			}
+		}
+		loopWatchdog = watchdog.New(watchdog.Config{OnWedged: onWedged}, healthAggregator)
+		loopWatchdog.Start()
 	}
-	driverErr, err := cmd.StderrPipe()
-	if err != nil {
-		log.WithError(err).Fatal("Failed to create pipe for dataplane driver")
+	registerLoop := func(name string) *watchdog.Loop {
+		if loopWatchdog == nil {
+			return nil
+		}
+		return loopWatchdog.Register(name,
+			time.Duration(configParams.WatchdogTimeoutSecs)*time.Second)
 	}
-	go io.Copy(os.Stdout, driverOut)
-	go io.Copy(os.Stderr, driverErr)
-	cmd.ExtraFiles = []*os.File{toDriverR, fromDriverW}
-	if err := cmd.Start(); err != nil {
-		log.WithError(err).Fatal("Failed to start dataplane driver")
+
+	// The supervisor restarts the optional subsystems, such as the port
+	// scan monitor, if they fail, rather than shutting Felix down.
+	subsystems := supervisor.New(supervisor.Config{
+		MaxRestarts: configParams.SubsystemMaxRestarts,
+		OnGiveUp: func(name string, err error) {
+			failureReportChan <- name + " failed"
+		},
+	}, healthAggregator)
+
+	// If the state cache is enabled, state that is expensive to work out is
+	// reused from the last run, if it's still valid.
+	var stateCache *statecache.Cache
+	if configParams.StateCacheFile != "" {
+		stateCache = statecache.Open(statecache.Config{
+			Path:         configParams.StateCacheFile,
+			FelixVersion: buildinfo.GitVersion,
+		})
 	}
 
-	// Now the sub-process is running, close our copy of the file handles
-	// for the child's end of the pipes.
-	if err := toDriverR.Close(); err != nil {
-		cmd.Process.Kill()
-		log.WithError(err).Fatal("Failed to close parent's copy of pipe")
+	// The rule renderer renders the chains that we program in Go, and
+	// those that the debug server and render-only mode report.
+	ruleRenderer := newRuleRenderer(configParams, detectFeatures(stateCache))
+
+	// The convergence tracker records the datastore revision that the
+	// dataplane is in sync with.
+	convergenceTracker := convergence.NewTracker()
+
+	var debugServer *debugserver.Server
+	var debugState *debugserver.DataplaneState
+	if configParams.DebugServerEnabled || configParams.DebugStateSocket != "" {
+		debugState = debugserver.NewDataplaneState(ruleRenderer)
+		debugState.SetRouteAggregation(newRouteAggregation(configParams))
 	}
-	if err := fromDriverW.Close(); err != nil {
-		cmd.Process.Kill()
-		log.WithError(err).Fatal("Failed to close parent's copy of pipe")
+	if configParams.DebugStateSocket != "" {
+		socketServer := debugserver.NewSocketServer(debugState)
+		go func() {
+			err := socketServer.ListenAndServe(configParams.DebugStateSocket)
+			log.WithError(err).Error("State socket failed")
+			failureReportChan <- "state socket failed"
+		}()
+	}
+	if configParams.DebugServerEnabled {
+		debugServer = debugserver.New(debugState)
+		debugServer.EnableCapture(capture.New(capture.Config{
+			Dir:         configParams.DebugCaptureDir,
+			MaxDuration: time.Duration(configParams.DebugCaptureMaxSecs) * time.Second,
+		}))
+		debugServer.EnableTrace(trace.New(
+			time.Duration(configParams.DebugTraceMaxSecs) * time.Second))
+		debugServer.EnableConvergence(convergenceTracker)
+		go func() {
+			err := debugServer.ListenAndServe(configParams.DebugServerAddr)
+			log.WithError(err).Error("Debug server failed")
+			failureReportChan <- "debug server failed"
+		}()
+	}
+
+	// Start up the dataplane driver or, in render-only mode, the driver
+	// that writes the state to files instead.
+	var dpDriver dataplane.DataplaneDriver
+	var dpDriverCmd *exec.Cmd
+	if configParams.RenderOnlyDir != "" {
+		log.WithField("dir", configParams.RenderOnlyDir).Info(
+			"Render-only mode, writing the dataplane state to files.")
+		renderDP := renderdataplane.NewRenderOnlyDataplane(
+			ruleRenderer,
+			renderdataplane.Config{
+				Dir:               configParams.RenderOnlyDir,
+				IPv6Enabled:       configParams.Ipv6Support,
+				RouteAggregation:  newRouteAggregation(configParams),
+				ReportingInterval: time.Duration(configParams.ReportingIntervalSecs) * time.Second,
+			},
+		)
+		renderDP.Start()
+		dpDriver = renderDP
+	} else {
+		log.Info("Starting the dataplane driver.")
+		dpDriver, dpDriverCmd = dataplane.StartDataplaneDriver(
+			configParams,
+			ruleRenderer,
+			newPolicyRouting(configParams),
+			newServices(configParams, ruleRenderer),
+			healthAggregator,
+		)
 	}
 
 	// Create the connection to/from the dataplane driver.
 	log.Info("Connect to the dataplane driver.")
-	failureReportChan := make(chan string)
-	felixConn := NewDataplaneConn(configParams,
-		datastore, toDriverW, fromDriverR, failureReportChan)
+	dpConnector := newConnector(configParams, datastore, dpDriver, failureReportChan, healthAggregator)
+	dpConnector.debugState = debugState
+	dpConnector.convergenceTracker = convergenceTracker
+	dpConnector.watchdogLoop = registerLoop("dataplane_connector")
+
+	// If the audit trail is enabled, record the changes to IP sets and
+	// routes that we send to the dataplane driver.
+	var auditLog *audit.Log
+	if configParams.AuditLogFile != "" || configParams.AuditLogSyslogEnabled {
+		log.Info("Audit trail enabled")
+		var err error
+		if auditLog, err = newAuditLog(configParams); err != nil {
+			log.WithError(err).Fatal("Failed to start audit trail")
+		}
+		dpConnector.auditor = audit.NewUpdateAuditor(auditLog)
+	}
 
 	// Now create the calculation graph, which receives updates from the
 	// datastore and outputs dataplane updates for the dataplane driver.
@@ -223,19 +400,74 @@ configRetry:
 	// The output of the calculation graph arrives at the dataplane
 	// connection via channel.
 	//
-	// Syncer -chan-> Validator -chan-> Calc graph -chan-> felixConn
+	// Syncer -chan-> Validator -chan-> Calc graph -chan-> dpConnector
 	//        KVPair            KVPair             protobufs
 
-	// Get a Syncer from the datastore, which will feed the calculation
-	// graph with updates, bringing Felix into sync..
+	// Get a Syncer from the datastore, or from the sync proxy if one is
+	// configured, which will feed the calculation graph with updates,
+	// bringing Felix into sync..
 	syncerToValidator := calc.NewSyncerCallbacksDecoupler()
-	syncer := datastore.Syncer(syncerToValidator)
+	syncerToValidator.WatchdogLoop = registerLoop("syncer")
+	var syncer bapi.Syncer
+	if syncProxyAddrs := configParams.SyncProxyAddrList(); len(syncProxyAddrs) > 0 {
+		log.WithField("addrs", syncProxyAddrs).Info(
+			"Sync proxy configured, getting updates from the proxy")
+		syncer = syncclient.New(
+			syncProxyAddrs,
+			configParams.FelixHostname,
+			buildinfo.GitVersion,
+			"felix",
+			syncerToValidator,
+			nil,
+		)
+	} else {
+		syncer = datastore.Syncer(syncerToValidator)
+	}
 	log.Debugf("Created Syncer: %#v", syncer)
 
+	if configParams.PortScanInterfaces != "" {
+		log.Info("Port scan banning enabled, starting port scan monitor")
+		startPortScanMonitor(configParams, subsystems)
+	}
+
+	if configParams.ThreatFeeds != "" {
+		log.Info("Threat feeds configured, starting threat feed client")
+		startThreatFeedClient(configParams, healthAggregator)
+	}
+
+	if configParams.NfacctClasses != "" {
+		log.Info("Traffic classes configured, starting nfacct accounting")
+		startNfacctAccounting(configParams, subsystems)
+	}
+
+	if configParams.ConntrackMonitorEnabled {
+		log.Info("Conntrack monitoring enabled, starting conntrack monitor")
+		startConntrackMonitor(configParams, subsystems)
+	}
+
+	// If DNS policy is enabled, the DNS policy manager sits between the
+	// calculation graph and the dpConnector, replacing the domain names in
+	// rules with IP sets.
+	calcGraphOutput := dpConnector.ToDataplane
+	if configParams.DNSPolicyEnabled {
+		log.Info("DNS policy enabled, starting DNS policy manager")
+		calcGraphOutput = startDNSPolicyManager(configParams, dpConnector.ToDataplane, subsystems)
+		if debugServer != nil {
+			dnsPolicyInput := calcGraphOutput
+			debugServer.RegisterQueue("dns_policy_manager", func() int {
+				return len(dnsPolicyInput)
+			})
+		}
+	}
+
 	// Create the ipsets/active policy calculation graph, which will
 	// do the dynamic calculation of ipset memberships and active policies
 	// etc.
-	asyncCalcGraph := calc.NewAsyncCalcGraph(configParams, felixConn.ToDataplane)
+	asyncCalcGraph := calc.NewAsyncCalcGraph(configParams, calcGraphOutput, healthAggregator)
+	asyncCalcGraph.WatchdogLoop = registerLoop("calc_graph")
+	if debugServer != nil {
+		debugServer.RegisterQueue("calc_graph", asyncCalcGraph.QueueLen)
+	}
 
 	if configParams.UsageReportingEnabled {
 		// Usage reporting enabled, add stats collector to graph and
@@ -262,35 +494,97 @@ configRetry:
 	// Create the validator, which sits between the syncer and the
 	// calculation graph.
 	validator := calc.NewValidationFilter(asyncCalcGraph)
+	var syncerOutput bapi.SyncerCallbacks = validator
+	if auditLog != nil {
+		// Stamp the audit records with the datastore revision.
+		syncerOutput = &auditRevisionRecorder{
+			SyncerCallbacks: validator,
+			auditLog:        auditLog,
+		}
+	}
+
+	// If the snapshot is enabled, the recorder keeps a copy of the
+	// datastore state so that, after a restart, we can start programming
+	// the dataplane before the Syncer is in sync.
+	var snapshotRecorder *snapshot.Recorder
+	if configParams.SnapshotFile != "" {
+		snapshotRecorder = snapshot.New(snapshot.Config{
+			Path:         configParams.SnapshotFile,
+			Hostname:     configParams.FelixHostname,
+			FelixVersion: buildinfo.GitVersion,
+			MaxAge:       time.Duration(configParams.SnapshotMaxAgeSecs) * time.Second,
+			SaveInterval: time.Duration(configParams.SnapshotSaveIntervalSecs) * time.Second,
+		}, syncerOutput)
+		syncerOutput = snapshotRecorder
+	}
 
-	// Start the background processing threads.
+	// Start the background processing threads.  The snapshot is replayed
+	// before we start passing on the Syncer's updates, which queue up in
+	// the meantime.
 	log.Infof("Starting the datastore Syncer/processing graph")
 	syncer.Start()
-	go syncerToValidator.SendTo(validator)
 	asyncCalcGraph.Start()
+	if snapshotRecorder != nil {
+		snapshotRecorder.Replay()
+	}
+	go syncerToValidator.SendTo(syncerOutput)
 	log.Infof("Started the datastore Syncer/processing graph")
 	var stopSignalChans []chan<- bool
-	if configParams.EndpointReportingEnabled {
+	if configParams.EndpointReportingEnabled && configParams.DatastoreType == "kubernetes" {
+		// The Kubernetes datastore has nowhere to store endpoint status;
+		// the orchestrator reports on pods itself.
+		log.Warning("Endpoint status reporting isn't supported by the " +
+			"kubernetes datastore, ignoring EndpointReportingEnabled")
+	} else if configParams.EndpointReportingEnabled {
 		delay := configParams.EndpointReportingDelay()
 		log.WithField("delay", delay).Info(
 			"Endpoint status reporting enabled, starting status reporter")
-		felixConn.statusReporter = statusrep.NewEndpointStatusReporter(
+		dpConnector.statusReporter = statusrep.NewEndpointStatusReporter(
 			configParams.FelixHostname,
-			felixConn.StatusUpdatesFromDataplane,
-			felixConn.InSync,
-			felixConn.datastore,
+			dpConnector.StatusUpdatesFromDataplane,
+			dpConnector.InSync,
+			dpConnector.datastore,
 			delay,
 			delay*180,
 		)
-		felixConn.statusReporter.Start()
+		dpConnector.statusReporter.Start()
+	}
+
+	if configParams.PolicySyncSocket != "" {
+		// Policy sync enabled, start the processor, which receives a
+		// copy of the dataplane updates, and the gRPC server that
+		// co-located agents connect to.
+		log.WithField("socket", configParams.PolicySyncSocket).Info(
+			"Policy sync API enabled, starting server")
+		policySyncProcessor := policysync.NewProcessor()
+		policySyncServer := policysync.NewServer(policySyncProcessor.JoinUpdates)
+		policySyncProcessor.Start()
+		go func() {
+			err := policySyncServer.ListenAndServe(configParams.PolicySyncSocket)
+			log.WithError(err).Error("Policy sync server failed")
+			failureReportChan <- "policy sync server failed"
+		}()
+		dpConnector.policySyncUpdates = policySyncProcessor.Updates
+		if debugServer != nil {
+			debugServer.RegisterQueue("policy_sync", func() int {
+				return len(policySyncProcessor.Updates)
+			})
+		}
+	}
+
+	if configParams.FlowLogsEnabled {
+		log.Info("Flow logs enabled, starting collector")
+		if err := startFlowLogCollector(configParams, subsystems); err != nil {
+			log.WithError(err).Fatal("Failed to start flow log collector")
+		}
 	}
 
 	// Start communicating with the dataplane driver.
-	felixConn.Start()
+	dpConnector.Start()
 
 	// Send the opening message to the dataplane driver, giving it its
 	// config.
-	felixConn.ToDataplane <- &proto.ConfigUpdate{
+	dpConnector.ToDataplane <- &proto.ConfigUpdate{
 		Config: configParams.RawValues(),
 	}
 
@@ -301,7 +595,419 @@ configRetry:
 
 	// Now monitor the worker process and our worker threads and shut
 	// down the process gracefully if they fail.
-	monitorAndManageShutdown(failureReportChan, cmd, stopSignalChans)
+	monitorAndManageShutdown(failureReportChan, dpDriverCmd, stopSignalChans,
+		func() { teardownDataplane(configParams, auditLog) })
+}
+
+// teardownDataplane removes our iptables chains, as configured by
+// ShutdownTeardownMode.  It must only be called once the dataplane driver
+// has stopped, otherwise the driver would put the chains straight back.
+func teardownDataplane(configParams *config.Config, auditLog *audit.Log) {
+	if configParams.ShutdownTeardownMode == "none" || configParams.RenderOnlyDir != "" {
+		return
+	}
+	removeInsertions := configParams.ShutdownTeardownMode == "all"
+	ipVersions := []uint8{4}
+	if configParams.Ipv6Support {
+		ipVersions = append(ipVersions, 6)
+	}
+	for _, ipVersion := range ipVersions {
+		for _, tableName := range []string{"raw", "mangle", "nat", "filter"} {
+			table := iptables.NewTable(tableName, ipVersion, iptables.TableOptions{
+				ChainNamePrefix: rules.ChainNamePrefix,
+				AuditLog:        auditLog,
+			})
+			if err := table.Teardown(removeInsertions); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"table":     tableName,
+					"ipVersion": ipVersion,
+				}).Error("Failed to tear down iptables chains")
+			}
+		}
+	}
+}
+
+// flowLogsIdleTimeout is the time after which the flow log collector
+// forgets an allowed flow that it hasn't heard about.  Conntrack normally
+// tells us when a flow ends; this only matters if we miss the event.
+const flowLogsIdleTimeout = time.Hour
+
+// startFlowLogCollector starts the flow log collector, with the configured
+// sinks, and the background threads that feed it from netlink.
+func startFlowLogCollector(configParams *config.Config, subsystems *supervisor.Supervisor) error {
+	var sinks []collector.Sink
+	if configParams.FlowLogsFile != "" {
+		sinks = append(sinks, collector.NewFileSink(configParams.FlowLogsFile))
+	}
+	if configParams.FlowLogsSyslogEnabled {
+		sink, err := collector.NewSyslogSink()
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, sink)
+	}
+	if configParams.FlowLogsCollectorAddr != "" {
+		sink, err := collector.NewGRPCSink(configParams.FlowLogsCollectorAddr, configParams.FelixHostname)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	flowCollector := collector.New(collector.Config{
+		FlushInterval: configParams.FlowLogsFlushInterval(),
+		MaxFlows:      configParams.FlowLogsMaxFlows,
+		IdleTimeout:   flowLogsIdleTimeout,
+	}, sinks...)
+	flowCollector.Start()
+
+	nflogReader := collector.NewNflogReader(
+		[]uint16{rules.NflogInboundGroup, rules.NflogOutboundGroup},
+		flowCollector.PacketInfoC,
+	)
+	subsystems.Go("NFLOG reader", nflogReader.Run)
+	conntrackReader := collector.NewConntrackReader(flowCollector.ConntrackInfoC)
+	subsystems.Go("conntrack event reader", conntrackReader.Run)
+	return nil
+}
+
+func newAuditLog(configParams *config.Config) (*audit.Log, error) {
+	var sinks []audit.Sink
+	if configParams.AuditLogFile != "" {
+		sinks = append(sinks, audit.NewFileSink(configParams.AuditLogFile))
+	}
+	if configParams.AuditLogSyslogEnabled {
+		sink, err := audit.NewSyslogSink()
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return audit.New(sinks...), nil
+}
+
+// auditRevisionRecorder passes updates from the Syncer through, recording
+// the latest datastore revision in the audit log.  The calculation graph
+// runs asynchronously, so the revision that is recorded with a change may
+// be slightly newer than the update that caused it.
+type auditRevisionRecorder struct {
+	bapi.SyncerCallbacks
+	auditLog *audit.Log
+}
+
+func (r *auditRevisionRecorder) OnUpdates(updates []bapi.Update) {
+	for i := len(updates) - 1; i >= 0; i-- {
+		if updates[i].Revision != nil {
+			r.auditLog.SetRevision(fmt.Sprint(updates[i].Revision))
+			break
+		}
+	}
+	r.SyncerCallbacks.OnUpdates(updates)
+}
+
+// dnsPolicyExpiryInterval is how often the DNS policy manager removes
+// expired addresses from its IP sets.
+const dnsPolicyExpiryInterval = time.Second
+
+// startDNSPolicyManager starts the DNS policy manager, which sends its output
+// to the dataplane, and the background thread that feeds it with snooped DNS
+// responses.  Returns the manager's input channel.
+func startDNSPolicyManager(
+	configParams *config.Config,
+	toDataplane chan<- interface{},
+	subsystems *supervisor.Supervisor,
+) chan interface{} {
+	manager := dnspolicy.NewManager(toDataplane, dnspolicy.Config{
+		MinTTL:         configParams.DNSPolicyMinTTL(),
+		MaxIPSetSize:   configParams.MaxIpsetSize,
+		ExpiryInterval: dnsPolicyExpiryInterval,
+	})
+	manager.Start()
+
+	snooper := dnspolicy.NewSnooper(rules.NflogDNSGroup, manager.ResolutionsC)
+	subsystems.Go("DNS snooper", snooper.Run)
+	return manager.Input
+}
+
+// portScanPollInterval is how often the port scan monitor checks its IP
+// sets for newly-banned sources.
+const portScanPollInterval = 10 * time.Second
+
+// startPortScanMonitor starts the background thread that creates the port
+// scan IP sets and reports ban events.
+func startPortScanMonitor(configParams *config.Config, subsystems *supervisor.Supervisor) {
+	ipVersions := []uint8{4}
+	if configParams.Ipv6Support {
+		ipVersions = append(ipVersions, 6)
+	}
+	monitor := portscan.New(portscan.Config{
+		IPVersions:       ipVersions,
+		BanTime:          time.Duration(configParams.PortScanBanSecs) * time.Second,
+		MaxBannedSources: configParams.MaxIpsetSize,
+		PollInterval:     portScanPollInterval,
+	})
+	subsystems.Go("port scan monitor", monitor.Run)
+}
+
+// startThreatFeedClient starts the background thread that keeps the threat
+// feed IP sets up to date.
+func startThreatFeedClient(configParams *config.Config, healthAggregator *health.HealthAggregator) {
+	ipVersions := []uint8{4}
+	if configParams.Ipv6Support {
+		ipVersions = append(ipVersions, 6)
+	}
+	var feeds []threatfeed.Feed
+	names, sources := configParams.ThreatFeedSpecs()
+	for i, name := range names {
+		// The sources were checked by Config.Validate().
+		source, err := threatfeed.NewSource(sources[i])
+		if err != nil {
+			log.WithError(err).WithField("feed", name).Panic(
+				"Invalid threat feed source")
+		}
+		feeds = append(feeds, threatfeed.Feed{Name: name, Source: source})
+	}
+	client := threatfeed.New(threatfeed.Config{
+		Feeds:           feeds,
+		IPVersions:      ipVersions,
+		RefreshInterval: time.Duration(configParams.ThreatFeedRefreshSecs) * time.Second,
+		MaxEntries:      configParams.ThreatFeedMaxEntries,
+	}, healthAggregator)
+	go client.Run()
+}
+
+// startNfacctAccounting starts the background thread that creates the
+// traffic classes' nfacct objects and exports their counts.
+func startNfacctAccounting(configParams *config.Config, subsystems *supervisor.Supervisor) {
+	var objNames []string
+	for _, class := range nfacctClasses(configParams) {
+		objNames = append(objNames, class.NfacctObjectName())
+	}
+	accounting := nfacct.New(objNames)
+	subsystems.Go("nfacct accounting", func() error {
+		return accounting.Run(time.Duration(configParams.NfacctPollSecs) * time.Second)
+	})
+}
+
+// startConntrackMonitor starts the background thread that exports the
+// conntrack table's stats.
+func startConntrackMonitor(configParams *config.Config, subsystems *supervisor.Supervisor) {
+	monitor := ctmonitor.New(ctmonitor.Config{
+		PollInterval:            time.Duration(configParams.ConntrackMonitorPollSecs) * time.Second,
+		WarningThresholdPercent: configParams.ConntrackWarningThresholdPercent,
+		MaxEntries:              uint32(configParams.ConntrackMaxEntries),
+	})
+	subsystems.Go("conntrack monitor", monitor.Run)
+}
+
+func nfacctClasses(configParams *config.Config) []rules.NfacctClass {
+	var classes []rules.NfacctClass
+	names, cidrs := configParams.NfacctClassSpecs()
+	for i, name := range names {
+		classes = append(classes, rules.NfacctClass{Name: name, CIDR: cidrs[i]})
+	}
+	return classes
+}
+
+// detectFeatures works out which iptables features the dataplane supports.
+// If there's a state cache, it uses the cached features, if there are any,
+// and caches them otherwise.
+func detectFeatures(stateCache *statecache.Cache) *iptables.Features {
+	detect := iptables.NewFeatureDetector().GetFeatures
+	if stateCache == nil {
+		return detect()
+	}
+	features := stateCache.Features(detect)
+	if err := stateCache.Save(); err != nil {
+		log.WithError(err).Warn("Failed to save state cache")
+	}
+	return features
+}
+
+// newRouteAggregation returns the aggregation of the routes to local
+// workloads that the config asks for.
+func newRouteAggregation(configParams *config.Config) debugserver.RouteAggregation {
+	return debugserver.RouteAggregation{
+		Threshold:   configParams.RouteAggregationThreshold,
+		BlockSizeV4: configParams.RouteAggregationBlockSizeV4,
+		BlockSizeV6: configParams.RouteAggregationBlockSizeV6,
+	}
+}
+
+// newRuleRenderer creates a rule renderer that matches the configuration of
+// the dataplane driver and the features of the dataplane.  Like the driver,
+// it uses the least significant bit of the mark mask for the accept mark and
+// the next one for the next-tier mark.  The driver uses the next bit for its
+// endpoint mark and, if there's one left, the bit after for its IPVS mark, so
+// those are skipped.  If the verdict cache is enabled, the driver uses the
+// next two bits for its connmarks, which we need to know to invalidate them.
+// The masquerade mark, which marks hairpin traffic to services, gets the bit
+// after that, if there is one.
+func newRuleRenderer(configParams *config.Config, features *iptables.Features) rules.RuleRenderer {
+	markBits := markbits.NewAllocator(configParams.IptablesMarkMask)
+	if markBits.AvailableBits() < config.MinIptablesMarkBits {
+		log.WithField("mask", configParams.IptablesMarkMask).Fatal(
+			"Not enough mark bits in IptablesMarkMask")
+	}
+	markAccept, _ := markBits.NextSingleBitMark()
+	markNextTier, _ := markBits.NextSingleBitMark()
+	// The driver's endpoint and IPVS marks.  The driver's chains set and
+	// clear them, so sharing them would corrupt our marks.
+	markBits.NextSingleBitMark()
+	markBits.NextSingleBitMark()
+	var markVerdictCacheIn, markVerdictCacheOut uint32
+	if configParams.VerdictCacheEnabled {
+		markVerdictCacheIn, _ = markBits.NextSingleBitMark()
+		markVerdictCacheOut, _ = markBits.NextSingleBitMark()
+		if markVerdictCacheIn == 0 || markVerdictCacheOut == 0 {
+			log.WithField("mask", configParams.IptablesMarkMask).Warn(
+				"Not enough mark bits left for the verdict cache; verdicts " +
+					"won't be cached")
+			markVerdictCacheIn, markVerdictCacheOut = 0, 0
+		}
+	}
+	markMasq, ok := markBits.NextSingleBitMark()
+	if !ok {
+		log.WithField("mask", configParams.IptablesMarkMask).Warn(
+			"No mark bit left for the masquerade mark; hairpin traffic to " +
+				"services won't be masqueraded")
+	}
+	var markEgressGateway uint32
+	if configParams.EgressGatewayRole == rules.EgressGatewayRoleClient {
+		var ok bool
+		markEgressGateway, ok = markBits.NextSingleBitMark()
+		if !ok {
+			log.WithField("mask", configParams.IptablesMarkMask).Warn(
+				"No mark bit left for the egress gateway; traffic won't be " +
+					"steered to it")
+		}
+	}
+	var markDSR uint32
+	if configParams.ServiceDSREnabled {
+		var numBits int
+		markDSR, numBits = markBits.NextBlockBitsMark(markBits.AvailableBits())
+		if numBits == 0 {
+			log.WithField("mask", configParams.IptablesMarkMask).Warn(
+				"No mark bits left for DSR; DSR disabled")
+		} else {
+			log.WithFields(log.Fields{
+				"mark":     markDSR,
+				"maxHosts": markbits.MaxNumber(markDSR),
+			}).Info("Allocated DSR mark field")
+		}
+	}
+	var nat64Prefix string
+	if configParams.NAT64Enabled {
+		nat64Prefix = configParams.NAT64Prefix
+	}
+	synproxyEnabled := configParams.SynFloodSynproxyEnabled
+	if synproxyEnabled {
+		if err := features.Require(iptables.FeatureSYNPROXY); err != nil {
+			log.WithError(err).Warn("SYN floods will only be rate limited")
+			synproxyEnabled = false
+		}
+	}
+	var synFloodInterfaces []string
+	if configParams.SynFloodProtectionInterfaces != "" {
+		synFloodInterfaces = strings.Split(configParams.SynFloodProtectionInterfaces, ",")
+	}
+	var portScanInterfaces []string
+	if configParams.PortScanInterfaces != "" {
+		portScanInterfaces = strings.Split(configParams.PortScanInterfaces, ",")
+	}
+	threatFeedNames, _ := configParams.ThreatFeedSpecs()
+	var nodePortRanges []rules.PortRange
+	if configParams.KubeProxyReplacementEnabled {
+		nodePortRanges = []rules.PortRange{{
+			Min: uint16(configParams.KubeNodePortRangeMin),
+			Max: uint16(configParams.KubeNodePortRangeMax),
+		}}
+	}
+	var egressGatewayAddr string
+	if configParams.EgressGatewayAddr != nil {
+		egressGatewayAddr = configParams.EgressGatewayAddr.String()
+	}
+	return rules.NewRenderer(rules.Config{
+		WorkloadIfacePrefixes:       strings.Split(configParams.InterfacePrefix, ","),
+		IptablesMarkAccept:          markAccept,
+		IptablesMarkNextTier:        markNextTier,
+		IptablesMarkMasq:            markMasq,
+		IptablesMarkDSR:             markDSR,
+		DSRRouteTableBase:           configParams.ServiceDSRRouteTableBase,
+		NAT64Prefix:                 nat64Prefix,
+		NAT64IPv4Pool:               configParams.NAT64IPv4Pool,
+		NAT64Device:                 configParams.NAT64Device,
+		EgressGatewayRole:           configParams.EgressGatewayRole,
+		IptablesMarkEgressGateway:   markEgressGateway,
+		EgressGatewayAddr:           egressGatewayAddr,
+		EgressGatewaySourceCIDRs:    configParams.EgressGatewaySourceCIDRs,
+		EgressGatewayExcludedCIDRs:  configParams.EgressGatewayExcludedCIDRs,
+		EgressGatewayRouteTable:     configParams.EgressGatewayRouteTable,
+		ConntrackBypassEnabled:      configParams.ConntrackBypassEnabled,
+		AntiSpoofingEnabled:         configParams.AntiSpoofingEnabled,
+		IptablesMarkVerdictCacheIn:  markVerdictCacheIn,
+		IptablesMarkVerdictCacheOut: markVerdictCacheOut,
+		FlowLogsEnabled:             configParams.FlowLogsEnabled,
+		DNSTrustedServers:           configParams.DNSTrustedServers,
+		NodePortRanges:              nodePortRanges,
+		SynFloodInterfaces:          synFloodInterfaces,
+		SynFloodRateLimit:           uint32(configParams.SynFloodRateLimit),
+		SynFloodBurst:               uint32(configParams.SynFloodBurst),
+		SynproxyEnabled:             synproxyEnabled,
+		PortScanInterfaces:          portScanInterfaces,
+		PortScanRateLimit:           uint32(configParams.PortScanRateLimit),
+		PortScanBurst:               uint32(configParams.PortScanBurst),
+		PortScanBanSecs:             uint32(configParams.PortScanBanSecs),
+		ThreatFeedNames:             threatFeedNames,
+		NfacctClasses:               nfacctClasses(configParams),
+	})
+}
+
+// newPolicyRouting creates the policy routing manager if a feature that
+// routes marked traffic, DSR or the egress gateway's clients, is enabled.
+// Otherwise it returns nil and we leave the routing rules alone, since the
+// manager owns every rule with its priority and would clean them up.
+func newPolicyRouting(configParams *config.Config) *policyrouting.Manager {
+	if !configParams.ServiceDSREnabled &&
+		configParams.EgressGatewayRole != rules.EgressGatewayRoleClient {
+		return nil
+	}
+	// Both features are IPv4-only.
+	return policyrouting.New(policyrouting.Config{IPVersion: 4})
+}
+
+// newServices starts watching the Kubernetes services if Felix programs
+// them in place of kube-proxy, and returns the host dataplane's config for
+// them.  Otherwise it returns nil.
+func newServices(configParams *config.Config, renderer rules.RuleRenderer) *hostdataplane.Services {
+	if !configParams.KubeProxyReplacementEnabled {
+		if configParams.ServiceDSREnabled {
+			log.Warn("DSR needs KubeProxyReplacementEnabled, leaving it disabled")
+		}
+		return nil
+	}
+	watcher, err := k8swatch.New(k8swatch.Config{
+		Kubeconfig:     configParams.KubeconfigFile,
+		K8sAPIEndpoint: configParams.K8sAPIEndpoint,
+		K8sKeyFile:     configParams.K8sKeyFile,
+		K8sCertFile:    configParams.K8sCertFile,
+		K8sCAFile:      configParams.K8sCAFile,
+		K8sAPIToken:    configParams.K8sAPIToken,
+	})
+	if err != nil {
+		log.WithError(err).Fatal("Failed to connect to the Kubernetes API to watch services")
+	}
+	watcher.Start()
+	return &hostdataplane.Services{
+		Updates: watcher.Updates(),
+		NewManager: func(ipVersion uint8, natTable, filterTable services.Table) hostdataplane.ServiceManager {
+			return services.NewManager(ipVersion, renderer, natTable, filterTable)
+		},
+		// DSR needs the policy routing, which newPolicyRouting creates.
+		// The endpoints' node names are matched against the hostnames.
+		DSREnabled: configParams.ServiceDSREnabled,
+		Hostname:   configParams.FelixHostname,
+	}
 }
 
 func servePrometheusMetrics(port int) {
@@ -315,7 +1021,15 @@ func servePrometheusMetrics(port int) {
 	}
 }
 
-func monitorAndManageShutdown(failureReportChan <-chan string, driverCmd *exec.Cmd, stopSignalChans []chan<- bool) {
+// monitorAndManageShutdown blocks until Felix needs to stop and then stops the
+// driver and exits.  teardown is only called when Felix is stopped by a
+// signal, after the driver has stopped.
+func monitorAndManageShutdown(
+	failureReportChan <-chan string,
+	driverCmd *exec.Cmd,
+	stopSignalChans []chan<- bool,
+	teardown func(),
+) {
 	// Ask the runtime to tell us if we get a term signal.
 	termSignalChan := make(chan os.Signal)
 	signal.Notify(termSignalChan, syscall.SIGTERM)
@@ -324,12 +1038,15 @@ func monitorAndManageShutdown(failureReportChan <-chan string, driverCmd *exec.C
 	// If the driver stops unexpectedly, we'll terminate this process.
 	// If this process needs to stop, we'll kill the driver and then wait
 	// for the message from the background thread.
+	// An in-process driver has no Cmd; it stops when we do.
 	driverStoppedC := make(chan bool)
-	go func() {
-		err := driverCmd.Wait()
-		log.WithError(err).Warn("Driver process stopped")
-		driverStoppedC <- true
-	}()
+	if driverCmd != nil {
+		go func() {
+			err := driverCmd.Wait()
+			log.WithError(err).Warn("Driver process stopped")
+			driverStoppedC <- true
+		}()
+	}
 
 	// Wait for one of the channels to give us a reason to shut down.
 	driverAlreadyStopped := false
@@ -354,7 +1071,7 @@ func monitorAndManageShutdown(failureReportChan <-chan string, driverCmd *exec.C
 		}
 	}
 
-	if !driverAlreadyStopped {
+	if driverCmd != nil && !driverAlreadyStopped {
 		// Driver may still be running, just in case the driver is
 		// unresponsive, start a thread to kill this process if we
 		// don't manage to kill the driver.
@@ -379,7 +1096,9 @@ func monitorAndManageShutdown(failureReportChan <-chan string, driverCmd *exec.C
 		}
 	}
 
-	if !receivedSignal {
+	if receivedSignal {
+		teardown()
+	} else {
 		// We're exiting due to a failure or a config change, wait
 		// a couple of seconds to ensure that we don't go into a tight
 		// restart loop (which would make the init daemon give up trying
@@ -399,6 +1118,20 @@ func monitorAndManageShutdown(failureReportChan <-chan string, driverCmd *exec.C
 	syscall.Exit(1)
 }
 
+// newDatastoreClient connects to the configured datastore.  The etcd v3
+// client is our own; the others come from libcalico-go.
+func newDatastoreClient(configParams *config.Config) (bapi.Client, error) {
+	if configParams.DatastoreType == "etcdv3" {
+		return etcdv3.NewClient(etcdv3.Config{
+			Endpoints: configParams.EtcdEndpointURLs(),
+			KeyFile:   configParams.EtcdKeyFile,
+			CertFile:  configParams.EtcdCertFile,
+			CAFile:    configParams.EtcdCaFile,
+		})
+	}
+	return backend.NewClient(configParams.DatastoreConfig())
+}
+
 func loadConfigFromDatastore(datastore bapi.Client, hostname string) (globalConfig, hostConfig map[string]string) {
 	for {
 		log.Info("Waiting for the datastore to be ready")
@@ -446,105 +1179,266 @@ func loadConfigFromDatastore(datastore bapi.Client, hostname string) (globalConf
 	return globalConfig, hostConfig
 }
 
+// dumpState prints the intended dataplane state of a running Felix, which
+// it gets from Felix's debug server.
+func dumpState(debugServerAddr string, asJSON bool) {
+	dump, err := debugserver.FetchState(debugServerAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to query the debug server at %v "+
+			"(is DebugServerEnabled set?): %v\n", debugServerAddr, err)
+		os.Exit(1)
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(dump, "", "  ")
+		if err != nil {
+			log.WithError(err).Fatal("Failed to marshal state")
+		}
+		os.Stdout.Write(data)
+		os.Stdout.Write([]byte("\n"))
+		return
+	}
+	if err := dump.WriteText(os.Stdout); err != nil {
+		log.WithError(err).Fatal("Failed to write state")
+	}
+}
+
+// checkState compares the live state of the kernel with the intended state
+// of a running Felix and prints any discrepancies.  It returns the exit code
+// for the check command.
+func checkState(debugServerAddr string, ipv6 bool) int {
+	dump, err := debugserver.FetchState(debugServerAddr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to query the debug server at %v "+
+			"(is DebugServerEnabled set?): %v\n", debugServerAddr, err)
+		return 2
+	}
+	discrepancies, err := check.New(check.Config{IPv6: ipv6}).Check(dump)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the live state: %v\n", err)
+		return 2
+	}
+	for _, d := range discrepancies {
+		fmt.Println(d)
+	}
+	if len(discrepancies) > 0 {
+		fmt.Printf("Found %d discrepancies.\n", len(discrepancies))
+		return 1
+	}
+	fmt.Println("Live state matches intent.")
+	return 0
+}
+
+// explainName prints what a name seen in the dataplane refers to, according
+// to a running Felix.  It returns the exit code for the explain command.
+func explainName(debugServerAddr, name string, asJSON bool) int {
+	explanations, err := debugserver.FetchExplanations(debugServerAddr, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to query the debug server at %v "+
+			"(is DebugServerEnabled set?): %v\n", debugServerAddr, err)
+		return 2
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(explanations, "", "  ")
+		if err != nil {
+			log.WithError(err).Fatal("Failed to marshal explanations")
+		}
+		os.Stdout.Write(data)
+		os.Stdout.Write([]byte("\n"))
+	} else {
+		for _, e := range explanations {
+			fmt.Println(e)
+		}
+	}
+	if len(explanations) == 0 {
+		fmt.Fprintf(os.Stderr, "%q doesn't match any chain, rule or NFLOG prefix "+
+			"that Felix intends to program.\n", name)
+		return 1
+	}
+	return 0
+}
+
+// decodeTrace prints the chains that the TRACE events in a kernel log
+// passed through, explained by a running Felix.  It reads the log from
+// stdin if logFile is empty.  It returns the exit code for the
+// decode-trace command.
+func decodeTrace(debugServerAddr, logFile string, asJSON bool) int {
+	input := os.Stdin
+	if logFile != "" {
+		f, err := os.Open(logFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open %v: %v\n", logFile, err)
+			return 2
+		}
+		defer f.Close()
+		input = f
+	}
+	events, err := trace.ReadEvents(input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the kernel log: %v\n", err)
+		return 2
+	}
+	steps, err := debugserver.FetchTraceExplanations(debugServerAddr, events)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to query the debug server at %v "+
+			"(is DebugServerEnabled set?): %v\n", debugServerAddr, err)
+		return 2
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(steps, "", "  ")
+		if err != nil {
+			log.WithError(err).Fatal("Failed to marshal trace")
+		}
+		os.Stdout.Write(data)
+		os.Stdout.Write([]byte("\n"))
+	} else {
+		for _, step := range steps {
+			fmt.Println(step)
+		}
+	}
+	if len(steps) == 0 {
+		fmt.Fprintln(os.Stderr, "No TRACE lines found.")
+		return 1
+	}
+	return 0
+}
+
+// graphChains prints the graph of the intended chains of a running Felix.
+func graphChains(debugServerAddr, ifaceName string, asJSON bool) {
+	graph, err := debugserver.FetchChainGraph(debugServerAddr, ifaceName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to query the debug server at %v "+
+			"(is DebugServerEnabled set?): %v\n", debugServerAddr, err)
+		os.Exit(1)
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(graph, "", "  ")
+		if err != nil {
+			log.WithError(err).Fatal("Failed to marshal graph")
+		}
+		os.Stdout.Write(data)
+		os.Stdout.Write([]byte("\n"))
+		return
+	}
+	if err := graph.WriteDot(os.Stdout); err != nil {
+		log.WithError(err).Fatal("Failed to write graph")
+	}
+}
+
 type ipUpdate struct {
 	ipset string
 	ip    ip.Addr
 }
 
-type DataplaneConn struct {
+const dataplaneHealthName = "dataplane"
+
+// DataplaneConnector connects the calculation graph to the dataplane driver.
+// It forwards updates from the calculation graph to the driver and handles
+// the status reports that the driver sends back.
+type DataplaneConnector struct {
 	config                     *config.Config
 	ToDataplane                chan interface{}
 	StatusUpdatesFromDataplane chan interface{}
 	InSync                     chan bool
 	failureReportChan          chan<- string
-	felixReader                io.Reader
-	felixWriter                io.Writer
+	dataplane                  dataplane.DataplaneDriver
 	datastore                  bapi.Client
 	statusReporter             *statusrep.EndpointStatusReporter
+	policySyncUpdates          chan<- interface{}
+	debugState                 *debugserver.DataplaneState
+	watchdogLoop               *watchdog.Loop
+	auditor                    *audit.UpdateAuditor
+	healthAggregator           *health.HealthAggregator
+	convergenceTracker         *convergence.Tracker
 
 	datastoreInSync bool
+	// lastConfig is the config from the last ConfigUpdate that we sent to
+	// the dataplane driver.
+	lastConfig map[string]string
+	// pendingMarker is the latest revision marker from before the
+	// datastore was in sync, which only takes effect once the driver has
+	// been sent the InSync message.
+	pendingMarker *convergence.RevisionMarker
 
 	firstStatusReportSent bool
-	nextSeqNumber         uint64
 }
 
 type Startable interface {
 	Start()
 }
 
-func NewDataplaneConn(configParams *config.Config,
+func newConnector(configParams *config.Config,
 	datastore bapi.Client,
-	toDriver io.Writer,
-	fromDriver io.Reader,
-	failureReportChan chan<- string) *DataplaneConn {
-	felixConn := &DataplaneConn{
+	dpDriver dataplane.DataplaneDriver,
+	failureReportChan chan<- string,
+	healthAggregator *health.HealthAggregator) *DataplaneConnector {
+	felixConn := &DataplaneConnector{
 		config:                     configParams,
 		datastore:                  datastore,
 		ToDataplane:                make(chan interface{}),
 		StatusUpdatesFromDataplane: make(chan interface{}),
-		InSync:            make(chan bool, 1),
-		failureReportChan: failureReportChan,
-		felixReader:       fromDriver,
-		felixWriter:       toDriver,
+		InSync:                     make(chan bool, 1),
+		failureReportChan:          failureReportChan,
+		dataplane:                  dpDriver,
+	}
+	if healthAggregator != nil && configParams.ReportingIntervalSecs > 0 {
+		// The dataplane driver sends a status report every reporting
+		// interval; use those as its health reports.  Allow for the
+		// driver's jitter by waiting for two intervals.
+		healthAggregator.RegisterReporter(dataplaneHealthName, &health.HealthReport{
+			Live:  true,
+			Ready: true,
+		}, 2*time.Duration(configParams.ReportingIntervalSecs)*time.Second)
+		felixConn.healthAggregator = healthAggregator
 	}
 	return felixConn
 }
 
-func (fc *DataplaneConn) readMessagesFromDataplane() {
+func (fc *DataplaneConnector) readMessagesFromDataplane() {
 	defer func() {
 		fc.shutDownProcess("Failed to read messages from dataplane")
 	}()
-	log.Info("Reading from dataplane driver pipe...")
+	log.Info("Reading from dataplane driver...")
 	for {
-		buf := make([]byte, 8)
-		_, err := io.ReadFull(fc.felixReader, buf)
+		payload, err := fc.dataplane.RecvMessage()
 		if err != nil {
 			log.WithError(err).Error("Failed to read from front-end socket")
 			fc.shutDownProcess("Failed to read from front-end socket")
 		}
-		length := binary.LittleEndian.Uint64(buf)
-
-		data := make([]byte, length)
-		_, err = io.ReadFull(fc.felixReader, data)
-		if err != nil {
-			log.WithError(err).Error("Failed to read from front-end socket")
-			fc.shutDownProcess("Failed to read from front-end socket")
-		}
-
-		msg := proto.FromDataplane{}
-		pb.Unmarshal(data, &msg)
-
-		log.Debugf("Message from Felix: %#v", msg.Payload)
-
-		payload := msg.Payload
+		log.WithField("payload", payload).Debug("New message from dataplane")
 		switch msg := payload.(type) {
-		case *proto.FromDataplane_ProcessStatusUpdate:
-			fc.handleProcessStatusUpdate(msg.ProcessStatusUpdate)
-		case *proto.FromDataplane_WorkloadEndpointStatusUpdate:
+		case *proto.ProcessStatusUpdate:
+			fc.handleProcessStatusUpdate(msg)
+		case *proto.WorkloadEndpointStatusUpdate:
 			if fc.statusReporter != nil {
-				fc.StatusUpdatesFromDataplane <- msg.WorkloadEndpointStatusUpdate
+				fc.StatusUpdatesFromDataplane <- msg
 			}
-		case *proto.FromDataplane_WorkloadEndpointStatusRemove:
+		case *proto.WorkloadEndpointStatusRemove:
 			if fc.statusReporter != nil {
-				fc.StatusUpdatesFromDataplane <- msg.WorkloadEndpointStatusRemove
+				fc.StatusUpdatesFromDataplane <- msg
 			}
-		case *proto.FromDataplane_HostEndpointStatusUpdate:
+		case *proto.HostEndpointStatusUpdate:
 			if fc.statusReporter != nil {
-				fc.StatusUpdatesFromDataplane <- msg.HostEndpointStatusUpdate
+				fc.StatusUpdatesFromDataplane <- msg
 			}
-		case *proto.FromDataplane_HostEndpointStatusRemove:
+		case *proto.HostEndpointStatusRemove:
 			if fc.statusReporter != nil {
-				fc.StatusUpdatesFromDataplane <- msg.HostEndpointStatusRemove
+				fc.StatusUpdatesFromDataplane <- msg
 			}
 		default:
-			log.Warningf("XXXX Unknown message from felix: %#v", msg)
+			log.WithField("msg", msg).Warning("Unknown message from dataplane")
 		}
 		log.Debug("Finished handling message from front-end")
 	}
 }
 
-func (fc *DataplaneConn) handleProcessStatusUpdate(msg *proto.ProcessStatusUpdate) {
+func (fc *DataplaneConnector) handleProcessStatusUpdate(msg *proto.ProcessStatusUpdate) {
 	log.Debugf("Status update from dataplane driver: %v", *msg)
+	if fc.healthAggregator != nil {
+		fc.healthAggregator.Report(dataplaneHealthName, &health.HealthReport{
+			Live:  true,
+			Ready: true,
+		})
+	}
 	statusReport := model.StatusReport{
 		Timestamp:     msg.IsoTimestamp,
 		UptimeSeconds: msg.Uptime,
@@ -571,46 +1465,129 @@ func (fc *DataplaneConn) handleProcessStatusUpdate(msg *proto.ProcessStatusUpdat
 	}
 }
 
-func (fc *DataplaneConn) sendMessagesToDataplaneDriver() {
+func (fc *DataplaneConnector) sendMessagesToDataplaneDriver() {
 	defer func() {
 		fc.shutDownProcess("Failed to send messages to dataplane")
 	}()
 
-	var config map[string]string
+	// If prioritization is enabled, the updates that the limiter lets
+	// through are queued so that updates that revoke access overtake bulk
+	// churn while the driver is busy; a second thread writes them out.
+	output := fc.sendMessageToDataplaneDriver
+	if fc.config.DataplaneUpdatePrioritization {
+		queue := priority.New(priority.Config{})
+		go fc.sendQueuedMessagesToDataplaneDriver(queue)
+		output = queue.Push
+	}
+
+	// The limiter holds back, and coalesces, the updates of any endpoint
+	// or IP set that is churning; we poll it for held updates that are due.
+	limiter := throttle.New(throttle.Config{
+		Rate:  fc.config.DataplaneUpdateRateLimit,
+		Burst: fc.config.DataplaneUpdateBurst,
+	}, output)
+	var releaseTimer *time.Timer
+	var releaseC <-chan time.Time
+	var idleTicks <-chan time.Time
+	if interval := fc.watchdogLoop.IdleInterval(); interval > 0 {
+		idleTicks = time.Tick(interval)
+	}
 	for {
-		msg := <-fc.ToDataplane
-		switch msg := msg.(type) {
-		case *proto.InSync:
-			log.Info("Datastore now in sync.")
-			if !fc.datastoreInSync {
-				fc.datastoreInSync = true
-				fc.InSync <- true
-			}
-		case *proto.ConfigUpdate:
-			logCxt := log.WithFields(log.Fields{
-				"old": config,
-				"new": msg.Config,
-			})
-			logCxt.Info("Possible config update")
-			if config != nil && !reflect.DeepEqual(msg.Config, config) {
+		select {
+		case msg := <-fc.ToDataplane:
+			limiter.OnUpdate(msg, time.Now())
+		case <-releaseC:
+			limiter.Flush(time.Now())
+		case <-idleTicks:
+		}
+		fc.watchdogLoop.CheckIn()
+		if releaseTimer != nil {
+			releaseTimer.Stop()
+			releaseTimer, releaseC = nil, nil
+		}
+		if next, ok := limiter.NextRelease(); ok {
+			releaseTimer = time.NewTimer(next.Sub(time.Now()))
+			releaseC = releaseTimer.C
+		}
+	}
+}
+
+func (fc *DataplaneConnector) sendQueuedMessagesToDataplaneDriver(queue *priority.Queue) {
+	defer func() {
+		fc.shutDownProcess("Failed to send messages to dataplane")
+	}()
+	for {
+		fc.sendMessageToDataplaneDriver(queue.Pop())
+	}
+}
+
+func (fc *DataplaneConnector) sendMessageToDataplaneDriver(msg interface{}) {
+	switch msg := msg.(type) {
+	case *convergence.RevisionMarker:
+		// Markers aren't for the driver; everything ahead of the marker
+		// has now been sent, so the dataplane has caught up with its
+		// revision.  The driver doesn't program anything until it's
+		// in sync, so hold on to the marker until then.
+		if !fc.datastoreInSync {
+			fc.pendingMarker = msg
+		} else if fc.convergenceTracker != nil {
+			fc.convergenceTracker.OnMarker(msg, time.Now())
+		}
+		return
+	case *proto.InSync:
+		log.Info("Datastore now in sync.")
+		if !fc.datastoreInSync {
+			fc.datastoreInSync = true
+			fc.InSync <- true
+		}
+	case *proto.ConfigUpdate:
+		logCxt := log.WithFields(log.Fields{
+			"old": fc.lastConfig,
+			"new": msg.Config,
+		})
+		logCxt.Info("Possible config update")
+		if fc.lastConfig != nil && !reflect.DeepEqual(msg.Config, fc.lastConfig) {
+			if config.RestartRequired(fc.lastConfig, msg.Config) {
 				logCxt.Warn("Felix configuration changed. Need to restart.")
 				fc.shutDownProcess("config changed")
-			} else if config == nil {
-				logCxt.Info("Config resolved.")
-				config = make(map[string]string)
-				for k, v := range msg.Config {
-					config[k] = v
-				}
 			}
-		case *calc.DatastoreNotReady:
-			log.Warn("Datastore became unready, need to restart.")
-			fc.shutDownProcess("datastore became unready")
+			// Only live parameters changed.  The calculation graph
+			// has already updated our config object; pass the
+			// update on to the dataplane driver to handle.
+			logCxt.Info("Felix configuration changed. Applying live.")
+			logutils.UpdateLogLevels(fc.config)
+		} else if fc.lastConfig == nil {
+			logCxt.Info("Config resolved.")
+		}
+		fc.lastConfig = make(map[string]string)
+		for k, v := range msg.Config {
+			fc.lastConfig[k] = v
+		}
+	case *calc.DatastoreNotReady:
+		log.Warn("Datastore became unready, need to restart.")
+		fc.shutDownProcess("datastore became unready")
+	}
+	if fc.policySyncUpdates != nil {
+		fc.policySyncUpdates <- msg
+	}
+	if fc.debugState != nil {
+		fc.debugState.OnUpdate(msg)
+	}
+	if fc.auditor != nil {
+		fc.auditor.OnUpdate(msg)
+	}
+	if err := fc.dataplane.SendMessage(msg); err != nil {
+		fc.shutDownProcess("Failed to write to dataplane driver")
+	}
+	if _, ok := msg.(*proto.InSync); ok && fc.pendingMarker != nil {
+		if fc.convergenceTracker != nil {
+			fc.convergenceTracker.OnMarker(fc.pendingMarker, time.Now())
 		}
-		fc.marshalToDataplane(msg)
+		fc.pendingMarker = nil
 	}
 }
 
-func (fc *DataplaneConn) shutDownProcess(reason string) {
+func (fc *DataplaneConnector) shutDownProcess(reason string) {
 	// Send a failure report to the managed shutdown thread then give it
 	// a few seconds to do the shutdown.
 	fc.failureReportChan <- reason
@@ -619,75 +1596,7 @@ func (fc *DataplaneConn) shutDownProcess(reason string) {
 	log.Panic("Managed shutdown failed. Panicking.")
 }
 
-func (fc *DataplaneConn) marshalToDataplane(msg interface{}) {
-	log.Debugf("Writing msg (%v) to felix: %#v", fc.nextSeqNumber, msg)
-
-	envelope := &proto.ToDataplane{
-		SequenceNumber: fc.nextSeqNumber,
-	}
-	fc.nextSeqNumber += 1
-	switch msg := msg.(type) {
-	case *proto.ConfigUpdate:
-		envelope.Payload = &proto.ToDataplane_ConfigUpdate{msg}
-	case *proto.InSync:
-		envelope.Payload = &proto.ToDataplane_InSync{msg}
-	case *proto.IPSetUpdate:
-		envelope.Payload = &proto.ToDataplane_IpsetUpdate{msg}
-	case *proto.IPSetDeltaUpdate:
-		envelope.Payload = &proto.ToDataplane_IpsetDeltaUpdate{msg}
-	case *proto.IPSetRemove:
-		envelope.Payload = &proto.ToDataplane_IpsetRemove{msg}
-	case *proto.ActivePolicyUpdate:
-		envelope.Payload = &proto.ToDataplane_ActivePolicyUpdate{msg}
-	case *proto.ActivePolicyRemove:
-		envelope.Payload = &proto.ToDataplane_ActivePolicyRemove{msg}
-	case *proto.ActiveProfileUpdate:
-		envelope.Payload = &proto.ToDataplane_ActiveProfileUpdate{msg}
-	case *proto.ActiveProfileRemove:
-		envelope.Payload = &proto.ToDataplane_ActiveProfileRemove{msg}
-	case *proto.HostEndpointUpdate:
-		envelope.Payload = &proto.ToDataplane_HostEndpointUpdate{msg}
-	case *proto.HostEndpointRemove:
-		envelope.Payload = &proto.ToDataplane_HostEndpointRemove{msg}
-	case *proto.WorkloadEndpointUpdate:
-		envelope.Payload = &proto.ToDataplane_WorkloadEndpointUpdate{msg}
-	case *proto.WorkloadEndpointRemove:
-		envelope.Payload = &proto.ToDataplane_WorkloadEndpointRemove{msg}
-	case *proto.HostMetadataUpdate:
-		envelope.Payload = &proto.ToDataplane_HostMetadataUpdate{msg}
-	case *proto.HostMetadataRemove:
-		envelope.Payload = &proto.ToDataplane_HostMetadataRemove{msg}
-	case *proto.IPAMPoolUpdate:
-		envelope.Payload = &proto.ToDataplane_IpamPoolUpdate{msg}
-	case *proto.IPAMPoolRemove:
-		envelope.Payload = &proto.ToDataplane_IpamPoolRemove{msg}
-	default:
-		log.WithField("msg", msg).Panic("Unknown message type")
-	}
-	data, err := pb.Marshal(envelope)
-	if err != nil {
-		log.WithError(err).WithField("msg", msg).Panic(
-			"Failed to marshal data to front end")
-	}
-
-	lengthBuffer := make([]byte, 8)
-	binary.LittleEndian.PutUint64(lengthBuffer, uint64(len(data)))
-
-	numBytes, err := fc.felixWriter.Write(lengthBuffer)
-	if err != nil || numBytes != len(lengthBuffer) {
-		log.WithError(err).WithField("bytesWritten", numBytes).Error(
-			"Failed to write to dataplane driver")
-		fc.shutDownProcess("Failed to write to front end")
-	}
-	numBytes, err = fc.felixWriter.Write(data)
-	if err != nil || numBytes != len(data) {
-		log.WithError(err).WithField("bytesWritten", numBytes).Error(
-			"Failed to write to dataplane driver")
-		fc.shutDownProcess("Failed to write to front end")
-	}
-}
-
-func (fc *DataplaneConn) Start() {
+func (fc *DataplaneConnector) Start() {
 	// Start a background thread to write to the dataplane driver.
 	go fc.sendMessagesToDataplaneDriver()
 
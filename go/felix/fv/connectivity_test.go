@@ -0,0 +1,168 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build fvtests
+// +build fvtests
+
+package fv_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/fv"
+
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/renderdataplane"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"github.com/projectcalico/felix/go/felix/services"
+	"os"
+)
+
+// The topology is a host namespace that routes between two workload
+// namespaces:
+//
+//	w1 eth0 10.65.0.2 --- cali1 10.65.0.1  host  cali2 10.65.1.1 --- eth0 10.65.1.2 w2
+var _ = Describe("Connectivity between two workloads", func() {
+	var host, w1, w2 *Namespace
+
+	newNamespace := func(name string) *Namespace {
+		ns, err := NewNamespace(fmt.Sprintf("felix-fv-%s-%d", name, os.Getpid()))
+		Expect(err).NotTo(HaveOccurred())
+		return ns
+	}
+
+	BeforeEach(func() {
+		if os.Geteuid() != 0 {
+			Skip("The FV tests need root")
+		}
+		host = newNamespace("host")
+		w1 = newNamespace("w1")
+		w2 = newNamespace("w2")
+		Expect(host.EnableForwarding()).To(Succeed())
+		Expect(ConnectVeth(w1, "eth0", "10.65.0.2/24", host, "cali1", "10.65.0.1/24")).To(Succeed())
+		Expect(ConnectVeth(w2, "eth0", "10.65.1.2/24", host, "cali2", "10.65.1.1/24")).To(Succeed())
+		Expect(w1.AddRoute("default", "10.65.0.1", "eth0")).To(Succeed())
+		Expect(w2.AddRoute("default", "10.65.1.1", "eth0")).To(Succeed())
+	})
+
+	AfterEach(func() {
+		for _, ns := range []*Namespace{host, w1, w2} {
+			if ns != nil {
+				ns.Delete()
+			}
+		}
+	})
+
+	It("should be open before any rules are programmed", func() {
+		Expect(w1.CanPing("10.65.1.2")).To(BeTrue())
+		Expect(w2.CanPing("10.65.0.2")).To(BeTrue())
+	})
+
+	Describe("with a filter Table", func() {
+		var filter *iptables.Table
+
+		BeforeEach(func() {
+			filter = host.NewTable("filter", 4)
+		})
+
+		It("should block and then unblock traffic", func() {
+			filter.UpdateChain(&iptables.Chain{
+				Name: "cali-fw-test",
+				Rules: []iptables.Rule{
+					{Match: iptables.Match().InInterface("cali1"), Action: iptables.DropAction{}},
+				},
+			})
+			filter.SetRuleInsertions("FORWARD", []iptables.Rule{
+				{Action: iptables.JumpAction{Target: "cali-fw-test"}},
+			})
+			Expect(filter.Apply()).To(Succeed())
+			Expect(w1.CanPing("10.65.1.2")).To(BeFalse())
+
+			filter.SetRuleInsertions("FORWARD", nil)
+			filter.RemoveChainByName("cali-fw-test")
+			Expect(filter.Apply()).To(Succeed())
+			Expect(w1.CanPing("10.65.1.2")).To(BeTrue())
+		})
+
+		It("should block the members of an IP set", func() {
+			Expect(host.RestoreIPSets(renderdataplane.RenderIPSetRestore(
+				map[string][]string{"blocked": {"10.65.0.2"}}, 4))).To(Succeed())
+			filter.SetRuleInsertions("FORWARD", []iptables.Rule{{
+				Match:  iptables.Match().SourceIPSet("felix-4-blocked"),
+				Action: iptables.DropAction{},
+			}})
+			Expect(filter.Apply()).To(Succeed())
+			Expect(w1.CanPing("10.65.1.2")).To(BeFalse())
+			Expect(w2.CanPing("10.65.0.2")).To(BeFalse())
+
+			Expect(host.RestoreIPSets(renderdataplane.RenderIPSetRestore(
+				map[string][]string{"blocked": {}}, 4))).To(Succeed())
+			Expect(w1.CanPing("10.65.1.2")).To(BeTrue())
+		})
+
+		It("should repair the dataplane after it has been tampered with", func() {
+			filter.SetRuleInsertions("FORWARD", []iptables.Rule{{
+				Match:  iptables.Match().InInterface("cali1"),
+				Action: iptables.DropAction{},
+			}})
+			Expect(filter.Apply()).To(Succeed())
+			_, err := host.Exec("iptables", "-F", "FORWARD")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(w1.CanPing("10.65.1.2")).To(BeTrue())
+
+			filter.InvalidateDataplaneCache()
+			Expect(filter.Apply()).To(Succeed())
+			Expect(w1.CanPing("10.65.1.2")).To(BeFalse())
+		})
+	})
+
+	Describe("with the service manager", func() {
+		webID := services.ServiceID{Namespace: "default", Name: "web"}
+
+		BeforeEach(func() {
+			Expect(w2.Listen(8080)).To(Succeed())
+
+			renderer := rules.NewRenderer(rules.Config{
+				IptablesMarkMasq: 0x4,
+				NodePortRanges:   []rules.PortRange{{Min: 30000, Max: 32767}},
+			})
+			nat := host.NewTable("nat", 4)
+			filter := host.NewTable("filter", 4)
+			nat.UpdateChain(renderer.MasqMarkedChain())
+			manager := services.NewManager(4, renderer, nat, filter)
+			manager.OnServiceUpdate(services.Service{
+				ID:        webID,
+				ClusterIP: "10.96.0.10",
+				Ports: []services.ServicePort{
+					{Name: "http", Protocol: "tcp", Port: 80},
+				},
+			})
+			manager.OnEndpointsUpdate(services.Endpoints{
+				ID:        webID,
+				Addresses: []string{"10.65.1.2"},
+				Ports:     []services.EndpointPort{{Name: "http", Port: 8080}},
+			})
+			manager.CompleteDeferredWork()
+			Expect(nat.Apply()).To(Succeed())
+			Expect(filter.Apply()).To(Succeed())
+		})
+
+		It("should DNAT the cluster IP to the endpoint", func() {
+			Expect(w1.CanConnect("10.65.1.2", 8080)).To(BeTrue())
+			Expect(w1.CanConnect("10.96.0.10", 80)).To(BeTrue())
+			Expect(w1.CanConnect("10.96.0.10", 81)).To(BeFalse())
+		})
+	})
+})
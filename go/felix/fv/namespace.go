@@ -0,0 +1,209 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The fv package is a harness for functional verification of the dataplane
+// code against a real kernel, without a cluster.  Each test builds a small
+// topology of network namespaces joined by veth pairs, points the real
+// iptables Tables, service manager and so on at one of the namespaces, and
+// then checks what actually gets through.
+//
+// The tests need root, iptables, ipset, iproute2 and a netcat that supports
+// -l, -z and -w.  They're behind the "fvtests" build tag so that they only
+// run when asked for, with "make go-fv" or
+//
+//	sudo go test -tags fvtests ./felix/fv/...
+package fv
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Namespace is a network namespace created by a test.
+type Namespace struct {
+	Name string
+	// listeners are the netcat servers started by Listen.
+	listeners []*exec.Cmd
+}
+
+// NewNamespace creates a network namespace and brings up its loopback
+// interface.  The caller must Delete it.
+func NewNamespace(name string) (*Namespace, error) {
+	if out, err := exec.Command("ip", "netns", "add", name).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to create namespace %s: %v: %s", name, err, out)
+	}
+	n := &Namespace{Name: name}
+	if _, err := n.Exec("ip", "link", "set", "lo", "up"); err != nil {
+		n.Delete()
+		return nil, err
+	}
+	return n, nil
+}
+
+// Delete stops any listeners and deletes the namespace, along with its
+// interfaces and iptables state.
+func (n *Namespace) Delete() error {
+	for _, cmd := range n.listeners {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	n.listeners = nil
+	if out, err := exec.Command("ip", "netns", "del", n.Name).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to delete namespace %s: %v: %s", n.Name, err, out)
+	}
+	return nil
+}
+
+// Command returns a command that runs inside the namespace.
+func (n *Namespace) Command(name string, arg ...string) *exec.Cmd {
+	return exec.Command("ip", append([]string{"netns", "exec", n.Name, name}, arg...)...)
+}
+
+// Exec runs a command inside the namespace and returns its combined output.
+func (n *Namespace) Exec(name string, arg ...string) ([]byte, error) {
+	out, err := n.Command(name, arg...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("%s %s failed in namespace %s: %v: %s",
+			name, strings.Join(arg, " "), n.Name, err, out)
+	}
+	return out, nil
+}
+
+// NewCmd is suitable for iptables.TableOptions.NewCmdOverride; it makes a
+// Table program the namespace's iptables.
+func (n *Namespace) NewCmd(name string, arg ...string) iptables.CmdIface {
+	return cmdAdapter{n.Command(name, arg...)}
+}
+
+// NewTable creates a Table that programs the namespace.
+func (n *Namespace) NewTable(table string, ipVersion uint8) *iptables.Table {
+	return iptables.NewTable(table, ipVersion, iptables.TableOptions{
+		NewCmdOverride: n.NewCmd,
+	})
+}
+
+// RestoreIPSets feeds the input, as rendered by
+// renderdataplane.RenderIPSetRestore, to ipset restore in the namespace.
+// Existing sets with the same names are replaced.
+func (n *Namespace) RestoreIPSets(input []byte) error {
+	// -exist stops ipset from failing on a set that already exists, but
+	// doesn't remove its old members, so flush each set after creating it.
+	var buf bytes.Buffer
+	for _, line := range strings.Split(string(input), "\n") {
+		if line == "" {
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+		if fields := strings.Fields(line); fields[0] == "create" {
+			fmt.Fprintf(&buf, "flush %s\n", fields[1])
+		}
+	}
+	cmd := n.Command("ipset", "restore", "-exist")
+	cmd.Stdin = &buf
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ipset restore failed in namespace %s: %v: %s", n.Name, err, out)
+	}
+	return nil
+}
+
+// AddRoute adds a route to dst, via the given gateway, or directly out of
+// the given interface if via is empty.
+func (n *Namespace) AddRoute(dst, via, iface string) error {
+	args := []string{"route", "replace", dst}
+	if via != "" {
+		args = append(args, "via", via)
+	}
+	if iface != "" {
+		args = append(args, "dev", iface)
+	}
+	_, err := n.Exec("ip", args...)
+	return err
+}
+
+// EnableForwarding turns the namespace into a router.
+func (n *Namespace) EnableForwarding() error {
+	_, err := n.Exec("sysctl", "-w", "net.ipv4.ip_forward=1")
+	return err
+}
+
+// CanPing returns true if a single ping from the namespace to addr gets a
+// reply within a second.
+func (n *Namespace) CanPing(addr string) bool {
+	_, err := n.Exec("ping", "-c", "1", "-W", "1", addr)
+	return err == nil
+}
+
+// Listen starts a TCP server on the given port that accepts connections
+// until the namespace is deleted.
+func (n *Namespace) Listen(port uint16) error {
+	cmd := n.Command("sh", "-c", "while true; do nc -l -p "+
+		strconv.Itoa(int(port))+" </dev/null >/dev/null; done")
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	n.listeners = append(n.listeners, cmd)
+	// Give the server time to bind.
+	time.Sleep(100 * time.Millisecond)
+	return nil
+}
+
+// CanConnect returns true if a TCP connection from the namespace to the
+// given address and port succeeds within a second.
+func (n *Namespace) CanConnect(addr string, port uint16) bool {
+	_, err := n.Exec("nc", "-z", "-w", "1", addr, strconv.Itoa(int(port)))
+	return err == nil
+}
+
+// ConnectVeth joins two namespaces with a veth pair.  Each end gets the
+// given name and address, in CIDR form, and is brought up.
+func ConnectVeth(a *Namespace, aIface, aAddr string, b *Namespace, bIface, bAddr string) error {
+	out, err := exec.Command("ip", "link", "add", aIface, "netns", a.Name,
+		"type", "veth", "peer", "name", bIface, "netns", b.Name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to create veth pair %s/%s: %v: %s", aIface, bIface, err, out)
+	}
+	for _, end := range []struct {
+		ns          *Namespace
+		iface, addr string
+	}{{a, aIface, aAddr}, {b, bIface, bAddr}} {
+		if _, err := end.ns.Exec("ip", "addr", "add", end.addr, "dev", end.iface); err != nil {
+			return err
+		}
+		if _, err := end.ns.Exec("ip", "link", "set", end.iface, "up"); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"a": a.Name + "/" + aIface,
+		"b": b.Name + "/" + bIface,
+	}).Debug("Connected namespaces")
+	return nil
+}
+
+// cmdAdapter adapts exec.Cmd to iptables.CmdIface.
+type cmdAdapter struct {
+	*exec.Cmd
+}
+
+func (c cmdAdapter) SetStdin(r io.Reader) {
+	c.Stdin = r
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hashutils
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+const shortenedPrefix = "_"
+
+// GetLengthLimitedID returns an ID that consists of the given prefix and
+// suffix, if the combined length is within maxLength.  Otherwise, it
+// replaces the suffix with "_" followed by a (truncated) hash of the suffix.
+// The "_" marker is reserved: a suffix that already starts with "_" is always
+// hashed so that a shortened ID can never collide with a literal one.
+func GetLengthLimitedID(fixedPrefix, suffix string, maxLength int) string {
+	prefixLen := len(fixedPrefix)
+	suffixLen := len(suffix)
+	totalLen := prefixLen + suffixLen
+	if totalLen > maxLength || (suffixLen > 0 && suffix[:1] == shortenedPrefix) {
+		// Either it's too long, or the original name starts with the
+		// character we use to indicate a shortened name.  Shorten it.
+		hasher := sha256.New224()
+		hasher.Write([]byte(suffix))
+		hash := base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))
+		charsLeftForHash := maxLength - prefixLen - len(shortenedPrefix)
+		if charsLeftForHash > len(hash) {
+			// Plenty of room; use the whole hash.
+			charsLeftForHash = len(hash)
+		}
+		return fixedPrefix + shortenedPrefix + hash[:charsLeftForHash]
+	}
+	// No need to shorten.
+	return fixedPrefix + suffix
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hashutils_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/hashutils"
+
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("GetLengthLimitedID",
+	func(prefix, suffix string, expected string) {
+		Expect(GetLengthLimitedID(prefix, suffix, 20)).To(Equal(expected))
+	},
+	Entry("short", "cali-", "foo", "cali-foo"),
+	Entry("exactly at limit", "cali-", "123456789012345", "cali-123456789012345"),
+	Entry("too long", "cali-", "1234567890123456", "cali-_yhYZe-HuBbadI7"),
+	Entry("reserved prefix", "cali-", "_foo", "cali-_UYWglFdi6DcgwU"),
+	Entry("empty suffix", "cali-", "", "cali-"),
+)
+
+var _ = DescribeTable("GetLengthLimitedID with a long limit",
+	func(prefix, suffix string, expected string) {
+		Expect(GetLengthLimitedID(prefix, suffix, 64)).To(Equal(expected))
+	},
+	Entry("reserved prefix", "cali-", "_foo", "cali-_UYWglFdi6DcgwUlVBxPubqHYEohNh9izeeiP8Q"),
+)
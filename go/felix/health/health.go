@@ -0,0 +1,159 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The health package aggregates the health of Felix's subsystems and exposes
+// it over HTTP so that an orchestrator can restart Felix if it gets stuck.
+//
+// Each subsystem registers as a reporter, saying whether it reports on
+// liveness, readiness or both, and then calls Report() periodically.  A
+// report expires after the reporter's timeout so a subsystem that stops
+// reporting, for example because it is wedged, is treated as unhealthy.
+//
+// Felix is live if all the reporters that report liveness are live; it is
+// ready if all the reporters that report readiness are ready.
+package health
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	LivenessPath  = "/liveness"
+	ReadinessPath = "/readiness"
+)
+
+// HealthReport is a report of a subsystem's health, or the summary of all
+// subsystems' health.
+type HealthReport struct {
+	Live  bool
+	Ready bool
+}
+
+type reporterState struct {
+	// reports says which of liveness and readiness this reporter reports
+	// on.
+	reports HealthReport
+	timeout time.Duration
+
+	latest    HealthReport
+	timestamp time.Time
+}
+
+// expired returns true if the reporter's latest report is too old to be
+// trusted.  A zero timeout means that reports never expire.
+func (r *reporterState) expired(now time.Time) bool {
+	return r.timeout > 0 && now.Sub(r.timestamp) > r.timeout
+}
+
+// HealthAggregator collects the reports from the registered reporters.  It
+// is safe for concurrent use.
+type HealthAggregator struct {
+	mutex     sync.Mutex
+	reporters map[string]*reporterState
+}
+
+func NewHealthAggregator() *HealthAggregator {
+	return &HealthAggregator{
+		reporters: map[string]*reporterState{},
+	}
+}
+
+// RegisterReporter registers a subsystem that will report its health.
+// Until it reports, the reporter is treated as not live and not ready.
+func (aggregator *HealthAggregator) RegisterReporter(name string, reports *HealthReport, timeout time.Duration) {
+	aggregator.mutex.Lock()
+	defer aggregator.mutex.Unlock()
+	aggregator.reporters[name] = &reporterState{
+		reports: *reports,
+		timeout: timeout,
+	}
+}
+
+// Report records the current health of the named reporter, which must have
+// been registered.
+func (aggregator *HealthAggregator) Report(name string, report *HealthReport) {
+	aggregator.mutex.Lock()
+	defer aggregator.mutex.Unlock()
+	reporter, ok := aggregator.reporters[name]
+	if !ok {
+		log.WithField("name", name).Panic("Health report from unregistered reporter")
+	}
+	if report.Live != reporter.latest.Live || report.Ready != reporter.latest.Ready {
+		log.WithFields(log.Fields{
+			"name":  name,
+			"live":  report.Live,
+			"ready": report.Ready,
+		}).Info("Health of reporter changed")
+	}
+	reporter.latest = *report
+	reporter.timestamp = time.Now()
+}
+
+// Summary calculates the overall health from the latest reports.
+func (aggregator *HealthAggregator) Summary() *HealthReport {
+	aggregator.mutex.Lock()
+	defer aggregator.mutex.Unlock()
+	summary := &HealthReport{Live: true, Ready: true}
+	now := time.Now()
+	for name, reporter := range aggregator.reporters {
+		latest := reporter.latest
+		if reporter.expired(now) {
+			log.WithField("name", name).Warn("Health report has expired")
+			latest = HealthReport{}
+		}
+		if reporter.reports.Live && !latest.Live {
+			summary.Live = false
+		}
+		if reporter.reports.Ready && !latest.Ready {
+			summary.Ready = false
+		}
+	}
+	return summary
+}
+
+// ServeHTTP serves the /liveness and /readiness endpoints.  They respond
+// with status 200 if Felix is live/ready and 503 otherwise.
+func (aggregator *HealthAggregator) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
+	var healthy bool
+	switch req.URL.Path {
+	case LivenessPath:
+		healthy = aggregator.Summary().Live
+	case ReadinessPath:
+		healthy = aggregator.Summary().Ready
+	default:
+		http.NotFound(rsp, req)
+		return
+	}
+	if healthy {
+		rsp.WriteHeader(http.StatusOK)
+		fmt.Fprintln(rsp, "ok")
+	} else {
+		rsp.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(rsp, "not ok")
+	}
+}
+
+// ListenAndServe serves the health endpoints on the given port.  Like
+// http.ListenAndServe, it only returns on failure.
+func (aggregator *HealthAggregator) ListenAndServe(port int) error {
+	mux := http.NewServeMux()
+	mux.Handle(LivenessPath, aggregator)
+	mux.Handle(ReadinessPath, aggregator)
+	log.WithField("port", port).Info("Starting health endpoints")
+	return http.ListenAndServe(fmt.Sprintf(":%v", port), mux)
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/health"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("HealthAggregator", func() {
+	var aggregator *HealthAggregator
+
+	BeforeEach(func() {
+		aggregator = NewHealthAggregator()
+		aggregator.RegisterReporter("liveOnly", &HealthReport{Live: true}, 0)
+		aggregator.RegisterReporter("readyOnly", &HealthReport{Ready: true}, 0)
+		aggregator.RegisterReporter("both", &HealthReport{Live: true, Ready: true}, 0)
+	})
+
+	statusOf := func(path string) int {
+		rsp := httptest.NewRecorder()
+		aggregator.ServeHTTP(rsp, httptest.NewRequest("GET", path, nil))
+		return rsp.Code
+	}
+
+	It("should be neither live nor ready before any reports", func() {
+		Expect(aggregator.Summary()).To(Equal(&HealthReport{}))
+		Expect(statusOf(LivenessPath)).To(Equal(http.StatusServiceUnavailable))
+		Expect(statusOf(ReadinessPath)).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	Describe("with all reporters healthy", func() {
+		BeforeEach(func() {
+			aggregator.Report("liveOnly", &HealthReport{Live: true})
+			aggregator.Report("readyOnly", &HealthReport{Ready: true})
+			aggregator.Report("both", &HealthReport{Live: true, Ready: true})
+		})
+
+		It("should be live and ready", func() {
+			Expect(aggregator.Summary()).To(Equal(&HealthReport{Live: true, Ready: true}))
+			Expect(statusOf(LivenessPath)).To(Equal(http.StatusOK))
+			Expect(statusOf(ReadinessPath)).To(Equal(http.StatusOK))
+		})
+		It("should not be ready if a readiness reporter isn't ready", func() {
+			aggregator.Report("readyOnly", &HealthReport{})
+			Expect(aggregator.Summary()).To(Equal(&HealthReport{Live: true}))
+			Expect(statusOf(LivenessPath)).To(Equal(http.StatusOK))
+			Expect(statusOf(ReadinessPath)).To(Equal(http.StatusServiceUnavailable))
+		})
+		It("should not be live if a liveness reporter isn't live", func() {
+			aggregator.Report("both", &HealthReport{Ready: true})
+			Expect(aggregator.Summary()).To(Equal(&HealthReport{Ready: true}))
+		})
+		It("should ignore aspects that a reporter doesn't report on", func() {
+			aggregator.Report("liveOnly", &HealthReport{Live: true, Ready: false})
+			Expect(aggregator.Summary()).To(Equal(&HealthReport{Live: true, Ready: true}))
+		})
+		It("should 404 on other paths", func() {
+			Expect(statusOf("/foo")).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	It("should treat expired reports as unhealthy", func() {
+		aggregator = NewHealthAggregator()
+		aggregator.RegisterReporter("timed", &HealthReport{Live: true, Ready: true}, 50*time.Millisecond)
+		aggregator.Report("timed", &HealthReport{Live: true, Ready: true})
+		Expect(aggregator.Summary()).To(Equal(&HealthReport{Live: true, Ready: true}))
+		Eventually(aggregator.Summary).Should(Equal(&HealthReport{}))
+		aggregator.Report("timed", &HealthReport{Live: true, Ready: true})
+		Expect(aggregator.Summary()).To(Equal(&HealthReport{Live: true, Ready: true}))
+	})
+
+	It("should panic on a report from an unregistered reporter", func() {
+		Expect(func() {
+			aggregator.Report("unknown", &HealthReport{Live: true})
+		}).To(Panic())
+	})
+})
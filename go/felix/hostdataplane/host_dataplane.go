@@ -0,0 +1,993 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The hostdataplane package programs the host-wide iptables chains that
+// are rendered by the rules package, such as the port forwarding and SYN
+// flood protection chains, alongside the dataplane driver, which programs
+// the endpoint and policy chains.
+//
+// Like the BPF dataplane, the host dataplane wraps the dataplane driver:
+// every update is passed through to the wrapped driver and also queued for
+// the host dataplane, which picks out the parts that it needs.
+//
+// The host dataplane owns the chains with the rules package's prefix.  In
+// each table, it hooks the chains that it renders into a dispatch chain per
+// kernel chain (for example, cali-FORWARD for the FORWARD chain), in a
+// fixed order, and skips the chains that are empty.  The driver jumps to
+// the dispatch chains of the filter and nat tables ahead of its own chains,
+// so that it stays in control of the order of the jumps in the kernel
+// chains.  The driver doesn't use the raw and mangle tables, so there we
+// insert the jumps to the dispatch chains ourselves.
+//
+// If Felix programs the services in place of kube-proxy, the host
+// dataplane also feeds the service updates to a services.Manager per IP
+// version, and programs the manager's chains along with its own.  For DSR,
+// it fills in the hosts' addresses of the services' endpoints from the
+// host metadata that the datastore sends us.
+//
+// The host dataplane also removes the conntrack flows of the workload
+// endpoints that are removed, or whose policy changes, so that established
+// flows don't outlive the policy that allowed them.  If the driver caches
+// verdicts in the flows' connmarks, it removes the marked flows after any
+// change that could change a verdict.
+package hostdataplane
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/backoff"
+	"github.com/projectcalico/felix/go/felix/health"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"github.com/projectcalico/felix/go/felix/services"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The dispatch chains, which jump to our other chains.  The names are
+// shared with the dataplane driver, which jumps to the filter and nat
+// dispatch chains.
+const (
+	ChainPrerouting  = rules.ChainNamePrefix + "-PREROUTING"
+	ChainInput       = rules.ChainNamePrefix + "-INPUT"
+	ChainForward     = rules.ChainNamePrefix + "-FORWARD"
+	ChainOutput      = rules.ChainNamePrefix + "-OUTPUT"
+	ChainPostrouting = rules.ChainNamePrefix + "-POSTROUTING"
+)
+
+// tableNames are the tables that we program, in the order that we apply
+// them.
+var tableNames = []string{"raw", "mangle", "nat", "filter"}
+
+// kernelChains maps from each of our dispatch chains to the kernel chain
+// that it hangs off.  Each table only has some of them.
+var kernelChains = map[string]string{
+	ChainPrerouting:  "PREROUTING",
+	ChainInput:       "INPUT",
+	ChainForward:     "FORWARD",
+	ChainOutput:      "OUTPUT",
+	ChainPostrouting: "POSTROUTING",
+}
+
+// dispatchChains lists the dispatch chains of each table.
+var dispatchChains = map[string][]string{
+	"raw":    {ChainPrerouting, ChainOutput},
+	"mangle": {ChainPrerouting},
+	"nat":    {ChainPrerouting, ChainOutput, ChainPostrouting},
+	"filter": {ChainInput, ChainForward, ChainOutput},
+}
+
+// driverTables are the tables in which the dataplane driver jumps to our
+// dispatch chains.
+var driverTables = map[string]bool{"nat": true, "filter": true}
+
+// workloadTables are the tables whose chains depend on the workload
+// endpoints.
+var workloadTables = []string{"raw", "mangle"}
+
+// backoffName identifies the host dataplane's backoff manager in the log and
+// health reports.
+const backoffName = "host_dataplane"
+
+// policyRoutingKey is the key of the policy routing's updates in the backoff
+// manager.
+const policyRoutingKey = "policy-routing"
+
+// driver is the interface of the wrapped dataplane driver; it matches
+// dataplane.DataplaneDriver.
+type driver interface {
+	SendMessage(msg interface{}) error
+	RecvMessage() (msg interface{}, err error)
+}
+
+// Table is the subset of the iptables.Table API that the host dataplane
+// uses.
+type Table interface {
+	UpdateChains(chains []*iptables.Chain)
+	RemoveChainByName(name string)
+	SetRuleInsertions(chainName string, rules []iptables.Rule)
+	InvalidateDataplaneCache()
+	Apply() error
+}
+
+// RouteManager is the subset of the policyrouting.Manager API that the host
+// dataplane uses.
+type RouteManager interface {
+	SetEgressGatewayRoute(route rules.EgressGatewayRoute, ok bool)
+	SetDSRRoutes(routes []rules.DSRRoute)
+	QueueResync()
+	Apply() error
+}
+
+// ServiceManager is the subset of the services.Manager API that the host
+// dataplane uses.
+type ServiceManager interface {
+	OnServiceUpdate(svc services.Service)
+	OnServiceRemove(id services.ServiceID)
+	OnEndpointsUpdate(eps services.Endpoints)
+	OnEndpointsRemove(id services.ServiceID)
+	EnableDSR(hostAddr string, mangleTable services.Table, routeTable services.RouteTable)
+	CompleteDeferredWork()
+}
+
+// Conntrack is the subset of the conntrack.Conntrack API that the host
+// dataplane uses.
+type Conntrack interface {
+	QueueFlowRemoval(ipAddr net.IP)
+	QueueMarkedFlowRemoval(mark uint32)
+	Flush()
+}
+
+// Services configures the services that we program in place of kube-proxy.
+type Services struct {
+	// Updates delivers the services.Service, services.ServiceRemove,
+	// services.Endpoints and services.EndpointsRemove updates.
+	Updates <-chan interface{}
+	// NewManager creates the manager of each IP version's services.  The
+	// tables that it's given queue its chains to be programmed with ours.
+	NewManager func(ipVersion uint8, natTable, filterTable services.Table) ServiceManager
+	// DSREnabled enables DSR on the IPv4 manager once we know the address
+	// of our host, which has the given Hostname.  It needs PolicyRouting.
+	DSREnabled bool
+	Hostname   string
+}
+
+type Config struct {
+	IPv6Enabled bool
+	// RetryInterval is the interval at which we check for failed updates
+	// to retry.  Each table is only retried once its backoff has expired.
+	RetryInterval time.Duration
+	// RefreshInterval, if non-zero, is the interval at which we reload
+	// the tables from the dataplane, to repair any changes that another
+	// process has made to our chains.
+	RefreshInterval time.Duration
+	// Backoff controls the backoff of failed updates.  The initial delay
+	// defaults to RetryInterval.
+	Backoff backoff.Config
+	// HealthAggregator, if non-nil, receives the health of the updates.
+	HealthAggregator *health.HealthAggregator
+
+	// PortForwards are the port forwards to program.  Invalid and
+	// conflicting forwards are skipped.
+	PortForwards []rules.PortForward
+	// DNSPolicyEnabled has us copy DNS responses to the DNS policy
+	// snooper.
+	DNSPolicyEnabled bool
+	// PolicyRouting, if non-nil, programs the routing rules and tables of
+	// the features that route marked traffic.  We apply it after the
+	// tables, so that the chains that mark the traffic are in place first.
+	PolicyRouting RouteManager
+	// Services, if non-nil, has us program the services.
+	Services *Services
+	// Conntrack, if non-nil, removes the flows of the workload endpoints
+	// that are removed and of the endpoints whose policies or profiles
+	// change, and the flows with cached verdicts, once the datastore is in
+	// sync.  We can't tell which flows a
+	// new policy denies so we remove them all; conntrack picks the ones
+	// that are still allowed up again from their next packet.  The
+	// removals are delayed by ConntrackFlushDelay, to give the driver time
+	// to program the endpoint's chains first; otherwise, the next packet
+	// could recreate a flow under the old policy.
+	Conntrack           Conntrack
+	ConntrackFlushDelay time.Duration
+}
+
+// tableState records what we've programmed in one table.
+type tableState struct {
+	name      string
+	ipVersion uint8
+	table     Table
+	// chainNames contains the names of the chains that we last wrote to
+	// the table.
+	chainNames map[string]bool
+	dirty      bool
+	// services, if the services are enabled, holds the chains and
+	// insertions that the ServiceManager has queued for the table.
+	services *serviceTable
+}
+
+// key returns the key of the table's updates in the backoff manager.
+func (t *tableState) key() string {
+	return fmt.Sprintf("%s-v%d", t.name, t.ipVersion)
+}
+
+type HostDataplane struct {
+	inner driver
+	// pendingUpdates queues the updates that SendMessage has passed on to
+	// the inner driver until the loop gets to them; updatesReady is
+	// signalled when the queue becomes non-empty.  Queueing, rather than
+	// sending on a bounded channel, means that a slow apply never blocks
+	// the calculation graph.
+	updatesLock    sync.Mutex
+	pendingUpdates []interface{}
+	updatesReady   chan struct{}
+
+	config   Config
+	renderer rules.RuleRenderer
+	tables   []*tableState
+
+	// portForwards are the valid port forwards, sorted by ID.
+	portForwards []rules.PortForward
+	// workloadEndpoints contains the workload endpoints that the
+	// datastore has told us about, by ID.
+	workloadEndpoints map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint
+
+	serviceManagers []ServiceManager
+	// serviceEndpoints contains the services' Endpoints as we received
+	// them; we fill in their HostAddrs before passing them on.
+	serviceEndpoints map[services.ServiceID]services.Endpoints
+	// hostAddrs maps each hostname to the host's IPv4 address.
+	hostAddrs map[string]string
+	// dsrManager is the IPv4 ServiceManager, which DSR applies to, and
+	// dsrMangleTable its view of the IPv4 mangle table.  dsrHostAddr is the
+	// address of our host that we last enabled DSR with.
+	dsrManager     ServiceManager
+	dsrMangleTable *serviceTable
+	dsrHostAddr    string
+
+	// conntrackFlushC fires once it's time to flush the queued conntrack
+	// removals; it's nil if there are none.
+	conntrackFlushC <-chan time.Time
+
+	datastoreInSync bool
+
+	backoffs *backoff.Manager
+}
+
+// NewHostDataplaneDriver creates a host dataplane that wraps the given
+// driver.  newTable is called to create each of the tables that we program.
+func NewHostDataplaneDriver(
+	inner driver,
+	renderer rules.RuleRenderer,
+	newTable func(name string, ipVersion uint8) Table,
+	config Config,
+) *HostDataplane {
+	backoffConfig := config.Backoff
+	if backoffConfig.InitialDelay == 0 {
+		backoffConfig.InitialDelay = config.RetryInterval
+	}
+	d := &HostDataplane{
+		inner:             inner,
+		updatesReady:      make(chan struct{}, 1),
+		config:            config,
+		renderer:          renderer,
+		workloadEndpoints: map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint{},
+		serviceEndpoints:  map[services.ServiceID]services.Endpoints{},
+		hostAddrs:         map[string]string{},
+		backoffs:          backoff.NewManager(backoffName, backoffConfig, config.HealthAggregator),
+	}
+	if config.Services != nil && config.Services.DSREnabled && config.PolicyRouting == nil {
+		log.Panic("DSR needs the policy routing")
+	}
+	ipVersions := []uint8{4}
+	if config.IPv6Enabled {
+		ipVersions = append(ipVersions, 6)
+	}
+	for _, ipVersion := range ipVersions {
+		serviceTables := map[string]*serviceTable{}
+		for _, name := range tableNames {
+			t := &tableState{
+				name:       name,
+				ipVersion:  ipVersion,
+				table:      newTable(name, ipVersion),
+				chainNames: map[string]bool{},
+				dirty:      true,
+			}
+			if config.Services != nil {
+				t.services = newServiceTable(t)
+				serviceTables[name] = t.services
+			}
+			d.tables = append(d.tables, t)
+		}
+		if config.Services != nil {
+			m := config.Services.NewManager(ipVersion, serviceTables["nat"], serviceTables["filter"])
+			d.serviceManagers = append(d.serviceManagers, m)
+			if ipVersion == 4 {
+				d.dsrManager = m
+				d.dsrMangleTable = serviceTables["mangle"]
+			}
+		}
+	}
+
+	forwards := rules.NewPortForwards()
+	for _, fwd := range config.PortForwards {
+		// Each forward is its own ID, so two forwards of the same external
+		// address and port conflict.  Add logs the forwards that are
+		// invalid or conflict and skips them.
+		forwards.Add(fwd.String(), fwd)
+	}
+	d.portForwards = forwards.Sorted()
+
+	if config.PolicyRouting != nil {
+		config.PolicyRouting.SetEgressGatewayRoute(renderer.EgressGatewayRoute())
+	}
+	return d
+}
+
+func (d *HostDataplane) Start() {
+	go d.loop()
+}
+
+// SendMessage passes the update to the wrapped driver and queues it for the
+// host dataplane.  It never blocks on the host dataplane.
+func (d *HostDataplane) SendMessage(msg interface{}) error {
+	if err := d.inner.SendMessage(msg); err != nil {
+		return err
+	}
+	d.updatesLock.Lock()
+	d.pendingUpdates = append(d.pendingUpdates, msg)
+	d.updatesLock.Unlock()
+	select {
+	case d.updatesReady <- struct{}{}:
+	default:
+		// The loop has already been woken up.
+	}
+	return nil
+}
+
+// takePendingUpdates removes and returns the queued updates.
+func (d *HostDataplane) takePendingUpdates() []interface{} {
+	d.updatesLock.Lock()
+	defer d.updatesLock.Unlock()
+	updates := d.pendingUpdates
+	d.pendingUpdates = nil
+	return updates
+}
+
+// RecvMessage returns the wrapped driver's status reports.
+func (d *HostDataplane) RecvMessage() (interface{}, error) {
+	return d.inner.RecvMessage()
+}
+
+func (d *HostDataplane) loop() {
+	log.Info("Host dataplane running")
+	retryTicker := time.NewTicker(d.config.RetryInterval)
+	var refreshC <-chan time.Time
+	if d.config.RefreshInterval > 0 {
+		refreshC = time.NewTicker(d.config.RefreshInterval).C
+	}
+	var serviceUpdates <-chan interface{}
+	if d.config.Services != nil {
+		serviceUpdates = d.config.Services.Updates
+	}
+	for {
+		select {
+		case <-d.updatesReady:
+			// Process all the pending updates before we apply, so that
+			// we batch up changes.
+			for _, msg := range d.takePendingUpdates() {
+				d.onUpdate(msg)
+			}
+		case upd := <-serviceUpdates:
+			d.onServiceUpdate(upd)
+		serviceBatchLoop:
+			for {
+				select {
+				case upd := <-serviceUpdates:
+					d.onServiceUpdate(upd)
+				default:
+					break serviceBatchLoop
+				}
+			}
+		case <-d.conntrackFlushC:
+			d.conntrackFlushC = nil
+			d.config.Conntrack.Flush()
+		case <-retryTicker.C:
+		case <-refreshC:
+			log.Debug("Refreshing host dataplane tables")
+			for _, t := range d.tables {
+				t.table.InvalidateDataplaneCache()
+				t.dirty = true
+			}
+			if d.config.PolicyRouting != nil {
+				d.config.PolicyRouting.QueueResync()
+			}
+		}
+		if d.datastoreInSync {
+			d.apply()
+		}
+	}
+}
+
+func (d *HostDataplane) onUpdate(msg interface{}) {
+	switch msg := msg.(type) {
+	case *proto.InSync:
+		log.Info("Datastore in sync, applying host dataplane updates")
+		d.datastoreInSync = true
+	case *proto.WorkloadEndpointUpdate:
+		if old, ok := d.workloadEndpoints[*msg.Id]; ok && policyChanged(old, msg.Endpoint) {
+			d.queueFlowRemoval(old)
+		}
+		d.workloadEndpoints[*msg.Id] = msg.Endpoint
+		d.markTablesDirty(workloadTables...)
+	case *proto.WorkloadEndpointRemove:
+		if old, ok := d.workloadEndpoints[*msg.Id]; ok {
+			d.queueFlowRemoval(old)
+		}
+		delete(d.workloadEndpoints, *msg.Id)
+		d.markTablesDirty(workloadTables...)
+	case *proto.ActivePolicyUpdate:
+		d.onPolicyChanged(*msg.Id)
+		d.invalidateVerdicts()
+	case *proto.ActivePolicyRemove:
+		d.onPolicyChanged(*msg.Id)
+		d.invalidateVerdicts()
+	case *proto.ActiveProfileUpdate:
+		d.onProfileChanged(msg.Id.Name)
+		d.invalidateVerdicts()
+	case *proto.ActiveProfileRemove:
+		d.onProfileChanged(msg.Id.Name)
+		d.invalidateVerdicts()
+	case *proto.IPSetUpdate, *proto.IPSetDeltaUpdate, *proto.IPSetRemove:
+		// The policies match on the IP sets.
+		d.invalidateVerdicts()
+	case *proto.HostMetadataUpdate:
+		d.onHostAddrUpdate(msg.Hostname, msg.Ipv4Addr)
+	case *proto.HostMetadataRemove:
+		d.onHostAddrUpdate(msg.Hostname, "")
+	}
+}
+
+// onPolicyChanged removes the flows of the workload endpoints that use the
+// policy.
+func (d *HostDataplane) onPolicyChanged(id proto.PolicyID) {
+	for _, ep := range d.workloadEndpoints {
+		for _, tier := range ep.Tiers {
+			if tier.Name == id.Tier && containsString(tier.Policies, id.Name) {
+				d.queueFlowRemoval(ep)
+				break
+			}
+		}
+	}
+}
+
+// onProfileChanged removes the flows of the workload endpoints that use the
+// profile.
+func (d *HostDataplane) onProfileChanged(name string) {
+	for _, ep := range d.workloadEndpoints {
+		if containsString(ep.ProfileIds, name) {
+			d.queueFlowRemoval(ep)
+		}
+	}
+}
+
+// invalidateVerdicts queues the removal of the flows with cached verdicts,
+// if the verdict cache is enabled.
+func (d *HostDataplane) invalidateVerdicts() {
+	if !d.removingFlows() {
+		return
+	}
+	marks := d.renderer.VerdictCacheMarks()
+	for _, mark := range marks {
+		d.config.Conntrack.QueueMarkedFlowRemoval(mark)
+	}
+	if len(marks) > 0 {
+		d.scheduleConntrackFlush()
+	}
+}
+
+// queueFlowRemoval queues the removal of the endpoint's flows.
+func (d *HostDataplane) queueFlowRemoval(ep *proto.WorkloadEndpoint) {
+	if !d.removingFlows() {
+		return
+	}
+	var nets []string
+	nets = append(nets, ep.Ipv4Nets...)
+	nets = append(nets, ep.Ipv6Nets...)
+	for _, cidr := range nets {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.WithError(err).WithField("cidr", cidr).Warn(
+				"Failed to parse endpoint address, not removing its flows")
+			continue
+		}
+		d.config.Conntrack.QueueFlowRemoval(ip)
+	}
+	d.scheduleConntrackFlush()
+}
+
+// removingFlows returns true if we remove flows and the datastore is in
+// sync; before that, we're just learning the existing endpoints and
+// policies.
+func (d *HostDataplane) removingFlows() bool {
+	return d.config.Conntrack != nil && d.datastoreInSync
+}
+
+func (d *HostDataplane) scheduleConntrackFlush() {
+	if d.conntrackFlushC == nil {
+		d.conntrackFlushC = time.After(d.config.ConntrackFlushDelay)
+	}
+}
+
+// policyChanged returns true if the endpoint's policies or profiles differ
+// between old and new.
+func policyChanged(old, new *proto.WorkloadEndpoint) bool {
+	if !stringsEqual(old.ProfileIds, new.ProfileIds) || len(old.Tiers) != len(new.Tiers) {
+		return true
+	}
+	for i, tier := range old.Tiers {
+		if tier.Name != new.Tiers[i].Name || !stringsEqual(tier.Policies, new.Tiers[i].Policies) {
+			return true
+		}
+	}
+	return false
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// onServiceUpdate passes the update to the ServiceManagers, which ignore
+// the services of the other IP version.
+func (d *HostDataplane) onServiceUpdate(upd interface{}) {
+	switch upd := upd.(type) {
+	case services.Service:
+		for _, m := range d.serviceManagers {
+			m.OnServiceUpdate(upd)
+		}
+	case services.ServiceRemove:
+		for _, m := range d.serviceManagers {
+			m.OnServiceRemove(upd.ID)
+		}
+	case services.Endpoints:
+		d.serviceEndpoints[upd.ID] = upd
+		d.updateEndpoints(upd)
+	case services.EndpointsRemove:
+		delete(d.serviceEndpoints, upd.ID)
+		for _, m := range d.serviceManagers {
+			m.OnEndpointsRemove(upd.ID)
+		}
+	default:
+		log.WithField("update", upd).Panic("Unknown service update")
+	}
+}
+
+// updateEndpoints fills in the HostAddrs of the endpoints whose hosts'
+// addresses we know, and passes them to the ServiceManagers.
+func (d *HostDataplane) updateEndpoints(eps services.Endpoints) {
+	if eps.Hostnames != nil {
+		eps.HostAddrs = map[string]string{}
+		for addr, hostname := range eps.Hostnames {
+			if hostAddr, ok := d.hostAddrs[hostname]; ok {
+				eps.HostAddrs[addr] = hostAddr
+			}
+		}
+	}
+	for _, m := range d.serviceManagers {
+		m.OnEndpointsUpdate(eps)
+	}
+}
+
+// onHostAddrUpdate records the address of a host, or its removal if addr
+// is empty, and updates the endpoints that run on the host.
+func (d *HostDataplane) onHostAddrUpdate(hostname, addr string) {
+	if d.config.Services == nil {
+		return
+	}
+	if addr == "" {
+		delete(d.hostAddrs, hostname)
+	} else {
+		d.hostAddrs[hostname] = addr
+	}
+	if hostname == d.config.Services.Hostname {
+		d.enableDSR()
+	}
+	for _, eps := range d.serviceEndpoints {
+		for _, epHostname := range eps.Hostnames {
+			if epHostname == hostname {
+				d.updateEndpoints(eps)
+				break
+			}
+		}
+	}
+}
+
+// enableDSR enables DSR once we know our host's address, and again if it
+// changes.  If our host's address is removed, we carry on with the old one.
+func (d *HostDataplane) enableDSR() {
+	if !d.config.Services.DSREnabled {
+		return
+	}
+	addr := d.hostAddrs[d.config.Services.Hostname]
+	if addr == "" || addr == d.dsrHostAddr {
+		return
+	}
+	log.WithField("hostAddr", addr).Info("Enabling DSR")
+	d.dsrHostAddr = addr
+	d.dsrManager.EnableDSR(addr, d.dsrMangleTable, d.config.PolicyRouting)
+}
+
+// markTablesDirty marks the tables with the given names, of both IP
+// versions, for update.
+func (d *HostDataplane) markTablesDirty(names ...string) {
+	for _, t := range d.tables {
+		for _, name := range names {
+			if t.name == name {
+				t.dirty = true
+			}
+		}
+	}
+}
+
+// sortedWorkloadEndpoints returns the workload endpoints sorted by interface
+// name, so that we render their rules in a stable order.
+func (d *HostDataplane) sortedWorkloadEndpoints() []*proto.WorkloadEndpoint {
+	eps := make([]*proto.WorkloadEndpoint, 0, len(d.workloadEndpoints))
+	for _, ep := range d.workloadEndpoints {
+		eps = append(eps, ep)
+	}
+	sort.Sort(endpointsByName(eps))
+	return eps
+}
+
+type endpointsByName []*proto.WorkloadEndpoint
+
+func (e endpointsByName) Len() int           { return len(e) }
+func (e endpointsByName) Less(i, j int) bool { return e[i].Name < e[j].Name }
+func (e endpointsByName) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// conntrackZones returns the conntrack zones of the workload endpoints that
+// are in a zone other than the default.
+func (d *HostDataplane) conntrackZones() []rules.EndpointConntrackZone {
+	var zones []rules.EndpointConntrackZone
+	for _, ep := range d.sortedWorkloadEndpoints() {
+		if ep.ConntrackZone == 0 {
+			continue
+		}
+		var addrs []string
+		addrs = append(addrs, ep.Ipv4Nets...)
+		addrs = append(addrs, ep.Ipv6Nets...)
+		zones = append(zones, rules.EndpointConntrackZone{
+			IfaceName: ep.Name,
+			Addrs:     addrs,
+			Zone:      uint16(ep.ConntrackZone),
+		})
+	}
+	return zones
+}
+
+// endpointDSCPs returns the DSCP values that the workload endpoints have
+// requested.
+func (d *HostDataplane) endpointDSCPs() []rules.EndpointDSCP {
+	var dscps []rules.EndpointDSCP
+	for _, ep := range d.sortedWorkloadEndpoints() {
+		if ep.Dscp == nil {
+			continue
+		}
+		dscps = append(dscps, rules.EndpointDSCP{
+			IfaceName: ep.Name,
+			DSCP:      uint8(ep.Dscp.Value),
+		})
+	}
+	return dscps
+}
+
+// apply renders the chains of each dirty table and applies them, then
+// applies the policy routing.  Tables that fail are left dirty so that they
+// are retried once their backoff expires.
+func (d *HostDataplane) apply() {
+	// The ServiceManagers queue their changes with our tables, marking
+	// them dirty.
+	for _, m := range d.serviceManagers {
+		m.CompleteDeferredWork()
+	}
+	for _, t := range d.tables {
+		if !t.dirty {
+			continue
+		}
+		err := d.backoffs.Apply(t.key(), func() error {
+			d.updateTable(t)
+			return t.table.Apply()
+		})
+		if err != nil {
+			if err != backoff.ErrBackingOff {
+				log.WithError(err).WithFields(log.Fields{
+					"table":     t.name,
+					"ipVersion": t.ipVersion,
+				}).Warn("Failed to update host dataplane table, will retry")
+			}
+			continue
+		}
+		t.dirty = false
+	}
+	if d.config.PolicyRouting == nil {
+		return
+	}
+	// The RouteManager tracks whether it's dirty itself, and stays dirty
+	// if it fails.
+	err := d.backoffs.Apply(policyRoutingKey, d.config.PolicyRouting.Apply)
+	if err != nil && err != backoff.ErrBackingOff {
+		log.WithError(err).Warn("Failed to update policy routing, will retry")
+	}
+}
+
+// updateTable queues the table's chains, and the removal of the chains that
+// we no longer want, with the Table.
+func (d *HostDataplane) updateTable(t *tableState) {
+	chains := d.renderTables(t.ipVersion)[t.name]
+	newNames := map[string]bool{}
+	for _, chain := range chains {
+		newNames[chain.Name] = true
+	}
+	t.table.UpdateChains(chains)
+	for name := range t.chainNames {
+		if !newNames[name] {
+			t.table.RemoveChainByName(name)
+		}
+	}
+	t.chainNames = newNames
+	if driverTables[t.name] {
+		return
+	}
+	for _, chainName := range dispatchChains[t.name] {
+		t.table.SetRuleInsertions(kernelChains[chainName], []iptables.Rule{
+			{Action: iptables.JumpAction{Target: chainName}},
+		})
+	}
+}
+
+// renderTables renders all of our chains of the given IP version, including
+// the dispatch chains, by table.  The order of the hooks sets the order of
+// the jumps in each dispatch chain.
+func (d *HostDataplane) renderTables(ipVersion uint8) map[string][]*iptables.Chain {
+	c := newTableChains()
+	// Accounting comes first so that it counts the traffic that the
+	// chains below drop.
+	accounting := d.renderer.AccountingChain(ipVersion)
+	c.hook("filter", ChainInput, accounting)
+	c.hook("filter", ChainForward, accounting)
+	c.hook("filter", ChainOutput, accounting)
+	threatFeeds := d.renderer.ThreatFeedChain(ipVersion)
+	c.hook("filter", ChainInput, threatFeeds)
+	c.hook("filter", ChainForward, threatFeeds)
+	c.hook("filter", ChainOutput, threatFeeds)
+	portScanBan := d.renderer.PortScanBanChain(ipVersion)
+	c.hook("filter", ChainInput, portScanBan)
+	c.hook("filter", ChainForward, portScanBan)
+	// The driver's host endpoint chains jump to the detection chain
+	// before they drop a packet.
+	c.add("filter", d.renderer.PortScanDetectChain(ipVersion))
+	if d.config.DNSPolicyEnabled {
+		dnsSnoop := d.renderer.DNSSnoopChain(ipVersion)
+		c.hook("filter", ChainInput, dnsSnoop)
+		c.hook("filter", ChainForward, dnsSnoop)
+	}
+	// Port forwards are IPv4-only; the SYN flood chain has to leave their
+	// SYNs tracked so that they can be DNATted.
+	var forwards []rules.PortForward
+	if ipVersion == 4 {
+		forwards = d.portForwards
+	}
+	c.hook("raw", ChainPrerouting, d.renderer.SynFloodRawChain(forwards))
+	// The zones have to be set before conntrack sees the packet, for both
+	// the traffic that we route to the workloads and the traffic that the
+	// host sends them.
+	ctZones := d.renderer.ConntrackZoneChain(d.conntrackZones(), ipVersion)
+	c.hook("raw", ChainPrerouting, ctZones)
+	c.hook("raw", ChainOutput, ctZones)
+	c.hook("filter", ChainInput, d.renderer.SynFloodChain())
+	c.hook("filter", ChainForward, d.renderer.NAT64ForwardChain(ipVersion))
+	if ipVersion == 4 {
+		// The egress gateway is IPv4-only.  Its NAT chain has to come
+		// before any other source NAT.
+		c.hook("mangle", ChainPrerouting, d.renderer.EgressGatewayMarkChain())
+		c.hook("nat", ChainPostrouting, d.renderer.EgressGatewayNATChain())
+		// The translator's IPv4 side is masqueraded to the host's
+		// address.
+		c.hook("nat", ChainPostrouting, d.renderer.NAT64MasqChain())
+		// Port forwards are IPv4-only.
+		fwdDNAT := d.renderer.PortForwardDNATChain(d.portForwards)
+		c.hook("nat", ChainPrerouting, fwdDNAT)
+		c.hook("nat", ChainOutput, fwdDNAT)
+		c.hook("filter", ChainForward, d.renderer.PortForwardAllowChain(d.portForwards))
+	}
+	// The DSCP chain follows the egress gateway's mark chain, which never
+	// terminates the traffic, so both apply to the workloads' traffic.
+	c.hook("mangle", ChainPrerouting, d.renderer.DSCPChain(d.endpointDSCPs()))
+	// The services come last; their DNAT only applies to the cluster IPs
+	// and node ports.
+	for _, t := range d.tables {
+		if t.ipVersion == ipVersion && t.services != nil {
+			t.services.addTo(c, t.name)
+		}
+	}
+	return c.render()
+}
+
+// tableChains accumulates the chains of each table, and the jumps to them
+// from the dispatch chains.
+type tableChains struct {
+	chains map[string][]*iptables.Chain
+	seen   map[string]map[string]bool
+	jumps  map[string]map[string][]iptables.Rule
+}
+
+func newTableChains() *tableChains {
+	c := &tableChains{
+		chains: map[string][]*iptables.Chain{},
+		seen:   map[string]map[string]bool{},
+		jumps:  map[string]map[string][]iptables.Rule{},
+	}
+	for _, name := range tableNames {
+		c.seen[name] = map[string]bool{}
+		c.jumps[name] = map[string][]iptables.Rule{}
+	}
+	return c
+}
+
+// hook adds a jump to the chain to the end of the given dispatch chain, and
+// the chain itself to the table, unless the chain is empty.  A chain may be
+// hooked into several dispatch chains.
+func (c *tableChains) hook(table, dispatchChain string, chain *iptables.Chain) {
+	if len(chain.Rules) == 0 {
+		return
+	}
+	c.add(table, chain)
+	c.addJumpRules(table, dispatchChain, []iptables.Rule{
+		{Action: iptables.JumpAction{Target: chain.Name}},
+	})
+}
+
+// add adds the chain to the table, without a jump from a dispatch chain,
+// unless the chain is empty or already added.
+func (c *tableChains) add(table string, chain *iptables.Chain) {
+	if len(chain.Rules) == 0 || c.seen[table][chain.Name] {
+		return
+	}
+	c.chains[table] = append(c.chains[table], chain)
+	c.seen[table][chain.Name] = true
+}
+
+// addReferenced adds the chain to the table even if it's empty, for chains
+// that other chains jump to.
+func (c *tableChains) addReferenced(table string, chain *iptables.Chain) {
+	if c.seen[table][chain.Name] {
+		return
+	}
+	c.chains[table] = append(c.chains[table], chain)
+	c.seen[table][chain.Name] = true
+}
+
+// addJumpRules adds the rules to the end of the given dispatch chain.
+func (c *tableChains) addJumpRules(table, dispatchChain string, rules []iptables.Rule) {
+	c.jumps[table][dispatchChain] = append(c.jumps[table][dispatchChain], rules...)
+}
+
+// render returns the chains of each table, followed by its dispatch chains,
+// which always exist.
+func (c *tableChains) render() map[string][]*iptables.Chain {
+	tables := map[string][]*iptables.Chain{}
+	for _, table := range tableNames {
+		chains := c.chains[table]
+		for _, chainName := range dispatchChains[table] {
+			rules := c.jumps[table][chainName]
+			if rules == nil {
+				rules = []iptables.Rule{}
+			}
+			chains = append(chains, &iptables.Chain{
+				Name:  chainName,
+				Rules: rules,
+			})
+		}
+		tables[table] = chains
+	}
+	return tables
+}
+
+// serviceTable implements services.Table for one of our tables.  It holds
+// on to the ServiceManager's chains and insertions so that we can program
+// them with our own chains, and turns the insertions into rules of our
+// dispatch chains, which the kernel chains already jump to.
+type serviceTable struct {
+	state      *tableState
+	chains     map[string]*iptables.Chain
+	insertions map[string][]iptables.Rule
+}
+
+func newServiceTable(state *tableState) *serviceTable {
+	return &serviceTable{
+		state:      state,
+		chains:     map[string]*iptables.Chain{},
+		insertions: map[string][]iptables.Rule{},
+	}
+}
+
+func (t *serviceTable) UpdateChains(chains []*iptables.Chain) {
+	for _, chain := range chains {
+		t.chains[chain.Name] = chain
+	}
+	t.state.dirty = true
+}
+
+func (t *serviceTable) RemoveChainByName(name string) {
+	delete(t.chains, name)
+	t.state.dirty = true
+}
+
+func (t *serviceTable) SetRuleInsertions(chainName string, rules []iptables.Rule) {
+	t.insertions[chainName] = rules
+	t.state.dirty = true
+}
+
+// addTo adds the chains, sorted by name, and the insertions to c.
+func (t *serviceTable) addTo(c *tableChains, table string) {
+	names := make([]string, 0, len(t.chains))
+	for name := range t.chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.addReferenced(table, t.chains[name])
+	}
+	for _, dispatchChain := range dispatchChains[table] {
+		c.addJumpRules(table, dispatchChain, t.insertions[kernelChains[dispatchChain]])
+	}
+	for kernelChain := range t.insertions {
+		if !hasDispatchChain(table, kernelChain) {
+			log.WithFields(log.Fields{
+				"table": table,
+				"chain": kernelChain,
+			}).Error("Ignoring service rules inserted into a kernel chain that we don't dispatch")
+		}
+	}
+}
+
+func hasDispatchChain(table, kernelChain string) bool {
+	for _, dispatchChain := range dispatchChains[table] {
+		if kernelChains[dispatchChain] == kernelChain {
+			return true
+		}
+	}
+	return false
+}
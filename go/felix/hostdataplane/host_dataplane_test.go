@@ -0,0 +1,1107 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostdataplane_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/hostdataplane"
+
+	"errors"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"github.com/projectcalico/felix/go/felix/services"
+	"net"
+	"sync"
+	"time"
+)
+
+type mockDriver struct {
+	lock sync.Mutex
+	sent []interface{}
+}
+
+func (d *mockDriver) SendMessage(msg interface{}) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.sent = append(d.sent, msg)
+	return nil
+}
+
+func (d *mockDriver) RecvMessage() (interface{}, error) {
+	return &proto.ProcessStatusUpdate{}, nil
+}
+
+// mockTable records the chains and insertions that have been applied.
+type mockTable struct {
+	lock       sync.Mutex
+	pending    map[string]*iptables.Chain
+	removed    map[string]bool
+	inserts    map[string][]iptables.Rule
+	chains     map[string]*iptables.Chain
+	applied    map[string][]iptables.Rule
+	numApplies int
+	failApply  bool
+	numInvalid int
+}
+
+func newMockTable() *mockTable {
+	return &mockTable{
+		pending: map[string]*iptables.Chain{},
+		removed: map[string]bool{},
+		inserts: map[string][]iptables.Rule{},
+		chains:  map[string]*iptables.Chain{},
+		applied: map[string][]iptables.Rule{},
+	}
+}
+
+func (t *mockTable) UpdateChains(chains []*iptables.Chain) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, chain := range chains {
+		t.pending[chain.Name] = chain
+		delete(t.removed, chain.Name)
+	}
+}
+
+func (t *mockTable) RemoveChainByName(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.pending, name)
+	t.removed[name] = true
+}
+
+func (t *mockTable) SetRuleInsertions(chainName string, rules []iptables.Rule) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.inserts[chainName] = rules
+}
+
+func (t *mockTable) InvalidateDataplaneCache() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.numInvalid++
+}
+
+func (t *mockTable) Apply() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.numApplies++
+	if t.failApply {
+		return errors.New("iptables-restore failed")
+	}
+	for name, chain := range t.pending {
+		t.chains[name] = chain
+	}
+	for name := range t.removed {
+		delete(t.chains, name)
+	}
+	t.pending = map[string]*iptables.Chain{}
+	t.removed = map[string]bool{}
+	for name, rules := range t.inserts {
+		t.applied[name] = rules
+	}
+	return nil
+}
+
+// ChainNames returns the names of the chains in the table.
+func (t *mockTable) ChainNames() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var names []string
+	for name := range t.chains {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Chain returns the rules of the given chain, or nil if it isn't in the
+// table.
+func (t *mockTable) Chain(name string) []iptables.Rule {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if chain := t.chains[name]; chain != nil {
+		return chain.Rules
+	}
+	return nil
+}
+
+func (t *mockTable) Insertions(chainName string) []iptables.Rule {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.applied[chainName]
+}
+
+func (t *mockTable) NumApplies() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.numApplies
+}
+
+func (t *mockTable) SetFailApply(fail bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.failApply = fail
+}
+
+type mockRouteManager struct {
+	lock         sync.Mutex
+	egressRoute  rules.EgressGatewayRoute
+	haveEgressGW bool
+	dsrRoutes    []rules.DSRRoute
+	numApplies   int
+	numResyncs   int
+	failApply    bool
+}
+
+func (m *mockRouteManager) SetEgressGatewayRoute(route rules.EgressGatewayRoute, ok bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.egressRoute, m.haveEgressGW = route, ok
+}
+
+func (m *mockRouteManager) SetDSRRoutes(routes []rules.DSRRoute) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dsrRoutes = routes
+}
+
+func (m *mockRouteManager) DSRRoutes() []rules.DSRRoute {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.dsrRoutes
+}
+
+func (m *mockRouteManager) QueueResync() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.numResyncs++
+}
+
+func (m *mockRouteManager) Apply() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.numApplies++
+	if m.failApply {
+		return errors.New("ip rule failed")
+	}
+	return nil
+}
+
+func (m *mockRouteManager) NumApplies() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.numApplies
+}
+
+func (m *mockRouteManager) NumResyncs() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.numResyncs
+}
+
+// mockConntrack records the flows that have been removed.
+type mockConntrack struct {
+	lock         sync.Mutex
+	pending      []string
+	removed      []string
+	pendingMarks []uint32
+	removedMarks []uint32
+}
+
+func (c *mockConntrack) QueueFlowRemoval(ipAddr net.IP) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pending = append(c.pending, ipAddr.String())
+}
+
+func (c *mockConntrack) QueueMarkedFlowRemoval(mark uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pendingMarks = append(c.pendingMarks, mark)
+}
+
+func (c *mockConntrack) Flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removed = append(c.removed, c.pending...)
+	c.pending = nil
+	c.removedMarks = append(c.removedMarks, c.pendingMarks...)
+	c.pendingMarks = nil
+}
+
+func (c *mockConntrack) RemovedMarks() []uint32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.removedMarks
+}
+
+func (c *mockConntrack) Removed() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.removed
+}
+
+func jumpTo(chainNames ...string) []iptables.Rule {
+	rules := []iptables.Rule{}
+	for _, name := range chainNames {
+		rules = append(rules, iptables.Rule{Action: iptables.JumpAction{Target: name}})
+	}
+	return rules
+}
+
+var _ = Describe("HostDataplane", func() {
+	var inner *mockDriver
+	var tables map[string]*mockTable
+	var renderer rules.RuleRenderer
+	var config Config
+	var dp *HostDataplane
+
+	fwd := rules.PortForward{
+		Protocol:     "tcp",
+		ExternalIP:   "203.0.113.5",
+		ExternalPort: 80,
+		WorkloadIP:   "10.65.0.2",
+		WorkloadPort: 8080,
+	}
+
+	BeforeEach(func() {
+		inner = &mockDriver{}
+		tables = map[string]*mockTable{}
+		renderer = rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+		})
+		config = Config{
+			IPv6Enabled:   true,
+			RetryInterval: 10 * time.Millisecond,
+		}
+	})
+
+	start := func() {
+		dp = NewHostDataplaneDriver(inner, renderer,
+			func(name string, ipVersion uint8) Table {
+				table := newMockTable()
+				tables[fmt.Sprintf("%s-v%d", name, ipVersion)] = table
+				return table
+			}, config)
+		dp.Start()
+	}
+
+	It("should pass updates through to the inner driver", func() {
+		start()
+		msg := &proto.InSync{}
+		Expect(dp.SendMessage(msg)).To(Succeed())
+		Expect(inner.sent).To(Equal([]interface{}{msg}))
+	})
+
+	It("should not block the sender while the loop isn't running", func() {
+		dp = NewHostDataplaneDriver(inner, renderer,
+			func(name string, ipVersion uint8) Table {
+				table := newMockTable()
+				tables[fmt.Sprintf("%s-v%d", name, ipVersion)] = table
+				return table
+			}, config)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 1000; i++ {
+				dp.SendMessage(&proto.InSync{})
+			}
+		}()
+		Eventually(done).Should(BeClosed())
+		dp.Start()
+		Eventually(tables["filter-v4"].NumApplies).Should(Equal(1))
+	})
+
+	It("should create a table of each type and IP version", func() {
+		start()
+		Expect(tables).To(HaveLen(8))
+		for _, name := range []string{"raw", "mangle", "nat", "filter"} {
+			Expect(tables).To(HaveKey(name + "-v4"))
+			Expect(tables).To(HaveKey(name + "-v6"))
+		}
+	})
+
+	It("should only create IPv4 tables if IPv6 is disabled", func() {
+		config.IPv6Enabled = false
+		start()
+		Expect(tables).To(HaveLen(4))
+		Expect(tables).NotTo(HaveKey("filter-v6"))
+	})
+
+	It("should wait for the datastore to be in sync", func() {
+		start()
+		Consistently(tables["filter-v4"].NumApplies, "50ms").Should(BeZero())
+		dp.SendMessage(&proto.InSync{})
+		Eventually(tables["filter-v4"].NumApplies).Should(Equal(1))
+	})
+
+	Describe("with no features configured", func() {
+		BeforeEach(func() {
+			start()
+			dp.SendMessage(&proto.InSync{})
+			Eventually(tables["filter-v6"].NumApplies).Should(Equal(1))
+		})
+
+		It("should program empty dispatch chains", func() {
+			Expect(tables["filter-v4"].ChainNames()).To(ConsistOf(
+				ChainInput, ChainForward, ChainOutput))
+			Expect(tables["filter-v4"].Chain(ChainForward)).To(BeEmpty())
+			Expect(tables["nat-v4"].ChainNames()).To(ConsistOf(
+				ChainPrerouting, ChainOutput, ChainPostrouting))
+			Expect(tables["mangle-v6"].ChainNames()).To(ConsistOf(ChainPrerouting))
+			Expect(tables["raw-v6"].ChainNames()).To(ConsistOf(ChainPrerouting, ChainOutput))
+		})
+
+		It("should jump to the raw and mangle dispatch chains", func() {
+			Expect(tables["raw-v4"].Insertions("PREROUTING")).To(Equal(jumpTo(ChainPrerouting)))
+			Expect(tables["raw-v4"].Insertions("OUTPUT")).To(Equal(jumpTo(ChainOutput)))
+			Expect(tables["mangle-v6"].Insertions("PREROUTING")).To(Equal(jumpTo(ChainPrerouting)))
+		})
+
+		It("should leave the filter and nat jumps to the driver", func() {
+			Expect(tables["filter-v4"].Insertions("INPUT")).To(BeNil())
+			Expect(tables["nat-v4"].Insertions("PREROUTING")).To(BeNil())
+		})
+
+		It("should only apply again after a refresh", func() {
+			Consistently(tables["filter-v4"].NumApplies, "50ms").Should(Equal(1))
+		})
+	})
+
+	Describe("with port forwards", func() {
+		BeforeEach(func() {
+			config.PortForwards = []rules.PortForward{
+				fwd,
+				// Conflicts with the first forward.
+				{
+					Protocol:     "tcp",
+					ExternalIP:   "203.0.113.5",
+					ExternalPort: 80,
+					WorkloadIP:   "10.65.0.3",
+					WorkloadPort: 8080,
+				},
+			}
+			start()
+			dp.SendMessage(&proto.InSync{})
+			Eventually(tables["filter-v6"].NumApplies).Should(Equal(1))
+		})
+
+		It("should program the DNAT chain and hook it into PREROUTING and OUTPUT", func() {
+			expected := renderer.PortForwardDNATChain([]rules.PortForward{fwd})
+			Expect(tables["nat-v4"].Chain(rules.ChainFwdDNAT)).To(Equal(expected.Rules))
+			Expect(tables["nat-v4"].Chain(ChainPrerouting)).To(Equal(jumpTo(rules.ChainFwdDNAT)))
+			Expect(tables["nat-v4"].Chain(ChainOutput)).To(Equal(jumpTo(rules.ChainFwdDNAT)))
+		})
+
+		It("should program the allow chain and hook it into FORWARD", func() {
+			expected := renderer.PortForwardAllowChain([]rules.PortForward{fwd})
+			Expect(tables["filter-v4"].Chain(rules.ChainFwdAllow)).To(Equal(expected.Rules))
+			Expect(tables["filter-v4"].Chain(ChainForward)).To(Equal(jumpTo(rules.ChainFwdAllow)))
+		})
+
+		It("should not program port forwards for IPv6", func() {
+			Expect(tables["nat-v6"].ChainNames()).NotTo(ContainElement(rules.ChainFwdDNAT))
+			Expect(tables["filter-v6"].Chain(ChainForward)).To(BeEmpty())
+		})
+	})
+
+	Describe("with SYN flood protection", func() {
+		BeforeEach(func() {
+			renderer = rules.NewRenderer(rules.Config{
+				WorkloadIfacePrefixes: []string{"cali"},
+				SynFloodInterfaces:    []string{"eth0"},
+				SynFloodRateLimit:     100,
+				SynFloodBurst:         200,
+				SynproxyEnabled:       true,
+			})
+			start()
+			dp.SendMessage(&proto.InSync{})
+			Eventually(tables["filter-v6"].NumApplies).Should(Equal(1))
+		})
+
+		It("should program the SYN flood chain and hook it into INPUT", func() {
+			for _, key := range []string{"filter-v4", "filter-v6"} {
+				Expect(tables[key].Chain(rules.ChainSynFlood)).To(Equal(renderer.SynFloodChain().Rules))
+				Expect(tables[key].Chain(ChainInput)).To(Equal(jumpTo(rules.ChainSynFlood)))
+			}
+		})
+
+		It("should program the raw chain and hook it into raw PREROUTING", func() {
+			for _, key := range []string{"raw-v4", "raw-v6"} {
+				Expect(tables[key].Chain(rules.ChainSynFloodRaw)).To(Equal(renderer.SynFloodRawChain(nil).Rules))
+				Expect(tables[key].Chain(ChainPrerouting)).To(Equal(jumpTo(rules.ChainSynFloodRaw)))
+			}
+		})
+	})
+
+	It("should leave the SYNs of IPv4 port forwards tracked", func() {
+		renderer = rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+			SynFloodInterfaces:    []string{"eth0"},
+			SynFloodRateLimit:     100,
+			SynFloodBurst:         200,
+			SynproxyEnabled:       true,
+		})
+		config.PortForwards = []rules.PortForward{fwd}
+		start()
+		dp.SendMessage(&proto.InSync{})
+		Eventually(tables["raw-v6"].NumApplies).Should(Equal(1))
+		Expect(tables["raw-v4"].Chain(rules.ChainSynFloodRaw)).To(Equal(
+			renderer.SynFloodRawChain([]rules.PortForward{fwd}).Rules))
+		Expect(tables["raw-v6"].Chain(rules.ChainSynFloodRaw)).To(Equal(
+			renderer.SynFloodRawChain(nil).Rules))
+	})
+
+	It("should skip the SYN flood raw chain if SYNPROXY is disabled", func() {
+		renderer = rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+			SynFloodInterfaces:    []string{"eth0"},
+			SynFloodRateLimit:     100,
+			SynFloodBurst:         200,
+		})
+		start()
+		dp.SendMessage(&proto.InSync{})
+		Eventually(tables["filter-v4"].NumApplies).Should(Equal(1))
+		Expect(tables["filter-v4"].Chain(ChainInput)).To(Equal(jumpTo(rules.ChainSynFlood)))
+		Expect(tables["raw-v4"].ChainNames()).To(ConsistOf(ChainPrerouting, ChainOutput))
+	})
+
+	Describe("with port scan detection", func() {
+		BeforeEach(func() {
+			renderer = rules.NewRenderer(rules.Config{
+				WorkloadIfacePrefixes: []string{"cali"},
+				PortScanInterfaces:    []string{"eth0"},
+				PortScanRateLimit:     5,
+				PortScanBurst:         20,
+				PortScanBanSecs:       600,
+				SynFloodInterfaces:    []string{"eth0"},
+				SynFloodRateLimit:     100,
+				SynFloodBurst:         200,
+			})
+			start()
+			dp.SendMessage(&proto.InSync{})
+			Eventually(tables["filter-v6"].NumApplies).Should(Equal(1))
+		})
+
+		It("should hook the ban chain into INPUT, ahead of SYN flood protection, and FORWARD", func() {
+			Expect(tables["filter-v4"].Chain(rules.ChainPortScanBan)).To(Equal(renderer.PortScanBanChain(4).Rules))
+			Expect(tables["filter-v6"].Chain(rules.ChainPortScanBan)).To(Equal(renderer.PortScanBanChain(6).Rules))
+			Expect(tables["filter-v4"].Chain(ChainInput)).To(Equal(
+				jumpTo(rules.ChainPortScanBan, rules.ChainSynFlood)))
+			Expect(tables["filter-v4"].Chain(ChainForward)).To(Equal(jumpTo(rules.ChainPortScanBan)))
+		})
+
+		It("should program the detection chain for the driver to jump to", func() {
+			Expect(tables["filter-v4"].Chain(rules.ChainPortScanDetect)).To(Equal(renderer.PortScanDetectChain(4).Rules))
+			Expect(tables["filter-v6"].Chain(rules.ChainPortScanDetect)).To(Equal(renderer.PortScanDetectChain(6).Rules))
+			for _, chainName := range []string{ChainInput, ChainForward, ChainOutput} {
+				Expect(tables["filter-v4"].Chain(chainName)).NotTo(ContainElement(
+					jumpTo(rules.ChainPortScanDetect)[0]))
+			}
+		})
+	})
+
+	It("should hook the threat feed chain into each filter chain, ahead of the port scan ban", func() {
+		renderer = rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+			ThreatFeedNames:       []string{"feed-1"},
+			PortScanInterfaces:    []string{"eth0"},
+		})
+		start()
+		dp.SendMessage(&proto.InSync{})
+		Eventually(tables["filter-v6"].NumApplies).Should(Equal(1))
+		Expect(tables["filter-v4"].Chain(rules.ChainThreatFeeds)).To(Equal(renderer.ThreatFeedChain(4).Rules))
+		Expect(tables["filter-v6"].Chain(rules.ChainThreatFeeds)).To(Equal(renderer.ThreatFeedChain(6).Rules))
+		Expect(tables["filter-v4"].Chain(ChainInput)).To(Equal(
+			jumpTo(rules.ChainThreatFeeds, rules.ChainPortScanBan)))
+		Expect(tables["filter-v4"].Chain(ChainForward)).To(Equal(
+			jumpTo(rules.ChainThreatFeeds, rules.ChainPortScanBan)))
+		Expect(tables["filter-v4"].Chain(ChainOutput)).To(Equal(jumpTo(rules.ChainThreatFeeds)))
+	})
+
+	It("should hook the accounting chain into each filter chain, ahead of the threat feeds", func() {
+		renderer = rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+			ThreatFeedNames:       []string{"feed-1"},
+			NfacctClasses: []rules.NfacctClass{
+				{Name: "internal", CIDR: "10.0.0.0/8"},
+			},
+		})
+		start()
+		dp.SendMessage(&proto.InSync{})
+		Eventually(tables["filter-v6"].NumApplies).Should(Equal(1))
+		Expect(tables["filter-v4"].Chain(rules.ChainAccounting)).To(Equal(renderer.AccountingChain(4).Rules))
+		for _, chainName := range []string{ChainInput, ChainForward, ChainOutput} {
+			Expect(tables["filter-v4"].Chain(chainName)).To(Equal(
+				jumpTo(rules.ChainAccounting, rules.ChainThreatFeeds)))
+		}
+		// The only class is IPv4, so the IPv6 chain is empty.
+		Expect(tables["filter-v6"].ChainNames()).NotTo(ContainElement(rules.ChainAccounting))
+		Expect(tables["filter-v6"].Chain(ChainOutput)).To(Equal(jumpTo(rules.ChainThreatFeeds)))
+	})
+
+	It("should hook the DNS snoop chain into INPUT and FORWARD if DNS policy is enabled", func() {
+		renderer = rules.NewRenderer(rules.Config{
+			WorkloadIfacePrefixes: []string{"cali"},
+			DNSTrustedServers:     []string{"10.0.0.53"},
+			SynFloodInterfaces:    []string{"eth0"},
+		})
+		config.DNSPolicyEnabled = true
+		start()
+		dp.SendMessage(&proto.InSync{})
+		Eventually(tables["filter-v6"].NumApplies).Should(Equal(1))
+		Expect(tables["filter-v4"].Chain(rules.ChainDNSSnoop)).To(Equal(renderer.DNSSnoopChain(4).Rules))
+		Expect(tables["filter-v4"].Chain(ChainInput)).To(Equal(
+			jumpTo(rules.ChainDNSSnoop, rules.ChainSynFlood)))
+		Expect(tables["filter-v4"].Chain(ChainForward)).To(Equal(jumpTo(rules.ChainDNSSnoop)))
+		// There are no trusted IPv6 servers.
+		Expect(tables["filter-v6"].ChainNames()).NotTo(ContainElement(rules.ChainDNSSnoop))
+	})
+
+	It("should not snoop DNS if DNS policy is disabled", func() {
+		start()
+		dp.SendMessage(&proto.InSync{})
+		Eventually(tables["filter-v4"].NumApplies).Should(Equal(1))
+		Expect(tables["filter-v4"].ChainNames()).NotTo(ContainElement(rules.ChainDNSSnoop))
+	})
+
+	Describe("with NAT64", func() {
+		BeforeEach(func() {
+			renderer = rules.NewRenderer(rules.Config{
+				WorkloadIfacePrefixes: []string{"cali"},
+				NAT64Prefix:           "64:ff9b::/96",
+				NAT64IPv4Pool:         "192.168.255.0/24",
+				NAT64Device:           "nat64",
+			})
+			config.PortForwards = []rules.PortForward{fwd}
+			start()
+			dp.SendMessage(&proto.InSync{})
+			Eventually(tables["filter-v6"].NumApplies).Should(Equal(1))
+		})
+
+		It("should hook the forward chain into FORWARD, ahead of the port forwards", func() {
+			Expect(tables["filter-v4"].Chain(rules.ChainNAT64Forward)).To(Equal(renderer.NAT64ForwardChain(4).Rules))
+			Expect(tables["filter-v6"].Chain(rules.ChainNAT64Forward)).To(Equal(renderer.NAT64ForwardChain(6).Rules))
+			Expect(tables["filter-v4"].Chain(ChainForward)).To(Equal(
+				jumpTo(rules.ChainNAT64Forward, rules.ChainFwdAllow)))
+			Expect(tables["filter-v6"].Chain(ChainForward)).To(Equal(jumpTo(rules.ChainNAT64Forward)))
+		})
+
+		It("should hook the masquerade chain into IPv4 POSTROUTING", func() {
+			Expect(tables["nat-v4"].Chain(rules.ChainNAT64Masq)).To(Equal(renderer.NAT64MasqChain().Rules))
+			Expect(tables["nat-v4"].Chain(ChainPostrouting)).To(Equal(jumpTo(rules.ChainNAT64Masq)))
+			Expect(tables["nat-v6"].Chain(ChainPostrouting)).To(BeEmpty())
+		})
+	})
+
+	Describe("with workload endpoints", func() {
+		zoned := &proto.WorkloadEndpointUpdate{
+			Id: &proto.WorkloadEndpointID{
+				OrchestratorId: "k8s",
+				WorkloadId:     "tenant-a/web",
+				EndpointId:     "eth0",
+			},
+			Endpoint: &proto.WorkloadEndpoint{
+				Name:          "cali1234",
+				Ipv4Nets:      []string{"10.65.0.2/32"},
+				Ipv6Nets:      []string{"fd00::2/128"},
+				ConntrackZone: 5,
+				Dscp:          &proto.DSCP{Value: 46},
+			},
+		}
+		zones := []rules.EndpointConntrackZone{{
+			IfaceName: "cali1234",
+			Addrs:     []string{"10.65.0.2/32", "fd00::2/128"},
+			Zone:      5,
+		}}
+
+		BeforeEach(func() {
+			start()
+			dp.SendMessage(zoned)
+			dp.SendMessage(&proto.WorkloadEndpointUpdate{
+				Id: &proto.WorkloadEndpointID{
+					OrchestratorId: "k8s",
+					WorkloadId:     "default/db",
+					EndpointId:     "eth0",
+				},
+				Endpoint: &proto.WorkloadEndpoint{
+					Name:     "cali5678",
+					Ipv4Nets: []string{"10.65.0.3/32"},
+				},
+			})
+			dp.SendMessage(&proto.InSync{})
+			Eventually(tables["raw-v6"].NumApplies).Should(Equal(1))
+		})
+
+		It("should hook the zone chain into raw PREROUTING and OUTPUT", func() {
+			for _, ipVersion := range []uint8{4, 6} {
+				key := fmt.Sprintf("raw-v%d", ipVersion)
+				Expect(tables[key].Chain(rules.ChainConntrackZones)).To(Equal(
+					renderer.ConntrackZoneChain(zones, ipVersion).Rules))
+				Expect(tables[key].Chain(ChainPrerouting)).To(Equal(jumpTo(rules.ChainConntrackZones)))
+				Expect(tables[key].Chain(ChainOutput)).To(Equal(jumpTo(rules.ChainConntrackZones)))
+			}
+		})
+
+		It("should remove the zone chain once the workload is removed", func() {
+			dp.SendMessage(&proto.WorkloadEndpointRemove{Id: zoned.Id})
+			Eventually(tables["raw-v4"].NumApplies).Should(Equal(2))
+			Expect(tables["raw-v4"].ChainNames()).To(ConsistOf(ChainPrerouting, ChainOutput))
+			Expect(tables["raw-v4"].Chain(ChainPrerouting)).To(BeEmpty())
+		})
+
+		It("should hook the DSCP chain into mangle PREROUTING", func() {
+			expected := renderer.DSCPChain([]rules.EndpointDSCP{{IfaceName: "cali1234", DSCP: 46}})
+			for _, key := range []string{"mangle-v4", "mangle-v6"} {
+				Expect(tables[key].Chain(rules.ChainDSCP)).To(Equal(expected.Rules))
+				Expect(tables[key].Chain(ChainPrerouting)).To(Equal(jumpTo(rules.ChainDSCP)))
+			}
+		})
+
+		It("should remove the DSCP chain once the workload is removed", func() {
+			dp.SendMessage(&proto.WorkloadEndpointRemove{Id: zoned.Id})
+			Eventually(tables["mangle-v4"].NumApplies).Should(Equal(2))
+			Expect(tables["mangle-v4"].ChainNames()).To(ConsistOf(ChainPrerouting))
+		})
+
+		It("should only update the raw and mangle tables", func() {
+			dp.SendMessage(&proto.WorkloadEndpointRemove{Id: zoned.Id})
+			Eventually(tables["raw-v4"].NumApplies).Should(Equal(2))
+			Eventually(tables["mangle-v6"].NumApplies).Should(Equal(2))
+			Expect(tables["filter-v4"].NumApplies()).To(Equal(1))
+			Expect(tables["nat-v4"].NumApplies()).To(Equal(1))
+		})
+	})
+
+	Describe("with conntrack", func() {
+		var ct *mockConntrack
+		webID := &proto.WorkloadEndpointID{
+			OrchestratorId: "k8s",
+			WorkloadId:     "default/web",
+			EndpointId:     "eth0",
+		}
+		web := &proto.WorkloadEndpoint{
+			Name:       "cali1234",
+			Ipv4Nets:   []string{"10.65.0.2/32"},
+			Ipv6Nets:   []string{"fd00::2/128"},
+			Tiers:      []*proto.TierInfo{{Name: "default", Policies: []string{"allow-web"}}},
+			ProfileIds: []string{"k8s_ns.default"},
+		}
+
+		BeforeEach(func() {
+			ct = &mockConntrack{}
+			config.Conntrack = ct
+			config.ConntrackFlushDelay = 10 * time.Millisecond
+			start()
+			dp.SendMessage(&proto.WorkloadEndpointUpdate{Id: webID, Endpoint: web})
+			dp.SendMessage(&proto.ActivePolicyUpdate{
+				Id: &proto.PolicyID{Tier: "default", Name: "allow-web"},
+			})
+			dp.SendMessage(&proto.InSync{})
+			Eventually(tables["filter-v4"].NumApplies).Should(Equal(1))
+		})
+
+		It("should leave the flows alone while the datastore syncs", func() {
+			Consistently(ct.Removed, "50ms").Should(BeEmpty())
+		})
+
+		It("should remove the flows of a removed endpoint", func() {
+			dp.SendMessage(&proto.WorkloadEndpointRemove{Id: webID})
+			Eventually(ct.Removed).Should(ConsistOf("10.65.0.2", "fd00::2"))
+		})
+
+		It("should remove the flows of an endpoint whose policy changes", func() {
+			dp.SendMessage(&proto.ActivePolicyUpdate{
+				Id: &proto.PolicyID{Tier: "default", Name: "allow-web"},
+			})
+			Eventually(ct.Removed).Should(ConsistOf("10.65.0.2", "fd00::2"))
+		})
+
+		It("should remove the flows of an endpoint whose profile is removed", func() {
+			dp.SendMessage(&proto.ActiveProfileRemove{Id: &proto.ProfileID{Name: "k8s_ns.default"}})
+			Eventually(ct.Removed).Should(ConsistOf("10.65.0.2", "fd00::2"))
+		})
+
+		It("should remove the flows of an endpoint whose policies change", func() {
+			dp.SendMessage(&proto.WorkloadEndpointUpdate{
+				Id: webID,
+				Endpoint: &proto.WorkloadEndpoint{
+					Name:       "cali1234",
+					Ipv4Nets:   []string{"10.65.0.2/32"},
+					ProfileIds: []string{"k8s_ns.default"},
+				},
+			})
+			Eventually(ct.Removed).Should(ConsistOf("10.65.0.2", "fd00::2"))
+		})
+
+		It("should leave the flows alone for other policies and endpoint changes", func() {
+			dp.SendMessage(&proto.ActivePolicyUpdate{
+				Id: &proto.PolicyID{Tier: "default", Name: "allow-db"},
+			})
+			dp.SendMessage(&proto.WorkloadEndpointUpdate{
+				Id: webID,
+				Endpoint: &proto.WorkloadEndpoint{
+					Name:       "cali1234",
+					Ipv4Nets:   []string{"10.65.0.2/32"},
+					Tiers:      web.Tiers,
+					ProfileIds: web.ProfileIds,
+					Dscp:       &proto.DSCP{Value: 46},
+				},
+			})
+			Consistently(ct.Removed, "50ms").Should(BeEmpty())
+		})
+
+		It("should leave the marked flows alone without the verdict cache", func() {
+			dp.SendMessage(&proto.IPSetDeltaUpdate{Id: "s:web", AddedMembers: []string{"10.65.0.4"}})
+			Consistently(ct.RemovedMarks, "50ms").Should(BeEmpty())
+		})
+	})
+
+	Describe("with conntrack and the verdict cache", func() {
+		var ct *mockConntrack
+
+		BeforeEach(func() {
+			renderer = rules.NewRenderer(rules.Config{
+				WorkloadIfacePrefixes:       []string{"cali"},
+				IptablesMarkVerdictCacheIn:  0x20,
+				IptablesMarkVerdictCacheOut: 0x40,
+			})
+			ct = &mockConntrack{}
+			config.Conntrack = ct
+			config.ConntrackFlushDelay = 10 * time.Millisecond
+			start()
+			dp.SendMessage(&proto.IPSetUpdate{Id: "s:web", Members: []string{"10.65.0.2"}})
+			dp.SendMessage(&proto.InSync{})
+			Eventually(tables["filter-v4"].NumApplies).Should(Equal(1))
+		})
+
+		It("should leave the flows alone while the datastore syncs", func() {
+			Consistently(ct.RemovedMarks, "50ms").Should(BeEmpty())
+		})
+
+		It("should remove the flows with cached verdicts when an IP set changes", func() {
+			dp.SendMessage(&proto.IPSetDeltaUpdate{Id: "s:web", AddedMembers: []string{"10.65.0.4"}})
+			Eventually(ct.RemovedMarks).Should(ConsistOf(uint32(0x20), uint32(0x40)))
+		})
+
+		It("should remove the flows with cached verdicts when a policy changes", func() {
+			dp.SendMessage(&proto.ActivePolicyUpdate{
+				Id: &proto.PolicyID{Tier: "default", Name: "allow-db"},
+			})
+			Eventually(ct.RemovedMarks).Should(ConsistOf(uint32(0x20), uint32(0x40)))
+		})
+	})
+
+	Describe("with services", func() {
+		var serviceUpdates chan interface{}
+		webID := services.ServiceID{Namespace: "default", Name: "web"}
+		webLB := rules.LoadBalancerChainName("default/web:tcp/80")
+
+		BeforeEach(func() {
+			renderer = rules.NewRenderer(rules.Config{
+				WorkloadIfacePrefixes: []string{"cali"},
+				IptablesMarkMasq:      0x4,
+				NodePortRanges:        []rules.PortRange{{Min: 30000, Max: 32767}},
+			})
+			serviceUpdates = make(chan interface{})
+			config.Services = &Services{
+				Updates: serviceUpdates,
+				NewManager: func(ipVersion uint8, natTable, filterTable services.Table) ServiceManager {
+					return services.NewManager(ipVersion, renderer, natTable, filterTable)
+				},
+			}
+			config.PortForwards = []rules.PortForward{fwd}
+			start()
+			serviceUpdates <- services.Service{
+				ID:        webID,
+				ClusterIP: "10.96.0.10",
+				Ports:     []services.ServicePort{{Name: "http", Protocol: "tcp", Port: 80}},
+			}
+			serviceUpdates <- services.Endpoints{
+				ID:        webID,
+				Addresses: []string{"10.65.0.2"},
+				Ports:     []services.EndpointPort{{Name: "http", Port: 8080}},
+			}
+			dp.SendMessage(&proto.InSync{})
+			Eventually(tables["nat-v4"].NumApplies).Should(Equal(1))
+		})
+
+		It("should program the services' chains", func() {
+			Expect(tables["nat-v4"].ChainNames()).To(ContainElement(services.ChainServices))
+			Expect(tables["nat-v4"].Chain(services.ChainServices)[0]).To(Equal(iptables.Rule{
+				Match:  iptables.Match().Protocol("tcp").DestNet("10.96.0.10").DestPorts(80),
+				Action: iptables.JumpAction{Target: webLB},
+			}))
+			Expect(tables["nat-v4"].ChainNames()).To(ContainElement(webLB))
+			Expect(tables["filter-v4"].Chain(rules.ChainNodePortsProtect)).To(Equal(
+				renderer.NodePortProtectChain().Rules))
+		})
+
+		It("should program the chains that are only jumped to, even if they're empty", func() {
+			Expect(tables["nat-v4"].ChainNames()).To(ContainElement(rules.ChainNodePorts))
+			Expect(tables["nat-v4"].Chain(rules.ChainNodePorts)).To(BeEmpty())
+		})
+
+		It("should turn the services' insertions into jumps from the dispatch chains", func() {
+			Expect(tables["nat-v4"].Chain(ChainPrerouting)).To(Equal(
+				jumpTo(rules.ChainFwdDNAT, services.ChainServices)))
+			Expect(tables["nat-v4"].Chain(ChainOutput)).To(Equal(
+				jumpTo(rules.ChainFwdDNAT, services.ChainServices)))
+			Expect(tables["nat-v4"].Chain(ChainPostrouting)).To(Equal(jumpTo(rules.ChainMasqMarked)))
+			Expect(tables["filter-v4"].Chain(ChainInput)).To(Equal(jumpTo(rules.ChainNodePortsProtect)))
+			Expect(tables["nat-v4"].Insertions("PREROUTING")).To(BeNil())
+		})
+
+		It("should leave the other IP version's service out", func() {
+			Expect(tables["nat-v6"].ChainNames()).NotTo(ContainElement(webLB))
+			Expect(tables["nat-v6"].Chain(ChainPrerouting)).To(Equal(jumpTo(services.ChainServices)))
+		})
+
+		It("should remove the service", func() {
+			serviceUpdates <- services.ServiceRemove{ID: webID}
+			serviceUpdates <- services.EndpointsRemove{ID: webID}
+			Eventually(tables["nat-v4"].ChainNames).ShouldNot(ContainElement(webLB))
+			Expect(tables["nat-v4"].Chain(services.ChainServices)).To(HaveLen(1))
+		})
+	})
+
+	It("should ignore service insertions into a kernel chain that we don't dispatch", func() {
+		config.Services = &Services{
+			Updates: make(chan interface{}),
+			NewManager: func(ipVersion uint8, natTable, filterTable services.Table) ServiceManager {
+				// The nat table has no INPUT dispatch chain.
+				natTable.SetRuleInsertions("INPUT", jumpTo("cali-stray"))
+				return services.NewManager(ipVersion, renderer, natTable, filterTable)
+			},
+		}
+		start()
+		dp.SendMessage(&proto.InSync{})
+		Eventually(tables["nat-v4"].NumApplies).Should(Equal(1))
+		Expect(tables["nat-v4"].Insertions("INPUT")).To(BeNil())
+		Expect(tables["nat-v4"].Chain(ChainPrerouting)).To(Equal(jumpTo(services.ChainServices)))
+	})
+
+	Describe("with DSR services", func() {
+		var serviceUpdates chan interface{}
+		var routing *mockRouteManager
+		webID := services.ServiceID{Namespace: "default", Name: "web"}
+
+		BeforeEach(func() {
+			renderer = rules.NewRenderer(rules.Config{
+				WorkloadIfacePrefixes: []string{"cali"},
+				IptablesMarkMasq:      0x4,
+				IptablesMarkDSR:       0x30,
+				DSRRouteTableBase:     1000,
+			})
+			serviceUpdates = make(chan interface{})
+			routing = &mockRouteManager{}
+			config.PolicyRouting = routing
+			config.Services = &Services{
+				Updates: serviceUpdates,
+				NewManager: func(ipVersion uint8, natTable, filterTable services.Table) ServiceManager {
+					return services.NewManager(ipVersion, renderer, natTable, filterTable)
+				},
+				DSREnabled: true,
+				Hostname:   "host-a",
+			}
+			start()
+			serviceUpdates <- services.Service{
+				ID:        webID,
+				ClusterIP: "10.96.0.10",
+				Ports:     []services.ServicePort{{Name: "http", Protocol: "tcp", Port: 80}},
+				DSR:       true,
+			}
+			serviceUpdates <- services.Endpoints{
+				ID:        webID,
+				Addresses: []string{"10.65.0.2", "10.65.1.3"},
+				Ports:     []services.EndpointPort{{Name: "http", Port: 8080}},
+				Hostnames: map[string]string{"10.65.0.2": "host-a", "10.65.1.3": "host-b"},
+			}
+			dp.SendMessage(&proto.HostMetadataUpdate{Hostname: "host-a", Ipv4Addr: "192.168.0.1"})
+			dp.SendMessage(&proto.HostMetadataUpdate{Hostname: "host-b", Ipv4Addr: "192.168.0.2"})
+			dp.SendMessage(&proto.InSync{})
+		})
+
+		It("should restore the DSR marks in the mangle table", func() {
+			Eventually(func() []iptables.Rule {
+				return tables["mangle-v4"].Chain(ChainPrerouting)
+			}).Should(Equal(renderer.DSRRestoreMarkRules()))
+			Expect(tables["mangle-v6"].Chain(ChainPrerouting)).To(BeEmpty())
+		})
+
+		It("should route the DSR traffic to the other host", func() {
+			route, err := renderer.DSRRoute(1, "192.168.0.2")
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(routing.DSRRoutes).Should(Equal([]rules.DSRRoute{route}))
+		})
+
+		It("should follow the other host's address", func() {
+			Eventually(routing.DSRRoutes).Should(HaveLen(1))
+			dp.SendMessage(&proto.HostMetadataUpdate{Hostname: "host-b", Ipv4Addr: "192.168.0.3"})
+			route, err := renderer.DSRRoute(1, "192.168.0.3")
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(routing.DSRRoutes).Should(Equal([]rules.DSRRoute{route}))
+		})
+
+		It("should stop routing to a host that's removed", func() {
+			Eventually(routing.DSRRoutes).Should(HaveLen(1))
+			dp.SendMessage(&proto.HostMetadataRemove{Hostname: "host-b", Ipv4Addr: "192.168.0.2"})
+			Eventually(routing.DSRRoutes).Should(BeEmpty())
+		})
+	})
+
+	Describe("with policy routing", func() {
+		var routing *mockRouteManager
+
+		BeforeEach(func() {
+			routing = &mockRouteManager{}
+			config.PolicyRouting = routing
+		})
+
+		It("should apply the policy routing once in sync", func() {
+			start()
+			Consistently(routing.NumApplies, "50ms").Should(BeZero())
+			dp.SendMessage(&proto.InSync{})
+			Eventually(routing.NumApplies).ShouldNot(BeZero())
+			// The tables come first.
+			Expect(tables["filter-v6"].NumApplies()).To(Equal(1))
+		})
+
+		It("should retry the policy routing if it fails", func() {
+			routing.failApply = true
+			start()
+			dp.SendMessage(&proto.InSync{})
+			Eventually(routing.NumApplies).Should(BeNumerically(">", 1))
+		})
+
+		It("should route the egress gateway's traffic on a client", func() {
+			renderer = rules.NewRenderer(rules.Config{
+				EgressGatewayRole:         rules.EgressGatewayRoleClient,
+				IptablesMarkEgressGateway: 0x800,
+				EgressGatewayAddr:         "10.0.0.5",
+				EgressGatewayRouteTable:   999,
+			})
+			start()
+			Expect(routing.haveEgressGW).To(BeTrue())
+			Expect(routing.egressRoute).To(Equal(rules.EgressGatewayRoute{
+				Mark:        0x800,
+				Table:       999,
+				GatewayAddr: "10.0.0.5",
+			}))
+		})
+
+		It("should not route to the egress gateway otherwise", func() {
+			start()
+			Expect(routing.haveEgressGW).To(BeFalse())
+		})
+
+		It("should resync the policy routing on refresh", func() {
+			config.RefreshInterval = 20 * time.Millisecond
+			start()
+			dp.SendMessage(&proto.InSync{})
+			Eventually(routing.NumResyncs).Should(BeNumerically(">", 1))
+		})
+	})
+
+	Describe("on an egress gateway client", func() {
+		BeforeEach(func() {
+			renderer = rules.NewRenderer(rules.Config{
+				EgressGatewayRole:          rules.EgressGatewayRoleClient,
+				IptablesMarkEgressGateway:  0x800,
+				EgressGatewayAddr:          "10.0.0.5",
+				EgressGatewaySourceCIDRs:   []string{"10.65.0.0/24"},
+				EgressGatewayExcludedCIDRs: []string{"10.0.0.0/8"},
+				EgressGatewayRouteTable:    999,
+				NAT64Prefix:                "64:ff9b::/96",
+				NAT64IPv4Pool:              "192.168.255.0/24",
+				NAT64Device:                "nat64",
+			})
+			start()
+			dp.SendMessage(&proto.InSync{})
+			Eventually(tables["filter-v6"].NumApplies).Should(Equal(1))
+		})
+
+		It("should hook the mark chain into mangle PREROUTING", func() {
+			Expect(tables["mangle-v4"].Chain(rules.ChainEgressGatewayMark)).To(Equal(
+				renderer.EgressGatewayMarkChain().Rules))
+			Expect(tables["mangle-v4"].Chain(ChainPrerouting)).To(Equal(jumpTo(rules.ChainEgressGatewayMark)))
+			Expect(tables["mangle-v6"].Chain(ChainPrerouting)).To(BeEmpty())
+		})
+
+		It("should hook the NAT chain into POSTROUTING ahead of the NAT64 masquerade", func() {
+			Expect(tables["nat-v4"].Chain(rules.ChainEgressGatewayNAT)).To(Equal(
+				renderer.EgressGatewayNATChain().Rules))
+			Expect(tables["nat-v4"].Chain(ChainPostrouting)).To(Equal(
+				jumpTo(rules.ChainEgressGatewayNAT, rules.ChainNAT64Masq)))
+			Expect(tables["nat-v6"].Chain(ChainPostrouting)).To(BeEmpty())
+		})
+
+		It("should set the DSCP value after marking the traffic", func() {
+			dp.SendMessage(&proto.WorkloadEndpointUpdate{
+				Id: &proto.WorkloadEndpointID{
+					OrchestratorId: "k8s",
+					WorkloadId:     "default/web",
+					EndpointId:     "eth0",
+				},
+				Endpoint: &proto.WorkloadEndpoint{
+					Name:     "cali1234",
+					Ipv4Nets: []string{"10.65.0.2/32"},
+					Dscp:     &proto.DSCP{Value: 46},
+				},
+			})
+			Eventually(tables["mangle-v4"].NumApplies).Should(Equal(2))
+			Expect(tables["mangle-v4"].Chain(ChainPrerouting)).To(Equal(
+				jumpTo(rules.ChainEgressGatewayMark, rules.ChainDSCP)))
+		})
+	})
+
+	It("should hook the egress gateway's NAT chain on the gateway", func() {
+		renderer = rules.NewRenderer(rules.Config{
+			EgressGatewayRole:        rules.EgressGatewayRoleGateway,
+			EgressGatewayAddr:        "10.0.0.5",
+			EgressGatewaySourceCIDRs: []string{"10.65.0.0/24"},
+		})
+		start()
+		dp.SendMessage(&proto.InSync{})
+		Eventually(tables["nat-v4"].NumApplies).Should(Equal(1))
+		Expect(tables["nat-v4"].Chain(ChainPostrouting)).To(Equal(jumpTo(rules.ChainEgressGatewayNAT)))
+		Expect(tables["mangle-v4"].Chain(ChainPrerouting)).To(BeEmpty())
+	})
+
+	It("should retry a table that fails", func() {
+		config.PortForwards = []rules.PortForward{fwd}
+		start()
+		tables["nat-v4"].SetFailApply(true)
+		dp.SendMessage(&proto.InSync{})
+		Eventually(tables["nat-v4"].NumApplies).Should(BeNumerically(">", 1))
+		Expect(tables["nat-v4"].ChainNames()).To(BeEmpty())
+		Expect(tables["filter-v4"].NumApplies()).To(Equal(1))
+		tables["nat-v4"].SetFailApply(false)
+		Eventually(tables["nat-v4"].ChainNames).Should(ContainElement(rules.ChainFwdDNAT))
+	})
+
+	It("should reload the tables on refresh", func() {
+		config.RefreshInterval = 20 * time.Millisecond
+		start()
+		dp.SendMessage(&proto.InSync{})
+		Eventually(tables["filter-v4"].NumApplies).Should(BeNumerically(">", 2))
+		tables["filter-v4"].lock.Lock()
+		defer tables["filter-v4"].lock.Unlock()
+		Expect(tables["filter-v4"].numInvalid).To(BeNumerically(">", 1))
+	})
+})
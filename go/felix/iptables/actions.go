@@ -0,0 +1,581 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Action is the "target" part of a rule; it renders itself as an iptables
+// fragment such as "--jump ACCEPT".  Actions must be comparable with ==,
+// which Rule.Equals relies on.
+type Action interface {
+	ToFragment() string
+}
+
+// fragmentWriter is implemented by actions whose fragment isn't a constant.
+// They write the fragment straight into the rule's buffer to avoid
+// allocating a string for every render.
+type fragmentWriter interface {
+	writeFragment(buf *bytes.Buffer)
+}
+
+func renderFragment(a fragmentWriter) string {
+	var buf bytes.Buffer
+	a.writeFragment(&buf)
+	return buf.String()
+}
+
+// writeUint writes v in the given base without allocating.
+func writeUint(buf *bytes.Buffer, v uint64, base int) {
+	var scratch [20]byte
+	buf.Write(strconv.AppendUint(scratch[:0], v, base))
+}
+
+// writeHexMark writes the mark in the same format as "%#x".
+func writeHexMark(buf *bytes.Buffer, mark uint32) {
+	buf.WriteString("0x")
+	writeUint(buf, uint64(mark), 16)
+}
+
+type GotoAction struct {
+	Target string
+}
+
+func (g GotoAction) ToFragment() string {
+	return renderFragment(g)
+}
+
+func (g GotoAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--goto ")
+	writeArg(buf, g.Target)
+}
+
+func (g GotoAction) String() string {
+	return "Goto->" + g.Target
+}
+
+type JumpAction struct {
+	Target string
+}
+
+func (g JumpAction) ToFragment() string {
+	return renderFragment(g)
+}
+
+func (g JumpAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump ")
+	writeArg(buf, g.Target)
+}
+
+func (g JumpAction) String() string {
+	return "Jump->" + g.Target
+}
+
+type ReturnAction struct{}
+
+func (r ReturnAction) ToFragment() string {
+	return "--jump RETURN"
+}
+
+func (r ReturnAction) String() string {
+	return "Return"
+}
+
+type DropAction struct{}
+
+func (g DropAction) ToFragment() string {
+	return "--jump DROP"
+}
+
+func (g DropAction) String() string {
+	return "Drop"
+}
+
+type LogAction struct {
+	Prefix string
+}
+
+func (g LogAction) ToFragment() string {
+	return renderFragment(g)
+}
+
+func (g LogAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString(`--jump LOG --log-prefix "`)
+	writeEscaped(buf, sanitizeText(g.Prefix, MaxLogPrefixLength))
+	buf.WriteString(`: " --log-level 5`)
+}
+
+func (g LogAction) String() string {
+	return "Log"
+}
+
+// NflogAction sends the packet to the given netlink log group, tagged with
+// the prefix.  Unlike LOG, it doesn't write to the kernel log; the packet is
+// delivered to a userspace listener instead.
+type NflogAction struct {
+	Group  uint16
+	Prefix string
+}
+
+func (n NflogAction) ToFragment() string {
+	return renderFragment(n)
+}
+
+func (n NflogAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump NFLOG --nflog-group ")
+	writeUint(buf, uint64(n.Group), 10)
+	buf.WriteString(` --nflog-prefix "`)
+	writeEscaped(buf, sanitizeText(n.Prefix, MaxNflogPrefixLength))
+	buf.WriteByte('"')
+}
+
+func (n NflogAction) String() string {
+	return fmt.Sprintf("Nflog:%d", n.Group)
+}
+
+type AcceptAction struct{}
+
+func (g AcceptAction) ToFragment() string {
+	return "--jump ACCEPT"
+}
+
+func (g AcceptAction) String() string {
+	return "Accept"
+}
+
+// DNATAction rewrites the destination of the packet to the given address
+// and, optionally, port.  If DestPort is 0, the packet's destination port is
+// left alone.  If MaxDestPort is greater than DestPort, the kernel picks a
+// destination port from the inclusive range.  IPv6 addresses are rendered in
+// the bracketed "[addr]:port" form that ip6tables expects.
+type DNATAction struct {
+	DestAddr string
+	// MaxDestAddr, if set, makes the destination an inclusive range of
+	// addresses, starting at DestAddr.
+	MaxDestAddr string
+	DestPort    uint16
+	MaxDestPort uint16
+	// Persistent gives each client the same destination address for all
+	// of its connections, rather than picking one per connection.  It only
+	// has an effect if MaxDestAddr is set.
+	Persistent bool
+}
+
+// Validate checks that the action is renderable for the given IP version.
+// iptables-restore rejects the whole transaction if a single rule is bad so
+// callers should validate user-supplied destinations before rendering them.
+func (g DNATAction) Validate(ipVersion uint8) error {
+	minIP, err := parseDNATAddr(g.DestAddr, ipVersion)
+	if err != nil {
+		return err
+	}
+	if g.MaxDestAddr != "" {
+		maxIP, err := parseDNATAddr(g.MaxDestAddr, ipVersion)
+		if err != nil {
+			return err
+		}
+		if bytes.Compare(maxIP.To16(), minIP.To16()) < 0 {
+			return fmt.Errorf("DNAT address range %s-%s is inverted",
+				g.DestAddr, g.MaxDestAddr)
+		}
+	}
+	if g.MaxDestPort != 0 && g.DestPort == 0 {
+		return errors.New("DNAT port range needs a minimum port")
+	}
+	if g.MaxDestPort != 0 && g.MaxDestPort < g.DestPort {
+		return fmt.Errorf("DNAT port range %d-%d is inverted", g.DestPort, g.MaxDestPort)
+	}
+	return nil
+}
+
+func parseDNATAddr(addr string, ipVersion uint8) (net.IP, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid DNAT address %#v", addr)
+	}
+	if (ip.To4() != nil) != (ipVersion == 4) {
+		return nil, fmt.Errorf("DNAT address %#v is not an IPv%d address", addr, ipVersion)
+	}
+	return ip, nil
+}
+
+func (g DNATAction) ToFragment() string {
+	return renderFragment(g)
+}
+
+func (g DNATAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump DNAT --to-destination ")
+	g.writeDest(buf)
+	if g.Persistent {
+		buf.WriteString(" --persistent")
+	}
+}
+
+func (g DNATAction) writeDest(buf *bytes.Buffer) {
+	// With a port, IPv6 addresses need brackets to separate them from
+	// the port.
+	bracketed := g.DestPort != 0 && strings.Contains(g.DestAddr, ":")
+	writeAddr := func(addr string) {
+		if bracketed {
+			buf.WriteByte('[')
+		}
+		writeArg(buf, addr)
+		if bracketed {
+			buf.WriteByte(']')
+		}
+	}
+	writeAddr(g.DestAddr)
+	if g.MaxDestAddr != "" {
+		buf.WriteByte('-')
+		writeAddr(g.MaxDestAddr)
+	}
+	if g.DestPort == 0 {
+		return
+	}
+	buf.WriteByte(':')
+	writeUint(buf, uint64(g.DestPort), 10)
+	if g.MaxDestPort > g.DestPort {
+		buf.WriteByte('-')
+		writeUint(buf, uint64(g.MaxDestPort), 10)
+	}
+}
+
+func (g DNATAction) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("DNAT->")
+	g.writeDest(&buf)
+	return buf.String()
+}
+
+type SNATAction struct {
+	ToAddr string
+}
+
+func (g SNATAction) ToFragment() string {
+	return renderFragment(g)
+}
+
+func (g SNATAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump SNAT --to-source ")
+	writeArg(buf, g.ToAddr)
+}
+
+func (g SNATAction) String() string {
+	return fmt.Sprintf("SNAT->%s", g.ToAddr)
+}
+
+// NetmapAction statically maps the packet's address onto the same host
+// part of ToNet, which is a CIDR such as "192.168.0.0/24".  In the nat
+// PREROUTING and OUTPUT chains it rewrites the destination; in POSTROUTING
+// it rewrites the source.  Unlike SNAT and DNAT, the mapping is 1:1 so it
+// can translate a whole subnet without tracking per-connection state.
+type NetmapAction struct {
+	ToNet string
+}
+
+func (g NetmapAction) ToFragment() string {
+	return renderFragment(g)
+}
+
+func (g NetmapAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump NETMAP --to ")
+	writeArg(buf, g.ToNet)
+}
+
+func (g NetmapAction) String() string {
+	return "Netmap->" + g.ToNet
+}
+
+// MasqAction rewrites the source of the packet to the address of the
+// interface that it leaves by.  The zero value leaves the choice of source
+// port to the kernel.
+type MasqAction struct {
+	// MinPort and MaxPort, if MinPort is non-zero, restrict the source
+	// ports to the given inclusive range.  A MaxPort of 0 means MinPort
+	// only.
+	MinPort, MaxPort uint16
+	// RandomFully picks each source port at random, which avoids the port
+	// collisions, and dropped connections, that the kernel's default
+	// sequential allocation suffers from under high connection rates.
+	// Only set it if Features.Require(FeatureMASQFullyRandom) succeeds;
+	// older versions of iptables-restore reject the option, failing the
+	// whole transaction.
+	RandomFully bool
+}
+
+func (g MasqAction) ToFragment() string {
+	if g == (MasqAction{}) {
+		return "--jump MASQUERADE"
+	}
+	return renderFragment(g)
+}
+
+func (g MasqAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump MASQUERADE")
+	if g.MinPort != 0 {
+		buf.WriteString(" --to-ports ")
+		writeUint(buf, uint64(g.MinPort), 10)
+		if g.MaxPort > g.MinPort {
+			buf.WriteByte('-')
+			writeUint(buf, uint64(g.MaxPort), 10)
+		}
+	}
+	if g.RandomFully {
+		buf.WriteString(" --random-fully")
+	}
+}
+
+func (g MasqAction) String() string {
+	return "Masq"
+}
+
+type ClearMarkAction struct {
+	Mark uint32
+}
+
+func (c ClearMarkAction) ToFragment() string {
+	return renderFragment(c)
+}
+
+func (c ClearMarkAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump MARK --set-mark 0/")
+	writeHexMark(buf, c.Mark)
+}
+
+func (c ClearMarkAction) String() string {
+	return fmt.Sprintf("Clear:%#x", c.Mark)
+}
+
+type SetMarkAction struct {
+	Mark uint32
+}
+
+func (c SetMarkAction) ToFragment() string {
+	return renderFragment(c)
+}
+
+func (c SetMarkAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump MARK --set-mark ")
+	writeHexMark(buf, c.Mark)
+	buf.WriteByte('/')
+	writeHexMark(buf, c.Mark)
+}
+
+func (c SetMarkAction) String() string {
+	return fmt.Sprintf("Set:%#x", c.Mark)
+}
+
+// SetMaskedMarkAction sets the bits of Mask to Mark, leaving the rest of
+// the mark alone.  Unlike SetMarkAction, it can set a multi-bit value.
+type SetMaskedMarkAction struct {
+	Mark uint32
+	Mask uint32
+}
+
+func (c SetMaskedMarkAction) ToFragment() string {
+	return renderFragment(c)
+}
+
+func (c SetMaskedMarkAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump MARK --set-mark ")
+	writeHexMark(buf, c.Mark)
+	buf.WriteByte('/')
+	writeHexMark(buf, c.Mask)
+}
+
+func (c SetMaskedMarkAction) String() string {
+	return fmt.Sprintf("Set:%#x/%#x", c.Mark, c.Mask)
+}
+
+// SaveConnMarkAction copies the bits of SaveMask from the packet's mark to
+// its connection's mark.  It renders the masks the way iptables-save prints
+// them, rather than using the --mask shorthand.
+type SaveConnMarkAction struct {
+	SaveMask uint32
+}
+
+func (c SaveConnMarkAction) ToFragment() string {
+	return renderFragment(c)
+}
+
+func (c SaveConnMarkAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump CONNMARK --save-mark --nfmask ")
+	writeHexMark(buf, c.SaveMask)
+	buf.WriteString(" --ctmask ")
+	writeHexMark(buf, c.SaveMask)
+}
+
+func (c SaveConnMarkAction) String() string {
+	return fmt.Sprintf("SaveConnMark:%#x", c.SaveMask)
+}
+
+// SetConnMarkAction sets the bits of Mask in the connection's mark to the
+// corresponding bits of Mark, leaving the packet's own mark untouched.
+type SetConnMarkAction struct {
+	Mark uint32
+	Mask uint32
+}
+
+func (c SetConnMarkAction) ToFragment() string {
+	return renderFragment(c)
+}
+
+func (c SetConnMarkAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump CONNMARK --set-xmark ")
+	writeHexMark(buf, c.Mark)
+	buf.WriteByte('/')
+	writeHexMark(buf, c.Mask)
+}
+
+func (c SetConnMarkAction) String() string {
+	return fmt.Sprintf("SetConnMark:%#x/%#x", c.Mark, c.Mask)
+}
+
+// RestoreConnMarkAction copies the bits of RestoreMask from the
+// connection's mark to the packet's mark.
+type RestoreConnMarkAction struct {
+	RestoreMask uint32
+}
+
+func (c RestoreConnMarkAction) ToFragment() string {
+	return renderFragment(c)
+}
+
+func (c RestoreConnMarkAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump CONNMARK --restore-mark --nfmask ")
+	writeHexMark(buf, c.RestoreMask)
+	buf.WriteString(" --ctmask ")
+	writeHexMark(buf, c.RestoreMask)
+}
+
+func (c RestoreConnMarkAction) String() string {
+	return fmt.Sprintf("RestoreConnMark:%#x", c.RestoreMask)
+}
+
+// CTZoneAction puts the packet's connection in the given conntrack zone,
+// which keeps it apart from connections with the same addresses and ports
+// in other zones.  It's only valid in the raw table.
+type CTZoneAction struct {
+	Zone uint16
+}
+
+func (c CTZoneAction) ToFragment() string {
+	return renderFragment(c)
+}
+
+func (c CTZoneAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump CT --zone ")
+	writeUint(buf, uint64(c.Zone), 10)
+}
+
+func (c CTZoneAction) String() string {
+	return fmt.Sprintf("CTZone:%d", c.Zone)
+}
+
+// SetDSCPAction sets the DSCP field of the packet's IP header, so that the
+// network can classify the traffic.  It's only valid in the mangle table.
+type SetDSCPAction struct {
+	DSCP uint8
+}
+
+func (c SetDSCPAction) ToFragment() string {
+	return renderFragment(c)
+}
+
+func (c SetDSCPAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump DSCP --set-dscp ")
+	writeUint(buf, uint64(c.DSCP), 10)
+}
+
+func (c SetDSCPAction) String() string {
+	return fmt.Sprintf("SetDSCP:%d", c.DSCP)
+}
+
+// SynproxyAction answers the SYN of an untracked connection with a SYN
+// cookie on the server's behalf and only hands the connection to the
+// server once the client has completed the handshake, so spoofed SYNs
+// never reach it.  The options must match the ones that the server uses.
+// It needs kernel 3.12 or later; see FeatureDetector.
+type SynproxyAction struct {
+	SACKPerm  bool
+	Timestamp bool
+	WScale    uint8
+	MSS       uint16
+}
+
+func (g SynproxyAction) ToFragment() string {
+	return renderFragment(g)
+}
+
+func (g SynproxyAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump SYNPROXY")
+	if g.SACKPerm {
+		buf.WriteString(" --sack-perm")
+	}
+	if g.Timestamp {
+		buf.WriteString(" --timestamp")
+	}
+	buf.WriteString(" --wscale ")
+	writeUint(buf, uint64(g.WScale), 10)
+	buf.WriteString(" --mss ")
+	writeUint(buf, uint64(g.MSS), 10)
+}
+
+func (g SynproxyAction) String() string {
+	return fmt.Sprintf("Synproxy:mss=%d,wscale=%d", g.MSS, g.WScale)
+}
+
+// AddToIPSetAction adds the packet's source address to the named IP set,
+// refreshing its timeout if it's already there.  A TimeoutSecs of 0 uses
+// the IP set's default timeout.  Unlike most actions, it doesn't end the
+// packet's traversal of the chain.
+type AddToIPSetAction struct {
+	SetName     string
+	TimeoutSecs uint32
+}
+
+func (g AddToIPSetAction) ToFragment() string {
+	return renderFragment(g)
+}
+
+func (g AddToIPSetAction) writeFragment(buf *bytes.Buffer) {
+	buf.WriteString("--jump SET --add-set ")
+	writeArg(buf, g.SetName)
+	buf.WriteString(" src --exist")
+	if g.TimeoutSecs != 0 {
+		buf.WriteString(" --timeout ")
+		writeUint(buf, uint64(g.TimeoutSecs), 10)
+	}
+}
+
+func (g AddToIPSetAction) String() string {
+	return fmt.Sprintf("AddToIPSet:%s", g.SetName)
+}
+
+type NoTrackAction struct{}
+
+func (g NoTrackAction) ToFragment() string {
+	return "--jump NOTRACK"
+}
+
+func (g NoTrackAction) String() string {
+	return "NOTRACK"
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("Actions",
+	func(action Action, expRendering string) {
+		Expect(action.ToFragment()).To(Equal(expRendering))
+	},
+	Entry("GotoAction", GotoAction{Target: "cali-abcd"}, "--goto cali-abcd"),
+	Entry("JumpAction", JumpAction{Target: "cali-abcd"}, "--jump cali-abcd"),
+	Entry("ReturnAction", ReturnAction{}, "--jump RETURN"),
+	Entry("DropAction", DropAction{}, "--jump DROP"),
+	Entry("AcceptAction", AcceptAction{}, "--jump ACCEPT"),
+	Entry("LogAction", LogAction{Prefix: "prefix"},
+		`--jump LOG --log-prefix "prefix: " --log-level 5`),
+	Entry("NflogAction", NflogAction{Group: 1, Prefix: "A|policy/default/pol1"},
+		`--jump NFLOG --nflog-group 1 --nflog-prefix "A|policy/default/pol1"`),
+	Entry("DNATAction", DNATAction{DestAddr: "10.0.0.1", DestPort: 8080},
+		"--jump DNAT --to-destination 10.0.0.1:8080"),
+	Entry("DNATAction without port", DNATAction{DestAddr: "10.0.0.1"},
+		"--jump DNAT --to-destination 10.0.0.1"),
+	Entry("DNATAction with port range", DNATAction{DestAddr: "10.0.0.1", DestPort: 8080, MaxDestPort: 8090},
+		"--jump DNAT --to-destination 10.0.0.1:8080-8090"),
+	Entry("DNATAction IPv6", DNATAction{DestAddr: "fd00::1", DestPort: 8080},
+		"--jump DNAT --to-destination [fd00::1]:8080"),
+	Entry("DNATAction IPv6 with port range", DNATAction{DestAddr: "fd00::1", DestPort: 8080, MaxDestPort: 8090},
+		"--jump DNAT --to-destination [fd00::1]:8080-8090"),
+	Entry("DNATAction IPv6 without port", DNATAction{DestAddr: "fd00::1"},
+		"--jump DNAT --to-destination fd00::1"),
+	Entry("DNATAction persistent address range",
+		DNATAction{DestAddr: "10.0.0.1", MaxDestAddr: "10.0.0.4", DestPort: 8080, Persistent: true},
+		"--jump DNAT --to-destination 10.0.0.1-10.0.0.4:8080 --persistent"),
+	Entry("DNATAction IPv6 address range",
+		DNATAction{DestAddr: "fd00::1", MaxDestAddr: "fd00::4", DestPort: 8080},
+		"--jump DNAT --to-destination [fd00::1]-[fd00::4]:8080"),
+	Entry("SNATAction", SNATAction{ToAddr: "10.0.0.1"}, "--jump SNAT --to-source 10.0.0.1"),
+	Entry("NetmapAction", NetmapAction{ToNet: "192.168.0.0/24"}, "--jump NETMAP --to 192.168.0.0/24"),
+	Entry("MasqAction", MasqAction{}, "--jump MASQUERADE"),
+	Entry("MasqAction with ports", MasqAction{MinPort: 1024, MaxPort: 65535},
+		"--jump MASQUERADE --to-ports 1024-65535"),
+	Entry("MasqAction with one port", MasqAction{MinPort: 1024},
+		"--jump MASQUERADE --to-ports 1024"),
+	Entry("MasqAction fully random", MasqAction{RandomFully: true},
+		"--jump MASQUERADE --random-fully"),
+	Entry("ClearMarkAction", ClearMarkAction{Mark: 0x1000}, "--jump MARK --set-mark 0/0x1000"),
+	Entry("SetMarkAction", SetMarkAction{Mark: 0x1000}, "--jump MARK --set-mark 0x1000/0x1000"),
+	Entry("SetMaskedMarkAction", SetMaskedMarkAction{Mark: 0x3000, Mask: 0xf000}, "--jump MARK --set-mark 0x3000/0xf000"),
+	Entry("SaveConnMarkAction", SaveConnMarkAction{SaveMask: 0xf000}, "--jump CONNMARK --save-mark --nfmask 0xf000 --ctmask 0xf000"),
+	Entry("SetConnMarkAction", SetConnMarkAction{Mark: 0x20, Mask: 0x30}, "--jump CONNMARK --set-xmark 0x20/0x30"),
+	Entry("SynproxyAction", SynproxyAction{SACKPerm: true, Timestamp: true, WScale: 7, MSS: 1460},
+		"--jump SYNPROXY --sack-perm --timestamp --wscale 7 --mss 1460"),
+	Entry("SynproxyAction without options", SynproxyAction{WScale: 0, MSS: 536},
+		"--jump SYNPROXY --wscale 0 --mss 536"),
+	Entry("AddToIPSetAction", AddToIPSetAction{SetName: "cali4-ban", TimeoutSecs: 600},
+		"--jump SET --add-set cali4-ban src --exist --timeout 600"),
+	Entry("AddToIPSetAction default timeout", AddToIPSetAction{SetName: "cali4-ban"},
+		"--jump SET --add-set cali4-ban src --exist"),
+	Entry("RestoreConnMarkAction", RestoreConnMarkAction{RestoreMask: 0xf000}, "--jump CONNMARK --restore-mark --nfmask 0xf000 --ctmask 0xf000"),
+	Entry("NoTrackAction", NoTrackAction{}, "--jump NOTRACK"),
+	Entry("CTZoneAction", CTZoneAction{Zone: 42}, "--jump CT --zone 42"),
+	Entry("SetDSCPAction", SetDSCPAction{DSCP: 46}, "--jump DSCP --set-dscp 46"),
+)
+
+var _ = DescribeTable("DNATAction validation",
+	func(action DNATAction, ipVersion uint8, expValid bool) {
+		if expValid {
+			Expect(action.Validate(ipVersion)).To(Succeed())
+		} else {
+			Expect(action.Validate(ipVersion)).NotTo(Succeed())
+		}
+	},
+	Entry("IPv4 address and port", DNATAction{DestAddr: "10.0.0.1", DestPort: 80}, uint8(4), true),
+	Entry("IPv4 address only", DNATAction{DestAddr: "10.0.0.1"}, uint8(4), true),
+	Entry("IPv4 port range", DNATAction{DestAddr: "10.0.0.1", DestPort: 80, MaxDestPort: 90}, uint8(4), true),
+	Entry("single-port range", DNATAction{DestAddr: "10.0.0.1", DestPort: 80, MaxDestPort: 80}, uint8(4), true),
+	Entry("IPv6 address and port", DNATAction{DestAddr: "fd00::1", DestPort: 80}, uint8(6), true),
+	Entry("IPv6 address for IPv4", DNATAction{DestAddr: "fd00::1", DestPort: 80}, uint8(4), false),
+	Entry("IPv4 address for IPv6", DNATAction{DestAddr: "10.0.0.1", DestPort: 80}, uint8(6), false),
+	Entry("bad address", DNATAction{DestAddr: "10.0.0.256"}, uint8(4), false),
+	Entry("range without minimum", DNATAction{DestAddr: "10.0.0.1", MaxDestPort: 90}, uint8(4), false),
+	Entry("inverted range", DNATAction{DestAddr: "10.0.0.1", DestPort: 90, MaxDestPort: 80}, uint8(4), false),
+	Entry("address range", DNATAction{DestAddr: "10.0.0.1", MaxDestAddr: "10.0.0.4"}, uint8(4), true),
+	Entry("inverted address range", DNATAction{DestAddr: "10.0.0.4", MaxDestAddr: "10.0.0.1"}, uint8(4), false),
+	Entry("mixed address range", DNATAction{DestAddr: "10.0.0.1", MaxDestAddr: "fd00::1"}, uint8(4), false),
+)
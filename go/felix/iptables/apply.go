@@ -0,0 +1,84 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/backoff"
+	"sync"
+)
+
+// ApplyTables calls Apply on each of the tables, running up to
+// maxParallelism of them at once.  The tables are independent (each has its
+// own iptables-save and iptables-restore invocations), so programming them
+// concurrently cuts the time taken to converge when several of them have
+// changed.  Each table is only touched by one goroutine.
+//
+// All the tables are applied even if some of them fail; the returned error
+// is that of the first table, in the order given, that failed.  If backoffs
+// is non-nil, a table that keeps failing is only retried once its backoff
+// has expired; until then, its error is backoff.ErrBackingOff.
+func ApplyTables(tables []*Table, maxParallelism int, backoffs *backoff.Manager) error {
+	if maxParallelism < 1 {
+		maxParallelism = 1
+	}
+	if maxParallelism > len(tables) {
+		maxParallelism = len(tables)
+	}
+
+	errs := make([]error, len(tables))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < maxParallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				table := tables[idx]
+				if backoffs == nil {
+					errs[idx] = table.Apply()
+					continue
+				}
+				key := fmt.Sprintf("ipv%d/%s", table.IPVersion, table.Name)
+				errs[idx] = backoffs.Apply(key, table.Apply)
+			}
+		}()
+	}
+	for idx := range tables {
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+
+	var firstErr error
+	for idx, err := range errs {
+		if err == nil {
+			continue
+		}
+		table := tables[idx]
+		if err != backoff.ErrBackingOff {
+			log.WithError(err).WithFields(log.Fields{
+				"table":     table.Name,
+				"ipVersion": table.IPVersion,
+			}).Warn("Failed to apply iptables table")
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("failed to apply IPv%d %s table: %v",
+				table.IPVersion, table.Name, err)
+		}
+	}
+	return firstErr
+}
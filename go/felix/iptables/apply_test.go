@@ -0,0 +1,124 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/backoff"
+	"sync"
+	"time"
+)
+
+var _ = Describe("ApplyTables", func() {
+	var dataplanes []*mockDataplane
+	var tables []*Table
+
+	BeforeEach(func() {
+		dataplanes = nil
+		tables = nil
+		for _, ipVersion := range []uint8{4, 6} {
+			for _, name := range []string{"filter", "nat", "mangle", "raw"} {
+				dataplane := newMockDataplane(name, map[string][]string{})
+				table := NewTable(name, ipVersion, TableOptions{
+					NewCmdOverride: dataplane.newCmd,
+				})
+				table.UpdateChain(&Chain{
+					Name:  "cali-foo",
+					Rules: []Rule{{Action: AcceptAction{}}},
+				})
+				dataplanes = append(dataplanes, dataplane)
+				tables = append(tables, table)
+			}
+		}
+	})
+
+	It("should apply all the tables", func() {
+		Expect(ApplyTables(tables, 3, nil)).To(Succeed())
+		for _, dataplane := range dataplanes {
+			Expect(dataplane.Chains).To(HaveKey("cali-foo"))
+		}
+	})
+
+	It("should apply tables concurrently, up to the limit", func() {
+		var lock sync.Mutex
+		inFlight, maxInFlight := 0, 0
+		bothInFlight := make(chan struct{})
+		overlapped := false
+		for _, dataplane := range dataplanes {
+			dataplane.OnRestore = func() {
+				lock.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				if inFlight == 2 && !overlapped {
+					overlapped = true
+					close(bothInFlight)
+				}
+				lock.Unlock()
+				// Wait for the other worker so that we know the
+				// applies overlapped.
+				select {
+				case <-bothInFlight:
+				case <-time.After(5 * time.Second):
+				}
+				lock.Lock()
+				inFlight--
+				lock.Unlock()
+			}
+		}
+		Expect(ApplyTables(tables, 2, nil)).To(Succeed())
+		Expect(maxInFlight).To(Equal(2))
+		for _, dataplane := range dataplanes {
+			Expect(dataplane.Chains).To(HaveKey("cali-foo"))
+		}
+	})
+
+	It("should apply the other tables if one fails", func() {
+		// Fail every attempt at the IPv4 nat table.
+		dataplanes[1].OnRestore = func() {
+			dataplanes[1].FailNextRestore = true
+		}
+		Expect(ApplyTables(tables, 4, nil)).To(MatchError(
+			"failed to apply IPv4 nat table: simulated failure"))
+		for i, dataplane := range dataplanes {
+			if i == 1 {
+				Expect(dataplane.Chains).NotTo(HaveKey("cali-foo"))
+			} else {
+				Expect(dataplane.Chains).To(HaveKey("cali-foo"))
+			}
+		}
+	})
+
+	It("should back off from a table that keeps failing", func() {
+		dataplanes[1].OnRestore = func() {
+			dataplanes[1].FailNextRestore = true
+		}
+		backoffs := backoff.NewManager("iptables", backoff.Config{
+			InitialDelay: time.Hour,
+		}, nil)
+		Expect(ApplyTables(tables, 4, backoffs)).To(HaveOccurred())
+		numRestores := len(dataplanes[1].RestoreInputs)
+
+		tables[0].UpdateChain(&Chain{Name: "cali-bar"})
+		Expect(ApplyTables(tables, 4, backoffs)).To(MatchError(
+			"failed to apply IPv4 nat table: " + backoff.ErrBackingOff.Error()))
+		Expect(dataplanes[1].RestoreInputs).To(HaveLen(numRestores))
+		Expect(dataplanes[0].Chains).To(HaveKey("cali-bar"))
+	})
+})
@@ -0,0 +1,254 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// iptables-save doesn't print rules back the way that we wrote them: it uses
+// short options, names protocols, adds prefix lengths to addresses, and so
+// on.  CanonicalArgs converts both forms to one that can be compared.
+
+var optionAliases = map[string]string{
+	"--jump":          "-j",
+	"--goto":          "-g",
+	"--in-interface":  "-i",
+	"--out-interface": "-o",
+	"--source":        "-s",
+	"--src":           "-s",
+	"--destination":   "-d",
+	"--dst":           "-d",
+	"--protocol":      "-p",
+	"--match":         "-m",
+	// multiport.
+	"--destination-ports": "--dports",
+	"--source-ports":      "--sports",
+}
+
+// basicOptions are the options that aren't part of a match extension.
+// iptables-save prints them ahead of any extensions.
+var basicOptions = map[string]bool{
+	"-p": true,
+	"-s": true,
+	"-d": true,
+	"-i": true,
+	"-o": true,
+	"-f": true,
+}
+
+var protocolNames = map[string]string{
+	"1":      "icmp",
+	"6":      "tcp",
+	"17":     "udp",
+	"47":     "gre",
+	"50":     "esp",
+	"51":     "ah",
+	"58":     "ipv6-icmp",
+	"132":    "sctp",
+	"136":    "udplite",
+	"icmpv6": "ipv6-icmp",
+}
+
+// CanonicalArgs returns a canonical form of a rule's arguments (as returned
+// by ParseRule) such that two rules that iptables treats as the same have the
+// same canonical form.  In particular, the canonical form of the arguments
+// of a rule that we rendered matches that of the same rule as printed by
+// iptables-save.
+//
+// The options within each match extension, and within the target, are
+// sorted, since iptables-save prints them in its own order.
+func CanonicalArgs(args []string) []string {
+	var basic []option
+	var segments [][]option
+	for _, opt := range splitOptions(args) {
+		opt = canonicalOption(opt)
+		switch {
+		case opt.isEmpty():
+			continue
+		case basicOptions[opt.name]:
+			basic = append(basic, opt)
+		case opt.name == "-m" || opt.name == "-j" || opt.name == "-g" || len(segments) == 0:
+			segments = append(segments, []option{opt})
+		default:
+			segments[len(segments)-1] = append(segments[len(segments)-1], opt)
+		}
+	}
+
+	canonical := []string{}
+	sort.Sort(optionsByName(basic))
+	for _, opt := range basic {
+		canonical = opt.appendTo(canonical)
+	}
+	for _, segment := range segments {
+		// Leave the "-m <extension>" or "-j <target>" at the front.
+		sort.Sort(optionsByName(segment[1:]))
+		for _, opt := range segment {
+			canonical = opt.appendTo(canonical)
+		}
+	}
+	return canonical
+}
+
+// option is a single option, with its values, such as "! -p tcp".
+type option struct {
+	negated bool
+	name    string
+	values  []string
+}
+
+func (o option) isEmpty() bool {
+	return o.name == "" && len(o.values) == 0
+}
+
+func (o option) appendTo(args []string) []string {
+	if o.negated {
+		args = append(args, "!")
+	}
+	if o.name != "" {
+		args = append(args, o.name)
+	}
+	return append(args, o.values...)
+}
+
+func (o option) String() string {
+	return strings.Join(o.appendTo(nil), " ")
+}
+
+type optionsByName []option
+
+func (s optionsByName) Len() int           { return len(s) }
+func (s optionsByName) Less(i, j int) bool { return s[i].String() < s[j].String() }
+func (s optionsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// splitOptions splits the arguments into options.  Each option starts with
+// an argument that begins with "-", optionally preceded by a "!".
+func splitOptions(args []string) []option {
+	var opts []option
+	var current option
+	started := false
+	for _, arg := range args {
+		isName := strings.HasPrefix(arg, "-") && len(arg) > 1
+		if arg == "!" || isName {
+			if started && (current.name != "" || current.negated && arg == "!") {
+				opts = append(opts, current)
+				current = option{}
+			}
+			started = true
+			if arg == "!" {
+				current.negated = true
+			} else {
+				current.name = arg
+			}
+			continue
+		}
+		started = true
+		current.values = append(current.values, arg)
+	}
+	if started {
+		opts = append(opts, current)
+	}
+	return opts
+}
+
+func canonicalOption(opt option) option {
+	if alias, ok := optionAliases[opt.name]; ok {
+		opt.name = alias
+	}
+	if len(opt.values) != 1 {
+		return opt
+	}
+	value := opt.values[0]
+	switch opt.name {
+	case "-p":
+		value = strings.ToLower(value)
+		if name, ok := protocolNames[value]; ok {
+			value = name
+		}
+	case "-s", "-d":
+		cidr := canonicalCIDR(value)
+		if !opt.negated && (cidr == "0.0.0.0/0" || cidr == "::/0") {
+			// iptables-save omits a match on all addresses.
+			return option{}
+		}
+		value = cidr
+	case "--mark", "--set-xmark":
+		value = canonicalMark(value)
+	case "--set-mark":
+		// The MARK target's --set-mark value/mask is shorthand for
+		// --set-xmark value/(mask|value), which is what iptables-save
+		// prints.
+		if v, m, ok := parseMark(value); ok {
+			opt.name = "--set-xmark"
+			value = formatMark(v, m|v)
+		}
+	case "--ctstate", "--state":
+		states := strings.Split(strings.ToUpper(value), ",")
+		sort.Strings(states)
+		value = strings.Join(states, ",")
+	}
+	opt.values = []string{value}
+	return opt
+}
+
+// canonicalCIDR converts an address or CIDR to a CIDR with the host bits
+// cleared.  Anything that doesn't parse is returned as is; it may be a
+// hostname, for example.
+func canonicalCIDR(value string) string {
+	if !strings.Contains(value, "/") {
+		if strings.Contains(value, ":") {
+			value += "/128"
+		} else {
+			value += "/32"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return value
+	}
+	return ipNet.String()
+}
+
+func canonicalMark(value string) string {
+	if v, m, ok := parseMark(value); ok {
+		return formatMark(v, m)
+	}
+	return value
+}
+
+// parseMark parses a "value/mask" or "value" mark; the mask defaults to all
+// ones.
+func parseMark(value string) (v, m uint32, ok bool) {
+	parts := strings.SplitN(value, "/", 2)
+	v64, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	m64 := uint64(0xffffffff)
+	if len(parts) == 2 {
+		if m64, err = strconv.ParseUint(parts[1], 0, 32); err != nil {
+			return 0, 0, false
+		}
+	}
+	return uint32(v64), uint32(m64), true
+}
+
+func formatMark(v, m uint32) string {
+	return fmt.Sprintf("0x%x/0x%x", v, m)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	"strings"
+
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("CanonicalArgs equivalence",
+	func(ours Rule, saved string, equivalent bool) {
+		parsed, err := ParseRule(ours.RenderAppend("cali-foo", ""))
+		Expect(err).NotTo(HaveOccurred())
+		savedArgs := strings.Fields(saved)
+		if equivalent {
+			Expect(CanonicalArgs(parsed.Args)).To(Equal(CanonicalArgs(savedArgs)))
+		} else {
+			Expect(CanonicalArgs(parsed.Args)).NotTo(Equal(CanonicalArgs(savedArgs)))
+		}
+	},
+	Entry("short options",
+		Rule{Match: Match().InInterface("cali+").OutInterface("eth0"), Action: JumpAction{Target: "cali-x"}},
+		"-i cali+ -o eth0 -j cali-x", true),
+	Entry("goto",
+		Rule{Action: GotoAction{Target: "cali-x"}},
+		"-g cali-x", true),
+	Entry("protocol number",
+		Rule{Match: Match().ProtocolNum(6), Action: AcceptAction{}},
+		"-p tcp -j ACCEPT", true),
+	Entry("negated protocol number",
+		Rule{Match: Match().NotProtocolNum(17), Action: AcceptAction{}},
+		"! -p udp -j ACCEPT", true),
+	Entry("different protocols",
+		Rule{Match: Match().ProtocolNum(6), Action: AcceptAction{}},
+		"-p udp -j ACCEPT", false),
+	Entry("SCTP multiport",
+		Rule{Match: Match().ProtocolNum(132).DestPorts(2905, 3868), Action: AcceptAction{}},
+		"-p sctp -m multiport --dports 2905,3868 -j ACCEPT", true),
+	Entry("UDP-Lite protocol number",
+		Rule{Match: Match().ProtocolNum(136), Action: AcceptAction{}},
+		"-p udplite -j ACCEPT", true),
+	Entry("ESP protocol",
+		Rule{Match: Match().ProtocolESP(), Action: AcceptAction{}},
+		"-p esp -j ACCEPT", true),
+	Entry("source MAC",
+		Rule{Match: Match().NotSourceMAC("aa:bb:cc:dd:ee:ff"), Action: DropAction{}},
+		"-m mac ! --mac-source AA:BB:CC:DD:EE:FF -j DROP", true),
+	Entry("IPv6 DNAT with port range",
+		Rule{Action: DNATAction{DestAddr: "fd00::1", DestPort: 8080, MaxDestPort: 8090}},
+		"-j DNAT --to-destination [fd00::1]:8080-8090", true),
+	Entry("NETMAP",
+		Rule{Action: NetmapAction{ToNet: "192.168.0.0/24"}},
+		"-j NETMAP --to 192.168.0.0/24", true),
+	Entry("MASQUERADE options",
+		Rule{Action: MasqAction{MinPort: 1024, MaxPort: 65535, RandomFully: true}},
+		"-j MASQUERADE --random-fully --to-ports 1024-65535", true),
+	Entry("connbytes",
+		Rule{Match: Match().ConnBytes(ConnBytesModeBytes, ConnBytesDirOriginal, 1000000, 0), Action: DropAction{}},
+		"-m connbytes --connbytes 1000000 --connbytes-mode bytes --connbytes-dir original -j DROP", true),
+	Entry("connlimit",
+		Rule{Match: Match().ConnLimitAbove(20, 32), Action: DropAction{}},
+		"-m connlimit --connlimit-above 20 --connlimit-mask 32 --connlimit-saddr -j DROP", true),
+	Entry("statistic",
+		Rule{Match: Match().StatisticRandom(0.25), Action: JumpAction{Target: "cali-lbb-abcd"}},
+		"-m statistic --mode random --probability 0.25000000000 -j cali-lbb-abcd", true),
+	Entry("recent check",
+		Rule{Match: Match().RecentCheck("cali-lbb-abcd", 10800, 4), Action: JumpAction{Target: "cali-lbb-abcd"}},
+		"-m recent --rcheck --seconds 10800 --reap --name cali-lbb-abcd --mask 255.255.255.255 --rsource "+
+			"-j cali-lbb-abcd", true),
+	Entry("cgroup class ID",
+		Rule{Match: Match().CgroupClassID(0x100001), Action: AcceptAction{}},
+		"-m cgroup --cgroup 1048577 -j ACCEPT", true),
+	Entry("ICMPv6 protocol",
+		Rule{Match: Match().Protocol("icmpv6")},
+		"-p ipv6-icmp", true),
+	Entry("basic options after extensions",
+		Rule{Match: Match().MarkSet(0x10).Protocol("tcp").DestPorts(80, 443), Action: AcceptAction{}},
+		"-p tcp -m mark --mark 0x10/0x10 -m multiport --dports 80,443 -j ACCEPT", true),
+	Entry("elided all-addresses match",
+		Rule{Match: Match().SourceNet("0.0.0.0/0").DestNet("::/0")},
+		"", true),
+	Entry("negated all-addresses match",
+		Rule{Match: Match().NotSourceNet("0.0.0.0/0")},
+		"", false),
+	Entry("host address",
+		Rule{Match: Match().SourceNet("10.0.0.1").NotDestNet("fd00::1")},
+		"-s 10.0.0.1/32 ! -d fd00::1/128", true),
+	Entry("CIDR with host bits",
+		Rule{Match: Match().DestNet("10.1.2.3/8")},
+		"-d 10.0.0.0/8", true),
+	Entry("different addresses",
+		Rule{Match: Match().DestNet("10.0.0.2")},
+		"-d 10.0.0.1/32", false),
+	Entry("mark clear",
+		Rule{Match: Match().MarkClear(0x10), Action: ClearMarkAction{Mark: 0x8}},
+		"-m mark --mark 0x0/0x10 -j MARK --set-xmark 0x0/0x8", true),
+	Entry("set mark",
+		Rule{Action: SetMarkAction{Mark: 0x8}},
+		"-j MARK --set-xmark 0x8/0x8", true),
+	Entry("different marks",
+		Rule{Action: SetMarkAction{Mark: 0x8}},
+		"-j MARK --set-xmark 0x10/0x10", false),
+	Entry("set masked mark",
+		Rule{Action: SetMaskedMarkAction{Mark: 0x3000, Mask: 0xf000}},
+		"-j MARK --set-xmark 0x3000/0xf000", true),
+	Entry("restore connmark",
+		Rule{Action: RestoreConnMarkAction{RestoreMask: 0xf000}},
+		"-j CONNMARK --restore-mark --nfmask 0xf000 --ctmask 0xf000", true),
+	Entry("connmark set",
+		Rule{Match: Match().ConnMarkSet(0x20), Action: SetConnMarkAction{Mark: 0x20, Mask: 0x20}},
+		"-m connmark --mark 0x20/0x20 -j CONNMARK --set-xmark 0x20/0x20", true),
+	Entry("conntrack states in a different order",
+		Rule{Match: Match().NotConntrackState("ESTABLISHED,RELATED")},
+		"-m conntrack ! --ctstate RELATED,ESTABLISHED", true),
+	Entry("target options in a different order",
+		Rule{Action: NflogAction{Group: 1, Prefix: "D|profiles"}},
+		"-j NFLOG --nflog-prefix D|profiles --nflog-group 1", true),
+	Entry("negation moved to a different option",
+		Rule{Match: Match().NotSourceIPSet("cali-s")},
+		"-m set --match-set cali-s src", false),
+)
@@ -0,0 +1,230 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultClass is a class of command failure that a FaultInjector injects.
+type FaultClass int
+
+const (
+	// FaultNone lets the command run normally.
+	FaultNone FaultClass = iota
+	// FaultExitCode makes the command fail without running it, as if it
+	// had exited with a non-zero status.
+	FaultExitCode
+	// FaultTimeout makes the command hang for the FaultInjector's timeout
+	// and then fail without running it.
+	FaultTimeout
+	// FaultPartial runs the command with only the first half of its input
+	// and then fails, as if the dataplane had been changed part way
+	// through.  A command without input returns the first half of its
+	// output along with the failure.
+	FaultPartial
+)
+
+// AllFaultClasses lists every FaultClass that is a failure.
+var AllFaultClasses = []FaultClass{FaultExitCode, FaultTimeout, FaultPartial}
+
+func (c FaultClass) String() string {
+	switch c {
+	case FaultNone:
+		return "none"
+	case FaultExitCode:
+		return "exit-code"
+	case FaultTimeout:
+		return "timeout"
+	case FaultPartial:
+		return "partial"
+	}
+	return fmt.Sprintf("FaultClass(%d)", int(c))
+}
+
+// InjectedFault is the error returned by a command that a FaultInjector
+// made fail.
+type InjectedFault struct {
+	Class FaultClass
+	Cmd   string
+}
+
+func (e InjectedFault) Error() string {
+	return fmt.Sprintf("injected %v failure of %q", e.Class, e.Cmd)
+}
+
+// Timeout returns true for a FaultTimeout, so that the failure is
+// classified as a timeout.
+func (e InjectedFault) Timeout() bool {
+	return e.Class == FaultTimeout
+}
+
+// FaultInjector wraps a command constructor, such as a mock dataplane's,
+// and makes some of the commands fail, so that tests can check that the
+// Table's retry and resync logic recovers from every class of failure.
+// Pass its NewCmd method as TableOptions.NewCmdOverride.  It is safe for
+// concurrent use.
+type FaultInjector struct {
+	newCmd func(name string, arg ...string) CmdIface
+
+	mutex sync.Mutex
+	// probability is the chance that each command fails with a random one
+	// of classes.
+	probability float64
+	classes     []FaultClass
+	timeout     time.Duration
+	rand        *rand.Rand
+	// forced are the faults to inject into the next commands, in order.
+	forced   []FaultClass
+	injected map[FaultClass]int
+}
+
+// NewFaultInjector creates a FaultInjector that passes commands through to
+// newCmd.  It doesn't inject any faults until told to.  The seed makes the
+// random faults reproducible.
+func NewFaultInjector(newCmd func(name string, arg ...string) CmdIface, seed int64) *FaultInjector {
+	return &FaultInjector{
+		newCmd:   newCmd,
+		timeout:  10 * time.Millisecond,
+		rand:     rand.New(rand.NewSource(seed)),
+		injected: map[FaultClass]int{},
+	}
+}
+
+// SetRandomFaults makes each command fail with the given probability, with
+// a class chosen at random from classes.
+func (f *FaultInjector) SetRandomFaults(probability float64, classes ...FaultClass) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.probability = probability
+	f.classes = classes
+}
+
+// SetTimeout sets how long a command hangs for before a FaultTimeout
+// failure.  Defaults to 10ms.
+func (f *FaultInjector) SetTimeout(timeout time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.timeout = timeout
+}
+
+// InjectNext injects the given classes of fault into the next commands,
+// one each, in order, ahead of any random faults.  FaultNone lets a command
+// through.
+func (f *FaultInjector) InjectNext(classes ...FaultClass) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.forced = append(f.forced, classes...)
+}
+
+// Injected returns the number of faults of the given class that have been
+// injected.
+func (f *FaultInjector) Injected(class FaultClass) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.injected[class]
+}
+
+// NewCmd creates a command that may fail.  The fault, if any, is chosen
+// when the command is created.
+func (f *FaultInjector) NewCmd(name string, arg ...string) CmdIface {
+	cmd := f.newCmd(name, arg...)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	class := FaultNone
+	switch {
+	case len(f.forced) > 0:
+		class = f.forced[0]
+		f.forced = f.forced[1:]
+	case len(f.classes) > 0 && f.rand.Float64() < f.probability:
+		class = f.classes[f.rand.Intn(len(f.classes))]
+	}
+	if class == FaultNone {
+		return cmd
+	}
+	f.injected[class]++
+	cmdString := strings.Join(append([]string{name}, arg...), " ")
+	log.WithFields(log.Fields{
+		"cmd":   cmdString,
+		"class": class,
+	}).Info("Injecting command failure")
+	return &faultyCmd{
+		cmd:     cmd,
+		fault:   InjectedFault{Class: class, Cmd: cmdString},
+		timeout: f.timeout,
+	}
+}
+
+// faultyCmd is a command that fails.
+type faultyCmd struct {
+	cmd     CmdIface
+	fault   InjectedFault
+	timeout time.Duration
+	stdin   io.Reader
+}
+
+func (c *faultyCmd) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+func (c *faultyCmd) Output() ([]byte, error) {
+	return c.run(c.cmd.Output)
+}
+
+func (c *faultyCmd) CombinedOutput() ([]byte, error) {
+	return c.run(c.cmd.CombinedOutput)
+}
+
+func (c *faultyCmd) run(output func() ([]byte, error)) ([]byte, error) {
+	switch c.fault.Class {
+	case FaultTimeout:
+		time.Sleep(c.timeout)
+	case FaultPartial:
+		if c.stdin == nil {
+			out, _ := output()
+			return firstHalfOfLines(out, nil), c.fault
+		}
+		var input bytes.Buffer
+		input.ReadFrom(c.stdin)
+		// Keep the input well-formed so that a real iptables-restore
+		// commits the part that it's given.
+		var suffix []byte
+		if bytes.HasPrefix(input.Bytes(), []byte("*")) {
+			suffix = []byte("COMMIT\n")
+		}
+		c.cmd.SetStdin(bytes.NewReader(firstHalfOfLines(input.Bytes(), suffix)))
+		out, _ := output()
+		return out, c.fault
+	}
+	return []byte(c.fault.Error()), c.fault
+}
+
+// firstHalfOfLines returns the first half of the lines in data, rounded
+// down, followed by suffix if it isn't already the last line.
+func firstHalfOfLines(data, suffix []byte) []byte {
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	half := bytes.Join(lines[:len(lines)/2], nil)
+	if len(suffix) > 0 && !bytes.HasSuffix(half, suffix) {
+		half = append(half, suffix...)
+	}
+	return half
+}
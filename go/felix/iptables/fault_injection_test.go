@@ -0,0 +1,135 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/cmderrors"
+	"math/rand"
+)
+
+var _ = Describe("Table with injected faults", func() {
+	var dataplane *mockDataplane
+	var faults *FaultInjector
+	var table *Table
+
+	chain := func(name string, numRules int) *Chain {
+		c := &Chain{Name: name}
+		for i := 0; i < numRules; i++ {
+			c.Rules = append(c.Rules, Rule{
+				Match:  Match().DestPorts(uint16(1000 + i)),
+				Action: AcceptAction{},
+			})
+		}
+		return c
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD":    {"--jump ACCEPT"},
+			"cali-stale": {"--jump DROP"},
+		})
+		faults = NewFaultInjector(dataplane.newCmd, 1)
+		table = NewTable("filter", 4, TableOptions{
+			NewCmdOverride: faults.NewCmd,
+		})
+	})
+
+	DescribeTable("should recover from a single failure",
+		func(class FaultClass, cmdIdx int) {
+			table.UpdateChains([]*Chain{chain("cali-a", 4), chain("cali-b", 4)})
+			table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-a"}}})
+			// Let the first cmdIdx commands through.
+			for i := 0; i < cmdIdx; i++ {
+				faults.InjectNext(FaultNone)
+			}
+			faults.InjectNext(class)
+			Expect(table.Apply()).To(Succeed())
+			Expect(faults.Injected(class)).To(Equal(1))
+			Expect(dataplane.Chains["cali-a"]).To(HaveLen(4))
+			Expect(dataplane.Chains["cali-b"]).To(HaveLen(4))
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-stale"))
+		},
+		Entry("exit code from iptables-save", FaultExitCode, 0),
+		Entry("timeout of iptables-save", FaultTimeout, 0),
+		Entry("partial iptables-save output", FaultPartial, 0),
+		Entry("exit code from iptables-restore", FaultExitCode, 1),
+		Entry("timeout of iptables-restore", FaultTimeout, 1),
+		Entry("partial iptables-restore", FaultPartial, 1),
+	)
+
+	It("should leave a partially-applied restore in a state that a resync repairs", func() {
+		Expect(table.Apply()).To(Succeed())
+		table.UpdateChains([]*Chain{chain("cali-a", 6), chain("cali-b", 6)})
+		faults.InjectNext(FaultPartial, FaultExitCode, FaultExitCode)
+		Expect(table.Apply()).To(HaveOccurred())
+		Expect(dataplane.Chains).To(HaveKey("cali-a"))
+		Expect(dataplane.Chains).NotTo(HaveKey("cali-b"))
+
+		Expect(table.Apply()).To(Succeed())
+		Expect(dataplane.Chains["cali-a"]).To(HaveLen(6))
+		Expect(dataplane.Chains["cali-b"]).To(HaveLen(6))
+	})
+
+	It("should classify the failures that it gives up on", func() {
+		Expect(table.Apply()).To(Succeed())
+		table.UpdateChains([]*Chain{chain("cali-a", 6)})
+		faults.SetRandomFaults(1, FaultTimeout)
+		err := table.Apply()
+		Expect(err).To(HaveOccurred())
+		Expect(cmderrors.ClassOf(err)).To(Equal(cmderrors.ClassTimeout))
+		Expect(cmderrors.ConsecutiveFailures("iptables-restore", "filter")).To(BeNumerically(">", 0))
+
+		faults.SetRandomFaults(0)
+		Expect(table.Apply()).To(Succeed())
+		Expect(cmderrors.ConsecutiveFailures("iptables-restore", "filter")).To(Equal(0))
+	})
+
+	It("should converge despite random failures of every class", func() {
+		faults.SetRandomFaults(0.3, AllFaultClasses...)
+		r := rand.New(rand.NewSource(2))
+		expected := map[string]int{}
+		for round := 0; round < 50; round++ {
+			name := fmt.Sprintf("cali-%d", r.Intn(5))
+			if numRules := r.Intn(4); numRules == 0 {
+				table.RemoveChainByName(name)
+				delete(expected, name)
+			} else {
+				table.UpdateChain(chain(name, numRules))
+				expected[name] = numRules
+			}
+			// Apply gives up after a few attempts; keep going until it
+			// succeeds, as the dataplane driver would.
+			Eventually(table.Apply, "10s", "1ms").Should(Succeed())
+		}
+		for _, class := range AllFaultClasses {
+			Expect(faults.Injected(class)).To(BeNumerically(">", 0), class.String())
+		}
+
+		faults.SetRandomFaults(0)
+		table.InvalidateDataplaneCache()
+		Expect(table.Apply()).To(Succeed())
+		Expect(dataplane.Chains).To(HaveLen(len(expected) + 1))
+		for name, numRules := range expected {
+			Expect(dataplane.Chains[name]).To(HaveLen(numRules), name)
+		}
+	})
+})
@@ -0,0 +1,232 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Features records the optional iptables features that the dataplane
+// supports.  The versions that each one needs are in featureGates.
+type Features struct {
+	// MASQFullyRandom is true if MASQUERADE supports --random-fully.
+	MASQFullyRandom bool
+	// SYNPROXY is true if the SYNPROXY target is available.
+	SYNPROXY bool
+	// RPFilter is true if the rpfilter match is available.
+	RPFilter bool
+}
+
+// The names of the optional features, for Features.Require.
+const (
+	FeatureMASQFullyRandom = "random-fully"
+	FeatureSYNPROXY        = "SYNPROXY"
+	FeatureRPFilter        = "rpfilter"
+)
+
+var (
+	iptablesVersionRegexp = regexp.MustCompile(`v(\d+)\.(\d+)\.(\d+)`)
+	kernelVersionRegexp   = regexp.MustCompile(`^(\d+)\.(\d+)(?:\.(\d+))?`)
+
+	v1_4_13 = version{1, 4, 13}
+	v1_4_21 = version{1, 4, 21}
+	v1_6_2  = version{1, 6, 2}
+	v3_3    = version{3, 3, 0}
+	v3_12   = version{3, 12, 0}
+	v3_13   = version{3, 13, 0}
+)
+
+// featureGate describes an optional match or target and the versions of
+// iptables and of the kernel that it needs.
+type featureGate struct {
+	name string
+	// kind is "match", "target" or, for an option of a target, "option".
+	kind        string
+	minIptables version
+	minKernel   version
+	// flag returns the Features field that records whether the feature is
+	// supported.
+	flag func(f *Features) *bool
+}
+
+// featureGates lists the optional features that Felix may emit.  A feature
+// is only enabled if both versions are known and new enough.
+var featureGates = []featureGate{
+	{
+		name:        FeatureMASQFullyRandom,
+		kind:        "option",
+		minIptables: v1_6_2,
+		minKernel:   v3_13,
+		flag:        func(f *Features) *bool { return &f.MASQFullyRandom },
+	},
+	{
+		name:        FeatureSYNPROXY,
+		kind:        "target",
+		minIptables: v1_4_21,
+		minKernel:   v3_12,
+		flag:        func(f *Features) *bool { return &f.SYNPROXY },
+	},
+	{
+		name:        FeatureRPFilter,
+		kind:        "match",
+		minIptables: v1_4_13,
+		minKernel:   v3_3,
+		flag:        func(f *Features) *bool { return &f.RPFilter },
+	},
+}
+
+// UnsupportedFeatureError is returned by Features.Require for a feature
+// that the dataplane doesn't support.
+type UnsupportedFeatureError struct {
+	Feature     string
+	Kind        string
+	MinIptables string
+	MinKernel   string
+}
+
+func (e UnsupportedFeatureError) Error() string {
+	return fmt.Sprintf("the %s %s isn't supported on this host; it needs iptables %s "+
+		"and kernel %s or later", e.Feature, e.Kind, e.MinIptables, e.MinKernel)
+}
+
+// Require returns nil if the named feature is supported or, if it isn't,
+// an UnsupportedFeatureError that explains what it needs.
+func (f *Features) Require(name string) error {
+	for _, gate := range featureGates {
+		if gate.name != name {
+			continue
+		}
+		if *gate.flag(f) {
+			return nil
+		}
+		return UnsupportedFeatureError{
+			Feature:     gate.name,
+			Kind:        gate.kind,
+			MinIptables: gate.minIptables.String(),
+			MinKernel:   gate.minKernel.String(),
+		}
+	}
+	return fmt.Errorf("unknown iptables feature %q", name)
+}
+
+// FeatureDetector works out which Features the dataplane supports from the
+// versions of iptables and of the kernel.  It only does so once; the
+// versions can't change while Felix is running.
+type FeatureDetector struct {
+	// NewCmd and ReadFile may be overridden for testing.
+	NewCmd   func(name string, arg ...string) CmdIface
+	ReadFile func(filename string) ([]byte, error)
+
+	features *Features
+}
+
+func NewFeatureDetector() *FeatureDetector {
+	return &FeatureDetector{
+		NewCmd:   newRealCmd,
+		ReadFile: ioutil.ReadFile,
+	}
+}
+
+// GetFeatures returns the supported features.  If either version can't be
+// determined, the features that depend on it are assumed to be missing.
+func (d *FeatureDetector) GetFeatures() *Features {
+	if d.features == nil {
+		iptablesVersion := d.iptablesVersion()
+		kernelVersion := d.kernelVersion()
+		d.features = &Features{}
+		for _, gate := range featureGates {
+			*gate.flag(d.features) = iptablesVersion.atLeast(gate.minIptables) &&
+				kernelVersion.atLeast(gate.minKernel)
+		}
+		log.WithFields(log.Fields{
+			"iptablesVersion": iptablesVersion.String(),
+			"kernelVersion":   kernelVersion.String(),
+			"features":        *d.features,
+		}).Info("Detected iptables features")
+	}
+	return d.features
+}
+
+func (d *FeatureDetector) iptablesVersion() version {
+	output, err := d.NewCmd("iptables", "--version").Output()
+	if err != nil {
+		log.WithError(err).Warn("Failed to get iptables version")
+		return nil
+	}
+	return parseVersion(iptablesVersionRegexp, string(output))
+}
+
+func (d *FeatureDetector) kernelVersion() version {
+	output, err := d.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		log.WithError(err).Warn("Failed to get kernel version")
+		return nil
+	}
+	return parseVersion(kernelVersionRegexp, strings.TrimSpace(string(output)))
+}
+
+// version is a dotted version number, such as 1.6.2.  nil means unknown.
+type version []int
+
+func parseVersion(re *regexp.Regexp, s string) version {
+	m := re.FindStringSubmatch(s)
+	if m == nil {
+		log.WithField("version", s).Warn("Failed to parse version")
+		return nil
+	}
+	v := make(version, len(m)-1)
+	for i, part := range m[1:] {
+		// A missing optional part is left as 0.
+		v[i], _ = strconv.Atoi(part)
+	}
+	return v
+}
+
+// String returns the version in dotted form, or "unknown".  Trailing zero
+// parts, after the first two, are omitted.
+func (v version) String() string {
+	if v == nil {
+		return "unknown"
+	}
+	parts := v
+	for len(parts) > 2 && parts[len(parts)-1] == 0 {
+		parts = parts[:len(parts)-1]
+	}
+	strs := make([]string, len(parts))
+	for i, part := range parts {
+		strs[i] = strconv.Itoa(part)
+	}
+	return strings.Join(strs, ".")
+}
+
+// atLeast returns true if v is known and is the same as or newer than
+// other, which must have the same number of parts.
+func (v version) atLeast(other version) bool {
+	if v == nil {
+		return false
+	}
+	for i := range other {
+		if v[i] != other[i] {
+			return v[i] > other[i]
+		}
+	}
+	return true
+}
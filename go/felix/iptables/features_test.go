@@ -0,0 +1,99 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	"errors"
+	"io"
+
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// versionCmd is a CmdIface that prints a fixed version string.
+type versionCmd struct {
+	output string
+}
+
+func (c versionCmd) SetStdin(r io.Reader) {}
+
+func (c versionCmd) Output() ([]byte, error) {
+	if c.output == "" {
+		return nil, errors.New("command failed")
+	}
+	return []byte(c.output), nil
+}
+
+func (c versionCmd) CombinedOutput() ([]byte, error) {
+	return c.Output()
+}
+
+var _ = DescribeTable("FeatureDetector",
+	func(iptablesVersion, kernelVersion string, expected Features) {
+		detector := NewFeatureDetector()
+		detector.NewCmd = func(name string, arg ...string) CmdIface {
+			return versionCmd{output: iptablesVersion}
+		}
+		detector.ReadFile = func(filename string) ([]byte, error) {
+			if kernelVersion == "" {
+				return nil, errors.New("no such file")
+			}
+			return []byte(kernelVersion), nil
+		}
+		Expect(*detector.GetFeatures()).To(Equal(expected))
+	},
+	Entry("old iptables", "iptables v1.6.1\n", "4.15.0-20-generic\n",
+		Features{SYNPROXY: true, RPFilter: true}),
+	Entry("new iptables", "iptables v1.6.2\n", "4.15.0-20-generic\n",
+		Features{MASQFullyRandom: true, SYNPROXY: true, RPFilter: true}),
+	Entry("nft iptables", "iptables v1.8.4 (nf_tables)\n", "5.4.0\n",
+		Features{MASQFullyRandom: true, SYNPROXY: true, RPFilter: true}),
+	Entry("old kernel", "iptables v1.6.2\n", "3.12.0-170-generic\n",
+		Features{SYNPROXY: true, RPFilter: true}),
+	Entry("kernel with random-fully", "iptables v1.6.2\n", "3.13.0-170-generic\n",
+		Features{MASQFullyRandom: true, SYNPROXY: true, RPFilter: true}),
+	Entry("kernel without patch version", "iptables v1.6.2\n", "3.14\n",
+		Features{MASQFullyRandom: true, SYNPROXY: true, RPFilter: true}),
+	Entry("iptables without SYNPROXY", "iptables v1.4.20\n", "4.15.0\n",
+		Features{RPFilter: true}),
+	Entry("kernel without SYNPROXY", "iptables v1.6.2\n", "3.10.0-957.el7.x86_64\n",
+		Features{RPFilter: true}),
+	Entry("iptables without rpfilter", "iptables v1.4.12\n", "4.15.0\n", Features{}),
+	Entry("kernel without rpfilter", "iptables v1.6.2\n", "3.2.0\n", Features{}),
+	Entry("unknown iptables version", "", "4.15.0\n", Features{}),
+	Entry("unparseable iptables version", "iptables unknown\n", "4.15.0\n", Features{}),
+	Entry("unknown kernel version", "iptables v1.6.2\n", "", Features{}),
+)
+
+var _ = DescribeTable("Features.Require",
+	func(features Features, name string, expectedErr string) {
+		err := features.Require(name)
+		if expectedErr == "" {
+			Expect(err).NotTo(HaveOccurred())
+		} else {
+			Expect(err).To(MatchError(expectedErr))
+		}
+	},
+	Entry("supported", Features{RPFilter: true}, FeatureRPFilter, ""),
+	Entry("unsupported match", Features{}, FeatureRPFilter,
+		"the rpfilter match isn't supported on this host; it needs iptables 1.4.13 and kernel 3.3 or later"),
+	Entry("unsupported target", Features{}, FeatureSYNPROXY,
+		"the SYNPROXY target isn't supported on this host; it needs iptables 1.4.21 and kernel 3.12 or later"),
+	Entry("unsupported option", Features{SYNPROXY: true}, FeatureMASQFullyRandom,
+		"the random-fully option isn't supported on this host; it needs iptables 1.6.2 and kernel 3.13 or later"),
+	Entry("unknown", Features{}, "frobnicate", `unknown iptables feature "frobnicate"`),
+)
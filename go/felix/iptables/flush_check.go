@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CheckForExternalFlush checks whether someone else, for example an
+// administrator running "iptables -F", has removed the rules that we insert
+// into chains that we don't own, such as the jumps from the kernel's FORWARD
+// chain.  Without those rules, none of our chains are reached, so the host
+// is unprotected.  If any are missing, it invalidates the dataplane cache,
+// so that the next Apply repairs the table, and returns true.
+//
+// The legacy iptables interface doesn't send netlink notifications when a
+// table changes, so the check polls instead.  It only lists the chains that
+// we insert into, which is much cheaper than a full iptables-save and so can
+// be done every second or so.  Changes to our own chains are left to the
+// periodic resync.
+func (t *Table) CheckForExternalFlush() bool {
+	if !t.inSyncWithDataPlane {
+		// The next Apply will reload everything anyway.
+		return false
+	}
+	for _, chainName := range sortedHashKeys(t.chainToDataplaneHashes) {
+		if t.ownsChain(chainName) {
+			continue
+		}
+		var expected []string
+		for _, hash := range t.chainToDataplaneHashes[chainName] {
+			if hash != "" {
+				expected = append(expected, hash)
+			}
+		}
+		if len(expected) == 0 {
+			continue
+		}
+		logCxt := log.WithFields(log.Fields{
+			"table":     t.Name,
+			"ipVersion": t.IPVersion,
+			"chainName": chainName,
+		})
+		output, err := t.newCmd(t.listCmd, "-t", t.Name, "-S", chainName).Output()
+		if err != nil {
+			logCxt.WithError(err).Warn("Failed to list chain, will resync")
+			t.InvalidateDataplaneCache()
+			return true
+		}
+		if !stringSlicesEqual(ourHashes(output), expected) {
+			logCxt.Warn("Our rules have been removed from chain, " +
+				"possibly by an iptables flush; will resync")
+			t.InvalidateDataplaneCache()
+			return true
+		}
+	}
+	return false
+}
+
+// ourHashes returns the hashes of our rules in the output of "iptables -S".
+func ourHashes(output []byte) []string {
+	var hashes []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !appendRegexp.MatchString(line) {
+			continue
+		}
+		if m := hashCommentRegexp.FindStringSubmatch(line); m != nil {
+			hashes = append(hashes, m[1])
+		}
+	}
+	return hashes
+}
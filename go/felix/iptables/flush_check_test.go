@@ -0,0 +1,82 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Table external flush check", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {"--jump ACCEPT"},
+			"INPUT":   {},
+		})
+		table = NewTable("filter", 4, TableOptions{
+			NewCmdOverride: dataplane.newCmd,
+		})
+	})
+
+	It("should do nothing before the dataplane has been loaded", func() {
+		Expect(table.CheckForExternalFlush()).To(BeFalse())
+		Expect(dataplane.Cmds).To(BeEmpty())
+	})
+
+	Describe("after programming some insertions", func() {
+		BeforeEach(func() {
+			table.UpdateChain(&Chain{
+				Name:  "cali-foo",
+				Rules: []Rule{{Action: DropAction{}}},
+			})
+			table.SetRuleInsertions("FORWARD", []Rule{
+				{Action: JumpAction{Target: "cali-foo"}},
+			})
+			Expect(table.Apply()).To(Succeed())
+			dataplane.Cmds = nil
+		})
+
+		It("should only list the chains that we insert into", func() {
+			Expect(table.CheckForExternalFlush()).To(BeFalse())
+			Expect(dataplane.Cmds).To(Equal([]string{"iptables -t filter -S FORWARD"}))
+		})
+		It("should detect a flush and repair it on the next Apply", func() {
+			expected := dataplane.Chains["FORWARD"][:1]
+			dataplane.Chains["FORWARD"] = []string{}
+			dataplane.Chains["cali-foo"] = []string{}
+			Expect(table.CheckForExternalFlush()).To(BeTrue())
+			Expect(table.Apply()).To(Succeed())
+			Expect(dataplane.Chains["FORWARD"]).To(Equal(expected))
+			Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+		})
+		It("should detect that one of our rules has been deleted", func() {
+			dataplane.Chains["FORWARD"] = dataplane.Chains["FORWARD"][1:]
+			Expect(table.CheckForExternalFlush()).To(BeTrue())
+		})
+		It("should ignore changes to other rules", func() {
+			dataplane.Chains["FORWARD"] = append(dataplane.Chains["FORWARD"], "--jump DROP")
+			Expect(table.CheckForExternalFlush()).To(BeFalse())
+		})
+		It("should resync if it can't list the chain", func() {
+			delete(dataplane.Chains, "FORWARD")
+			Expect(table.CheckForExternalFlush()).To(BeTrue())
+		})
+	})
+})
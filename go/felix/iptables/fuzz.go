@@ -0,0 +1,180 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build gofuzz
+// +build gofuzz
+
+package iptables
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Fuzz is the entry point for go-fuzz:
+//
+//	go-fuzz-build github.com/projectcalico/felix/go/felix/iptables
+//	go-fuzz -bin=iptables-fuzz.zip -workdir=fuzz
+//
+// It builds a Rule from the input, renders it, parses it back and checks
+// that the rule survived the round trip.  It also feeds the raw input to
+// ParseRule to check that it doesn't panic.
+func Fuzz(data []byte) int {
+	if parsed, err := ParseRule(string(data)); err == nil {
+		reparsed, err := ParseRule(parsed.Render())
+		if err != nil || !reflect.DeepEqual(parsed, reparsed) {
+			panic(fmt.Sprintf("re-rendering %q gave %#v (%v)", data, reparsed, err))
+		}
+	}
+
+	f := &fuzzInput{data: data}
+	chain := &Chain{Name: f.ident(), Rules: []Rule{f.rule()}}
+	if err := checkRoundTrip(chain); err != nil {
+		panic(err)
+	}
+	return 1
+}
+
+// checkRoundTrip renders the first rule in the chain, with its hash, and
+// checks that it parses back to the same arguments.
+func checkRoundTrip(chain *Chain) error {
+	rule := chain.Rules[0]
+	cache := NewRenderCache()
+	line := cache.RenderAppends(chain, HashCommentPrefix)[0]
+	parsed, err := ParseRule(line)
+	if err != nil {
+		return fmt.Errorf("failed to parse %q: %v", line, err)
+	}
+
+	expected := []string{}
+	for _, fragment := range rule.Match {
+		args, err := splitArgs(fragment)
+		if err != nil {
+			return fmt.Errorf("failed to split %q: %v", fragment, err)
+		}
+		expected = append(expected, args...)
+	}
+	if rule.Action != nil {
+		args, err := splitArgs(rule.Action.ToFragment())
+		if err != nil {
+			return fmt.Errorf("failed to split action of %q: %v", line, err)
+		}
+		expected = append(expected, args...)
+	}
+	var comments []string
+	for _, comment := range rule.Comment {
+		if comment = sanitizeText(comment, MaxCommentLength); comment != "" {
+			comments = append(comments, comment)
+		}
+	}
+
+	if parsed.Op != "-A" || parsed.Chain != chain.Name ||
+		parsed.Hash != cache.RuleHashes(chain)[0] || !reflect.DeepEqual(parsed.Comment, comments) ||
+		!reflect.DeepEqual(parsed.Args, expected) {
+		return fmt.Errorf("%q parsed as %#v, expected args %#v", line, parsed, expected)
+	}
+	return nil
+}
+
+const fuzzIdentChars = "abcdefghijklmnopqrstuvwxyz0123456789-_./:|"
+
+// fuzzInput generates values from the fuzzer's input.  Once the input is
+// used up, it generates zeroes.
+type fuzzInput struct {
+	data []byte
+}
+
+func (f *fuzzInput) byte() byte {
+	if len(f.data) == 0 {
+		return 0
+	}
+	b := f.data[0]
+	f.data = f.data[1:]
+	return b
+}
+
+func (f *fuzzInput) uint16() uint16 {
+	return uint16(f.byte())<<8 | uint16(f.byte())
+}
+
+func (f *fuzzInput) uint32() uint32 {
+	return uint32(f.uint16())<<16 | uint32(f.uint16())
+}
+
+// ident returns a non-empty string that is valid as an unquoted argument.
+func (f *fuzzInput) ident() string {
+	n := 1 + int(f.byte()%16)
+	s := make([]byte, n)
+	for i := range s {
+		s[i] = fuzzIdentChars[int(f.byte())%len(fuzzIdentChars)]
+	}
+	return string(s)
+}
+
+// text returns an arbitrary string.
+func (f *fuzzInput) text() string {
+	n := int(f.byte() % 32)
+	if n > len(f.data) {
+		n = len(f.data)
+	}
+	s := string(f.data[:n])
+	f.data = f.data[n:]
+	return s
+}
+
+func (f *fuzzInput) rule() Rule {
+	rule := Rule{}
+	for i := f.byte() % 3; i > 0; i-- {
+		rule.Comment = append(rule.Comment, f.text())
+	}
+	for i := f.byte() % 4; i > 0; i-- {
+		switch f.byte() % 9 {
+		case 0:
+			rule.Match = rule.Match.MarkSet(f.uint32())
+		case 1:
+			rule.Match = rule.Match.MarkClear(f.uint32())
+		case 2:
+			rule.Match = rule.Match.InInterface(f.ident())
+		case 3:
+			rule.Match = rule.Match.NotConntrackState(f.ident())
+		case 4:
+			rule.Match = rule.Match.Protocol(f.ident())
+		case 5:
+			rule.Match = rule.Match.DestIPSet(f.ident())
+		case 6:
+			rule.Match = rule.Match.NotSourcePorts(f.uint16(), f.uint16())
+		case 7:
+			rule.Match = rule.Match.ICMPV6Type(f.byte())
+		case 8:
+			rule.Match = rule.Match.CgroupPath(f.text())
+		}
+	}
+	switch f.byte() % 8 {
+	case 0:
+		rule.Action = JumpAction{Target: f.ident()}
+	case 1:
+		rule.Action = GotoAction{Target: f.ident()}
+	case 2:
+		rule.Action = LogAction{Prefix: f.text()}
+	case 3:
+		rule.Action = NflogAction{Group: f.uint16(), Prefix: f.text()}
+	case 4:
+		rule.Action = SetMarkAction{Mark: f.uint32()}
+	case 5:
+		rule.Action = DNATAction{DestAddr: f.ident(), DestPort: f.uint16()}
+	case 6:
+		rule.Action = AcceptAction{}
+	}
+	return rule
+}
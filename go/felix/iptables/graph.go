@@ -0,0 +1,190 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ChainGraph is the graph of the jumps and gotos between a set of chains.
+// It's used to visualise the chains that a packet may traverse, either as
+// JSON or, via WriteDot, as a Graphviz graph.
+type ChainGraph struct {
+	Nodes []*GraphNode `json:"nodes"`
+	Edges []*GraphEdge `json:"edges"`
+}
+
+type GraphNode struct {
+	Name string `json:"name"`
+	// Label describes the chain, for example, the policy that it belongs
+	// to.
+	Label    string `json:"label,omitempty"`
+	NumRules int    `json:"num_rules"`
+	// External is set for chains that are referenced but weren't passed
+	// to NewChainGraph, for example because they're programmed elsewhere.
+	External bool `json:"external,omitempty"`
+}
+
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// RuleIndex is the 1-based position of the rule in the From chain.
+	RuleIndex int    `json:"rule_index"`
+	Goto      bool   `json:"goto,omitempty"`
+	Match     string `json:"match,omitempty"`
+}
+
+// NewChainGraph builds the graph of the given chains.  label, if non-nil,
+// is called to label each chain, including the external ones.  The nodes
+// are sorted by name and the edges are in rule order.
+func NewChainGraph(chains []*Chain, label func(chainName string) string) *ChainGraph {
+	g := &ChainGraph{}
+	nodes := map[string]*GraphNode{}
+	addNode := func(name string) *GraphNode {
+		node := nodes[name]
+		if node == nil {
+			node = &GraphNode{Name: name, External: true}
+			if label != nil {
+				node.Label = label(name)
+			}
+			nodes[name] = node
+		}
+		return node
+	}
+	sorted := make([]*Chain, len(chains))
+	copy(sorted, chains)
+	sort.Sort(chainsByName(sorted))
+	for _, chain := range sorted {
+		node := addNode(chain.Name)
+		node.External = false
+		node.NumRules = len(chain.Rules)
+	}
+	for _, chain := range sorted {
+		for i, rule := range chain.Rules {
+			target := referencedChain(rule.Action)
+			if target == "" {
+				continue
+			}
+			addNode(target)
+			_, isGoto := rule.Action.(GotoAction)
+			g.Edges = append(g.Edges, &GraphEdge{
+				From:      chain.Name,
+				To:        target,
+				RuleIndex: i + 1,
+				Goto:      isGoto,
+				Match:     rule.Match.Render(),
+			})
+		}
+	}
+	for _, name := range sortedNodeNames(nodes) {
+		g.Nodes = append(g.Nodes, nodes[name])
+	}
+	return g
+}
+
+// ReachableFrom returns the subgraph of the chains that can be reached from
+// the given chains, including the given chains themselves.
+func (g *ChainGraph) ReachableFrom(roots ...string) *ChainGraph {
+	edgesFrom := map[string][]*GraphEdge{}
+	for _, edge := range g.Edges {
+		edgesFrom[edge.From] = append(edgesFrom[edge.From], edge)
+	}
+	reachable := map[string]bool{}
+	var visit func(name string)
+	visit = func(name string) {
+		if reachable[name] {
+			return
+		}
+		reachable[name] = true
+		for _, edge := range edgesFrom[name] {
+			visit(edge.To)
+		}
+	}
+	for _, root := range roots {
+		visit(root)
+	}
+	sub := &ChainGraph{}
+	for _, node := range g.Nodes {
+		if reachable[node.Name] {
+			sub.Nodes = append(sub.Nodes, node)
+		}
+	}
+	for _, edge := range g.Edges {
+		if reachable[edge.From] {
+			sub.Edges = append(sub.Edges, edge)
+		}
+	}
+	return sub
+}
+
+// WriteDot writes the graph in Graphviz's DOT language.  External chains
+// are drawn dashed, as are gotos.
+func (g *ChainGraph) WriteDot(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	buf.WriteString("digraph chains {\n")
+	buf.WriteString("  rankdir=LR;\n")
+	buf.WriteString("  node [shape=box];\n")
+	for _, node := range g.Nodes {
+		label := node.Name
+		if node.Label != "" {
+			label += "\n" + node.Label
+		}
+		attrs := "label=" + dotQuote(label)
+		if node.External {
+			attrs += ", style=dashed"
+		}
+		fmt.Fprintf(buf, "  %s [%s];\n", dotQuote(node.Name), attrs)
+	}
+	for _, edge := range g.Edges {
+		label := fmt.Sprint(edge.RuleIndex)
+		if edge.Match != "" {
+			label += ": " + edge.Match
+		}
+		attrs := "label=" + dotQuote(label)
+		if edge.Goto {
+			attrs += ", style=dashed"
+		}
+		fmt.Fprintf(buf, "  %s -> %s [%s];\n", dotQuote(edge.From), dotQuote(edge.To), attrs)
+	}
+	buf.WriteString("}\n")
+	return buf.Flush()
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// dotQuote quotes a DOT ID.  Within a label, the escaped newline is rendered
+// as a line break.
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+type chainsByName []*Chain
+
+func (c chainsByName) Len() int           { return len(c) }
+func (c chainsByName) Less(i, j int) bool { return c[i].Name < c[j].Name }
+func (c chainsByName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+func sortedNodeNames(nodes map[string]*GraphNode) []string {
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	"bytes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ChainGraph", func() {
+	chains := []*Chain{
+		{
+			Name: "cali-tw-cali1234",
+			Rules: []Rule{
+				{Action: ClearMarkAction{Mark: 0x8}},
+				{Match: Match().MarkClear(0x10), Action: JumpAction{Target: "cali-pi-default/a"}},
+				{Action: GotoAction{Target: "cali-common"}},
+			},
+		},
+		{
+			Name: "cali-common",
+			Rules: []Rule{
+				{Action: JumpAction{Target: "cali-pri-prof1"}},
+			},
+		},
+		{
+			Name:  "cali-unrelated",
+			Rules: []Rule{{Action: DropAction{}}},
+		},
+	}
+	label := func(name string) string {
+		if name == "cali-pi-default/a" {
+			return `policy "a"`
+		}
+		return ""
+	}
+	var graph *ChainGraph
+
+	BeforeEach(func() {
+		graph = NewChainGraph(chains, label)
+	})
+
+	It("should include every chain and jump", func() {
+		Expect(graph.Nodes).To(Equal([]*GraphNode{
+			{Name: "cali-common", NumRules: 1},
+			{Name: "cali-pi-default/a", Label: `policy "a"`, External: true},
+			{Name: "cali-pri-prof1", External: true},
+			{Name: "cali-tw-cali1234", NumRules: 3},
+			{Name: "cali-unrelated", NumRules: 1},
+		}))
+		Expect(graph.Edges).To(Equal([]*GraphEdge{
+			{From: "cali-common", To: "cali-pri-prof1", RuleIndex: 1},
+			{From: "cali-tw-cali1234", To: "cali-pi-default/a", RuleIndex: 2,
+				Match: "-m mark --mark 0/0x10"},
+			{From: "cali-tw-cali1234", To: "cali-common", RuleIndex: 3, Goto: true},
+		}))
+	})
+
+	It("should find the reachable subgraph", func() {
+		sub := graph.ReachableFrom("cali-tw-cali1234")
+		var names []string
+		for _, node := range sub.Nodes {
+			names = append(names, node.Name)
+		}
+		Expect(names).To(Equal([]string{
+			"cali-common",
+			"cali-pi-default/a",
+			"cali-pri-prof1",
+			"cali-tw-cali1234",
+		}))
+		Expect(sub.Edges).To(HaveLen(3))
+		Expect(graph.ReachableFrom("cali-unrelated").Edges).To(BeEmpty())
+	})
+
+	It("should render DOT", func() {
+		var buf bytes.Buffer
+		Expect(graph.ReachableFrom("cali-common").WriteDot(&buf)).To(Succeed())
+		Expect(buf.String()).To(Equal(`digraph chains {
+  rankdir=LR;
+  node [shape=box];
+  "cali-common" [label="cali-common"];
+  "cali-pri-prof1" [label="cali-pri-prof1", style=dashed];
+  "cali-common" -> "cali-pri-prof1" [label="1"];
+}
+`))
+	})
+
+	It("should escape labels in DOT", func() {
+		var buf bytes.Buffer
+		Expect(graph.WriteDot(&buf)).To(Succeed())
+		Expect(buf.String()).To(ContainSubstring(
+			`"cali-pi-default/a" [label="cali-pi-default/a\npolicy \"a\"", style=dashed];`))
+		Expect(buf.String()).To(ContainSubstring(
+			`"cali-tw-cali1234" -> "cali-common" [label="3", style=dashed];`))
+	})
+})
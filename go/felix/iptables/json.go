@@ -0,0 +1,81 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"encoding/json"
+)
+
+// ChainJSON is the structured form of a chain, for audit and inventory
+// tools that would rather not parse iptables fragments.
+type ChainJSON struct {
+	Table string     `json:"table"`
+	Name  string     `json:"name"`
+	Rules []RuleJSON `json:"rules"`
+}
+
+// RuleJSON is the structured form of a rule.  Match holds the rule's match
+// criteria, one fragment per criterion, and Action the action's fragment,
+// such as "--jump ACCEPT".  Comment holds the comments as they are
+// programmed, after sanitizing.  Hash is the hash that the Table embeds in
+// the rule's comment when it programs it.
+type RuleJSON struct {
+	Table   string   `json:"table"`
+	Chain   string   `json:"chain"`
+	Index   int      `json:"index"`
+	Match   []string `json:"match"`
+	Action  string   `json:"action,omitempty"`
+	Comment []string `json:"comment,omitempty"`
+	Hash    string   `json:"hash"`
+}
+
+// ChainsToJSON returns the structured form of the chains, as they would be
+// programmed into the given table.
+func (c *RenderCache) ChainsToJSON(table string, chains []*Chain) []ChainJSON {
+	result := make([]ChainJSON, len(chains))
+	for i, chain := range chains {
+		hashes := c.RuleHashes(chain)
+		rules := make([]RuleJSON, len(chain.Rules))
+		for j, rule := range chain.Rules {
+			rules[j] = RuleJSON{
+				Table: table,
+				Chain: chain.Name,
+				Index: j,
+				Match: append([]string{}, rule.Match...),
+				Hash:  hashes[j],
+			}
+			if rule.Action != nil {
+				rules[j].Action = rule.Action.ToFragment()
+			}
+			for _, comment := range rule.Comment {
+				if comment = sanitizeText(comment, MaxCommentLength); comment != "" {
+					rules[j].Comment = append(rules[j].Comment, comment)
+				}
+			}
+		}
+		result[i] = ChainJSON{
+			Table: table,
+			Name:  chain.Name,
+			Rules: rules,
+		}
+	}
+	return result
+}
+
+// RenderJSON renders the chains, as they would be programmed into the given
+// table, as an indented JSON array of ChainJSON.
+func (c *RenderCache) RenderJSON(table string, chains []*Chain) ([]byte, error) {
+	return json.MarshalIndent(c.ChainsToJSON(table, chains), "", "  ")
+}
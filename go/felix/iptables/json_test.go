@@ -0,0 +1,75 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JSON rendering", func() {
+	var cache *RenderCache
+	var chain *Chain
+
+	BeforeEach(func() {
+		cache = NewRenderCache()
+		chain = &Chain{
+			Name: "cali-foo",
+			Rules: []Rule{
+				{Match: Match().Protocol("tcp"), Action: JumpAction{Target: "cali-bar"}},
+				{Action: DropAction{}, Comment: []string{`drop "the" rest`, "bad\ncomment"}},
+			},
+		}
+	})
+
+	It("should give each rule's fields and hash", func() {
+		hashes := cache.RuleHashes(chain)
+		Expect(cache.ChainsToJSON("filter", []*Chain{chain})).To(Equal([]ChainJSON{{
+			Table: "filter",
+			Name:  "cali-foo",
+			Rules: []RuleJSON{
+				{
+					Table:  "filter",
+					Chain:  "cali-foo",
+					Index:  0,
+					Match:  []string{"-p tcp"},
+					Action: "--jump cali-bar",
+					Hash:   hashes[0],
+				},
+				{
+					Table:   "filter",
+					Chain:   "cali-foo",
+					Index:   1,
+					Match:   []string{},
+					Action:  "--jump DROP",
+					Comment: []string{"drop the rest"},
+					Hash:    hashes[1],
+				},
+			},
+		}}))
+	})
+	It("should render valid JSON", func() {
+		data, err := cache.RenderJSON("filter", []*Chain{chain})
+		Expect(err).NotTo(HaveOccurred())
+		var decoded []map[string]interface{}
+		Expect(json.Unmarshal(data, &decoded)).To(Succeed())
+		Expect(decoded).To(HaveLen(1))
+		Expect(decoded[0]["name"]).To(Equal("cali-foo"))
+		Expect(decoded[0]["rules"]).To(HaveLen(2))
+	})
+})
@@ -0,0 +1,453 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+)
+
+// MatchCriteria is a builder for the match part of an iptables rule.  Like the
+// built-in append(), each method appends a match and returns the updated
+// criteria so that criteria can be built up in a chain of calls:
+//
+//	Match().InInterface("cali+").Protocol("tcp")
+type MatchCriteria []string
+
+func Match() MatchCriteria {
+	return nil
+}
+
+// Render returns the iptables fragment for the match criteria.
+func (m MatchCriteria) Render() string {
+	return strings.Join([]string(m), " ")
+}
+
+// renderTo writes each of the criteria to buf, preceded by a space.
+func (m MatchCriteria) renderTo(buf *bytes.Buffer) {
+	for _, fragment := range m {
+		buf.WriteByte(' ')
+		buf.WriteString(fragment)
+	}
+}
+
+func (m MatchCriteria) String() string {
+	return fmt.Sprintf("MatchCriteria[%s]", m.Render())
+}
+
+func (m MatchCriteria) MarkClear(mark uint32) MatchCriteria {
+	return append(m, fmt.Sprintf("-m mark --mark 0/%#x", mark))
+}
+
+func (m MatchCriteria) MarkSet(mark uint32) MatchCriteria {
+	return append(m, fmt.Sprintf("-m mark --mark %#x/%#x", mark, mark))
+}
+
+// ConnMarkSet matches packets whose connection has all the given mark bits
+// set, as stored by SetConnMarkAction or SaveConnMarkAction.
+func (m MatchCriteria) ConnMarkSet(mark uint32) MatchCriteria {
+	return append(m, fmt.Sprintf("-m connmark --mark %#x/%#x", mark, mark))
+}
+
+func (m MatchCriteria) InInterface(ifaceMatch string) MatchCriteria {
+	return append(m, fmt.Sprintf("--in-interface %s", ifaceMatch))
+}
+
+func (m MatchCriteria) OutInterface(ifaceMatch string) MatchCriteria {
+	return append(m, fmt.Sprintf("--out-interface %s", ifaceMatch))
+}
+
+// ConntrackState matches on the comma-separated list of conntrack states,
+// for example "INVALID" or "RELATED,ESTABLISHED".
+func (m MatchCriteria) ConntrackState(stateNames string) MatchCriteria {
+	return append(m, fmt.Sprintf("-m conntrack --ctstate %s", stateNames))
+}
+
+func (m MatchCriteria) NotConntrackState(stateNames string) MatchCriteria {
+	return append(m, fmt.Sprintf("-m conntrack ! --ctstate %s", stateNames))
+}
+
+func (m MatchCriteria) Protocol(name string) MatchCriteria {
+	return append(m, fmt.Sprintf("-p %s", name))
+}
+
+func (m MatchCriteria) NotProtocol(name string) MatchCriteria {
+	return append(m, fmt.Sprintf("! -p %s", name))
+}
+
+func (m MatchCriteria) ProtocolNum(num uint8) MatchCriteria {
+	return append(m, fmt.Sprintf("-p %d", num))
+}
+
+func (m MatchCriteria) NotProtocolNum(num uint8) MatchCriteria {
+	return append(m, fmt.Sprintf("! -p %d", num))
+}
+
+// Protocol numbers of the tunnel protocols used by VPNs.  We match them by
+// number since iptables looks names up in /etc/protocols, which doesn't
+// always list them.
+const (
+	ProtocolGRE uint8 = 47
+	ProtocolESP uint8 = 50
+	ProtocolAH  uint8 = 51
+)
+
+// ProtocolGRE, ProtocolESP and ProtocolAH match the traffic of GRE and IPsec
+// tunnels, for example to allow a tunnel that terminates on the host.
+func (m MatchCriteria) ProtocolGRE() MatchCriteria {
+	return m.ProtocolNum(ProtocolGRE)
+}
+
+func (m MatchCriteria) ProtocolESP() MatchCriteria {
+	return m.ProtocolNum(ProtocolESP)
+}
+
+func (m MatchCriteria) ProtocolAH() MatchCriteria {
+	return m.ProtocolNum(ProtocolAH)
+}
+
+func (m MatchCriteria) SourceNet(net string) MatchCriteria {
+	return append(m, fmt.Sprintf("--source %s", net))
+}
+
+func (m MatchCriteria) NotSourceNet(net string) MatchCriteria {
+	return append(m, fmt.Sprintf("! --source %s", net))
+}
+
+func (m MatchCriteria) DestNet(net string) MatchCriteria {
+	return append(m, fmt.Sprintf("--destination %s", net))
+}
+
+func (m MatchCriteria) NotDestNet(net string) MatchCriteria {
+	return append(m, fmt.Sprintf("! --destination %s", net))
+}
+
+// MulticastDest matches packets to any multicast group of the given IP
+// version.  Combine it with DestNet to match a particular group.
+func (m MatchCriteria) MulticastDest(ipVersion uint8) MatchCriteria {
+	return m.DestNet(MulticastCIDR(ipVersion))
+}
+
+func (m MatchCriteria) NotMulticastDest(ipVersion uint8) MatchCriteria {
+	return m.NotDestNet(MulticastCIDR(ipVersion))
+}
+
+// PacketType matches packets by their link-layer packet type.  Unlike a
+// match on the destination address, it also matches broadcasts, which have
+// no reserved range of addresses.
+func (m MatchCriteria) PacketType(pktType PktType) MatchCriteria {
+	return append(m, fmt.Sprintf("-m pkttype --pkt-type %s", pktType))
+}
+
+func (m MatchCriteria) NotPacketType(pktType PktType) MatchCriteria {
+	return append(m, fmt.Sprintf("-m pkttype ! --pkt-type %s", pktType))
+}
+
+func (m MatchCriteria) SourceIPSet(name string) MatchCriteria {
+	return append(m, fmt.Sprintf("-m set --match-set %s src", name))
+}
+
+func (m MatchCriteria) NotSourceIPSet(name string) MatchCriteria {
+	return append(m, fmt.Sprintf("-m set ! --match-set %s src", name))
+}
+
+func (m MatchCriteria) DestIPSet(name string) MatchCriteria {
+	return append(m, fmt.Sprintf("-m set --match-set %s dst", name))
+}
+
+func (m MatchCriteria) NotDestIPSet(name string) MatchCriteria {
+	return append(m, fmt.Sprintf("-m set ! --match-set %s dst", name))
+}
+
+func (m MatchCriteria) SourcePorts(ports ...uint16) MatchCriteria {
+	portsString := PortsToMultiport(ports)
+	return append(m, fmt.Sprintf("-m multiport --source-ports %s", portsString))
+}
+
+func (m MatchCriteria) NotSourcePorts(ports ...uint16) MatchCriteria {
+	portsString := PortsToMultiport(ports)
+	return append(m, fmt.Sprintf("-m multiport ! --source-ports %s", portsString))
+}
+
+func (m MatchCriteria) DestPorts(ports ...uint16) MatchCriteria {
+	portsString := PortsToMultiport(ports)
+	return append(m, fmt.Sprintf("-m multiport --destination-ports %s", portsString))
+}
+
+func (m MatchCriteria) NotDestPorts(ports ...uint16) MatchCriteria {
+	portsString := PortsToMultiport(ports)
+	return append(m, fmt.Sprintf("-m multiport ! --destination-ports %s", portsString))
+}
+
+// DestPortRange matches destination ports in the inclusive range.  Like
+// the other port matches, it has to follow a TCP, UDP, UDP-Lite or SCTP
+// protocol match.
+func (m MatchCriteria) DestPortRange(min, max uint16) MatchCriteria {
+	return append(m, fmt.Sprintf("-m multiport --destination-ports %d:%d", min, max))
+}
+
+func (m MatchCriteria) SrcAddrType(addrType AddrType, limitIfaceOut bool) MatchCriteria {
+	if limitIfaceOut {
+		return append(m, fmt.Sprintf("-m addrtype --src-type %s --limit-iface-out", addrType))
+	} else {
+		return append(m, fmt.Sprintf("-m addrtype --src-type %s", addrType))
+	}
+}
+
+func (m MatchCriteria) DestAddrType(addrType AddrType) MatchCriteria {
+	return append(m, fmt.Sprintf("-m addrtype --dst-type %s", addrType))
+}
+
+func (m MatchCriteria) ICMPType(t uint8) MatchCriteria {
+	return append(m, fmt.Sprintf("-m icmp --icmp-type %d", t))
+}
+
+func (m MatchCriteria) NotICMPType(t uint8) MatchCriteria {
+	return append(m, fmt.Sprintf("-m icmp ! --icmp-type %d", t))
+}
+
+func (m MatchCriteria) ICMPTypeAndCode(t, c uint8) MatchCriteria {
+	return append(m, fmt.Sprintf("-m icmp --icmp-type %d/%d", t, c))
+}
+
+func (m MatchCriteria) NotICMPTypeAndCode(t, c uint8) MatchCriteria {
+	return append(m, fmt.Sprintf("-m icmp ! --icmp-type %d/%d", t, c))
+}
+
+func (m MatchCriteria) ICMPV6Type(t uint8) MatchCriteria {
+	return append(m, fmt.Sprintf("-m icmp6 --icmpv6-type %d", t))
+}
+
+func (m MatchCriteria) NotICMPV6Type(t uint8) MatchCriteria {
+	return append(m, fmt.Sprintf("-m icmp6 ! --icmpv6-type %d", t))
+}
+
+func (m MatchCriteria) ICMPV6TypeAndCode(t, c uint8) MatchCriteria {
+	return append(m, fmt.Sprintf("-m icmp6 --icmpv6-type %d/%d", t, c))
+}
+
+func (m MatchCriteria) NotICMPV6TypeAndCode(t, c uint8) MatchCriteria {
+	return append(m, fmt.Sprintf("-m icmp6 ! --icmpv6-type %d/%d", t, c))
+}
+
+// SourceMAC matches packets with the given source MAC address.  The address
+// is rendered in upper case, as iptables-save prints it.
+func (m MatchCriteria) SourceMAC(mac string) MatchCriteria {
+	return append(m, "-m mac --mac-source "+argString(strings.ToUpper(mac)))
+}
+
+func (m MatchCriteria) NotSourceMAC(mac string) MatchCriteria {
+	return append(m, "-m mac ! --mac-source "+argString(strings.ToUpper(mac)))
+}
+
+// CgroupClassID matches packets from sockets in the net_cls cgroup with the
+// given class ID, for example 0x100001 for "10:1".  Like CgroupPath, it only
+// matches locally generated packets, so it belongs in the OUTPUT chain,
+// where it allows egress to be controlled per host service.  The ID is
+// rendered in decimal, as iptables-save prints it.
+func (m MatchCriteria) CgroupClassID(classID uint32) MatchCriteria {
+	return append(m, fmt.Sprintf("-m cgroup --cgroup %d", classID))
+}
+
+func (m MatchCriteria) NotCgroupClassID(classID uint32) MatchCriteria {
+	return append(m, fmt.Sprintf("-m cgroup ! --cgroup %d", classID))
+}
+
+// CgroupPath matches packets from sockets in the given cgroup v2 path, or in
+// any of its descendants, for example "system.slice/sshd.service" for a
+// systemd unit.  It needs kernel 4.5 or later.
+func (m MatchCriteria) CgroupPath(path string) MatchCriteria {
+	return append(m, "-m cgroup --path "+argString(path))
+}
+
+func (m MatchCriteria) NotCgroupPath(path string) MatchCriteria {
+	return append(m, "-m cgroup ! --path "+argString(path))
+}
+
+// ConnBytesMode is what a "connbytes" match counts.
+type ConnBytesMode string
+
+const (
+	ConnBytesModeBytes   ConnBytesMode = "bytes"
+	ConnBytesModePackets ConnBytesMode = "packets"
+	// ConnBytesModeAvgPkt is the average packet size, in bytes.
+	ConnBytesModeAvgPkt ConnBytesMode = "avgpkt"
+)
+
+// ConnBytesDir is the direction of the traffic that a "connbytes" match
+// counts.
+type ConnBytesDir string
+
+const (
+	ConnBytesDirOriginal ConnBytesDir = "original"
+	ConnBytesDirReply    ConnBytesDir = "reply"
+	ConnBytesDirBoth     ConnBytesDir = "both"
+)
+
+// ConnBytes matches packets of connections that have so far transferred
+// between from and to bytes (or packets, according to mode), inclusive.  A to
+// of 0 means no upper limit.  For example, a policy can rate-limit or drop
+// connections once they exceed a size that a well-behaved client never
+// reaches.
+func (m MatchCriteria) ConnBytes(mode ConnBytesMode, dir ConnBytesDir, from, to uint64) MatchCriteria {
+	rangeStr := fmt.Sprintf("%d", from)
+	if to != 0 {
+		rangeStr = fmt.Sprintf("%d:%d", from, to)
+	}
+	return append(m, fmt.Sprintf(
+		"-m connbytes --connbytes %s --connbytes-mode %s --connbytes-dir %s",
+		rangeStr, mode, dir))
+}
+
+// ConnLimitAbove matches packets that would take the number of concurrent
+// connections from a source above limit.  Sources are grouped by their
+// first prefixLen bits, so 32 (or 128 for IPv6) limits each address
+// separately.  Only new connections are refused when the match is used to
+// drop packets, because established ones don't add to the count.
+func (m MatchCriteria) ConnLimitAbove(limit uint32, prefixLen uint8) MatchCriteria {
+	return append(m, fmt.Sprintf(
+		"-m connlimit --connlimit-above %d --connlimit-mask %d --connlimit-saddr",
+		limit, prefixLen))
+}
+
+// RecentSet adds, or refreshes, the packet's source address in the named
+// "recent" list.  It always matches so it can be combined with a target to
+// record the clients that hit a rule.  The ipVersion selects the all-ones
+// mask that iptables-save prints for the list.
+func (m MatchCriteria) RecentSet(name string, ipVersion uint8) MatchCriteria {
+	return append(m, fmt.Sprintf("-m recent --set --name %s --mask %s --rsource",
+		argString(name), recentMask(ipVersion)))
+}
+
+// RecentCheck matches packets whose source address was added to the named
+// "recent" list in the last seconds.  Older entries are reaped as they are
+// checked so that the list doesn't fill up with stale clients.
+func (m MatchCriteria) RecentCheck(name string, seconds uint32, ipVersion uint8) MatchCriteria {
+	return append(m, fmt.Sprintf(
+		"-m recent --rcheck --seconds %d --reap --name %s --mask %s --rsource",
+		seconds, argString(name), recentMask(ipVersion)))
+}
+
+// TCPSYN matches TCP packets that have SYN set and ACK, RST and FIN clear,
+// that is, the first packet of a connection.  It must follow
+// Protocol("tcp").  It's rendered the way iptables-save prints --syn.
+func (m MatchCriteria) TCPSYN() MatchCriteria {
+	return append(m, "-m tcp --tcp-flags FIN,SYN,RST,ACK SYN")
+}
+
+// HashLimitAbove matches packets from sources that exceed ratePerSec
+// packets per second, after an initial burst, each source being tracked
+// separately in the named hash table.  The name must be unique per IP
+// version.
+func (m MatchCriteria) HashLimitAbove(name string, ratePerSec, burst uint32) MatchCriteria {
+	return append(m, fmt.Sprintf(
+		"-m hashlimit --hashlimit-above %d/sec --hashlimit-burst %d --hashlimit-mode srcip --hashlimit-name %s",
+		ratePerSec, burst, argString(name)))
+}
+
+// NfacctName always matches, adding the packet to the packets and bytes of
+// the named nfacct accounting object, which must already exist.  There's
+// no NFACCT target; a rule with this match and no action just counts the
+// traffic that its other criteria select.
+func (m MatchCriteria) NfacctName(name string) MatchCriteria {
+	return append(m, "-m nfacct --nfacct-name "+argString(name))
+}
+
+// NotRPFilter matches packets that fail the reverse path filter, that is,
+// packets whose source address isn't routed back out of the interface that
+// they arrived on.  It's only valid in the raw and mangle PREROUTING chains
+// and needs the rpfilter match; see Features.RPFilter.
+func (m MatchCriteria) NotRPFilter() MatchCriteria {
+	return append(m, "-m rpfilter --invert")
+}
+
+func recentMask(ipVersion uint8) string {
+	if ipVersion == 6 {
+		return "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"
+	}
+	return "255.255.255.255"
+}
+
+// StatisticRandom matches packets at random with the given probability,
+// between 0 and 1.  The kernel stores the probability as a 31-bit fraction
+// so it is rounded to that precision, and rendered with the 11 decimal
+// places that iptables-save uses.
+func (m MatchCriteria) StatisticRandom(probability float64) MatchCriteria {
+	fraction := math.Floor(probability*0x80000000 + 0.5)
+	return append(m, fmt.Sprintf("-m statistic --mode random --probability %.11f",
+		fraction/0x80000000))
+}
+
+// AddrType is the type of address to match in an "addrtype" match.
+type AddrType string
+
+const (
+	AddrTypeLocal AddrType = "LOCAL"
+)
+
+// PktType is the link-layer packet type to match in a "pkttype" match.
+type PktType string
+
+const (
+	PktTypeUnicast   PktType = "unicast"
+	PktTypeBroadcast PktType = "broadcast"
+	PktTypeMulticast PktType = "multicast"
+)
+
+const (
+	IPv4MulticastCIDR = "224.0.0.0/4"
+	IPv6MulticastCIDR = "ff00::/8"
+)
+
+// MulticastCIDR returns the range of multicast group addresses for the given
+// IP version.
+func MulticastCIDR(ipVersion uint8) string {
+	if ipVersion == 6 {
+		return IPv6MulticastCIDR
+	}
+	return IPv4MulticastCIDR
+}
+
+// IsMulticastCIDR returns true if the given CIDR only contains multicast
+// group addresses, so a destination match on it only matches multicast
+// traffic.
+func IsMulticastCIDR(cidr string) bool {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	ipVersion := uint8(4)
+	if ipNet.IP.To4() == nil {
+		ipVersion = 6
+	}
+	_, multicastNet, _ := net.ParseCIDR(MulticastCIDR(ipVersion))
+	multicastPrefixLen, _ := multicastNet.Mask.Size()
+	prefixLen, _ := ipNet.Mask.Size()
+	return prefixLen >= multicastPrefixLen && multicastNet.Contains(ipNet.IP)
+}
+
+// PortsToMultiport converts a list of ports to a multiport set suitable
+// for inclusion in a multiport match.
+func PortsToMultiport(ports []uint16) string {
+	portFragments := make([]string, len(ports))
+	for i, port := range ports {
+		portFragments[i] = fmt.Sprintf("%d", port)
+	}
+	portsString := strings.Join(portFragments, ",")
+	return portsString
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("MatchCriteria",
+	func(match MatchCriteria, expRendering string) {
+		Expect(match.Render()).To(Equal(expRendering))
+	},
+	Entry("Empty match", Match(), ""),
+	Entry("MarkClear", Match().MarkClear(0x400a), "-m mark --mark 0/0x400a"),
+	Entry("MarkSet", Match().MarkSet(0x400a), "-m mark --mark 0x400a/0x400a"),
+	Entry("ConnMarkSet", Match().ConnMarkSet(0x400a), "-m connmark --mark 0x400a/0x400a"),
+	Entry("TCPSYN", Match().Protocol("tcp").TCPSYN(), "-p tcp -m tcp --tcp-flags FIN,SYN,RST,ACK SYN"),
+	Entry("HashLimitAbove", Match().HashLimitAbove("cali-syn", 20, 40),
+		"-m hashlimit --hashlimit-above 20/sec --hashlimit-burst 40 --hashlimit-mode srcip --hashlimit-name cali-syn"),
+	Entry("NotRPFilter", Match().NotRPFilter(), "-m rpfilter --invert"),
+	Entry("NfacctName", Match().NfacctName("cali-web"), "-m nfacct --nfacct-name cali-web"),
+	Entry("InInterface", Match().InInterface("tap1234abcd"), "--in-interface tap1234abcd"),
+	Entry("OutInterface", Match().OutInterface("tap1234abcd"), "--out-interface tap1234abcd"),
+	Entry("ConntrackState", Match().ConntrackState("INVALID"), "-m conntrack --ctstate INVALID"),
+	Entry("NotConntrackState", Match().NotConntrackState("DNAT"), "-m conntrack ! --ctstate DNAT"),
+	Entry("Protocol", Match().Protocol("tcp"), "-p tcp"),
+	Entry("NotProtocol", Match().NotProtocol("tcp"), "! -p tcp"),
+	Entry("ProtocolNum", Match().ProtocolNum(123), "-p 123"),
+	Entry("NotProtocolNum", Match().NotProtocolNum(123), "! -p 123"),
+	Entry("ProtocolGRE", Match().ProtocolGRE(), "-p 47"),
+	Entry("ProtocolESP", Match().ProtocolESP(), "-p 50"),
+	Entry("ProtocolAH", Match().ProtocolAH(), "-p 51"),
+	Entry("SourceMAC", Match().SourceMAC("aa:bb:cc:dd:ee:ff"), "-m mac --mac-source AA:BB:CC:DD:EE:FF"),
+	Entry("NotSourceMAC", Match().NotSourceMAC("aa:bb:cc:dd:ee:ff"), "-m mac ! --mac-source AA:BB:CC:DD:EE:FF"),
+	Entry("ConnBytes", Match().ConnBytes(ConnBytesModeBytes, ConnBytesDirBoth, 1000, 2000),
+		"-m connbytes --connbytes 1000:2000 --connbytes-mode bytes --connbytes-dir both"),
+	Entry("ConnBytes with no upper limit", Match().ConnBytes(ConnBytesModePackets, ConnBytesDirReply, 10, 0),
+		"-m connbytes --connbytes 10 --connbytes-mode packets --connbytes-dir reply"),
+	Entry("ConnLimitAbove", Match().ConnLimitAbove(20, 32),
+		"-m connlimit --connlimit-above 20 --connlimit-mask 32 --connlimit-saddr"),
+	Entry("StatisticRandom", Match().StatisticRandom(0.5),
+		"-m statistic --mode random --probability 0.50000000000"),
+	Entry("StatisticRandom rounded", Match().StatisticRandom(1.0/3),
+		"-m statistic --mode random --probability 0.33333333349"),
+	Entry("RecentSet", Match().RecentSet("cali-lbb-abcd", 4),
+		"-m recent --set --name cali-lbb-abcd --mask 255.255.255.255 --rsource"),
+	Entry("RecentCheck IPv6", Match().RecentCheck("cali-lbb-abcd", 10800, 6),
+		"-m recent --rcheck --seconds 10800 --reap --name cali-lbb-abcd "+
+			"--mask ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff --rsource"),
+	Entry("CgroupClassID", Match().CgroupClassID(0x100001), "-m cgroup --cgroup 1048577"),
+	Entry("NotCgroupClassID", Match().NotCgroupClassID(0x100001), "-m cgroup ! --cgroup 1048577"),
+	Entry("CgroupPath", Match().CgroupPath("system.slice/sshd.service"),
+		"-m cgroup --path system.slice/sshd.service"),
+	Entry("NotCgroupPath", Match().NotCgroupPath("system.slice/sshd.service"),
+		"-m cgroup ! --path system.slice/sshd.service"),
+	Entry("CgroupPath with a space", Match().CgroupPath("a b"), "-m cgroup --path a_b"),
+	Entry("SourceNet", Match().SourceNet("10.0.0.0/16"), "--source 10.0.0.0/16"),
+	Entry("NotSourceNet", Match().NotSourceNet("10.0.0.0/16"), "! --source 10.0.0.0/16"),
+	Entry("DestNet", Match().DestNet("10.0.0.0/16"), "--destination 10.0.0.0/16"),
+	Entry("NotDestNet", Match().NotDestNet("10.0.0.0/16"), "! --destination 10.0.0.0/16"),
+	Entry("MulticastDest", Match().MulticastDest(4), "--destination 224.0.0.0/4"),
+	Entry("MulticastDest IPv6", Match().MulticastDest(6), "--destination ff00::/8"),
+	Entry("NotMulticastDest", Match().NotMulticastDest(4), "! --destination 224.0.0.0/4"),
+	Entry("PacketType", Match().PacketType(PktTypeMulticast), "-m pkttype --pkt-type multicast"),
+	Entry("NotPacketType", Match().NotPacketType(PktTypeBroadcast), "-m pkttype ! --pkt-type broadcast"),
+	Entry("SourceIPSet", Match().SourceIPSet("calits:12345abc-_"), "-m set --match-set calits:12345abc-_ src"),
+	Entry("NotSourceIPSet", Match().NotSourceIPSet("calits:12345abc-_"), "-m set ! --match-set calits:12345abc-_ src"),
+	Entry("DestIPSet", Match().DestIPSet("calits:12345abc-_"), "-m set --match-set calits:12345abc-_ dst"),
+	Entry("NotDestIPSet", Match().NotDestIPSet("calits:12345abc-_"), "-m set ! --match-set calits:12345abc-_ dst"),
+	Entry("SourcePorts", Match().SourcePorts(1234, 5678), "-m multiport --source-ports 1234,5678"),
+	Entry("NotSourcePorts", Match().NotSourcePorts(1234, 5678), "-m multiport ! --source-ports 1234,5678"),
+	Entry("DestPorts", Match().DestPorts(1234, 5678), "-m multiport --destination-ports 1234,5678"),
+	Entry("NotDestPorts", Match().NotDestPorts(1234, 5678), "-m multiport ! --destination-ports 1234,5678"),
+	Entry("DestPortRange", Match().DestPortRange(30000, 32767),
+		"-m multiport --destination-ports 30000:32767"),
+	Entry("SrcAddrType", Match().SrcAddrType(AddrTypeLocal, false), "-m addrtype --src-type LOCAL"),
+	Entry("SrcAddrType limit iface", Match().SrcAddrType(AddrTypeLocal, true),
+		"-m addrtype --src-type LOCAL --limit-iface-out"),
+	Entry("DestAddrType", Match().DestAddrType(AddrTypeLocal), "-m addrtype --dst-type LOCAL"),
+	Entry("ICMPType", Match().ICMPType(8), "-m icmp --icmp-type 8"),
+	Entry("NotICMPType", Match().NotICMPType(8), "-m icmp ! --icmp-type 8"),
+	Entry("ICMPTypeAndCode", Match().ICMPTypeAndCode(8, 1), "-m icmp --icmp-type 8/1"),
+	Entry("NotICMPTypeAndCode", Match().NotICMPTypeAndCode(8, 1), "-m icmp ! --icmp-type 8/1"),
+	Entry("ICMPV6Type", Match().ICMPV6Type(135), "-m icmp6 --icmpv6-type 135"),
+	Entry("NotICMPV6Type", Match().NotICMPV6Type(135), "-m icmp6 ! --icmpv6-type 135"),
+	Entry("ICMPV6TypeAndCode", Match().ICMPV6TypeAndCode(1, 3), "-m icmp6 --icmpv6-type 1/3"),
+	Entry("NotICMPV6TypeAndCode", Match().NotICMPV6TypeAndCode(1, 3), "-m icmp6 ! --icmpv6-type 1/3"),
+
+	// Composite matches.
+	Entry("Protocol and ports", Match().Protocol("tcp").DestPorts(80),
+		"-p tcp -m multiport --destination-ports 80"),
+	Entry("Interface and source", Match().InInterface("cali+").SourceNet("10.0.0.1"),
+		"--in-interface cali+ --source 10.0.0.1"),
+)
+
+var _ = DescribeTable("IsMulticastCIDR",
+	func(cidr string, expected bool) {
+		Expect(IsMulticastCIDR(cidr)).To(Equal(expected))
+	},
+	Entry("IPv4 group", "239.1.2.3/32", true),
+	Entry("IPv4 range", "224.0.0.0/4", true),
+	Entry("IPv4 larger than the range", "224.0.0.0/3", false),
+	Entry("IPv4 unicast", "10.0.0.0/8", false),
+	Entry("IPv6 group", "ff02::1/128", true),
+	Entry("IPv6 unicast", "fd00::/64", false),
+	Entry("Not a CIDR", "239.1.2.3", false),
+)
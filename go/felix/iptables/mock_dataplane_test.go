@@ -0,0 +1,210 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mockDataplane simulates iptables-save and iptables-restore for a single
+// table.  Chains maps from chain name to the rules in the chain, each
+// without its "-A <chain> " prefix.
+type mockDataplane struct {
+	Table  string
+	Chains map[string][]string
+
+	// Cmds records the commands that have been run.
+	Cmds []string
+	// RestoreInputs records the input passed to each iptables-restore.
+	RestoreInputs []string
+	// FailNextRestore makes the next iptables-restore fail without
+	// changing anything.
+	FailNextRestore bool
+	// OnRestore, if non-nil, is called at the start of each
+	// iptables-restore.
+	OnRestore func()
+}
+
+func newMockDataplane(table string, chains map[string][]string) *mockDataplane {
+	return &mockDataplane{
+		Table:  table,
+		Chains: chains,
+	}
+}
+
+func (d *mockDataplane) newCmd(name string, arg ...string) CmdIface {
+	d.Cmds = append(d.Cmds, strings.Join(append([]string{name}, arg...), " "))
+	return &mockCmd{dataplane: d, name: name, args: arg}
+}
+
+func (d *mockDataplane) save() []byte {
+	var chainNames []string
+	for chainName := range d.Chains {
+		chainNames = append(chainNames, chainName)
+	}
+	sort.Strings(chainNames)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%s\n", d.Table)
+	for _, chainName := range chainNames {
+		fmt.Fprintf(&buf, ":%s - [0:0]\n", chainName)
+	}
+	for _, chainName := range chainNames {
+		for _, rule := range d.Chains[chainName] {
+			fmt.Fprintf(&buf, "-A %s %s\n", chainName, rule)
+		}
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.Bytes()
+}
+
+// restore applies the input to a copy of the chains, so that a failure
+// leaves the dataplane untouched, as iptables-restore does.
+func (d *mockDataplane) restore(input string) error {
+	d.RestoreInputs = append(d.RestoreInputs, input)
+	if d.OnRestore != nil {
+		d.OnRestore()
+	}
+	if d.FailNextRestore {
+		d.FailNextRestore = false
+		return errors.New("simulated failure")
+	}
+	chains := map[string][]string{}
+	for name, rules := range d.Chains {
+		chains[name] = append([]string(nil), rules...)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line == "COMMIT" || strings.HasPrefix(line, "*") {
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// Defining a chain creates it or flushes it.
+			chains[strings.Fields(line[1:])[0]] = []string{}
+			continue
+		}
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 {
+			return fmt.Errorf("bad line %q", line)
+		}
+		op, chainName := parts[0], parts[1]
+		rules, ok := chains[chainName]
+		if !ok {
+			return fmt.Errorf("no such chain %q", chainName)
+		}
+		switch op {
+		case "-A", "-I":
+			if target := jumpTarget(parts[2]); target != "" && chains[target] == nil {
+				return fmt.Errorf("no such target %q in %q", target, line)
+			}
+			if op == "-A" {
+				chains[chainName] = append(rules, parts[2])
+			} else {
+				chains[chainName] = append([]string{parts[2]}, rules...)
+			}
+		case "-D":
+			n, err := strconv.Atoi(parts[2])
+			if err != nil || n < 1 || n > len(rules) {
+				return fmt.Errorf("bad rule number in %q", line)
+			}
+			chains[chainName] = append(rules[:n-1], rules[n:]...)
+		case "-X":
+			for otherName, otherRules := range chains {
+				for _, rule := range otherRules {
+					if jumpTarget(rule) == chainName {
+						return fmt.Errorf("chain %q still referenced by %q",
+							chainName, otherName)
+					}
+				}
+			}
+			delete(chains, chainName)
+		default:
+			return fmt.Errorf("unknown operation in %q", line)
+		}
+	}
+	d.Chains = chains
+	return nil
+}
+
+// jumpTarget returns the chain that a rule jumps or goes to, or "" if its
+// target is one of the built-in ones, which are all upper case.
+func jumpTarget(rule string) string {
+	fields := strings.Fields(rule)
+	for i, field := range fields {
+		if (field == "--jump" || field == "--goto") && i+1 < len(fields) {
+			if target := fields[i+1]; target != strings.ToUpper(target) {
+				return target
+			}
+		}
+	}
+	return ""
+}
+
+type mockCmd struct {
+	dataplane *mockDataplane
+	name      string
+	args      []string
+	stdin     io.Reader
+}
+
+func (c *mockCmd) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+// list simulates "iptables -t <table> -S <chain>".
+func (d *mockDataplane) list(chainName string) ([]byte, error) {
+	rules, ok := d.Chains[chainName]
+	if !ok {
+		return nil, fmt.Errorf("no such chain %q", chainName)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "-N %s\n", chainName)
+	for _, rule := range rules {
+		fmt.Fprintf(&buf, "-A %s %s\n", chainName, rule)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *mockCmd) Output() ([]byte, error) {
+	if (c.name == "iptables" || c.name == "ip6tables") &&
+		len(c.args) == 4 && c.args[2] == "-S" {
+		return c.dataplane.list(c.args[3])
+	}
+	if !strings.HasSuffix(c.name, "-save") {
+		return nil, fmt.Errorf("unexpected command %q", c.name)
+	}
+	return c.dataplane.save(), nil
+}
+
+func (c *mockCmd) CombinedOutput() ([]byte, error) {
+	if !strings.HasSuffix(c.name, "-restore") {
+		return nil, fmt.Errorf("unexpected command %q", c.name)
+	}
+	var input bytes.Buffer
+	input.ReadFrom(c.stdin)
+	if err := c.dataplane.restore(input.String()); err != nil {
+		return []byte(err.Error()), err
+	}
+	return nil, nil
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ParsedRule is a rule that has been read back from iptables-save (or
+// iptables-restore) syntax.
+type ParsedRule struct {
+	// Op is "-A" or "-I".
+	Op    string
+	Chain string
+	// Hash is the hash from the rule's first comment, if that comment was
+	// written by a Table.
+	Hash string
+	// Comment holds the rule's own comments, in order.
+	Comment []string
+	// Args holds the rest of the rule's arguments, with any quoting
+	// removed.
+	Args []string
+}
+
+// ParseRule parses a single "-A" or "-I" line.  It unquotes arguments in the
+// same way as iptables-restore.
+func ParseRule(line string) (ParsedRule, error) {
+	args, err := splitArgs(line)
+	if err != nil {
+		return ParsedRule{}, err
+	}
+	if len(args) < 2 || (args[0] != "-A" && args[0] != "-I") {
+		return ParsedRule{}, fmt.Errorf("not a rule: %q", line)
+	}
+	parsed := ParsedRule{Op: args[0], Chain: args[1]}
+	args = args[2:]
+	for len(args) >= 4 && args[0] == "-m" && args[1] == "comment" && args[2] == "--comment" {
+		// Only the first comment can be our hash; the rule's own
+		// comments follow it.
+		if parsed.Hash == "" && parsed.Comment == nil && isHashComment(args[3]) {
+			parsed.Hash = args[3][len(HashCommentPrefix):]
+		} else {
+			parsed.Comment = append(parsed.Comment, args[3])
+		}
+		args = args[4:]
+	}
+	parsed.Args = args
+	return parsed, nil
+}
+
+func isHashComment(comment string) bool {
+	if !strings.HasPrefix(comment, HashCommentPrefix) {
+		return false
+	}
+	hash := comment[len(HashCommentPrefix):]
+	if hash == "" {
+		return false
+	}
+	for _, c := range hash {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Render renders the parsed rule back into iptables-restore syntax.
+func (p ParsedRule) Render() string {
+	var buf bytes.Buffer
+	buf.WriteString(p.Op)
+	buf.WriteByte(' ')
+	buf.WriteString(p.Chain)
+	if p.Hash != "" {
+		buf.WriteString(` -m comment --comment "`)
+		buf.WriteString(HashCommentPrefix)
+		buf.WriteString(p.Hash)
+		buf.WriteByte('"')
+	}
+	for _, comment := range p.Comment {
+		buf.WriteString(` -m comment --comment "`)
+		writeEscaped(&buf, comment)
+		buf.WriteByte('"')
+	}
+	for _, arg := range p.Args {
+		buf.WriteByte(' ')
+		if arg == "" || strings.ContainsAny(arg, " \t\"\\") {
+			buf.WriteByte('"')
+			writeEscaped(&buf, arg)
+			buf.WriteByte('"')
+		} else {
+			buf.WriteString(arg)
+		}
+	}
+	return buf.String()
+}
+
+var errUnterminatedQuote = errors.New("unterminated quote")
+
+// splitArgs splits a line into arguments in the same way as
+// iptables-restore: arguments are separated by whitespace, which may be
+// included in an argument by quoting it with double quotes, and, within
+// quotes, a backslash escapes the next character.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg bytes.Buffer
+	inArg, inQuotes, escaped := false, false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case escaped:
+			arg.WriteByte(c)
+			escaped = false
+		case inQuotes && c == '\\':
+			escaped = true
+		case c == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case !inQuotes && (c == ' ' || c == '\t'):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inQuotes || escaped {
+		return nil, errUnterminatedQuote
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// writeEscaped writes s for use inside double quotes, escaping quotes and
+// backslashes.  iptables-restore reads its input a line at a time, so line
+// breaks (and NULs) are replaced with spaces.
+func writeEscaped(buf *bytes.Buffer, s string) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c == '\n' || c == '\r' || c == 0:
+			buf.WriteByte(' ')
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// HashLength is the length of the rule hashes that the Table embeds in the
+// comments of the rules that it programs.
+const HashLength = 16
+
+// RenderCache caches the rendered body and hash of each rule in a chain.
+// Rendering and hashing every rule on every apply cycle is expensive on a
+// host with many rules; with the cache, an unchanged chain costs a cheap,
+// rule-by-rule comparison against the cached copies of its rules.
+//
+// Entries are keyed by chain name and rule position.  A rule is re-rendered
+// if it no longer Equals the cached copy.  Since each rule's hash covers the
+// rules before it, a change also invalidates the hashes (but not the
+// rendered bodies) of the later rules in the chain.
+type RenderCache struct {
+	chains map[string]*renderedChain
+}
+
+type renderedChain struct {
+	// rules holds copies of the rules that were rendered.
+	rules []Rule
+	// bodies holds the rendered rules, without the "-A <chain>" prefix;
+	// see Rule.renderBodyTo.
+	bodies []string
+	hashes []string
+}
+
+func NewRenderCache() *RenderCache {
+	return &RenderCache{
+		chains: map[string]*renderedChain{},
+	}
+}
+
+// RuleHashes returns the hashes of the chain's rules.  The hash of each rule
+// covers the chain's name and all the rules up to and including that rule.
+// The returned slice must not be modified.
+func (c *RenderCache) RuleHashes(chain *Chain) []string {
+	return c.update(chain).hashes
+}
+
+// RenderAppends returns the rendered rules of the chain as appends
+// ("-A <chain> ..."), with each rule's hash included in a comment.
+func (c *RenderCache) RenderAppends(chain *Chain, hashCommentPrefix string) []string {
+	rendered := c.update(chain)
+	lines := make([]string, len(rendered.bodies))
+	for i, body := range rendered.bodies {
+		lines[i] = "-A " + chain.Name + " " + hashComment(hashCommentPrefix, rendered.hashes[i]) + body
+	}
+	return lines
+}
+
+// Forget removes the cached rendering of the named chain.
+func (c *RenderCache) Forget(chainName string) {
+	delete(c.chains, chainName)
+}
+
+func (c *RenderCache) update(chain *Chain) *renderedChain {
+	cached := c.chains[chain.Name]
+	if cached == nil {
+		cached = &renderedChain{}
+		c.chains[chain.Name] = cached
+	}
+
+	var buf bytes.Buffer
+	hashChanged := false
+	for i, rule := range chain.Rules {
+		if i < len(cached.rules) && cached.rules[i].Equals(rule) {
+			if !hashChanged {
+				// Rule and all the rules before it are unchanged.
+				continue
+			}
+		} else {
+			// Take a copy of the match criteria and comments so that
+			// we don't alias the caller's backing arrays.
+			rule.Match = append(MatchCriteria(nil), rule.Match...)
+			rule.Comment = append([]string(nil), rule.Comment...)
+			buf.Reset()
+			rule.renderBodyTo(&buf)
+			if i < len(cached.rules) {
+				cached.rules[i] = rule
+				cached.bodies[i] = buf.String()
+			} else {
+				cached.rules = append(cached.rules, rule)
+				cached.bodies = append(cached.bodies, buf.String())
+				cached.hashes = append(cached.hashes, "")
+			}
+		}
+		var prevHash string
+		if i > 0 {
+			prevHash = cached.hashes[i-1]
+		}
+		cached.hashes[i] = ruleHash(chain.Name, prevHash, cached.bodies[i])
+		hashChanged = true
+	}
+	cached.rules = cached.rules[:len(chain.Rules)]
+	cached.bodies = cached.bodies[:len(chain.Rules)]
+	cached.hashes = cached.hashes[:len(chain.Rules)]
+	return cached
+}
+
+// ruleHash calculates the hash of a rule from the hash of the rule before it
+// (or "" for the first rule) and its rendered body.  The chain name is
+// included so that identical rules in different chains get different hashes.
+//
+// The body is hashed as the list of arguments that iptables would see, so
+// that the hash doesn't depend on the whitespace between arguments.  The
+// hashes are programmed into the dataplane, so they must be stable across
+// restarts and upgrades; changing them causes every rule to be rewritten.
+func ruleHash(chainName, prevHash, body string) string {
+	hasher := sha256.New224()
+	hasher.Write([]byte(chainName))
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(prevHash))
+	hasher.Write([]byte{0})
+	if args, err := splitArgs(body); err == nil {
+		for _, arg := range args {
+			hasher.Write([]byte(arg))
+			hasher.Write([]byte{0})
+		}
+	} else {
+		hasher.Write([]byte(body))
+	}
+	hash := hasher.Sum(nil)
+	// Use the URL-safe base64 variant, whose characters are all valid in
+	// an unquoted iptables comment.
+	return base64.RawURLEncoding.EncodeToString(hash)[:HashLength]
+}
+
+func hashComment(prefix, hash string) string {
+	return `-m comment --comment "` + prefix + hash + `"`
+}
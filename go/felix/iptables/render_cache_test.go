@@ -0,0 +1,101 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RenderCache", func() {
+	var cache *RenderCache
+	var chain *Chain
+
+	BeforeEach(func() {
+		cache = NewRenderCache()
+		chain = &Chain{
+			Name: "cali-foo",
+			Rules: []Rule{
+				{Match: Match().Protocol("tcp"), Action: AcceptAction{}},
+				{Action: DropAction{}, Comment: []string{"drop the rest"}},
+			},
+		}
+	})
+
+	It("should return stable hashes", func() {
+		hashes := append([]string(nil), cache.RuleHashes(chain)...)
+		Expect(hashes).To(HaveLen(2))
+		Expect(hashes[0]).To(HaveLen(HashLength))
+		Expect(hashes[0]).NotTo(Equal(hashes[1]))
+		Expect(cache.RuleHashes(chain)).To(Equal(hashes))
+		Expect(NewRenderCache().RuleHashes(chain)).To(Equal(hashes))
+	})
+	It("should give identical rules in different chains different hashes", func() {
+		other := &Chain{Name: "cali-bar", Rules: chain.Rules}
+		Expect(cache.RuleHashes(other)).NotTo(Equal(cache.RuleHashes(chain)))
+	})
+	It("should render appends with the hashes", func() {
+		hashes := cache.RuleHashes(chain)
+		Expect(cache.RenderAppends(chain, "cali:")).To(Equal([]string{
+			`-A cali-foo -m comment --comment "cali:` + hashes[0] + `" -p tcp --jump ACCEPT`,
+			`-A cali-foo -m comment --comment "cali:` + hashes[1] + `" ` +
+				`-m comment --comment "drop the rest" --jump DROP`,
+		}))
+	})
+
+	Describe("after caching the chain", func() {
+		var oldHashes []string
+
+		BeforeEach(func() {
+			oldHashes = append([]string(nil), cache.RuleHashes(chain)...)
+		})
+
+		It("should change the hashes from a modified rule onwards", func() {
+			chain = &Chain{Name: "cali-foo", Rules: []Rule{
+				chain.Rules[0],
+				{Action: ReturnAction{}},
+			}}
+			hashes := cache.RuleHashes(chain)
+			Expect(hashes[0]).To(Equal(oldHashes[0]))
+			Expect(hashes[1]).NotTo(Equal(oldHashes[1]))
+		})
+		It("should change all the hashes if the first rule changes", func() {
+			chain = &Chain{Name: "cali-foo", Rules: []Rule{
+				{Match: Match().Protocol("udp"), Action: AcceptAction{}},
+				chain.Rules[1],
+			}}
+			hashes := cache.RuleHashes(chain)
+			Expect(hashes[0]).NotTo(Equal(oldHashes[0]))
+			Expect(hashes[1]).NotTo(Equal(oldHashes[1]))
+			Expect(cache.RenderAppends(chain, "cali:")[1]).To(ContainSubstring("drop the rest"))
+		})
+		It("should notice a change to a rule's match criteria in place", func() {
+			chain.Rules[0].Match[0] = "-p udp"
+			Expect(cache.RuleHashes(chain)[0]).NotTo(Equal(oldHashes[0]))
+			Expect(cache.RenderAppends(chain, "cali:")[0]).To(ContainSubstring("-p udp"))
+		})
+		It("should handle rules being removed and added", func() {
+			short := &Chain{Name: "cali-foo", Rules: chain.Rules[:1]}
+			Expect(cache.RuleHashes(short)).To(Equal(oldHashes[:1]))
+			Expect(cache.RuleHashes(chain)).To(Equal(oldHashes))
+		})
+		It("should re-render after Forget", func() {
+			cache.Forget("cali-foo")
+			Expect(cache.RuleHashes(chain)).To(Equal(oldHashes))
+		})
+	})
+})
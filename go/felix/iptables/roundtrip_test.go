@@ -0,0 +1,338 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	"math/rand"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// identChars are the characters that can appear in unquoted arguments, such
+// as interface and IP set names.
+const identChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:|"
+
+// freeChars are the characters that can appear in quoted arguments, such as
+// comments and log prefixes.
+const freeChars = identChars + " \t\"\\'\n\r\x00$`!#;*é日"
+
+func randomString(r *rand.Rand, chars string, minLen int) string {
+	runes := []rune(chars)
+	n := minLen + r.Intn(12)
+	s := make([]rune, n)
+	for i := range s {
+		s[i] = runes[r.Intn(len(runes))]
+	}
+	return string(s)
+}
+
+func randomMatch(r *rand.Rand) MatchCriteria {
+	m := Match()
+	for i := r.Intn(4); i > 0; i-- {
+		ident := randomString(r, identChars, 1)
+		switch r.Intn(13) {
+		case 0:
+			m = m.MarkSet(r.Uint32())
+		case 1:
+			m = m.MarkClear(r.Uint32())
+		case 2:
+			m = m.InInterface(ident)
+		case 3:
+			m = m.OutInterface(ident)
+		case 4:
+			m = m.ConntrackState(ident)
+		case 5:
+			m = m.ProtocolNum(uint8(r.Intn(256)))
+		case 6:
+			m = m.NotSourceIPSet(ident)
+		case 7:
+			m = m.DestPorts(uint16(r.Intn(65536)), uint16(r.Intn(65536)))
+		case 8:
+			m = m.SrcAddrType(AddrTypeLocal, r.Intn(2) == 0)
+		case 9:
+			m = m.ICMPTypeAndCode(uint8(r.Intn(256)), uint8(r.Intn(256)))
+		case 10:
+			m = m.ConnMarkSet(r.Uint32())
+		case 11:
+			m = m.HashLimitAbove(ident, uint32(r.Intn(10000)+1), uint32(r.Intn(10000)+1))
+		case 12:
+			m = m.NfacctName(ident)
+		}
+	}
+	return m
+}
+
+func randomAction(r *rand.Rand) Action {
+	switch r.Intn(22) {
+	case 0:
+		return nil
+	case 1:
+		return GotoAction{Target: randomString(r, identChars, 1)}
+	case 2:
+		return JumpAction{Target: randomString(r, identChars, 1)}
+	case 3:
+		return ReturnAction{}
+	case 4:
+		return DropAction{}
+	case 5:
+		return LogAction{Prefix: randomString(r, freeChars, 0)}
+	case 6:
+		return NflogAction{Group: uint16(r.Intn(65536)), Prefix: randomString(r, freeChars, 0)}
+	case 7:
+		return AcceptAction{}
+	case 8:
+		return DNATAction{DestAddr: "fd00::1", DestPort: uint16(r.Intn(65536)), MaxDestPort: uint16(r.Intn(65536))}
+	case 9:
+		return SNATAction{ToAddr: "10.0.0.1"}
+	case 10:
+		return MasqAction{MinPort: uint16(r.Intn(65536)), RandomFully: r.Intn(2) == 0}
+	case 11:
+		return ClearMarkAction{Mark: r.Uint32()}
+	case 12:
+		return NetmapAction{ToNet: "192.168.0.0/24"}
+	case 13:
+		return SetMaskedMarkAction{Mark: r.Uint32(), Mask: r.Uint32()}
+	case 14:
+		return SaveConnMarkAction{SaveMask: r.Uint32()}
+	case 15:
+		return RestoreConnMarkAction{RestoreMask: r.Uint32()}
+	case 16:
+		return CTZoneAction{Zone: uint16(r.Intn(65536))}
+	case 17:
+		return SetConnMarkAction{Mark: r.Uint32(), Mask: r.Uint32()}
+	case 18:
+		return SynproxyAction{SACKPerm: r.Intn(2) == 0, Timestamp: r.Intn(2) == 0,
+			WScale: uint8(r.Intn(15)), MSS: uint16(r.Intn(65536))}
+	case 19:
+		return AddToIPSetAction{SetName: randomString(r, identChars, 1), TimeoutSecs: r.Uint32()}
+	case 20:
+		return SetDSCPAction{DSCP: uint8(r.Intn(64))}
+	default:
+		return SetMarkAction{Mark: r.Uint32()}
+	}
+}
+
+func randomRule(r *rand.Rand) Rule {
+	rule := Rule{
+		Match:  randomMatch(r),
+		Action: randomAction(r),
+	}
+	for i := r.Intn(3); i > 0; i-- {
+		rule.Comment = append(rule.Comment, randomString(r, freeChars, 0))
+	}
+	return rule
+}
+
+// sanitized returns s as it appears in the dataplane: dropped if it
+// contains a line break, otherwise with double quotes removed and truncated
+// to maxLen bytes without splitting a character.
+func sanitized(s string, maxLen int) string {
+	if strings.ContainsAny(s, "\n\r\x00") {
+		return ""
+	}
+	result := ""
+	for _, r := range strings.Replace(s, `"`, "", -1) {
+		if len(result)+len(string(r)) > maxLen {
+			break
+		}
+		result += string(r)
+	}
+	return result
+}
+
+// sanitizedComments returns the comments that should be parsed back from the
+// rendered rule, or nil if there are none.
+func sanitizedComments(comments []string) []string {
+	var result []string
+	for _, c := range comments {
+		if c = sanitized(c, MaxCommentLength); c != "" {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// expectedArgs returns the arguments that iptables should see for the
+// rule's match criteria and action.
+func expectedArgs(rule Rule) []string {
+	args := []string{}
+	for _, fragment := range rule.Match {
+		args = append(args, strings.Fields(fragment)...)
+	}
+	switch a := rule.Action.(type) {
+	case nil:
+	case LogAction:
+		args = append(args, "--jump", "LOG", "--log-prefix",
+			sanitized(a.Prefix, MaxLogPrefixLength)+": ",
+			"--log-level", "5")
+	case NflogAction:
+		args = append(args, strings.Fields(a.ToFragment())[:4]...)
+		args = append(args, "--nflog-prefix", sanitized(a.Prefix, MaxNflogPrefixLength))
+	default:
+		args = append(args, strings.Fields(a.ToFragment())...)
+	}
+	return args
+}
+
+var _ = Describe("Rule parsing", func() {
+	It("should parse a rule with a hash and comment", func() {
+		Expect(ParseRule(`-A cali-foo -m comment --comment "cali:abcd-_1" ` +
+			`-m comment --comment "say \"hi\"" -p tcp --jump LOG --log-prefix "a b: "`)).To(Equal(
+			ParsedRule{
+				Op:      "-A",
+				Chain:   "cali-foo",
+				Hash:    "abcd-_1",
+				Comment: []string{`say "hi"`},
+				Args:    []string{"-p", "tcp", "--jump", "LOG", "--log-prefix", "a b: "},
+			}))
+	})
+	It("should parse an unquoted comment from iptables-save", func() {
+		Expect(ParseRule(`-I FORWARD -m comment --comment cali:abcd --jump cali-foo`)).To(Equal(
+			ParsedRule{
+				Op:    "-I",
+				Chain: "FORWARD",
+				Hash:  "abcd",
+				Args:  []string{"--jump", "cali-foo"},
+			}))
+	})
+	It("should treat a comment that isn't a hash as the rule's comment", func() {
+		parsed, err := ParseRule(`-A cali-foo -m comment --comment "cali: nope"`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed.Hash).To(Equal(""))
+		Expect(parsed.Comment).To(Equal([]string{"cali: nope"}))
+	})
+	It("should parse several comments after the hash", func() {
+		Expect(ParseRule(`-A cali-foo -m comment --comment cali:abcd ` +
+			`-m comment --comment "policy default/allow-web" -m comment --comment cali:efgh ` +
+			`--jump ACCEPT`)).To(Equal(
+			ParsedRule{
+				Op:      "-A",
+				Chain:   "cali-foo",
+				Hash:    "abcd",
+				Comment: []string{"policy default/allow-web", "cali:efgh"},
+				Args:    []string{"--jump", "ACCEPT"},
+			}))
+	})
+	It("should only treat the first comment as a hash", func() {
+		parsed, err := ParseRule(`-A cali-foo -m comment --comment "a b" -m comment --comment cali:abcd`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed.Hash).To(Equal(""))
+		Expect(parsed.Comment).To(Equal([]string{"a b", "cali:abcd"}))
+	})
+	It("should reject an unterminated quote", func() {
+		_, err := ParseRule(`-A cali-foo -m comment --comment "oops`)
+		Expect(err).To(HaveOccurred())
+	})
+	It("should reject a line that isn't a rule", func() {
+		_, err := ParseRule(`:cali-foo - [0:0]`)
+		Expect(err).To(HaveOccurred())
+	})
+	It("should strip quotes from comments and escape backslashes", func() {
+		Expect(Rule{Comment: []string{"a \"b\" \\c"}}.RenderAppend("cali-foo", "")).To(Equal(
+			`-A cali-foo -m comment --comment "a b \\c"`))
+	})
+
+	It("should render each comment as its own match", func() {
+		Expect(Rule{Comment: []string{"one", "two"}, Action: AcceptAction{}}.RenderAppend("cali-foo", "")).To(Equal(
+			`-A cali-foo -m comment --comment "one" -m comment --comment "two" --jump ACCEPT`))
+	})
+
+	It("should round-trip random rules", func() {
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 5000; i++ {
+			rule := randomRule(r)
+			chain := &Chain{Name: randomString(r, identChars, 1), Rules: []Rule{rule}}
+			cache := NewRenderCache()
+			line := cache.RenderAppends(chain, HashCommentPrefix)[0]
+
+			parsed, err := ParseRule(line)
+			Expect(err).NotTo(HaveOccurred(), line)
+			Expect(parsed).To(Equal(ParsedRule{
+				Op:      "-A",
+				Chain:   chain.Name,
+				Hash:    cache.RuleHashes(chain)[0],
+				Comment: sanitizedComments(rule.Comment),
+				Args:    expectedArgs(rule),
+			}), line)
+
+			reparsed, err := ParseRule(parsed.Render())
+			Expect(err).NotTo(HaveOccurred(), line)
+			Expect(reparsed).To(Equal(parsed), line)
+		}
+	})
+})
+
+var _ = Describe("Rule hashes", func() {
+	chain := &Chain{
+		Name: "cali-foo",
+		Rules: []Rule{
+			{Match: Match().Protocol("tcp").DestPorts(80), Action: AcceptAction{}},
+			{Action: NflogAction{Group: 1, Prefix: "D|profiles"}, Comment: []string{"log drops"}},
+			{Action: DropAction{}},
+		},
+	}
+
+	It("should be stable across restarts", func() {
+		// The hashes are programmed into the dataplane; if they change, an
+		// upgrade rewrites every rule.
+		Expect(NewRenderCache().RuleHashes(chain)).To(Equal([]string{
+			"UPhp-J4jawuAam31",
+			"fkAE6cvTltOAEJt4",
+			"BvLPVFjXd7o0r_YK",
+		}))
+	})
+	It("should ignore whitespace between arguments", func() {
+		spaced := &Chain{
+			Name: "cali-foo",
+			Rules: []Rule{
+				{Match: MatchCriteria{"-p  tcp", "-m\tmultiport --destination-ports 80 "},
+					Action: AcceptAction{}},
+				chain.Rules[1],
+				chain.Rules[2],
+			},
+		}
+		Expect(NewRenderCache().RuleHashes(spaced)).To(Equal(NewRenderCache().RuleHashes(chain)))
+	})
+	It("should not ignore whitespace inside quotes", func() {
+		spaced := &Chain{
+			Name: "cali-foo",
+			Rules: []Rule{
+				chain.Rules[0],
+				{Action: chain.Rules[1].Action, Comment: []string{"log  drops"}},
+				chain.Rules[2],
+			},
+		}
+		Expect(NewRenderCache().RuleHashes(spaced)[1]).NotTo(
+			Equal(NewRenderCache().RuleHashes(chain)[1]))
+	})
+	It("should be insensitive to random whitespace", func() {
+		r := rand.New(rand.NewSource(2))
+		for i := 0; i < 1000; i++ {
+			rule := randomRule(r)
+			respaced := rule
+			respaced.Match = nil
+			for _, fragment := range rule.Match {
+				respaced.Match = append(respaced.Match,
+					"\t"+strings.Join(strings.Fields(fragment), "  \t ")+" ")
+			}
+			Expect(NewRenderCache().RuleHashes(&Chain{Name: "c", Rules: []Rule{respaced}})).To(Equal(
+				NewRenderCache().RuleHashes(&Chain{Name: "c", Rules: []Rule{rule}})))
+		}
+	})
+})
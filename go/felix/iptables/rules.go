@@ -0,0 +1,147 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The iptables package contains Felix's model of iptables rules and chains.
+//
+// A Chain is a named list of Rules.  Each Rule is made up of some
+// MatchCriteria, which are built up using the methods on MatchCriteria, and
+// an Action, such as AcceptAction or JumpAction.  Rules render themselves
+// into the fragment of iptables-restore syntax that appends (or inserts)
+// them to a chain:
+//
+//	rule := Rule{
+//	    Match:  Match().Protocol("tcp").DestPorts(80),
+//	    Action: AcceptAction{},
+//	}
+//	rule.RenderAppend("cali-foo", "")
+//	// -A cali-foo -p tcp -m multiport --destination-ports 80 --jump ACCEPT
+//
+// A Table programs chains into one iptables table using iptables-restore.
+// It tags each rule with a hash so that, using a RenderCache, it only
+// rewrites the chains that have changed.
+package iptables
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Rule represents a single iptables rule; a set of match criteria and an
+// action to take if the criteria all match.
+type Rule struct {
+	Match  MatchCriteria
+	Action Action
+	// Comment holds the comments to attach to the rule, each using its own
+	// comment match, in order.  Double quotes are removed, each comment is
+	// truncated to MaxCommentLength bytes and a comment that contains a
+	// line break is dropped.
+	Comment []string
+}
+
+// bufferPool holds the buffers used by RenderAppend and RenderInsert, which
+// are called for every rule on every programming cycle.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
+// RenderAppend renders the rule as an append ("-A") fragment for the given
+// chain.  If prefixFragment is non-empty, it is included ahead of the rule's
+// own match criteria.
+func (r Rule) RenderAppend(chainName, prefixFragment string) string {
+	return r.render("-A", chainName, prefixFragment)
+}
+
+// RenderInsert renders the rule as an insert ("-I") fragment for the given
+// chain, which puts it at the top of the chain.
+func (r Rule) RenderInsert(chainName, prefixFragment string) string {
+	return r.render("-I", chainName, prefixFragment)
+}
+
+// RenderAppendTo is like RenderAppend but it writes the fragment to buf.
+// Callers that render many rules into one buffer, such as the input to
+// iptables-restore, should use it to avoid allocating a string per rule.
+func (r Rule) RenderAppendTo(buf *bytes.Buffer, chainName, prefixFragment string) {
+	r.renderTo(buf, "-A", chainName, prefixFragment)
+}
+
+// RenderInsertTo is like RenderInsert but it writes the fragment to buf.
+func (r Rule) RenderInsertTo(buf *bytes.Buffer, chainName, prefixFragment string) {
+	r.renderTo(buf, "-I", chainName, prefixFragment)
+}
+
+func (r Rule) render(op, chainName, prefixFragment string) string {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	r.renderTo(buf, op, chainName, prefixFragment)
+	rendered := buf.String()
+	bufferPool.Put(buf)
+	return rendered
+}
+
+func (r Rule) renderTo(buf *bytes.Buffer, op, chainName, prefixFragment string) {
+	buf.WriteString(op)
+	buf.WriteByte(' ')
+	buf.WriteString(chainName)
+	if prefixFragment != "" {
+		buf.WriteByte(' ')
+		buf.WriteString(prefixFragment)
+	}
+	r.renderBodyTo(buf)
+}
+
+// renderBodyTo writes the rule's comments, match criteria and action, each
+// preceded by a space.  The comments are sanitized; see sanitizeText.
+func (r Rule) renderBodyTo(buf *bytes.Buffer) {
+	for _, comment := range r.Comment {
+		if comment = sanitizeText(comment, MaxCommentLength); comment != "" {
+			buf.WriteString(` -m comment --comment "`)
+			writeEscaped(buf, comment)
+			buf.WriteByte('"')
+		}
+	}
+	r.Match.renderTo(buf)
+	if r.Action == nil {
+		return
+	}
+	if writer, ok := r.Action.(fragmentWriter); ok {
+		buf.WriteByte(' ')
+		writer.writeFragment(buf)
+	} else if actionFragment := r.Action.ToFragment(); actionFragment != "" {
+		buf.WriteByte(' ')
+		buf.WriteString(actionFragment)
+	}
+}
+
+// Equals returns true if the two rules would render identically.  It is
+// much cheaper than rendering them.
+func (r Rule) Equals(other Rule) bool {
+	if r.Action != other.Action || len(r.Match) != len(other.Match) ||
+		!stringSlicesEqual(r.Comment, other.Comment) {
+		return false
+	}
+	for i := range r.Match {
+		if r.Match[i] != other.Match[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Chain is a named, ordered list of Rules.
+type Chain struct {
+	Name  string
+	Rules []Rule
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	"bytes"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+var _ = Describe("Rule rendering", func() {
+	rule := Rule{
+		Match:   Match().Protocol("tcp").DestPorts(80),
+		Action:  AcceptAction{},
+		Comment: []string{"allow http"},
+	}
+
+	It("should render an append", func() {
+		Expect(rule.RenderAppend("cali-foo", "")).To(Equal(
+			`-A cali-foo -m comment --comment "allow http" ` +
+				`-p tcp -m multiport --destination-ports 80 --jump ACCEPT`))
+	})
+	It("should render an insert", func() {
+		Expect(rule.RenderInsert("cali-foo", "")).To(Equal(
+			`-I cali-foo -m comment --comment "allow http" ` +
+				`-p tcp -m multiport --destination-ports 80 --jump ACCEPT`))
+	})
+	It("should include the prefix fragment ahead of the rule", func() {
+		Expect(rule.RenderAppend("cali-foo", "-m comment --comment \"cali:abcd\"")).To(Equal(
+			`-A cali-foo -m comment --comment "cali:abcd" -m comment --comment "allow http" ` +
+				`-p tcp -m multiport --destination-ports 80 --jump ACCEPT`))
+	})
+	It("should render a rule with no match or action", func() {
+		Expect(Rule{}.RenderAppend("cali-foo", "")).To(Equal("-A cali-foo"))
+	})
+	It("should render an append into a buffer", func() {
+		var buf bytes.Buffer
+		buf.WriteString("existing\n")
+		rule.RenderAppendTo(&buf, "cali-foo", "")
+		Expect(buf.String()).To(Equal("existing\n" + rule.RenderAppend("cali-foo", "")))
+	})
+	It("should render an insert into a buffer", func() {
+		var buf bytes.Buffer
+		rule.RenderInsertTo(&buf, "cali-foo", "-m comment --comment \"cali:abcd\"")
+		Expect(buf.String()).To(Equal(rule.RenderInsert("cali-foo", "-m comment --comment \"cali:abcd\"")))
+	})
+	It("should render actions with parameters", func() {
+		Expect(Rule{
+			Match:  Match().MarkSet(0x10),
+			Action: SetMarkAction{Mark: 0x8},
+		}.RenderAppend("cali-foo", "")).To(Equal(
+			"-A cali-foo -m mark --mark 0x10/0x10 --jump MARK --set-mark 0x8/0x8"))
+	})
+})
+
+// benchmarkRules is a typical mix of endpoint chain rules.
+var benchmarkRules = []Rule{
+	{Action: ClearMarkAction{Mark: 0x8}},
+	{Comment: []string{"Start of tier default"}, Action: ClearMarkAction{Mark: 0x10}},
+	{Match: Match().MarkClear(0x10), Action: JumpAction{Target: "cali-pi-default/a"}},
+	{Match: Match().MarkSet(0x8).ConntrackState("NEW"),
+		Action: NflogAction{Group: 1, Prefix: "A|policy/default/a"}},
+	{Match: Match().MarkSet(0x8), Action: ReturnAction{}, Comment: []string{"Return if policy accepted"}},
+	{Match: Match().Protocol("tcp").DestPorts(80, 443), Action: AcceptAction{}},
+}
+
+func BenchmarkRenderAppend(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, rule := range benchmarkRules {
+			_ = rule.RenderAppend("cali-tw-cali1234", "")
+		}
+	}
+}
+
+func BenchmarkRenderAppendTo(b *testing.B) {
+	b.ReportAllocs()
+	var buf bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		for _, rule := range benchmarkRules {
+			rule.RenderAppendTo(&buf, "cali-tw-cali1234", "")
+			buf.WriteByte('\n')
+		}
+	}
+}
+
+// BenchmarkRenderAppendTo100kRules renders a chain the size of a large
+// host's.
+func BenchmarkRenderAppendTo100kRules(b *testing.B) {
+	b.ReportAllocs()
+	rules := make([]Rule, 100000)
+	for i := range rules {
+		rules[i] = benchmarkRules[i%len(benchmarkRules)]
+		rules[i].Comment = []string{fmt.Sprintf("rule %d", i)}
+	}
+	var buf bytes.Buffer
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		for _, rule := range rules {
+			rule.RenderAppendTo(&buf, "cali-tw-cali1234", "")
+			buf.WriteByte('\n')
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// MaxCommentLength is the longest comment that the kernel accepts; its
+	// buffer is 256 bytes, including the terminating NUL.
+	MaxCommentLength = 255
+	// MaxLogPrefixLength is the longest prefix that a LogAction can have.
+	// The kernel allows 29 bytes, which includes the ": " that we append.
+	MaxLogPrefixLength = 27
+	// MaxNflogPrefixLength is the longest prefix that an NflogAction can
+	// have.
+	MaxNflogPrefixLength = 63
+)
+
+// sanitizeText returns the text, which may come from the user, as it should
+// be rendered inside quotes, such as in a comment.
+//
+// iptables-restore reads its input a line at a time so text containing a
+// line break (or a NUL) would end the rule early and the remainder would be
+// read as another command.  Such text is rejected: sanitizeText returns "".
+// Otherwise, double quotes are removed, so that the text can't close the
+// quotes, and the text is truncated to maxLen bytes, without splitting a
+// UTF-8 character.  Backslashes are escaped by writeEscaped.
+func sanitizeText(s string, maxLen int) string {
+	if strings.IndexAny(s, "\n\r\x00") >= 0 {
+		log.WithField("text", s).Warn(
+			"Ignoring rule comment or log prefix that contains a line break")
+		return ""
+	}
+	if strings.IndexByte(s, '"') >= 0 {
+		s = strings.Replace(s, `"`, "", -1)
+	}
+	if len(s) > maxLen {
+		// Back up to the start of the character that we'd cut.
+		cut := maxLen
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		s = s[:cut]
+	}
+	return s
+}
+
+// writeArg writes s as a single unquoted argument.  Any character that would
+// end the argument, or start a quoted section, is replaced with "_" so that
+// a bad value, such as a chain name containing a space, can't add arguments
+// to the rule; iptables-restore rejects the rule instead.
+func writeArg(buf *bytes.Buffer, s string) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c == '"' || c == 0x7f {
+			c = '_'
+		}
+		buf.WriteByte(c)
+	}
+}
+
+// argString returns s as writeArg would write it.
+func argString(s string) string {
+	var buf bytes.Buffer
+	writeArg(&buf, s)
+	return buf.String()
+}
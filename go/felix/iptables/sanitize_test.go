@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"strings"
+)
+
+var _ = DescribeTable("Comment sanitization",
+	func(comment, expRendering string) {
+		Expect(Rule{Comment: []string{comment}, Action: AcceptAction{}}.RenderAppend("cali-foo", "")).To(
+			Equal("-A cali-foo" + expRendering + " --jump ACCEPT"))
+	},
+	Entry("plain comment", "allow http", ` -m comment --comment "allow http"`),
+	Entry("quotes", `say "hi"`, ` -m comment --comment "say hi"`),
+	Entry("quote injection", `x" --jump DROP -m comment --comment "y`,
+		` -m comment --comment "x --jump DROP -m comment --comment y"`),
+	Entry("trailing backslash", `x\`, ` -m comment --comment "x\\"`),
+	Entry("newline injection", "x\n-A cali-foo --jump DROP", ""),
+	Entry("carriage return", "x\ry", ""),
+	Entry("NUL", "x\x00y", ""),
+	Entry("too long", strings.Repeat("a", 300),
+		` -m comment --comment "`+strings.Repeat("a", MaxCommentLength)+`"`),
+	Entry("too long, cutting a character", strings.Repeat("a", MaxCommentLength-1)+"日",
+		` -m comment --comment "`+strings.Repeat("a", MaxCommentLength-1)+`"`),
+)
+
+var _ = DescribeTable("Action sanitization",
+	func(action Action, expRendering string) {
+		Expect(action.ToFragment()).To(Equal(expRendering))
+	},
+	Entry("LogAction with quotes", LogAction{Prefix: `a"b`},
+		`--jump LOG --log-prefix "ab: " --log-level 5`),
+	Entry("LogAction with a line break", LogAction{Prefix: "a\n-X cali-foo"},
+		`--jump LOG --log-prefix ": " --log-level 5`),
+	Entry("LogAction too long", LogAction{Prefix: strings.Repeat("a", 40)},
+		`--jump LOG --log-prefix "`+strings.Repeat("a", MaxLogPrefixLength)+`: " --log-level 5`),
+	Entry("NflogAction with quotes", NflogAction{Group: 1, Prefix: `a"b`},
+		`--jump NFLOG --nflog-group 1 --nflog-prefix "ab"`),
+	Entry("NflogAction with a line break", NflogAction{Group: 1, Prefix: "a\r\nb"},
+		`--jump NFLOG --nflog-group 1 --nflog-prefix ""`),
+	Entry("NflogAction too long", NflogAction{Group: 1, Prefix: strings.Repeat("a", 70)},
+		`--jump NFLOG --nflog-group 1 --nflog-prefix "`+strings.Repeat("a", MaxNflogPrefixLength)+`"`),
+	Entry("JumpAction with a space", JumpAction{Target: "cali-foo --jump ACCEPT"},
+		"--jump cali-foo_--jump_ACCEPT"),
+	Entry("GotoAction with a line break", GotoAction{Target: "cali-foo\n-F"},
+		"--goto cali-foo_-F"),
+	Entry("GotoAction with a quote", GotoAction{Target: `cali-"foo`},
+		"--goto cali-_foo"),
+	Entry("DNATAction with a tab", DNATAction{DestAddr: "10.0.0.1\t-j", DestPort: 80},
+		"--jump DNAT --to-destination 10.0.0.1_-j:80"),
+	Entry("SNATAction with a line break", SNATAction{ToAddr: "10.0.0.1\n-F"},
+		"--jump SNAT --to-source 10.0.0.1_-F"),
+)
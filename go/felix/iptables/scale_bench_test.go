@@ -0,0 +1,212 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// The scale benchmarks program the chains of a large host: 10k endpoints,
+// each with a chain of 10 rules, for 100k rules in all.  Run them with
+//
+//	go test -run XXX -bench Scale ./felix/iptables/
+const (
+	scaleNumEndpoints     = 10000
+	scaleRulesPerEndpoint = 10
+)
+
+// scaleChains builds the endpoint chains.  Each rule has a comment that's
+// unique to its endpoint so that no two chains render the same.
+func scaleChains() []*Chain {
+	chains := make([]*Chain, scaleNumEndpoints)
+	for i := range chains {
+		name := fmt.Sprintf("cali-tw-cali%08x", i)
+		rules := make([]Rule, scaleRulesPerEndpoint)
+		for j := range rules {
+			rules[j] = benchmarkRules[j%len(benchmarkRules)]
+			rules[j].Comment = []string{fmt.Sprintf("endpoint %d rule %d", i, j)}
+		}
+		chains[i] = &Chain{Name: name, Rules: rules}
+	}
+	return chains
+}
+
+// benchDataplane is a dataplane that discards the input to iptables-restore
+// and returns a fixed output from iptables-save, so that the Table
+// benchmarks measure the Table rather than a simulation of iptables.
+type benchDataplane struct {
+	saveOutput []byte
+}
+
+func (d *benchDataplane) newCmd(name string, arg ...string) CmdIface {
+	return &benchCmd{dataplane: d}
+}
+
+type benchCmd struct {
+	dataplane *benchDataplane
+	stdin     io.Reader
+}
+
+func (c *benchCmd) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+func (c *benchCmd) Output() ([]byte, error) {
+	return c.dataplane.saveOutput, nil
+}
+
+func (c *benchCmd) CombinedOutput() ([]byte, error) {
+	if c.stdin != nil {
+		io.Copy(ioutil.Discard, c.stdin)
+	}
+	return nil, nil
+}
+
+// saveOutputFor renders the chains as iptables-save would print them once
+// they've been programmed, hash comments and all.
+func saveOutputFor(chains []*Chain) []byte {
+	cache := NewRenderCache()
+	var buf bytes.Buffer
+	buf.WriteString("*filter\n")
+	for _, chain := range chains {
+		fmt.Fprintf(&buf, ":%s - [0:0]\n", chain.Name)
+	}
+	for _, chain := range chains {
+		for _, line := range cache.RenderAppends(chain, HashCommentPrefix) {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.Bytes()
+}
+
+func BenchmarkScaleBuildChains(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		scaleChains()
+	}
+}
+
+// BenchmarkScaleRender renders and hashes every rule from scratch, as at
+// start of day.
+func BenchmarkScaleRender(b *testing.B) {
+	b.ReportAllocs()
+	chains := scaleChains()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache := NewRenderCache()
+		for _, chain := range chains {
+			cache.RenderAppends(chain, HashCommentPrefix)
+		}
+	}
+}
+
+// BenchmarkScaleHash calculates the hashes of every rule from scratch.
+func BenchmarkScaleHash(b *testing.B) {
+	b.ReportAllocs()
+	chains := scaleChains()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache := NewRenderCache()
+		for _, chain := range chains {
+			cache.RuleHashes(chain)
+		}
+	}
+}
+
+// BenchmarkScaleHashCached gets the hashes of unchanged chains, as the
+// Table does for every chain marked dirty by a resync.
+func BenchmarkScaleHashCached(b *testing.B) {
+	b.ReportAllocs()
+	chains := scaleChains()
+	cache := NewRenderCache()
+	for _, chain := range chains {
+		cache.RuleHashes(chain)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, chain := range chains {
+			cache.RuleHashes(chain)
+		}
+	}
+}
+
+// BenchmarkScaleRestoreInput generates the iptables-restore input that
+// programs every chain into an empty table.
+func BenchmarkScaleRestoreInput(b *testing.B) {
+	b.ReportAllocs()
+	chains := scaleChains()
+	dataplane := &benchDataplane{saveOutput: []byte("*filter\nCOMMIT\n")}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table := NewTable("filter", 4, TableOptions{NewCmdOverride: dataplane.newCmd})
+		table.UpdateChains(chains)
+		if err := table.Apply(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkScaleDiffInSync resyncs with a dataplane that already has every
+// chain: it parses the iptables-save output and compares the hashes, but
+// writes nothing.
+func BenchmarkScaleDiffInSync(b *testing.B) {
+	b.ReportAllocs()
+	chains := scaleChains()
+	dataplane := &benchDataplane{saveOutput: saveOutputFor(chains)}
+	table := NewTable("filter", 4, TableOptions{NewCmdOverride: dataplane.newCmd})
+	table.UpdateChains(chains)
+	if err := table.Apply(); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.InvalidateDataplaneCache()
+		if err := table.Apply(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkScaleDiffOneChange updates a single chain of a fully-programmed
+// table, which is the common case in steady state.
+func BenchmarkScaleDiffOneChange(b *testing.B) {
+	b.ReportAllocs()
+	chains := scaleChains()
+	dataplane := &benchDataplane{saveOutput: saveOutputFor(chains)}
+	table := NewTable("filter", 4, TableOptions{NewCmdOverride: dataplane.newCmd})
+	table.UpdateChains(chains)
+	if err := table.Apply(); err != nil {
+		b.Fatal(err)
+	}
+	changed := []*Chain{
+		{Name: chains[0].Name, Rules: chains[0].Rules[1:]},
+		chains[0],
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.UpdateChain(changed[i%2])
+		if err := table.Apply(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/cmderrors"
+	"strings"
+)
+
+// LoadDataplaneStates loads the state of the dataplane for each of the given
+// tables that hasn't loaded it yet, using a single iptables-save of all the
+// tables per IP version rather than one per table.  It is intended for
+// start of day: the first Apply of each table then compares the chains that
+// we want with the ones that a previous run left behind, keeps those whose
+// rule hashes (and rules) still match and only writes the difference.  On a
+// host that has already converged, that is nothing at all, so a restart
+// doesn't touch the dataplane or the traffic flowing through it.
+//
+// Tables that were given cached hashes (see
+// TableOptions.CachedDataplaneHashes) are skipped, since they don't need an
+// iptables-save at all.  If the iptables-save fails, the tables are left to
+// load their own state in Apply as usual.
+func LoadDataplaneStates(tables []*Table) error {
+	var firstErr error
+	for _, ipVersion := range []uint8{4, 6} {
+		var toLoad []*Table
+		for _, t := range tables {
+			if t.IPVersion == ipVersion && !t.inSyncWithDataPlane &&
+				t.cachedDataplaneHashes == nil {
+				toLoad = append(toLoad, t)
+			}
+		}
+		if len(toLoad) == 0 {
+			continue
+		}
+		saveCmd := toLoad[0].saveCmd
+		log.WithField("ipVersion", ipVersion).Info("Loading state of all iptables tables")
+		output, err := toLoad[0].newCmd(saveCmd).Output()
+		if err := cmderrors.Record(saveCmd, "", nil, err); err != nil {
+			log.WithError(err).WithField("ipVersion", ipVersion).Warn(
+				"Failed to load iptables state, tables will load their own")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sections := splitSaveOutput(output)
+		for _, t := range toLoad {
+			// The kernel only creates a table when it is first used, so
+			// one that is missing from the output is empty.
+			t.setDataplaneState(parseDataplane(sections[t.Name]))
+		}
+	}
+	return firstErr
+}
+
+// splitSaveOutput splits the output of an iptables-save of several tables
+// into the section for each table, from its "*<table>" line to its COMMIT.
+func splitSaveOutput(output []byte) map[string][]byte {
+	sections := map[string][]byte{}
+	var tableName string
+	var section bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "*") {
+			tableName = line[1:]
+			section.Reset()
+		}
+		if tableName == "" {
+			// Comments and blank lines between the tables.
+			continue
+		}
+		section.WriteString(line)
+		section.WriteByte('\n')
+		if line == "COMMIT" {
+			sections[tableName] = append([]byte{}, section.Bytes()...)
+			tableName = ""
+		}
+	}
+	return sections
+}
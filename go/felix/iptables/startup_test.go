@@ -0,0 +1,176 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	"errors"
+	"io"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// saveAllCmd simulates an iptables-save of all the tables, which prints
+// each table in turn.
+type saveAllCmd struct {
+	dataplanes []*mockDataplane
+	fail       bool
+}
+
+func (c *saveAllCmd) SetStdin(r io.Reader) {}
+
+func (c *saveAllCmd) Output() ([]byte, error) {
+	if c.fail {
+		return nil, errors.New("simulated failure")
+	}
+	output := []byte("# Generated by iptables-save\n")
+	for _, dataplane := range c.dataplanes {
+		output = append(output, dataplane.save()...)
+		output = append(output, "# Completed\n"...)
+	}
+	return output, nil
+}
+
+func (c *saveAllCmd) CombinedOutput() ([]byte, error) {
+	return nil, errors.New("unexpected command")
+}
+
+var _ = Describe("LoadDataplaneStates", func() {
+	var dataplanes map[string]*mockDataplane
+	var numSaveAlls int
+	var failSaveAll bool
+
+	chainFor := func(tableName string) *Chain {
+		return &Chain{
+			Name: "cali-" + tableName,
+			Rules: []Rule{
+				{Match: Match().Protocol("tcp"), Action: AcceptAction{}},
+				{Action: DropAction{}},
+			},
+		}
+	}
+
+	// newTable creates a Table for the named table whose iptables-save
+	// of all the tables sees every table except raw, which the kernel
+	// hasn't created.
+	newTable := func(tableName string, options TableOptions) *Table {
+		dataplane := dataplanes[tableName]
+		options.NewCmdOverride = func(name string, arg ...string) CmdIface {
+			if name == "iptables-save" && len(arg) == 0 {
+				numSaveAlls++
+				dataplane.Cmds = append(dataplane.Cmds, name)
+				return &saveAllCmd{
+					dataplanes: []*mockDataplane{dataplanes["filter"], dataplanes["nat"]},
+					fail:       failSaveAll,
+				}
+			}
+			return dataplane.newCmd(name, arg...)
+		}
+		return NewTable(tableName, 4, options)
+	}
+
+	BeforeEach(func() {
+		numSaveAlls = 0
+		failSaveAll = false
+		dataplanes = map[string]*mockDataplane{
+			"filter": newMockDataplane("filter", map[string][]string{
+				"FORWARD": {"--jump ACCEPT"},
+			}),
+			"nat": newMockDataplane("nat", map[string][]string{}),
+			"raw": newMockDataplane("raw", map[string][]string{}),
+		}
+		// Program the filter and nat tables, as a previous run would
+		// have.
+		for _, tableName := range []string{"filter", "nat"} {
+			table := NewTable(tableName, 4, TableOptions{
+				NewCmdOverride: dataplanes[tableName].newCmd,
+			})
+			table.UpdateChain(chainFor(tableName))
+			Expect(table.Apply()).To(Succeed())
+			dataplanes[tableName].Cmds = nil
+			dataplanes[tableName].RestoreInputs = nil
+		}
+	})
+
+	Describe("after a restart", func() {
+		var tables []*Table
+
+		BeforeEach(func() {
+			tables = nil
+			for _, tableName := range []string{"filter", "nat", "raw"} {
+				table := newTable(tableName, TableOptions{})
+				table.UpdateChain(chainFor(tableName))
+				tables = append(tables, table)
+			}
+		})
+
+		It("should load all the tables with one iptables-save and only write the raw table", func() {
+			Expect(LoadDataplaneStates(tables)).To(Succeed())
+			Expect(ApplyTables(tables, 1, nil)).To(Succeed())
+			Expect(numSaveAlls).To(Equal(1))
+			Expect(dataplanes["filter"].Cmds).To(Equal([]string{"iptables-save"}))
+			Expect(dataplanes["nat"].Cmds).To(BeEmpty())
+			Expect(dataplanes["raw"].Cmds).To(Equal([]string{
+				"iptables-restore --noflush --verbose",
+			}))
+			Expect(dataplanes["raw"].Chains).To(HaveKey("cali-raw"))
+		})
+		It("should only write the chains that changed", func() {
+			tables[1].UpdateChain(&Chain{
+				Name:  "cali-nat",
+				Rules: []Rule{{Action: ReturnAction{}}},
+			})
+			tables[1].UpdateChain(&Chain{Name: "cali-nat-new"})
+			Expect(LoadDataplaneStates(tables)).To(Succeed())
+			Expect(ApplyTables(tables, 1, nil)).To(Succeed())
+			Expect(dataplanes["filter"].RestoreInputs).To(BeEmpty())
+			Expect(dataplanes["nat"].RestoreInputs).To(HaveLen(1))
+			input := dataplanes["nat"].RestoreInputs[0]
+			Expect(input).To(ContainSubstring(":cali-nat - -\n"))
+			Expect(input).To(ContainSubstring(":cali-nat-new - -\n"))
+			Expect(dataplanes["nat"].Chains["cali-nat"]).To(HaveLen(1))
+			Expect(dataplanes["nat"].Chains["cali-nat"][0]).To(HaveSuffix("--jump RETURN"))
+		})
+		It("should remove stale chains that the previous run left behind", func() {
+			dataplanes["filter"].Chains["cali-stale"] = []string{"--jump DROP"}
+			Expect(LoadDataplaneStates(tables)).To(Succeed())
+			Expect(ApplyTables(tables, 1, nil)).To(Succeed())
+			Expect(dataplanes["filter"].Chains).NotTo(HaveKey("cali-stale"))
+			Expect(dataplanes["filter"].Chains).To(HaveKey("cali-filter"))
+		})
+		It("should not load tables that have already loaded their state", func() {
+			Expect(tables[0].Apply()).To(Succeed())
+			dataplanes["filter"].Cmds = nil
+			Expect(LoadDataplaneStates(tables[:1])).To(Succeed())
+			Expect(numSaveAlls).To(Equal(0))
+		})
+		It("should leave the tables to load their own state if the save fails", func() {
+			failSaveAll = true
+			Expect(LoadDataplaneStates(tables)).NotTo(Succeed())
+			Expect(ApplyTables(tables, 1, nil)).To(Succeed())
+			Expect(dataplanes["nat"].Cmds).To(Equal([]string{"iptables-save -t nat"}))
+		})
+	})
+
+	It("should skip tables that have cached hashes", func() {
+		table := newTable("filter", TableOptions{
+			CachedDataplaneHashes: map[string][]string{},
+		})
+		Expect(LoadDataplaneStates([]*Table{table})).To(Succeed())
+		Expect(numSaveAlls).To(Equal(0))
+	})
+})
@@ -0,0 +1,713 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/audit"
+	"github.com/projectcalico/felix/go/felix/cmderrors"
+	"io"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// HashCommentPrefix prefixes the hash that the Table puts in a comment
+	// on each rule that it programs.
+	HashCommentPrefix = "cali:"
+
+	defaultChainNamePrefix = "cali"
+	maxApplyAttempts       = 3
+)
+
+var (
+	chainDefRegexp    = regexp.MustCompile(`^:(\S+)`)
+	appendRegexp      = regexp.MustCompile(`^-A (\S+)`)
+	hashCommentRegexp = regexp.MustCompile(`--comment "?` + HashCommentPrefix + `([a-zA-Z0-9_-]+)"?`)
+
+	// kernelChains are the chains that the kernel creates in its tables.
+	// Their policies belong to the administrator, so the Table never
+	// defines, flushes or deletes them, whatever its chain name prefix; it
+	// only inserts rules into them.
+	kernelChains = map[string]bool{
+		"INPUT":       true,
+		"OUTPUT":      true,
+		"FORWARD":     true,
+		"PREROUTING":  true,
+		"POSTROUTING": true,
+	}
+)
+
+// CmdIface is the subset of exec.Cmd that the Table uses; it allows the
+// iptables commands to be replaced in tests.
+type CmdIface interface {
+	SetStdin(r io.Reader)
+	Output() ([]byte, error)
+	CombinedOutput() ([]byte, error)
+}
+
+type cmdAdapter struct {
+	*exec.Cmd
+}
+
+func (c cmdAdapter) SetStdin(r io.Reader) {
+	c.Stdin = r
+}
+
+func newRealCmd(name string, arg ...string) CmdIface {
+	return cmdAdapter{exec.Command(name, arg...)}
+}
+
+type TableOptions struct {
+	// ChainNamePrefix is the prefix of the chains that the Table owns.  At
+	// start of day, and after a failure, the Table deletes any chains with
+	// the prefix that it hasn't been told about.  Defaults to "cali".
+	ChainNamePrefix string
+	// MaxRestoreInputSize, if non-zero, limits the size, in bytes, of the
+	// input passed to each iptables-restore.  A larger update is split
+	// into several transactions, which avoids a single huge restore
+	// timing out.  A single chain is never split, so one transaction may
+	// still exceed the limit.
+	MaxRestoreInputSize int
+	// AuditLog, if non-nil, receives a record of each change that the
+	// Table makes to a chain.
+	AuditLog *audit.Log
+	// NewCmdOverride, if non-nil, is used in place of exec.Command.
+	NewCmdOverride func(name string, arg ...string) CmdIface
+	// CachedDataplaneHashes, if non-nil, are the rule hashes that a
+	// previous run left in the dataplane, as returned by DataplaneHashes().
+	// The first Apply trusts them in place of loading the state with
+	// iptables-save, so that a restart only has to write the chains that
+	// have changed.  They must only be used if the dataplane can't have
+	// been reset since, for example by a reboot.
+	CachedDataplaneHashes map[string][]string
+}
+
+// Table programs a single iptables table (such as "filter") for one IP
+// version.  Callers queue up changes with UpdateChains, RemoveChains and
+// SetRuleInsertions and then call Apply, which writes the changes to the
+// dataplane in a single iptables-restore transaction (or, for a very large
+// update, several; see TableOptions.MaxRestoreInputSize).
+//
+// The Table tags each rule that it programs with a hash of the rule and the
+// rules before it (see RenderCache).  It loads the hashes back with
+// iptables-save when it starts and after a failure, which allows it to
+// leave alone any chains that are already correct and to remove chains that
+// are no longer wanted.  Between resyncs, it trusts its own record of the
+// dataplane, so only chains that have changed are rendered and written.
+type Table struct {
+	Name      string
+	IPVersion uint8
+
+	chainNamePrefix string
+
+	chainNameToChain map[string]*Chain
+	// chainToInsertedRules holds the rules that we insert at the top of
+	// chains that we don't own, such as the kernel's FORWARD chain.
+	chainToInsertedRules map[string][]Rule
+
+	dirtyChains  map[string]bool
+	dirtyInserts map[string]bool
+
+	// chainToDataplaneHashes holds the hashes of the rules in each chain
+	// in the dataplane, with "" for rules that aren't ours.
+	chainToDataplaneHashes map[string][]string
+	// chainToDataplaneRules holds the rules in each chain, as printed by
+	// iptables-save, with "" for rules that aren't ours.  It is only
+	// populated between loading the dataplane state and the next
+	// successful update, during which the contents of rules whose hashes
+	// match are checked too, in case they have been modified.
+	chainToDataplaneRules map[string][]string
+	inSyncWithDataPlane   bool
+	// cachedDataplaneHashes holds TableOptions.CachedDataplaneHashes until
+	// the first load of the dataplane state uses them.
+	cachedDataplaneHashes map[string][]string
+	// appliedOnce is set once the first update has succeeded.
+	appliedOnce bool
+
+	renderCache *RenderCache
+
+	maxRestoreInputSize int
+
+	auditLog *audit.Log
+
+	saveCmd    string
+	restoreCmd string
+	listCmd    string
+	newCmd     func(name string, arg ...string) CmdIface
+}
+
+func NewTable(name string, ipVersion uint8, options TableOptions) *Table {
+	t := &Table{
+		Name:                   name,
+		IPVersion:              ipVersion,
+		chainNamePrefix:        options.ChainNamePrefix,
+		maxRestoreInputSize:    options.MaxRestoreInputSize,
+		auditLog:               options.AuditLog,
+		chainNameToChain:       map[string]*Chain{},
+		chainToInsertedRules:   map[string][]Rule{},
+		dirtyChains:            map[string]bool{},
+		dirtyInserts:           map[string]bool{},
+		chainToDataplaneHashes: map[string][]string{},
+		renderCache:            NewRenderCache(),
+		saveCmd:                "iptables-save",
+		restoreCmd:             "iptables-restore",
+		listCmd:                "iptables",
+		newCmd:                 options.NewCmdOverride,
+		cachedDataplaneHashes:  options.CachedDataplaneHashes,
+	}
+	if t.chainNamePrefix == "" {
+		t.chainNamePrefix = defaultChainNamePrefix
+	}
+	if ipVersion == 6 {
+		t.saveCmd = "ip6tables-save"
+		t.restoreCmd = "ip6tables-restore"
+		t.listCmd = "ip6tables"
+	}
+	if t.newCmd == nil {
+		t.newCmd = newRealCmd
+	}
+	return t
+}
+
+// UpdateChains queues an update to the given chains, creating them if
+// necessary.  The Table keeps a reference to each Chain, so it must not be
+// modified after it has been passed in; pass a new Chain instead.
+func (t *Table) UpdateChains(chains []*Chain) {
+	for _, chain := range chains {
+		t.UpdateChain(chain)
+	}
+}
+
+func (t *Table) UpdateChain(chain *Chain) {
+	if err := t.checkOwnedChainName(chain.Name); err != nil {
+		log.WithError(err).Error("Ignoring update of chain that we don't own")
+		return
+	}
+	log.WithField("chainName", chain.Name).Debug("Queueing update of chain.")
+	t.chainNameToChain[chain.Name] = chain
+	t.dirtyChains[chain.Name] = true
+}
+
+func (t *Table) RemoveChains(chains []*Chain) {
+	for _, chain := range chains {
+		t.RemoveChainByName(chain.Name)
+	}
+}
+
+func (t *Table) RemoveChainByName(name string) {
+	if err := t.checkOwnedChainName(name); err != nil {
+		log.WithError(err).Error("Ignoring deletion of chain that we don't own")
+		return
+	}
+	log.WithField("chainName", name).Debug("Queueing deletion of chain.")
+	delete(t.chainNameToChain, name)
+	t.renderCache.Forget(name)
+	t.dirtyChains[name] = true
+}
+
+// SetRuleInsertions sets the rules that the Table inserts at the top of a
+// chain that it doesn't own.  Passing no rules removes any that were
+// inserted before.
+func (t *Table) SetRuleInsertions(chainName string, rules []Rule) {
+	log.WithField("chainName", chainName).Debug("Queueing change to rule insertions.")
+	t.chainToInsertedRules[chainName] = rules
+	t.dirtyInserts[chainName] = true
+}
+
+// InvalidateDataplaneCache forces the next Apply to reload the state of
+// the dataplane, repairing anything that has been changed behind our back.
+func (t *Table) InvalidateDataplaneCache() {
+	t.inSyncWithDataPlane = false
+}
+
+// Apply writes any pending changes to the dataplane.  It retries a few times
+// before giving up, reloading the dataplane state each time.
+func (t *Table) Apply() (err error) {
+	for attempt := 1; attempt <= maxApplyAttempts; attempt++ {
+		if !t.inSyncWithDataPlane {
+			if err = t.loadDataplaneState(); err != nil {
+				log.WithError(err).WithField("table", t.Name).Warn(
+					"Failed to load iptables state")
+				continue
+			}
+		}
+		if err = t.applyUpdates(); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"table":   t.Name,
+				"attempt": attempt,
+			}).Warn("Failed to update iptables, will resync")
+			t.inSyncWithDataPlane = false
+			continue
+		}
+		return nil
+	}
+	return err
+}
+
+// loadDataplaneState reads the hashes of the rules in the dataplane and
+// marks any chains that don't match our state as dirty.  The first time
+// round, it uses the cached hashes instead, if there are any.
+func (t *Table) loadDataplaneState() error {
+	var hashes, rules map[string][]string
+	if t.cachedDataplaneHashes != nil {
+		log.WithField("table", t.Name).Info("Using cached iptables state")
+		hashes = t.cachedDataplaneHashes
+		t.cachedDataplaneHashes = nil
+	} else {
+		log.WithField("table", t.Name).Info("Loading iptables state")
+		cmd := t.newCmd(t.saveCmd, "-t", t.Name)
+		output, err := cmd.Output()
+		if err := cmderrors.Record(t.saveCmd, t.Name, nil, err); err != nil {
+			return err
+		}
+		hashes, rules = parseDataplane(output)
+	}
+	t.setDataplaneState(hashes, rules)
+	return nil
+}
+
+// setDataplaneState records the hashes and rules loaded from the dataplane
+// and marks any chains that don't match our state as dirty.
+func (t *Table) setDataplaneState(hashes, rules map[string][]string) {
+	for chainName := range t.chainNameToChain {
+		t.dirtyChains[chainName] = true
+	}
+	for chainName, chainHashes := range hashes {
+		if t.ownsChain(chainName) {
+			if t.chainNameToChain[chainName] == nil {
+				log.WithField("chainName", chainName).Info(
+					"Found unexpected chain, will delete it")
+				t.dirtyChains[chainName] = true
+			}
+			continue
+		}
+		for _, hash := range chainHashes {
+			if hash != "" {
+				// There are rules from us in a chain that we don't
+				// own; make sure they're still the right ones.
+				t.dirtyInserts[chainName] = true
+				break
+			}
+		}
+	}
+	for chainName := range t.chainToInsertedRules {
+		t.dirtyInserts[chainName] = true
+	}
+	t.chainToDataplaneHashes = hashes
+	t.chainToDataplaneRules = rules
+	t.inSyncWithDataPlane = true
+}
+
+// DataplaneHashes returns a copy of the Table's record of the hashes of the
+// rules in the dataplane, for caching across restarts.  The record is only
+// complete once Apply has succeeded.
+func (t *Table) DataplaneHashes() map[string][]string {
+	hashes := map[string][]string{}
+	for chainName, chainHashes := range t.chainToDataplaneHashes {
+		hashes[chainName] = append([]string{}, chainHashes...)
+	}
+	return hashes
+}
+
+func (t *Table) ownsChain(chainName string) bool {
+	return strings.HasPrefix(chainName, t.chainNamePrefix) && !kernelChains[chainName]
+}
+
+// checkOwnedChainName returns an error if the Table may not define, flush or
+// delete the named chain, because it is one of the kernel's chains or it
+// doesn't have our prefix.  Writing such a chain would replace the
+// administrator's rules, or reset the chain's policy, so a caller asking for
+// one has a bug.
+func (t *Table) checkOwnedChainName(chainName string) error {
+	if kernelChains[chainName] {
+		return fmt.Errorf("chain %q is a kernel chain", chainName)
+	}
+	if !strings.HasPrefix(chainName, t.chainNamePrefix) {
+		return fmt.Errorf("chain %q doesn't have our prefix %q",
+			chainName, t.chainNamePrefix)
+	}
+	return nil
+}
+
+// parseDataplane extracts the rule hashes from the output of iptables-save,
+// along with the rules that have hashes.  Every chain in the output gets an
+// entry, even if it is empty.
+func parseDataplane(output []byte) (hashes, rules map[string][]string) {
+	hashes = map[string][]string{}
+	rules = map[string][]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := chainDefRegexp.FindStringSubmatch(line); m != nil {
+			if hashes[m[1]] == nil {
+				hashes[m[1]] = []string{}
+			}
+		} else if m := appendRegexp.FindStringSubmatch(line); m != nil {
+			hash, rule := "", ""
+			if h := hashCommentRegexp.FindStringSubmatch(line); h != nil {
+				hash, rule = h[1], line
+			}
+			hashes[m[1]] = append(hashes[m[1]], hash)
+			rules[m[1]] = append(rules[m[1]], rule)
+		}
+	}
+	return
+}
+
+// dataplaneRulesMatch checks that the rules at the start of the named chain
+// in the dataplane are equivalent to the given rendered rules.  It is only
+// called once the hashes are known to match, so it only fails if someone
+// has modified our rules in place.  It returns true if the dataplane rules
+// haven't been loaded since the last update.
+func (t *Table) dataplaneRulesMatch(chainName string, rendered []string) bool {
+	if t.chainToDataplaneRules == nil {
+		return true
+	}
+	dataplaneRules := t.chainToDataplaneRules[chainName]
+	if len(dataplaneRules) < len(rendered) {
+		return false
+	}
+	for i, line := range rendered {
+		if !rulesEquivalent(line, dataplaneRules[i]) {
+			log.WithFields(log.Fields{
+				"chainName": chainName,
+				"expected":  line,
+				"actual":    dataplaneRules[i],
+			}).Warn("Rule has been modified in the dataplane, will rewrite it")
+			return false
+		}
+	}
+	return true
+}
+
+// rulesEquivalent returns true if the two rules, which may be in our format
+// or iptables-save's, have the same effect.
+func rulesEquivalent(a, b string) bool {
+	parsedA, err := ParseRule(a)
+	if err != nil {
+		return false
+	}
+	parsedB, err := ParseRule(b)
+	if err != nil {
+		return false
+	}
+	return parsedA.Hash == parsedB.Hash &&
+		stringSlicesEqual(parsedA.Comment, parsedB.Comment) &&
+		stringSlicesEqual(CanonicalArgs(parsedA.Args), CanonicalArgs(parsedB.Args))
+}
+
+// restoreUnit is a piece of iptables-restore input that must go into a
+// single transaction, along with the dataplane hashes that it results in.
+type restoreUnit struct {
+	lines     bytes.Buffer
+	newHashes map[string][]string
+}
+
+// applyUpdates writes the dirty chains and insertions to the dataplane.
+// Chains whose cached hashes match the dataplane are skipped.
+func (t *Table) applyUpdates() error {
+	var units []*restoreUnit
+	var deletedChains []string
+
+	// Work out which chains need to be rewritten and which deleted.
+	var chainsToWrite []*Chain
+	numReused := 0
+	for _, chainName := range sortedKeys(t.dirtyChains) {
+		if err := t.checkOwnedChainName(chainName); err != nil {
+			// UpdateChain and RemoveChainByName already refuse these,
+			// but the input we write replaces the chain wholesale, so
+			// check again rather than risk resetting a kernel chain's
+			// policy.
+			log.WithError(err).Error("Refusing to write chain")
+			continue
+		}
+		chain := t.chainNameToChain[chainName]
+		dataplaneHashes, inDataplane := t.chainToDataplaneHashes[chainName]
+		if chain == nil {
+			if inDataplane {
+				deletedChains = append(deletedChains, chainName)
+			}
+			continue
+		}
+		hashes := t.renderCache.RuleHashes(chain)
+		if inDataplane && stringSlicesEqual(hashes, dataplaneHashes) &&
+			t.dataplaneRulesMatch(chainName, t.renderCache.RenderAppends(chain, HashCommentPrefix)) {
+			numReused++
+			continue
+		}
+		chainsToWrite = append(chainsToWrite, chain)
+	}
+
+	// Write each chain after the chains that it jumps to so that, if the
+	// input is split into several transactions, the targets of the jumps
+	// always exist.
+	for _, chain := range orderByReferences(chainsToWrite) {
+		// The render cache updates its hashes in place, so take a copy
+		// for our record of the dataplane.
+		unit := &restoreUnit{newHashes: map[string][]string{
+			chain.Name: append([]string{}, t.renderCache.RuleHashes(chain)...),
+		}}
+		fmt.Fprintf(&unit.lines, ":%s - -\n", chain.Name)
+		for _, line := range t.renderCache.RenderAppends(chain, HashCommentPrefix) {
+			unit.lines.WriteString(line)
+			unit.lines.WriteByte('\n')
+		}
+		units = append(units, unit)
+	}
+
+	// Insertions come next since they jump to our chains.
+	for _, chainName := range sortedKeys(t.dirtyInserts) {
+		if unit := t.insertionsUnit(chainName); unit != nil {
+			units = append(units, unit)
+		}
+	}
+
+	// Finally, delete the chains that are no longer wanted, which are no
+	// longer referenced by the chains that we rewrote above.  Flushing them
+	// all first drops any references between them.
+	if len(deletedChains) > 0 {
+		flushes := &restoreUnit{newHashes: map[string][]string{}}
+		for _, chainName := range deletedChains {
+			fmt.Fprintf(&flushes.lines, ":%s - -\n", chainName)
+			flushes.newHashes[chainName] = []string{}
+		}
+		units = append(units, flushes)
+		for _, chainName := range deletedChains {
+			unit := &restoreUnit{newHashes: map[string][]string{chainName: nil}}
+			fmt.Fprintf(&unit.lines, "-X %s\n", chainName)
+			units = append(units, unit)
+		}
+	}
+
+	// Pack the units into as few transactions as the size limit allows.
+	var batch []*restoreUnit
+	batchSize := 0
+	for _, unit := range units {
+		if len(batch) > 0 && t.maxRestoreInputSize > 0 &&
+			batchSize+unit.lines.Len() > t.maxRestoreInputSize {
+			if err := t.restore(batch); err != nil {
+				return err
+			}
+			batch = nil
+			batchSize = 0
+		}
+		batch = append(batch, unit)
+		batchSize += unit.lines.Len()
+	}
+	if len(batch) > 0 {
+		if err := t.restore(batch); err != nil {
+			return err
+		}
+	}
+
+	t.dirtyChains = map[string]bool{}
+	t.dirtyInserts = map[string]bool{}
+	t.chainToDataplaneRules = nil
+	if !t.appliedOnce {
+		// On a restart, this shows how much of the previous run's state
+		// was reused.
+		log.WithFields(log.Fields{
+			"table":     t.Name,
+			"ipVersion": t.IPVersion,
+			"reused":    numReused,
+			"written":   len(chainsToWrite),
+			"deleted":   len(deletedChains),
+		}).Info("Completed first update of iptables table")
+		t.appliedOnce = true
+	}
+	return nil
+}
+
+// insertionsUnit returns the input that replaces our rules at the top of the
+// given chain, or nil if they're already correct.
+func (t *Table) insertionsUnit(chainName string) *restoreUnit {
+	inserts := t.chainToInsertedRules[chainName]
+	insertChain := &Chain{Name: chainName, Rules: inserts}
+	wantedHashes := t.renderCache.RuleHashes(insertChain)
+	dataplaneHashes := t.chainToDataplaneHashes[chainName]
+	var ourPositions []int
+	var otherHashes []string
+	for i, hash := range dataplaneHashes {
+		if hash != "" {
+			ourPositions = append(ourPositions, i+1)
+		} else {
+			otherHashes = append(otherHashes, hash)
+		}
+	}
+	if len(ourPositions) == len(wantedHashes) &&
+		stringSlicesEqual(wantedHashes, dataplaneHashes[:len(wantedHashes)]) &&
+		t.dataplaneRulesMatch(chainName, t.renderCache.RenderAppends(insertChain, HashCommentPrefix)) {
+		return nil
+	}
+	unit := &restoreUnit{newHashes: map[string][]string{
+		chainName: append(append([]string{}, wantedHashes...), otherHashes...),
+	}}
+	// Remove our old rules, from the bottom up so that the rule numbers
+	// stay valid, then insert the new ones.  Each insert goes at the top,
+	// so we write them in reverse order.
+	for i := len(ourPositions) - 1; i >= 0; i-- {
+		fmt.Fprintf(&unit.lines, "-D %s %d\n", chainName, ourPositions[i])
+	}
+	lines := t.renderCache.RenderAppends(insertChain, HashCommentPrefix)
+	for i := len(lines) - 1; i >= 0; i-- {
+		unit.lines.WriteString("-I")
+		unit.lines.WriteString(strings.TrimPrefix(lines[i], "-A"))
+		unit.lines.WriteByte('\n')
+	}
+	return unit
+}
+
+// restore runs iptables-restore to apply the given units in one transaction
+// and, if it succeeds, records their effect on the dataplane.
+func (t *Table) restore(units []*restoreUnit) error {
+	var input bytes.Buffer
+	fmt.Fprintf(&input, "*%s\n", t.Name)
+	for _, unit := range units {
+		input.Write(unit.lines.Bytes())
+	}
+	input.WriteString("COMMIT\n")
+	if log.GetLevel() >= log.DebugLevel {
+		log.WithField("input", input.String()).Debug("Writing to iptables-restore")
+	}
+	cmd := t.newCmd(t.restoreCmd, "--noflush", "--verbose")
+	cmd.SetStdin(&input)
+	output, err := cmd.CombinedOutput()
+	if err := cmderrors.Record(t.restoreCmd, t.Name, output, err); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"output": string(output),
+			"class":  cmderrors.ClassOf(err),
+		}).Warn("iptables-restore failed")
+		return err
+	}
+	if t.auditLog != nil {
+		t.auditLog.Record(t.auditRecords(units)...)
+	}
+	for _, unit := range units {
+		for chainName, hashes := range unit.newHashes {
+			if hashes == nil {
+				delete(t.chainToDataplaneHashes, chainName)
+			} else {
+				t.chainToDataplaneHashes[chainName] = hashes
+			}
+		}
+	}
+	return nil
+}
+
+// auditRecords returns a record of the change that each of the units made to
+// its chain.  The content of a chain is represented by its rule hashes.  A
+// deleted chain is flushed and deleted in separate units, so the units are
+// applied to a copy of the state as we go.
+func (t *Table) auditRecords(units []*restoreUnit) []*audit.Record {
+	var records []*audit.Record
+	appliedHashes := map[string][]string{}
+	for _, unit := range units {
+		for _, chainName := range sortedHashKeys(unit.newHashes) {
+			// In the copy, as in newHashes, nil means deleted.
+			before, applied := appliedHashes[chainName]
+			if !applied {
+				var exists bool
+				before, exists = t.chainToDataplaneHashes[chainName]
+				if exists && before == nil {
+					before = []string{}
+				}
+			}
+			after := unit.newHashes[chainName]
+			appliedHashes[chainName] = after
+			rec := audit.NewRecord(audit.KindChain, chainName, before, after)
+			rec.Table = t.Name
+			rec.IPVersion = t.IPVersion
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// orderByReferences sorts the chains so that each chain comes after any of
+// the other chains that it jumps to.  iptables doesn't allow loops, so the
+// order always exists for valid input.
+func orderByReferences(chains []*Chain) []*Chain {
+	byName := map[string]*Chain{}
+	for _, chain := range chains {
+		byName[chain.Name] = chain
+	}
+	ordered := make([]*Chain, 0, len(chains))
+	visited := map[string]bool{}
+	var visit func(chain *Chain)
+	visit = func(chain *Chain) {
+		if visited[chain.Name] {
+			return
+		}
+		visited[chain.Name] = true
+		for _, rule := range chain.Rules {
+			if target := byName[referencedChain(rule.Action)]; target != nil {
+				visit(target)
+			}
+		}
+		ordered = append(ordered, chain)
+	}
+	for _, chain := range chains {
+		visit(chain)
+	}
+	return ordered
+}
+
+// referencedChain returns the name of the chain that the action jumps to, or
+// "" if it doesn't jump to a chain.
+func referencedChain(action Action) string {
+	switch a := action.(type) {
+	case JumpAction:
+		return a.Target
+	case GotoAction:
+		return a.Target
+	}
+	return ""
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedHashKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,517 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/audit"
+	"strings"
+)
+
+var _ = Describe("Table", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	fooChain := &Chain{
+		Name: "cali-foo",
+		Rules: []Rule{
+			{Match: Match().Protocol("tcp"), Action: AcceptAction{}},
+			{Action: DropAction{}},
+		},
+	}
+	barChain := &Chain{
+		Name:  "cali-bar",
+		Rules: []Rule{{Action: JumpAction{Target: "cali-foo"}}},
+	}
+
+	// stripHashes removes the hash comments from the rules in a chain.
+	stripHashes := func(rules []string) []string {
+		stripped := []string{}
+		for _, rule := range rules {
+			if strings.HasPrefix(rule, "-m comment --comment \"cali:") {
+				rule = rule[strings.Index(rule, "\" ")+2:]
+			}
+			stripped = append(stripped, rule)
+		}
+		return stripped
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD":    {"--jump ACCEPT"},
+			"cali-stale": {"--jump DROP"},
+		})
+		table = NewTable("filter", 4, TableOptions{
+			NewCmdOverride: dataplane.newCmd,
+		})
+	})
+
+	It("should use the right commands for IPv6", func() {
+		table = NewTable("filter", 6, TableOptions{
+			NewCmdOverride: dataplane.newCmd,
+		})
+		Expect(table.Apply()).To(Succeed())
+		Expect(dataplane.Cmds).To(Equal([]string{
+			"ip6tables-save -t filter",
+			"ip6tables-restore --noflush --verbose",
+		}))
+	})
+
+	It("should delete unknown chains with our prefix at start of day", func() {
+		Expect(table.Apply()).To(Succeed())
+		Expect(dataplane.Chains).To(Equal(map[string][]string{
+			"FORWARD": {"--jump ACCEPT"},
+		}))
+	})
+
+	Describe("after programming some chains", func() {
+		BeforeEach(func() {
+			table.UpdateChains([]*Chain{fooChain, barChain})
+			table.SetRuleInsertions("FORWARD", []Rule{
+				{Action: JumpAction{Target: "cali-bar"}},
+			})
+			Expect(table.Apply()).To(Succeed())
+		})
+
+		It("should program the chains and insertions", func() {
+			Expect(stripHashes(dataplane.Chains["cali-foo"])).To(Equal([]string{
+				"-p tcp --jump ACCEPT",
+				"--jump DROP",
+			}))
+			Expect(stripHashes(dataplane.Chains["cali-bar"])).To(Equal([]string{
+				"--jump cali-foo",
+			}))
+			Expect(stripHashes(dataplane.Chains["FORWARD"])).To(Equal([]string{
+				"--jump cali-bar",
+				"--jump ACCEPT",
+			}))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-stale"))
+		})
+		It("should do nothing if nothing has changed", func() {
+			numCmds := len(dataplane.Cmds)
+			table.UpdateChain(fooChain)
+			Expect(table.Apply()).To(Succeed())
+			Expect(dataplane.Cmds).To(HaveLen(numCmds))
+		})
+		It("should only rewrite the chains that changed", func() {
+			table.UpdateChain(&Chain{
+				Name:  "cali-foo",
+				Rules: []Rule{{Action: ReturnAction{}}},
+			})
+			table.UpdateChain(barChain)
+			Expect(table.Apply()).To(Succeed())
+			input := dataplane.RestoreInputs[len(dataplane.RestoreInputs)-1]
+			Expect(input).To(ContainSubstring(":cali-foo - -"))
+			Expect(input).NotTo(ContainSubstring("cali-bar"))
+			Expect(stripHashes(dataplane.Chains["cali-foo"])).To(Equal([]string{
+				"--jump RETURN",
+			}))
+		})
+		It("should rewrite a chain whose rules changed without changing its length", func() {
+			table.UpdateChain(&Chain{
+				Name: "cali-foo",
+				Rules: []Rule{
+					{Match: Match().Protocol("udp"), Action: AcceptAction{}},
+					{Action: DropAction{}},
+				},
+			})
+			Expect(table.Apply()).To(Succeed())
+			Expect(stripHashes(dataplane.Chains["cali-foo"])).To(Equal([]string{
+				"-p udp --jump ACCEPT",
+				"--jump DROP",
+			}))
+		})
+		It("should replace the insertions", func() {
+			table.SetRuleInsertions("FORWARD", []Rule{
+				{Action: JumpAction{Target: "cali-foo"}},
+				{Action: JumpAction{Target: "cali-bar"}},
+			})
+			Expect(table.Apply()).To(Succeed())
+			Expect(stripHashes(dataplane.Chains["FORWARD"])).To(Equal([]string{
+				"--jump cali-foo",
+				"--jump cali-bar",
+				"--jump ACCEPT",
+			}))
+			table.SetRuleInsertions("FORWARD", nil)
+			Expect(table.Apply()).To(Succeed())
+			Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{"--jump ACCEPT"}))
+		})
+		It("should remove chains", func() {
+			table.RemoveChainByName("cali-bar")
+			table.SetRuleInsertions("FORWARD", nil)
+			Expect(table.Apply()).To(Succeed())
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-bar"))
+			Expect(dataplane.Chains).To(HaveKey("cali-foo"))
+		})
+		It("should repair changes to the dataplane after a resync", func() {
+			dataplane.Chains["cali-foo"] = []string{"--jump ACCEPT"}
+			dataplane.Chains["FORWARD"] = []string{"--jump ACCEPT"}
+			table.InvalidateDataplaneCache()
+			Expect(table.Apply()).To(Succeed())
+			Expect(stripHashes(dataplane.Chains["cali-foo"])).To(Equal([]string{
+				"-p tcp --jump ACCEPT",
+				"--jump DROP",
+			}))
+			Expect(stripHashes(dataplane.Chains["FORWARD"])).To(Equal([]string{
+				"--jump cali-bar",
+				"--jump ACCEPT",
+			}))
+			Expect(dataplane.RestoreInputs[len(dataplane.RestoreInputs)-1]).NotTo(
+				ContainSubstring("cali-bar -"))
+		})
+		It("should split a large update into several transactions", func() {
+			table = NewTable("filter", 4, TableOptions{
+				MaxRestoreInputSize: 1,
+				NewCmdOverride:      dataplane.newCmd,
+			})
+			// Chains that jump to each other, in the wrong order by
+			// name.
+			table.UpdateChains([]*Chain{
+				{Name: "cali-a", Rules: []Rule{{Action: JumpAction{Target: "cali-b"}}}},
+				{Name: "cali-b", Rules: []Rule{{Action: GotoAction{Target: "cali-c"}}}},
+				{Name: "cali-c", Rules: []Rule{{Action: DropAction{}}}},
+			})
+			table.SetRuleInsertions("FORWARD", []Rule{
+				{Action: JumpAction{Target: "cali-a"}},
+			})
+			numRestores := len(dataplane.RestoreInputs)
+			Expect(table.Apply()).To(Succeed())
+			inputs := dataplane.RestoreInputs[numRestores:]
+			// One per chain, one for the insertion and, since the
+			// Table doesn't know about them, two to remove the old
+			// chains and one to flush them first.
+			Expect(inputs).To(HaveLen(3 + 1 + 3))
+			Expect(inputs[0]).To(ContainSubstring(":cali-c - -"))
+			Expect(inputs[1]).To(ContainSubstring(":cali-b - -"))
+			Expect(inputs[2]).To(ContainSubstring(":cali-a - -"))
+			Expect(inputs[3]).To(ContainSubstring("-I FORWARD"))
+			Expect(inputs[4]).To(ContainSubstring(":cali-bar - -\n:cali-foo - -\n"))
+			for _, input := range inputs {
+				Expect(input).To(HavePrefix("*filter\n"))
+				Expect(input).To(HaveSuffix("COMMIT\n"))
+			}
+			Expect(dataplane.Chains).To(HaveLen(4))
+			Expect(stripHashes(dataplane.Chains["FORWARD"])).To(Equal([]string{
+				"--jump cali-a",
+				"--jump ACCEPT",
+			}))
+		})
+		It("should reject deleting a chain that is still referenced", func() {
+			// Sanity check of the mock dataplane, which the ordering
+			// tests rely on.
+			table.RemoveChainByName("cali-bar")
+			Expect(table.Apply()).To(HaveOccurred())
+		})
+		Describe("with the rules rewritten in iptables-save's format", func() {
+			var hashes []string
+
+			BeforeEach(func() {
+				hashes = nil
+				for _, rule := range dataplane.Chains["cali-foo"] {
+					parsed, err := ParseRule("-A cali-foo " + rule)
+					Expect(err).NotTo(HaveOccurred())
+					hashes = append(hashes, parsed.Hash)
+				}
+				dataplane.Chains["cali-foo"] = []string{
+					"-m comment --comment cali:" + hashes[0] + " -p tcp -j ACCEPT",
+					"-m comment --comment cali:" + hashes[1] + " -j DROP",
+				}
+			})
+
+			It("should not rewrite them after a resync", func() {
+				numRestores := len(dataplane.RestoreInputs)
+				table.InvalidateDataplaneCache()
+				Expect(table.Apply()).To(Succeed())
+				Expect(dataplane.RestoreInputs).To(HaveLen(numRestores))
+			})
+			It("should rewrite a rule that has been modified in place", func() {
+				dataplane.Chains["cali-foo"][0] = "-m comment --comment cali:" + hashes[0] +
+					" -p udp -j ACCEPT"
+				table.InvalidateDataplaneCache()
+				Expect(table.Apply()).To(Succeed())
+				Expect(stripHashes(dataplane.Chains["cali-foo"])).To(Equal([]string{
+					"-p tcp --jump ACCEPT",
+					"--jump DROP",
+				}))
+			})
+		})
+		Describe("with a rule that has several comments", func() {
+			var hash string
+
+			BeforeEach(func() {
+				table.UpdateChain(&Chain{
+					Name: "cali-foo",
+					Rules: []Rule{{
+						Match:   Match().Protocol("tcp"),
+						Action:  AcceptAction{},
+						Comment: []string{"policy default/allow-web", "allow tcp"},
+					}},
+				})
+				Expect(table.Apply()).To(Succeed())
+				parsed, err := ParseRule("-A cali-foo " + dataplane.Chains["cali-foo"][0])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(parsed.Comment).To(Equal([]string{"policy default/allow-web", "allow tcp"}))
+				hash = parsed.Hash
+			})
+
+			It("should not rewrite it after a resync", func() {
+				dataplane.Chains["cali-foo"] = []string{
+					"-m comment --comment cali:" + hash +
+						` -m comment --comment "policy default/allow-web"` +
+						` -m comment --comment "allow tcp" -p tcp -j ACCEPT`,
+				}
+				numRestores := len(dataplane.RestoreInputs)
+				table.InvalidateDataplaneCache()
+				Expect(table.Apply()).To(Succeed())
+				Expect(dataplane.RestoreInputs).To(HaveLen(numRestores))
+			})
+			It("should rewrite it if its comments have been changed", func() {
+				dataplane.Chains["cali-foo"] = []string{
+					"-m comment --comment cali:" + hash +
+						` -m comment --comment "allow tcp" -p tcp -j ACCEPT`,
+				}
+				numRestores := len(dataplane.RestoreInputs)
+				table.InvalidateDataplaneCache()
+				Expect(table.Apply()).To(Succeed())
+				Expect(dataplane.RestoreInputs).To(HaveLen(numRestores + 1))
+			})
+		})
+		It("should resync and retry after a failure", func() {
+			dataplane.FailNextRestore = true
+			table.UpdateChain(&Chain{
+				Name:  "cali-foo",
+				Rules: []Rule{{Action: ReturnAction{}}},
+			})
+			Expect(table.Apply()).To(Succeed())
+			Expect(dataplane.Cmds[len(dataplane.Cmds)-2]).To(Equal("iptables-save -t filter"))
+			Expect(stripHashes(dataplane.Chains["cali-foo"])).To(Equal([]string{
+				"--jump RETURN",
+			}))
+		})
+		It("should return a copy of its dataplane hashes", func() {
+			hashes := table.DataplaneHashes()
+			Expect(hashes).To(HaveKey("cali-foo"))
+			Expect(hashes["cali-foo"]).To(HaveLen(2))
+			hashes["cali-foo"][0] = "modified"
+			Expect(table.DataplaneHashes()["cali-foo"][0]).NotTo(Equal("modified"))
+		})
+
+		Describe("after a restart with the cached hashes", func() {
+			var numCmds int
+
+			BeforeEach(func() {
+				hashes := table.DataplaneHashes()
+				numCmds = len(dataplane.Cmds)
+				table = NewTable("filter", 4, TableOptions{
+					NewCmdOverride:        dataplane.newCmd,
+					CachedDataplaneHashes: hashes,
+				})
+				table.UpdateChains([]*Chain{fooChain, barChain})
+				table.SetRuleInsertions("FORWARD", []Rule{
+					{Action: JumpAction{Target: "cali-bar"}},
+				})
+			})
+
+			It("should skip iptables-save and rewrite nothing", func() {
+				Expect(table.Apply()).To(Succeed())
+				Expect(dataplane.Cmds).To(HaveLen(numCmds))
+			})
+			It("should only write the chains that changed", func() {
+				table.UpdateChain(&Chain{
+					Name:  "cali-foo",
+					Rules: []Rule{{Action: ReturnAction{}}},
+				})
+				Expect(table.Apply()).To(Succeed())
+				Expect(dataplane.Cmds[numCmds:]).To(Equal([]string{
+					"iptables-restore --noflush --verbose",
+				}))
+				input := dataplane.RestoreInputs[len(dataplane.RestoreInputs)-1]
+				Expect(input).To(ContainSubstring(":cali-foo - -"))
+				Expect(input).NotTo(ContainSubstring("cali-bar"))
+			})
+			It("should load the state from the dataplane after a resync", func() {
+				Expect(table.Apply()).To(Succeed())
+				table.InvalidateDataplaneCache()
+				Expect(table.Apply()).To(Succeed())
+				Expect(dataplane.Cmds[numCmds:]).To(Equal([]string{
+					"iptables-save -t filter",
+				}))
+			})
+		})
+	})
+
+	Describe("protection of chains that we don't own", func() {
+		kernelChains := []string{"INPUT", "OUTPUT", "FORWARD", "PREROUTING", "POSTROUTING"}
+
+		// expectNoKernelChainDefs checks that none of the input written
+		// so far defines (and so flushes and resets the policy of), or
+		// deletes, a kernel chain.
+		expectNoKernelChainDefs := func() {
+			for _, input := range dataplane.RestoreInputs {
+				for _, line := range strings.Split(input, "\n") {
+					for _, chainName := range kernelChains {
+						Expect(line).NotTo(HavePrefix(":"+chainName+" "), input)
+						Expect(line).NotTo(Equal("-X "+chainName), input)
+					}
+				}
+			}
+		}
+
+		BeforeEach(func() {
+			for _, chainName := range kernelChains {
+				if dataplane.Chains[chainName] == nil {
+					dataplane.Chains[chainName] = []string{"--jump ACCEPT"}
+				}
+			}
+		})
+
+		It("should ignore updates and deletions of kernel chains", func() {
+			for _, chainName := range kernelChains {
+				table.UpdateChain(&Chain{
+					Name:  chainName,
+					Rules: []Rule{{Action: DropAction{}}},
+				})
+				table.RemoveChainByName(chainName)
+				table.UpdateChain(&Chain{Name: chainName})
+			}
+			Expect(table.Apply()).To(Succeed())
+			expectNoKernelChainDefs()
+			for _, chainName := range kernelChains {
+				Expect(dataplane.Chains[chainName]).To(Equal([]string{"--jump ACCEPT"}))
+			}
+		})
+		It("should ignore updates and deletions of chains without our prefix", func() {
+			dataplane.Chains["admin-chain"] = []string{"--jump DROP"}
+			table.UpdateChain(&Chain{Name: "admin-chain"})
+			table.UpdateChain(&Chain{Name: "other", Rules: []Rule{{Action: DropAction{}}}})
+			Expect(table.Apply()).To(Succeed())
+			table.RemoveChainByName("admin-chain")
+			Expect(table.Apply()).To(Succeed())
+			Expect(dataplane.Chains["admin-chain"]).To(Equal([]string{"--jump DROP"}))
+			Expect(dataplane.Chains).NotTo(HaveKey("other"))
+			for _, input := range dataplane.RestoreInputs {
+				Expect(input).NotTo(ContainSubstring("admin-chain"))
+				Expect(input).NotTo(ContainSubstring(":other"))
+			}
+		})
+		It("should still insert rules into kernel chains", func() {
+			table.UpdateChain(fooChain)
+			for _, chainName := range kernelChains {
+				table.SetRuleInsertions(chainName, []Rule{
+					{Action: JumpAction{Target: "cali-foo"}},
+				})
+			}
+			Expect(table.Apply()).To(Succeed())
+			expectNoKernelChainDefs()
+			for _, chainName := range kernelChains {
+				Expect(stripHashes(dataplane.Chains[chainName])).To(Equal([]string{
+					"--jump cali-foo",
+					"--jump ACCEPT",
+				}))
+			}
+		})
+		It("should never write a kernel chain, even if it has our prefix", func() {
+			// A prefix that the kernel chains share would make them
+			// look like ours, and so stale, on every resync.
+			for _, prefix := range []string{"IN", "OUT", "F", "P", "POST"} {
+				table = NewTable("filter", 4, TableOptions{
+					ChainNamePrefix: prefix,
+					NewCmdOverride:  dataplane.newCmd,
+				})
+				for _, chainName := range kernelChains {
+					table.UpdateChain(&Chain{Name: chainName})
+					table.RemoveChainByName(chainName)
+				}
+				Expect(table.Apply()).To(Succeed())
+				table.InvalidateDataplaneCache()
+				Expect(table.Apply()).To(Succeed())
+			}
+			expectNoKernelChainDefs()
+			for _, chainName := range kernelChains {
+				Expect(dataplane.Chains[chainName]).To(Equal([]string{"--jump ACCEPT"}))
+			}
+		})
+	})
+
+	Describe("with an audit log", func() {
+		var sink *recordingSink
+
+		BeforeEach(func() {
+			sink = &recordingSink{}
+			table = NewTable("filter", 4, TableOptions{
+				AuditLog:       audit.New(sink),
+				NewCmdOverride: dataplane.newCmd,
+			})
+			table.UpdateChain(fooChain)
+			Expect(table.Apply()).To(Succeed())
+		})
+
+		It("should record the creation of a chain and the removal of a stale one", func() {
+			Expect(sink.ops()).To(Equal([]string{
+				"create cali-foo",
+				"update cali-stale",
+				"delete cali-stale",
+			}))
+			for _, rec := range sink.records {
+				Expect(rec.Table).To(Equal("filter"))
+				Expect(rec.IPVersion).To(Equal(uint8(4)))
+			}
+			Expect(sink.records[0].Before).To(BeEmpty())
+			Expect(sink.records[0].After).NotTo(BeEmpty())
+			Expect(sink.records[2].Before).To(Equal(sink.records[1].After))
+			Expect(sink.records[2].After).To(BeEmpty())
+		})
+		It("should record the before and after hashes of an update", func() {
+			created := sink.records[0]
+			sink.records = nil
+			table.UpdateChain(&Chain{
+				Name:  "cali-foo",
+				Rules: []Rule{{Action: ReturnAction{}}},
+			})
+			Expect(table.Apply()).To(Succeed())
+			Expect(sink.ops()).To(Equal([]string{"update cali-foo"}))
+			Expect(sink.records[0].Before).To(Equal(created.After))
+			Expect(sink.records[0].After).NotTo(Equal(created.After))
+		})
+		It("should record nothing if nothing has changed", func() {
+			sink.records = nil
+			table.UpdateChain(fooChain)
+			Expect(table.Apply()).To(Succeed())
+			Expect(sink.records).To(BeEmpty())
+		})
+	})
+})
+
+// recordingSink is an audit.Sink that keeps the records that it is given.
+type recordingSink struct {
+	records []*audit.Record
+}
+
+func (s *recordingSink) Export(records []*audit.Record) error {
+	s.records = append(s.records, records...)
+	return nil
+}
+
+// ops returns the op and name of each record.
+func (s *recordingSink) ops() []string {
+	ops := []string{}
+	for _, rec := range s.records {
+		ops = append(ops, rec.Op+" "+rec.Name)
+	}
+	return ops
+}
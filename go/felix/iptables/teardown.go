@@ -0,0 +1,159 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Teardown removes our chains from the dataplane, for use when Felix is
+// shutting down for good.  Each of our chains is flushed and then deleted
+// unless a rule in a chain that we don't own still jumps to it; such a chain
+// is left empty, which means that traffic passes straight through it.  If
+// removeInsertions is true, our rules in chains that we don't own, such as
+// the jumps from the kernel's FORWARD chain, are removed first, so that
+// normally no references remain.
+//
+// The whole teardown is applied in one iptables-restore transaction.  The
+// Table shouldn't be used after Teardown.
+func (t *Table) Teardown(removeInsertions bool) error {
+	log.WithFields(log.Fields{
+		"table":            t.Name,
+		"ipVersion":        t.IPVersion,
+		"removeInsertions": removeInsertions,
+	}).Info("Tearing down iptables chains")
+	output, err := t.newCmd(t.saveCmd, "-t", t.Name).Output()
+	if err != nil {
+		return err
+	}
+	hashes, _ := parseDataplane(output)
+	t.chainToDataplaneHashes = hashes
+	t.chainToDataplaneRules = nil
+	t.inSyncWithDataPlane = false
+
+	var units []*restoreUnit
+	if removeInsertions {
+		for _, chainName := range sortedHashKeys(hashes) {
+			if t.ownsChain(chainName) {
+				continue
+			}
+			if unit := removeOurRulesUnit(chainName, hashes[chainName]); unit != nil {
+				units = append(units, unit)
+			}
+		}
+	}
+
+	// Find the references to our chains that will remain once the units
+	// above have been applied.
+	referenced := map[string]bool{}
+	for _, ref := range chainReferences(output) {
+		if t.ownsChain(ref.from) || !t.ownsChain(ref.to) {
+			continue
+		}
+		if removeInsertions && ref.ours {
+			continue
+		}
+		referenced[ref.to] = true
+	}
+
+	flushes := &restoreUnit{newHashes: map[string][]string{}}
+	var deletions []*restoreUnit
+	for _, chainName := range sortedHashKeys(hashes) {
+		if !t.ownsChain(chainName) {
+			continue
+		}
+		fmt.Fprintf(&flushes.lines, ":%s - -\n", chainName)
+		flushes.newHashes[chainName] = []string{}
+		if referenced[chainName] {
+			log.WithField("chainName", chainName).Info(
+				"Chain still referenced, leaving it in place but empty")
+			continue
+		}
+		unit := &restoreUnit{newHashes: map[string][]string{chainName: nil}}
+		fmt.Fprintf(&unit.lines, "-X %s\n", chainName)
+		deletions = append(deletions, unit)
+	}
+	if len(flushes.newHashes) > 0 {
+		units = append(units, flushes)
+		units = append(units, deletions...)
+	}
+
+	if len(units) == 0 {
+		log.WithField("table", t.Name).Info("Nothing to tear down")
+		return nil
+	}
+	return t.restore(units)
+}
+
+// removeOurRulesUnit returns the input that removes the rules with our hash
+// from the given chain, or nil if there aren't any.
+func removeOurRulesUnit(chainName string, hashes []string) *restoreUnit {
+	var ourPositions []int
+	otherHashes := []string{}
+	for i, hash := range hashes {
+		if hash != "" {
+			ourPositions = append(ourPositions, i+1)
+		} else {
+			otherHashes = append(otherHashes, hash)
+		}
+	}
+	if len(ourPositions) == 0 {
+		return nil
+	}
+	unit := &restoreUnit{newHashes: map[string][]string{chainName: otherHashes}}
+	// From the bottom up so that the rule numbers stay valid.
+	for i := len(ourPositions) - 1; i >= 0; i-- {
+		fmt.Fprintf(&unit.lines, "-D %s %d\n", chainName, ourPositions[i])
+	}
+	return unit
+}
+
+// chainReference is a rule in one chain that jumps or goes to another.
+type chainReference struct {
+	from, to string
+	// ours is true if the rule has our hash.
+	ours bool
+}
+
+// chainReferences finds the jumps between chains in the output of
+// iptables-save.
+func chainReferences(output []byte) []chainReference {
+	var refs []chainReference
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		m := appendRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "-j", "--jump", "-g", "--goto":
+				refs = append(refs, chainReference{
+					from: m[1],
+					to:   fields[i+1],
+					ours: hashCommentRegexp.MatchString(line),
+				})
+			}
+		}
+	}
+	return refs
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Table teardown", func() {
+	var dataplane *mockDataplane
+	var newTable func() *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {"--jump ACCEPT"},
+		})
+		newTable = func() *Table {
+			return NewTable("filter", 4, TableOptions{
+				NewCmdOverride: dataplane.newCmd,
+			})
+		}
+		table := newTable()
+		table.UpdateChains([]*Chain{
+			{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}},
+			{Name: "cali-bar", Rules: []Rule{{Action: JumpAction{Target: "cali-foo"}}}},
+		})
+		table.SetRuleInsertions("FORWARD", []Rule{
+			{Action: JumpAction{Target: "cali-bar"}},
+		})
+		Expect(table.Apply()).To(Succeed())
+	})
+
+	It("should remove everything in one transaction when removing insertions", func() {
+		numRestores := len(dataplane.RestoreInputs)
+		Expect(newTable().Teardown(true)).To(Succeed())
+		Expect(dataplane.Chains).To(Equal(map[string][]string{
+			"FORWARD": {"--jump ACCEPT"},
+		}))
+		Expect(dataplane.RestoreInputs).To(HaveLen(numRestores + 1))
+	})
+	It("should leave referenced chains in place, but empty, when keeping insertions", func() {
+		Expect(newTable().Teardown(false)).To(Succeed())
+		Expect(dataplane.Chains).To(HaveLen(2))
+		Expect(dataplane.Chains["cali-bar"]).To(BeEmpty())
+		Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+	})
+	It("should leave a chain that someone else jumps to", func() {
+		dataplane.Chains["INPUT"] = []string{"--jump cali-foo"}
+		Expect(newTable().Teardown(true)).To(Succeed())
+		Expect(dataplane.Chains).To(Equal(map[string][]string{
+			"FORWARD":  {"--jump ACCEPT"},
+			"INPUT":    {"--jump cali-foo"},
+			"cali-foo": {},
+		}))
+	})
+	It("should do nothing if there's nothing to remove", func() {
+		Expect(newTable().Teardown(true)).To(Succeed())
+		numCmds := len(dataplane.Cmds)
+		Expect(newTable().Teardown(true)).To(Succeed())
+		Expect(dataplane.Cmds).To(HaveLen(numCmds + 1))
+	})
+	It("should return an error if the restore fails", func() {
+		dataplane.FailNextRestore = true
+		Expect(newTable().Teardown(true)).NotTo(Succeed())
+		Expect(dataplane.Chains).To(HaveKey("cali-foo"))
+	})
+})
@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8swatch
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/services"
+	"k8s.io/client-go/pkg/api/v1"
+	"strings"
+)
+
+// DSRAnnotation enables direct server return for a service's cluster IP,
+// if it's set to "true" and Felix has DSR enabled.
+const DSRAnnotation = "projectcalico.org/dsr"
+
+// clientIPAffinityTimeoutSecs is how long a client sticks to an endpoint
+// if the service asks for ClientIP session affinity.  It matches
+// kube-proxy.
+const clientIPAffinityTimeoutSecs = 180 * 60
+
+func serviceID(meta v1.ObjectMeta) services.ServiceID {
+	return services.ServiceID{
+		Namespace: meta.Namespace,
+		Name:      meta.Name,
+	}
+}
+
+// ServiceFromK8s converts a Kubernetes Service.  It returns false if the
+// service has no cluster IP to program, as with headless and ExternalName
+// services.
+func ServiceFromK8s(k8sSvc *v1.Service) (services.Service, bool) {
+	svc := services.Service{
+		ID:        serviceID(k8sSvc.ObjectMeta),
+		ClusterIP: k8sSvc.Spec.ClusterIP,
+		DSR:       k8sSvc.Annotations[DSRAnnotation] == "true",
+	}
+	if k8sSvc.Spec.Type == v1.ServiceTypeExternalName ||
+		svc.ClusterIP == "" || svc.ClusterIP == v1.ClusterIPNone {
+		return svc, false
+	}
+	for _, port := range k8sSvc.Spec.Ports {
+		svc.Ports = append(svc.Ports, services.ServicePort{
+			Name:     port.Name,
+			Protocol: strings.ToLower(string(port.Protocol)),
+			Port:     uint16(port.Port),
+			NodePort: uint16(port.NodePort),
+		})
+	}
+	if k8sSvc.Spec.SessionAffinity == v1.ServiceAffinityClientIP {
+		svc.AffinityTimeoutSecs = clientIPAffinityTimeoutSecs
+	}
+	return svc, true
+}
+
+// EndpointsFromK8s converts Kubernetes Endpoints, leaving out the addresses
+// that aren't ready.  Each of the Kubernetes subsets has its own ports but
+// all of our addresses serve all of the ports, so we only take the subsets
+// whose ports match the first one's.  Subsets only differ while the
+// service's pods are being updated to serve different ports.  The Hostnames
+// are the names of the addresses' nodes, which are also their Calico
+// hostnames.
+func EndpointsFromK8s(k8sEps *v1.Endpoints) services.Endpoints {
+	eps := services.Endpoints{ID: serviceID(k8sEps.ObjectMeta)}
+	for i, subset := range k8sEps.Subsets {
+		if i == 0 {
+			for _, port := range subset.Ports {
+				eps.Ports = append(eps.Ports, services.EndpointPort{
+					Name: port.Name,
+					Port: uint16(port.Port),
+				})
+			}
+		} else if !samePorts(subset.Ports, k8sEps.Subsets[0].Ports) {
+			log.WithFields(log.Fields{
+				"service": eps.ID,
+				"ports":   subset.Ports,
+			}).Warn("Skipping endpoints with different ports")
+			continue
+		}
+		for _, addr := range subset.Addresses {
+			eps.Addresses = append(eps.Addresses, addr.IP)
+			if addr.NodeName == nil {
+				continue
+			}
+			if eps.Hostnames == nil {
+				eps.Hostnames = map[string]string{}
+			}
+			eps.Hostnames[addr.IP] = *addr.NodeName
+		}
+	}
+	return eps
+}
+
+func samePorts(a, b []v1.EndpointPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ports := map[string]int32{}
+	for _, port := range a {
+		ports[port.Name] = port.Port
+	}
+	for _, port := range b {
+		if num, ok := ports[port.Name]; !ok || num != port.Port {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8swatch_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/k8swatch"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/services"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var webID = services.ServiceID{Namespace: "default", Name: "web"}
+
+var _ = Describe("ServiceFromK8s", func() {
+	var k8sSvc *v1.Service
+
+	BeforeEach(func() {
+		k8sSvc = &v1.Service{
+			ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec: v1.ServiceSpec{
+				Type:      v1.ServiceTypeNodePort,
+				ClusterIP: "10.96.0.10",
+				Ports: []v1.ServicePort{
+					{Name: "http", Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080},
+					{Name: "dns", Protocol: v1.ProtocolUDP, Port: 53},
+				},
+			},
+		}
+	})
+
+	It("should convert the cluster IP and ports", func() {
+		svc, ok := ServiceFromK8s(k8sSvc)
+		Expect(ok).To(BeTrue())
+		Expect(svc).To(Equal(services.Service{
+			ID:        webID,
+			ClusterIP: "10.96.0.10",
+			Ports: []services.ServicePort{
+				{Name: "http", Protocol: "tcp", Port: 80, NodePort: 30080},
+				{Name: "dns", Protocol: "udp", Port: 53},
+			},
+		}))
+	})
+
+	It("should convert ClientIP session affinity", func() {
+		k8sSvc.Spec.SessionAffinity = v1.ServiceAffinityClientIP
+		svc, _ := ServiceFromK8s(k8sSvc)
+		Expect(svc.AffinityTimeoutSecs).To(BeEquivalentTo(10800))
+	})
+
+	It("should enable DSR if the service is annotated", func() {
+		k8sSvc.Annotations = map[string]string{DSRAnnotation: "true"}
+		svc, _ := ServiceFromK8s(k8sSvc)
+		Expect(svc.DSR).To(BeTrue())
+	})
+
+	It("should skip headless services", func() {
+		k8sSvc.Spec.ClusterIP = v1.ClusterIPNone
+		svc, ok := ServiceFromK8s(k8sSvc)
+		Expect(ok).To(BeFalse())
+		Expect(svc.ID).To(Equal(webID))
+	})
+
+	It("should skip ExternalName services", func() {
+		k8sSvc.Spec.Type = v1.ServiceTypeExternalName
+		k8sSvc.Spec.ClusterIP = ""
+		_, ok := ServiceFromK8s(k8sSvc)
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("EndpointsFromK8s", func() {
+	httpPort := v1.EndpointPort{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}
+
+	It("should merge the subsets with the same ports", func() {
+		eps := EndpointsFromK8s(&v1.Endpoints{
+			ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "web"},
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses:         []v1.EndpointAddress{{IP: "10.65.0.2"}},
+					NotReadyAddresses: []v1.EndpointAddress{{IP: "10.65.0.9"}},
+					Ports:             []v1.EndpointPort{httpPort},
+				},
+				{
+					Addresses: []v1.EndpointAddress{{IP: "10.65.1.3"}},
+					Ports:     []v1.EndpointPort{httpPort},
+				},
+			},
+		})
+		Expect(eps).To(Equal(services.Endpoints{
+			ID:        webID,
+			Addresses: []string{"10.65.0.2", "10.65.1.3"},
+			Ports:     []services.EndpointPort{{Name: "http", Port: 8080}},
+		}))
+	})
+
+	It("should record the addresses' nodes", func() {
+		node := "node-1"
+		eps := EndpointsFromK8s(&v1.Endpoints{
+			ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "web"},
+			Subsets: []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{
+					{IP: "10.65.0.2", NodeName: &node},
+					{IP: "10.65.0.3"},
+				},
+				Ports: []v1.EndpointPort{httpPort},
+			}},
+		})
+		Expect(eps.Hostnames).To(Equal(map[string]string{"10.65.0.2": "node-1"}))
+	})
+
+	It("should skip subsets with different ports", func() {
+		eps := EndpointsFromK8s(&v1.Endpoints{
+			ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "web"},
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{{IP: "10.65.0.2"}},
+					Ports:     []v1.EndpointPort{httpPort},
+				},
+				{
+					Addresses: []v1.EndpointAddress{{IP: "10.65.1.3"}},
+					Ports:     []v1.EndpointPort{{Name: "http", Port: 9090}},
+				},
+			},
+		})
+		Expect(eps.Addresses).To(Equal([]string{"10.65.0.2"}))
+	})
+
+	It("should handle endpoints without subsets", func() {
+		eps := EndpointsFromK8s(&v1.Endpoints{
+			ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "web"},
+		})
+		Expect(eps).To(Equal(services.Endpoints{ID: webID}))
+	})
+})
@@ -0,0 +1,155 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The k8swatch package watches the Kubernetes API for the Services and
+// Endpoints that the services package programs when Felix replaces
+// kube-proxy.  The Watcher converts them to the services package's types
+// and sends them to its update channel, for the owner of the
+// services.Manager to pass on.
+package k8swatch
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/services"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/fields"
+	"k8s.io/client-go/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Config is the connection to the Kubernetes API.  Fields that are left
+// empty fall back to the kubeconfig file or, without one, to the
+// in-cluster config.
+type Config struct {
+	Kubeconfig     string
+	K8sAPIEndpoint string
+	K8sKeyFile     string
+	K8sCertFile    string
+	K8sCAFile      string
+	K8sAPIToken    string
+}
+
+// Watcher sends the Services and Endpoints to its update channel as
+// services.Service, services.ServiceRemove, services.Endpoints and
+// services.EndpointsRemove values.
+type Watcher struct {
+	clientset *kubernetes.Clientset
+	updates   chan interface{}
+}
+
+func New(config Config) (*Watcher, error) {
+	configOverrides := &clientcmd.ConfigOverrides{}
+	var overridesMap = []struct {
+		variable *string
+		value    string
+	}{
+		{&configOverrides.ClusterInfo.Server, config.K8sAPIEndpoint},
+		{&configOverrides.AuthInfo.ClientCertificate, config.K8sCertFile},
+		{&configOverrides.AuthInfo.ClientKey, config.K8sKeyFile},
+		{&configOverrides.ClusterInfo.CertificateAuthority, config.K8sCAFile},
+		{&configOverrides.AuthInfo.Token, config.K8sAPIToken},
+	}
+	for _, override := range overridesMap {
+		if override.value != "" {
+			*override.variable = override.value
+		}
+	}
+	loadingRules := clientcmd.ClientConfigLoadingRules{}
+	if config.Kubeconfig != "" {
+		loadingRules.ExplicitPath = config.Kubeconfig
+	}
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&loadingRules, configOverrides).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{
+		clientset: clientset,
+		updates:   make(chan interface{}, 100),
+	}, nil
+}
+
+// Updates returns the channel that the updates are sent to.
+func (w *Watcher) Updates() <-chan interface{} {
+	return w.updates
+}
+
+// Start starts the watches in the background.  Each one lists all the
+// resources first and then watches for changes, relisting if the watch
+// fails.
+func (w *Watcher) Start() {
+	restClient := w.clientset.Core().RESTClient()
+	_, serviceController := cache.NewInformer(
+		cache.NewListWatchFromClient(restClient, "services", v1.NamespaceAll, fields.Everything()),
+		&v1.Service{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    w.onServiceUpdate,
+			UpdateFunc: func(_, obj interface{}) { w.onServiceUpdate(obj) },
+			DeleteFunc: w.onServiceDelete,
+		},
+	)
+	_, endpointsController := cache.NewInformer(
+		cache.NewListWatchFromClient(restClient, "endpoints", v1.NamespaceAll, fields.Everything()),
+		&v1.Endpoints{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    w.onEndpointsUpdate,
+			UpdateFunc: func(_, obj interface{}) { w.onEndpointsUpdate(obj) },
+			DeleteFunc: w.onEndpointsDelete,
+		},
+	)
+	log.Info("Watching Kubernetes services")
+	go serviceController.Run(wait.NeverStop)
+	go endpointsController.Run(wait.NeverStop)
+}
+
+func (w *Watcher) onServiceUpdate(obj interface{}) {
+	k8sSvc := obj.(*v1.Service)
+	svc, ok := ServiceFromK8s(k8sSvc)
+	if !ok {
+		// The service may have been changed to one that we don't
+		// program, so make sure it's gone.
+		log.WithField("service", svc.ID).Debug("Ignoring service without a cluster IP")
+		w.updates <- services.ServiceRemove{ID: svc.ID}
+		return
+	}
+	w.updates <- svc
+}
+
+func (w *Watcher) onServiceDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	k8sSvc := obj.(*v1.Service)
+	w.updates <- services.ServiceRemove{ID: serviceID(k8sSvc.ObjectMeta)}
+}
+
+func (w *Watcher) onEndpointsUpdate(obj interface{}) {
+	w.updates <- EndpointsFromK8s(obj.(*v1.Endpoints))
+}
+
+func (w *Watcher) onEndpointsDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	k8sEps := obj.(*v1.Endpoints)
+	w.updates <- services.EndpointsRemove{ID: serviceID(k8sEps.ObjectMeta)}
+}
@@ -29,6 +29,8 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // logrusToSyslogLevel maps logrus.Level to the matching syslog level used by
@@ -78,6 +80,65 @@ func ConfigureEarlyLogging() {
 	log.Infof("Early screen log level set to %v", logLevelScreen)
 }
 
+// componentKey is the key of the field in which the ContextHook records the
+// component that logged an entry.  The field is used to apply the level
+// overrides; it isn't output.
+const componentKey = "component"
+
+// LevelOverrides maps the name of a component, which is the name of its Go
+// package, to the log level for that component.
+type LevelOverrides map[string]log.Level
+
+func (o LevelOverrides) levels() []log.Level {
+	var levels []log.Level
+	for _, level := range o {
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+// levelOverrides holds the current LevelOverrides.  It's read on every log
+// entry, so it's an atomic.Value rather than a mutex-protected map.
+var levelOverrides atomic.Value
+
+// SetLevelOverrides sets the log level overrides that our hooks apply.  Note
+// that the global log level must also be at least as verbose as the
+// overrides, or logrus filters the entries before they reach the hooks.
+func SetLevelOverrides(overrides LevelOverrides) {
+	levelOverrides.Store(overrides)
+}
+
+// parseLevelOverrides parses a list of <component>=<level> pairs, skipping
+// any invalid ones.  The config package has already validated the list.
+func ParseLevelOverrides(raw string) LevelOverrides {
+	overrides := LevelOverrides{}
+	if raw == "" {
+		return overrides
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			log.WithField("override", pair).Warn("Invalid log level override, ignoring")
+			continue
+		}
+		level, err := log.ParseLevel(parts[1])
+		if err != nil {
+			log.WithField("override", pair).Warn("Invalid log level override, ignoring")
+			continue
+		}
+		overrides[strings.ToLower(parts[0])] = level
+	}
+	return overrides
+}
+
+// The hooks created by ConfigureLogging.  We keep hold of them so that
+// UpdateLogLevels can change their levels on the fly.
+var (
+	screenHook *StreamHook
+	fileHook   *StreamHook
+	syslogHook *LeveledHook
+)
+
 // ConfigureLogging uses the resolved configuration to complete the logging
 // configuration.  It creates hooks for the relevant logging targets and
 // attaches them to logrus.
@@ -86,19 +147,14 @@ func ConfigureLogging(configParams *config.Config) {
 	logLevelScreen := safeParseLogLevel(configParams.LogSeverityScreen)
 	logLevelFile := safeParseLogLevel(configParams.LogSeverityFile)
 	logLevelSyslog := safeParseLogLevel(configParams.LogSeveritySys)
+	overrides := ParseLevelOverrides(configParams.LogSeverityOverrides)
+	SetLevelOverrides(overrides)
 
-	// Work out the most verbose level that is being logged.
-	mostVerboseLevel := logLevelScreen
-	if logLevelFile > mostVerboseLevel {
-		mostVerboseLevel = logLevelFile
-	}
-	if logLevelSyslog > mostVerboseLevel {
-		mostVerboseLevel = logLevelScreen
-	}
 	// Disable all more-verbose levels using the global setting, this
 	// ensures that debug logs are filtered as early as possible in the
 	// pipeline.
-	log.SetLevel(mostVerboseLevel)
+	log.SetLevel(mostVerbose(append(overrides.levels(),
+		logLevelScreen, logLevelFile, logLevelSyslog)...))
 
 	// Disable logrus' default output, which only supports a single
 	// destination at the global log level.
@@ -106,35 +162,27 @@ func ConfigureLogging(configParams *config.Config) {
 
 	// Screen target.
 	if configParams.LogSeverityScreen != "" {
-		screenLevels := filterLevels(logLevelScreen)
-		log.AddHook(&StreamHook{
-			writer: os.Stdout,
-			levels: screenLevels,
-		})
+		screenHook = &StreamHook{writer: os.Stdout}
+		screenHook.SetLevel(logLevelScreen)
+		log.AddHook(screenHook)
 	}
 
 	// File target.
 	if configParams.LogSeverityFile != "" {
-		fileLevels := filterLevels(logLevelFile)
-		if err := os.MkdirAll(path.Dir(configParams.LogFilePath), 0755); err != nil {
-			log.WithError(err).Fatal("Failed to create log dir")
-		}
-		rotAwareFile, err := rfw.Open(configParams.LogFilePath, 0644)
-		if err != nil {
-			log.WithError(err).Fatal("Failed to open log file")
-		}
-		log.AddHook(&StreamHook{
-			writer: rotAwareFile,
-			levels: fileLevels,
-		})
+		fileHook = &StreamHook{writer: openLogFile(configParams)}
+		fileHook.SetLevel(logLevelFile)
+		log.AddHook(fileHook)
 	}
 
 	if configParams.LogSeveritySys != "" {
-		// Syslog target.
-		// Set net/addr to "" so we connect to the system syslog server rather
-		// than a remote one.
+		// Syslog target.  With net/addr set to "", we connect to the
+		// system syslog server rather than a remote one.
 		net := ""
 		addr := ""
+		if configParams.LogSyslogAddr != "" {
+			net = configParams.LogSyslogNetwork
+			addr = configParams.LogSyslogAddr
+		}
 		// The priority parameter is a combination of facility and default
 		// severity.  We want to log with the standard LOG_USER facility; the
 		// severity is actually irrelevant because the hook always overrides
@@ -142,27 +190,88 @@ func ConfigureLogging(configParams *config.Config) {
 		priority := syslog.LOG_USER | syslog.LOG_INFO
 		tag := "calico-felix"
 		if hook, err := logrus_syslog.NewSyslogHook(net, addr, priority, tag); err != nil {
-			log.WithError(err).WithField("level", configParams.LogSeveritySys).Error("Failed to connect to syslog")
+			log.WithError(err).WithFields(log.Fields{
+				"level": configParams.LogSeveritySys,
+				"addr":  addr,
+			}).Error("Failed to connect to syslog")
 		} else {
-			syslogLevels := filterLevels(logLevelSyslog)
-			levHook := &LeveledHook{
-				hook:   hook,
-				levels: syslogLevels,
-			}
-			log.AddHook(levHook)
+			syslogHook = &LeveledHook{hook: hook}
+			syslogHook.SetLevel(logLevelSyslog)
+			log.AddHook(syslogHook)
 		}
 	}
 }
 
-// filterLevels returns all the logrus.Level values <= maxLevel.
-func filterLevels(maxLevel log.Level) []log.Level {
-	levels := []log.Level{}
-	for _, l := range log.AllLevels {
-		if l <= maxLevel {
-			levels = append(levels, l)
+// openLogFile opens the log file.  If rotation limits are configured, we
+// rotate the file ourselves; otherwise, we expect an external logrotate to
+// move it aside, and reopen it when that happens.
+func openLogFile(configParams *config.Config) io.Writer {
+	if configParams.LogFileMaxSizeMB > 0 || configParams.LogFileMaxAgeHours > 0 {
+		file, err := OpenRotatingFile(RotatingFileConfig{
+			Path:       configParams.LogFilePath,
+			MaxSize:    int64(configParams.LogFileMaxSizeMB) * 1024 * 1024,
+			MaxAge:     time.Duration(configParams.LogFileMaxAgeHours) * time.Hour,
+			MaxBackups: configParams.LogFileMaxBackups,
+		})
+		if err != nil {
+			log.WithError(err).Fatal("Failed to open log file")
 		}
+		return file
 	}
-	return levels
+	if err := os.MkdirAll(path.Dir(configParams.LogFilePath), 0755); err != nil {
+		log.WithError(err).Fatal("Failed to create log dir")
+	}
+	rotAwareFile, err := rfw.Open(configParams.LogFilePath, 0644)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to open log file")
+	}
+	return rotAwareFile
+}
+
+// UpdateLogLevels applies changes to the log levels in the configuration to
+// the hooks that were created by ConfigureLogging.  Enabling a logging target
+// that was disabled at start of day requires a restart.
+func UpdateLogLevels(configParams *config.Config) {
+	logLevelScreen := safeParseLogLevel(configParams.LogSeverityScreen)
+	logLevelFile := safeParseLogLevel(configParams.LogSeverityFile)
+	logLevelSyslog := safeParseLogLevel(configParams.LogSeveritySys)
+	overrides := ParseLevelOverrides(configParams.LogSeverityOverrides)
+	SetLevelOverrides(overrides)
+
+	if screenHook != nil {
+		screenHook.SetLevel(logLevelScreen)
+	} else if configParams.LogSeverityScreen != "" {
+		log.Warn("Screen logging was disabled at start of day, restart to enable it")
+	}
+	if fileHook != nil {
+		fileHook.SetLevel(logLevelFile)
+	} else if configParams.LogSeverityFile != "" {
+		log.Warn("File logging was disabled at start of day, restart to enable it")
+	}
+	if syslogHook != nil {
+		syslogHook.SetLevel(logLevelSyslog)
+	} else if configParams.LogSeveritySys != "" {
+		log.Warn("Syslog logging was disabled at start of day, restart to enable it")
+	}
+	log.SetLevel(mostVerbose(append(overrides.levels(),
+		logLevelScreen, logLevelFile, logLevelSyslog)...))
+	log.WithFields(log.Fields{
+		"screen":    logLevelScreen,
+		"file":      logLevelFile,
+		"syslog":    logLevelSyslog,
+		"overrides": configParams.LogSeverityOverrides,
+	}).Info("Updated log levels")
+}
+
+// mostVerbose returns the most verbose of the given levels.
+func mostVerbose(levels ...log.Level) log.Level {
+	result := log.PanicLevel
+	for _, l := range levels {
+		if l > result {
+			result = l
+		}
+	}
+	return result
 }
 
 // Formatter is our custom log formatter, which mimics the style used by the
@@ -170,7 +279,7 @@ func filterLevels(maxLevel log.Level) []log.Level {
 // logs the level and PID.  Since logrus deosn't yet expose file and line
 // numbers, we log "go" as a placeholder.
 //
-//    2016-10-04 14:45:45,999 [ERROR][70826] go: Hello world key=value
+//	2016-10-04 14:45:45,999 [ERROR][70826] go: Hello world key=value
 type Formatter struct{}
 
 func (f *Formatter) Format(entry *log.Entry) ([]byte, error) {
@@ -193,7 +302,7 @@ func (f *Formatter) Format(entry *log.Entry) ([]byte, error) {
 	b.WriteString(formatted)
 
 	for _, key := range keys {
-		if key == "file" || key == "line" {
+		if key == "file" || key == "line" || key == componentKey {
 			continue
 		}
 		b.WriteString(fmt.Sprintf(" %v=%v", key, entry.Data[key]))
@@ -226,6 +335,7 @@ func (hook ContextHook) Fire(entry *log.Entry) error {
 			if !shouldSkipFrame(frame) {
 				entry.Data["file"] = path.Base(frame.File)
 				entry.Data["line"] = frame.Line
+				entry.Data[componentKey] = componentOfFunction(frame.Function)
 				break
 			}
 			if !more {
@@ -236,25 +346,69 @@ func (hook ContextHook) Fire(entry *log.Entry) error {
 	return nil
 }
 
+// componentOfFunction returns the component that a function belongs to: the
+// name of its package.  For example, the component of
+// "github.com/projectcalico/felix/go/felix/iptables.(*Table).Apply" is
+// "iptables".
+func componentOfFunction(function string) string {
+	function = function[strings.LastIndex(function, "/")+1:]
+	if dot := strings.Index(function, "."); dot >= 0 {
+		function = function[:dot]
+	}
+	return function
+}
+
 func shouldSkipFrame(frame runtime.Frame) bool {
 	return strings.LastIndex(frame.File, "exported.go") > 0 ||
 		strings.LastIndex(frame.File, "logger.go") > 0 ||
 		strings.LastIndex(frame.File, "entry.go") > 0
 }
 
+// levelFilter filters log entries by level.  logrus only asks a hook for its
+// Levels() when the hook is added so, to allow the level to be changed later,
+// our hooks register for all levels and then filter in Fire().
+type levelFilter struct {
+	maxLevel uint32
+}
+
+func (f *levelFilter) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// SetLevel sets the most verbose level that the hook will fire for.
+func (f *levelFilter) SetLevel(maxLevel log.Level) {
+	atomic.StoreUint32(&f.maxLevel, uint32(maxLevel))
+}
+
+// enabled returns true if the entry should be logged.  A level override for
+// the entry's component takes the place of the hook's own level.
+func (f *levelFilter) enabled(entry *log.Entry) bool {
+	maxLevel := log.Level(atomic.LoadUint32(&f.maxLevel))
+	if component, ok := entry.Data[componentKey].(string); ok {
+		overrides, _ := levelOverrides.Load().(LevelOverrides)
+		if level, ok := overrides[component]; ok {
+			maxLevel = level
+		}
+	}
+	return entry.Level <= maxLevel
+}
+
 // StreamHook is a logrus Hook that writes to a stream when fired.
 // It supports configuration of log levels at which is fires.
 type StreamHook struct {
+	levelFilter
 	mu     sync.Mutex
 	writer io.Writer
-	levels []log.Level
 }
 
-func (h *StreamHook) Levels() []log.Level {
-	return h.levels
+func NewStreamHook(writer io.Writer) *StreamHook {
+	return &StreamHook{writer: writer}
 }
 
 func (h *StreamHook) Fire(entry *log.Entry) (err error) {
+	if !h.enabled(entry) {
+		return
+	}
 	var serialized []byte
 	if serialized, err = entry.Logger.Formatter.Format(entry); err != nil {
 		return
@@ -268,15 +422,14 @@ func (h *StreamHook) Fire(entry *log.Entry) (err error) {
 }
 
 type LeveledHook struct {
-	hook   log.Hook
-	levels []log.Level
-}
-
-func (h *LeveledHook) Levels() []log.Level {
-	return h.levels
+	levelFilter
+	hook log.Hook
 }
 
 func (h *LeveledHook) Fire(entry *log.Entry) error {
+	if !h.enabled(entry) {
+		return nil
+	}
 	return h.hook.Fire(entry)
 }
 
@@ -0,0 +1,96 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logutils_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/logutils"
+
+	"bytes"
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("ParseLevelOverrides",
+	func(raw string, expected LevelOverrides) {
+		Expect(ParseLevelOverrides(raw)).To(Equal(expected))
+	},
+	Entry("empty", "", LevelOverrides{}),
+	Entry("single", "iptables=DEBUG", LevelOverrides{"iptables": log.DebugLevel}),
+	Entry("multiple", "iptables=debug,calc=Info", LevelOverrides{
+		"iptables": log.DebugLevel,
+		"calc":     log.InfoLevel,
+	}),
+	Entry("mixed case component", "IPTables=DEBUG", LevelOverrides{"iptables": log.DebugLevel}),
+	Entry("invalid pairs skipped", "iptables,calc=foo,ipsets=warning", LevelOverrides{
+		"ipsets": log.WarnLevel,
+	}),
+)
+
+var _ = Describe("Level overrides", func() {
+	var savedHooks log.LevelHooks
+	var savedLevel log.Level
+	var savedFormatter log.Formatter
+	var buf *bytes.Buffer
+
+	BeforeEach(func() {
+		savedHooks = log.StandardLogger().Hooks
+		savedLevel = log.GetLevel()
+		savedFormatter = log.StandardLogger().Formatter
+		buf = &bytes.Buffer{}
+		hook := NewStreamHook(buf)
+		hook.SetLevel(log.InfoLevel)
+		log.StandardLogger().Hooks = log.LevelHooks{}
+		log.AddHook(&ContextHook{})
+		log.AddHook(hook)
+		log.SetLevel(log.DebugLevel)
+		log.SetFormatter(&Formatter{})
+	})
+	AfterEach(func() {
+		SetLevelOverrides(nil)
+		log.StandardLogger().Hooks = savedHooks
+		log.SetLevel(savedLevel)
+		log.SetFormatter(savedFormatter)
+	})
+
+	It("should filter debug logs by default", func() {
+		log.Debug("Debug log")
+		log.Info("Info log")
+		Expect(buf.String()).NotTo(ContainSubstring("Debug log"))
+		Expect(buf.String()).To(ContainSubstring("Info log"))
+	})
+	It("should pass debug logs from an overridden component", func() {
+		SetLevelOverrides(LevelOverrides{"logutils_test": log.DebugLevel})
+		log.Debug("Debug log")
+		Expect(buf.String()).To(ContainSubstring("Debug log"))
+	})
+	It("should filter info logs from a component overridden to warning", func() {
+		SetLevelOverrides(LevelOverrides{"logutils_test": log.WarnLevel})
+		log.Info("Info log")
+		log.Warn("Warning log")
+		Expect(buf.String()).NotTo(ContainSubstring("Info log"))
+		Expect(buf.String()).To(ContainSubstring("Warning log"))
+	})
+	It("should ignore overrides for other components", func() {
+		SetLevelOverrides(LevelOverrides{"iptables": log.DebugLevel})
+		log.Debug("Debug log")
+		Expect(buf.String()).NotTo(ContainSubstring("Debug log"))
+	})
+	It("should not output the component field", func() {
+		log.Info("Info log")
+		Expect(buf.String()).NotTo(ContainSubstring("component"))
+	})
+})
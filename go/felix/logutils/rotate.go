@@ -0,0 +1,162 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logutils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+var errClosed = errors.New("log file is closed")
+
+type RotatingFileConfig struct {
+	Path string
+	// MaxSize is the size, in bytes, at which the file is rotated.  Zero
+	// means no limit.
+	MaxSize int64
+	// MaxAge is the age at which the file is rotated.  The age counts
+	// from when we opened the file, since Linux doesn't record when a
+	// file was created.  Zero means no limit.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files that are kept, as
+	// <path>.1 (the newest) to <path>.<MaxBackups>.  Zero means that
+	// the file is truncated on rotation.
+	MaxBackups int
+}
+
+// RotatingFile is a log file that rotates itself once it gets too big or too
+// old.  It's an alternative to relying on an external logrotate, for hosts
+// that don't run one.  It is safe for concurrent use.
+type RotatingFile struct {
+	config RotatingFileConfig
+
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// OpenRotatingFile opens, or creates, the log file, creating its directory
+// if needed.  Writes are appended to any existing file.
+func OpenRotatingFile(config RotatingFileConfig) (*RotatingFile, error) {
+	if err := os.MkdirAll(path.Dir(config.Path), 0755); err != nil {
+		return nil, err
+	}
+	f := &RotatingFile{config: config}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+// Write writes p to the file, rotating the file first if p would take it
+// over its maximum size, or if it has reached its maximum age.  A single
+// write that is larger than the maximum size is written to a fresh file.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return 0, errClosed
+	}
+	if f.needsRotation(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			// Carry on writing to the old file, if we still have
+			// it; losing logs would be worse than an oversized
+			// file.  We can't log the failure, since we are the
+			// log.
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file %s: %v\n", f.config.Path, err)
+			if f.file == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) needsRotation(writeLen int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.config.MaxSize > 0 && f.size+writeLen > f.config.MaxSize {
+		return true
+	}
+	if f.config.MaxAge > 0 && time.Now().Sub(f.openedAt) >= f.config.MaxAge {
+		return true
+	}
+	return false
+}
+
+// rotate shifts the backups along by one, dropping the oldest, moves the
+// current file to <path>.1 and opens a new file.  If the renames fail, it
+// reopens the current file.
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	err := f.shiftBackups()
+	if openErr := f.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (f *RotatingFile) shiftBackups() error {
+	if f.config.MaxBackups == 0 {
+		return os.Truncate(f.config.Path, 0)
+	}
+	for i := f.config.MaxBackups - 1; i >= 1; i-- {
+		err := os.Rename(f.backupName(i), f.backupName(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.config.Path, f.backupName(1))
+}
+
+func (f *RotatingFile) backupName(i int) string {
+	return fmt.Sprintf("%s.%d", f.config.Path, i)
+}
+
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logutils_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/logutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+var _ = Describe("RotatingFile", func() {
+	var dir, logPath string
+	var file *RotatingFile
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-rotate")
+		Expect(err).NotTo(HaveOccurred())
+		logPath = path.Join(dir, "logs", "felix.log")
+	})
+	AfterEach(func() {
+		if file != nil {
+			file.Close()
+			file = nil
+		}
+		os.RemoveAll(dir)
+	})
+
+	open := func(config RotatingFileConfig) {
+		config.Path = logPath
+		var err error
+		file, err = OpenRotatingFile(config)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	write := func(s string) {
+		_, err := file.Write([]byte(s))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	contents := func(p string) string {
+		data, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			return "<missing>"
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return string(data)
+	}
+
+	It("should append to an existing file", func() {
+		open(RotatingFileConfig{})
+		write("one\n")
+		file.Close()
+		open(RotatingFileConfig{})
+		write("two\n")
+		Expect(contents(logPath)).To(Equal("one\ntwo\n"))
+	})
+
+	It("should rotate by size and keep the configured number of backups", func() {
+		open(RotatingFileConfig{MaxSize: 8, MaxBackups: 2})
+		for _, line := range []string{"aaa\n", "bbb\n", "ccc\n", "ddd\n", "eee\n", "fff\n", "ggg\n"} {
+			write(line)
+		}
+		Expect(contents(logPath)).To(Equal("ggg\n"))
+		Expect(contents(logPath + ".1")).To(Equal("eee\nfff\n"))
+		Expect(contents(logPath + ".2")).To(Equal("ccc\nddd\n"))
+		Expect(contents(logPath + ".3")).To(Equal("<missing>"))
+	})
+
+	It("should take into account the size of an existing file", func() {
+		open(RotatingFileConfig{})
+		write("aaaaaa\n")
+		file.Close()
+		open(RotatingFileConfig{MaxSize: 8, MaxBackups: 1})
+		write("bbb\n")
+		Expect(contents(logPath)).To(Equal("bbb\n"))
+		Expect(contents(logPath + ".1")).To(Equal("aaaaaa\n"))
+	})
+
+	It("should write an oversized entry to a fresh file", func() {
+		open(RotatingFileConfig{MaxSize: 4, MaxBackups: 1})
+		write("a\n")
+		write("0123456789\n")
+		write("b\n")
+		Expect(contents(logPath)).To(Equal("b\n"))
+		Expect(contents(logPath + ".1")).To(Equal("0123456789\n"))
+	})
+
+	It("should truncate if no backups are kept", func() {
+		open(RotatingFileConfig{MaxSize: 4})
+		write("aaa\n")
+		write("bbb\n")
+		Expect(contents(logPath)).To(Equal("bbb\n"))
+		Expect(contents(logPath + ".1")).To(Equal("<missing>"))
+	})
+
+	It("should rotate by age", func() {
+		open(RotatingFileConfig{MaxAge: 50 * time.Millisecond, MaxBackups: 1})
+		write("aaa\n")
+		write("bbb\n")
+		time.Sleep(60 * time.Millisecond)
+		write("ccc\n")
+		Expect(contents(logPath)).To(Equal("ccc\n"))
+		Expect(contents(logPath + ".1")).To(Equal("aaa\nbbb\n"))
+	})
+
+	It("should fail writes after being closed", func() {
+		open(RotatingFileConfig{})
+		Expect(file.Close()).To(Succeed())
+		_, err := file.Write([]byte("a\n"))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,98 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The markbits package hands out the bits of the iptables mark that Felix
+// is allowed to use (IptablesMarkMask) to the features that need them, so
+// that no two features share a bit.
+package markbits
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Allocator allocates marks from a mask, least significant bit first.
+type Allocator struct {
+	mask      uint32
+	allocated uint32
+}
+
+func NewAllocator(mask uint32) *Allocator {
+	return &Allocator{mask: mask}
+}
+
+// NextSingleBitMark returns the next free bit of the mask, or false if all
+// of the bits have been allocated.
+func (a *Allocator) NextSingleBitMark() (uint32, bool) {
+	free := a.mask &^ a.allocated
+	if free == 0 {
+		log.WithField("mask", a.mask).Debug("No free mark bits")
+		return 0, false
+	}
+	bit := free & -free
+	a.allocated |= bit
+	return bit, true
+}
+
+// NextBlockBitsMark allocates up to size of the free bits of the mask,
+// which needn't be contiguous, for a multi-bit mark field.  It returns the
+// mask of the field and the number of bits in it, which is less than size
+// if there weren't enough bits left.
+func (a *Allocator) NextBlockBitsMark(size int) (uint32, int) {
+	var block uint32
+	allocated := 0
+	for ; allocated < size; allocated++ {
+		bit, ok := a.NextSingleBitMark()
+		if !ok {
+			break
+		}
+		block |= bit
+	}
+	return block, allocated
+}
+
+// AvailableBits returns the number of bits that haven't been allocated.
+func (a *Allocator) AvailableBits() int {
+	count := 0
+	for free := a.mask &^ a.allocated; free != 0; free &= free - 1 {
+		count++
+	}
+	return count
+}
+
+// MapNumberToMark spreads the bits of number over the bits of the mask,
+// least significant first, to give the value of a multi-bit mark field.
+func MapNumberToMark(number int, mask uint32) (uint32, error) {
+	if number < 0 {
+		return 0, errors.New("negative number can't be mapped to a mark")
+	}
+	var mark uint32
+	remaining := uint64(number)
+	for free := mask; free != 0 && remaining != 0; free &= free - 1 {
+		if remaining&1 != 0 {
+			mark |= free & -free
+		}
+		remaining >>= 1
+	}
+	if remaining != 0 {
+		return 0, errors.New("number too big for mark mask")
+	}
+	return mark, nil
+}
+
+// MaxNumber returns the largest number that MapNumberToMark can map to the
+// mask.
+func MaxNumber(mask uint32) int {
+	return 1<<uint(NewAllocator(mask).AvailableBits()) - 1
+}
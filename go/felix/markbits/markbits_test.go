@@ -0,0 +1,74 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package markbits_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/markbits"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Allocator", func() {
+	It("should allocate the bits of the mask, least significant first", func() {
+		a := NewAllocator(0x0a000010)
+		Expect(a.AvailableBits()).To(Equal(3))
+		for _, expBit := range []uint32{0x10, 0x02000000, 0x08000000} {
+			bit, ok := a.NextSingleBitMark()
+			Expect(ok).To(BeTrue())
+			Expect(bit).To(Equal(expBit))
+		}
+		Expect(a.AvailableBits()).To(Equal(0))
+	})
+	It("should report when the bits run out", func() {
+		a := NewAllocator(0x80000000)
+		_, ok := a.NextSingleBitMark()
+		Expect(ok).To(BeTrue())
+		_, ok = a.NextSingleBitMark()
+		Expect(ok).To(BeFalse())
+	})
+	It("should have no bits in an empty mask", func() {
+		_, ok := NewAllocator(0).NextSingleBitMark()
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("Multi-bit marks", func() {
+	It("should allocate a block of the remaining bits", func() {
+		a := NewAllocator(0xf1)
+		a.NextSingleBitMark()
+		block, size := a.NextBlockBitsMark(3)
+		Expect(block).To(Equal(uint32(0x70)))
+		Expect(size).To(Equal(3))
+		block, size = a.NextBlockBitsMark(3)
+		Expect(block).To(Equal(uint32(0x80)))
+		Expect(size).To(Equal(1))
+	})
+	It("should spread a number over a non-contiguous mask", func() {
+		mark, err := MapNumberToMark(5, 0x0a000010)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mark).To(Equal(uint32(0x08000010)))
+		Expect(MaxNumber(0x0a000010)).To(Equal(7))
+	})
+	It("should reject numbers that don't fit", func() {
+		_, err := MapNumberToMark(8, 0x0a000010)
+		Expect(err).To(HaveOccurred())
+		_, err = MapNumberToMark(-1, 0x0a000010)
+		Expect(err).To(HaveOccurred())
+	})
+	It("should map zero to no bits", func() {
+		Expect(MapNumberToMark(0, 0)).To(Equal(uint32(0)))
+	})
+})
@@ -0,0 +1,145 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The nfacct package manages the kernel's nfacct accounting objects, which
+// the rules.AccountingChain counts traffic into, and exports their counts
+// as metrics.  Reading an object's counts is much cheaper than listing the
+// iptables rules and parsing their per-rule counters.
+package nfacct
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"github.com/prometheus/client_golang/prometheus"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	gaugePackets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "felix_nfacct_packets",
+		Help: "Number of packets accounted to each nfacct object.",
+	}, []string{"name"})
+	gaugeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "felix_nfacct_bytes",
+		Help: "Number of bytes accounted to each nfacct object.",
+	}, []string{"name"})
+)
+
+func init() {
+	prometheus.MustRegister(gaugePackets)
+	prometheus.MustRegister(gaugeBytes)
+}
+
+// listLineRegexp matches a line of the output of "nfacct list", for
+// example:
+//
+//	{ pkts = 00000000000000000012, bytes = 00000000000000003456 } = cali-pods;
+var listLineRegexp = regexp.MustCompile(`pkts = (\d+), bytes = (\d+).*\} = ([^;]+);`)
+
+// Counts are the counts of an nfacct object.
+type Counts struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+type Accounting struct {
+	newCmd cmdshim.NewCmd
+	// names are the names of the objects that we manage.
+	names []string
+}
+
+func New(names []string) *Accounting {
+	return NewWithCmdShim(names, cmdshim.NewRealCmd)
+}
+
+// NewWithCmdShim is a test constructor that allows for shimming exec.Command.
+func NewWithCmdShim(names []string, shim cmdshim.NewCmd) *Accounting {
+	return &Accounting{
+		newCmd: shim,
+		names:  names,
+	}
+}
+
+// EnsureObjects creates the nfacct objects, if they don't already exist.
+// It must succeed before the rules that reference them are programmed.
+func (a *Accounting) EnsureObjects() error {
+	for _, name := range a.names {
+		output, err := a.newCmd("nfacct", "add", name).CombinedOutput()
+		if err != nil && !strings.Contains(string(output), "File exists") {
+			log.WithError(err).WithFields(log.Fields{
+				"name":   name,
+				"output": string(output),
+			}).Error("Failed to create nfacct object")
+			return err
+		}
+	}
+	return nil
+}
+
+// Read returns the counts of all the nfacct objects, including those that
+// we don't manage.
+func (a *Accounting) Read() (map[string]Counts, error) {
+	output, err := a.newCmd("nfacct", "list").CombinedOutput()
+	if err != nil {
+		log.WithError(err).WithField("output", string(output)).Warn(
+			"Failed to list nfacct objects")
+		return nil, err
+	}
+	counts := map[string]Counts{}
+	for _, line := range strings.Split(string(output), "\n") {
+		m := listLineRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		packets, _ := strconv.ParseUint(m[1], 10, 64)
+		bytes, _ := strconv.ParseUint(m[2], 10, 64)
+		counts[strings.TrimSpace(m[3])] = Counts{Packets: packets, Bytes: bytes}
+	}
+	return counts, nil
+}
+
+// UpdateMetrics reads the counts of the managed objects into the metrics.
+func (a *Accounting) UpdateMetrics() error {
+	counts, err := a.Read()
+	if err != nil {
+		return err
+	}
+	for _, name := range a.names {
+		c, ok := counts[name]
+		if !ok {
+			log.WithField("name", name).Warn("nfacct object missing")
+			continue
+		}
+		gaugePackets.WithLabelValues(name).Set(float64(c.Packets))
+		gaugeBytes.WithLabelValues(name).Set(float64(c.Bytes))
+	}
+	return nil
+}
+
+// Run creates the objects and then updates the metrics every interval.
+// It only returns if the objects can't be created.
+func (a *Accounting) Run(interval time.Duration) error {
+	if err := a.EnsureObjects(); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.UpdateMetrics()
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfacct_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/nfacct"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+)
+
+const listOutput = `{ pkts = 00000000000000000012, bytes = 00000000000000003456 } = cali-pods;
+{ pkts = 00000000000000000000, bytes = 00000000000000000000 } = other;
+`
+
+var _ = Describe("Accounting", func() {
+	var accounting *Accounting
+	var cmdRec *cmdshim.Recorder
+	BeforeEach(func() {
+		cmdRec = &cmdshim.Recorder{}
+		accounting = NewWithCmdShim([]string{"cali-pods", "cali-nodes"}, cmdRec.NewCmd)
+	})
+
+	It("should create the objects", func() {
+		Expect(accounting.EnsureObjects()).To(Succeed())
+		Expect(cmdRec.Commands()).To(Equal([]string{
+			"nfacct add cali-pods",
+			"nfacct add cali-nodes",
+		}))
+	})
+	It("should ignore objects that already exist", func() {
+		cmdRec.Output = "nfacct v1.0.2: File exists"
+		cmdRec.FailAll = true
+		Expect(accounting.EnsureObjects()).To(Succeed())
+	})
+	It("should fail if an object can't be created", func() {
+		cmdRec.Output = "nfacct v1.0.2: Operation not permitted"
+		cmdRec.FailAll = true
+		Expect(accounting.EnsureObjects()).NotTo(Succeed())
+		Expect(cmdRec.Commands()).To(HaveLen(1))
+	})
+
+	It("should read the counts", func() {
+		cmdRec.Output = listOutput
+		Expect(accounting.Read()).To(Equal(map[string]Counts{
+			"cali-pods": {Packets: 12, Bytes: 3456},
+			"other":     {},
+		}))
+		Expect(cmdRec.Commands()).To(Equal([]string{"nfacct list"}))
+	})
+	It("should report a failure to read the counts", func() {
+		cmdRec.FailAll = true
+		_, err := accounting.Read()
+		Expect(err).To(HaveOccurred())
+		Expect(accounting.UpdateMetrics()).NotTo(Succeed())
+	})
+	It("should update the metrics despite missing objects", func() {
+		cmdRec.Output = listOutput
+		Expect(accounting.UpdateMetrics()).To(Succeed())
+	})
+})
@@ -0,0 +1,213 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The nfnetlink package contains the parts of the netfilter netlink
+// protocol that Felix uses to listen to the kernel: NFLOG and conntrack
+// events, and conntrack table statistics.
+package nfnetlink
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unsafe"
+)
+
+// Constants from the linux/netfilter/nfnetlink*.h headers.
+const (
+	SubsysCTNetlink = 1
+	SubsysULog      = 4
+
+	NflogPacketMsgType = SubsysULog<<8 | 0
+	NflogConfigMsgType = SubsysULog<<8 | 1
+
+	CtGetMsgType      = SubsysCTNetlink<<8 | 1
+	CtGetStatsMsgType = SubsysCTNetlink<<8 | 5
+
+	// GenMsgLen is the length of the nfgenmsg header that starts each
+	// netfilter message.
+	GenMsgLen = 4
+
+	attrHdrLen   = 4
+	attrTypeMask = 0x3fff
+
+	nfulaPayload = 9
+	nfulaPrefix  = 10
+
+	nfulaCfgCmd      = 1
+	nfulaCfgMode     = 2
+	nfulnlCfgCmdBind = 1
+	nfulnlCfgPFBind  = 3
+	nfulnlCopyPacket = 2
+
+	ctaTupleOrig             = 1
+	ctaTupleProto            = 2
+	ctaProtoNum              = 1
+	ctaStatsGlobalEntries    = 1
+	ctaStatsGlobalMaxEntries = 2
+)
+
+var (
+	ErrTruncated   = errors.New("truncated netlink message")
+	ErrMissingAttr = errors.New("netlink message is missing a required attribute")
+)
+
+// NativeEndian is the byte order of the host, which netlink uses for its
+// headers.
+var NativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		NativeEndian = binary.BigEndian
+	}
+}
+
+// NflogPacket is a packet that an NFLOG rule sent to userspace.
+type NflogPacket struct {
+	Group  uint16
+	Prefix string
+	// Payload is the start of the packet, from its IP header.  It's
+	// truncated to the copy range that was requested for the group.
+	Payload []byte
+}
+
+// ParseNflogPacket parses an NFLOG packet message, without its netlink
+// header.
+func ParseNflogPacket(data []byte) (*NflogPacket, error) {
+	if len(data) < GenMsgLen {
+		return nil, ErrTruncated
+	}
+	attrs, err := ParseAttrs(data[GenMsgLen:])
+	if err != nil {
+		return nil, err
+	}
+	prefix, ok := attrs[nfulaPrefix]
+	if !ok {
+		return nil, ErrMissingAttr
+	}
+	payload, ok := attrs[nfulaPayload]
+	if !ok {
+		return nil, ErrMissingAttr
+	}
+	return &NflogPacket{
+		// The group number is in the resource ID of the nfgenmsg
+		// header.
+		Group:   binary.BigEndian.Uint16(data[2:4]),
+		Prefix:  strings.TrimRight(string(prefix), "\x00"),
+		Payload: payload,
+	}, nil
+}
+
+// ParseAttrs parses a sequence of netlink attributes into a map from
+// attribute type to value.  A nil slice parses as no attributes.
+func ParseAttrs(b []byte) (map[uint16][]byte, error) {
+	attrs := map[uint16][]byte{}
+	for len(b) >= attrHdrLen {
+		attrLen := int(NativeEndian.Uint16(b[0:2]))
+		attrType := NativeEndian.Uint16(b[2:4]) & attrTypeMask
+		if attrLen < attrHdrLen || attrLen > len(b) {
+			return nil, ErrTruncated
+		}
+		attrs[attrType] = b[attrHdrLen:attrLen]
+		// Attributes are padded to a multiple of 4 bytes; the last one
+		// may not be.
+		paddedLen := (attrLen + 3) &^ 3
+		if paddedLen >= len(b) {
+			break
+		}
+		b = b[paddedLen:]
+	}
+	return attrs, nil
+}
+
+// EncodeAttr encodes a netlink attribute, including its padding.
+func EncodeAttr(attrType uint16, value []byte) []byte {
+	attrLen := attrHdrLen + len(value)
+	b := make([]byte, (attrLen+3)&^3)
+	NativeEndian.PutUint16(b[0:2], uint16(attrLen))
+	NativeEndian.PutUint16(b[2:4], attrType)
+	copy(b[attrHdrLen:], value)
+	return b
+}
+
+// GenMsg encodes the nfgenmsg header of a netfilter message.
+func GenMsg(family uint8, resID uint16) []byte {
+	b := make([]byte, GenMsgLen)
+	b[0] = family
+	binary.BigEndian.PutUint16(b[2:4], resID)
+	return b
+}
+
+// ConntrackStats are the global conntrack statistics.
+type ConntrackStats struct {
+	Entries uint32
+	// MaxEntries is the size limit of the table, or 0 if the kernel is too
+	// old to report it.
+	MaxEntries uint32
+}
+
+// ParseConntrackStats parses the reply to a CtGetStatsMsgType request,
+// without its netlink header.
+func ParseConntrackStats(data []byte) (*ConntrackStats, error) {
+	if len(data) < GenMsgLen {
+		return nil, ErrTruncated
+	}
+	attrs, err := ParseAttrs(data[GenMsgLen:])
+	if err != nil {
+		return nil, err
+	}
+	entries, ok := attrs[ctaStatsGlobalEntries]
+	if !ok {
+		return nil, ErrMissingAttr
+	}
+	if len(entries) < 4 {
+		return nil, ErrTruncated
+	}
+	stats := &ConntrackStats{Entries: binary.BigEndian.Uint32(entries)}
+	if maxEntries := attrs[ctaStatsGlobalMaxEntries]; len(maxEntries) >= 4 {
+		stats.MaxEntries = binary.BigEndian.Uint32(maxEntries)
+	}
+	return stats, nil
+}
+
+// ParseConntrackProtocol parses the IP protocol number of a conntrack entry
+// from a CtGetMsgType message, without its netlink header.
+func ParseConntrackProtocol(data []byte) (uint8, error) {
+	if len(data) < GenMsgLen {
+		return 0, ErrTruncated
+	}
+	attrs, err := ParseAttrs(data[GenMsgLen:])
+	if err != nil {
+		return 0, err
+	}
+	// The protocol is nested in the proto part of the original tuple.
+	for _, attrType := range []uint16{ctaTupleOrig, ctaTupleProto} {
+		nested, ok := attrs[attrType]
+		if !ok {
+			return 0, ErrMissingAttr
+		}
+		if attrs, err = ParseAttrs(nested); err != nil {
+			return 0, err
+		}
+	}
+	protoNum, ok := attrs[ctaProtoNum]
+	if !ok {
+		return 0, ErrMissingAttr
+	}
+	if len(protoNum) < 1 {
+		return 0, ErrTruncated
+	}
+	return protoNum[0], nil
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfnetlink_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/nfnetlink"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Attributes", func() {
+	It("should round-trip padded attributes", func() {
+		b := append(EncodeAttr(1, []byte("abcde")), EncodeAttr(2, []byte{7})...)
+		Expect(b).To(HaveLen(20))
+		attrs, err := ParseAttrs(b)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attrs).To(Equal(map[uint16][]byte{
+			1: []byte("abcde"),
+			2: {7},
+		}))
+	})
+	It("should parse nil as no attributes", func() {
+		Expect(ParseAttrs(nil)).To(BeEmpty())
+	})
+	It("should reject a truncated attribute", func() {
+		b := EncodeAttr(1, []byte("abcde"))
+		_, err := ParseAttrs(b[:6])
+		Expect(err).To(Equal(ErrTruncated))
+	})
+})
+
+var _ = Describe("ParseNflogPacket", func() {
+	const (
+		nfulaPayload = 9
+		nfulaPrefix  = 10
+	)
+
+	It("should parse the group, prefix and payload", func() {
+		msg := GenMsg(2, 3)
+		msg = append(msg, EncodeAttr(nfulaPrefix, []byte("prefix\x00"))...)
+		msg = append(msg, EncodeAttr(nfulaPayload, []byte{0x45, 0, 0, 20})...)
+		Expect(ParseNflogPacket(msg)).To(Equal(&NflogPacket{
+			Group:   3,
+			Prefix:  "prefix",
+			Payload: []byte{0x45, 0, 0, 20},
+		}))
+	})
+	It("should reject a packet without a payload", func() {
+		msg := GenMsg(2, 3)
+		msg = append(msg, EncodeAttr(nfulaPrefix, []byte("prefix\x00"))...)
+		_, err := ParseNflogPacket(msg)
+		Expect(err).To(Equal(ErrMissingAttr))
+	})
+	It("should reject a truncated header", func() {
+		_, err := ParseNflogPacket([]byte{2, 0})
+		Expect(err).To(Equal(ErrTruncated))
+	})
+})
+
+var _ = Describe("ParseConntrackStats", func() {
+	It("should parse the entries and limit", func() {
+		msg := GenMsg(0, 0)
+		msg = append(msg, EncodeAttr(1, []byte{0, 0, 0x01, 0x00})...)
+		msg = append(msg, EncodeAttr(2, []byte{0, 0x01, 0, 0})...)
+		Expect(ParseConntrackStats(msg)).To(Equal(&ConntrackStats{
+			Entries:    256,
+			MaxEntries: 65536,
+		}))
+	})
+	It("should allow the limit to be missing", func() {
+		msg := append(GenMsg(0, 0), EncodeAttr(1, []byte{0, 0, 0, 7})...)
+		Expect(ParseConntrackStats(msg)).To(Equal(&ConntrackStats{Entries: 7}))
+	})
+	It("should reject stats without the entries", func() {
+		_, err := ParseConntrackStats(GenMsg(0, 0))
+		Expect(err).To(Equal(ErrMissingAttr))
+	})
+})
+
+var _ = Describe("ParseConntrackProtocol", func() {
+	const (
+		ctaTupleOrig  = 1
+		ctaTupleProto = 2
+		ctaProtoNum   = 1
+	)
+
+	It("should parse the protocol of the original tuple", func() {
+		proto := EncodeAttr(ctaTupleProto, EncodeAttr(ctaProtoNum, []byte{17}))
+		msg := append(GenMsg(2, 0), EncodeAttr(ctaTupleOrig, proto)...)
+		Expect(ParseConntrackProtocol(msg)).To(Equal(uint8(17)))
+	})
+	It("should reject an entry without a protocol", func() {
+		msg := append(GenMsg(2, 0), EncodeAttr(ctaTupleOrig, nil)...)
+		_, err := ParseConntrackProtocol(msg)
+		Expect(err).To(Equal(ErrMissingAttr))
+	})
+	It("should reject a truncated header", func() {
+		_, err := ParseConntrackProtocol([]byte{2})
+		Expect(err).To(Equal(ErrTruncated))
+	})
+})
@@ -0,0 +1,276 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfnetlink
+
+import (
+	"encoding/binary"
+	log "github.com/Sirupsen/logrus"
+	"syscall"
+	"time"
+)
+
+// receiveBufferSize is the size of the sockets' receive buffers.  If the
+// buffer overflows, messages are lost.
+const receiveBufferSize = 4 * 1024 * 1024
+
+// stopPollInterval is how often ReceiveUntil checks its stop channel.
+const stopPollInterval = time.Second
+
+// Socket is a netlink socket for the netfilter subsystems.
+type Socket struct {
+	fd  int
+	seq uint32
+}
+
+// OpenSocket opens a socket that is subscribed to the given multicast
+// groups.
+func OpenSocket(groups uint32) (*Socket, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC,
+		syscall.NETLINK_NETFILTER)
+	if err != nil {
+		log.WithError(err).Error("Failed to open netfilter netlink socket")
+		return nil, err
+	}
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, receiveBufferSize)
+	if err != nil {
+		log.WithError(err).Warn("Failed to increase netlink receive buffer size")
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: groups,
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to bind netfilter netlink socket")
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &Socket{fd: fd}, nil
+}
+
+func (s *Socket) Close() error {
+	return syscall.Close(s.fd)
+}
+
+// Request sends a netfilter request and waits for the kernel to
+// acknowledge it.
+func (s *Socket) Request(msgType uint16, parts ...[]byte) error {
+	return s.Query(msgType, 0, nil, parts...)
+}
+
+// Query sends a netfilter request, with the given extra flags, and passes
+// each of the kernel's replies to the handler until the kernel acknowledges
+// the request or, for a dump, finishes the dump.
+func (s *Socket) Query(msgType uint16, flags uint16, handle func(msgType uint16, data []byte), parts ...[]byte) error {
+	s.seq++
+	msg := make([]byte, syscall.NLMSG_HDRLEN)
+	for _, part := range parts {
+		msg = append(msg, part...)
+	}
+	NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	NativeEndian.PutUint16(msg[4:6], msgType)
+	NativeEndian.PutUint16(msg[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags)
+	NativeEndian.PutUint32(msg[8:12], s.seq)
+	err := syscall.Sendto(s.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return err
+	}
+
+	// Dumps batch several replies into each read.
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := syscall.Recvfrom(s.fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != s.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return ErrTruncated
+				}
+				if errno := int32(NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return syscall.Errno(-errno)
+				}
+				return nil
+			default:
+				if handle != nil {
+					handle(m.Header.Type, m.Data)
+				}
+			}
+		}
+	}
+}
+
+// Receive reads messages from the socket, passing each one to the handler,
+// until it fails.
+func (s *Socket) Receive(handle func(msgType uint16, data []byte)) error {
+	return s.ReceiveUntil(nil, handle)
+}
+
+// ReceiveUntil is like Receive but it also returns, with a nil error, once
+// the stop channel is closed.  The socket is polled for the stop signal
+// every stopPollInterval, so the return can lag the close by that long.
+func (s *Socket) ReceiveUntil(stop <-chan struct{}, handle func(msgType uint16, data []byte)) error {
+	if stop != nil {
+		tv := syscall.NsecToTimeval(stopPollInterval.Nanoseconds())
+		err := syscall.SetsockoptTimeval(s.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+		if err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := syscall.Recvfrom(s.fd, buf, 0)
+		if stop != nil && stopped(stop) {
+			return nil
+		}
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			continue
+		} else if err == syscall.ENOBUFS {
+			log.Warn("Netlink receive buffer overflowed, some messages were lost")
+			continue
+		} else if err != nil {
+			log.WithError(err).Error("Failed to read from netfilter netlink socket")
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			log.WithError(err).Warn("Failed to parse netlink messages")
+			continue
+		}
+		for _, m := range msgs {
+			handle(m.Header.Type, m.Data)
+		}
+	}
+}
+
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadNflog binds the given NFLOG groups, asking for the first copyRange
+// bytes of each packet, and then passes the packets to the handler until
+// it fails.
+func ReadNflog(groups []uint16, copyRange uint32, handle func(*NflogPacket)) error {
+	return ReadNflogUntil(groups, copyRange, nil, handle)
+}
+
+// ReadNflogUntil is like ReadNflog but it also returns, with a nil error,
+// once the stop channel is closed.  Closing the socket unbinds the groups,
+// so another listener can then bind them.
+func ReadNflogUntil(groups []uint16, copyRange uint32, stop <-chan struct{}, handle func(*NflogPacket)) error {
+	sock, err := OpenSocket(0)
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+
+	// Older kernels require a listener to bind each address family; newer
+	// ones ignore the command.
+	for _, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		err := sock.Request(NflogConfigMsgType,
+			GenMsg(family, 0),
+			EncodeAttr(nfulaCfgCmd, []byte{nfulnlCfgPFBind}))
+		if err != nil {
+			log.WithError(err).WithField("family", family).Info(
+				"Failed to bind NFLOG to address family, continuing")
+		}
+	}
+	for _, group := range groups {
+		mode := make([]byte, 6)
+		binary.BigEndian.PutUint32(mode[0:4], copyRange)
+		mode[4] = nfulnlCopyPacket
+		err := sock.Request(NflogConfigMsgType,
+			GenMsg(syscall.AF_UNSPEC, group),
+			EncodeAttr(nfulaCfgCmd, []byte{nfulnlCfgCmdBind}),
+			EncodeAttr(nfulaCfgMode, mode))
+		if err != nil {
+			log.WithError(err).WithField("group", group).Error("Failed to bind NFLOG group")
+			return err
+		}
+	}
+	log.WithField("groups", groups).Info("Listening for NFLOG packets")
+
+	return sock.ReceiveUntil(stop, func(msgType uint16, data []byte) {
+		if msgType != NflogPacketMsgType {
+			return
+		}
+		pkt, err := ParseNflogPacket(data)
+		if err != nil {
+			log.WithError(err).Debug("Ignoring malformed NFLOG packet")
+			return
+		}
+		handle(pkt)
+	})
+}
+
+// ReadConntrackStats reads the global conntrack statistics and then dumps
+// the conntrack table, passing the IP protocol of each entry to the handler.
+// The dump is a snapshot, so its entries may not add up to the statistics.
+func ReadConntrackStats(handleProtocol func(protocol uint8)) (*ConntrackStats, error) {
+	sock, err := OpenSocket(0)
+	if err != nil {
+		return nil, err
+	}
+	defer sock.Close()
+
+	var stats *ConntrackStats
+	err = sock.Query(CtGetStatsMsgType, 0, func(msgType uint16, data []byte) {
+		if msgType != CtGetStatsMsgType {
+			return
+		}
+		parsed, err := ParseConntrackStats(data)
+		if err != nil {
+			log.WithError(err).Warn("Failed to parse conntrack statistics")
+			return
+		}
+		stats = parsed
+	}, GenMsg(syscall.AF_UNSPEC, 0))
+	if err != nil {
+		return nil, err
+	}
+	if stats == nil {
+		return nil, ErrMissingAttr
+	}
+
+	err = sock.Query(CtGetMsgType, syscall.NLM_F_DUMP, func(msgType uint16, data []byte) {
+		protocol, err := ParseConntrackProtocol(data)
+		if err != nil {
+			log.WithError(err).Debug("Ignoring malformed conntrack entry")
+			return
+		}
+		handleProtocol(protocol)
+	}, GenMsg(syscall.AF_UNSPEC, 0))
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
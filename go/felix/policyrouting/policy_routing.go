@@ -0,0 +1,400 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The policyrouting package manages the policy routing that sends marked
+// traffic through a custom routing table: the "ip rule" entries that match
+// a fwmark and the routes in the tables that they look up.  Features such
+// as direct server return and the egress gateway each own a set of rules
+// and routes, and the Manager merges them and programs the result.
+//
+// The Manager marks what it programs as its own, so that it can clean up
+// the rules and routes that it no longer wants, even after a restart: its
+// rules all have the configured priority and its routes have protocol
+// RouteProtocol.  It never touches anything else, nor any route in a table
+// numbered below MinTable, which includes the kernel's main and local
+// tables.
+package policyrouting
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// RouteProtocol marks the routes that we program, in the routes'
+	// protocol field.
+	RouteProtocol = 80
+	// MinTable is the lowest routing table that we manage.  The tables
+	// below it are reserved by the kernel or in common use.
+	MinTable = 256
+	// DefaultRulePriority is the priority of our rules unless configured
+	// otherwise.  It puts them ahead of the kernel's main table (32766).
+	DefaultRulePriority = 100
+)
+
+// Owners of rules and routes.
+const (
+	OwnerDSR           = "dsr"
+	OwnerEgressGateway = "egress-gateway"
+)
+
+// Rule is an "ip rule" that sends the traffic whose mark matches Mark,
+// under Mask, to routing table Table.
+type Rule struct {
+	Mark  uint32
+	Mask  uint32
+	Table int
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("fwmark %#x/%#x lookup %d", r.Mark, r.Mask, r.Table)
+}
+
+// Route is a route in one of the custom routing tables.  Dst is "default"
+// or a CIDR.  Via and Dev are optional; OnLink has the route treat its
+// gateway as directly connected to Dev.
+type Route struct {
+	Table  int
+	Dst    string
+	Via    string
+	Dev    string
+	OnLink bool
+}
+
+type Config struct {
+	// IPVersion is the IP version of the rules and routes; 4 or 6.
+	IPVersion uint8
+	// RulePriority is the priority of our rules.  Any rule with this
+	// priority is considered ours, so no other software may use it.
+	// Defaults to DefaultRulePriority.
+	RulePriority int
+}
+
+// Manager programs the policy routing of one IP version.  Each owner
+// replaces its rules and routes wholesale with SetRules and SetRoutes, and
+// Apply brings the dataplane in line.  It isn't safe for concurrent use.
+type Manager struct {
+	config Config
+	newCmd cmdshim.NewCmd
+
+	rulesByOwner  map[string][]Rule
+	routesByOwner map[string][]Route
+	dirty         bool
+}
+
+func New(config Config) *Manager {
+	return NewWithCmdShim(config, cmdshim.NewRealCmd)
+}
+
+// NewWithCmdShim is a test constructor that allows for shimming exec.Command.
+func NewWithCmdShim(config Config, shim cmdshim.NewCmd) *Manager {
+	if config.RulePriority == 0 {
+		config.RulePriority = DefaultRulePriority
+	}
+	return &Manager{
+		config:        config,
+		newCmd:        shim,
+		rulesByOwner:  map[string][]Rule{},
+		routesByOwner: map[string][]Route{},
+		// Clean up after any previous run on the first Apply.
+		dirty: true,
+	}
+}
+
+// SetRules replaces the rules of the given owner.
+func (m *Manager) SetRules(owner string, rules []Rule) {
+	log.WithFields(log.Fields{"owner": owner, "rules": rules}).Debug("Policy routing rules updated")
+	m.rulesByOwner[owner] = rules
+	m.dirty = true
+}
+
+// SetRoutes replaces the routes of the given owner.  Routes in tables below
+// MinTable are ignored.
+func (m *Manager) SetRoutes(owner string, routes []Route) {
+	log.WithFields(log.Fields{"owner": owner, "routes": routes}).Debug("Policy routing routes updated")
+	m.routesByOwner[owner] = routes
+	m.dirty = true
+}
+
+// SetDSRRoutes replaces the rules and routes that send DSR traffic to other
+// hosts.  It implements services.RouteTable.
+func (m *Manager) SetDSRRoutes(dsrRoutes []rules.DSRRoute) {
+	var ipRules []Rule
+	var routes []Route
+	for _, r := range dsrRoutes {
+		ipRules = append(ipRules, Rule{Mark: r.Mark, Mask: r.Mask, Table: r.Table})
+		routes = append(routes, Route{
+			Table:  r.Table,
+			Dst:    "default",
+			Via:    r.HostAddr,
+			Dev:    rules.DSRTunnelDevice,
+			OnLink: true,
+		})
+	}
+	m.SetRules(OwnerDSR, ipRules)
+	m.SetRoutes(OwnerDSR, routes)
+}
+
+// SetEgressGatewayRoute replaces the rule and route that send marked traffic
+// to the egress gateway; if ok is false, there are none, as returned by
+// rules.RuleRenderer.EgressGatewayRoute on a host that isn't a client.
+func (m *Manager) SetEgressGatewayRoute(route rules.EgressGatewayRoute, ok bool) {
+	if !ok {
+		m.SetRules(OwnerEgressGateway, nil)
+		m.SetRoutes(OwnerEgressGateway, nil)
+		return
+	}
+	m.SetRules(OwnerEgressGateway, []Rule{{Mark: route.Mark, Mask: route.Mark, Table: route.Table}})
+	m.SetRoutes(OwnerEgressGateway, []Route{{Table: route.Table, Dst: "default", Via: route.GatewayAddr}})
+}
+
+// QueueResync has the next Apply check the dataplane, even if nothing has
+// changed, to repair any rules or routes that were removed or added behind
+// our back.
+func (m *Manager) QueueResync() {
+	m.dirty = true
+}
+
+// Apply programs the rules and routes and removes the stale ones that we
+// own.  If it fails, the next Apply tries again.
+func (m *Manager) Apply() error {
+	if !m.dirty {
+		return nil
+	}
+	if err := m.applyRules(); err != nil {
+		return err
+	}
+	if err := m.applyRoutes(); err != nil {
+		return err
+	}
+	m.dirty = false
+	return nil
+}
+
+func (m *Manager) applyRules() error {
+	desired := map[string]Rule{}
+	for _, ownerRules := range m.rulesByOwner {
+		for _, rule := range ownerRules {
+			desired[rule.String()] = rule
+		}
+	}
+	output, err := m.ip("rule", "show")
+	if err != nil {
+		return err
+	}
+	present := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		priority, spec, ok := parseRuleLine(line)
+		if !ok || priority != m.config.RulePriority {
+			continue
+		}
+		if _, ok := desired[spec]; ok {
+			present[spec] = true
+			continue
+		}
+		log.WithField("rule", spec).Info("Removing stale policy routing rule")
+		args := append([]string{"rule", "del", "priority", strconv.Itoa(priority)}, strings.Fields(spec)...)
+		if _, err := m.ip(args...); err != nil {
+			return err
+		}
+	}
+	specs := []string{}
+	for spec := range desired {
+		if !present[spec] {
+			specs = append(specs, spec)
+		}
+	}
+	sort.Strings(specs)
+	for _, spec := range specs {
+		rule := desired[spec]
+		log.WithField("rule", spec).Info("Adding policy routing rule")
+		if _, err := m.ip("rule", "add",
+			"priority", strconv.Itoa(m.config.RulePriority),
+			"fwmark", fmt.Sprintf("%#x/%#x", rule.Mark, rule.Mask),
+			"lookup", strconv.Itoa(rule.Table),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) applyRoutes() error {
+	desired := map[string]Route{}
+	for owner, routes := range m.routesByOwner {
+		for _, route := range routes {
+			if route.Table < MinTable {
+				log.WithFields(log.Fields{"owner": owner, "route": route}).Warn(
+					"Ignoring route in reserved routing table")
+				continue
+			}
+			desired[routeKey(route.Table, m.normaliseDst(route.Dst))] = route
+		}
+	}
+	output, err := m.ip("route", "show", "table", "all", "proto", strconv.Itoa(RouteProtocol))
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(output, "\n") {
+		table, dst, ok := parseRouteLine(line)
+		if !ok || table < MinTable {
+			continue
+		}
+		if _, ok := desired[routeKey(table, m.normaliseDst(dst))]; ok {
+			continue
+		}
+		log.WithFields(log.Fields{"table": table, "dst": dst}).Info("Removing stale policy routing route")
+		if _, err := m.ip("route", "del", dst,
+			"table", strconv.Itoa(table),
+			"proto", strconv.Itoa(RouteProtocol),
+		); err != nil {
+			return err
+		}
+	}
+	// "route replace" is idempotent, and corrects a route whose gateway
+	// or device changed, so we don't need to compare the routes in detail.
+	keys := []string{}
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		route := desired[key]
+		args := []string{"route", "replace", route.Dst}
+		if route.Via != "" {
+			args = append(args, "via", route.Via)
+		}
+		if route.Dev != "" {
+			args = append(args, "dev", route.Dev)
+		}
+		if route.OnLink {
+			args = append(args, "onlink")
+		}
+		args = append(args,
+			"table", strconv.Itoa(route.Table),
+			"proto", strconv.Itoa(RouteProtocol),
+		)
+		if _, err := m.ip(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ip runs the ip command for our IP version.
+func (m *Manager) ip(args ...string) (string, error) {
+	args = append([]string{fmt.Sprintf("-%d", m.config.IPVersion)}, args...)
+	output, err := m.newCmd("ip", args...).CombinedOutput()
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"args":   args,
+			"output": string(output),
+		}).Error("Failed to update policy routing")
+		return "", err
+	}
+	return string(output), nil
+}
+
+// normaliseDst gives a single address the prefix length that "ip route
+// show" omits, so that the routes we list match the ones we want.
+func (m *Manager) normaliseDst(dst string) string {
+	if dst == "default" || strings.Contains(dst, "/") {
+		return dst
+	}
+	if m.config.IPVersion == 6 {
+		return dst + "/128"
+	}
+	return dst + "/32"
+}
+
+func routeKey(table int, dst string) string {
+	return fmt.Sprintf("%d %s", table, dst)
+}
+
+// parseRuleLine parses a line of "ip rule show" that matches a fwmark and
+// looks up a numbered table, such as
+//
+//	100:	from all fwmark 0x40/0x40 lookup 999
+//
+// and returns the rule's priority and its spec, as returned by
+// Rule.String.
+func parseRuleLine(line string) (priority int, spec string, ok bool) {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 {
+		return
+	}
+	priority, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, "", false
+	}
+	var rule Rule
+	var haveMark, haveTable bool
+	fields := strings.Fields(parts[1])
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "fwmark":
+			markParts := strings.SplitN(fields[i+1], "/", 2)
+			mark, err := strconv.ParseUint(markParts[0], 0, 32)
+			if err != nil {
+				return
+			}
+			// The mask is omitted if it is all ones.
+			mask := uint64(0xffffffff)
+			if len(markParts) == 2 {
+				if mask, err = strconv.ParseUint(markParts[1], 0, 32); err != nil {
+					return
+				}
+			}
+			rule.Mark, rule.Mask = uint32(mark), uint32(mask)
+			haveMark = true
+		case "lookup", "table":
+			table, err := strconv.Atoi(fields[i+1])
+			if err != nil {
+				return
+			}
+			rule.Table = table
+			haveTable = true
+		}
+	}
+	if !haveMark || !haveTable {
+		return
+	}
+	return priority, rule.String(), true
+}
+
+// parseRouteLine parses a line of "ip route show table all", such as
+//
+//	default via 10.0.0.1 dev eth0 table 999 proto 80 onlink
+//
+// and returns the route's table and destination.  Routes in the main table,
+// which don't list a table, are skipped.
+func parseRouteLine(line string) (table int, dst string, ok bool) {
+	fields := strings.Fields(line)
+	for i := 1; i+1 < len(fields); i++ {
+		if fields[i] != "table" {
+			continue
+		}
+		table, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			return 0, "", false
+		}
+		return table, fields[0], true
+	}
+	return 0, "", false
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policyrouting_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/policyrouting"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"github.com/projectcalico/felix/go/felix/rules"
+)
+
+const ruleShowOutput = `0:	from all lookup local
+100:	from all fwmark 0x40/0x40 lookup 999
+100:	from all fwmark 0x80 lookup 1001
+200:	from all fwmark 0x100/0x100 lookup 2000
+32766:	from all lookup main
+32767:	from all lookup default
+`
+
+const routeShowOutput = `default via 10.0.0.1 dev eth0 table 999 proto 80
+default via 10.0.1.1 dev tunl0 table 1001 proto 80 onlink
+10.0.2.1 dev eth0 table 1002 proto 80
+10.0.3.0/24 dev eth0 proto 80
+`
+
+var _ = Describe("Manager", func() {
+	var manager *Manager
+	var cmdRec *cmdshim.Recorder
+
+	BeforeEach(func() {
+		cmdRec = &cmdshim.Recorder{Outputs: map[string]string{}}
+		manager = NewWithCmdShim(Config{IPVersion: 4}, cmdRec.NewCmd)
+	})
+
+	It("should clean up the rules and routes it owns on the first apply", func() {
+		cmdRec.Outputs["ip -4 rule show"] = ruleShowOutput
+		cmdRec.Outputs["ip -4 route show table all proto 80"] = routeShowOutput
+		Expect(manager.Apply()).To(Succeed())
+		Expect(cmdRec.Commands()).To(Equal([]string{
+			"ip -4 rule show",
+			"ip -4 rule del priority 100 fwmark 0x40/0x40 lookup 999",
+			"ip -4 rule del priority 100 fwmark 0x80/0xffffffff lookup 1001",
+			"ip -4 route show table all proto 80",
+			"ip -4 route del default table 999 proto 80",
+			"ip -4 route del default table 1001 proto 80",
+			"ip -4 route del 10.0.2.1 table 1002 proto 80",
+		}))
+	})
+
+	It("should program the DSR and egress gateway rules and routes", func() {
+		cmdRec.Outputs["ip -4 rule show"] = ruleShowOutput
+		cmdRec.Outputs["ip -4 route show table all proto 80"] = routeShowOutput
+		manager.SetDSRRoutes([]rules.DSRRoute{
+			{Mark: 0x80, Mask: 0x180, Table: 1001, HostAddr: "10.0.1.1"},
+		})
+		manager.SetEgressGatewayRoute(rules.EgressGatewayRoute{
+			Mark: 0x40, Table: 999, GatewayAddr: "10.0.0.1",
+		}, true)
+		Expect(manager.Apply()).To(Succeed())
+		Expect(cmdRec.Commands()).To(Equal([]string{
+			"ip -4 rule show",
+			"ip -4 rule del priority 100 fwmark 0x80/0xffffffff lookup 1001",
+			"ip -4 rule add priority 100 fwmark 0x80/0x180 lookup 1001",
+			"ip -4 route show table all proto 80",
+			"ip -4 route del 10.0.2.1 table 1002 proto 80",
+			"ip -4 route replace default via 10.0.1.1 dev tunl0 onlink table 1001 proto 80",
+			"ip -4 route replace default via 10.0.0.1 table 999 proto 80",
+		}))
+	})
+
+	It("should only apply when something changed or a resync is queued", func() {
+		Expect(manager.Apply()).To(Succeed())
+		cmdRec.Reset()
+		Expect(manager.Apply()).To(Succeed())
+		Expect(cmdRec.Commands()).To(BeEmpty())
+		manager.QueueResync()
+		Expect(manager.Apply()).To(Succeed())
+		Expect(cmdRec.Commands()).To(HaveLen(2))
+	})
+
+	It("should retry after a failure", func() {
+		cmdRec.FailAll = true
+		Expect(manager.Apply()).NotTo(Succeed())
+		cmdRec.FailAll = false
+		cmdRec.Reset()
+		Expect(manager.Apply()).To(Succeed())
+		Expect(cmdRec.Commands()).To(HaveLen(2))
+	})
+
+	It("should ignore routes in reserved tables", func() {
+		manager.SetRoutes("test", []Route{{Table: 254, Dst: "10.0.0.0/24", Dev: "eth0"}})
+		Expect(manager.Apply()).To(Succeed())
+		Expect(cmdRec.Commands()).To(Equal([]string{
+			"ip -4 rule show",
+			"ip -4 route show table all proto 80",
+		}))
+	})
+
+	It("should use the configured rule priority and IP version", func() {
+		manager = NewWithCmdShim(Config{IPVersion: 6, RulePriority: 200}, cmdRec.NewCmd)
+		cmdRec.Outputs["ip -6 rule show"] = ruleShowOutput
+		manager.SetRules("test", []Rule{{Mark: 0x100, Mask: 0x100, Table: 2000}})
+		Expect(manager.Apply()).To(Succeed())
+		Expect(cmdRec.Commands()).To(Equal([]string{
+			"ip -6 rule show",
+			"ip -6 route show table all proto 80",
+		}))
+	})
+})
@@ -0,0 +1,388 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The policysync package implements the PolicySync gRPC API, which allows
+// enforcement agents that run alongside a workload (for example, an L7 proxy)
+// to subscribe to the policy that Felix has calculated for that workload.
+//
+// The Processor receives the same stream of updates as the dataplane driver
+// and maintains a cache of the active endpoints, policies, profiles and IP
+// sets.  The Server handles the gRPC connections; when an agent connects, the
+// Server sends a JoinRequest to the Processor, which responds with a
+// snapshot of the state that is relevant to the agent's workload, followed by
+// incremental updates.
+package policysync
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/set"
+)
+
+// JoinRequest is sent to the Processor when an agent subscribes to the
+// policy for a workload.
+type JoinRequest struct {
+	OrchestratorID string
+	WorkloadID     string
+	// C is the channel that the Processor uses to send updates to the
+	// agent.  The Processor only closes C after it receives the matching
+	// LeaveRequest; until then, the receiver must keep draining C.
+	C chan<- *proto.ToDataplane
+}
+
+// LeaveRequest is sent to the Processor when an agent disconnects.
+type LeaveRequest struct {
+	C chan<- *proto.ToDataplane
+}
+
+type workloadKey struct {
+	orchestratorID string
+	workloadID     string
+}
+
+type Processor struct {
+	// Updates receives the messages that are sent to the dataplane driver.
+	Updates chan interface{}
+	// JoinUpdates receives JoinRequests and LeaveRequests.
+	JoinUpdates chan interface{}
+
+	inSync    bool
+	endpoints map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint
+	policies  map[proto.PolicyID]*proto.Policy
+	profiles  map[proto.ProfileID]*proto.Profile
+	// ipSets maps from IP set ID to the set of member strings.
+	ipSets map[string]set.Set
+
+	subscribers map[chan<- *proto.ToDataplane]*subscriber
+}
+
+// subscriber tracks the state that has been sent to one agent.
+type subscriber struct {
+	workload workloadKey
+	output   chan<- *proto.ToDataplane
+
+	sentEndpoints set.Set
+	sentPolicies  set.Set
+	sentProfiles  set.Set
+	sentIPSets    set.Set
+
+	nextSeqNumber uint64
+}
+
+func (s *subscriber) send(msg interface{}) {
+	envelope := toEnvelope(msg)
+	envelope.SequenceNumber = s.nextSeqNumber
+	s.nextSeqNumber++
+	s.output <- envelope
+}
+
+func NewProcessor() *Processor {
+	return &Processor{
+		Updates:     make(chan interface{}, 100),
+		JoinUpdates: make(chan interface{}, 10),
+		endpoints:   map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint{},
+		policies:    map[proto.PolicyID]*proto.Policy{},
+		profiles:    map[proto.ProfileID]*proto.Profile{},
+		ipSets:      map[string]set.Set{},
+		subscribers: map[chan<- *proto.ToDataplane]*subscriber{},
+	}
+}
+
+func (p *Processor) Start() {
+	go p.loop()
+}
+
+func (p *Processor) loop() {
+	log.Info("Policy sync processor running")
+	for {
+		select {
+		case update := <-p.Updates:
+			p.onUpdate(update)
+		case joinUpdate := <-p.JoinUpdates:
+			switch r := joinUpdate.(type) {
+			case JoinRequest:
+				p.onJoin(r)
+			case LeaveRequest:
+				p.onLeave(r)
+			default:
+				log.WithField("request", r).Panic("Unexpected join/leave request")
+			}
+		}
+	}
+}
+
+func (p *Processor) onJoin(r JoinRequest) {
+	log.WithFields(log.Fields{
+		"orchestrator": r.OrchestratorID,
+		"workload":     r.WorkloadID,
+	}).Info("Agent joined")
+	sub := &subscriber{
+		workload: workloadKey{
+			orchestratorID: r.OrchestratorID,
+			workloadID:     r.WorkloadID,
+		},
+		output:        r.C,
+		sentEndpoints: set.New(),
+		sentPolicies:  set.New(),
+		sentProfiles:  set.New(),
+		sentIPSets:    set.New(),
+	}
+	p.subscribers[r.C] = sub
+	p.syncSubscriber(sub, nil)
+	if p.inSync {
+		sub.send(&proto.InSync{})
+	}
+}
+
+func (p *Processor) onLeave(r LeaveRequest) {
+	sub := p.subscribers[r.C]
+	if sub == nil {
+		log.Warn("Leave request for unknown agent")
+		return
+	}
+	log.WithField("workload", sub.workload).Info("Agent left")
+	delete(p.subscribers, r.C)
+	close(r.C)
+}
+
+func (p *Processor) onUpdate(update interface{}) {
+	switch update := update.(type) {
+	case *proto.InSync:
+		p.inSync = true
+		for _, sub := range p.subscribers {
+			sub.send(update)
+		}
+	case *proto.IPSetUpdate:
+		members := set.New()
+		for _, m := range update.Members {
+			members.Add(m)
+		}
+		p.ipSets[update.Id] = members
+		p.forwardIPSetUpdate(update.Id, update)
+	case *proto.IPSetDeltaUpdate:
+		members := p.ipSets[update.Id]
+		if members == nil {
+			log.WithField("id", update.Id).Panic("Delta update for unknown IP set")
+		}
+		for _, m := range update.AddedMembers {
+			members.Add(m)
+		}
+		for _, m := range update.RemovedMembers {
+			members.Discard(m)
+		}
+		p.forwardIPSetUpdate(update.Id, update)
+	case *proto.IPSetRemove:
+		delete(p.ipSets, update.Id)
+		p.syncAllSubscribers(nil)
+	case *proto.ActivePolicyUpdate:
+		p.policies[*update.Id] = update.Policy
+		p.syncAllSubscribers(*update.Id)
+	case *proto.ActivePolicyRemove:
+		delete(p.policies, *update.Id)
+		p.syncAllSubscribers(nil)
+	case *proto.ActiveProfileUpdate:
+		p.profiles[*update.Id] = update.Profile
+		p.syncAllSubscribers(*update.Id)
+	case *proto.ActiveProfileRemove:
+		delete(p.profiles, *update.Id)
+		p.syncAllSubscribers(nil)
+	case *proto.WorkloadEndpointUpdate:
+		p.endpoints[*update.Id] = update.Endpoint
+		p.syncWorkloadSubscribers(update.Id, *update.Id)
+	case *proto.WorkloadEndpointRemove:
+		delete(p.endpoints, *update.Id)
+		p.syncWorkloadSubscribers(update.Id, nil)
+	}
+}
+
+// forwardIPSetUpdate sends an IP set update to the agents that have already
+// been sent the IP set.  Agents that haven't been sent the IP set will
+// receive its full membership if it becomes relevant to them.
+func (p *Processor) forwardIPSetUpdate(id string, update interface{}) {
+	for _, sub := range p.subscribers {
+		if sub.sentIPSets.Contains(id) {
+			sub.send(update)
+		}
+	}
+}
+
+func (p *Processor) syncAllSubscribers(dirtyID interface{}) {
+	for _, sub := range p.subscribers {
+		p.syncSubscriber(sub, dirtyID)
+	}
+}
+
+func (p *Processor) syncWorkloadSubscribers(id *proto.WorkloadEndpointID, dirtyID interface{}) {
+	for _, sub := range p.subscribers {
+		if sub.workload.orchestratorID == id.OrchestratorId &&
+			sub.workload.workloadID == id.WorkloadId {
+			p.syncSubscriber(sub, dirtyID)
+		}
+	}
+}
+
+// syncSubscriber calculates the endpoints, policies, profiles and IP sets
+// that the agent needs and sends it the difference from what it already has.
+// dirtyID, if non-nil, is the ID of an endpoint, policy or profile that has
+// been updated and should be resent.
+//
+// Updates are sent in dependency order so that the agent never sees a
+// reference to an IP set, policy or profile that it doesn't know about.
+func (p *Processor) syncSubscriber(sub *subscriber, dirtyID interface{}) {
+	wantedEndpoints := set.New()
+	wantedPolicies := set.New()
+	wantedProfiles := set.New()
+	wantedIPSets := set.New()
+	addRuleIPSets := func(rules []*proto.Rule) {
+		for _, rule := range rules {
+			for _, ids := range [][]string{
+				rule.SrcIpSetIds, rule.DstIpSetIds,
+				rule.NotSrcIpSetIds, rule.NotDstIpSetIds,
+			} {
+				for _, id := range ids {
+					if _, ok := p.ipSets[id]; ok {
+						wantedIPSets.Add(id)
+					}
+				}
+			}
+		}
+	}
+	for id, ep := range p.endpoints {
+		if id.OrchestratorId != sub.workload.orchestratorID ||
+			id.WorkloadId != sub.workload.workloadID {
+			continue
+		}
+		wantedEndpoints.Add(id)
+		for _, tier := range ep.Tiers {
+			for _, name := range tier.Policies {
+				polID := proto.PolicyID{Tier: tier.Name, Name: name}
+				if policy, ok := p.policies[polID]; ok {
+					wantedPolicies.Add(polID)
+					addRuleIPSets(policy.InboundRules)
+					addRuleIPSets(policy.OutboundRules)
+				}
+			}
+		}
+		for _, name := range ep.ProfileIds {
+			profID := proto.ProfileID{Name: name}
+			if profile, ok := p.profiles[profID]; ok {
+				wantedProfiles.Add(profID)
+				addRuleIPSets(profile.InboundRules)
+				addRuleIPSets(profile.OutboundRules)
+			}
+		}
+	}
+
+	// Send adds and updates, dependencies first.
+	wantedIPSets.Iter(func(item interface{}) error {
+		id := item.(string)
+		if !sub.sentIPSets.Contains(id) {
+			update := &proto.IPSetUpdate{Id: id}
+			p.ipSets[id].Iter(func(member interface{}) error {
+				update.Members = append(update.Members, member.(string))
+				return nil
+			})
+			sub.send(update)
+			sub.sentIPSets.Add(id)
+		}
+		return nil
+	})
+	wantedProfiles.Iter(func(item interface{}) error {
+		id := item.(proto.ProfileID)
+		if !sub.sentProfiles.Contains(id) || id == dirtyID {
+			sub.send(&proto.ActiveProfileUpdate{Id: &id, Profile: p.profiles[id]})
+			sub.sentProfiles.Add(id)
+		}
+		return nil
+	})
+	wantedPolicies.Iter(func(item interface{}) error {
+		id := item.(proto.PolicyID)
+		if !sub.sentPolicies.Contains(id) || id == dirtyID {
+			sub.send(&proto.ActivePolicyUpdate{Id: &id, Policy: p.policies[id]})
+			sub.sentPolicies.Add(id)
+		}
+		return nil
+	})
+	wantedEndpoints.Iter(func(item interface{}) error {
+		id := item.(proto.WorkloadEndpointID)
+		if !sub.sentEndpoints.Contains(id) || id == dirtyID {
+			sub.send(&proto.WorkloadEndpointUpdate{Id: &id, Endpoint: p.endpoints[id]})
+			sub.sentEndpoints.Add(id)
+		}
+		return nil
+	})
+
+	// Then send removes, in reverse order.
+	sub.sentEndpoints.Iter(func(item interface{}) error {
+		id := item.(proto.WorkloadEndpointID)
+		if !wantedEndpoints.Contains(id) {
+			sub.send(&proto.WorkloadEndpointRemove{Id: &id})
+			sub.sentEndpoints.Discard(id)
+		}
+		return nil
+	})
+	sub.sentPolicies.Iter(func(item interface{}) error {
+		id := item.(proto.PolicyID)
+		if !wantedPolicies.Contains(id) {
+			sub.send(&proto.ActivePolicyRemove{Id: &id})
+			sub.sentPolicies.Discard(id)
+		}
+		return nil
+	})
+	sub.sentProfiles.Iter(func(item interface{}) error {
+		id := item.(proto.ProfileID)
+		if !wantedProfiles.Contains(id) {
+			sub.send(&proto.ActiveProfileRemove{Id: &id})
+			sub.sentProfiles.Discard(id)
+		}
+		return nil
+	})
+	sub.sentIPSets.Iter(func(item interface{}) error {
+		id := item.(string)
+		if !wantedIPSets.Contains(id) {
+			sub.send(&proto.IPSetRemove{Id: id})
+			sub.sentIPSets.Discard(id)
+		}
+		return nil
+	})
+}
+
+func toEnvelope(msg interface{}) *proto.ToDataplane {
+	envelope := &proto.ToDataplane{}
+	switch msg := msg.(type) {
+	case *proto.InSync:
+		envelope.Payload = &proto.ToDataplane_InSync{msg}
+	case *proto.IPSetUpdate:
+		envelope.Payload = &proto.ToDataplane_IpsetUpdate{msg}
+	case *proto.IPSetDeltaUpdate:
+		envelope.Payload = &proto.ToDataplane_IpsetDeltaUpdate{msg}
+	case *proto.IPSetRemove:
+		envelope.Payload = &proto.ToDataplane_IpsetRemove{msg}
+	case *proto.ActivePolicyUpdate:
+		envelope.Payload = &proto.ToDataplane_ActivePolicyUpdate{msg}
+	case *proto.ActivePolicyRemove:
+		envelope.Payload = &proto.ToDataplane_ActivePolicyRemove{msg}
+	case *proto.ActiveProfileUpdate:
+		envelope.Payload = &proto.ToDataplane_ActiveProfileUpdate{msg}
+	case *proto.ActiveProfileRemove:
+		envelope.Payload = &proto.ToDataplane_ActiveProfileRemove{msg}
+	case *proto.WorkloadEndpointUpdate:
+		envelope.Payload = &proto.ToDataplane_WorkloadEndpointUpdate{msg}
+	case *proto.WorkloadEndpointRemove:
+		envelope.Payload = &proto.ToDataplane_WorkloadEndpointRemove{msg}
+	default:
+		log.WithField("msg", msg).Panic("Unexpected message type for policy sync")
+	}
+	return envelope
+}
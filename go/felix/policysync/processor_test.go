@@ -0,0 +1,192 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysync_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/policysync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/proto"
+)
+
+var (
+	wlEPID1 = proto.WorkloadEndpointID{
+		OrchestratorId: "k8s",
+		WorkloadId:     "pod-1",
+		EndpointId:     "eth0",
+	}
+	wlEPID2 = proto.WorkloadEndpointID{
+		OrchestratorId: "k8s",
+		WorkloadId:     "pod-2",
+		EndpointId:     "eth0",
+	}
+	polID  = proto.PolicyID{Tier: "default", Name: "pol-1"}
+	profID = proto.ProfileID{Name: "prof-1"}
+)
+
+func endpointUpdate(id proto.WorkloadEndpointID, profiles []string, policies []string) *proto.WorkloadEndpointUpdate {
+	return &proto.WorkloadEndpointUpdate{
+		Id: &id,
+		Endpoint: &proto.WorkloadEndpoint{
+			Name:       "cali1234",
+			ProfileIds: profiles,
+			Tiers: []*proto.TierInfo{
+				{Name: "default", Policies: policies},
+			},
+		},
+	}
+}
+
+var _ = Describe("Processor", func() {
+	var processor *Processor
+	var output chan *proto.ToDataplane
+
+	// recv returns the payload of the next message sent to the agent.
+	recv := func() interface{} {
+		var msg *proto.ToDataplane
+		Eventually(output).Should(Receive(&msg))
+		return msg.Payload
+	}
+	expectNoMessages := func() {
+		Consistently(output, "50ms").ShouldNot(Receive())
+	}
+
+	policy := &proto.Policy{
+		InboundRules: []*proto.Rule{
+			{Action: "allow", SrcIpSetIds: []string{"ipset-1"}},
+		},
+	}
+	profile := &proto.Profile{
+		OutboundRules: []*proto.Rule{{Action: "allow"}},
+	}
+
+	BeforeEach(func() {
+		processor = NewProcessor()
+		processor.Start()
+		output = make(chan *proto.ToDataplane, 100)
+	})
+	AfterEach(func() {
+		processor.JoinUpdates <- LeaveRequest{C: output}
+		Eventually(output).Should(BeClosed())
+	})
+
+	join := func() {
+		processor.JoinUpdates <- JoinRequest{
+			OrchestratorID: "k8s",
+			WorkloadID:     "pod-1",
+			C:              output,
+		}
+	}
+
+	It("should send InSync to a new agent once in sync", func() {
+		processor.Updates <- &proto.InSync{}
+		join()
+		Expect(recv()).To(Equal(&proto.ToDataplane_InSync{&proto.InSync{}}))
+		expectNoMessages()
+	})
+
+	Describe("with state for two workloads", func() {
+		BeforeEach(func() {
+			processor.Updates <- &proto.IPSetUpdate{Id: "ipset-1", Members: []string{"10.0.0.1"}}
+			processor.Updates <- &proto.IPSetUpdate{Id: "ipset-2", Members: []string{"10.0.0.2"}}
+			processor.Updates <- &proto.ActivePolicyUpdate{Id: &polID, Policy: policy}
+			processor.Updates <- &proto.ActiveProfileUpdate{Id: &profID, Profile: profile}
+			processor.Updates <- endpointUpdate(wlEPID1, []string{"prof-1"}, []string{"pol-1"})
+			processor.Updates <- endpointUpdate(wlEPID2, nil, nil)
+			processor.Updates <- &proto.InSync{}
+			join()
+		})
+
+		It("should send only the state for the agent's workload, in order", func() {
+			Expect(recv()).To(Equal(&proto.ToDataplane_IpsetUpdate{
+				&proto.IPSetUpdate{Id: "ipset-1", Members: []string{"10.0.0.1"}},
+			}))
+			Expect(recv()).To(Equal(&proto.ToDataplane_ActiveProfileUpdate{
+				&proto.ActiveProfileUpdate{Id: &profID, Profile: profile},
+			}))
+			Expect(recv()).To(Equal(&proto.ToDataplane_ActivePolicyUpdate{
+				&proto.ActivePolicyUpdate{Id: &polID, Policy: policy},
+			}))
+			Expect(recv()).To(Equal(&proto.ToDataplane_WorkloadEndpointUpdate{
+				endpointUpdate(wlEPID1, []string{"prof-1"}, []string{"pol-1"}),
+			}))
+			Expect(recv()).To(Equal(&proto.ToDataplane_InSync{&proto.InSync{}}))
+			expectNoMessages()
+		})
+
+		Describe("after the initial snapshot", func() {
+			BeforeEach(func() {
+				for i := 0; i < 5; i++ {
+					recv()
+				}
+			})
+
+			It("should forward deltas for IP sets that the agent has", func() {
+				delta := &proto.IPSetDeltaUpdate{Id: "ipset-1", AddedMembers: []string{"10.0.0.3"}}
+				processor.Updates <- delta
+				processor.Updates <- &proto.IPSetDeltaUpdate{Id: "ipset-2", AddedMembers: []string{"10.0.0.4"}}
+				Expect(recv()).To(Equal(&proto.ToDataplane_IpsetDeltaUpdate{delta}))
+				expectNoMessages()
+			})
+			It("should resend an updated policy", func() {
+				processor.Updates <- &proto.ActivePolicyUpdate{Id: &polID, Policy: policy}
+				Expect(recv()).To(Equal(&proto.ToDataplane_ActivePolicyUpdate{
+					&proto.ActivePolicyUpdate{Id: &polID, Policy: policy},
+				}))
+				expectNoMessages()
+			})
+			It("should send a newly-referenced IP set before the policy", func() {
+				newPolicy := &proto.Policy{
+					InboundRules: []*proto.Rule{
+						{Action: "allow", DstIpSetIds: []string{"ipset-2"}},
+					},
+				}
+				processor.Updates <- &proto.ActivePolicyUpdate{Id: &polID, Policy: newPolicy}
+				Expect(recv()).To(Equal(&proto.ToDataplane_IpsetUpdate{
+					&proto.IPSetUpdate{Id: "ipset-2", Members: []string{"10.0.0.2"}},
+				}))
+				Expect(recv()).To(Equal(&proto.ToDataplane_ActivePolicyUpdate{
+					&proto.ActivePolicyUpdate{Id: &polID, Policy: newPolicy},
+				}))
+				Expect(recv()).To(Equal(&proto.ToDataplane_IpsetRemove{
+					&proto.IPSetRemove{Id: "ipset-1"},
+				}))
+				expectNoMessages()
+			})
+			It("should remove the endpoint before its policy and profile", func() {
+				processor.Updates <- &proto.WorkloadEndpointRemove{Id: &wlEPID1}
+				Expect(recv()).To(Equal(&proto.ToDataplane_WorkloadEndpointRemove{
+					&proto.WorkloadEndpointRemove{Id: &wlEPID1},
+				}))
+				Expect(recv()).To(Equal(&proto.ToDataplane_ActivePolicyRemove{
+					&proto.ActivePolicyRemove{Id: &polID},
+				}))
+				Expect(recv()).To(Equal(&proto.ToDataplane_ActiveProfileRemove{
+					&proto.ActiveProfileRemove{Id: &profID},
+				}))
+				Expect(recv()).To(Equal(&proto.ToDataplane_IpsetRemove{
+					&proto.IPSetRemove{Id: "ipset-1"},
+				}))
+				expectNoMessages()
+			})
+			It("should ignore updates to other workloads", func() {
+				processor.Updates <- endpointUpdate(wlEPID2, []string{"prof-1"}, nil)
+				processor.Updates <- &proto.WorkloadEndpointRemove{Id: &wlEPID2}
+				expectNoMessages()
+			})
+		})
+	})
+})
@@ -0,0 +1,103 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysync
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"google.golang.org/grpc"
+	"net"
+	"os"
+)
+
+// outputQueueLen is the number of updates that we buffer for each agent.
+const outputQueueLen = 100
+
+var ErrMissingWorkloadID = errors.New("SyncRequest must include the orchestrator and workload IDs")
+
+// Server implements the PolicySync gRPC service.  Each call to Sync joins the
+// Processor for the requested workload and streams the Processor's updates
+// to the agent.
+type Server struct {
+	JoinUpdates chan<- interface{}
+}
+
+func NewServer(joins chan<- interface{}) *Server {
+	return &Server{
+		JoinUpdates: joins,
+	}
+}
+
+// ListenAndServe creates the unix socket at the given path, replacing any
+// stale socket left behind by a previous Felix process, and serves the
+// PolicySync API on it.  It only returns if serving fails.
+func (s *Server) ListenAndServe(socketPath string) error {
+	logCxt := log.WithField("socket", socketPath)
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		logCxt.WithError(err).Error("Failed to remove old policy sync socket")
+		return err
+	}
+	lis, err := net.Listen("unix", socketPath)
+	if err != nil {
+		logCxt.WithError(err).Error("Failed to listen on policy sync socket")
+		return err
+	}
+	grpcServer := grpc.NewServer()
+	proto.RegisterPolicySyncServer(grpcServer, s)
+	logCxt.Info("Serving policy sync API")
+	return grpcServer.Serve(lis)
+}
+
+func (s *Server) Sync(req *proto.SyncRequest, stream proto.PolicySync_SyncServer) error {
+	if req.OrchestratorId == "" || req.WorkloadId == "" {
+		return ErrMissingWorkloadID
+	}
+	logCxt := log.WithFields(log.Fields{
+		"orchestrator": req.OrchestratorId,
+		"workload":     req.WorkloadId,
+	})
+	logCxt.Info("New policy sync connection")
+
+	updates := make(chan *proto.ToDataplane, outputQueueLen)
+	s.JoinUpdates <- JoinRequest{
+		OrchestratorID: req.OrchestratorId,
+		WorkloadID:     req.WorkloadId,
+		C:              updates,
+	}
+	defer func() {
+		// The Processor may be blocked sending to us so we send the
+		// leave request in the background and drain the channel until
+		// the Processor closes it.
+		go func() {
+			s.JoinUpdates <- LeaveRequest{C: updates}
+		}()
+		for range updates {
+		}
+		logCxt.Info("Policy sync connection closed")
+	}()
+
+	for {
+		select {
+		case update := <-updates:
+			if err := stream.Send(update); err != nil {
+				logCxt.WithError(err).Warn("Failed to send to agent")
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
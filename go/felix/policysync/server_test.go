@@ -0,0 +1,93 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policysync_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/policysync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"time"
+)
+
+var _ = Describe("Server", func() {
+	var processor *Processor
+	var tmpDir, socketPath string
+	var conn *grpc.ClientConn
+	var client proto.PolicySyncClient
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "policysync")
+		Expect(err).NotTo(HaveOccurred())
+		socketPath = path.Join(tmpDir, "policysync.sock")
+		// Leave a stale file behind to check that the server replaces
+		// it.
+		Expect(ioutil.WriteFile(socketPath, nil, 0600)).To(Succeed())
+
+		processor = NewProcessor()
+		processor.Start()
+		server := NewServer(processor.JoinUpdates)
+		go server.ListenAndServe(socketPath)
+
+		conn, err = grpc.Dial(socketPath,
+			grpc.WithInsecure(),
+			grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+				return net.DialTimeout("unix", addr, timeout)
+			}))
+		Expect(err).NotTo(HaveOccurred())
+		client = proto.NewPolicySyncClient(conn)
+	})
+	AfterEach(func() {
+		conn.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should stream updates for the requested workload", func() {
+		processor.Updates <- endpointUpdate(wlEPID1, nil, nil)
+		processor.Updates <- &proto.InSync{}
+
+		stream, err := client.Sync(context.Background(), &proto.SyncRequest{
+			OrchestratorId: "k8s",
+			WorkloadId:     "pod-1",
+		}, grpc.FailFast(false))
+		Expect(err).NotTo(HaveOccurred())
+
+		msg, err := stream.Recv()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg.SequenceNumber).To(Equal(uint64(0)))
+		Expect(msg.Payload).To(Equal(&proto.ToDataplane_WorkloadEndpointUpdate{
+			endpointUpdate(wlEPID1, nil, nil),
+		}))
+		msg, err = stream.Recv()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg.SequenceNumber).To(Equal(uint64(1)))
+		Expect(msg.Payload).To(Equal(&proto.ToDataplane_InSync{&proto.InSync{}}))
+	})
+	It("should reject a request without a workload ID", func() {
+		stream, err := client.Sync(context.Background(), &proto.SyncRequest{},
+			grpc.FailFast(false))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = stream.Recv()
+		Expect(err).To(HaveOccurred())
+	})
+})
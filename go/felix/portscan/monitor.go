@@ -0,0 +1,185 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The portscan package manages the IP sets that hold the sources banned by
+// rules.PortScanDetectChain.  The kernel adds the sources, and removes them
+// again when their ban times out, so the Monitor only creates the IP sets
+// and polls their members to report ban events as metrics.
+package portscan
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/cmderrors"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"github.com/projectcalico/felix/go/felix/set"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"time"
+)
+
+var (
+	banEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_portscan_bans",
+		Help: "Number of sources that were banned for port scanning.",
+	})
+	bannedSources = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_portscan_banned_sources",
+		Help: "Number of sources that are currently banned for port scanning.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(banEvents)
+	prometheus.MustRegister(bannedSources)
+}
+
+// Config holds the tunable parameters of the Monitor.
+type Config struct {
+	// IPVersions are the IP versions whose IP sets are managed.
+	IPVersions []uint8
+	// BanTime is the default timeout of the IP sets' members.  It's
+	// normally overridden by the rules.
+	BanTime time.Duration
+	// MaxBannedSources bounds the size of each IP set; once it's full,
+	// no more sources are banned until some of the bans time out.
+	MaxBannedSources int
+	// PollInterval is how often the IP sets are polled for new bans.
+	PollInterval time.Duration
+}
+
+type Monitor struct {
+	newCmd cmdshim.NewCmd
+	config Config
+
+	// banned maps from IP version to the set of sources that were banned
+	// at the last poll.
+	banned map[uint8]set.Set
+}
+
+func New(config Config) *Monitor {
+	return NewWithCmdShim(config, cmdshim.NewRealCmd)
+}
+
+// NewWithCmdShim is a test constructor that allows for shimming exec.Command.
+func NewWithCmdShim(config Config, shim cmdshim.NewCmd) *Monitor {
+	banned := map[uint8]set.Set{}
+	for _, ipVersion := range config.IPVersions {
+		banned[ipVersion] = set.New()
+	}
+	return &Monitor{
+		newCmd: shim,
+		config: config,
+		banned: banned,
+	}
+}
+
+// Run creates the IP sets and then polls them forever.  It only returns if
+// the IP sets can't be created.
+func (m *Monitor) Run() error {
+	if err := m.EnsureIPSets(); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(m.config.PollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.Poll()
+	}
+	return nil
+}
+
+// EnsureIPSets creates the IP sets, if they don't already exist.
+func (m *Monitor) EnsureIPSets() error {
+	for _, ipVersion := range m.config.IPVersions {
+		family := "inet"
+		if ipVersion == 6 {
+			family = "inet6"
+		}
+		name := rules.PortScanIPSetName(ipVersion)
+		output, err := m.newCmd("ipset", "create", name, "hash:ip",
+			"family", family,
+			"timeout", fmt.Sprint(int(m.config.BanTime.Seconds())),
+			"maxelem", fmt.Sprint(m.config.MaxBannedSources),
+			"-exist").CombinedOutput()
+		if err := cmderrors.Record("ipset", name, output, err); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"name":   name,
+				"output": string(output),
+			}).Error("Failed to create port scan IP set")
+			return err
+		}
+	}
+	return nil
+}
+
+// Poll lists the members of the IP sets and counts the sources that have
+// been banned since the last poll.  A source that's banned again after its
+// previous ban timed out between two polls isn't counted.
+func (m *Monitor) Poll() {
+	numBanned := 0
+	for _, ipVersion := range m.config.IPVersions {
+		name := rules.PortScanIPSetName(ipVersion)
+		output, err := m.newCmd("ipset", "list", name).CombinedOutput()
+		if err := cmderrors.Record("ipset", name, output, err); err != nil {
+			log.WithError(err).WithField("name", name).Warn(
+				"Failed to list port scan IP set")
+			numBanned += m.banned[ipVersion].Len()
+			continue
+		}
+		members := parseMembers(string(output))
+		members.Iter(func(item interface{}) error {
+			if !m.banned[ipVersion].Contains(item) {
+				log.WithField("source", item).Warn("Banned source for port scanning")
+				banEvents.Inc()
+			}
+			return nil
+		})
+		m.banned[ipVersion] = members
+		numBanned += members.Len()
+	}
+	bannedSources.Set(float64(numBanned))
+}
+
+// NumBanned returns the number of sources that were banned at the last
+// poll.
+func (m *Monitor) NumBanned() int {
+	numBanned := 0
+	for _, banned := range m.banned {
+		numBanned += banned.Len()
+	}
+	return numBanned
+}
+
+// parseMembers parses the addresses that follow the "Members:" line of the
+// output of "ipset list".  Each member line has the address followed by
+// its remaining timeout.
+func parseMembers(output string) set.Set {
+	members := set.New()
+	inMembers := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !inMembers {
+			inMembers = line == "Members:"
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			members.Add(fields[0])
+		}
+	}
+	return members
+}
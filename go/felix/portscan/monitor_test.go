@@ -0,0 +1,82 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portscan_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/portscan"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"time"
+)
+
+const listOutput = `Name: cali4-portscan-ban
+Type: hash:ip
+Revision: 4
+Header: family inet hashsize 1024 maxelem 1000 timeout 600
+Size in memory: 248
+References: 2
+Number of entries: 2
+Members:
+10.0.0.1 timeout 599
+10.0.0.2 timeout 12
+`
+
+var _ = Describe("Monitor", func() {
+	var monitor *Monitor
+	var cmdRec *cmdshim.Recorder
+	BeforeEach(func() {
+		cmdRec = &cmdshim.Recorder{Outputs: map[string]string{}}
+		monitor = NewWithCmdShim(Config{
+			IPVersions:       []uint8{4, 6},
+			BanTime:          10 * time.Minute,
+			MaxBannedSources: 1000,
+			PollInterval:     time.Second,
+		}, cmdRec.NewCmd)
+	})
+
+	It("should create the IP sets", func() {
+		Expect(monitor.EnsureIPSets()).To(Succeed())
+		Expect(cmdRec.Commands()).To(Equal([]string{
+			"ipset create cali4-portscan-ban hash:ip family inet timeout 600 maxelem 1000 -exist",
+			"ipset create cali6-portscan-ban hash:ip family inet6 timeout 600 maxelem 1000 -exist",
+		}))
+	})
+	It("should fail if an IP set can't be created", func() {
+		cmdRec.FailAll = true
+		Expect(monitor.EnsureIPSets()).NotTo(Succeed())
+		Expect(cmdRec.Commands()).To(HaveLen(1))
+	})
+
+	It("should track the banned sources", func() {
+		cmdRec.Outputs["ipset list cali4-portscan-ban"] = listOutput
+		cmdRec.Outputs["ipset list cali6-portscan-ban"] = "Name: cali6-portscan-ban\nMembers:\n"
+		monitor.Poll()
+		Expect(monitor.NumBanned()).To(Equal(2))
+
+		cmdRec.Outputs["ipset list cali4-portscan-ban"] = "Members:\n10.0.0.2 timeout 2\n"
+		cmdRec.Outputs["ipset list cali6-portscan-ban"] = "Members:\nfd00::1 timeout 600\n"
+		monitor.Poll()
+		Expect(monitor.NumBanned()).To(Equal(2))
+	})
+	It("should keep the previous bans if listing fails", func() {
+		cmdRec.Outputs["ipset list cali4-portscan-ban"] = listOutput
+		monitor.Poll()
+		cmdRec.FailAll = true
+		monitor.Poll()
+		Expect(monitor.NumBanned()).To(Equal(2))
+	})
+})
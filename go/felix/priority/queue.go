@@ -0,0 +1,377 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The priority package queues the updates for the dataplane driver so that
+// the ones that take access away jump ahead of bulk churn, bounding how long
+// it takes to enforce a deny while the driver is busy.
+//
+// Each update has a class.  Critical updates are the ones that revoke
+// access: removing an endpoint, taking an endpoint down and removing members
+// from an IP set.  Bulk updates, such as host metadata and IPAM pools, don't
+// affect policy.  Everything else is normal.  The queue hands out critical
+// updates first, then normal, then bulk; within a class, updates keep their
+// order.
+//
+// Reordering is only safe if an update never overtakes one that it depends
+// on, so when an update is queued, the earlier updates to the same object,
+// and to the objects that it refers to, are promoted to its class along
+// with it: an endpoint update brings its policies and profiles, which bring
+// their IP sets.  ConfigUpdate, InSync and unknown messages are barriers:
+// everything queued before them is handed out before them.
+package priority
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Class is the priority of an update; lower values are handed out first.
+type Class int
+
+const (
+	Critical Class = iota
+	Normal
+	Bulk
+
+	numClasses
+)
+
+func (c Class) String() string {
+	switch c {
+	case Critical:
+		return "critical"
+	case Normal:
+		return "normal"
+	case Bulk:
+		return "bulk"
+	}
+	return "unknown"
+}
+
+var (
+	queueLatency = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name: "felix_dataplane_queue_latency_seconds",
+		Help: "Time that updates for the dataplane driver spent queued, by priority class.",
+	}, []string{"class"})
+	queueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "felix_dataplane_queue_length",
+		Help: "Number of updates queued for the dataplane driver, by priority class.",
+	}, []string{"class"})
+)
+
+func init() {
+	prometheus.MustRegister(queueLatency)
+	prometheus.MustRegister(queueLength)
+}
+
+const defaultMaxBulkDelay = 5 * time.Second
+
+type Config struct {
+	// MaxBulkDelay is the longest that a bulk update waits behind other
+	// updates before it's handed out as a normal one, so that bulk
+	// updates aren't starved by sustained churn.  Defaults to 5s.
+	MaxBulkDelay time.Duration
+
+	// NowOverride replaces time.Now, for testing.
+	NowOverride func() time.Time
+}
+
+type item struct {
+	msg      interface{}
+	seq      uint64
+	class    Class
+	key      string
+	deps     []string
+	queuedAt time.Time
+	done     bool
+}
+
+// Queue is a queue of updates for the dataplane driver.  It is safe for
+// concurrent use: typically, one goroutine pushes the updates from the
+// calculation graph and another pops them and writes them to the driver.
+type Queue struct {
+	config Config
+	now    func() time.Time
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	nextSeq uint64
+	// lanes holds the queued items of each class, in order of sequence
+	// number.  An item that has been promoted is left behind in its old
+	// lane and skipped when it reaches the front.
+	lanes [numClasses][]*item
+	// byKey indexes the queued items by the object that they update.
+	byKey  map[string][]*item
+	length int
+}
+
+func New(config Config) *Queue {
+	if config.MaxBulkDelay <= 0 {
+		config.MaxBulkDelay = defaultMaxBulkDelay
+	}
+	q := &Queue{
+		config: config,
+		now:    time.Now,
+		byKey:  map[string][]*item{},
+	}
+	if config.NowOverride != nil {
+		q.now = config.NowOverride
+	}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// Push queues an update.
+func (q *Queue) Push(msg interface{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	class, key, deps := classify(msg)
+	it := &item{
+		msg:      msg,
+		seq:      q.nextSeq,
+		class:    numClasses,
+		key:      key,
+		deps:     deps,
+		queuedAt: q.now(),
+	}
+	q.nextSeq++
+	if key == "" {
+		// A barrier; everything that's already queued has to go first.
+		// Promoting it all to critical keeps its order and puts it ahead
+		// of everything that's queued after the barrier.
+		class = Critical
+		for c := Normal; c < numClasses; c++ {
+			for _, queued := range q.lanes[c] {
+				q.promote(queued, Critical)
+			}
+		}
+	} else {
+		q.byKey[key] = append(q.byKey[key], it)
+	}
+	q.promote(it, class)
+	q.length++
+	log.WithFields(log.Fields{
+		"class": class,
+		"key":   key,
+	}).Debug("Queued dataplane update")
+	q.cond.Signal()
+}
+
+// Pop blocks until there's an update and then returns the one with the
+// highest priority.
+func (q *Queue) Pop() interface{} {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for q.length == 0 {
+		q.cond.Wait()
+	}
+	return q.pop()
+}
+
+// TryPop returns the update with the highest priority, or false if the
+// queue is empty.
+func (q *Queue) TryPop() (interface{}, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.length == 0 {
+		return nil, false
+	}
+	return q.pop(), true
+}
+
+// Len returns the number of queued updates.
+func (q *Queue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.length
+}
+
+func (q *Queue) pop() interface{} {
+	now := q.now()
+	if it := q.head(Bulk); it != nil && now.Sub(it.queuedAt) >= q.config.MaxBulkDelay {
+		log.WithField("key", it.key).Debug("Bulk update waited too long, promoting it")
+		q.promote(it, Normal)
+	}
+	for c := Critical; c < numClasses; c++ {
+		it := q.head(c)
+		if it == nil {
+			continue
+		}
+		q.lanes[c] = q.lanes[c][1:]
+		it.done = true
+		q.length--
+		queueLength.WithLabelValues(c.String()).Dec()
+		queueLatency.WithLabelValues(c.String()).Observe(now.Sub(it.queuedAt).Seconds())
+		if it.key != "" {
+			q.removeFromKey(it)
+		}
+		return it.msg
+	}
+	log.Panic("Queue length doesn't match the queued items")
+	return nil
+}
+
+// head returns the first item in the lane that is still in that lane,
+// discarding any promoted items in front of it.
+func (q *Queue) head(c Class) *item {
+	for len(q.lanes[c]) > 0 {
+		it := q.lanes[c][0]
+		if it.class == c {
+			return it
+		}
+		q.lanes[c] = q.lanes[c][1:]
+	}
+	return nil
+}
+
+// promote moves the item up to the given class, if it isn't already at
+// that class or higher, along with the earlier queued items that it
+// depends on.
+func (q *Queue) promote(it *item, class Class) {
+	if it.done || it.class <= class {
+		return
+	}
+	if it.class < numClasses {
+		queueLength.WithLabelValues(it.class.String()).Dec()
+	}
+	it.class = class
+	queueLength.WithLabelValues(class.String()).Inc()
+	lane := q.lanes[class]
+	i := sort.Search(len(lane), func(i int) bool { return lane[i].seq > it.seq })
+	lane = append(lane, nil)
+	copy(lane[i+1:], lane[i:])
+	lane[i] = it
+	q.lanes[class] = lane
+
+	for _, key := range append([]string{it.key}, it.deps...) {
+		for _, earlier := range q.byKey[key] {
+			if earlier.seq >= it.seq {
+				break
+			}
+			q.promote(earlier, class)
+		}
+	}
+}
+
+func (q *Queue) removeFromKey(it *item) {
+	items := q.byKey[it.key]
+	for i, other := range items {
+		if other == it {
+			items = append(items[:i], items[i+1:]...)
+			break
+		}
+	}
+	if len(items) == 0 {
+		delete(q.byKey, it.key)
+	} else {
+		q.byKey[it.key] = items
+	}
+}
+
+// classify returns the class of the update, the key of the object that it
+// updates and the keys of the objects that it refers to.  A barrier has no
+// key.
+func classify(msg interface{}) (class Class, key string, deps []string) {
+	switch msg := msg.(type) {
+	case *proto.WorkloadEndpointUpdate:
+		class = Normal
+		if msg.Endpoint.State != "active" {
+			class = Critical
+		}
+		return class, workloadKey(msg.Id),
+			endpointDeps(msg.Endpoint.ProfileIds, msg.Endpoint.Tiers)
+	case *proto.WorkloadEndpointRemove:
+		return Critical, workloadKey(msg.Id), nil
+	case *proto.HostEndpointUpdate:
+		deps := endpointDeps(msg.Endpoint.ProfileIds, msg.Endpoint.Tiers)
+		deps = append(deps, endpointDeps(nil, msg.Endpoint.UntrackedTiers)...)
+		return Normal, "host-endpoint:" + msg.Id.EndpointId, deps
+	case *proto.HostEndpointRemove:
+		return Critical, "host-endpoint:" + msg.Id.EndpointId, nil
+	case *proto.IPSetUpdate:
+		return Normal, "ipset:" + msg.Id, nil
+	case *proto.IPSetDeltaUpdate:
+		class = Normal
+		if len(msg.AddedMembers) == 0 && len(msg.RemovedMembers) > 0 {
+			class = Critical
+		}
+		return class, "ipset:" + msg.Id, nil
+	case *proto.IPSetRemove:
+		return Normal, "ipset:" + msg.Id, nil
+	case *proto.ActivePolicyUpdate:
+		return Normal, policyKey(msg.Id.Tier, msg.Id.Name),
+			ruleDeps(msg.Policy.InboundRules, msg.Policy.OutboundRules)
+	case *proto.ActivePolicyRemove:
+		return Normal, policyKey(msg.Id.Tier, msg.Id.Name), nil
+	case *proto.ActiveProfileUpdate:
+		return Normal, "profile:" + msg.Id.Name,
+			ruleDeps(msg.Profile.InboundRules, msg.Profile.OutboundRules)
+	case *proto.ActiveProfileRemove:
+		return Normal, "profile:" + msg.Id.Name, nil
+	case *proto.HostMetadataUpdate:
+		return Bulk, "host:" + msg.Hostname, nil
+	case *proto.HostMetadataRemove:
+		return Bulk, "host:" + msg.Hostname, nil
+	case *proto.IPAMPoolUpdate:
+		return Bulk, "pool:" + msg.Id, nil
+	case *proto.IPAMPoolRemove:
+		return Bulk, "pool:" + msg.Id, nil
+	}
+	return Critical, "", nil
+}
+
+func workloadKey(id *proto.WorkloadEndpointID) string {
+	return "workload:" + id.OrchestratorId + "/" + id.WorkloadId + "/" + id.EndpointId
+}
+
+func policyKey(tier, name string) string {
+	return "policy:" + tier + "/" + name
+}
+
+func endpointDeps(profileIDs []string, tiers []*proto.TierInfo) []string {
+	var deps []string
+	for _, id := range profileIDs {
+		deps = append(deps, "profile:"+id)
+	}
+	for _, tier := range tiers {
+		for _, name := range tier.Policies {
+			deps = append(deps, policyKey(tier.Name, name))
+		}
+	}
+	return deps
+}
+
+func ruleDeps(ruleLists ...[]*proto.Rule) []string {
+	var deps []string
+	for _, rules := range ruleLists {
+		for _, rule := range rules {
+			for _, ids := range [][]string{
+				rule.SrcIpSetIds,
+				rule.DstIpSetIds,
+				rule.NotSrcIpSetIds,
+				rule.NotDstIpSetIds,
+			} {
+				for _, id := range ids {
+					deps = append(deps, "ipset:"+id)
+				}
+			}
+		}
+	}
+	return deps
+}
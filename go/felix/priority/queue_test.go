@@ -0,0 +1,172 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package priority_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/priority"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"time"
+)
+
+var _ = Describe("Queue", func() {
+	var queue *Queue
+	var now time.Time
+
+	wepID := func(name string) *proto.WorkloadEndpointID {
+		return &proto.WorkloadEndpointID{
+			OrchestratorId: "k8s",
+			WorkloadId:     name,
+			EndpointId:     "eth0",
+		}
+	}
+	wepUpdate := func(name, state string, policies ...string) *proto.WorkloadEndpointUpdate {
+		return &proto.WorkloadEndpointUpdate{
+			Id: wepID(name),
+			Endpoint: &proto.WorkloadEndpoint{
+				Name:  name,
+				State: state,
+				Tiers: []*proto.TierInfo{{Name: "default", Policies: policies}},
+			},
+		}
+	}
+	policyUpdate := func(name string, ipSetIDs ...string) *proto.ActivePolicyUpdate {
+		return &proto.ActivePolicyUpdate{
+			Id: &proto.PolicyID{Tier: "default", Name: name},
+			Policy: &proto.Policy{
+				InboundRules: []*proto.Rule{{SrcIpSetIds: ipSetIDs}},
+			},
+		}
+	}
+	hostMetadata := &proto.HostMetadataUpdate{Hostname: "host1", Ipv4Addr: "10.0.0.1"}
+	pool := &proto.IPAMPoolUpdate{Id: "10.1.0.0-16", Pool: &proto.IPAMPool{Cidr: "10.1.0.0/16"}}
+
+	popAll := func() []interface{} {
+		var msgs []interface{}
+		for {
+			msg, ok := queue.TryPop()
+			if !ok {
+				return msgs
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	BeforeEach(func() {
+		now = time.Now()
+		queue = New(Config{
+			MaxBulkDelay: time.Second,
+			NowOverride:  func() time.Time { return now },
+		})
+	})
+
+	It("should keep the order of updates of the same class", func() {
+		a := wepUpdate("a", "active")
+		b := wepUpdate("b", "active")
+		c := policyUpdate("c")
+		queue.Push(a)
+		queue.Push(b)
+		queue.Push(c)
+		Expect(queue.Len()).To(Equal(3))
+		Expect(popAll()).To(Equal([]interface{}{a, b, c}))
+		Expect(queue.Len()).To(Equal(0))
+	})
+
+	It("should hand out critical updates ahead of normal and bulk ones", func() {
+		normal := wepUpdate("a", "active")
+		remove := &proto.WorkloadEndpointRemove{Id: wepID("b")}
+		down := wepUpdate("c", "inactive")
+		queue.Push(hostMetadata)
+		queue.Push(normal)
+		queue.Push(remove)
+		queue.Push(down)
+		Expect(popAll()).To(Equal([]interface{}{remove, down, normal, hostMetadata}))
+	})
+
+	It("should treat IP set member removals as critical but additions as normal", func() {
+		add := &proto.IPSetDeltaUpdate{Id: "s1", AddedMembers: []string{"10.0.0.1"}}
+		remove := &proto.IPSetDeltaUpdate{Id: "s2", RemovedMembers: []string{"10.0.0.2"}}
+		queue.Push(add)
+		queue.Push(remove)
+		Expect(popAll()).To(Equal([]interface{}{remove, add}))
+	})
+
+	It("should promote earlier updates of the same object", func() {
+		create := &proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1"}}
+		other := &proto.IPSetUpdate{Id: "s2"}
+		remove := &proto.IPSetDeltaUpdate{Id: "s1", RemovedMembers: []string{"10.0.0.1"}}
+		queue.Push(create)
+		queue.Push(other)
+		queue.Push(remove)
+		Expect(popAll()).To(Equal([]interface{}{create, remove, other}))
+	})
+
+	It("should promote the policies and IP sets that an endpoint refers to", func() {
+		unrelated := policyUpdate("unrelated")
+		ipSet := &proto.IPSetUpdate{Id: "s1"}
+		policy := policyUpdate("deny-all", "s1")
+		down := wepUpdate("a", "inactive", "deny-all")
+		queue.Push(unrelated)
+		queue.Push(ipSet)
+		queue.Push(policy)
+		queue.Push(down)
+		Expect(popAll()).To(Equal([]interface{}{ipSet, policy, down, unrelated}))
+	})
+
+	It("should not promote later updates of the same object", func() {
+		remove := &proto.WorkloadEndpointRemove{Id: wepID("a")}
+		recreate := wepUpdate("a", "active")
+		queue.Push(remove)
+		queue.Push(recreate)
+		Expect(popAll()).To(Equal([]interface{}{remove, recreate}))
+	})
+
+	It("should hand out everything queued before a barrier first", func() {
+		normal := wepUpdate("a", "active")
+		inSync := &proto.InSync{}
+		remove := &proto.WorkloadEndpointRemove{Id: wepID("b")}
+		queue.Push(pool)
+		queue.Push(normal)
+		queue.Push(inSync)
+		queue.Push(remove)
+		Expect(popAll()).To(Equal([]interface{}{pool, normal, inSync, remove}))
+	})
+
+	It("should stop holding back a bulk update after the max delay", func() {
+		first := wepUpdate("a", "active")
+		second := wepUpdate("b", "active")
+		queue.Push(hostMetadata)
+		queue.Push(first)
+		queue.Push(second)
+		now = now.Add(time.Second - time.Millisecond)
+		msg, ok := queue.TryPop()
+		Expect(ok).To(BeTrue())
+		Expect(msg).To(Equal(first))
+		now = now.Add(time.Millisecond)
+		Expect(popAll()).To(Equal([]interface{}{hostMetadata, second}))
+	})
+
+	It("should block in Pop until there's an update", func() {
+		popped := make(chan interface{})
+		go func() {
+			popped <- queue.Pop()
+		}()
+		Consistently(popped, "50ms").ShouldNot(Receive())
+		queue.Push(pool)
+		Eventually(popped).Should(Receive(Equal(pool)))
+	})
+})
@@ -0,0 +1,193 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The qos package extracts per-endpoint bandwidth limits, DSCP values and
+// connection rate limits from workload endpoint labels.  The dataplane driver
+// enforces the bandwidth limits with tc qdiscs on the workload's interface,
+// sets the DSCP value on the workload's egress traffic in the mangle table
+// and drops new connections beyond the rate limit with a hashlimit match.
+package qos
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"strconv"
+	"strings"
+)
+
+const (
+	// IngressBandwidthLabel limits the rate of traffic into the workload.
+	IngressBandwidthLabel = "qos.projectcalico.org/ingress-bandwidth"
+	// EgressBandwidthLabel limits the rate of traffic out of the workload.
+	EgressBandwidthLabel = "qos.projectcalico.org/egress-bandwidth"
+	// DSCPLabel requests a DSCP value for traffic out of the workload.
+	DSCPLabel = "qos.projectcalico.org/dscp"
+	// ConnectionRateLabel limits the rate, per second, at which the
+	// workload may open new connections.
+	ConnectionRateLabel = "qos.projectcalico.org/max-connection-rate"
+
+	// MinBandwidth is the lowest limit we accept, in bits per second;
+	// anything lower would make the workload unusable.
+	MinBandwidth = 1000
+	// MaxBandwidth is the highest limit we accept, in bits per second.
+	MaxBandwidth = 1000 * 1000 * 1000 * 1000
+
+	// MaxDSCP is the highest DSCP value; the field is 6 bits wide.
+	MaxDSCP = 63
+
+	// MaxConnectionRate is the highest connection rate limit we accept, per
+	// second; a higher limit wouldn't protect the conntrack table.
+	MaxConnectionRate = 10000
+)
+
+// dscpClasses maps the standard names of DSCP values to the values.
+var dscpClasses = map[string]uint8{
+	"BE":   0,
+	"CS0":  0,
+	"CS1":  8,
+	"AF11": 10,
+	"AF12": 12,
+	"AF13": 14,
+	"CS2":  16,
+	"AF21": 18,
+	"AF22": 20,
+	"AF23": 22,
+	"CS3":  24,
+	"AF31": 26,
+	"AF32": 28,
+	"AF33": 30,
+	"CS4":  32,
+	"AF41": 34,
+	"AF42": 36,
+	"AF43": 38,
+	"CS5":  40,
+	"EF":   46,
+	"CS6":  48,
+	"CS7":  56,
+}
+
+var suffixMultipliers = map[string]uint64{
+	"":  1,
+	"k": 1000,
+	"M": 1000 * 1000,
+	"G": 1000 * 1000 * 1000,
+	"T": 1000 * 1000 * 1000 * 1000,
+}
+
+// ParseBandwidth parses a bandwidth, in bits per second, with an optional
+// decimal suffix: "k", "M", "G" or "T".  For example, "10M" is 10,000,000
+// bits per second.
+func ParseBandwidth(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	numPart := strings.TrimRight(s, "kMGT")
+	suffix := s[len(numPart):]
+	multiplier, ok := suffixMultipliers[suffix]
+	if !ok || numPart == "" {
+		return 0, fmt.Errorf("invalid bandwidth %q", s)
+	}
+	num, err := strconv.ParseUint(numPart, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q", s)
+	}
+	if num > MaxBandwidth/multiplier {
+		return 0, fmt.Errorf("bandwidth %q is higher than the maximum %d", s, uint64(MaxBandwidth))
+	}
+	bps := num * multiplier
+	if bps < MinBandwidth {
+		return 0, fmt.Errorf("bandwidth %q is lower than the minimum %d", s, MinBandwidth)
+	}
+	return bps, nil
+}
+
+// LimitsFromLabels returns the ingress and egress bandwidth limits set by
+// the endpoint's labels, in bits per second.  A limit is 0 if it is not set;
+// invalid limits are logged and ignored.
+func LimitsFromLabels(labels map[string]string) (ingress, egress uint64) {
+	parse := func(label string) uint64 {
+		value, ok := labels[label]
+		if !ok {
+			return 0
+		}
+		bps, err := ParseBandwidth(value)
+		if err != nil {
+			log.WithError(err).WithField("label", label).Warn(
+				"Ignoring invalid bandwidth limit")
+			return 0
+		}
+		return bps
+	}
+	return parse(IngressBandwidthLabel), parse(EgressBandwidthLabel)
+}
+
+// ParseDSCP parses a DSCP value, either as a number between 0 and 63 or as
+// the name of a standard class, such as "EF" or "AF41".
+func ParseDSCP(s string) (uint8, error) {
+	s = strings.TrimSpace(s)
+	if dscp, ok := dscpClasses[strings.ToUpper(s)]; ok {
+		return dscp, nil
+	}
+	dscp, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || dscp > MaxDSCP {
+		return 0, fmt.Errorf("invalid DSCP value %q", s)
+	}
+	return uint8(dscp), nil
+}
+
+// DSCPFromLabels returns the DSCP value requested by the endpoint's labels.
+// It returns false if no value is requested; an invalid value is logged and
+// ignored.
+func DSCPFromLabels(labels map[string]string) (uint8, bool) {
+	value, ok := labels[DSCPLabel]
+	if !ok {
+		return 0, false
+	}
+	dscp, err := ParseDSCP(value)
+	if err != nil {
+		log.WithError(err).WithField("label", DSCPLabel).Warn(
+			"Ignoring invalid DSCP value")
+		return 0, false
+	}
+	return dscp, true
+}
+
+// ParseConnectionRate parses a connection rate limit, in new connections per
+// second, between 1 and MaxConnectionRate.
+func ParseConnectionRate(s string) (uint32, error) {
+	s = strings.TrimSpace(s)
+	rate, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || rate == 0 {
+		return 0, fmt.Errorf("invalid connection rate %q", s)
+	}
+	if rate > MaxConnectionRate {
+		return 0, fmt.Errorf("connection rate %q is higher than the maximum %d", s, MaxConnectionRate)
+	}
+	return uint32(rate), nil
+}
+
+// ConnectionRateFromLabels returns the connection rate limit set by the
+// endpoint's labels, per second.  The limit is 0 if it is not set; an invalid
+// limit is logged and ignored.
+func ConnectionRateFromLabels(labels map[string]string) uint32 {
+	value, ok := labels[ConnectionRateLabel]
+	if !ok {
+		return 0
+	}
+	rate, err := ParseConnectionRate(value)
+	if err != nil {
+		log.WithError(err).WithField("label", ConnectionRateLabel).Warn(
+			"Ignoring invalid connection rate limit")
+		return 0
+	}
+	return rate
+}
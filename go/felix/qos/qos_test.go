@@ -0,0 +1,159 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qos_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/qos"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("ParseBandwidth",
+	func(input string, expected uint64) {
+		bps, err := ParseBandwidth(input)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bps).To(Equal(expected))
+	},
+	Entry("plain", "1500", uint64(1500)),
+	Entry("kilobits", "100k", uint64(100000)),
+	Entry("megabits", "10M", uint64(10000000)),
+	Entry("gigabits", " 2G ", uint64(2000000000)),
+	Entry("maximum", "1T", uint64(MaxBandwidth)),
+)
+
+var _ = DescribeTable("ParseBandwidth failures",
+	func(input string) {
+		_, err := ParseBandwidth(input)
+		Expect(err).To(HaveOccurred())
+	},
+	Entry("empty", ""),
+	Entry("suffix only", "M"),
+	Entry("unknown suffix", "10m"),
+	Entry("double suffix", "10kM"),
+	Entry("negative", "-10M"),
+	Entry("fraction", "1.5M"),
+	Entry("too low", "999"),
+	Entry("too high", "1001G"),
+	Entry("overflow", "99999999999999999999T"),
+)
+
+var _ = Describe("LimitsFromLabels", func() {
+	It("should return both limits", func() {
+		ingress, egress := LimitsFromLabels(map[string]string{
+			IngressBandwidthLabel: "10M",
+			EgressBandwidthLabel:  "1M",
+			"app":                 "web",
+		})
+		Expect(ingress).To(Equal(uint64(10000000)))
+		Expect(egress).To(Equal(uint64(1000000)))
+	})
+	It("should return 0 for missing and invalid limits", func() {
+		ingress, egress := LimitsFromLabels(map[string]string{
+			EgressBandwidthLabel: "lots",
+		})
+		Expect(ingress).To(BeZero())
+		Expect(egress).To(BeZero())
+	})
+	It("should handle nil labels", func() {
+		ingress, egress := LimitsFromLabels(nil)
+		Expect(ingress).To(BeZero())
+		Expect(egress).To(BeZero())
+	})
+})
+
+var _ = DescribeTable("ParseDSCP",
+	func(input string, expected uint8) {
+		dscp, err := ParseDSCP(input)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dscp).To(Equal(expected))
+	},
+	Entry("zero", "0", uint8(0)),
+	Entry("number", "46", uint8(46)),
+	Entry("maximum", "63", uint8(63)),
+	Entry("EF", "EF", uint8(46)),
+	Entry("lower case class", "af41", uint8(34)),
+	Entry("best effort", " BE ", uint8(0)),
+)
+
+var _ = DescribeTable("ParseDSCP failures",
+	func(input string) {
+		_, err := ParseDSCP(input)
+		Expect(err).To(HaveOccurred())
+	},
+	Entry("empty", ""),
+	Entry("too high", "64"),
+	Entry("way too high", "256"),
+	Entry("negative", "-1"),
+	Entry("unknown class", "AF44"),
+)
+
+var _ = Describe("DSCPFromLabels", func() {
+	It("should return the requested value", func() {
+		dscp, ok := DSCPFromLabels(map[string]string{DSCPLabel: "EF"})
+		Expect(ok).To(BeTrue())
+		Expect(dscp).To(Equal(uint8(46)))
+	})
+	It("should distinguish an explicit 0 from no value", func() {
+		dscp, ok := DSCPFromLabels(map[string]string{DSCPLabel: "0"})
+		Expect(ok).To(BeTrue())
+		Expect(dscp).To(BeZero())
+		_, ok = DSCPFromLabels(map[string]string{})
+		Expect(ok).To(BeFalse())
+	})
+	It("should ignore invalid values", func() {
+		_, ok := DSCPFromLabels(map[string]string{DSCPLabel: "urgent"})
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = DescribeTable("ParseConnectionRate",
+	func(input string, expected uint32) {
+		rate, err := ParseConnectionRate(input)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rate).To(Equal(expected))
+	},
+	Entry("minimum", "1", uint32(1)),
+	Entry("typical", " 100 ", uint32(100)),
+	Entry("maximum", "10000", uint32(MaxConnectionRate)),
+)
+
+var _ = DescribeTable("ParseConnectionRate failures",
+	func(input string) {
+		_, err := ParseConnectionRate(input)
+		Expect(err).To(HaveOccurred())
+	},
+	Entry("empty", ""),
+	Entry("zero", "0"),
+	Entry("negative", "-1"),
+	Entry("fraction", "1.5"),
+	Entry("suffix", "10k"),
+	Entry("too high", "10001"),
+)
+
+var _ = Describe("ConnectionRateFromLabels", func() {
+	It("should return the limit", func() {
+		Expect(ConnectionRateFromLabels(map[string]string{
+			ConnectionRateLabel: "250",
+		})).To(Equal(uint32(250)))
+	})
+	It("should return 0 for missing and invalid limits", func() {
+		Expect(ConnectionRateFromLabels(map[string]string{})).To(BeZero())
+		Expect(ConnectionRateFromLabels(map[string]string{
+			ConnectionRateLabel: "lots",
+		})).To(BeZero())
+	})
+})
@@ -0,0 +1,294 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The renderdataplane package implements a dataplane driver that never
+// touches the kernel.  Instead, it writes the state that the calculation
+// graph asks for to files, in the formats accepted by iptables-restore,
+// ipset restore and ip -batch, so that a policy set can be validated in CI,
+// or reviewed on an air-gapped machine, without privileges.
+//
+// Like the debug server, it renders the workload endpoint chains, the IP
+// sets and the routes to the workloads, fanning the dual-stack model out to
+// each IP version; the policy and profile chains are rendered by the
+// iptables driver.  The files are rewritten, atomically, whenever the state
+// changes once the datastore is in sync.  Alongside each iptables-save
+// file, a .json file holds the same chains in structured form, with each
+// rule's hash, for audit and inventory tools.
+package renderdataplane
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/debugserver"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// IP sets are named with a per-family prefix followed by the IP set
+	// ID, truncated so that the name fits in the kernel's limit, as the
+	// iptables driver names them.
+	ipSetPrefixV4    = "felix-4-"
+	ipSetPrefixV6    = "felix-6-"
+	maxIPSetIDLength = 24
+)
+
+type Config struct {
+	// Dir is the directory that the files are written to.  It must exist.
+	Dir string
+	// IPv6Enabled adds the IPv6 files.
+	IPv6Enabled bool
+	// RouteAggregation configures the aggregation of the routes by IPAM
+	// block; see debugserver.RouteAggregation.
+	RouteAggregation debugserver.RouteAggregation
+	// ReportingInterval is the interval at which the driver sends process
+	// status updates.  Defaults to 30s.
+	ReportingInterval time.Duration
+}
+
+const defaultReportingInterval = 30 * time.Second
+
+// RenderOnlyDataplane is a DataplaneDriver that writes the intended state
+// to files.
+type RenderOnlyDataplane struct {
+	toDataplane   chan interface{}
+	fromDataplane chan interface{}
+
+	config Config
+	state  *debugserver.DataplaneState
+
+	datastoreInSync bool
+	dirty           bool
+	// written maps from the name of each file to the content that we last
+	// wrote to it.
+	written   map[string][]byte
+	startTime time.Time
+}
+
+func NewRenderOnlyDataplane(renderer rules.RuleRenderer, config Config) *RenderOnlyDataplane {
+	if config.ReportingInterval <= 0 {
+		config.ReportingInterval = defaultReportingInterval
+	}
+	state := debugserver.NewDataplaneState(renderer)
+	state.SetRouteAggregation(config.RouteAggregation)
+	return &RenderOnlyDataplane{
+		toDataplane:   make(chan interface{}, 100),
+		fromDataplane: make(chan interface{}, 100),
+		config:        config,
+		state:         state,
+		written:       map[string][]byte{},
+		startTime:     time.Now(),
+	}
+}
+
+func (d *RenderOnlyDataplane) Start() {
+	go d.loop()
+}
+
+func (d *RenderOnlyDataplane) SendMessage(msg interface{}) error {
+	d.toDataplane <- msg
+	return nil
+}
+
+func (d *RenderOnlyDataplane) RecvMessage() (interface{}, error) {
+	return <-d.fromDataplane, nil
+}
+
+func (d *RenderOnlyDataplane) loop() {
+	log.WithField("dir", d.config.Dir).Info("Render-only dataplane driver running")
+	reportTicker := time.NewTicker(d.config.ReportingInterval)
+	d.reportProcessStatus()
+	for {
+		select {
+		case msg := <-d.toDataplane:
+			d.onUpdate(msg)
+			// Process any other pending updates before we write, so that
+			// we batch up changes.
+		batchLoop:
+			for {
+				select {
+				case msg := <-d.toDataplane:
+					d.onUpdate(msg)
+				default:
+					break batchLoop
+				}
+			}
+			if d.datastoreInSync && d.dirty {
+				d.apply()
+			}
+		case <-reportTicker.C:
+			d.reportProcessStatus()
+			if d.datastoreInSync && d.dirty {
+				log.Info("Retrying failed writes")
+				d.apply()
+			}
+		}
+	}
+}
+
+func (d *RenderOnlyDataplane) onUpdate(msg interface{}) {
+	log.WithField("msg", msg).Debug("Dataplane update")
+	if _, ok := msg.(*proto.InSync); ok {
+		log.Info("Datastore in sync, writing dataplane state")
+		d.datastoreInSync = true
+		d.dirty = true
+		return
+	}
+	d.state.OnUpdate(msg)
+	d.dirty = true
+}
+
+// apply writes the files whose content has changed.  A file that fails to
+// write is retried after the next update or status report.
+func (d *RenderOnlyDataplane) apply() {
+	d.dirty = false
+	ipVersions := []uint8{4}
+	if d.config.IPv6Enabled {
+		ipVersions = append(ipVersions, 6)
+	}
+	for _, stack := range d.state.Stacks(ipVersions...) {
+		chainsJSON, err := iptables.NewRenderCache().RenderJSON("filter", stack.Chains)
+		if err != nil {
+			log.WithError(err).Panic("Failed to render chains as JSON")
+		}
+		ipVersion := stack.IPVersion
+		files := map[string][]byte{
+			fmt.Sprintf("iptables-save.v%d", ipVersion):      RenderIptablesSave("filter", stack.Chains),
+			fmt.Sprintf("iptables-save.v%d.json", ipVersion): chainsJSON,
+			fmt.Sprintf("ipset-restore.v%d", ipVersion):      RenderIPSetRestore(stack.IPSets, ipVersion),
+			fmt.Sprintf("ip-route.v%d", ipVersion):           RenderIPRoutes(stack.Routes),
+		}
+		for name, content := range files {
+			if bytes.Equal(d.written[name], content) {
+				continue
+			}
+			path := filepath.Join(d.config.Dir, name)
+			if err := writeFileAtomic(path, content); err != nil {
+				log.WithError(err).WithField("path", path).Error("Failed to write dataplane state")
+				delete(d.written, name)
+				d.dirty = true
+				continue
+			}
+			log.WithField("path", path).Info("Wrote dataplane state")
+			d.written[name] = content
+		}
+	}
+}
+
+func (d *RenderOnlyDataplane) reportProcessStatus() {
+	now := time.Now()
+	d.fromDataplane <- &proto.ProcessStatusUpdate{
+		IsoTimestamp: now.UTC().Format(time.RFC3339),
+		Uptime:       now.Sub(d.startTime).Seconds(),
+	}
+}
+
+// RenderIptablesSave renders the chains as the given table in the format
+// written by iptables-save and accepted by iptables-restore.
+func RenderIptablesSave(table string, chains []*iptables.Chain) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%s\n", table)
+	for _, chain := range chains {
+		fmt.Fprintf(&buf, ":%s - [0:0]\n", chain.Name)
+	}
+	for _, chain := range chains {
+		for _, rule := range chain.Rules {
+			rule.RenderAppendTo(&buf, chain.Name, "")
+			buf.WriteByte('\n')
+		}
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.Bytes()
+}
+
+// RenderIPSetRestore renders the IP sets of one IP version, such as those of
+// a debugserver.Stack, in the format accepted by ipset restore.
+func RenderIPSetRestore(ipSets map[string][]string, ipVersion uint8) []byte {
+	prefix, family := ipSetPrefixV4, "inet"
+	if ipVersion == 6 {
+		prefix, family = ipSetPrefixV6, "inet6"
+	}
+	ids := make([]string, 0, len(ipSets))
+	for id := range ipSets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var buf bytes.Buffer
+	for _, id := range ids {
+		name := id
+		if len(name) > maxIPSetIDLength {
+			name = name[:maxIPSetIDLength]
+		}
+		name = prefix + name
+		members := ipSets[id]
+		fmt.Fprintf(&buf, "create %s %s family %s\n", name, ipSetType(members), family)
+		for _, member := range members {
+			fmt.Fprintf(&buf, "add %s %s\n", name, member)
+		}
+	}
+	return buf.Bytes()
+}
+
+// RenderIPRoutes renders the routes in the format accepted by "ip -batch"
+// (or, for IPv6, "ip -6 -batch").
+func RenderIPRoutes(routes []debugserver.Route) []byte {
+	var buf bytes.Buffer
+	for _, route := range routes {
+		fmt.Fprintf(&buf, "route replace %s dev %s\n", route.Dst, route.Interface)
+	}
+	return buf.Bytes()
+}
+
+// ipSetType returns the type of IP set that can hold the given members.
+func ipSetType(members []string) string {
+	setType := "hash:ip"
+	for _, member := range members {
+		if strings.Contains(member, ",") {
+			return "hash:ip,port"
+		}
+		if strings.Contains(member, "/") {
+			setType = "hash:net"
+		}
+	}
+	return setType
+}
+
+// writeFileAtomic writes the file via a temporary file so that a reader
+// never sees a partial file.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package renderdataplane_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/renderdataplane"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var _ = Describe("RenderOnlyDataplane", func() {
+	var dir string
+	var dp *RenderOnlyDataplane
+
+	readFile := func(name string) func() string {
+		return func() string {
+			data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+			return string(data)
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-render")
+		Expect(err).NotTo(HaveOccurred())
+		dp = NewRenderOnlyDataplane(
+			rules.NewRenderer(rules.Config{WorkloadIfacePrefixes: []string{"cali"}}),
+			Config{Dir: dir, IPv6Enabled: true, ReportingInterval: time.Hour},
+		)
+		dp.Start()
+		msg, err := dp.RecvMessage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg).To(BeAssignableToTypeOf(&proto.ProcessStatusUpdate{}))
+
+		dp.SendMessage(&proto.IPSetUpdate{Id: "s1", Members: []string{"10.0.0.1", "fd00::1"}})
+		dp.SendMessage(&proto.WorkloadEndpointUpdate{
+			Id: &proto.WorkloadEndpointID{
+				OrchestratorId: "k8s",
+				WorkloadId:     "pod1",
+				EndpointId:     "eth0",
+			},
+			Endpoint: &proto.WorkloadEndpoint{Name: "cali1234"},
+		})
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should write nothing before the datastore is in sync", func() {
+		Consistently(readFile("ipset-restore.v4"), "50ms").Should(BeEmpty())
+	})
+
+	Describe("once in sync", func() {
+		BeforeEach(func() {
+			dp.SendMessage(&proto.InSync{})
+		})
+
+		It("should write the IP sets of each IP version", func() {
+			Eventually(readFile("ipset-restore.v4")).Should(Equal(
+				"create felix-4-s1 hash:ip family inet\n" +
+					"add felix-4-s1 10.0.0.1\n"))
+			Eventually(readFile("ipset-restore.v6")).Should(Equal(
+				"create felix-6-s1 hash:ip family inet6\n" +
+					"add felix-6-s1 fd00::1\n"))
+		})
+		It("should write the endpoint chains", func() {
+			Eventually(readFile("iptables-save.v4")).Should(ContainSubstring(":cali-tw-cali1234 - [0:0]\n"))
+			Expect(readFile("iptables-save.v4")()).To(HavePrefix("*filter\n"))
+			Expect(readFile("iptables-save.v4")()).To(HaveSuffix("COMMIT\n"))
+		})
+		It("should write the endpoint chains as JSON", func() {
+			Eventually(readFile("iptables-save.v4.json")).Should(ContainSubstring(`"name": "cali-tw-cali1234"`))
+		})
+		It("should write the routes of each IP version", func() {
+			dp.SendMessage(&proto.WorkloadEndpointUpdate{
+				Id: &proto.WorkloadEndpointID{
+					OrchestratorId: "k8s",
+					WorkloadId:     "pod1",
+					EndpointId:     "eth0",
+				},
+				Endpoint: &proto.WorkloadEndpoint{
+					Name:     "cali1234",
+					Ipv4Nets: []string{"10.0.0.1/32"},
+					Ipv6Nets: []string{"fd00::1/128"},
+				},
+			})
+			Eventually(readFile("ip-route.v4")).Should(Equal("route replace 10.0.0.1/32 dev cali1234\n"))
+			Eventually(readFile("ip-route.v6")).Should(Equal("route replace fd00::1/128 dev cali1234\n"))
+		})
+		It("should rewrite the files when the state changes", func() {
+			Eventually(readFile("ipset-restore.v4")).ShouldNot(BeEmpty())
+			dp.SendMessage(&proto.IPSetRemove{Id: "s1"})
+			Eventually(readFile("ipset-restore.v4")).Should(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("RenderIptablesSave", func() {
+	It("should declare all the chains before their rules", func() {
+		out := string(RenderIptablesSave("filter", []*iptables.Chain{
+			{Name: "cali-a", Rules: []iptables.Rule{{Action: iptables.JumpAction{Target: "cali-b"}}}},
+			{Name: "cali-b", Rules: []iptables.Rule{{Action: iptables.DropAction{}}}},
+		}))
+		Expect(strings.Split(out, "\n")).To(Equal([]string{
+			"*filter",
+			":cali-a - [0:0]",
+			":cali-b - [0:0]",
+			"-A cali-a --jump cali-b",
+			"-A cali-b --jump DROP",
+			"COMMIT",
+			"",
+		}))
+	})
+})
+
+var _ = Describe("RenderIPSetRestore", func() {
+	It("should pick a set type that fits the members", func() {
+		out := string(RenderIPSetRestore(map[string][]string{
+			"nets":  {"10.0.0.0/24", "10.0.1.1"},
+			"ports": {"10.0.0.1,tcp:80"},
+		}, 4))
+		Expect(out).To(ContainSubstring("create felix-4-nets hash:net family inet\n"))
+		Expect(out).To(ContainSubstring("create felix-4-ports hash:ip,port family inet\n"))
+	})
+	It("should truncate long IDs", func() {
+		out := string(RenderIPSetRestore(map[string][]string{
+			"0123456789abcdef0123456789abcdef": {},
+		}, 4))
+		Expect(out).To(Equal("create felix-4-0123456789abcdef01234567 hash:ip family inet\n"))
+	})
+})
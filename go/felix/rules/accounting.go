@@ -0,0 +1,63 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"strings"
+
+	"github.com/projectcalico/felix/go/felix/iptables"
+)
+
+const (
+	ChainAccounting = ChainNamePrefix + "-accounting"
+
+	// NfacctNamePrefix is prepended to the names of the traffic classes
+	// to give the names of their nfacct objects.
+	NfacctNamePrefix = ChainNamePrefix + "-"
+)
+
+// NfacctClass is a class of traffic, to or from CIDR, that's accounted
+// for in its own nfacct object.
+type NfacctClass struct {
+	Name string
+	CIDR string
+}
+
+// NfacctObjectName returns the name of the class's nfacct object.
+func (c NfacctClass) NfacctObjectName() string {
+	return NfacctNamePrefix + c.Name
+}
+
+// AccountingChain renders the filter-table chain that accounts the traffic
+// of each of the NfacctClasses, of the given IP version, to its nfacct
+// object.  It only counts, it never ends a packet's traversal, so it should
+// be jumped to from the top of the FORWARD, INPUT and OUTPUT chains.
+func (r *DefaultRuleRenderer) AccountingChain(ipVersion uint8) *iptables.Chain {
+	rules := []iptables.Rule{}
+	for _, class := range r.NfacctClasses {
+		if strings.Contains(class.CIDR, ":") != (ipVersion == 6) {
+			continue
+		}
+		objName := class.NfacctObjectName()
+		rules = append(rules,
+			iptables.Rule{Match: iptables.Match().SourceNet(class.CIDR).NfacctName(objName)},
+			iptables.Rule{Match: iptables.Match().DestNet(class.CIDR).NfacctName(objName)},
+		)
+	}
+	return &iptables.Chain{
+		Name:  ChainAccounting,
+		Rules: rules,
+	}
+}
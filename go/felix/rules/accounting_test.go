@@ -0,0 +1,50 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+)
+
+var _ = Describe("Accounting", func() {
+	renderer := NewRenderer(Config{
+		NfacctClasses: []NfacctClass{
+			{Name: "pods", CIDR: "10.65.0.0/16"},
+			{Name: "pods-v6", CIDR: "fd00:65::/64"},
+		},
+	})
+
+	It("should name the nfacct objects after the classes", func() {
+		Expect(NfacctClass{Name: "pods"}.NfacctObjectName()).To(Equal("cali-pods"))
+	})
+
+	It("should account the classes of the IP version in both directions", func() {
+		Expect(renderer.AccountingChain(4)).To(Equal(&Chain{
+			Name: "cali-accounting",
+			Rules: []Rule{
+				{Match: Match().SourceNet("10.65.0.0/16").NfacctName("cali-pods")},
+				{Match: Match().DestNet("10.65.0.0/16").NfacctName("cali-pods")},
+			},
+		}))
+		Expect(renderer.AccountingChain(6).Rules).To(Equal([]Rule{
+			{Match: Match().SourceNet("fd00:65::/64").NfacctName("cali-pods-v6")},
+			{Match: Match().DestNet("fd00:65::/64").NfacctName("cali-pods-v6")},
+		}))
+	})
+})
@@ -0,0 +1,78 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"net"
+)
+
+// WorkloadSourceChain renders the chain that the from-endpoint chain of the
+// given workload interface jumps to if AntiSpoofingEnabled is set.  It
+// returns for traffic from the sourceNets of the given IP version, which
+// are the workload's own addresses plus any allowed source prefixes, such
+// as a virtual IP that it shares for failover, and drops everything else,
+// so a workload can't send traffic from another workload's address even
+// if the reverse path filter is disabled.  Source nets that can't be
+// parsed are skipped.  It returns nil if AntiSpoofingEnabled isn't set.
+//
+// The chain differs between IP versions, unlike the endpoint chains
+// themselves.
+func (r *DefaultRuleRenderer) WorkloadSourceChain(
+	ifaceName string,
+	sourceNets []string,
+	ipVersion uint8,
+) *iptables.Chain {
+	if !r.AntiSpoofingEnabled {
+		return nil
+	}
+	rules := []iptables.Rule{}
+	for _, cidr := range sourceNets {
+		if netIPVersion(cidr) != ipVersion {
+			continue
+		}
+		rules = append(rules, iptables.Rule{
+			Match:  iptables.Match().SourceNet(cidr),
+			Action: iptables.ReturnAction{},
+		})
+	}
+	rules = append(rules, iptables.Rule{
+		Action:  iptables.DropAction{},
+		Comment: []string{"Drop if source address is not the endpoint's"},
+	})
+	return &iptables.Chain{
+		Name:  EndpointChainName(WorkloadSourcePfx, ifaceName),
+		Rules: rules,
+	}
+}
+
+// netIPVersion returns the IP version of an address or CIDR, or 0 if it
+// can't be parsed.
+func netIPVersion(cidr string) uint8 {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		ip = net.ParseIP(cidr)
+	}
+	switch {
+	case ip == nil:
+		log.WithField("cidr", cidr).Warn("Ignoring invalid source net")
+		return 0
+	case ip.To4() != nil:
+		return 4
+	default:
+		return 6
+	}
+}
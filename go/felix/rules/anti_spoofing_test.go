@@ -0,0 +1,82 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+)
+
+var _ = Describe("Anti-spoofing", func() {
+	var renderer RuleRenderer
+	nets := []string{"10.0.0.1/32", "fd00::1/128", "10.0.1.0/24", "bogus"}
+	dropRule := Rule{
+		Action:  DropAction{},
+		Comment: []string{"Drop if source address is not the endpoint's"},
+	}
+
+	Describe("when enabled", func() {
+		BeforeEach(func() {
+			renderer = NewRenderer(Config{
+				WorkloadIfacePrefixes: []string{"cali"},
+				IptablesMarkAccept:    0x8,
+				IptablesMarkNextTier:  0x10,
+				AntiSpoofingEnabled:   true,
+			})
+		})
+
+		It("should only allow the endpoint's IPv4 nets in the IPv4 chain", func() {
+			Expect(renderer.WorkloadSourceChain("cali1234", nets, 4)).To(Equal(&Chain{
+				Name: "cali-fs-cali1234",
+				Rules: []Rule{
+					{Match: Match().SourceNet("10.0.0.1/32"), Action: ReturnAction{}},
+					{Match: Match().SourceNet("10.0.1.0/24"), Action: ReturnAction{}},
+					dropRule,
+				},
+			}))
+		})
+		It("should only allow the endpoint's IPv6 nets in the IPv6 chain", func() {
+			Expect(renderer.WorkloadSourceChain("cali1234", nets, 6).Rules).To(Equal([]Rule{
+				{Match: Match().SourceNet("fd00::1/128"), Action: ReturnAction{}},
+				dropRule,
+			}))
+		})
+		It("should drop everything from an endpoint with no addresses", func() {
+			Expect(renderer.WorkloadSourceChain("cali1234", nil, 4).Rules).To(Equal(
+				[]Rule{dropRule}))
+		})
+		It("should jump to the source chain after the MAC check", func() {
+			chains := renderer.WorkloadEndpointToIptablesChains(
+				"cali1234", "aa:bb:cc:dd:ee:ff", nil, []string{"prof1"}, ConntrackBypassOn, false,
+			)
+			Expect(chains[1].Rules[0].Match).To(Equal(Match().NotSourceMAC("aa:bb:cc:dd:ee:ff")))
+			Expect(chains[1].Rules[1]).To(Equal(Rule{
+				Action: JumpAction{Target: "cali-fs-cali1234"},
+			}))
+			Expect(chains[1].Rules[2].Match).To(Equal(Match().ConntrackState("RELATED,ESTABLISHED")))
+			for _, rule := range chains[0].Rules {
+				Expect(rule.Action).NotTo(Equal(JumpAction{Target: "cali-fs-cali1234"}))
+			}
+		})
+	})
+
+	It("should render no source chain when disabled", func() {
+		renderer = NewRenderer(Config{WorkloadIfacePrefixes: []string{"cali"}})
+		Expect(renderer.WorkloadSourceChain("cali1234", nets, 4)).To(BeNil())
+	})
+})
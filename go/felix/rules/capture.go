@@ -0,0 +1,33 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+const (
+	// NflogCaptureGroup is the NFLOG group that the capture package's
+	// temporary rules send packets to.
+	NflogCaptureGroup uint16 = 4
+	// NflogCapturePrefix is the prefix of the capture rules' packets.
+	NflogCapturePrefix = "CAPTURE"
+)
+
+// CaptureChainName returns the name of the chain to attach a capture to for
+// the given endpoint interface.  Inbound captures see the traffic to the
+// endpoint; outbound ones see the traffic from it.
+func CaptureChainName(ifaceName string, inbound bool) string {
+	if inbound {
+		return EndpointChainName(WorkloadToEndpointPfx, ifaceName)
+	}
+	return EndpointChainName(WorkloadFromEndpointPfx, ifaceName)
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"unicode/utf8"
+)
+
+const (
+	// truncatedNameMarker separates a truncated name from the hash of the
+	// full name in a comment.
+	truncatedNameMarker = "~"
+	// commentNameHashLength is the number of characters of the hash of the
+	// full name that a truncated comment ends with.
+	commentNameHashLength = 10
+)
+
+// NameComment returns a rule comment made of the given text followed by a
+// name, such as a tier or threat feed name, that comes from the user.
+//
+// A comment can be at most iptables.MaxCommentLength bytes.  If the text
+// and name don't fit, the name is truncated, without splitting a UTF-8
+// character, and followed by "~" and a hash of the full name.  So the
+// comment is the same on every host, and on every version of Felix, while
+// names that share a long prefix still get different comments.  The
+// debugserver's Explain maps a tier's truncated comment back to the tier.
+func NameComment(text, name string) string {
+	if len(text)+len(name) <= iptables.MaxCommentLength {
+		return text + name
+	}
+	hasher := sha256.New()
+	hasher.Write([]byte(name))
+	hash := base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))[:commentNameHashLength]
+	keep := iptables.MaxCommentLength - len(text) - len(truncatedNameMarker) - len(hash)
+	if keep < 0 {
+		keep = 0
+	}
+	for keep > 0 && !utf8.RuneStart(name[keep]) {
+		keep--
+	}
+	comment := text + name[:keep] + truncatedNameMarker + hash
+	log.WithFields(log.Fields{
+		"name":    name,
+		"comment": comment,
+	}).Debug("Truncated name to fit in rule comment")
+	return comment
+}
+
+// TierStartComment returns the comment on the rule that starts the given
+// tier in an endpoint chain.
+func TierStartComment(tierName string) string {
+	return NameComment("Start of tier ", tierName)
+}
+
+// ThreatFeedComment returns the comment on the rule that drops traffic from
+// (or, if inbound is false, to) the entries of the given threat feed.
+func ThreatFeedComment(feedName string, inbound bool) string {
+	if inbound {
+		return NameComment("Drop traffic from threat feed ", feedName)
+	}
+	return NameComment("Drop traffic to threat feed ", feedName)
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"strings"
+	"unicode/utf8"
+)
+
+var _ = Describe("NameComment", func() {
+	long := strings.Repeat("x", 300)
+
+	It("should leave a comment that fits alone", func() {
+		Expect(NameComment("Start of tier ", "default")).To(Equal("Start of tier default"))
+	})
+	It("should use the whole budget for a comment that doesn't fit", func() {
+		comment := NameComment("Start of tier ", long)
+		Expect(comment).To(HaveLen(iptables.MaxCommentLength))
+		Expect(comment).To(HavePrefix("Start of tier xxx"))
+		Expect(comment).To(ContainSubstring("~"))
+	})
+	It("should truncate deterministically", func() {
+		Expect(NameComment("Start of tier ", long)).To(Equal(NameComment("Start of tier ", long)))
+	})
+	It("should give names with the same long prefix different comments", func() {
+		Expect(NameComment("Start of tier ", long+"a")).NotTo(Equal(
+			NameComment("Start of tier ", long+"b")))
+	})
+	It("should not split a UTF-8 character", func() {
+		comment := NameComment("Start of tier ", strings.Repeat("é", 200))
+		Expect(len(comment)).To(BeNumerically("<=", iptables.MaxCommentLength))
+		Expect(utf8.ValidString(comment)).To(BeTrue())
+	})
+})
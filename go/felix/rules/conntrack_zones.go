@@ -0,0 +1,72 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"strings"
+)
+
+const ChainConntrackZones = ChainNamePrefix + "-ct-zones"
+
+// EndpointConntrackZone assigns the connections of a workload endpoint to
+// a conntrack zone, so that workloads in different zones can use
+// overlapping IP ranges without their connections colliding.
+type EndpointConntrackZone struct {
+	IfaceName string
+	// Addrs are the endpoint's addresses, of both IP versions; traffic
+	// towards the endpoint is picked out by its destination since, in the
+	// raw table, the routing decision hasn't been made yet.
+	Addrs []string
+	Zone  uint16
+}
+
+// ConntrackZoneChain renders the raw-table chain that puts each endpoint's
+// traffic in the endpoint's zone: traffic from the endpoint by ingress
+// interface and traffic to it by destination.  It should be jumped to from
+// the raw PREROUTING and OUTPUT chains of the given IP version.  Endpoints
+// in zone 0, the default zone, need no rules.
+func (r *DefaultRuleRenderer) ConntrackZoneChain(
+	zones []EndpointConntrackZone,
+	ipVersion uint8,
+) *iptables.Chain {
+	rules := []iptables.Rule{}
+	for _, epZone := range zones {
+		if epZone.Zone == 0 {
+			log.WithField("iface", epZone.IfaceName).Debug(
+				"Endpoint in default conntrack zone")
+			continue
+		}
+		action := iptables.CTZoneAction{Zone: epZone.Zone}
+		rules = append(rules, iptables.Rule{
+			Match:  iptables.Match().InInterface(epZone.IfaceName),
+			Action: action,
+		})
+		for _, addr := range epZone.Addrs {
+			if strings.Contains(addr, ":") != (ipVersion == 6) {
+				continue
+			}
+			rules = append(rules, iptables.Rule{
+				Match:  iptables.Match().DestNet(addr),
+				Action: action,
+			})
+		}
+	}
+	return &iptables.Chain{
+		Name:  ChainConntrackZones,
+		Rules: rules,
+	}
+}
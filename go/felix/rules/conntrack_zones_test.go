@@ -0,0 +1,48 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+)
+
+var _ = Describe("Conntrack zones", func() {
+	renderer := NewRenderer(Config{})
+
+	zones := []EndpointConntrackZone{
+		{IfaceName: "cali1234", Addrs: []string{"10.0.0.1/32", "fd00::1/128"}, Zone: 10},
+		{IfaceName: "cali5678", Addrs: []string{"10.0.0.1/32"}, Zone: 0},
+	}
+
+	It("should put each endpoint's traffic in its zone", func() {
+		Expect(renderer.ConntrackZoneChain(zones, 4)).To(Equal(&Chain{
+			Name: "cali-ct-zones",
+			Rules: []Rule{
+				{Match: Match().InInterface("cali1234"), Action: CTZoneAction{Zone: 10}},
+				{Match: Match().DestNet("10.0.0.1/32"), Action: CTZoneAction{Zone: 10}},
+			},
+		}))
+	})
+	It("should only match addresses of the chain's IP version", func() {
+		Expect(renderer.ConntrackZoneChain(zones, 6).Rules).To(Equal([]Rule{
+			{Match: Match().InInterface("cali1234"), Action: CTZoneAction{Zone: 10}},
+			{Match: Match().DestNet("fd00::1/128"), Action: CTZoneAction{Zone: 10}},
+		}))
+	})
+})
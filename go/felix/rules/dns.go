@@ -0,0 +1,70 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"net"
+)
+
+const (
+	ChainDNSSnoop = ChainNamePrefix + "-dns-snoop"
+
+	// NflogDNSGroup is the NFLOG group that the snoop chain sends DNS
+	// responses to.
+	NflogDNSGroup uint16 = 3
+
+	nflogDNSPrefix = "DNS"
+	dnsPort        = 53
+)
+
+// DNSSnoopChain renders the filter-table chain that copies DNS responses to
+// the dnspolicy package's snooper, via NFLOG.  It should be jumped to from
+// the INPUT and FORWARD chains, before any policy, so that the snooper sees
+// the responses for the host and for its workloads.
+//
+// If DNSTrustedServers is set, only responses from those servers are copied
+// (and a family with no trusted servers gets an empty chain); otherwise
+// responses from any server are copied.
+func (r *DefaultRuleRenderer) DNSSnoopChain(ipVersion uint8) *iptables.Chain {
+	action := iptables.NflogAction{
+		Group:  NflogDNSGroup,
+		Prefix: nflogDNSPrefix,
+	}
+	rules := []iptables.Rule{}
+	if len(r.DNSTrustedServers) == 0 {
+		rules = append(rules, iptables.Rule{
+			Match:  iptables.Match().Protocol("udp").SourcePorts(dnsPort),
+			Action: action,
+		})
+	}
+	for _, server := range r.DNSTrustedServers {
+		ip := net.ParseIP(server)
+		if ip == nil || (ip.To4() != nil) != (ipVersion == 4) {
+			continue
+		}
+		rules = append(rules, iptables.Rule{
+			Match: iptables.Match().
+				Protocol("udp").
+				SourceNet(ip.String()).
+				SourcePorts(dnsPort),
+			Action: action,
+		})
+	}
+	return &iptables.Chain{
+		Name:  ChainDNSSnoop,
+		Rules: rules,
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+)
+
+var _ = Describe("DNS snoop chain", func() {
+	snoopAction := NflogAction{Group: 3, Prefix: "DNS"}
+
+	It("should snoop responses from any server by default", func() {
+		renderer := NewRenderer(Config{})
+		Expect(renderer.DNSSnoopChain(4)).To(Equal(&Chain{
+			Name: "cali-dns-snoop",
+			Rules: []Rule{
+				{Match: Match().Protocol("udp").SourcePorts(53), Action: snoopAction},
+			},
+		}))
+	})
+	It("should only snoop responses from trusted servers of the right family", func() {
+		renderer := NewRenderer(Config{
+			DNSTrustedServers: []string{"10.0.0.53", "fd00::53", "10.0.1.53"},
+		})
+		Expect(renderer.DNSSnoopChain(4)).To(Equal(&Chain{
+			Name: "cali-dns-snoop",
+			Rules: []Rule{
+				{Match: Match().Protocol("udp").SourceNet("10.0.0.53").SourcePorts(53), Action: snoopAction},
+				{Match: Match().Protocol("udp").SourceNet("10.0.1.53").SourcePorts(53), Action: snoopAction},
+			},
+		}))
+		Expect(renderer.DNSSnoopChain(6)).To(Equal(&Chain{
+			Name: "cali-dns-snoop",
+			Rules: []Rule{
+				{Match: Match().Protocol("udp").SourceNet("fd00::53").SourcePorts(53), Action: snoopAction},
+			},
+		}))
+	})
+	It("should render an empty chain if there are no trusted servers of the family", func() {
+		renderer := NewRenderer(Config{DNSTrustedServers: []string{"10.0.0.53"}})
+		Expect(renderer.DNSSnoopChain(6).Rules).To(BeEmpty())
+	})
+})
@@ -0,0 +1,47 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"github.com/projectcalico/felix/go/felix/iptables"
+)
+
+const ChainDSCP = ChainNamePrefix + "-dscp"
+
+// EndpointDSCP is the DSCP value that a workload endpoint has requested for
+// its egress traffic.
+type EndpointDSCP struct {
+	IfaceName string
+	DSCP      uint8
+}
+
+// DSCPChain renders the mangle-table chain that sets the requested DSCP
+// value on each endpoint's egress traffic, which it picks out by ingress
+// interface.  The DSCP target works for both IP versions, so the chain is
+// the same for both.  It should be jumped to from the mangle PREROUTING
+// chain.
+func (r *DefaultRuleRenderer) DSCPChain(endpoints []EndpointDSCP) *iptables.Chain {
+	rules := []iptables.Rule{}
+	for _, ep := range endpoints {
+		rules = append(rules, iptables.Rule{
+			Match:  iptables.Match().InInterface(ep.IfaceName),
+			Action: iptables.SetDSCPAction{DSCP: ep.DSCP},
+		})
+	}
+	return &iptables.Chain{
+		Name:  ChainDSCP,
+		Rules: rules,
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+)
+
+var _ = Describe("DSCP", func() {
+	renderer := NewRenderer(Config{})
+
+	It("should set each endpoint's DSCP value", func() {
+		Expect(renderer.DSCPChain([]EndpointDSCP{
+			{IfaceName: "cali1234", DSCP: 46},
+			{IfaceName: "cali5678", DSCP: 0},
+		})).To(Equal(&Chain{
+			Name: "cali-dscp",
+			Rules: []Rule{
+				{Match: Match().InInterface("cali1234"), Action: SetDSCPAction{DSCP: 46}},
+				{Match: Match().InInterface("cali5678"), Action: SetDSCPAction{DSCP: 0}},
+			},
+		}))
+	})
+	It("should render an empty chain with no endpoints", func() {
+		Expect(renderer.DSCPChain(nil).Rules).To(BeEmpty())
+	})
+})
@@ -0,0 +1,122 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/markbits"
+	"strconv"
+)
+
+// DSRTunnelDevice is the IP-in-IP device that direct server return traffic
+// is routed over, and arrives on.  DSR is IPv4-only, like the tunnel.
+const DSRTunnelDevice = "tunl0"
+
+// DSRRoute routes the traffic that's marked with a host's DSR mark to that
+// host, over the tunnel, without changing its destination.  The host
+// DNATs the traffic to one of its own backends so, when the backend
+// replies, the host reverses the DNAT and sends the reply straight to the
+// client, rather than back through us.
+type DSRRoute struct {
+	Mark     uint32
+	Mask     uint32
+	Table    int
+	HostAddr string
+}
+
+// RuleArgs returns the arguments to "ip" that add the routing rule that
+// sends marked traffic to the host's routing table.
+func (r DSRRoute) RuleArgs() []string {
+	return []string{
+		"rule", "add",
+		"fwmark", fmt.Sprintf("%#x/%#x", r.Mark, r.Mask),
+		"table", strconv.Itoa(r.Table),
+	}
+}
+
+// RouteArgs returns the arguments to "ip" that program the host's routing
+// table.
+func (r DSRRoute) RouteArgs() []string {
+	return []string{
+		"route", "replace", "default",
+		"via", r.HostAddr,
+		"dev", DSRTunnelDevice,
+		"onlink",
+		"table", strconv.Itoa(r.Table),
+	}
+}
+
+// MaxDSRHosts returns the number of hosts that the IptablesMarkDSR field
+// can identify; zero if DSR is disabled.
+func (r *DefaultRuleRenderer) MaxDSRHosts() int {
+	return markbits.MaxNumber(r.IptablesMarkDSR)
+}
+
+// DSRHostMark returns the DSR mark of the host with the given index, from
+// 1 to MaxDSRHosts.
+func (r *DefaultRuleRenderer) DSRHostMark(hostIdx int) (uint32, error) {
+	if hostIdx < 1 || hostIdx > r.MaxDSRHosts() {
+		return 0, errors.New("DSR host index out of range")
+	}
+	return markbits.MapNumberToMark(hostIdx, r.IptablesMarkDSR)
+}
+
+// DSRRoute returns the route for the host with the given index.
+func (r *DefaultRuleRenderer) DSRRoute(hostIdx int, hostAddr string) (DSRRoute, error) {
+	mark, err := r.DSRHostMark(hostIdx)
+	if err != nil {
+		return DSRRoute{}, err
+	}
+	return DSRRoute{
+		Mark:     mark,
+		Mask:     r.IptablesMarkDSR,
+		Table:    r.DSRRouteTableBase + hostIdx,
+		HostAddr: hostAddr,
+	}, nil
+}
+
+// DSRRestoreMarkRules renders the mangle-table rules that copy the DSR
+// mark from each DSR connection to its packets.  The nat chains only see
+// a connection's first packet so, without these rules, the rest of its
+// packets wouldn't be routed to the host.  They belong in the mangle
+// PREROUTING chain.
+func (r *DefaultRuleRenderer) DSRRestoreMarkRules() []iptables.Rule {
+	if r.IptablesMarkDSR == 0 {
+		return nil
+	}
+	return []iptables.Rule{{
+		Match:  iptables.Match().ConntrackState("ESTABLISHED,RELATED"),
+		Action: iptables.RestoreConnMarkAction{RestoreMask: r.IptablesMarkDSR},
+	}}
+}
+
+// dsrBackendRules renders the rules that mark a connection for DSR, save
+// the mark to the connection, and accept it to end its nat processing,
+// leaving its destination alone.
+func (r *DefaultRuleRenderer) dsrBackendRules(match iptables.MatchCriteria, dsrMark uint32) []iptables.Rule {
+	return []iptables.Rule{
+		{
+			Match: match,
+			Action: iptables.SetMaskedMarkAction{
+				Mark: dsrMark,
+				Mask: r.IptablesMarkDSR,
+			},
+		},
+		{Action: iptables.SaveConnMarkAction{SaveMask: r.IptablesMarkDSR}},
+		{Action: iptables.AcceptAction{}},
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+)
+
+var _ = Describe("DSR", func() {
+	var renderer RuleRenderer
+	BeforeEach(func() {
+		renderer = NewRenderer(Config{
+			IptablesMarkMasq:  0x4,
+			IptablesMarkDSR:   0x70,
+			DSRRouteTableBase: 200,
+		})
+	})
+
+	It("should mark and accept traffic to a backend on another host", func() {
+		backend := LoadBalancerBackend{Addr: "10.0.1.5", Port: 8080, DSRMark: 0x30}
+		Expect(renderer.LoadBalancerBackendChain("svc", backend, 4, false)).To(Equal(&Chain{
+			Name: LoadBalancerBackendChainName("svc", backend),
+			Rules: []Rule{
+				{Action: SetMaskedMarkAction{Mark: 0x30, Mask: 0x70}},
+				{Action: SaveConnMarkAction{SaveMask: 0x70}},
+				{Action: AcceptAction{}},
+			},
+		}))
+	})
+	It("should number hosts within the mark field", func() {
+		Expect(renderer.MaxDSRHosts()).To(Equal(7))
+		Expect(renderer.DSRHostMark(3)).To(Equal(uint32(0x30)))
+		_, err := renderer.DSRHostMark(8)
+		Expect(err).To(HaveOccurred())
+		_, err = renderer.DSRHostMark(0)
+		Expect(err).To(HaveOccurred())
+	})
+	It("should route each host's traffic over the tunnel", func() {
+		route, err := renderer.DSRRoute(3, "192.168.0.3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(route.RuleArgs()).To(Equal([]string{
+			"rule", "add", "fwmark", "0x30/0x70", "table", "203",
+		}))
+		Expect(route.RouteArgs()).To(Equal([]string{
+			"route", "replace", "default", "via", "192.168.0.3",
+			"dev", "tunl0", "onlink", "table", "203",
+		}))
+	})
+	It("should restore the mark of established connections", func() {
+		Expect(renderer.DSRRestoreMarkRules()).To(Equal([]Rule{
+			{
+				Match:  Match().ConntrackState("ESTABLISHED,RELATED"),
+				Action: RestoreConnMarkAction{RestoreMask: 0x70},
+			},
+		}))
+	})
+	It("should be disabled without a mark field", func() {
+		renderer = NewRenderer(Config{})
+		Expect(renderer.MaxDSRHosts()).To(Equal(0))
+		Expect(renderer.DSRRestoreMarkRules()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,138 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"fmt"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"strconv"
+)
+
+const (
+	ChainEgressGatewayMark = ChainNamePrefix + "-egress-gw-mark"
+	ChainEgressGatewayNAT  = ChainNamePrefix + "-egress-gw-nat"
+)
+
+const (
+	EgressGatewayRoleNone    = "none"
+	EgressGatewayRoleClient  = "client"
+	EgressGatewayRoleGateway = "gateway"
+)
+
+// EgressGatewayRoute routes the traffic that's marked with
+// IptablesMarkEgressGateway to the egress gateway, which must be on a
+// directly-connected network.
+type EgressGatewayRoute struct {
+	Mark        uint32
+	Table       int
+	GatewayAddr string
+}
+
+// RuleArgs returns the arguments to "ip" that add the routing rule that
+// sends marked traffic to the gateway's routing table.
+func (r EgressGatewayRoute) RuleArgs() []string {
+	return []string{
+		"rule", "add",
+		"fwmark", fmt.Sprintf("%#x/%#x", r.Mark, r.Mark),
+		"table", strconv.Itoa(r.Table),
+	}
+}
+
+// RouteArgs returns the arguments to "ip" that program the gateway's
+// routing table.
+func (r EgressGatewayRoute) RouteArgs() []string {
+	return []string{
+		"route", "replace", "default",
+		"via", r.GatewayAddr,
+		"table", strconv.Itoa(r.Table),
+	}
+}
+
+// EgressGatewayMarkChain renders the mangle-table chain that marks the
+// external traffic of the egress gateway's workloads so that it's routed
+// to the gateway.  It only has rules on client hosts.  It should be
+// jumped to from the mangle PREROUTING chain.
+func (r *DefaultRuleRenderer) EgressGatewayMarkChain() *iptables.Chain {
+	rules := []iptables.Rule{}
+	if r.EgressGatewayRole == EgressGatewayRoleClient && r.IptablesMarkEgressGateway != 0 {
+		rules = append(rules, r.egressGatewayExclusionRules()...)
+		for _, cidr := range r.EgressGatewaySourceCIDRs {
+			rules = append(rules, iptables.Rule{
+				Match:  iptables.Match().SourceNet(cidr),
+				Action: iptables.SetMarkAction{Mark: r.IptablesMarkEgressGateway},
+			})
+		}
+	}
+	return &iptables.Chain{
+		Name:  ChainEgressGatewayMark,
+		Rules: rules,
+	}
+}
+
+// EgressGatewayNATChain renders the nat-table chain that, on client hosts,
+// exempts the marked traffic from SNAT, so that the gateway sees the
+// workload's address, and, on the gateway, SNATs the workloads' external
+// traffic to the gateway's address.  It should be jumped to from the top
+// of the nat POSTROUTING chain, ahead of any masquerade rules.
+func (r *DefaultRuleRenderer) EgressGatewayNATChain() *iptables.Chain {
+	rules := []iptables.Rule{}
+	switch r.EgressGatewayRole {
+	case EgressGatewayRoleClient:
+		if r.IptablesMarkEgressGateway != 0 {
+			rules = append(rules, iptables.Rule{
+				Match:  iptables.Match().MarkSet(r.IptablesMarkEgressGateway),
+				Action: iptables.AcceptAction{},
+			})
+		}
+	case EgressGatewayRoleGateway:
+		rules = append(rules, r.egressGatewayExclusionRules()...)
+		for _, cidr := range r.EgressGatewaySourceCIDRs {
+			rules = append(rules, iptables.Rule{
+				Match:  iptables.Match().SourceNet(cidr),
+				Action: iptables.SNATAction{ToAddr: r.EgressGatewayAddr},
+			})
+		}
+	}
+	return &iptables.Chain{
+		Name:  ChainEgressGatewayNAT,
+		Rules: rules,
+	}
+}
+
+// EgressGatewayRoute returns the route to the gateway, or false if this
+// isn't a client host.
+func (r *DefaultRuleRenderer) EgressGatewayRoute() (EgressGatewayRoute, bool) {
+	if r.EgressGatewayRole != EgressGatewayRoleClient || r.IptablesMarkEgressGateway == 0 {
+		return EgressGatewayRoute{}, false
+	}
+	return EgressGatewayRoute{
+		Mark:        r.IptablesMarkEgressGateway,
+		Table:       r.EgressGatewayRouteTable,
+		GatewayAddr: r.EgressGatewayAddr,
+	}, true
+}
+
+// egressGatewayExclusionRules renders the rules that return traffic to
+// destinations that aren't external.
+func (r *DefaultRuleRenderer) egressGatewayExclusionRules() []iptables.Rule {
+	rules := []iptables.Rule{}
+	for _, cidr := range r.EgressGatewayExcludedCIDRs {
+		rules = append(rules, iptables.Rule{
+			Match:  iptables.Match().DestNet(cidr),
+			Action: iptables.ReturnAction{},
+		})
+	}
+	return rules
+}
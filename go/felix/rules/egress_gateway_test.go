@@ -0,0 +1,96 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+)
+
+var _ = Describe("Egress gateway", func() {
+	var config Config
+	BeforeEach(func() {
+		config = Config{
+			EgressGatewayRole:          EgressGatewayRoleClient,
+			IptablesMarkEgressGateway:  0x8,
+			EgressGatewayAddr:          "10.0.0.254",
+			EgressGatewaySourceCIDRs:   []string{"10.65.0.0/16"},
+			EgressGatewayExcludedCIDRs: []string{"10.64.0.0/10"},
+			EgressGatewayRouteTable:    999,
+		}
+	})
+
+	Describe("on a client host", func() {
+		var renderer RuleRenderer
+		BeforeEach(func() {
+			renderer = NewRenderer(config)
+		})
+
+		It("should mark the workloads' external traffic", func() {
+			Expect(renderer.EgressGatewayMarkChain()).To(Equal(&Chain{
+				Name: "cali-egress-gw-mark",
+				Rules: []Rule{
+					{Match: Match().DestNet("10.64.0.0/10"), Action: ReturnAction{}},
+					{Match: Match().SourceNet("10.65.0.0/16"), Action: SetMarkAction{Mark: 0x8}},
+				},
+			}))
+		})
+		It("should exempt marked traffic from SNAT", func() {
+			Expect(renderer.EgressGatewayNATChain().Rules).To(Equal([]Rule{
+				{Match: Match().MarkSet(0x8), Action: AcceptAction{}},
+			}))
+		})
+		It("should route marked traffic to the gateway", func() {
+			route, ok := renderer.EgressGatewayRoute()
+			Expect(ok).To(BeTrue())
+			Expect(route.RuleArgs()).To(Equal([]string{
+				"rule", "add", "fwmark", "0x8/0x8", "table", "999",
+			}))
+			Expect(route.RouteArgs()).To(Equal([]string{
+				"route", "replace", "default", "via", "10.0.0.254", "table", "999",
+			}))
+		})
+	})
+
+	Describe("on the gateway", func() {
+		var renderer RuleRenderer
+		BeforeEach(func() {
+			config.EgressGatewayRole = EgressGatewayRoleGateway
+			config.IptablesMarkEgressGateway = 0
+			renderer = NewRenderer(config)
+		})
+
+		It("should SNAT the workloads' external traffic", func() {
+			Expect(renderer.EgressGatewayNATChain().Rules).To(Equal([]Rule{
+				{Match: Match().DestNet("10.64.0.0/10"), Action: ReturnAction{}},
+				{Match: Match().SourceNet("10.65.0.0/16"), Action: SNATAction{ToAddr: "10.0.0.254"}},
+			}))
+		})
+		It("should neither mark nor route", func() {
+			Expect(renderer.EgressGatewayMarkChain().Rules).To(BeEmpty())
+			_, ok := renderer.EgressGatewayRoute()
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	It("should do nothing by default", func() {
+		renderer := NewRenderer(Config{})
+		Expect(renderer.EgressGatewayMarkChain().Rules).To(BeEmpty())
+		Expect(renderer.EgressGatewayNATChain().Rules).To(BeEmpty())
+	})
+})
@@ -0,0 +1,284 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"github.com/projectcalico/felix/go/felix/hashutils"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/proto"
+)
+
+// ConntrackBypass controls whether an endpoint's chains start with a rule
+// that accepts packets belonging to already-established flows.  Enabling the
+// bypass means that only the first packet of each flow is checked against
+// policy, which greatly reduces the per-packet cost of long policy chains.
+// The trade-off is that a policy change doesn't affect flows that were
+// already established before the change.
+type ConntrackBypass int
+
+const (
+	// ConntrackBypassDefault uses the renderer's ConntrackBypassEnabled
+	// setting.
+	ConntrackBypassDefault ConntrackBypass = iota
+	ConntrackBypassOn
+	ConntrackBypassOff
+)
+
+// WorkloadEndpointToIptablesChains renders the chains for traffic to and
+// from a workload endpoint.  If mac is set, the from-endpoint chain drops
+// packets with any other source MAC, which stops the workload from
+// spoofing another's MAC.  If AntiSpoofingEnabled is set, the from-endpoint
+// chain then jumps to the endpoint's WorkloadSourceChain, which must be
+// programmed alongside it.
+//
+// If verdictCache is set, and the verdict cache mark bits are configured,
+// the chains record an accept verdict in the connection's mark and accept
+// later packets of the flow with a single connmark match.  Unlike the
+// conntrack bypass, the cached verdicts can be invalidated after a policy
+// change by removing the marked flows with
+// conntrack.QueueMarkedFlowRemoval().
+func (r *DefaultRuleRenderer) WorkloadEndpointToIptablesChains(
+	ifaceName string,
+	mac string,
+	tiers []*proto.TierInfo,
+	profileIDs []string,
+	conntrackBypass ConntrackBypass,
+	verdictCache bool,
+) []*Chain {
+	bypass := r.conntrackBypassEnabled(conntrackBypass)
+	var cacheMarkIn, cacheMarkOut uint32
+	if verdictCache {
+		cacheMarkIn = r.IptablesMarkVerdictCacheIn
+		cacheMarkOut = r.IptablesMarkVerdictCacheOut
+	}
+	return []*Chain{
+		// Chain for traffic _to_ the endpoint.
+		r.endpointToIptablesChain(
+			tiers,
+			profileIDs,
+			ifaceName,
+			PolicyInboundPfx,
+			ProfileInboundPfx,
+			WorkloadToEndpointPfx,
+			"",
+			false,
+			NflogInboundGroup,
+			bypass,
+			cacheMarkIn,
+		),
+		// Chain for traffic _from_ the endpoint.
+		r.endpointToIptablesChain(
+			tiers,
+			profileIDs,
+			ifaceName,
+			PolicyOutboundPfx,
+			ProfileOutboundPfx,
+			WorkloadFromEndpointPfx,
+			mac,
+			r.AntiSpoofingEnabled,
+			NflogOutboundGroup,
+			bypass,
+			cacheMarkOut,
+		),
+	}
+}
+
+// VerdictCacheMarks returns the connmark bits in which the endpoint chains
+// cache their verdicts, or nil if the verdict cache is disabled.  Removing
+// the flows that have them set, after a change that could change a
+// verdict, makes those flows' next packets go through policy again.
+func (r *DefaultRuleRenderer) VerdictCacheMarks() []uint32 {
+	if r.IptablesMarkVerdictCacheIn == 0 || r.IptablesMarkVerdictCacheOut == 0 {
+		return nil
+	}
+	return []uint32{r.IptablesMarkVerdictCacheIn, r.IptablesMarkVerdictCacheOut}
+}
+
+func (r *DefaultRuleRenderer) conntrackBypassEnabled(mode ConntrackBypass) bool {
+	switch mode {
+	case ConntrackBypassOn:
+		return true
+	case ConntrackBypassOff:
+		return false
+	default:
+		return r.ConntrackBypassEnabled
+	}
+}
+
+func (r *DefaultRuleRenderer) endpointToIptablesChain(
+	tiers []*proto.TierInfo,
+	profileIDs []string,
+	name string,
+	policyPrefix PolicyChainNamePrefix,
+	profilePrefix ProfileChainNamePrefix,
+	endpointPrefix string,
+	expectedSourceMAC string,
+	checkSourceAddr bool,
+	nflogGroup uint16,
+	conntrackBypass bool,
+	verdictCacheMark uint32,
+) *Chain {
+	rules := []Rule{}
+	chainName := EndpointChainName(endpointPrefix, name)
+
+	if expectedSourceMAC != "" {
+		// Police the source MAC first so that the bypass below can't let
+		// through spoofed packets that happen to match an existing flow.
+		rules = append(rules, Rule{
+			Match:   Match().NotSourceMAC(expectedSourceMAC),
+			Action:  DropAction{},
+			Comment: []string{"Drop if source MAC is not the endpoint's"},
+		})
+	}
+
+	if checkSourceAddr {
+		rules = append(rules, Rule{
+			Action: JumpAction{Target: EndpointChainName(WorkloadSourcePfx, name)},
+		})
+	}
+
+	if conntrackBypass {
+		// Short-circuit packets from flows that have already been
+		// accepted; only the first packet of a flow reaches the policy
+		// chains below.
+		rules = append(rules, AcceptEstablishedTemplate(TemplateParams{
+			Comment: "Bypass policy for established flows",
+		})...)
+	}
+
+	if verdictCacheMark != 0 {
+		// Accept packets from flows whose first packet was accepted by
+		// the policy chains below.
+		rules = append(rules, Rule{
+			Match:   Match().ConnMarkSet(verdictCacheMark),
+			Action:  AcceptAction{},
+			Comment: []string{"Accept flows with a cached verdict"},
+		})
+	}
+
+	// Start by ensuring that the accept mark bit is clear, policies set
+	// that bit to indicate that they accepted the packet.
+	rules = append(rules, Rule{
+		Action: ClearMarkAction{Mark: r.IptablesMarkAccept},
+	})
+
+	for _, tier := range tiers {
+		// For each tier, clear the "accepted by tier" mark.
+		rules = append(rules, Rule{
+			Comment: []string{TierStartComment(tier.Name)},
+			Action:  ClearMarkAction{Mark: r.IptablesMarkNextTier},
+		})
+		// Then, jump to each policy in turn.
+		for _, polName := range tier.Policies {
+			// If policy marked packet as accepted, it returns, setting
+			// the accept mark bit.  If that is set, return from this
+			// chain.
+			rules = append(rules, r.JumpToPolicyTemplate(TemplateParams{
+				Target: PolicyChainName(
+					policyPrefix,
+					&proto.PolicyID{Tier: tier.Name, Name: polName},
+				),
+				NflogGroup:       nflogGroup,
+				NflogRule:        NflogPolicyRule(tier.Name, polName),
+				VerdictCacheMark: verdictCacheMark,
+			})...)
+		}
+		// If no policy in the tier marked the packet as next-tier, drop
+		// the packet.
+		if r.FlowLogsEnabled {
+			rules = append(rules, Rule{
+				Match: Match().MarkClear(r.IptablesMarkNextTier),
+				Action: NflogAction{
+					Group:  nflogGroup,
+					Prefix: NflogPrefix(NflogActionDeny, NflogTierRule(tier.Name)),
+				},
+			})
+		}
+		rules = append(rules, Rule{
+			Match:   Match().MarkClear(r.IptablesMarkNextTier),
+			Action:  DropAction{},
+			Comment: []string{"Drop if no policies passed packet"},
+		})
+	}
+
+	// Then, jump to each profile in turn.
+	for _, profileID := range profileIDs {
+		// If the profile accepted the packet, it returns, setting the
+		// accept mark bit.  If that is set, return from this chain.
+		rules = append(rules, r.JumpToProfileTemplate(TemplateParams{
+			Target:           ProfileChainName(profilePrefix, &proto.ProfileID{Name: profileID}),
+			NflogGroup:       nflogGroup,
+			NflogRule:        NflogProfileRule(profileID),
+			VerdictCacheMark: verdictCacheMark,
+		})...)
+	}
+
+	// If no profile marked the packet as accepted, drop the packet.
+	if r.FlowLogsEnabled {
+		rules = append(rules, Rule{
+			Action: NflogAction{
+				Group:  nflogGroup,
+				Prefix: NflogPrefix(NflogActionDeny, NflogNoProfileRule),
+			},
+		})
+	}
+	rules = append(rules, Rule{
+		Action:  DropAction{},
+		Comment: []string{"Drop if no profiles matched"},
+	})
+
+	return &Chain{
+		Name:  chainName,
+		Rules: rules,
+	}
+}
+
+// appendCacheVerdictRule appends, if verdictCacheMark is non-zero, a rule
+// that records an accept verdict in the connection's mark.
+func appendCacheVerdictRule(rules []Rule, acceptMark, verdictCacheMark uint32) []Rule {
+	if verdictCacheMark == 0 {
+		return rules
+	}
+	return append(rules, Rule{
+		Match:  Match().MarkSet(acceptMark),
+		Action: SetConnMarkAction{Mark: verdictCacheMark, Mask: verdictCacheMark},
+	})
+}
+
+// appendAcceptNflogRule appends, if flow logs are enabled, a rule that
+// reports the first packet of each flow that was accepted by the given rule.
+// The rest of the flow is accounted for by conntrack.
+func (r *DefaultRuleRenderer) appendAcceptNflogRule(rules []Rule, group uint16, rule string) []Rule {
+	if !r.FlowLogsEnabled {
+		return rules
+	}
+	return append(rules, Rule{
+		Match: Match().MarkSet(r.IptablesMarkAccept).ConntrackState("NEW"),
+		Action: NflogAction{
+			Group:  group,
+			Prefix: NflogPrefix(NflogActionAllow, rule),
+		},
+	})
+}
+
+// EndpointChainName returns the name of the chain for the endpoint with the
+// given interface name.
+func EndpointChainName(prefix string, ifaceName string) string {
+	return hashutils.GetLengthLimitedID(
+		prefix,
+		ifaceName,
+		MaxChainNameLength,
+	)
+}
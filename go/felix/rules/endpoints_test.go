@@ -0,0 +1,363 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/proto"
+)
+
+var _ = Describe("Endpoints", func() {
+	var rrConfigNormal = Config{
+		WorkloadIfacePrefixes: []string{"cali"},
+		IptablesMarkAccept:    0x8,
+		IptablesMarkNextTier:  0x10,
+	}
+	var renderer RuleRenderer
+
+	bypassRule := Rule{
+		Match:   Match().ConntrackState("RELATED,ESTABLISHED"),
+		Action:  AcceptAction{},
+		Comment: []string{"Bypass policy for established flows"},
+	}
+
+	expectedChains := func(prefix []Rule) []*Chain {
+		return []*Chain{
+			{
+				Name: "cali-tw-cali1234",
+				Rules: append(prefix,
+					Rule{Action: ClearMarkAction{Mark: 0x8}},
+					Rule{Action: JumpAction{Target: "cali-pri-prof1"}},
+					Rule{Match: Match().MarkSet(0x8),
+						Action:  ReturnAction{},
+						Comment: []string{"Return if profile accepted"}},
+					Rule{Action: DropAction{},
+						Comment: []string{"Drop if no profiles matched"}},
+				),
+			},
+			{
+				Name: "cali-fw-cali1234",
+				Rules: append(prefix,
+					Rule{Action: ClearMarkAction{Mark: 0x8}},
+					Rule{Action: JumpAction{Target: "cali-pro-prof1"}},
+					Rule{Match: Match().MarkSet(0x8),
+						Action:  ReturnAction{},
+						Comment: []string{"Return if profile accepted"}},
+					Rule{Action: DropAction{},
+						Comment: []string{"Drop if no profiles matched"}},
+				),
+			},
+		}
+	}
+
+	Describe("with the conntrack bypass disabled by default", func() {
+		BeforeEach(func() {
+			renderer = NewRenderer(rrConfigNormal)
+		})
+
+		It("should render a minimal workload endpoint", func() {
+			Expect(renderer.WorkloadEndpointToIptablesChains(
+				"cali1234", "", nil, []string{"prof1"}, ConntrackBypassDefault, false,
+			)).To(Equal(expectedChains(nil)))
+		})
+		It("should render the bypass rule if enabled for the endpoint", func() {
+			Expect(renderer.WorkloadEndpointToIptablesChains(
+				"cali1234", "", nil, []string{"prof1"}, ConntrackBypassOn, false,
+			)).To(Equal(expectedChains([]Rule{bypassRule})))
+		})
+	})
+
+	Describe("with the conntrack bypass enabled by default", func() {
+		BeforeEach(func() {
+			config := rrConfigNormal
+			config.ConntrackBypassEnabled = true
+			renderer = NewRenderer(config)
+		})
+
+		It("should render the bypass rule", func() {
+			Expect(renderer.WorkloadEndpointToIptablesChains(
+				"cali1234", "", nil, []string{"prof1"}, ConntrackBypassDefault, false,
+			)).To(Equal(expectedChains([]Rule{bypassRule})))
+		})
+		It("should omit the bypass rule if disabled for the endpoint", func() {
+			Expect(renderer.WorkloadEndpointToIptablesChains(
+				"cali1234", "", nil, []string{"prof1"}, ConntrackBypassOff, false,
+			)).To(Equal(expectedChains(nil)))
+		})
+	})
+
+	It("should drop packets from the endpoint with the wrong source MAC", func() {
+		renderer = NewRenderer(rrConfigNormal)
+		chains := renderer.WorkloadEndpointToIptablesChains(
+			"cali1234", "aa:bb:cc:dd:ee:ff", nil, []string{"prof1"}, ConntrackBypassOn, false,
+		)
+		expected := expectedChains([]Rule{bypassRule})
+		expected[1].Rules = append([]Rule{{
+			Match:   Match().NotSourceMAC("aa:bb:cc:dd:ee:ff"),
+			Action:  DropAction{},
+			Comment: []string{"Drop if source MAC is not the endpoint's"},
+		}}, expected[1].Rules...)
+		Expect(chains).To(Equal(expected))
+	})
+
+	Describe("with the verdict cache marks configured", func() {
+		BeforeEach(func() {
+			config := rrConfigNormal
+			config.IptablesMarkVerdictCacheIn = 0x20
+			config.IptablesMarkVerdictCacheOut = 0x40
+			renderer = NewRenderer(config)
+		})
+
+		It("should cache the verdict if enabled for the endpoint", func() {
+			chains := renderer.WorkloadEndpointToIptablesChains(
+				"cali1234",
+				"",
+				[]*proto.TierInfo{{Name: "default", Policies: []string{"a"}}},
+				[]string{"prof1"},
+				ConntrackBypassDefault,
+				true,
+			)
+			Expect(chains[0].Rules).To(Equal([]Rule{
+				{Match: Match().ConnMarkSet(0x20),
+					Action:  AcceptAction{},
+					Comment: []string{"Accept flows with a cached verdict"}},
+				{Action: ClearMarkAction{Mark: 0x8}},
+				{Comment: []string{"Start of tier default"},
+					Action: ClearMarkAction{Mark: 0x10}},
+				{Match: Match().MarkClear(0x10),
+					Action: JumpAction{Target: "cali-pi-default/a"}},
+				{Match: Match().MarkSet(0x8),
+					Action: SetConnMarkAction{Mark: 0x20, Mask: 0x20}},
+				{Match: Match().MarkSet(0x8),
+					Action:  ReturnAction{},
+					Comment: []string{"Return if policy accepted"}},
+				{Match: Match().MarkClear(0x10),
+					Action:  DropAction{},
+					Comment: []string{"Drop if no policies passed packet"}},
+				{Action: JumpAction{Target: "cali-pri-prof1"}},
+				{Match: Match().MarkSet(0x8),
+					Action: SetConnMarkAction{Mark: 0x20, Mask: 0x20}},
+				{Match: Match().MarkSet(0x8),
+					Action:  ReturnAction{},
+					Comment: []string{"Return if profile accepted"}},
+				{Action: DropAction{},
+					Comment: []string{"Drop if no profiles matched"}},
+			}))
+			Expect(chains[1].Rules[0].Match).To(Equal(Match().ConnMarkSet(0x40)))
+			Expect(chains[1].Rules[4].Action).To(Equal(
+				SetConnMarkAction{Mark: 0x40, Mask: 0x40}))
+		})
+		It("should check the source MAC before the cached verdict", func() {
+			chains := renderer.WorkloadEndpointToIptablesChains(
+				"cali1234", "aa:bb:cc:dd:ee:ff", nil, []string{"prof1"}, ConntrackBypassDefault, true,
+			)
+			Expect(chains[1].Rules[0].Action).To(Equal(DropAction{}))
+			Expect(chains[1].Rules[1].Match).To(Equal(Match().ConnMarkSet(0x40)))
+		})
+		It("should return the marks to invalidate", func() {
+			Expect(renderer.VerdictCacheMarks()).To(Equal([]uint32{0x20, 0x40}))
+		})
+		It("should not cache the verdict by default", func() {
+			Expect(renderer.WorkloadEndpointToIptablesChains(
+				"cali1234", "", nil, []string{"prof1"}, ConntrackBypassDefault, false,
+			)).To(Equal(expectedChains(nil)))
+		})
+	})
+
+	It("should not cache the verdict if the marks aren't configured", func() {
+		renderer = NewRenderer(rrConfigNormal)
+		Expect(renderer.VerdictCacheMarks()).To(BeNil())
+		Expect(renderer.WorkloadEndpointToIptablesChains(
+			"cali1234", "", nil, []string{"prof1"}, ConntrackBypassDefault, true,
+		)).To(Equal(expectedChains(nil)))
+	})
+
+	It("should render NFLOG rules if flow logs are enabled", func() {
+		config := rrConfigNormal
+		config.FlowLogsEnabled = true
+		renderer = NewRenderer(config)
+		chains := renderer.WorkloadEndpointToIptablesChains(
+			"cali1234",
+			"",
+			[]*proto.TierInfo{{Name: "default", Policies: []string{"a"}}},
+			[]string{"prof1"},
+			ConntrackBypassDefault,
+			false,
+		)
+		Expect(chains[0].Rules).To(Equal([]Rule{
+			{Action: ClearMarkAction{Mark: 0x8}},
+			{Comment: []string{"Start of tier default"},
+				Action: ClearMarkAction{Mark: 0x10}},
+			{Match: Match().MarkClear(0x10),
+				Action: JumpAction{Target: "cali-pi-default/a"}},
+			{Match: Match().MarkSet(0x8).ConntrackState("NEW"),
+				Action: NflogAction{Group: 1, Prefix: "A|policy/default/a"}},
+			{Match: Match().MarkSet(0x8),
+				Action:  ReturnAction{},
+				Comment: []string{"Return if policy accepted"}},
+			{Match: Match().MarkClear(0x10),
+				Action: NflogAction{Group: 1, Prefix: "D|tier/default"}},
+			{Match: Match().MarkClear(0x10),
+				Action:  DropAction{},
+				Comment: []string{"Drop if no policies passed packet"}},
+			{Action: JumpAction{Target: "cali-pri-prof1"}},
+			{Match: Match().MarkSet(0x8).ConntrackState("NEW"),
+				Action: NflogAction{Group: 1, Prefix: "A|profile/prof1"}},
+			{Match: Match().MarkSet(0x8),
+				Action:  ReturnAction{},
+				Comment: []string{"Return if profile accepted"}},
+			{Action: NflogAction{Group: 1, Prefix: "D|profiles"}},
+			{Action: DropAction{},
+				Comment: []string{"Drop if no profiles matched"}},
+		}))
+		Expect(chains[1].Rules[3]).To(Equal(Rule{
+			Match:  Match().MarkSet(0x8).ConntrackState("NEW"),
+			Action: NflogAction{Group: 2, Prefix: "A|policy/default/a"},
+		}))
+	})
+
+	It("should render the sections of the chain in the documented order", func() {
+		config := rrConfigNormal
+		config.IptablesMarkVerdictCacheOut = 0x40
+		config.AntiSpoofingEnabled = true
+		renderer = NewRenderer(config)
+		tiers := []*proto.TierInfo{
+			{Name: "tier1", Policies: []string{"b", "a"}},
+			{Name: "tier2", Policies: []string{"c"}},
+		}
+		render := func() *Chain {
+			return renderer.WorkloadEndpointToIptablesChains(
+				"cali1234", "aa:bb:cc:dd:ee:ff", tiers, []string{"prof2", "prof1"},
+				ConntrackBypassOn, true,
+			)[1]
+		}
+		chain := render()
+		var sections []string
+		for _, rule := range chain.Rules {
+			switch {
+			case len(rule.Comment) > 0:
+				sections = append(sections, rule.Comment[0])
+			case rule.Action == ClearMarkAction{Mark: 0x8}:
+				sections = append(sections, "Clear accept mark")
+			default:
+				if jump, ok := rule.Action.(JumpAction); ok {
+					sections = append(sections, jump.Target)
+				}
+			}
+		}
+		Expect(sections).To(Equal([]string{
+			"Drop if source MAC is not the endpoint's",
+			"cali-fs-cali1234",
+			"Bypass policy for established flows",
+			"Accept flows with a cached verdict",
+			"Clear accept mark",
+			"Start of tier tier1",
+			"cali-po-tier1/b",
+			"Return if policy accepted",
+			"cali-po-tier1/a",
+			"Return if policy accepted",
+			"Drop if no policies passed packet",
+			"Start of tier tier2",
+			"cali-po-tier2/c",
+			"Return if policy accepted",
+			"Drop if no policies passed packet",
+			"cali-pro-prof2",
+			"Return if profile accepted",
+			"cali-pro-prof1",
+			"Return if profile accepted",
+			"Drop if no profiles matched",
+		}))
+		Expect(render()).To(Equal(chain))
+	})
+
+	It("should render a fully-loaded workload endpoint", func() {
+		renderer = NewRenderer(rrConfigNormal)
+		Expect(renderer.WorkloadEndpointToIptablesChains(
+			"cali1234",
+			"",
+			[]*proto.TierInfo{{Name: "default", Policies: []string{"a", "b"}}},
+			[]string{"prof1", "prof2"},
+			ConntrackBypassDefault,
+			false,
+		)).To(Equal([]*Chain{
+			{
+				Name: "cali-tw-cali1234",
+				Rules: []Rule{
+					{Action: ClearMarkAction{Mark: 0x8}},
+					{Comment: []string{"Start of tier default"},
+						Action: ClearMarkAction{Mark: 0x10}},
+					{Match: Match().MarkClear(0x10),
+						Action: JumpAction{Target: "cali-pi-default/a"}},
+					{Match: Match().MarkSet(0x8),
+						Action:  ReturnAction{},
+						Comment: []string{"Return if policy accepted"}},
+					{Match: Match().MarkClear(0x10),
+						Action: JumpAction{Target: "cali-pi-default/b"}},
+					{Match: Match().MarkSet(0x8),
+						Action:  ReturnAction{},
+						Comment: []string{"Return if policy accepted"}},
+					{Match: Match().MarkClear(0x10),
+						Action:  DropAction{},
+						Comment: []string{"Drop if no policies passed packet"}},
+					{Action: JumpAction{Target: "cali-pri-prof1"}},
+					{Match: Match().MarkSet(0x8),
+						Action:  ReturnAction{},
+						Comment: []string{"Return if profile accepted"}},
+					{Action: JumpAction{Target: "cali-pri-prof2"}},
+					{Match: Match().MarkSet(0x8),
+						Action:  ReturnAction{},
+						Comment: []string{"Return if profile accepted"}},
+					{Action: DropAction{},
+						Comment: []string{"Drop if no profiles matched"}},
+				},
+			},
+			{
+				Name: "cali-fw-cali1234",
+				Rules: []Rule{
+					{Action: ClearMarkAction{Mark: 0x8}},
+					{Comment: []string{"Start of tier default"},
+						Action: ClearMarkAction{Mark: 0x10}},
+					{Match: Match().MarkClear(0x10),
+						Action: JumpAction{Target: "cali-po-default/a"}},
+					{Match: Match().MarkSet(0x8),
+						Action:  ReturnAction{},
+						Comment: []string{"Return if policy accepted"}},
+					{Match: Match().MarkClear(0x10),
+						Action: JumpAction{Target: "cali-po-default/b"}},
+					{Match: Match().MarkSet(0x8),
+						Action:  ReturnAction{},
+						Comment: []string{"Return if policy accepted"}},
+					{Match: Match().MarkClear(0x10),
+						Action:  DropAction{},
+						Comment: []string{"Drop if no policies passed packet"}},
+					{Action: JumpAction{Target: "cali-pro-prof1"}},
+					{Match: Match().MarkSet(0x8),
+						Action:  ReturnAction{},
+						Comment: []string{"Return if profile accepted"}},
+					{Action: JumpAction{Target: "cali-pro-prof2"}},
+					{Match: Match().MarkSet(0x8),
+						Action:  ReturnAction{},
+						Comment: []string{"Return if profile accepted"}},
+					{Action: DropAction{},
+						Comment: []string{"Drop if no profiles matched"}},
+				},
+			},
+		}))
+	})
+})
@@ -0,0 +1,184 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"fmt"
+	"github.com/projectcalico/felix/go/felix/hashutils"
+	"github.com/projectcalico/felix/go/felix/iptables"
+)
+
+const (
+	LoadBalancerPfx        = ChainNamePrefix + "-lb-"
+	LoadBalancerBackendPfx = ChainNamePrefix + "-lbb-"
+)
+
+// LoadBalancerBackend is one of the addresses that a load-balanced service
+// spreads its traffic over.
+type LoadBalancerBackend struct {
+	Addr string
+	Port uint16
+	// DSRMark, if non-zero, is the DSRHostMark of the host that runs the
+	// backend.  Rather than being DNATted, the backend's traffic is marked
+	// so that it's routed, as is, to that host, which picks one of its own
+	// backends.  See DSRRoute.
+	DSRMark uint32
+}
+
+func (b LoadBalancerBackend) String() string {
+	return fmt.Sprintf("%s:%d", b.Addr, b.Port)
+}
+
+// LoadBalancerChainName returns the name of the named load balancer's chain,
+// which picks a backend for each new connection.
+func LoadBalancerChainName(lbName string) string {
+	return hashutils.GetLengthLimitedID(LoadBalancerPfx, lbName, MaxChainNameLength)
+}
+
+// LoadBalancerBackendChainName returns the name of the chain that DNATs the
+// named load balancer's traffic to the given backend.  The name doubles as
+// the name of the backend's "recent" list, which tracks client affinity.
+func LoadBalancerBackendChainName(lbName string, backend LoadBalancerBackend) string {
+	return hashutils.GetLengthLimitedID(
+		LoadBalancerBackendPfx,
+		lbName+"/"+backend.String(),
+		MaxChainNameLength,
+	)
+}
+
+// LoadBalancerBackendChain renders the nat-table chain that DNATs the named
+// load balancer's traffic to one of its backends.  If affinity is set, the
+// chain also records the client in the backend's "recent" list so that the
+// rules from LoadBalancerAffinityRules send the client's later connections
+// to the same backend.
+//
+// If IptablesMarkMasq is set, the chain marks connections from the backend
+// to itself for masquerade.  Without that, the backend would see its own
+// address as the source and reply directly, bypassing the reverse DNAT, so
+// a workload couldn't reach a service that load-balances back to it.
+//
+// If the backend has a DSRMark, the chain marks the connection for DSR
+// instead of DNATting it.
+func (r *DefaultRuleRenderer) LoadBalancerBackendChain(
+	lbName string,
+	backend LoadBalancerBackend,
+	ipVersion uint8,
+	affinity bool,
+) *iptables.Chain {
+	chainName := LoadBalancerBackendChainName(lbName, backend)
+	match := iptables.Match()
+	if affinity {
+		match = match.RecentSet(chainName, ipVersion)
+	}
+	if backend.DSRMark != 0 {
+		return &iptables.Chain{
+			Name:  chainName,
+			Rules: r.dsrBackendRules(match, backend.DSRMark),
+		}
+	}
+	rules := []iptables.Rule{}
+	if r.IptablesMarkMasq != 0 {
+		rules = append(rules, iptables.Rule{
+			Match:   iptables.Match().SourceNet(backend.Addr),
+			Action:  iptables.SetMarkAction{Mark: r.IptablesMarkMasq},
+			Comment: []string{"Mark hairpin traffic for masquerade"},
+		})
+	}
+	rules = append(rules, iptables.Rule{
+		Match: match,
+		Action: iptables.DNATAction{
+			DestAddr: backend.Addr,
+			DestPort: backend.Port,
+		},
+	})
+	return &iptables.Chain{
+		Name:  chainName,
+		Rules: rules,
+	}
+}
+
+// LoadBalancerAffinityRules renders the rules that send a client that
+// connected to the named load balancer in the last timeoutSecs to the same
+// backend as before.  They belong at the top of the load balancer's chain,
+// ahead of the rules that pick a backend for new clients.
+func (r *DefaultRuleRenderer) LoadBalancerAffinityRules(
+	lbName string,
+	backends []LoadBalancerBackend,
+	ipVersion uint8,
+	timeoutSecs uint32,
+) []iptables.Rule {
+	rules := make([]iptables.Rule, 0, len(backends))
+	for _, backend := range backends {
+		chainName := LoadBalancerBackendChainName(lbName, backend)
+		rules = append(rules, iptables.Rule{
+			Match:  iptables.Match().RecentCheck(chainName, timeoutSecs, ipVersion),
+			Action: iptables.JumpAction{Target: chainName},
+		})
+	}
+	return rules
+}
+
+// LoadBalancerChains renders the nat-table chains that spread new
+// connections to the named load balancer evenly over its backends: the
+// load balancer's own chain, first, followed by a chain per backend.  The
+// load balancer's chain should be jumped to from a rule that matches the
+// service's address and port.  If affinityTimeoutSecs is non-zero, a client
+// sticks to its backend until it has been idle for that long.
+//
+// If there are no backends, the load balancer's chain is empty, so traffic
+// falls through to the rules after the jump.
+func (r *DefaultRuleRenderer) LoadBalancerChains(
+	lbName string,
+	backends []LoadBalancerBackend,
+	ipVersion uint8,
+	affinityTimeoutSecs uint32,
+) []*iptables.Chain {
+	affinity := affinityTimeoutSecs != 0
+	lbRules := []iptables.Rule{}
+	if affinity {
+		lbRules = append(lbRules,
+			r.LoadBalancerAffinityRules(lbName, backends, ipVersion, affinityTimeoutSecs)...)
+	}
+	chains := []*iptables.Chain{{Name: LoadBalancerChainName(lbName)}}
+	backendChainNames := make([]string, len(backends))
+	for i, backend := range backends {
+		chain := r.LoadBalancerBackendChain(lbName, backend, ipVersion, affinity)
+		backendChainNames[i] = chain.Name
+		chains = append(chains, chain)
+	}
+	chains[0].Rules = append(lbRules, loadBalancingRules(backendChainNames)...)
+	return chains
+}
+
+// loadBalancingRules renders the "ladder" of rules that jumps to one of the
+// given chains, picked uniformly at random.  Each rule only sees the packets
+// that the rules above it didn't take so, to give each of n chains a 1/n
+// share, the i-th rule (counting from 0) has to match with probability
+// 1/(n-i).  The last rule always matches.
+func loadBalancingRules(chainNames []string) []iptables.Rule {
+	rules := make([]iptables.Rule, len(chainNames))
+	n := len(chainNames)
+	for i, chainName := range chainNames {
+		match := iptables.Match()
+		if i < n-1 {
+			match = match.StatisticRandom(1.0 / float64(n-i))
+		}
+		rules[i] = iptables.Rule{
+			Match:  match,
+			Action: iptables.JumpAction{Target: chainName},
+		}
+	}
+	return rules
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+)
+
+var _ = Describe("Load balancer chains", func() {
+	var renderer RuleRenderer
+	backend1 := LoadBalancerBackend{Addr: "10.0.0.1", Port: 8080}
+	backend2 := LoadBalancerBackend{Addr: "10.0.0.2", Port: 8080}
+	chain1 := LoadBalancerBackendChainName("svc", backend1)
+	chain2 := LoadBalancerBackendChainName("svc", backend2)
+
+	BeforeEach(func() {
+		renderer = NewRenderer(Config{})
+	})
+
+	It("should give each backend its own length-limited chain", func() {
+		Expect(chain1).NotTo(Equal(chain2))
+		Expect(strings.HasPrefix(chain1, "cali-lbb-")).To(BeTrue())
+		long := LoadBalancerBackendChainName(strings.Repeat("x", 100), backend1)
+		Expect(len(long)).To(BeNumerically("<=", MaxChainNameLength))
+	})
+	It("should render a backend chain without affinity", func() {
+		Expect(renderer.LoadBalancerBackendChain("svc", backend1, 4, false)).To(Equal(&Chain{
+			Name: chain1,
+			Rules: []Rule{
+				{Match: Match(), Action: DNATAction{DestAddr: "10.0.0.1", DestPort: 8080}},
+			},
+		}))
+	})
+	It("should record the client in a backend chain with affinity", func() {
+		Expect(renderer.LoadBalancerBackendChain("svc", backend1, 6, true)).To(Equal(&Chain{
+			Name: chain1,
+			Rules: []Rule{
+				{
+					Match:  Match().RecentSet(chain1, 6),
+					Action: DNATAction{DestAddr: "10.0.0.1", DestPort: 8080},
+				},
+			},
+		}))
+	})
+	It("should mark hairpin traffic for masquerade", func() {
+		renderer = NewRenderer(Config{IptablesMarkMasq: 0x4})
+		Expect(renderer.LoadBalancerBackendChain("svc", backend1, 4, false)).To(Equal(&Chain{
+			Name: chain1,
+			Rules: []Rule{
+				{
+					Match:   Match().SourceNet("10.0.0.1"),
+					Action:  SetMarkAction{Mark: 0x4},
+					Comment: []string{"Mark hairpin traffic for masquerade"},
+				},
+				{Match: Match(), Action: DNATAction{DestAddr: "10.0.0.1", DestPort: 8080}},
+			},
+		}))
+	})
+	It("should render an affinity rule per backend", func() {
+		Expect(renderer.LoadBalancerAffinityRules("svc", []LoadBalancerBackend{backend1, backend2}, 4, 10800)).To(Equal(
+			[]Rule{
+				{Match: Match().RecentCheck(chain1, 10800, 4), Action: JumpAction{Target: chain1}},
+				{Match: Match().RecentCheck(chain2, 10800, 4), Action: JumpAction{Target: chain2}},
+			}))
+	})
+
+	Describe("LoadBalancerChains", func() {
+		backend3 := LoadBalancerBackend{Addr: "10.0.0.3", Port: 8080}
+		chain3 := LoadBalancerBackendChainName("svc", backend3)
+		backends := []LoadBalancerBackend{backend1, backend2, backend3}
+
+		It("should render a ladder that picks each backend evenly", func() {
+			chains := renderer.LoadBalancerChains("svc", backends, 4, 0)
+			Expect(chains).To(HaveLen(4))
+			Expect(chains[0]).To(Equal(&Chain{
+				Name: LoadBalancerChainName("svc"),
+				Rules: []Rule{
+					{Match: Match().StatisticRandom(1.0 / 3), Action: JumpAction{Target: chain1}},
+					{Match: Match().StatisticRandom(0.5), Action: JumpAction{Target: chain2}},
+					{Match: Match(), Action: JumpAction{Target: chain3}},
+				},
+			}))
+			Expect(chains[1:]).To(Equal([]*Chain{
+				renderer.LoadBalancerBackendChain("svc", backend1, 4, false),
+				renderer.LoadBalancerBackendChain("svc", backend2, 4, false),
+				renderer.LoadBalancerBackendChain("svc", backend3, 4, false),
+			}))
+		})
+		It("should check affinity before picking a backend", func() {
+			chains := renderer.LoadBalancerChains("svc", backends[:2], 6, 600)
+			Expect(chains[0].Rules).To(Equal(append(
+				renderer.LoadBalancerAffinityRules("svc", backends[:2], 6, 600),
+				Rule{Match: Match().StatisticRandom(0.5), Action: JumpAction{Target: chain1}},
+				Rule{Match: Match(), Action: JumpAction{Target: chain2}},
+			)))
+			Expect(chains[1:]).To(Equal([]*Chain{
+				renderer.LoadBalancerBackendChain("svc", backend1, 6, true),
+				renderer.LoadBalancerBackendChain("svc", backend2, 6, true),
+			}))
+		})
+		It("should always jump to a single backend", func() {
+			chains := renderer.LoadBalancerChains("svc", backends[:1], 4, 0)
+			Expect(chains[0].Rules).To(Equal([]Rule{
+				{Match: Match(), Action: JumpAction{Target: chain1}},
+			}))
+		})
+		It("should render an empty chain if there are no backends", func() {
+			chains := renderer.LoadBalancerChains("svc", nil, 4, 0)
+			Expect(chains).To(Equal([]*Chain{
+				{Name: LoadBalancerChainName("svc"), Rules: []Rule{}},
+			}))
+		})
+	})
+})
@@ -0,0 +1,137 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"errors"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"net"
+)
+
+const (
+	ChainNAT64Masq    = ChainNamePrefix + "-nat64-masq"
+	ChainNAT64Forward = ChainNamePrefix + "-nat64-fwd"
+)
+
+var nat64PrefixLens = map[int]bool{32: true, 40: true, 48: true, 56: true, 64: true, 96: true}
+
+// NAT64Addr returns the IPv6 address that represents the IPv4 address
+// within the NAT64 prefix, as described in RFC 6052.  The prefix length
+// must be 32, 40, 48, 56, 64 or 96; the IPv4 address skips bits 64 to 71
+// of the result, which must be zero.
+func NAT64Addr(prefix *net.IPNet, v4Addr net.IP) (net.IP, error) {
+	v4 := v4Addr.To4()
+	if v4 == nil {
+		return nil, errors.New("not an IPv4 address")
+	}
+	ones, bits := prefix.Mask.Size()
+	if bits != 8*net.IPv6len || !nat64PrefixLens[ones] {
+		return nil, errors.New("invalid NAT64 prefix length")
+	}
+	addr := make(net.IP, net.IPv6len)
+	copy(addr, prefix.IP.Mask(prefix.Mask))
+	pos := ones / 8
+	for _, b := range v4 {
+		if pos == 8 {
+			// Skip the "u" octet.
+			pos++
+		}
+		addr[pos] = b
+		pos++
+	}
+	return addr, nil
+}
+
+// NAT64MasqChain renders the IPv4 nat-table chain that masquerades the
+// translator's traffic from NAT64IPv4Pool to the host's address, which is
+// what makes the translation stateful: the pool can be much smaller than
+// the number of workloads.  It should be jumped to from the nat
+// POSTROUTING chain.
+func (r *DefaultRuleRenderer) NAT64MasqChain() *iptables.Chain {
+	rules := []iptables.Rule{}
+	if r.NAT64Prefix != "" {
+		rules = append(rules, iptables.Rule{
+			Match: iptables.Match().
+				SourceNet(r.NAT64IPv4Pool).
+				NotDestNet(r.NAT64IPv4Pool),
+			Action: iptables.MasqAction{},
+		})
+	}
+	return &iptables.Chain{
+		Name:  ChainNAT64Masq,
+		Rules: rules,
+	}
+}
+
+// NAT64ForwardChain renders the filter-table chain that allows traffic
+// through the translator: IPv6 traffic to the NAT64 prefix, or IPv4
+// traffic from the pool, into it, and the replies back out of it.  Traffic
+// to or from a workload interface is returned first, so that it is left to
+// the workload's policy in the felix FORWARD chain rather than accepted
+// here.  It should be jumped to from the filter FORWARD chain.
+func (r *DefaultRuleRenderer) NAT64ForwardChain(ipVersion uint8) *iptables.Chain {
+	rules := []iptables.Rule{}
+	if r.NAT64Prefix != "" {
+		for _, ifaceMatch := range r.workloadIfaceMatches() {
+			rules = append(rules,
+				iptables.Rule{
+					Match:  iptables.Match().InInterface(ifaceMatch),
+					Action: iptables.ReturnAction{},
+				},
+				iptables.Rule{
+					Match:  iptables.Match().OutInterface(ifaceMatch),
+					Action: iptables.ReturnAction{},
+				},
+			)
+		}
+		if ipVersion == 6 {
+			rules = append(rules,
+				iptables.Rule{
+					Match: iptables.Match().
+						OutInterface(r.NAT64Device).
+						DestNet(r.NAT64Prefix),
+					Action: iptables.AcceptAction{},
+				},
+				iptables.Rule{
+					Match: iptables.Match().
+						InInterface(r.NAT64Device).
+						SourceNet(r.NAT64Prefix).
+						ConntrackState("RELATED,ESTABLISHED"),
+					Action: iptables.AcceptAction{},
+				},
+			)
+		} else {
+			rules = append(rules,
+				iptables.Rule{
+					Match: iptables.Match().
+						InInterface(r.NAT64Device).
+						SourceNet(r.NAT64IPv4Pool),
+					Action: iptables.AcceptAction{},
+				},
+				iptables.Rule{
+					Match: iptables.Match().
+						OutInterface(r.NAT64Device).
+						DestNet(r.NAT64IPv4Pool).
+						ConntrackState("RELATED,ESTABLISHED"),
+					Action: iptables.AcceptAction{},
+				},
+			)
+		}
+	}
+	return &iptables.Chain{
+		Name:  ChainNAT64Forward,
+		Rules: rules,
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+	"net"
+)
+
+var _ = DescribeTable("NAT64 address mapping",
+	func(prefix, v4, expected string) {
+		_, prefixNet, err := net.ParseCIDR(prefix)
+		Expect(err).NotTo(HaveOccurred())
+		addr, err := NAT64Addr(prefixNet, net.ParseIP(v4))
+		if expected == "" {
+			Expect(err).To(HaveOccurred())
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addr.String()).To(Equal(expected))
+	},
+	// Examples from RFC 6052, section 2.4.
+	Entry("/32", "2001:db8::/32", "192.0.2.33", "2001:db8:c000:221::"),
+	Entry("/40", "2001:db8:100::/40", "192.0.2.33", "2001:db8:1c0:2:21::"),
+	Entry("/48", "2001:db8:122::/48", "192.0.2.33", "2001:db8:122:c000:2:2100::"),
+	Entry("/56", "2001:db8:122:300::/56", "192.0.2.33", "2001:db8:122:3c0:0:221::"),
+	Entry("/64", "2001:db8:122:344::/64", "192.0.2.33", "2001:db8:122:344:c0:2:2100:0"),
+	Entry("/96", "2001:db8:122:344::/96", "192.0.2.33", "2001:db8:122:344::c000:221"),
+	Entry("well-known prefix", "64:ff9b::/96", "192.0.2.33", "64:ff9b::c000:221"),
+	Entry("bad prefix length", "64:ff9b::/80", "192.0.2.33", ""),
+	Entry("IPv6 address", "64:ff9b::/96", "fd00::1", ""),
+)
+
+var _ = Describe("NAT64 chains", func() {
+	var renderer RuleRenderer
+	BeforeEach(func() {
+		renderer = NewRenderer(Config{
+			NAT64Prefix:   "64:ff9b::/96",
+			NAT64IPv4Pool: "192.168.255.0/24",
+			NAT64Device:   "nat64",
+
+			WorkloadIfacePrefixes: []string{"cali"},
+		})
+	})
+
+	It("should masquerade the pool", func() {
+		Expect(renderer.NAT64MasqChain()).To(Equal(&Chain{
+			Name: "cali-nat64-masq",
+			Rules: []Rule{
+				{
+					Match:  Match().SourceNet("192.168.255.0/24").NotDestNet("192.168.255.0/24"),
+					Action: MasqAction{},
+				},
+			},
+		}))
+	})
+	It("should allow IPv6 traffic to the prefix through the translator", func() {
+		Expect(renderer.NAT64ForwardChain(6).Rules).To(Equal([]Rule{
+			{Match: Match().InInterface("cali+"), Action: ReturnAction{}},
+			{Match: Match().OutInterface("cali+"), Action: ReturnAction{}},
+			{
+				Match:  Match().OutInterface("nat64").DestNet("64:ff9b::/96"),
+				Action: AcceptAction{},
+			},
+			{
+				Match: Match().InInterface("nat64").SourceNet("64:ff9b::/96").
+					ConntrackState("RELATED,ESTABLISHED"),
+				Action: AcceptAction{},
+			},
+		}))
+	})
+	It("should allow IPv4 traffic from the pool out of the translator", func() {
+		Expect(renderer.NAT64ForwardChain(4).Rules).To(Equal([]Rule{
+			{Match: Match().InInterface("cali+"), Action: ReturnAction{}},
+			{Match: Match().OutInterface("cali+"), Action: ReturnAction{}},
+			{
+				Match:  Match().InInterface("nat64").SourceNet("192.168.255.0/24"),
+				Action: AcceptAction{},
+			},
+			{
+				Match: Match().OutInterface("nat64").DestNet("192.168.255.0/24").
+					ConntrackState("RELATED,ESTABLISHED"),
+				Action: AcceptAction{},
+			},
+		}))
+	})
+	It("should return traffic on every workload interface before accepting", func() {
+		// Neither leg of a workload's translated connection may be
+		// accepted before the felix FORWARD chain has applied the
+		// workload's policy.
+		renderer = NewRenderer(Config{
+			NAT64Prefix:   "64:ff9b::/96",
+			NAT64IPv4Pool: "192.168.255.0/24",
+			NAT64Device:   "nat64",
+
+			WorkloadIfacePrefixes: []string{"cali", "tap"},
+		})
+		for _, ipVersion := range []uint8{4, 6} {
+			Expect(renderer.NAT64ForwardChain(ipVersion).Rules[:4]).To(Equal([]Rule{
+				{Match: Match().InInterface("cali+"), Action: ReturnAction{}},
+				{Match: Match().OutInterface("cali+"), Action: ReturnAction{}},
+				{Match: Match().InInterface("tap+"), Action: ReturnAction{}},
+				{Match: Match().OutInterface("tap+"), Action: ReturnAction{}},
+			}))
+		}
+	})
+	It("should render empty chains when disabled", func() {
+		renderer = NewRenderer(Config{})
+		Expect(renderer.NAT64MasqChain().Rules).To(BeEmpty())
+		Expect(renderer.NAT64ForwardChain(6).Rules).To(BeEmpty())
+	})
+})
@@ -0,0 +1,81 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"github.com/projectcalico/felix/go/felix/hashutils"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"strings"
+)
+
+// When flow logs are enabled, the endpoint chains send the packets that get
+// a policy verdict to NFLOG, tagged with a prefix of the form
+// "<action>|<rule>", for example "A|policy/default/allow-web".  The
+// collector package parses the prefixes back into verdicts.
+const (
+	// NflogInboundGroup is the NFLOG group for traffic to endpoints.
+	NflogInboundGroup uint16 = 1
+	// NflogOutboundGroup is the NFLOG group for traffic from endpoints.
+	NflogOutboundGroup uint16 = 2
+
+	NflogActionAllow = "A"
+	NflogActionDeny  = "D"
+
+	nflogPrefixSeparator = "|"
+)
+
+// NflogPolicyRule identifies a verdict that was reached by a policy.
+func NflogPolicyRule(tier, policy string) string {
+	return "policy/" + tier + "/" + policy
+}
+
+// NflogTierRule identifies the drop at the end of a tier, which applies if
+// no policy in the tier accepted the packet or passed it to the next tier.
+func NflogTierRule(tier string) string {
+	return "tier/" + tier
+}
+
+// NflogProfileRule identifies a verdict that was reached by a profile.
+func NflogProfileRule(profile string) string {
+	return "profile/" + profile
+}
+
+// NflogNoProfileRule identifies the drop that applies if no profile accepted
+// the packet.
+const NflogNoProfileRule = "profiles"
+
+// NflogPrefix returns the NFLOG prefix for the given action and rule.  Long
+// rule IDs are hashed to fit.
+func NflogPrefix(action, rule string) string {
+	return hashutils.GetLengthLimitedID(
+		action+nflogPrefixSeparator,
+		rule,
+		iptables.MaxNflogPrefixLength,
+	)
+}
+
+// ParseNflogPrefix is the inverse of NflogPrefix.  Returns false if the
+// prefix wasn't rendered by NflogPrefix.
+func ParseNflogPrefix(prefix string) (action, rule string, ok bool) {
+	parts := strings.SplitN(prefix, nflogPrefixSeparator, 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	switch parts[0] {
+	case NflogActionAllow, NflogActionDeny:
+		return parts[0], parts[1], true
+	}
+	return "", "", false
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"strings"
+)
+
+var _ = Describe("NFLOG prefixes", func() {
+	It("should round-trip a policy verdict", func() {
+		prefix := NflogPrefix(NflogActionAllow, NflogPolicyRule("default", "allow-web"))
+		Expect(prefix).To(Equal("A|policy/default/allow-web"))
+		action, rule, ok := ParseNflogPrefix(prefix)
+		Expect(ok).To(BeTrue())
+		Expect(action).To(Equal(NflogActionAllow))
+		Expect(rule).To(Equal("policy/default/allow-web"))
+	})
+	It("should hash long rule IDs", func() {
+		prefix := NflogPrefix(NflogActionDeny, NflogProfileRule(strings.Repeat("x", 100)))
+		Expect(len(prefix)).To(BeNumerically("<=", iptables.MaxNflogPrefixLength))
+		Expect(prefix).To(HavePrefix("D|_"))
+		_, _, ok := ParseNflogPrefix(prefix)
+		Expect(ok).To(BeTrue())
+	})
+})
+
+var _ = DescribeTable("Invalid NFLOG prefixes",
+	func(prefix string) {
+		_, _, ok := ParseNflogPrefix(prefix)
+		Expect(ok).To(BeFalse())
+	},
+	Entry("empty", ""),
+	Entry("no separator", "A"),
+	Entry("unknown action", "X|tier/default"),
+)
@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/iptables"
+)
+
+const (
+	ChainNodePorts        = ChainNamePrefix + "-nodeports"
+	ChainNodePortsProtect = ChainNamePrefix + "-nodeports-protect"
+	ChainMasqMarked       = ChainNamePrefix + "-masq-marked"
+)
+
+// nodePortProtocols are the protocols that node port ranges are reserved
+// for.
+var nodePortProtocols = []string{"tcp", "udp"}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Min, Max uint16
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+// NodePort exposes a load balancer on a port of each of the host's
+// addresses.
+type NodePort struct {
+	Protocol string
+	Port     uint16
+	// LBName is the name of the load balancer, as passed to
+	// LoadBalancerChains, that the node port's traffic is sent to.
+	LBName string
+}
+
+func (n NodePort) String() string {
+	return fmt.Sprintf("%s:%d->%s", n.Protocol, n.Port, n.LBName)
+}
+
+// NodePortChain renders the nat-table chain that sends traffic for the
+// given node ports to their load balancers.  It should be jumped to from
+// the nat PREROUTING and OUTPUT chains.  Node ports outside NodePortRanges
+// are ignored.
+//
+// Traffic that comes from one of the host's own addresses is marked for
+// masquerade (see MasqMarkedChain): without that, a backend that is local
+// to the host would reply directly to the host, bypassing the reverse
+// DNAT.
+func (r *DefaultRuleRenderer) NodePortChain(nodePorts []NodePort) *iptables.Chain {
+	rules := []iptables.Rule{}
+	for _, nodePort := range nodePorts {
+		if !r.inNodePortRanges(nodePort.Port) {
+			log.WithField("nodePort", nodePort).Warn(
+				"Node port outside the configured ranges, ignoring")
+			continue
+		}
+		match := iptables.Match().
+			Protocol(nodePort.Protocol).
+			DestAddrType(iptables.AddrTypeLocal).
+			DestPorts(nodePort.Port)
+		if r.IptablesMarkMasq != 0 {
+			rules = append(rules, iptables.Rule{
+				Match:  match.SrcAddrType(iptables.AddrTypeLocal, false),
+				Action: iptables.SetMarkAction{Mark: r.IptablesMarkMasq},
+			})
+		}
+		rules = append(rules, iptables.Rule{
+			Match:  match,
+			Action: iptables.JumpAction{Target: LoadBalancerChainName(nodePort.LBName)},
+		})
+	}
+	return &iptables.Chain{
+		Name:  ChainNodePorts,
+		Rules: rules,
+	}
+}
+
+// NodePortProtectChain renders the filter-table chain that drops traffic
+// to the host on the node port ranges.  Node port traffic that was sent on
+// to a backend has been DNATted, so what's left is aimed at ports without a
+// node port, which shouldn't reach host processes that happen to be
+// listening there.  It should be jumped to from the filter INPUT chain.
+func (r *DefaultRuleRenderer) NodePortProtectChain() *iptables.Chain {
+	rules := []iptables.Rule{}
+	for _, portRange := range r.NodePortRanges {
+		for _, protocol := range nodePortProtocols {
+			rules = append(rules, iptables.Rule{
+				Match: iptables.Match().
+					Protocol(protocol).
+					NotConntrackState("DNAT").
+					DestAddrType(iptables.AddrTypeLocal).
+					DestPortRange(portRange.Min, portRange.Max),
+				Action: iptables.DropAction{},
+			})
+		}
+	}
+	return &iptables.Chain{
+		Name:  ChainNodePortsProtect,
+		Rules: rules,
+	}
+}
+
+// MasqMarkedChain renders the nat-table chain that masquerades traffic
+// that was marked with IptablesMarkMasq.  It should be jumped to from the
+// nat POSTROUTING chain.
+func (r *DefaultRuleRenderer) MasqMarkedChain() *iptables.Chain {
+	rules := []iptables.Rule{}
+	if r.IptablesMarkMasq != 0 {
+		rules = append(rules, iptables.Rule{
+			Match:  iptables.Match().MarkSet(r.IptablesMarkMasq),
+			Action: iptables.MasqAction{},
+		})
+	}
+	return &iptables.Chain{
+		Name:  ChainMasqMarked,
+		Rules: rules,
+	}
+}
+
+func (r *DefaultRuleRenderer) inNodePortRanges(port uint16) bool {
+	for _, portRange := range r.NodePortRanges {
+		if portRange.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
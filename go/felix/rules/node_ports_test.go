@@ -0,0 +1,96 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+)
+
+var _ = Describe("Node port chains", func() {
+	var renderer RuleRenderer
+	BeforeEach(func() {
+		renderer = NewRenderer(Config{
+			IptablesMarkMasq: 0x4,
+			NodePortRanges:   []PortRange{{Min: 30000, Max: 32767}},
+		})
+	})
+
+	It("should mark local traffic for masquerade and jump to the load balancer", func() {
+		nodePortMatch := Match().Protocol("tcp").DestAddrType(AddrTypeLocal).DestPorts(30080)
+		Expect(renderer.NodePortChain([]NodePort{
+			{Protocol: "tcp", Port: 30080, LBName: "svc"},
+		})).To(Equal(&Chain{
+			Name: "cali-nodeports",
+			Rules: []Rule{
+				{
+					Match:  nodePortMatch.SrcAddrType(AddrTypeLocal, false),
+					Action: SetMarkAction{Mark: 0x4},
+				},
+				{
+					Match:  nodePortMatch,
+					Action: JumpAction{Target: LoadBalancerChainName("svc")},
+				},
+			},
+		}))
+	})
+	It("should ignore node ports outside the configured ranges", func() {
+		Expect(renderer.NodePortChain([]NodePort{
+			{Protocol: "udp", Port: 8080, LBName: "svc"},
+		}).Rules).To(BeEmpty())
+	})
+	It("should not mark traffic without a masquerade mark", func() {
+		renderer = NewRenderer(Config{
+			NodePortRanges: []PortRange{{Min: 30000, Max: 32767}},
+		})
+		Expect(renderer.NodePortChain([]NodePort{
+			{Protocol: "udp", Port: 30053, LBName: "dns"},
+		}).Rules).To(Equal([]Rule{
+			{
+				Match:  Match().Protocol("udp").DestAddrType(AddrTypeLocal).DestPorts(30053),
+				Action: JumpAction{Target: LoadBalancerChainName("dns")},
+			},
+		}))
+		Expect(renderer.MasqMarkedChain().Rules).To(BeEmpty())
+	})
+	It("should drop un-DNATted traffic to the node port ranges", func() {
+		Expect(renderer.NodePortProtectChain()).To(Equal(&Chain{
+			Name: "cali-nodeports-protect",
+			Rules: []Rule{
+				{
+					Match: Match().Protocol("tcp").NotConntrackState("DNAT").
+						DestAddrType(AddrTypeLocal).DestPortRange(30000, 32767),
+					Action: DropAction{},
+				},
+				{
+					Match: Match().Protocol("udp").NotConntrackState("DNAT").
+						DestAddrType(AddrTypeLocal).DestPortRange(30000, 32767),
+					Action: DropAction{},
+				},
+			},
+		}))
+	})
+	It("should masquerade marked traffic", func() {
+		Expect(renderer.MasqMarkedChain()).To(Equal(&Chain{
+			Name: "cali-masq-marked",
+			Rules: []Rule{
+				{Match: Match().MarkSet(0x4), Action: MasqAction{}},
+			},
+		}))
+	})
+})
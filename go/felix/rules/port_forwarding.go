@@ -0,0 +1,211 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"net"
+	"sort"
+)
+
+// PortForward maps traffic that arrives for an external IP and port (for
+// example, a floating IP) onto a port on a local workload.
+type PortForward struct {
+	Protocol     string
+	ExternalIP   string
+	ExternalPort uint16
+	WorkloadIP   string
+	WorkloadPort uint16
+}
+
+func (f PortForward) String() string {
+	return fmt.Sprintf("%s:%s:%d->%s:%d", f.Protocol,
+		f.ExternalIP, f.ExternalPort, f.WorkloadIP, f.WorkloadPort)
+}
+
+// Validate checks that the PortForward is complete and renderable.  Only IPv4
+// forwards are currently supported.
+func (f PortForward) Validate() error {
+	if f.Protocol != "tcp" && f.Protocol != "udp" {
+		return fmt.Errorf("unsupported protocol %#v; should be tcp or udp", f.Protocol)
+	}
+	if f.ExternalPort == 0 || f.WorkloadPort == 0 {
+		return errors.New("port must be non-zero")
+	}
+	for _, addr := range []string{f.ExternalIP, f.WorkloadIP} {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %#v", addr)
+		}
+		if ip.To4() == nil {
+			return fmt.Errorf("IPv6 address %#v not supported", addr)
+		}
+	}
+	return nil
+}
+
+// frontend returns the part of the PortForward that identifies the traffic it
+// captures.
+func (f PortForward) frontend() portForwardFrontend {
+	return portForwardFrontend{
+		protocol: f.Protocol,
+		ip:       net.ParseIP(f.ExternalIP).String(),
+		port:     f.ExternalPort,
+	}
+}
+
+type portForwardFrontend struct {
+	protocol string
+	ip       string
+	port     uint16
+}
+
+// PortForwardConflict is returned by PortForwards.Add() if the new mapping
+// would capture the same traffic as an existing one.
+type PortForwardConflict struct {
+	ID            string
+	ConflictingID string
+	Forward       PortForward
+}
+
+func (e PortForwardConflict) Error() string {
+	return fmt.Sprintf("port forward %v (%s) conflicts with existing port forward %s",
+		e.Forward, e.ID, e.ConflictingID)
+}
+
+// PortForwards tracks the set of active PortForwards, indexed by an ID
+// chosen by the caller.  It rejects any mapping that would capture the same
+// external protocol, IP and port as a mapping with a different ID.
+type PortForwards struct {
+	forwardsByID  map[string]PortForward
+	idsByFrontend map[portForwardFrontend]string
+}
+
+func NewPortForwards() *PortForwards {
+	return &PortForwards{
+		forwardsByID:  map[string]PortForward{},
+		idsByFrontend: map[portForwardFrontend]string{},
+	}
+}
+
+// Add adds or updates the PortForward with the given ID.  If the forward is
+// invalid or it conflicts with another ID's forward then it returns an error
+// and leaves any previous value for the ID in place.
+func (p *PortForwards) Add(id string, fwd PortForward) error {
+	logCxt := log.WithFields(log.Fields{"id": id, "forward": fwd})
+	if err := fwd.Validate(); err != nil {
+		logCxt.WithError(err).Warn("Invalid port forward")
+		return err
+	}
+	frontend := fwd.frontend()
+	if otherID, ok := p.idsByFrontend[frontend]; ok && otherID != id {
+		err := PortForwardConflict{
+			ID:            id,
+			ConflictingID: otherID,
+			Forward:       fwd,
+		}
+		logCxt.WithError(err).Warn("Conflicting port forward")
+		return err
+	}
+	p.Remove(id)
+	logCxt.Debug("Adding port forward")
+	p.forwardsByID[id] = fwd
+	p.idsByFrontend[frontend] = id
+	return nil
+}
+
+// Remove removes the PortForward with the given ID, if present.
+func (p *PortForwards) Remove(id string) {
+	oldFwd, ok := p.forwardsByID[id]
+	if !ok {
+		return
+	}
+	log.WithField("id", id).Debug("Removing port forward")
+	delete(p.idsByFrontend, oldFwd.frontend())
+	delete(p.forwardsByID, id)
+}
+
+func (p *PortForwards) Len() int {
+	return len(p.forwardsByID)
+}
+
+// Sorted returns the active forwards, sorted by ID so that the rendered
+// chains are stable.
+func (p *PortForwards) Sorted() []PortForward {
+	ids := make([]string, 0, len(p.forwardsByID))
+	for id := range p.forwardsByID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	forwards := make([]PortForward, len(ids))
+	for i, id := range ids {
+		forwards[i] = p.forwardsByID[id]
+	}
+	return forwards
+}
+
+// PortForwardDNATChain renders the nat-table chain that rewrites the
+// destination of forwarded traffic.  It should be jumped to from the nat
+// PREROUTING chain (and OUTPUT chain, to cover locally-originated traffic).
+func (r *DefaultRuleRenderer) PortForwardDNATChain(forwards []PortForward) *iptables.Chain {
+	rules := make([]iptables.Rule, 0, len(forwards))
+	for _, fwd := range forwards {
+		rules = append(rules, iptables.Rule{
+			Match: iptables.Match().
+				Protocol(fwd.Protocol).
+				DestNet(fwd.ExternalIP).
+				DestPorts(fwd.ExternalPort),
+			Action: iptables.DNATAction{
+				DestAddr: fwd.WorkloadIP,
+				DestPort: fwd.WorkloadPort,
+			},
+		})
+	}
+	return &iptables.Chain{
+		Name:  ChainFwdDNAT,
+		Rules: rules,
+	}
+}
+
+// PortForwardAllowChain renders the filter-table chain that picks out
+// forwarded traffic to the workload.  It should be jumped to from the filter
+// FORWARD chain.  The rules only match connections that were DNATted and
+// that are heading to a workload interface, and they return them rather
+// than accepting them: a port forward only rewrites the destination, so the
+// workload's own policy, in the felix FORWARD chain, still decides whether
+// the traffic is allowed.
+func (r *DefaultRuleRenderer) PortForwardAllowChain(forwards []PortForward) *iptables.Chain {
+	rules := []iptables.Rule{}
+	for _, fwd := range forwards {
+		for _, ifaceMatch := range r.workloadIfaceMatches() {
+			rules = append(rules, iptables.Rule{
+				Match: iptables.Match().
+					OutInterface(ifaceMatch).
+					ConntrackState("DNAT").
+					Protocol(fwd.Protocol).
+					DestNet(fwd.WorkloadIP).
+					DestPorts(fwd.WorkloadPort),
+				Action: iptables.ReturnAction{},
+			})
+		}
+	}
+	return &iptables.Chain{
+		Name:  ChainFwdAllow,
+		Rules: rules,
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/proto"
+)
+
+var fwd1 = PortForward{
+	Protocol:     "tcp",
+	ExternalIP:   "172.16.0.1",
+	ExternalPort: 80,
+	WorkloadIP:   "10.0.0.1",
+	WorkloadPort: 8080,
+}
+
+var fwd2 = PortForward{
+	Protocol:     "udp",
+	ExternalIP:   "172.16.0.1",
+	ExternalPort: 53,
+	WorkloadIP:   "10.0.0.2",
+	WorkloadPort: 53,
+}
+
+var _ = Describe("PortForwards", func() {
+	var forwards *PortForwards
+	BeforeEach(func() {
+		forwards = NewPortForwards()
+	})
+
+	It("should accept non-conflicting forwards", func() {
+		Expect(forwards.Add("b", fwd1)).To(Succeed())
+		Expect(forwards.Add("a", fwd2)).To(Succeed())
+		Expect(forwards.Len()).To(Equal(2))
+		Expect(forwards.Sorted()).To(Equal([]PortForward{fwd2, fwd1}))
+	})
+	It("should allow the same port with a different protocol", func() {
+		udpFwd := fwd1
+		udpFwd.Protocol = "udp"
+		Expect(forwards.Add("a", fwd1)).To(Succeed())
+		Expect(forwards.Add("b", udpFwd)).To(Succeed())
+	})
+	It("should reject a conflicting forward", func() {
+		conflicting := fwd1
+		conflicting.WorkloadIP = "10.0.0.3"
+		Expect(forwards.Add("a", fwd1)).To(Succeed())
+		err := forwards.Add("b", conflicting)
+		Expect(err).To(Equal(PortForwardConflict{
+			ID:            "b",
+			ConflictingID: "a",
+			Forward:       conflicting,
+		}))
+		Expect(forwards.Sorted()).To(Equal([]PortForward{fwd1}))
+	})
+	It("should allow an ID's forward to be updated", func() {
+		updated := fwd1
+		updated.WorkloadPort = 8081
+		Expect(forwards.Add("a", fwd1)).To(Succeed())
+		Expect(forwards.Add("a", updated)).To(Succeed())
+		Expect(forwards.Sorted()).To(Equal([]PortForward{updated}))
+	})
+	It("should release the frontend on removal", func() {
+		Expect(forwards.Add("a", fwd1)).To(Succeed())
+		forwards.Remove("a")
+		Expect(forwards.Len()).To(Equal(0))
+		Expect(forwards.Add("b", fwd1)).To(Succeed())
+	})
+	It("should ignore removal of an unknown ID", func() {
+		forwards.Remove("unknown")
+		Expect(forwards.Len()).To(Equal(0))
+	})
+	It("should reject invalid forwards", func() {
+		bad := fwd1
+		bad.Protocol = "icmp"
+		Expect(forwards.Add("a", bad)).NotTo(Succeed())
+		bad = fwd1
+		bad.ExternalPort = 0
+		Expect(forwards.Add("a", bad)).NotTo(Succeed())
+		bad = fwd1
+		bad.WorkloadIP = "foobar"
+		Expect(forwards.Add("a", bad)).NotTo(Succeed())
+		bad = fwd1
+		bad.ExternalIP = "fd00::1"
+		Expect(forwards.Add("a", bad)).NotTo(Succeed())
+		Expect(forwards.Len()).To(Equal(0))
+	})
+})
+
+var _ = Describe("Port forward rendering", func() {
+	var renderer RuleRenderer
+	BeforeEach(func() {
+		renderer = NewRenderer(Config{
+			WorkloadIfacePrefixes: []string{"cali", "tap"},
+		})
+	})
+
+	It("should render the DNAT chain", func() {
+		Expect(renderer.PortForwardDNATChain([]PortForward{fwd1, fwd2})).To(Equal(&iptables.Chain{
+			Name: "cali-fwd-dnat",
+			Rules: []iptables.Rule{
+				{
+					Match: iptables.Match().Protocol("tcp").
+						DestNet("172.16.0.1").DestPorts(80),
+					Action: iptables.DNATAction{DestAddr: "10.0.0.1", DestPort: 8080},
+				},
+				{
+					Match: iptables.Match().Protocol("udp").
+						DestNet("172.16.0.1").DestPorts(53),
+					Action: iptables.DNATAction{DestAddr: "10.0.0.2", DestPort: 53},
+				},
+			},
+		}))
+	})
+	It("should render the allow chain", func() {
+		Expect(renderer.PortForwardAllowChain([]PortForward{fwd1})).To(Equal(&iptables.Chain{
+			Name: "cali-fwd-allow",
+			Rules: []iptables.Rule{
+				{
+					Match: iptables.Match().OutInterface("cali+").
+						ConntrackState("DNAT").Protocol("tcp").
+						DestNet("10.0.0.1").DestPorts(8080),
+					Action: iptables.ReturnAction{},
+				},
+				{
+					Match: iptables.Match().OutInterface("tap+").
+						ConntrackState("DNAT").Protocol("tcp").
+						DestNet("10.0.0.1").DestPorts(8080),
+					Action: iptables.ReturnAction{},
+				},
+			},
+		}))
+	})
+	It("should leave the verdict to the workload's policy", func() {
+		// A forward must not open up a workload whose policy denies the
+		// traffic: the allow chain never accepts, so the packet carries on
+		// to the workload's to-endpoint chain, which drops it.
+		for _, rule := range renderer.PortForwardAllowChain([]PortForward{fwd1, fwd2}).Rules {
+			Expect(rule.Action).To(Equal(iptables.ReturnAction{}))
+		}
+		toChain := renderer.WorkloadEndpointToIptablesChains(
+			"cali1234",
+			"",
+			[]*proto.TierInfo{{Name: "default", Policies: []string{"deny-all"}}},
+			nil,
+			ConntrackBypassDefault,
+			false,
+		)[0]
+		lastRule := toChain.Rules[len(toChain.Rules)-1]
+		Expect(lastRule.Action).To(Equal(iptables.DropAction{}))
+	})
+	It("should render empty chains when there are no forwards", func() {
+		Expect(renderer.PortForwardDNATChain(nil).Rules).To(BeEmpty())
+		Expect(renderer.PortForwardAllowChain(nil).Rules).To(BeEmpty())
+	})
+})
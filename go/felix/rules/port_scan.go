@@ -0,0 +1,82 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/felix/go/felix/iptables"
+)
+
+const (
+	ChainPortScanBan    = ChainNamePrefix + "-portscan-ban"
+	ChainPortScanDetect = ChainNamePrefix + "-portscan"
+
+	// PortScanHashLimitName is the name of the hashlimit table that
+	// tracks the rate at which each source probes closed ports.
+	PortScanHashLimitName = ChainNamePrefix + "-portscan"
+)
+
+// PortScanIPSetName returns the name of the IP set that holds the banned
+// sources of the given IP version.  The IP set is created, with a default
+// timeout, by the portscan package rather than by the dataplane driver.
+func PortScanIPSetName(ipVersion uint8) string {
+	return fmt.Sprintf("%s%d-portscan-ban", ChainNamePrefix, ipVersion)
+}
+
+// PortScanBanChain renders the filter-table chain that drops traffic from
+// banned sources on the PortScanInterfaces.  It should be jumped to from
+// the top of the INPUT and FORWARD chains.
+func (r *DefaultRuleRenderer) PortScanBanChain(ipVersion uint8) *iptables.Chain {
+	rules := []iptables.Rule{}
+	for _, ifaceName := range r.PortScanInterfaces {
+		rules = append(rules, iptables.Rule{
+			Match: iptables.Match().InInterface(ifaceName).
+				SourceIPSet(PortScanIPSetName(ipVersion)),
+			Action:  iptables.DropAction{},
+			Comment: []string{"Drop traffic from banned port scanners"},
+		})
+	}
+	return &iptables.Chain{
+		Name:  ChainPortScanBan,
+		Rules: rules,
+	}
+}
+
+// PortScanDetectChain renders the filter-table chain that bans the sources
+// that open new connections on the PortScanInterfaces faster than
+// PortScanRateLimit per second, after an initial PortScanBurst, for
+// PortScanBanSecs.  It should be jumped to just before the host endpoints'
+// final drop rule, so that only probes of closed, or denied, ports count
+// towards the limit.  It doesn't drop anything itself.
+func (r *DefaultRuleRenderer) PortScanDetectChain(ipVersion uint8) *iptables.Chain {
+	rules := []iptables.Rule{}
+	for _, ifaceName := range r.PortScanInterfaces {
+		rules = append(rules, iptables.Rule{
+			Match: iptables.Match().InInterface(ifaceName).
+				ConntrackState("NEW").
+				HashLimitAbove(PortScanHashLimitName, r.PortScanRateLimit, r.PortScanBurst),
+			Action: iptables.AddToIPSetAction{
+				SetName:     PortScanIPSetName(ipVersion),
+				TimeoutSecs: r.PortScanBanSecs,
+			},
+			Comment: []string{"Ban sources that probe too many closed ports"},
+		})
+	}
+	return &iptables.Chain{
+		Name:  ChainPortScanDetect,
+		Rules: rules,
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+)
+
+var _ = Describe("Port scan banning", func() {
+	renderer := NewRenderer(Config{
+		PortScanInterfaces: []string{"eth0", "eth1"},
+		PortScanRateLimit:  5,
+		PortScanBurst:      20,
+		PortScanBanSecs:    600,
+	})
+
+	It("should name the IP sets by IP version", func() {
+		Expect(PortScanIPSetName(4)).To(Equal("cali4-portscan-ban"))
+		Expect(PortScanIPSetName(6)).To(Equal("cali6-portscan-ban"))
+	})
+
+	It("should drop traffic from banned sources", func() {
+		Expect(renderer.PortScanBanChain(6)).To(Equal(&Chain{
+			Name: "cali-portscan-ban",
+			Rules: []Rule{
+				{Match: Match().InInterface("eth0").SourceIPSet("cali6-portscan-ban"),
+					Action:  DropAction{},
+					Comment: []string{"Drop traffic from banned port scanners"}},
+				{Match: Match().InInterface("eth1").SourceIPSet("cali6-portscan-ban"),
+					Action:  DropAction{},
+					Comment: []string{"Drop traffic from banned port scanners"}},
+			},
+		}))
+	})
+
+	It("should ban sources over the rate limit", func() {
+		chain := renderer.PortScanDetectChain(4)
+		Expect(chain.Name).To(Equal("cali-portscan"))
+		Expect(chain.Rules).To(HaveLen(2))
+		Expect(chain.Rules[0]).To(Equal(Rule{
+			Match: Match().InInterface("eth0").ConntrackState("NEW").
+				HashLimitAbove("cali-portscan", 5, 20),
+			Action:  AddToIPSetAction{SetName: "cali4-portscan-ban", TimeoutSecs: 600},
+			Comment: []string{"Ban sources that probe too many closed ports"},
+		}))
+	})
+
+	It("should render empty chains if no interfaces are protected", func() {
+		renderer := NewRenderer(Config{})
+		Expect(renderer.PortScanBanChain(4).Rules).To(BeEmpty())
+		Expect(renderer.PortScanDetectChain(4).Rules).To(BeEmpty())
+	})
+})
@@ -0,0 +1,277 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The rules package contains the RuleRenderer, which compiles Felix's
+// dataplane model into iptables Chains (see the iptables package).
+//
+// The renderer is stateless; it is given the current state of an object
+// and returns the complete set of chains that implement it.  Keeping track
+// of which chains need to be written to, or removed from, the dataplane is
+// left to the caller.
+//
+// The rendered rules depend only on the renderer's inputs, and their order
+// is part of the renderer's contract, so that the chains programmed by
+// different versions of Felix can be diffed and so that drift detection
+// doesn't see churn.  An endpoint chain always has its rules in this order:
+//
+//  1. The anti-spoofing checks of the source MAC and then the source
+//     address (from-endpoint chain only).
+//  2. The conntrack shortcuts: the established-flow bypass and then the
+//     cached verdict check, if enabled.
+//  3. The rule that clears the accept mark.
+//  4. Each tier, in the order given, with its policies in the order given,
+//     followed by the tier's default drop.  The calculation graph sorts
+//     policies by their order field, with missing orders last and ties
+//     broken by name.
+//  5. Each profile, in the order given, which is the endpoint's own order.
+//  6. The final default drop.
+//
+// Flow log and verdict cache rules immediately follow the rule whose
+// verdict they record.  Renderers that take a list of objects, such as port
+// forwards or services, render them in the order given; their callers sort
+// them by ID.
+package rules
+
+import (
+	"github.com/projectcalico/felix/go/felix/hashutils"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"strings"
+)
+
+const (
+	// ChainNamePrefix is the prefix used for all our iptables chains.  We
+	// use a different prefix from the Python dataplane driver ("felix-") so
+	// that the two can't clobber each other's chains.
+	ChainNamePrefix = "cali"
+
+	// MaxChainNameLength is the maximum length of an iptables chain name.
+	MaxChainNameLength = 28
+
+	ChainFwdDNAT  = ChainNamePrefix + "-fwd-dnat"
+	ChainFwdAllow = ChainNamePrefix + "-fwd-allow"
+
+	WorkloadToEndpointPfx   = ChainNamePrefix + "-tw-"
+	WorkloadFromEndpointPfx = ChainNamePrefix + "-fw-"
+	WorkloadSourcePfx       = ChainNamePrefix + "-fs-"
+
+	PolicyInboundPfx   PolicyChainNamePrefix  = ChainNamePrefix + "-pi-"
+	PolicyOutboundPfx  PolicyChainNamePrefix  = ChainNamePrefix + "-po-"
+	ProfileInboundPfx  ProfileChainNamePrefix = ChainNamePrefix + "-pri-"
+	ProfileOutboundPfx ProfileChainNamePrefix = ChainNamePrefix + "-pro-"
+)
+
+type PolicyChainNamePrefix string
+type ProfileChainNamePrefix string
+
+type RuleRenderer interface {
+	WorkloadEndpointToIptablesChains(
+		ifaceName string,
+		mac string,
+		tiers []*proto.TierInfo,
+		profileIDs []string,
+		conntrackBypass ConntrackBypass,
+		verdictCache bool,
+	) []*iptables.Chain
+	WorkloadSourceChain(ifaceName string, sourceNets []string, ipVersion uint8) *iptables.Chain
+	VerdictCacheMarks() []uint32
+
+	PortForwardDNATChain(forwards []PortForward) *iptables.Chain
+	PortForwardAllowChain(forwards []PortForward) *iptables.Chain
+
+	DNSSnoopChain(ipVersion uint8) *iptables.Chain
+
+	LoadBalancerChains(
+		lbName string,
+		backends []LoadBalancerBackend,
+		ipVersion uint8,
+		affinityTimeoutSecs uint32,
+	) []*iptables.Chain
+	LoadBalancerBackendChain(
+		lbName string,
+		backend LoadBalancerBackend,
+		ipVersion uint8,
+		affinity bool,
+	) *iptables.Chain
+	LoadBalancerAffinityRules(
+		lbName string,
+		backends []LoadBalancerBackend,
+		ipVersion uint8,
+		timeoutSecs uint32,
+	) []iptables.Rule
+
+	NodePortChain(nodePorts []NodePort) *iptables.Chain
+	NodePortProtectChain() *iptables.Chain
+	MasqMarkedChain() *iptables.Chain
+
+	MaxDSRHosts() int
+	DSRHostMark(hostIdx int) (uint32, error)
+	DSRRoute(hostIdx int, hostAddr string) (DSRRoute, error)
+	DSRRestoreMarkRules() []iptables.Rule
+
+	NAT64MasqChain() *iptables.Chain
+	NAT64ForwardChain(ipVersion uint8) *iptables.Chain
+
+	EgressGatewayMarkChain() *iptables.Chain
+	EgressGatewayNATChain() *iptables.Chain
+	EgressGatewayRoute() (EgressGatewayRoute, bool)
+
+	ConntrackZoneChain(zones []EndpointConntrackZone, ipVersion uint8) *iptables.Chain
+	DSCPChain(endpoints []EndpointDSCP) *iptables.Chain
+
+	SynFloodChain() *iptables.Chain
+	SynFloodRawChain(forwards []PortForward) *iptables.Chain
+
+	PortScanBanChain(ipVersion uint8) *iptables.Chain
+	PortScanDetectChain(ipVersion uint8) *iptables.Chain
+
+	ThreatFeedChain(ipVersion uint8) *iptables.Chain
+
+	AccountingChain(ipVersion uint8) *iptables.Chain
+}
+
+type DefaultRuleRenderer struct {
+	Config
+}
+
+type Config struct {
+	// WorkloadIfacePrefixes is the list of interface name prefixes that
+	// identify workload interfaces, for example, "cali" or "tap".
+	WorkloadIfacePrefixes []string
+
+	// IptablesMarkAccept is the mark bit that policy and profile chains set
+	// to signal that they accepted the packet.
+	IptablesMarkAccept uint32
+	// IptablesMarkNextTier is the mark bit that policy chains set to pass the
+	// packet on to the next tier.
+	IptablesMarkNextTier uint32
+	// IptablesMarkMasq is the mark bit that nat chains set to have the
+	// packet masqueraded on its way out.  If zero, nothing is marked.
+	IptablesMarkMasq uint32
+
+	// ConntrackBypassEnabled is the default behaviour for endpoints that use
+	// ConntrackBypassDefault.  See ConntrackBypass.
+	ConntrackBypassEnabled bool
+	// AntiSpoofingEnabled has each from-endpoint chain check the source
+	// address of the workload's traffic; see WorkloadSourceChain.
+	AntiSpoofingEnabled bool
+	// IptablesMarkVerdictCacheIn and IptablesMarkVerdictCacheOut are the
+	// connmark bits that record that a flow was accepted by the to- and
+	// from-endpoint chains respectively.  If zero, verdicts aren't cached.
+	IptablesMarkVerdictCacheIn  uint32
+	IptablesMarkVerdictCacheOut uint32
+
+	// FlowLogsEnabled adds NFLOG rules to the endpoint chains, which
+	// report each policy verdict to the flow log collector.  Allowed flows
+	// are only reported for their first packet; denied packets are all
+	// reported.
+	FlowLogsEnabled bool
+
+	// DNSTrustedServers limits the DNS responses that are snooped for
+	// domain-based policy to those from the given server IPs.  If empty,
+	// responses from any server are trusted.
+	DNSTrustedServers []string
+
+	// NodePortRanges are the port ranges that are reserved for node ports.
+	NodePortRanges []PortRange
+
+	// IptablesMarkDSR is the multi-bit mark field that identifies the
+	// host that direct server return traffic is routed to.  If zero, DSR
+	// is disabled.
+	IptablesMarkDSR uint32
+	// DSRRouteTableBase is the routing table index of the first host's
+	// DSR routing table; each host's table follows on from it.
+	DSRRouteTableBase int
+
+	// NAT64Prefix, if set, enables NAT64 through the translator that owns
+	// NAT64Device.  NAT64IPv4Pool is the range of IPv4 addresses that the
+	// translator maps the workloads' IPv6 addresses to.
+	NAT64Prefix   string
+	NAT64IPv4Pool string
+	NAT64Device   string
+
+	// EgressGatewayRole is one of the EgressGatewayRole... constants.  See
+	// EgressGatewayMarkChain and EgressGatewayNATChain.
+	EgressGatewayRole string
+	// IptablesMarkEgressGateway is the mark bit that client hosts set on
+	// traffic that's routed to the egress gateway.
+	IptablesMarkEgressGateway  uint32
+	EgressGatewayAddr          string
+	EgressGatewaySourceCIDRs   []string
+	EgressGatewayExcludedCIDRs []string
+	EgressGatewayRouteTable    int
+
+	// SynFloodInterfaces are the host interfaces that SynFloodChain
+	// protects.  SynFloodRateLimit is the number of SYNs per second, after
+	// an initial SynFloodBurst, that each source may send.
+	SynFloodInterfaces []string
+	SynFloodRateLimit  uint32
+	SynFloodBurst      uint32
+	// SynproxyEnabled has SYNPROXY complete the handshakes of the
+	// SynFloodInterfaces.  Only set it if FeatureDetector reports that the
+	// dataplane supports it.
+	SynproxyEnabled bool
+
+	// PortScanInterfaces are the host interfaces on which sources that
+	// open new connections to closed ports faster than PortScanRateLimit
+	// per second, after an initial PortScanBurst, are banned for
+	// PortScanBanSecs.
+	PortScanInterfaces []string
+	PortScanRateLimit  uint32
+	PortScanBurst      uint32
+	PortScanBanSecs    uint32
+
+	// ThreatFeedNames are the names of the threat feeds whose entries
+	// ThreatFeedChain denies.
+	ThreatFeedNames []string
+
+	// NfacctClasses are the classes of traffic that AccountingChain
+	// accounts for.
+	NfacctClasses []NfacctClass
+}
+
+func NewRenderer(config Config) RuleRenderer {
+	return &DefaultRuleRenderer{
+		Config: config,
+	}
+}
+
+// PolicyChainName returns the name of the chain for the given policy.  Long
+// names are hashed to fit in an iptables chain name.
+func PolicyChainName(prefix PolicyChainNamePrefix, polID *proto.PolicyID) string {
+	return hashutils.GetLengthLimitedID(
+		string(prefix),
+		polID.Tier+"/"+polID.Name,
+		MaxChainNameLength,
+	)
+}
+
+// ProfileChainName returns the name of the chain for the given profile.
+func ProfileChainName(prefix ProfileChainNamePrefix, profID *proto.ProfileID) string {
+	return hashutils.GetLengthLimitedID(
+		string(prefix),
+		profID.Name,
+		MaxChainNameLength,
+	)
+}
+
+// workloadIfaceMatches returns the iptables interface match ("cali+") for
+// each configured workload interface prefix.
+func (r *DefaultRuleRenderer) workloadIfaceMatches() []string {
+	matches := make([]string, len(r.WorkloadIfacePrefixes))
+	for i, prefix := range r.WorkloadIfacePrefixes {
+		matches[i] = strings.TrimSpace(prefix) + "+"
+	}
+	return matches
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"github.com/projectcalico/felix/go/felix/iptables"
+)
+
+const (
+	ChainSynFlood    = ChainNamePrefix + "-syn-flood"
+	ChainSynFloodRaw = ChainNamePrefix + "-syn-flood-raw"
+
+	// SynFloodHashLimitName is the name of the hashlimit table that
+	// tracks the SYN rate of each source.
+	SynFloodHashLimitName = ChainNamePrefix + "-syn-flood"
+
+	// The TCP options that SYNPROXY offers to clients.  They're what a
+	// typical Linux server offers; it matters that the server behind
+	// the proxy supports them, since the proxy can't take them back.
+	synproxyMSS    = 1460
+	synproxyWScale = 7
+)
+
+// SynFloodChain renders the filter-table chain that protects the host
+// endpoints in SynFloodInterfaces from SYN floods.  SYNs from a source that
+// exceeds SynFloodRateLimit per second are dropped.  If SynproxyEnabled is
+// set, SYNs that pass the limit are answered by SYNPROXY, so that
+// connections from spoofed sources never reach the host's sockets.  It
+// should be jumped to from the INPUT chain.
+func (r *DefaultRuleRenderer) SynFloodChain() *iptables.Chain {
+	rules := []iptables.Rule{}
+	for _, ifaceName := range r.SynFloodInterfaces {
+		rules = append(rules, iptables.Rule{
+			Match: iptables.Match().InInterface(ifaceName).
+				Protocol("tcp").TCPSYN().
+				HashLimitAbove(SynFloodHashLimitName, r.SynFloodRateLimit, r.SynFloodBurst),
+			Action:  iptables.DropAction{},
+			Comment: []string{"Drop SYNs from sources over the rate limit"},
+		})
+		if !r.SynproxyEnabled {
+			continue
+		}
+		// The raw chain stops conntrack from tracking the SYN, which
+		// leaves it to SYNPROXY; the client's ACK then shows up as
+		// INVALID until SYNPROXY has validated it and opened the
+		// connection to the server.
+		rules = append(rules,
+			iptables.Rule{
+				Match: iptables.Match().InInterface(ifaceName).
+					Protocol("tcp").ConntrackState("INVALID,UNTRACKED"),
+				Action: iptables.SynproxyAction{
+					SACKPerm:  true,
+					Timestamp: true,
+					WScale:    synproxyWScale,
+					MSS:       synproxyMSS,
+				},
+			},
+			iptables.Rule{
+				Match: iptables.Match().InInterface(ifaceName).
+					Protocol("tcp").ConntrackState("INVALID"),
+				Action:  iptables.DropAction{},
+				Comment: []string{"Drop packets that SYNPROXY rejected"},
+			},
+		)
+	}
+	return &iptables.Chain{
+		Name:  ChainSynFlood,
+		Rules: rules,
+	}
+}
+
+// SynFloodRawChain renders the raw-table chain that hands the SYNs of the
+// host endpoints in SynFloodInterfaces over to SYNPROXY.  It's empty unless
+// SynproxyEnabled is set.  It should be jumped to from the raw PREROUTING
+// chain.
+//
+// Only SYNs to the host's own addresses are handed over, since SYNPROXY
+// only answers in the INPUT chain; a forwarded SYN has to stay tracked, or
+// the connection would never be set up.  For the same reason, SYNs to the
+// DNAT frontends, the given port forwards and the NodePortRanges, are left
+// alone: the raw table sees them before their destination is rewritten, so
+// they still look local.
+func (r *DefaultRuleRenderer) SynFloodRawChain(forwards []PortForward) *iptables.Chain {
+	rules := []iptables.Rule{}
+	if r.SynproxyEnabled && len(r.SynFloodInterfaces) > 0 {
+		for _, fwd := range forwards {
+			if fwd.Protocol != "tcp" {
+				continue
+			}
+			rules = append(rules, iptables.Rule{
+				Match: iptables.Match().Protocol("tcp").
+					DestNet(fwd.ExternalIP).DestPorts(fwd.ExternalPort),
+				Action: iptables.ReturnAction{},
+			})
+		}
+		for _, portRange := range r.NodePortRanges {
+			rules = append(rules, iptables.Rule{
+				Match: iptables.Match().Protocol("tcp").
+					DestPortRange(portRange.Min, portRange.Max),
+				Action: iptables.ReturnAction{},
+			})
+		}
+		for _, ifaceName := range r.SynFloodInterfaces {
+			rules = append(rules, iptables.Rule{
+				Match: iptables.Match().InInterface(ifaceName).Protocol("tcp").TCPSYN().
+					DestAddrType(iptables.AddrTypeLocal),
+				Action: iptables.NoTrackAction{},
+			})
+		}
+	}
+	return &iptables.Chain{
+		Name:  ChainSynFloodRaw,
+		Rules: rules,
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+)
+
+var _ = Describe("SYN flood protection", func() {
+	var config Config
+	BeforeEach(func() {
+		config = Config{
+			SynFloodInterfaces: []string{"eth0"},
+			SynFloodRateLimit:  100,
+			SynFloodBurst:      200,
+		}
+	})
+
+	rateLimitRule := Rule{
+		Match: Match().InInterface("eth0").Protocol("tcp").TCPSYN().
+			HashLimitAbove("cali-syn-flood", 100, 200),
+		Action:  DropAction{},
+		Comment: []string{"Drop SYNs from sources over the rate limit"},
+	}
+
+	It("should only rate limit SYNs without SYNPROXY", func() {
+		renderer := NewRenderer(config)
+		Expect(renderer.SynFloodChain()).To(Equal(&Chain{
+			Name:  "cali-syn-flood",
+			Rules: []Rule{rateLimitRule},
+		}))
+		Expect(renderer.SynFloodRawChain(nil)).To(Equal(&Chain{
+			Name:  "cali-syn-flood-raw",
+			Rules: []Rule{},
+		}))
+	})
+
+	It("should hand SYNs to SYNPROXY if enabled", func() {
+		config.SynproxyEnabled = true
+		renderer := NewRenderer(config)
+		Expect(renderer.SynFloodChain().Rules).To(Equal([]Rule{
+			rateLimitRule,
+			{
+				Match: Match().InInterface("eth0").Protocol("tcp").
+					ConntrackState("INVALID,UNTRACKED"),
+				Action: SynproxyAction{SACKPerm: true, Timestamp: true, WScale: 7, MSS: 1460},
+			},
+			{
+				Match:   Match().InInterface("eth0").Protocol("tcp").ConntrackState("INVALID"),
+				Action:  DropAction{},
+				Comment: []string{"Drop packets that SYNPROXY rejected"},
+			},
+		}))
+		Expect(renderer.SynFloodRawChain(nil).Rules).To(Equal([]Rule{
+			{
+				Match: Match().InInterface("eth0").Protocol("tcp").TCPSYN().
+					DestAddrType(AddrTypeLocal),
+				Action: NoTrackAction{},
+			},
+		}))
+	})
+
+	It("should leave forwarded and DNATted SYNs tracked", func() {
+		config.SynproxyEnabled = true
+		config.NodePortRanges = []PortRange{{Min: 30000, Max: 32767}}
+		renderer := NewRenderer(config)
+		forwards := []PortForward{
+			{
+				Protocol:     "tcp",
+				ExternalIP:   "172.16.0.1",
+				ExternalPort: 80,
+				WorkloadIP:   "10.0.0.1",
+				WorkloadPort: 8080,
+			},
+			// UDP has no SYNs to proxy.
+			{
+				Protocol:     "udp",
+				ExternalIP:   "172.16.0.1",
+				ExternalPort: 53,
+				WorkloadIP:   "10.0.0.2",
+				WorkloadPort: 53,
+			},
+		}
+		Expect(renderer.SynFloodRawChain(forwards).Rules).To(Equal([]Rule{
+			{
+				Match:  Match().Protocol("tcp").DestNet("172.16.0.1").DestPorts(80),
+				Action: ReturnAction{},
+			},
+			{
+				Match:  Match().Protocol("tcp").DestPortRange(30000, 32767),
+				Action: ReturnAction{},
+			},
+			{
+				// A SYN that's routed through the host, to a workload
+				// say, isn't to a local address, so it isn't touched.
+				Match: Match().InInterface("eth0").Protocol("tcp").TCPSYN().
+					DestAddrType(AddrTypeLocal),
+				Action: NoTrackAction{},
+			},
+		}))
+	})
+
+	It("should render empty chains if no interfaces are protected", func() {
+		config.SynFloodInterfaces = nil
+		config.SynproxyEnabled = true
+		renderer := NewRenderer(config)
+		Expect(renderer.SynFloodChain().Rules).To(BeEmpty())
+		Expect(renderer.SynFloodRawChain([]PortForward{fwd1}).Rules).To(BeEmpty())
+	})
+})
@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	. "github.com/projectcalico/felix/go/felix/iptables"
+	"sort"
+)
+
+// TemplateParams are the parameters with which a RuleTemplate is
+// instantiated.  Each template only uses the ones that it needs.
+type TemplateParams struct {
+	// Target is the chain that a jump template jumps to.
+	Target string
+	// Comment, if set, is attached to the rules of the templates that
+	// don't have a comment of their own.
+	Comment string
+	// NflogGroup and NflogRule, if flow logs are enabled, are the group
+	// and rule name with which a jump template reports accepted flows.
+	NflogGroup uint16
+	NflogRule  string
+	// VerdictCacheMark, if non-zero, is the mark bit in which a jump
+	// template caches an accept verdict.
+	VerdictCacheMark uint32
+}
+
+// RuleTemplate renders a common pattern of rules from its parameters.  The
+// patterns that appear in many chains, such as the jump to each policy from
+// an endpoint chain, are defined once as templates so that every copy is
+// built the same way, and so gets the same rule hashes.
+type RuleTemplate func(params TemplateParams) []Rule
+
+// TemplateInstance is a template with the parameters to instantiate it with.
+type TemplateInstance struct {
+	Template RuleTemplate
+	Params   TemplateParams
+}
+
+// AcceptEstablishedTemplate accepts packets that belong to flows that have
+// already been accepted.
+func AcceptEstablishedTemplate(params TemplateParams) []Rule {
+	return []Rule{{
+		Match:   Match().ConntrackState("RELATED,ESTABLISHED"),
+		Action:  AcceptAction{},
+		Comment: templateComment(params),
+	}}
+}
+
+// DropInvalidTemplate drops packets that conntrack can't match to a valid
+// flow.
+func DropInvalidTemplate(params TemplateParams) []Rule {
+	return []Rule{{
+		Match:   Match().ConntrackState("INVALID"),
+		Action:  DropAction{},
+		Comment: templateComment(params),
+	}}
+}
+
+// JumpToPolicyTemplate jumps to the policy chain params.Target, unless an
+// earlier policy in the tier has already passed the packet to the next
+// tier, and returns if the policy accepted the packet.
+func (r *DefaultRuleRenderer) JumpToPolicyTemplate(params TemplateParams) []Rule {
+	return r.jumpAndReturnIfAccepted(
+		Match().MarkClear(r.IptablesMarkNextTier), params, "Return if policy accepted")
+}
+
+// JumpToProfileTemplate jumps to the profile chain params.Target and
+// returns if the profile accepted the packet.
+func (r *DefaultRuleRenderer) JumpToProfileTemplate(params TemplateParams) []Rule {
+	return r.jumpAndReturnIfAccepted(nil, params, "Return if profile accepted")
+}
+
+// jumpAndReturnIfAccepted renders a jump to a policy or profile chain,
+// which sets the accept mark if it accepts the packet, followed by the
+// rules that record the verdict and return if it was an accept.
+func (r *DefaultRuleRenderer) jumpAndReturnIfAccepted(
+	match MatchCriteria,
+	params TemplateParams,
+	returnComment string,
+) []Rule {
+	rules := []Rule{{
+		Match:  match,
+		Action: JumpAction{Target: params.Target},
+	}}
+	if params.NflogRule != "" {
+		rules = r.appendAcceptNflogRule(rules, params.NflogGroup, params.NflogRule)
+	}
+	rules = appendCacheVerdictRule(rules, r.IptablesMarkAccept, params.VerdictCacheMark)
+	return append(rules, Rule{
+		Match:   Match().MarkSet(r.IptablesMarkAccept),
+		Action:  ReturnAction{},
+		Comment: []string{returnComment},
+	})
+}
+
+func templateComment(params TemplateParams) []string {
+	if params.Comment == "" {
+		return nil
+	}
+	return []string{params.Comment}
+}
+
+// InstantiateRules renders each of the instances in turn.
+func InstantiateRules(instances ...TemplateInstance) []Rule {
+	var rules []Rule
+	for _, instance := range instances {
+		rules = append(rules, instance.Template(instance.Params)...)
+	}
+	return rules
+}
+
+// InstantiateChains renders a chain from the same list of templates for
+// each of the given sets of parameters, for example one per endpoint.  The
+// chains are returned in order of name.
+func InstantiateChains(templates []RuleTemplate, chainNameToParams map[string]TemplateParams) []*Chain {
+	var chainNames []string
+	for chainName := range chainNameToParams {
+		chainNames = append(chainNames, chainName)
+	}
+	sort.Strings(chainNames)
+	chains := make([]*Chain, 0, len(chainNames))
+	for _, chainName := range chainNames {
+		params := chainNameToParams[chainName]
+		var rules []Rule
+		for _, template := range templates {
+			rules = append(rules, template(params)...)
+		}
+		chains = append(chains, &Chain{Name: chainName, Rules: rules})
+	}
+	return chains
+}
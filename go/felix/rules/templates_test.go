@@ -0,0 +1,107 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+)
+
+var _ = Describe("Rule templates", func() {
+	var renderer *DefaultRuleRenderer
+
+	BeforeEach(func() {
+		renderer = &DefaultRuleRenderer{Config: Config{
+			IptablesMarkAccept:   0x8,
+			IptablesMarkNextTier: 0x10,
+		}}
+	})
+
+	It("should render accept-established with the given comment", func() {
+		Expect(AcceptEstablishedTemplate(TemplateParams{Comment: "Established"})).To(Equal([]Rule{{
+			Match:   Match().ConntrackState("RELATED,ESTABLISHED"),
+			Action:  AcceptAction{},
+			Comment: []string{"Established"},
+		}}))
+	})
+
+	It("should render drop-invalid without a comment by default", func() {
+		Expect(DropInvalidTemplate(TemplateParams{})).To(Equal([]Rule{{
+			Match:  Match().ConntrackState("INVALID"),
+			Action: DropAction{},
+		}}))
+	})
+
+	It("should render a jump to a policy", func() {
+		Expect(renderer.JumpToPolicyTemplate(TemplateParams{Target: "cali-pi-a"})).To(Equal([]Rule{
+			{Match: Match().MarkClear(0x10), Action: JumpAction{Target: "cali-pi-a"}},
+			{Match: Match().MarkSet(0x8), Action: ReturnAction{},
+				Comment: []string{"Return if policy accepted"}},
+		}))
+	})
+
+	It("should render a jump to a profile with flow logs and the verdict cache", func() {
+		renderer.FlowLogsEnabled = true
+		Expect(renderer.JumpToProfileTemplate(TemplateParams{
+			Target:           "cali-pri-prof1",
+			NflogGroup:       1,
+			NflogRule:        NflogProfileRule("prof1"),
+			VerdictCacheMark: 0x40,
+		})).To(Equal([]Rule{
+			{Action: JumpAction{Target: "cali-pri-prof1"}},
+			{Match: Match().MarkSet(0x8).ConntrackState("NEW"), Action: NflogAction{
+				Group:  1,
+				Prefix: NflogPrefix(NflogActionAllow, NflogProfileRule("prof1")),
+			}},
+			{Match: Match().MarkSet(0x8), Action: SetConnMarkAction{Mark: 0x40, Mask: 0x40}},
+			{Match: Match().MarkSet(0x8), Action: ReturnAction{},
+				Comment: []string{"Return if profile accepted"}},
+		}))
+	})
+
+	It("should instantiate a list of instances in order", func() {
+		Expect(InstantiateRules(
+			TemplateInstance{Template: DropInvalidTemplate},
+			TemplateInstance{Template: renderer.JumpToProfileTemplate, Params: TemplateParams{Target: "cali-pro-a"}},
+		)).To(Equal([]Rule{
+			{Match: Match().ConntrackState("INVALID"), Action: DropAction{}},
+			{Action: JumpAction{Target: "cali-pro-a"}},
+			{Match: Match().MarkSet(0x8), Action: ReturnAction{},
+				Comment: []string{"Return if profile accepted"}},
+		}))
+	})
+
+	It("should instantiate a chain per set of params, in order of name, with identical rules", func() {
+		templates := []RuleTemplate{AcceptEstablishedTemplate, renderer.JumpToProfileTemplate}
+		chains := InstantiateChains(templates, map[string]TemplateParams{
+			"cali-b": {Target: "cali-pro-x"},
+			"cali-a": {Target: "cali-pro-x"},
+			"cali-c": {Target: "cali-pro-y"},
+		})
+		Expect(chains).To(HaveLen(3))
+		Expect(chains[0].Name).To(Equal("cali-a"))
+		Expect(chains[1].Name).To(Equal("cali-b"))
+		Expect(chains[2].Name).To(Equal("cali-c"))
+		Expect(chains[0].Rules).To(Equal(chains[1].Rules))
+		Expect(chains[0].Rules).NotTo(Equal(chains[2].Rules))
+
+		// Identical rules in the same positions get identical hashes.
+		Expect(NewRenderCache().RuleHashes(&Chain{Name: "cali-x", Rules: chains[0].Rules})).To(Equal(
+			NewRenderCache().RuleHashes(&Chain{Name: "cali-x", Rules: chains[1].Rules})))
+	})
+})
@@ -0,0 +1,57 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/felix/go/felix/iptables"
+)
+
+const ChainThreatFeeds = ChainNamePrefix + "-threat-feeds"
+
+// ThreatFeedIPSetName returns the name of the IP set that holds the given
+// feed's entries of the given IP version.  The IP set is maintained by the
+// threatfeed package rather than by the dataplane driver.
+func ThreatFeedIPSetName(feedName string, ipVersion uint8) string {
+	return fmt.Sprintf("%s%d-tf-%s", ChainNamePrefix, ipVersion, feedName)
+}
+
+// ThreatFeedChain renders the filter-table chain that drops traffic to and
+// from the entries of the ThreatFeedNames.  It's a global hook that applies
+// ahead of any endpoint's policy, so it should be jumped to from the top
+// of the INPUT, OUTPUT and FORWARD chains.
+func (r *DefaultRuleRenderer) ThreatFeedChain(ipVersion uint8) *iptables.Chain {
+	rules := []iptables.Rule{}
+	for _, feedName := range r.ThreatFeedNames {
+		setName := ThreatFeedIPSetName(feedName, ipVersion)
+		rules = append(rules,
+			iptables.Rule{
+				Match:   iptables.Match().SourceIPSet(setName),
+				Action:  iptables.DropAction{},
+				Comment: []string{ThreatFeedComment(feedName, true)},
+			},
+			iptables.Rule{
+				Match:   iptables.Match().DestIPSet(setName),
+				Action:  iptables.DropAction{},
+				Comment: []string{ThreatFeedComment(feedName, false)},
+			},
+		)
+	}
+	return &iptables.Chain{
+		Name:  ChainThreatFeeds,
+		Rules: rules,
+	}
+}
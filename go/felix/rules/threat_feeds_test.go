@@ -0,0 +1,52 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/projectcalico/felix/go/felix/iptables"
+)
+
+var _ = Describe("Threat feeds", func() {
+	It("should name the IP sets by feed and IP version", func() {
+		Expect(ThreatFeedIPSetName("spamhaus", 4)).To(Equal("cali4-tf-spamhaus"))
+		Expect(ThreatFeedIPSetName("spamhaus", 6)).To(Equal("cali6-tf-spamhaus"))
+	})
+
+	It("should drop traffic to and from each feed", func() {
+		renderer := NewRenderer(Config{ThreatFeedNames: []string{"a", "b"}})
+		Expect(renderer.ThreatFeedChain(4)).To(Equal(&Chain{
+			Name: "cali-threat-feeds",
+			Rules: []Rule{
+				{Match: Match().SourceIPSet("cali4-tf-a"), Action: DropAction{},
+					Comment: []string{"Drop traffic from threat feed a"}},
+				{Match: Match().DestIPSet("cali4-tf-a"), Action: DropAction{},
+					Comment: []string{"Drop traffic to threat feed a"}},
+				{Match: Match().SourceIPSet("cali4-tf-b"), Action: DropAction{},
+					Comment: []string{"Drop traffic from threat feed b"}},
+				{Match: Match().DestIPSet("cali4-tf-b"), Action: DropAction{},
+					Comment: []string{"Drop traffic to threat feed b"}},
+			},
+		}))
+	})
+
+	It("should render an empty chain with no feeds", func() {
+		renderer := NewRenderer(Config{})
+		Expect(renderer.ThreatFeedChain(6).Rules).To(BeEmpty())
+	})
+})
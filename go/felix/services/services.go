@@ -0,0 +1,466 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The services package implements Kubernetes-style services in iptables,
+// so that Felix can replace kube-proxy.  The Manager renders each service's
+// cluster IP and node ports as DNATs to the service's endpoints, spread
+// evenly by the load-balancer chains of the rules package.
+//
+// The Manager doesn't watch the datastore itself; its owner feeds it with
+// the Service and Endpoints data that it receives, then calls
+// CompleteDeferredWork and applies the tables.
+//
+// If DSR (direct server return) is enabled, the Manager also routes the
+// cluster IP traffic of DSR services, without DNAT, to the hosts that run
+// their endpoints; each host load balances the traffic over its own
+// endpoints and replies go straight back to the client.  Node port traffic
+// is always DNATted, since it's addressed to the host itself and would be
+// delivered locally rather than routed.
+package services
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"net"
+	"sort"
+)
+
+const ChainServices = rules.ChainNamePrefix + "-services"
+
+// ServiceID identifies a Service and its Endpoints.
+type ServiceID struct {
+	Namespace string
+	Name      string
+}
+
+func (id ServiceID) String() string {
+	return id.Namespace + "/" + id.Name
+}
+
+type ServicePort struct {
+	// Name matches the port with the EndpointPort of the same name.
+	Name     string
+	Protocol string
+	Port     uint16
+	// NodePort, if non-zero, also exposes the port on each of the host's
+	// addresses.
+	NodePort uint16
+}
+
+type Service struct {
+	ID        ServiceID
+	ClusterIP string
+	Ports     []ServicePort
+	// AffinityTimeoutSecs, if non-zero, sends each client to the same
+	// endpoint until it has been idle for that long.
+	AffinityTimeoutSecs uint32
+	// DSR enables direct server return for the cluster IP, if the Manager
+	// has DSR enabled.
+	DSR bool
+}
+
+type EndpointPort struct {
+	Name string
+	Port uint16
+}
+
+// Endpoints lists the addresses that back the Service with the same ID.
+// Every address serves all of the ports.
+type Endpoints struct {
+	ID        ServiceID
+	Addresses []string
+	Ports     []EndpointPort
+	// HostAddrs maps each address to the address of the host that it runs
+	// on.  It's only needed for DSR.
+	HostAddrs map[string]string
+	// Hostnames maps each address to the hostname of the host that it
+	// runs on, for owners that fill in HostAddrs from the hosts' addresses.
+	Hostnames map[string]string
+}
+
+// ServiceRemove and EndpointsRemove remove the Service or Endpoints with the
+// given ID, for owners that get their updates over a channel.
+type ServiceRemove struct {
+	ID ServiceID
+}
+
+type EndpointsRemove struct {
+	ID ServiceID
+}
+
+// Table is the subset of the iptables.Table API that the Manager uses.
+type Table interface {
+	UpdateChains(chains []*iptables.Chain)
+	RemoveChainByName(name string)
+	SetRuleInsertions(chainName string, rules []iptables.Rule)
+}
+
+// RouteTable programs the routes that send DSR traffic to other hosts.
+type RouteTable interface {
+	SetDSRRoutes(routes []rules.DSRRoute)
+}
+
+// Manager programs the services of one IP version.  Services and
+// Endpoints of the other IP version are ignored.
+type Manager struct {
+	ipVersion   uint8
+	renderer    rules.RuleRenderer
+	natTable    Table
+	filterTable Table
+
+	services  map[ServiceID]Service
+	endpoints map[ServiceID]Endpoints
+	dirty     bool
+
+	// natChainNames contains the names of the chains that we last wrote
+	// to the nat table.
+	natChainNames map[string]bool
+
+	// DSR state, only set if DSR is enabled.  dsrHostIdxs maps the address
+	// of each host that we route DSR traffic to to its index, which picks
+	// its mark and routing table.  Indexes stay the same while a host is in
+	// use so that its established connections keep being routed to it.
+	dsrHostAddr string
+	mangleTable Table
+	routeTable  RouteTable
+	dsrHostIdxs map[string]int
+}
+
+func NewManager(ipVersion uint8, renderer rules.RuleRenderer, natTable, filterTable Table) *Manager {
+	return &Manager{
+		ipVersion:     ipVersion,
+		renderer:      renderer,
+		natTable:      natTable,
+		filterTable:   filterTable,
+		services:      map[ServiceID]Service{},
+		endpoints:     map[ServiceID]Endpoints{},
+		dirty:         true,
+		natChainNames: map[string]bool{},
+	}
+}
+
+// EnableDSR enables DSR for services that ask for it.  hostAddr is the
+// address of our host, which is how the Endpoints' HostAddrs refer to it.
+// DSR is IPv4-only and needs a DSR mark field; otherwise this is a no-op.
+func (m *Manager) EnableDSR(hostAddr string, mangleTable Table, routeTable RouteTable) {
+	if m.ipVersion != 4 || m.renderer.MaxDSRHosts() == 0 {
+		log.Warn("DSR needs IPv4 and a DSR mark field, leaving it disabled")
+		return
+	}
+	m.dsrHostAddr = hostAddr
+	m.mangleTable = mangleTable
+	m.routeTable = routeTable
+	m.dsrHostIdxs = map[string]int{}
+	m.dirty = true
+}
+
+func (m *Manager) OnServiceUpdate(svc Service) {
+	log.WithField("service", svc.ID).Debug("Service updated")
+	m.services[svc.ID] = svc
+	m.dirty = true
+}
+
+func (m *Manager) OnServiceRemove(id ServiceID) {
+	log.WithField("service", id).Debug("Service removed")
+	delete(m.services, id)
+	m.dirty = true
+}
+
+func (m *Manager) OnEndpointsUpdate(eps Endpoints) {
+	log.WithField("service", eps.ID).Debug("Endpoints updated")
+	m.endpoints[eps.ID] = eps
+	m.dirty = true
+}
+
+func (m *Manager) OnEndpointsRemove(id ServiceID) {
+	log.WithField("service", id).Debug("Endpoints removed")
+	delete(m.endpoints, id)
+	m.dirty = true
+}
+
+// CompleteDeferredWork queues the updates to the tables that are needed to
+// bring them in line with the current services.  Since a change to a
+// service's endpoints changes the probabilities of all of its load-balancing
+// rules, the chains are re-rendered from scratch; the Table only writes the
+// ones that actually changed.
+func (m *Manager) CompleteDeferredWork() {
+	if !m.dirty {
+		return
+	}
+	if m.dsrEnabled() {
+		m.updateDSRHosts()
+	}
+	natChains := m.renderNATChains()
+	newNames := map[string]bool{}
+	for _, chain := range natChains {
+		newNames[chain.Name] = true
+	}
+	for name := range m.natChainNames {
+		if !newNames[name] {
+			m.natTable.RemoveChainByName(name)
+		}
+	}
+	m.natTable.UpdateChains(natChains)
+	m.natChainNames = newNames
+
+	servicesJump := []iptables.Rule{{Action: iptables.JumpAction{Target: ChainServices}}}
+	m.natTable.SetRuleInsertions("PREROUTING", servicesJump)
+	m.natTable.SetRuleInsertions("OUTPUT", servicesJump)
+	m.natTable.SetRuleInsertions("POSTROUTING", []iptables.Rule{
+		{Action: iptables.JumpAction{Target: rules.ChainMasqMarked}},
+	})
+	m.filterTable.UpdateChains([]*iptables.Chain{m.renderer.NodePortProtectChain()})
+	m.filterTable.SetRuleInsertions("INPUT", []iptables.Rule{
+		{Action: iptables.JumpAction{Target: rules.ChainNodePortsProtect}},
+	})
+	if m.dsrEnabled() {
+		m.mangleTable.SetRuleInsertions("PREROUTING", m.renderer.DSRRestoreMarkRules())
+		m.routeTable.SetDSRRoutes(m.dsrRoutes())
+	}
+	m.dirty = false
+}
+
+func (m *Manager) renderNATChains() []*iptables.Chain {
+	ids := make([]ServiceID, 0, len(m.services))
+	for id := range m.services {
+		ids = append(ids, id)
+	}
+	sort.Sort(serviceIDs(ids))
+
+	var lbChains []*iptables.Chain
+	var nodePorts []rules.NodePort
+	// DSR traffic from other hosts has to go to one of our own endpoints
+	// so its rules come before the ones that might route it elsewhere.
+	dsrRules := []iptables.Rule{}
+	servicesRules := []iptables.Rule{}
+	for _, id := range ids {
+		svc := m.services[id]
+		clusterIP := net.ParseIP(svc.ClusterIP)
+		if clusterIP != nil && !m.isOurVersion(clusterIP) {
+			// A service has a single cluster IP so, if it's not
+			// ours, the service isn't either.
+			continue
+		}
+		eps := m.endpoints[id]
+		dsr := svc.DSR && clusterIP != nil && m.dsrEnabled()
+		for _, port := range svc.Ports {
+			lbName := loadBalancerName(id, port)
+			if !dsr || port.NodePort != 0 {
+				lbChains = append(lbChains, m.renderer.LoadBalancerChains(
+					lbName,
+					m.backends(eps, port),
+					m.ipVersion,
+					svc.AffinityTimeoutSecs,
+				)...)
+			}
+			clusterIPLBName := lbName
+			if dsr {
+				clusterIPLBName = lbName + "/dsr"
+				localLBName := lbName + "/dsr-local"
+				lbChains = append(lbChains, m.renderer.LoadBalancerChains(
+					clusterIPLBName,
+					m.dsrBackends(eps, port),
+					m.ipVersion,
+					svc.AffinityTimeoutSecs,
+				)...)
+				lbChains = append(lbChains, m.renderer.LoadBalancerChains(
+					localLBName,
+					m.localBackends(eps, port),
+					m.ipVersion,
+					svc.AffinityTimeoutSecs,
+				)...)
+				dsrRules = append(dsrRules, iptables.Rule{
+					Match: iptables.Match().
+						InInterface(rules.DSRTunnelDevice).
+						Protocol(port.Protocol).
+						DestNet(clusterIP.String()).
+						DestPorts(port.Port),
+					Action: iptables.JumpAction{Target: rules.LoadBalancerChainName(localLBName)},
+				})
+			}
+			if clusterIP != nil {
+				servicesRules = append(servicesRules, iptables.Rule{
+					Match: iptables.Match().
+						Protocol(port.Protocol).
+						DestNet(clusterIP.String()).
+						DestPorts(port.Port),
+					Action: iptables.JumpAction{Target: rules.LoadBalancerChainName(clusterIPLBName)},
+				})
+			}
+			if port.NodePort != 0 {
+				nodePorts = append(nodePorts, rules.NodePort{
+					Protocol: port.Protocol,
+					Port:     port.NodePort,
+					LBName:   lbName,
+				})
+			}
+		}
+	}
+	servicesRules = append(servicesRules, iptables.Rule{
+		Match:  iptables.Match().DestAddrType(iptables.AddrTypeLocal),
+		Action: iptables.JumpAction{Target: rules.ChainNodePorts},
+	})
+
+	chains := []*iptables.Chain{
+		{Name: ChainServices, Rules: append(dsrRules, servicesRules...)},
+		m.renderer.NodePortChain(nodePorts),
+		m.renderer.MasqMarkedChain(),
+	}
+	return append(chains, lbChains...)
+}
+
+// backends returns the endpoint addresses, of our IP version, that serve
+// the given port.
+func (m *Manager) backends(eps Endpoints, port ServicePort) []rules.LoadBalancerBackend {
+	var backends []rules.LoadBalancerBackend
+	for _, epPort := range eps.Ports {
+		if epPort.Name != port.Name {
+			continue
+		}
+		for _, addr := range eps.Addresses {
+			ip := net.ParseIP(addr)
+			if ip == nil || !m.isOurVersion(ip) {
+				continue
+			}
+			backends = append(backends, rules.LoadBalancerBackend{
+				Addr: ip.String(),
+				Port: epPort.Port,
+			})
+		}
+	}
+	return backends
+}
+
+// dsrBackends returns the backends for the port with the endpoints on
+// other hosts marked for DSR.  Endpoints on hosts that didn't get a DSR
+// index, because we ran out, are DNATted as usual.
+func (m *Manager) dsrBackends(eps Endpoints, port ServicePort) []rules.LoadBalancerBackend {
+	backends := m.backends(eps, port)
+	for i, backend := range backends {
+		hostIdx := m.dsrHostIdxs[eps.HostAddrs[backend.Addr]]
+		if hostIdx == 0 {
+			continue
+		}
+		mark, err := m.renderer.DSRHostMark(hostIdx)
+		if err != nil {
+			log.WithError(err).Panic("Allocated DSR host index out of range")
+		}
+		backends[i].DSRMark = mark
+	}
+	return backends
+}
+
+// localBackends returns the backends for the port that run on our host.
+func (m *Manager) localBackends(eps Endpoints, port ServicePort) []rules.LoadBalancerBackend {
+	var backends []rules.LoadBalancerBackend
+	for _, backend := range m.backends(eps, port) {
+		if eps.HostAddrs[backend.Addr] == m.dsrHostAddr {
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
+func (m *Manager) dsrEnabled() bool {
+	return m.dsrHostIdxs != nil
+}
+
+// updateDSRHosts frees the indexes of the hosts that no longer run
+// endpoints of DSR services and allocates indexes to the new ones, lowest
+// first.
+func (m *Manager) updateDSRHosts() {
+	hostAddrs := map[string]bool{}
+	for id, svc := range m.services {
+		if !svc.DSR {
+			continue
+		}
+		for _, hostAddr := range m.endpoints[id].HostAddrs {
+			if hostAddr != "" && hostAddr != m.dsrHostAddr {
+				hostAddrs[hostAddr] = true
+			}
+		}
+	}
+	usedIdxs := map[int]bool{}
+	for hostAddr, idx := range m.dsrHostIdxs {
+		if !hostAddrs[hostAddr] {
+			delete(m.dsrHostIdxs, hostAddr)
+			continue
+		}
+		usedIdxs[idx] = true
+	}
+	newHostAddrs := []string{}
+	for hostAddr := range hostAddrs {
+		if _, ok := m.dsrHostIdxs[hostAddr]; !ok {
+			newHostAddrs = append(newHostAddrs, hostAddr)
+		}
+	}
+	sort.Strings(newHostAddrs)
+	idx := 1
+	for _, hostAddr := range newHostAddrs {
+		for usedIdxs[idx] {
+			idx++
+		}
+		if idx > m.renderer.MaxDSRHosts() {
+			log.WithField("host", hostAddr).Warn(
+				"Out of DSR host indexes, DNATting traffic to host instead")
+			continue
+		}
+		m.dsrHostIdxs[hostAddr] = idx
+		usedIdxs[idx] = true
+	}
+}
+
+// dsrRoutes returns the routes to the hosts that have DSR indexes, in
+// index order.
+func (m *Manager) dsrRoutes() []rules.DSRRoute {
+	routes := []rules.DSRRoute{}
+	for hostAddr, idx := range m.dsrHostIdxs {
+		route, err := m.renderer.DSRRoute(idx, hostAddr)
+		if err != nil {
+			log.WithError(err).Panic("Allocated DSR host index out of range")
+		}
+		routes = append(routes, route)
+	}
+	sort.Sort(dsrRoutesByTable(routes))
+	return routes
+}
+
+func (m *Manager) isOurVersion(ip net.IP) bool {
+	return (ip.To4() != nil) == (m.ipVersion == 4)
+}
+
+// loadBalancerName returns the name of the load balancer for the service
+// port, which is unique across all services.
+func loadBalancerName(id ServiceID, port ServicePort) string {
+	return fmt.Sprintf("%s:%s/%d", id, port.Protocol, port.Port)
+}
+
+type serviceIDs []ServiceID
+
+func (s serviceIDs) Len() int      { return len(s) }
+func (s serviceIDs) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s serviceIDs) Less(i, j int) bool {
+	if s[i].Namespace != s[j].Namespace {
+		return s[i].Namespace < s[j].Namespace
+	}
+	return s[i].Name < s[j].Name
+}
+
+type dsrRoutesByTable []rules.DSRRoute
+
+func (s dsrRoutesByTable) Len() int           { return len(s) }
+func (s dsrRoutesByTable) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s dsrRoutesByTable) Less(i, j int) bool { return s[i].Table < s[j].Table }
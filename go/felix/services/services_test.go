@@ -0,0 +1,244 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/services"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"github.com/projectcalico/felix/go/felix/rules"
+)
+
+type mockTable struct {
+	chains     map[string]*iptables.Chain
+	insertions map[string][]iptables.Rule
+}
+
+func newMockTable() *mockTable {
+	return &mockTable{
+		chains:     map[string]*iptables.Chain{},
+		insertions: map[string][]iptables.Rule{},
+	}
+}
+
+func (t *mockTable) UpdateChains(chains []*iptables.Chain) {
+	for _, chain := range chains {
+		t.chains[chain.Name] = chain
+	}
+}
+
+func (t *mockTable) RemoveChainByName(name string) {
+	delete(t.chains, name)
+}
+
+func (t *mockTable) SetRuleInsertions(chainName string, rules []iptables.Rule) {
+	t.insertions[chainName] = rules
+}
+
+type mockRouteTable struct {
+	routes []rules.DSRRoute
+}
+
+func (t *mockRouteTable) SetDSRRoutes(routes []rules.DSRRoute) {
+	t.routes = routes
+}
+
+var webID = ServiceID{Namespace: "default", Name: "web"}
+
+var webService = Service{
+	ID:        webID,
+	ClusterIP: "10.96.0.10",
+	Ports: []ServicePort{
+		{Name: "http", Protocol: "tcp", Port: 80, NodePort: 30080},
+	},
+}
+
+var webEndpoints = Endpoints{
+	ID:        webID,
+	Addresses: []string{"10.0.0.1", "fd00::1", "10.0.0.2"},
+	Ports:     []EndpointPort{{Name: "http", Port: 8080}},
+}
+
+const webLBName = "default/web:tcp/80"
+
+var _ = Describe("Manager", func() {
+	var renderer rules.RuleRenderer
+	var natTable, filterTable *mockTable
+	var manager *Manager
+
+	BeforeEach(func() {
+		renderer = rules.NewRenderer(rules.Config{
+			IptablesMarkMasq: 0x4,
+			NodePortRanges:   []rules.PortRange{{Min: 30000, Max: 32767}},
+		})
+		natTable = newMockTable()
+		filterTable = newMockTable()
+		manager = NewManager(4, renderer, natTable, filterTable)
+	})
+
+	It("should hook its chains into the top-level chains", func() {
+		manager.CompleteDeferredWork()
+		Expect(natTable.insertions["PREROUTING"]).To(Equal([]iptables.Rule{
+			{Action: iptables.JumpAction{Target: "cali-services"}},
+		}))
+		Expect(natTable.insertions["OUTPUT"]).To(Equal(natTable.insertions["PREROUTING"]))
+		Expect(natTable.insertions["POSTROUTING"]).To(Equal([]iptables.Rule{
+			{Action: iptables.JumpAction{Target: "cali-masq-marked"}},
+		}))
+		Expect(filterTable.insertions["INPUT"]).To(Equal([]iptables.Rule{
+			{Action: iptables.JumpAction{Target: "cali-nodeports-protect"}},
+		}))
+		Expect(filterTable.chains["cali-nodeports-protect"]).To(Equal(renderer.NodePortProtectChain()))
+		Expect(natTable.chains["cali-services"].Rules).To(Equal([]iptables.Rule{
+			{
+				Match:  iptables.Match().DestAddrType(iptables.AddrTypeLocal),
+				Action: iptables.JumpAction{Target: "cali-nodeports"},
+			},
+		}))
+	})
+
+	Describe("with a service and its endpoints", func() {
+		BeforeEach(func() {
+			manager.OnServiceUpdate(webService)
+			manager.OnEndpointsUpdate(webEndpoints)
+			manager.CompleteDeferredWork()
+		})
+
+		It("should DNAT the cluster IP to the load balancer", func() {
+			Expect(natTable.chains["cali-services"].Rules[0]).To(Equal(iptables.Rule{
+				Match:  iptables.Match().Protocol("tcp").DestNet("10.96.0.10").DestPorts(80),
+				Action: iptables.JumpAction{Target: rules.LoadBalancerChainName(webLBName)},
+			}))
+		})
+		It("should balance over the endpoints of the right IP version", func() {
+			backends := []rules.LoadBalancerBackend{
+				{Addr: "10.0.0.1", Port: 8080},
+				{Addr: "10.0.0.2", Port: 8080},
+			}
+			for _, chain := range renderer.LoadBalancerChains(webLBName, backends, 4, 0) {
+				Expect(natTable.chains[chain.Name]).To(Equal(chain))
+			}
+		})
+		It("should render the node port", func() {
+			Expect(natTable.chains["cali-nodeports"]).To(Equal(renderer.NodePortChain([]rules.NodePort{
+				{Protocol: "tcp", Port: 30080, LBName: webLBName},
+			})))
+		})
+		It("should remove the service's chains when it goes away", func() {
+			manager.OnServiceRemove(webID)
+			manager.CompleteDeferredWork()
+			Expect(natTable.chains).NotTo(HaveKey(rules.LoadBalancerChainName(webLBName)))
+			Expect(natTable.chains["cali-services"].Rules).To(HaveLen(1))
+			Expect(natTable.chains["cali-nodeports"].Rules).To(BeEmpty())
+		})
+		It("should leave the load balancer empty without endpoints", func() {
+			manager.OnEndpointsRemove(webID)
+			manager.CompleteDeferredWork()
+			Expect(natTable.chains[rules.LoadBalancerChainName(webLBName)].Rules).To(BeEmpty())
+		})
+	})
+
+	Describe("with DSR enabled", func() {
+		var mangleTable *mockTable
+		var routeTable *mockRouteTable
+		var dsrEndpoints Endpoints
+
+		BeforeEach(func() {
+			renderer = rules.NewRenderer(rules.Config{
+				IptablesMarkMasq:  0x4,
+				IptablesMarkDSR:   0x30,
+				DSRRouteTableBase: 200,
+				NodePortRanges:    []rules.PortRange{{Min: 30000, Max: 32767}},
+			})
+			manager = NewManager(4, renderer, natTable, filterTable)
+			mangleTable = newMockTable()
+			routeTable = &mockRouteTable{}
+			manager.EnableDSR("192.168.0.1", mangleTable, routeTable)
+
+			dsrService := webService
+			dsrService.DSR = true
+			dsrEndpoints = webEndpoints
+			dsrEndpoints.HostAddrs = map[string]string{
+				"10.0.0.1": "192.168.0.1",
+				"10.0.0.2": "192.168.0.2",
+			}
+			manager.OnServiceUpdate(dsrService)
+			manager.OnEndpointsUpdate(dsrEndpoints)
+			manager.CompleteDeferredWork()
+		})
+
+		It("should route the other host's traffic over the tunnel", func() {
+			Expect(routeTable.routes).To(Equal([]rules.DSRRoute{
+				{Mark: 0x10, Mask: 0x30, Table: 201, HostAddr: "192.168.0.2"},
+			}))
+			Expect(mangleTable.insertions["PREROUTING"]).To(Equal(renderer.DSRRestoreMarkRules()))
+		})
+		It("should mark the cluster IP traffic for the other host", func() {
+			backends := []rules.LoadBalancerBackend{
+				{Addr: "10.0.0.1", Port: 8080},
+				{Addr: "10.0.0.2", Port: 8080, DSRMark: 0x10},
+			}
+			for _, chain := range renderer.LoadBalancerChains(webLBName+"/dsr", backends, 4, 0) {
+				Expect(natTable.chains[chain.Name]).To(Equal(chain))
+			}
+			Expect(natTable.chains["cali-services"].Rules[1]).To(Equal(iptables.Rule{
+				Match:  iptables.Match().Protocol("tcp").DestNet("10.96.0.10").DestPorts(80),
+				Action: iptables.JumpAction{Target: rules.LoadBalancerChainName(webLBName + "/dsr")},
+			}))
+		})
+		It("should send DSR traffic from other hosts to the local endpoint", func() {
+			Expect(natTable.chains["cali-services"].Rules[0]).To(Equal(iptables.Rule{
+				Match: iptables.Match().InInterface("tunl0").
+					Protocol("tcp").DestNet("10.96.0.10").DestPorts(80),
+				Action: iptables.JumpAction{Target: rules.LoadBalancerChainName(webLBName + "/dsr-local")},
+			}))
+			local := []rules.LoadBalancerBackend{{Addr: "10.0.0.1", Port: 8080}}
+			for _, chain := range renderer.LoadBalancerChains(webLBName+"/dsr-local", local, 4, 0) {
+				Expect(natTable.chains[chain.Name]).To(Equal(chain))
+			}
+		})
+		It("should still DNAT the node port", func() {
+			Expect(natTable.chains).To(HaveKey(rules.LoadBalancerChainName(webLBName)))
+		})
+		It("should keep a host's index while it's in use", func() {
+			dsrEndpoints.Addresses = append(dsrEndpoints.Addresses, "10.0.0.3", "10.0.0.4")
+			dsrEndpoints.HostAddrs["10.0.0.3"] = "192.168.0.0"
+			dsrEndpoints.HostAddrs["10.0.0.4"] = "192.168.0.4"
+			manager.OnEndpointsUpdate(dsrEndpoints)
+			manager.CompleteDeferredWork()
+			Expect(routeTable.routes).To(Equal([]rules.DSRRoute{
+				{Mark: 0x10, Mask: 0x30, Table: 201, HostAddr: "192.168.0.2"},
+				{Mark: 0x20, Mask: 0x30, Table: 202, HostAddr: "192.168.0.0"},
+				{Mark: 0x30, Mask: 0x30, Table: 203, HostAddr: "192.168.0.4"},
+			}))
+		})
+		It("should remove the routes when the endpoints go away", func() {
+			manager.OnEndpointsRemove(webID)
+			manager.CompleteDeferredWork()
+			Expect(routeTable.routes).To(BeEmpty())
+		})
+	})
+
+	It("should ignore a service of the other IP version", func() {
+		v6Service := webService
+		v6Service.ClusterIP = "fd00:96::10"
+		manager.OnServiceUpdate(v6Service)
+		manager.CompleteDeferredWork()
+		Expect(natTable.chains["cali-services"].Rules).To(HaveLen(1))
+		Expect(natTable.chains).NotTo(HaveKey(rules.LoadBalancerChainName(webLBName)))
+	})
+})
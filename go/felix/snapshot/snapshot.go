@@ -0,0 +1,284 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The snapshot package persists a compressed copy of the datastore state
+// that Felix last saw, so that a restarting Felix can start programming the
+// dataplane straight away, from the snapshot, instead of waiting for its
+// first resync with the datastore, which can take a long time in a large
+// cluster.  Until the dataplane driver has been given the endpoints and
+// policy, new workloads aren't protected, so this shortens that window.
+//
+// The snapshot is only a head start: once the Syncer is in sync, anything
+// in the snapshot that the datastore no longer has is deleted, so Felix
+// ends up in the same state as it would without one.
+package snapshot
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshot is the content of the snapshot file, before compression.
+type snapshot struct {
+	FelixVersion string    `json:"felix_version"`
+	Hostname     string    `json:"hostname"`
+	Time         time.Time `json:"time"`
+	// KVs maps from the datastore path of each key to its serialized
+	// value.
+	KVs map[string]string `json:"kvs"`
+}
+
+type Config struct {
+	// Path is the path of the snapshot file.
+	Path string
+	// Hostname and FelixVersion identify the Felix that writes the
+	// snapshot; a snapshot written by another host or version is
+	// ignored.
+	Hostname     string
+	FelixVersion string
+	// MaxAge, if non-zero, is the age beyond which a snapshot is too
+	// stale to be worth using.
+	MaxAge time.Duration
+	// SaveInterval is the minimum time between saves of the snapshot.
+	SaveInterval time.Duration
+	// NowOverride, if non-nil, is used in place of time.Now.
+	NowOverride func() time.Time
+}
+
+// Recorder sits between the Syncer and the rest of Felix, passing the
+// updates through and keeping a copy of the state so that it can save it.
+// Like the rest of the Syncer's output, its methods must only be called from
+// one goroutine.
+type Recorder struct {
+	config    Config
+	callbacks api.SyncerCallbacks
+	now       func() time.Time
+
+	kvs      map[string]string
+	inSync   bool
+	dirty    bool
+	lastSave time.Time
+
+	// replayedKeys holds the keys from the snapshot that the Syncer hasn't
+	// reported yet.  Those that are left when it is in sync have been
+	// deleted from the datastore.
+	replayedKeys map[string]model.Key
+}
+
+func New(config Config, callbacks api.SyncerCallbacks) *Recorder {
+	r := &Recorder{
+		config:       config,
+		callbacks:    callbacks,
+		now:          config.NowOverride,
+		kvs:          map[string]string{},
+		replayedKeys: map[string]model.Key{},
+	}
+	if r.now == nil {
+		r.now = time.Now
+	}
+	return r
+}
+
+// Replay loads the snapshot, if there's a valid one, and passes its contents
+// on as if they came from the Syncer.  It must be called before any updates
+// from the Syncer.  Returns the number of keys replayed.
+func (r *Recorder) Replay() int {
+	snap := r.load()
+	if snap == nil {
+		return 0
+	}
+	var updates []api.Update
+	for path, value := range snap.KVs {
+		logCxt := log.WithField("key", path)
+		key := model.KeyFromDefaultPath(path)
+		if key == nil {
+			logCxt.Warn("Ignoring unknown key in snapshot")
+			continue
+		}
+		parsed, err := model.ParseValue(key, []byte(value))
+		if err != nil || parsed == nil {
+			logCxt.WithError(err).Warn("Ignoring bad value in snapshot")
+			continue
+		}
+		r.kvs[path] = value
+		r.replayedKeys[path] = key
+		updates = append(updates, api.Update{
+			KVPair:     model.KVPair{Key: key, Value: parsed},
+			UpdateType: api.UpdateTypeKVNew,
+		})
+	}
+	log.WithFields(log.Fields{
+		"path": r.config.Path,
+		"keys": len(updates),
+		"age":  r.now().Sub(snap.Time),
+	}).Info("Replaying datastore snapshot")
+	r.callbacks.OnStatusUpdated(api.ResyncInProgress)
+	if len(updates) > 0 {
+		r.callbacks.OnUpdates(updates)
+	}
+	return len(updates)
+}
+
+// load reads the snapshot file.  It returns nil if there's no snapshot or
+// it can't be used.
+func (r *Recorder) load() *snapshot {
+	logCxt := log.WithField("path", r.config.Path)
+	f, err := os.Open(r.config.Path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logCxt.WithError(err).Warn("Failed to open snapshot, ignoring it")
+		}
+		return nil
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to read snapshot, ignoring it")
+		return nil
+	}
+	var snap snapshot
+	if err := json.NewDecoder(gz).Decode(&snap); err != nil {
+		logCxt.WithError(err).Warn("Failed to parse snapshot, ignoring it")
+		return nil
+	}
+	if snap.Hostname != r.config.Hostname || snap.FelixVersion != r.config.FelixVersion {
+		logCxt.WithFields(log.Fields{
+			"hostname":     snap.Hostname,
+			"felixVersion": snap.FelixVersion,
+		}).Info("Snapshot is from a different host or version, ignoring it")
+		return nil
+	}
+	if age := r.now().Sub(snap.Time); r.config.MaxAge > 0 && age > r.config.MaxAge {
+		logCxt.WithField("age", age).Info("Snapshot is too old, ignoring it")
+		return nil
+	}
+	return &snap
+}
+
+func (r *Recorder) OnStatusUpdated(status api.SyncStatus) {
+	if status == api.InSync && !r.inSync {
+		// The Syncer has now reported everything in the datastore, so
+		// any replayed keys that it hasn't reported are gone.
+		var deletions []api.Update
+		for path, key := range r.replayedKeys {
+			deletions = append(deletions, api.Update{
+				KVPair:     model.KVPair{Key: key},
+				UpdateType: api.UpdateTypeKVDeleted,
+			})
+			delete(r.kvs, path)
+		}
+		if len(deletions) > 0 {
+			log.WithField("keys", len(deletions)).Info(
+				"Removing keys from the snapshot that are no longer in the datastore")
+			r.callbacks.OnUpdates(deletions)
+		}
+		r.replayedKeys = map[string]model.Key{}
+		r.inSync = true
+		r.dirty = true
+	}
+	r.callbacks.OnStatusUpdated(status)
+	r.maybeSave()
+}
+
+func (r *Recorder) OnUpdates(updates []api.Update) {
+	for i, update := range updates {
+		path, err := model.KeyToDefaultPath(update.Key)
+		if err != nil {
+			log.WithError(err).WithField("key", update.Key).Debug(
+				"Not recording key without a datastore path")
+			continue
+		}
+		if _, replayed := r.replayedKeys[path]; replayed {
+			delete(r.replayedKeys, path)
+			if update.UpdateType == api.UpdateTypeKVNew {
+				// The rest of Felix has already seen the key, from the
+				// snapshot.
+				updates[i].UpdateType = api.UpdateTypeKVUpdated
+			}
+		}
+		r.dirty = true
+		if update.Value == nil {
+			delete(r.kvs, path)
+			continue
+		}
+		value, err := model.SerializeValue(&updates[i].KVPair)
+		if err != nil {
+			log.WithError(err).WithField("key", path).Warn(
+				"Failed to serialize value, leaving it out of the snapshot")
+			delete(r.kvs, path)
+			continue
+		}
+		r.kvs[path] = string(value)
+	}
+	r.callbacks.OnUpdates(updates)
+	r.maybeSave()
+}
+
+// maybeSave saves the snapshot if anything has changed since the last save
+// and the save interval has passed.  A partial state would make a misleading
+// snapshot, so nothing is saved until the Syncer is in sync.  Since saves
+// are only triggered by updates, the last few changes before a quiet period
+// may not be saved until the next update.
+func (r *Recorder) maybeSave() {
+	if !r.inSync || !r.dirty || r.now().Sub(r.lastSave) < r.config.SaveInterval {
+		return
+	}
+	if err := r.save(); err != nil {
+		log.WithError(err).WithField("path", r.config.Path).Warn("Failed to save snapshot")
+	}
+	// Don't retry a failure until the next interval either.
+	r.lastSave = r.now()
+}
+
+// save writes the snapshot to its file.  It writes to a temporary file and
+// renames it into place so that a crash can't leave a partial file behind.
+func (r *Recorder) save() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(r.config.Path), filepath.Base(r.config.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(tmp)
+	err = json.NewEncoder(gz).Encode(&snapshot{
+		FelixVersion: r.config.FelixVersion,
+		Hostname:     r.config.Hostname,
+		Time:         r.now(),
+		KVs:          r.kvs,
+	})
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.config.Path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	r.dirty = false
+	log.WithFields(log.Fields{
+		"path": r.config.Path,
+		"keys": len(r.kvs),
+	}).Debug("Saved datastore snapshot")
+	return nil
+}
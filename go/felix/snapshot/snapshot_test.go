@@ -0,0 +1,203 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/snapshot"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// recordingCallbacks records the statuses and updates that it is given.
+type recordingCallbacks struct {
+	statuses []api.SyncStatus
+	updates  []api.Update
+}
+
+func (c *recordingCallbacks) OnStatusUpdated(status api.SyncStatus) {
+	c.statuses = append(c.statuses, status)
+}
+
+func (c *recordingCallbacks) OnUpdates(updates []api.Update) {
+	c.updates = append(c.updates, updates...)
+}
+
+// summary returns the type, name and value of each update, sorted, since
+// the order of the keys in a replay isn't defined.
+func (c *recordingCallbacks) summary() map[string]interface{} {
+	summary := map[string]interface{}{}
+	for _, update := range c.updates {
+		name := update.Key.(model.GlobalConfigKey).Name
+		summary[name] = []interface{}{update.UpdateType, update.Value}
+	}
+	return summary
+}
+
+func configUpdate(name string, value interface{}, updateType api.UpdateType) api.Update {
+	return api.Update{
+		KVPair:     model.KVPair{Key: model.GlobalConfigKey{Name: name}, Value: value},
+		UpdateType: updateType,
+	}
+}
+
+var _ = Describe("Snapshot recorder", func() {
+	var dir, path string
+	var now time.Time
+	var callbacks *recordingCallbacks
+
+	newRecorder := func(hostname, felixVersion string) *Recorder {
+		callbacks = &recordingCallbacks{}
+		return New(Config{
+			Path:         path,
+			Hostname:     hostname,
+			FelixVersion: felixVersion,
+			MaxAge:       time.Hour,
+			SaveInterval: 10 * time.Second,
+			NowOverride:  func() time.Time { return now },
+		}, callbacks)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-snapshot")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "snapshot.gz")
+		now = time.Date(2016, 11, 1, 12, 0, 0, 0, time.UTC)
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should replay nothing if there's no snapshot", func() {
+		r := newRecorder("host1", "v1")
+		Expect(r.Replay()).To(Equal(0))
+		Expect(callbacks.statuses).To(BeEmpty())
+		Expect(callbacks.updates).To(BeEmpty())
+	})
+
+	It("should pass updates through", func() {
+		r := newRecorder("host1", "v1")
+		r.OnStatusUpdated(api.ResyncInProgress)
+		r.OnUpdates([]api.Update{configUpdate("A", "1", api.UpdateTypeKVNew)})
+		Expect(callbacks.statuses).To(Equal([]api.SyncStatus{api.ResyncInProgress}))
+		Expect(callbacks.updates).To(Equal([]api.Update{
+			configUpdate("A", "1", api.UpdateTypeKVNew),
+		}))
+	})
+
+	It("should not save a snapshot before it's in sync", func() {
+		r := newRecorder("host1", "v1")
+		r.OnStatusUpdated(api.ResyncInProgress)
+		r.OnUpdates([]api.Update{configUpdate("A", "1", api.UpdateTypeKVNew)})
+		_, err := os.Stat(path)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	Describe("with a saved snapshot", func() {
+		BeforeEach(func() {
+			r := newRecorder("host1", "v1")
+			r.OnStatusUpdated(api.ResyncInProgress)
+			r.OnUpdates([]api.Update{
+				configUpdate("A", "1", api.UpdateTypeKVNew),
+				configUpdate("B", "2", api.UpdateTypeKVNew),
+				configUpdate("C", "3", api.UpdateTypeKVNew),
+			})
+			r.OnUpdates([]api.Update{configUpdate("C", nil, api.UpdateTypeKVDeleted)})
+			r.OnStatusUpdated(api.InSync)
+			now = now.Add(time.Minute)
+		})
+
+		It("should replay the snapshot as if it came from the syncer", func() {
+			r := newRecorder("host1", "v1")
+			Expect(r.Replay()).To(Equal(2))
+			Expect(callbacks.statuses).To(Equal([]api.SyncStatus{api.ResyncInProgress}))
+			Expect(callbacks.summary()).To(Equal(map[string]interface{}{
+				"A": []interface{}{api.UpdateTypeKVNew, "1"},
+				"B": []interface{}{api.UpdateTypeKVNew, "2"},
+			}))
+		})
+		It("should ignore a snapshot from another host", func() {
+			Expect(newRecorder("host2", "v1").Replay()).To(Equal(0))
+		})
+		It("should ignore a snapshot from another version", func() {
+			Expect(newRecorder("host1", "v2").Replay()).To(Equal(0))
+		})
+		It("should ignore a snapshot that is too old", func() {
+			now = now.Add(2 * time.Hour)
+			Expect(newRecorder("host1", "v1").Replay()).To(Equal(0))
+		})
+		It("should ignore a corrupt snapshot", func() {
+			Expect(ioutil.WriteFile(path, []byte("garbage"), 0644)).To(Succeed())
+			Expect(newRecorder("host1", "v1").Replay()).To(Equal(0))
+		})
+
+		Describe("after replaying it", func() {
+			var r *Recorder
+
+			BeforeEach(func() {
+				r = newRecorder("host1", "v1")
+				r.Replay()
+				callbacks.statuses = nil
+				callbacks.updates = nil
+			})
+
+			It("should turn the syncer's creation of a replayed key into an update", func() {
+				r.OnUpdates([]api.Update{
+					configUpdate("A", "10", api.UpdateTypeKVNew),
+					configUpdate("D", "4", api.UpdateTypeKVNew),
+				})
+				Expect(callbacks.updates).To(Equal([]api.Update{
+					configUpdate("A", "10", api.UpdateTypeKVUpdated),
+					configUpdate("D", "4", api.UpdateTypeKVNew),
+				}))
+			})
+			It("should delete the replayed keys that the syncer doesn't report once in sync", func() {
+				r.OnStatusUpdated(api.ResyncInProgress)
+				r.OnUpdates([]api.Update{configUpdate("A", "1", api.UpdateTypeKVNew)})
+				callbacks.updates = nil
+				r.OnStatusUpdated(api.InSync)
+				Expect(callbacks.updates).To(Equal([]api.Update{
+					configUpdate("B", nil, api.UpdateTypeKVDeleted),
+				}))
+				Expect(callbacks.statuses).To(Equal([]api.SyncStatus{
+					api.ResyncInProgress,
+					api.InSync,
+				}))
+
+				// The new snapshot shouldn't have B either.
+				Expect(newRecorder("host1", "v1").Replay()).To(Equal(1))
+			})
+			It("should only save again once the save interval has passed", func() {
+				// Saves the snapshot straight away, without A or B, which
+				// the syncer didn't report.
+				r.OnStatusUpdated(api.InSync)
+				r.OnUpdates([]api.Update{configUpdate("A", "1", api.UpdateTypeKVNew)})
+				r.OnUpdates([]api.Update{configUpdate("E", "5", api.UpdateTypeKVNew)})
+				Expect(newRecorder("host1", "v1").Replay()).To(Equal(0))
+
+				now = now.Add(10 * time.Second)
+				r.OnUpdates([]api.Update{configUpdate("F", "6", api.UpdateTypeKVNew)})
+				Expect(newRecorder("host1", "v1").Replay()).To(Equal(3))
+			})
+		})
+	})
+})
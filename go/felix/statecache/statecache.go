@@ -0,0 +1,184 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The statecache package persists state that is expensive to recalculate
+// across Felix restarts: the features that the dataplane supports and the
+// hashes of the iptables rules that Felix last programmed.  With those, a
+// restarting Felix can skip probing the dataplane and only rewrite the
+// chains that have changed.
+//
+// The cache is only valid for the boot, kernel and Felix version that
+// wrote it; if any of those has changed, it's discarded and the state is
+// recalculated from scratch.
+package statecache
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	bootIDFile        = "/proc/sys/kernel/random/boot_id"
+	kernelReleaseFile = "/proc/sys/kernel/osrelease"
+)
+
+// state is the content of the cache file.
+type state struct {
+	BootID        string `json:"boot_id"`
+	KernelRelease string `json:"kernel_release"`
+	FelixVersion  string `json:"felix_version"`
+
+	Features *iptables.Features `json:"features,omitempty"`
+	// TableHashes maps from "<IP version>/<table>" to the table's chains'
+	// rule hashes.
+	TableHashes map[string]map[string][]string `json:"table_hashes,omitempty"`
+}
+
+type Config struct {
+	// Path is the path of the cache file.
+	Path string
+	// FelixVersion is the version of Felix; a cache written by a different
+	// version is ignored.
+	FelixVersion string
+	// ReadFileOverride, if non-nil, is used in place of ioutil.ReadFile.
+	ReadFileOverride func(filename string) ([]byte, error)
+}
+
+// Cache is the persisted state.  It isn't safe for concurrent use.
+type Cache struct {
+	path  string
+	state state
+}
+
+// Open loads the cache file.  If the file is missing or unreadable, or was
+// written by a different boot, kernel or Felix version, the cache starts
+// empty.
+func Open(config Config) *Cache {
+	readFile := config.ReadFileOverride
+	if readFile == nil {
+		readFile = ioutil.ReadFile
+	}
+	c := &Cache{
+		path: config.Path,
+		state: state{
+			BootID:        readProcFile(readFile, bootIDFile),
+			KernelRelease: readProcFile(readFile, kernelReleaseFile),
+			FelixVersion:  config.FelixVersion,
+		},
+	}
+	logCxt := log.WithField("path", c.path)
+	data, err := readFile(c.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logCxt.WithError(err).Warn("Failed to read state cache, ignoring it")
+		}
+		return c
+	}
+	var cached state
+	if err := json.Unmarshal(data, &cached); err != nil {
+		logCxt.WithError(err).Warn("Failed to parse state cache, ignoring it")
+		return c
+	}
+	if c.state.BootID == "" ||
+		cached.BootID != c.state.BootID ||
+		cached.KernelRelease != c.state.KernelRelease ||
+		cached.FelixVersion != c.state.FelixVersion {
+		logCxt.WithFields(log.Fields{
+			"cached":  fmt.Sprintf("%s/%s/%s", cached.BootID, cached.KernelRelease, cached.FelixVersion),
+			"current": fmt.Sprintf("%s/%s/%s", c.state.BootID, c.state.KernelRelease, c.state.FelixVersion),
+		}).Info("State cache is from a different boot, kernel or version, ignoring it")
+		return c
+	}
+	logCxt.Info("Loaded state cache")
+	c.state.Features = cached.Features
+	c.state.TableHashes = cached.TableHashes
+	return c
+}
+
+func readProcFile(readFile func(string) ([]byte, error), filename string) string {
+	data, err := readFile(filename)
+	if err != nil {
+		log.WithError(err).WithField("file", filename).Warn(
+			"Failed to read file, state cache will be ignored")
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Features returns the cached features, if there are any, or else calls
+// detect and caches its result.
+func (c *Cache) Features(detect func() *iptables.Features) *iptables.Features {
+	if c.state.Features == nil {
+		c.state.Features = detect()
+	} else {
+		log.WithField("features", *c.state.Features).Info("Using cached iptables features")
+	}
+	return c.state.Features
+}
+
+// TableHashes returns the cached rule hashes of the given table, in the
+// form expected by iptables.TableOptions.CachedDataplaneHashes, or nil if
+// there are none.
+func (c *Cache) TableHashes(table string, ipVersion uint8) map[string][]string {
+	return c.state.TableHashes[tableKey(table, ipVersion)]
+}
+
+// SetTableHashes records the rule hashes of the given table, as returned
+// by iptables.Table.DataplaneHashes() after a successful Apply.
+func (c *Cache) SetTableHashes(table string, ipVersion uint8, hashes map[string][]string) {
+	if c.state.TableHashes == nil {
+		c.state.TableHashes = map[string]map[string][]string{}
+	}
+	c.state.TableHashes[tableKey(table, ipVersion)] = hashes
+}
+
+// Save writes the cache to its file.  It writes to a temporary file and
+// renames it into place so that a crash can't leave a partial file behind.
+func (c *Cache) Save() error {
+	if c.state.BootID == "" {
+		// We wouldn't be able to tell whether the cache was still valid.
+		return nil
+	}
+	data, err := json.Marshal(&c.state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	log.WithField("path", c.path).Debug("Saved state cache")
+	return nil
+}
+
+func tableKey(table string, ipVersion uint8) string {
+	return fmt.Sprintf("%d/%s", ipVersion, table)
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/statecache"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/iptables"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("State cache", func() {
+	var dir, path string
+	var bootID, kernelRelease string
+	var numDetections int
+
+	readFile := func(filename string) ([]byte, error) {
+		switch filename {
+		case "/proc/sys/kernel/random/boot_id":
+			return []byte(bootID + "\n"), nil
+		case "/proc/sys/kernel/osrelease":
+			return []byte(kernelRelease + "\n"), nil
+		}
+		return ioutil.ReadFile(filename)
+	}
+	open := func(felixVersion string) *Cache {
+		return Open(Config{
+			Path:             path,
+			FelixVersion:     felixVersion,
+			ReadFileOverride: readFile,
+		})
+	}
+	detect := func() *iptables.Features {
+		numDetections++
+		return &iptables.Features{SYNPROXY: true}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-statecache")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "state.json")
+		bootID = "b00t"
+		kernelRelease = "4.4.0"
+		numDetections = 0
+
+		cache := open("2.0.0")
+		Expect(cache.Features(detect)).To(Equal(&iptables.Features{SYNPROXY: true}))
+		cache.SetTableHashes("filter", 4, map[string][]string{"cali-foo": {"abcd"}})
+		Expect(cache.Save()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should detect the features when there is no cache", func() {
+		Expect(numDetections).To(Equal(1))
+	})
+	It("should reuse the cached state after a restart", func() {
+		cache := open("2.0.0")
+		Expect(cache.Features(detect)).To(Equal(&iptables.Features{SYNPROXY: true}))
+		Expect(numDetections).To(Equal(1))
+		Expect(cache.TableHashes("filter", 4)).To(Equal(map[string][]string{"cali-foo": {"abcd"}}))
+		Expect(cache.TableHashes("filter", 6)).To(BeNil())
+	})
+	It("should leave no temporary files behind", func() {
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+	})
+	It("should ignore the cache after a reboot", func() {
+		bootID = "b00t2"
+		cache := open("2.0.0")
+		cache.Features(detect)
+		Expect(numDetections).To(Equal(2))
+		Expect(cache.TableHashes("filter", 4)).To(BeNil())
+	})
+	It("should ignore the cache after a kernel change", func() {
+		kernelRelease = "4.9.0"
+		Expect(open("2.0.0").TableHashes("filter", 4)).To(BeNil())
+	})
+	It("should ignore the cache after an upgrade", func() {
+		Expect(open("2.1.0").TableHashes("filter", 4)).To(BeNil())
+	})
+	It("should ignore a corrupt cache", func() {
+		Expect(ioutil.WriteFile(path, []byte("{"), 0600)).To(Succeed())
+		Expect(open("2.0.0").TableHashes("filter", 4)).To(BeNil())
+	})
+})
@@ -0,0 +1,195 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statusrep
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/set"
+)
+
+// Oper statuses reported for endpoints.  These match the values used by the
+// Python dataplane driver.
+const (
+	StatusUp    = "up"
+	StatusDown  = "down"
+	StatusError = "error"
+)
+
+// EndpointStatusCalculator is the dataplane-side counterpart of the
+// EndpointStatusReporter.  The dataplane feeds it with the state of each
+// local endpoint: whether its interface is up and whether its policy has
+// been programmed (or failed to program).  From that, it calculates the
+// endpoint's oper status:
+//
+//   - "error" if programming the endpoint's policy failed.
+//   - "down" if the policy hasn't been programmed yet or the interface is
+//     down.
+//   - "up" otherwise.
+//
+// Status changes are only emitted from Flush(), which the dataplane should
+// call once it has confirmed that its pending updates have been applied.
+// That ensures that we never report an endpoint as up before its policy is
+// in place.  Since the EndpointStatusReporter rate-limits and coalesces
+// updates, Flush() only emits the latest status of each endpoint that
+// changed.
+//
+// Endpoint IDs are *proto.WorkloadEndpointID or *proto.HostEndpointID.
+type EndpointStatusCalculator struct {
+	endpointStates map[interface{}]*endpointState
+	reported       map[interface{}]string
+	dirtyIDs       set.Set
+	callback       func(msg interface{})
+}
+
+type endpointState struct {
+	ifaceUp       bool
+	policyApplied bool
+	lastErr       error
+}
+
+func (s *endpointState) status() string {
+	if s.lastErr != nil {
+		return StatusError
+	}
+	if !s.policyApplied || !s.ifaceUp {
+		return StatusDown
+	}
+	return StatusUp
+}
+
+// NewEndpointStatusCalculator creates a calculator that passes its status
+// updates and removals to the given callback; typically, the callback sends
+// them to the EndpointStatusReporter.
+func NewEndpointStatusCalculator(callback func(msg interface{})) *EndpointStatusCalculator {
+	return &EndpointStatusCalculator{
+		endpointStates: map[interface{}]*endpointState{},
+		reported:       map[interface{}]string{},
+		dirtyIDs:       set.New(),
+		callback:       callback,
+	}
+}
+
+// OnEndpointUpdate records that the endpoint is active in the dataplane.  Its
+// status is "down" until its policy is programmed and its interface is up.
+func (c *EndpointStatusCalculator) OnEndpointUpdate(id interface{}) {
+	key := endpointKey(id)
+	if _, ok := c.endpointStates[key]; ok {
+		return
+	}
+	c.endpointStates[key] = &endpointState{}
+	c.dirtyIDs.Add(key)
+}
+
+// OnEndpointRemove records that the endpoint has been removed from the
+// dataplane; its status will be deleted on the next Flush().
+func (c *EndpointStatusCalculator) OnEndpointRemove(id interface{}) {
+	key := endpointKey(id)
+	delete(c.endpointStates, key)
+	c.dirtyIDs.Add(key)
+}
+
+// OnIfaceStateUpdate records the oper state of the endpoint's interface.
+func (c *EndpointStatusCalculator) OnIfaceStateUpdate(id interface{}, up bool) {
+	if state := c.stateFor(id); state != nil {
+		state.ifaceUp = up
+	}
+}
+
+// OnPolicyProgrammed records the result of programming the endpoint's
+// policy; err should be nil if programming succeeded.
+func (c *EndpointStatusCalculator) OnPolicyProgrammed(id interface{}, err error) {
+	if state := c.stateFor(id); state != nil {
+		state.policyApplied = err == nil
+		state.lastErr = err
+	}
+}
+
+func (c *EndpointStatusCalculator) stateFor(id interface{}) *endpointState {
+	key := endpointKey(id)
+	state := c.endpointStates[key]
+	if state == nil {
+		log.WithField("id", id).Debug("Ignoring update for unknown endpoint")
+		return nil
+	}
+	c.dirtyIDs.Add(key)
+	return state
+}
+
+// Flush emits a status update (or removal) for each endpoint whose status
+// has changed since the last Flush().
+func (c *EndpointStatusCalculator) Flush() {
+	c.dirtyIDs.Iter(func(item interface{}) error {
+		state := c.endpointStates[item]
+		if state == nil {
+			if _, ok := c.reported[item]; ok {
+				c.callback(removeMsg(item))
+				delete(c.reported, item)
+			}
+			return nil
+		}
+		status := state.status()
+		if c.reported[item] != status {
+			log.WithFields(log.Fields{
+				"id":     item,
+				"status": status,
+			}).Info("Endpoint status changed")
+			c.callback(updateMsg(item, status))
+			c.reported[item] = status
+		}
+		return nil
+	})
+	c.dirtyIDs = set.New()
+}
+
+// endpointKey converts a pointer ID into a value, which is suitable for use
+// as a map key.
+func endpointKey(id interface{}) interface{} {
+	switch id := id.(type) {
+	case *proto.WorkloadEndpointID:
+		return *id
+	case *proto.HostEndpointID:
+		return *id
+	default:
+		log.WithField("id", id).Panic("Unknown endpoint ID type")
+	}
+	return nil
+}
+
+func updateMsg(key interface{}, status string) interface{} {
+	switch key := key.(type) {
+	case proto.WorkloadEndpointID:
+		return &proto.WorkloadEndpointStatusUpdate{
+			Id:     &key,
+			Status: &proto.EndpointStatus{Status: status},
+		}
+	case proto.HostEndpointID:
+		return &proto.HostEndpointStatusUpdate{
+			Id:     &key,
+			Status: &proto.EndpointStatus{Status: status},
+		}
+	}
+	return nil
+}
+
+func removeMsg(key interface{}) interface{} {
+	switch key := key.(type) {
+	case proto.WorkloadEndpointID:
+		return &proto.WorkloadEndpointStatusRemove{Id: &key}
+	case proto.HostEndpointID:
+		return &proto.HostEndpointStatusRemove{Id: &key}
+	}
+	return nil
+}
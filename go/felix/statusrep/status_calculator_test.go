@@ -0,0 +1,139 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statusrep_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/statusrep"
+
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/proto"
+)
+
+var _ = Describe("EndpointStatusCalculator", func() {
+	var calc *EndpointStatusCalculator
+	var msgs []interface{}
+	wlID := &proto.WorkloadEndpointID{
+		OrchestratorId: "orch",
+		WorkloadId:     "wlid",
+		EndpointId:     "epid",
+	}
+	hostID := &proto.HostEndpointID{EndpointId: "epid"}
+
+	wlUpdate := func(status string) interface{} {
+		return &proto.WorkloadEndpointStatusUpdate{
+			Id:     wlID,
+			Status: &proto.EndpointStatus{Status: status},
+		}
+	}
+
+	BeforeEach(func() {
+		msgs = nil
+		calc = NewEndpointStatusCalculator(func(msg interface{}) {
+			msgs = append(msgs, msg)
+		})
+	})
+
+	It("should report nothing before a flush", func() {
+		calc.OnEndpointUpdate(wlID)
+		Expect(msgs).To(BeEmpty())
+	})
+	It("should report a new endpoint as down", func() {
+		calc.OnEndpointUpdate(wlID)
+		calc.Flush()
+		Expect(msgs).To(Equal([]interface{}{wlUpdate("down")}))
+	})
+	It("should ignore updates for unknown endpoints", func() {
+		calc.OnIfaceStateUpdate(wlID, true)
+		calc.OnPolicyProgrammed(wlID, nil)
+		calc.Flush()
+		Expect(msgs).To(BeEmpty())
+	})
+
+	Describe("with an endpoint that has been reported", func() {
+		BeforeEach(func() {
+			calc.OnEndpointUpdate(wlID)
+			calc.Flush()
+			msgs = nil
+		})
+
+		It("should stay down if only the interface is up", func() {
+			calc.OnIfaceStateUpdate(wlID, true)
+			calc.Flush()
+			Expect(msgs).To(BeEmpty())
+		})
+		It("should stay down if only the policy is programmed", func() {
+			calc.OnPolicyProgrammed(wlID, nil)
+			calc.Flush()
+			Expect(msgs).To(BeEmpty())
+		})
+		It("should report up once the interface is up and policy programmed", func() {
+			calc.OnIfaceStateUpdate(wlID, true)
+			calc.OnPolicyProgrammed(wlID, nil)
+			calc.Flush()
+			Expect(msgs).To(Equal([]interface{}{wlUpdate("up")}))
+		})
+		It("should report an error if programming fails", func() {
+			calc.OnIfaceStateUpdate(wlID, true)
+			calc.OnPolicyProgrammed(wlID, errors.New("iptables-restore failed"))
+			calc.Flush()
+			Expect(msgs).To(Equal([]interface{}{wlUpdate("error")}))
+		})
+		It("should coalesce flaps between flushes", func() {
+			calc.OnIfaceStateUpdate(wlID, true)
+			calc.OnIfaceStateUpdate(wlID, false)
+			calc.Flush()
+			Expect(msgs).To(BeEmpty())
+		})
+		It("should not re-report an unchanged endpoint", func() {
+			calc.OnEndpointUpdate(wlID)
+			calc.Flush()
+			Expect(msgs).To(BeEmpty())
+		})
+		It("should report removal", func() {
+			calc.OnEndpointRemove(wlID)
+			calc.Flush()
+			Expect(msgs).To(Equal([]interface{}{
+				&proto.WorkloadEndpointStatusRemove{Id: wlID},
+			}))
+		})
+	})
+
+	It("should handle host endpoints", func() {
+		calc.OnEndpointUpdate(hostID)
+		calc.OnIfaceStateUpdate(hostID, true)
+		calc.OnPolicyProgrammed(hostID, nil)
+		calc.Flush()
+		calc.OnEndpointRemove(hostID)
+		calc.Flush()
+		Expect(msgs).To(Equal([]interface{}{
+			&proto.HostEndpointStatusUpdate{
+				Id:     hostID,
+				Status: &proto.EndpointStatus{Status: "up"},
+			},
+			&proto.HostEndpointStatusRemove{Id: hostID},
+		}))
+	})
+	It("should not report removal of an endpoint that was never reported", func() {
+		calc.OnEndpointUpdate(wlID)
+		calc.OnEndpointRemove(wlID)
+		calc.Flush()
+		Expect(msgs).To(BeEmpty())
+	})
+	It("should panic on an unknown ID type", func() {
+		Expect(func() { calc.OnEndpointUpdate("foo") }).To(Panic())
+	})
+})
@@ -0,0 +1,209 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The supervisor package restarts Felix's optional subsystems, such as the
+// port scan monitor or the flow log readers, when they fail, so that one
+// failing subsystem doesn't take down the rest of Felix.
+//
+// A subsystem is a function that runs until it fails.  The Supervisor runs
+// it in its own goroutine and, when it returns or panics, runs it again
+// after a delay that doubles with each consecutive failure.  A subsystem
+// that ran for StableAfter before failing starts again from InitialDelay.
+// If a subsystem fails MaxRestarts times in a row, the Supervisor gives up
+// on it and calls OnGiveUp, which typically shuts Felix down.
+//
+// If a health aggregator is supplied, the Supervisor reports itself not
+// ready while any subsystem is waiting to be restarted or has been given
+// up on.
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/health"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	healthName = "supervisor"
+
+	defaultInitialDelay = time.Second
+	defaultMaxDelay     = time.Minute
+	defaultStableAfter  = 5 * time.Minute
+)
+
+// ErrStopped is the failure recorded for a subsystem that returned without
+// an error; subsystems are expected to run until Felix exits.
+var ErrStopped = errors.New("subsystem stopped")
+
+type Config struct {
+	// InitialDelay is the delay before the first restart; it doubles with
+	// each further consecutive failure.  Defaults to 1s.
+	InitialDelay time.Duration
+	// MaxDelay caps the delay.  Defaults to 1m.
+	MaxDelay time.Duration
+	// StableAfter is how long a subsystem must run before a failure no
+	// longer counts as consecutive with the one before.  Defaults to 5m.
+	StableAfter time.Duration
+	// MaxRestarts is the number of consecutive restarts after which the
+	// Supervisor gives up on a subsystem.  Zero means never give up.
+	MaxRestarts int
+	// OnGiveUp, if non-nil, is called when the Supervisor gives up on a
+	// subsystem, with the subsystem's last error.
+	OnGiveUp func(name string, err error)
+
+	// NowOverride replaces time.Now, for testing.
+	NowOverride func() time.Time
+	// SleepOverride replaces time.Sleep, for testing.
+	SleepOverride func(d time.Duration)
+}
+
+// Supervisor runs and restarts subsystems.  It is safe for concurrent use.
+type Supervisor struct {
+	config           Config
+	healthAggregator *health.HealthAggregator
+	now              func() time.Time
+	sleep            func(d time.Duration)
+
+	mutex sync.Mutex
+	// down is the set of subsystems that aren't currently running.
+	down map[string]bool
+}
+
+// New creates a Supervisor.  If healthAggregator is non-nil, the Supervisor
+// reports its readiness to it.
+func New(config Config, healthAggregator *health.HealthAggregator) *Supervisor {
+	if config.InitialDelay <= 0 {
+		config.InitialDelay = defaultInitialDelay
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = defaultMaxDelay
+	}
+	if config.StableAfter <= 0 {
+		config.StableAfter = defaultStableAfter
+	}
+	s := &Supervisor{
+		config:           config,
+		healthAggregator: healthAggregator,
+		now:              time.Now,
+		sleep:            time.Sleep,
+		down:             map[string]bool{},
+	}
+	if config.NowOverride != nil {
+		s.now = config.NowOverride
+	}
+	if config.SleepOverride != nil {
+		s.sleep = config.SleepOverride
+	}
+	if healthAggregator != nil {
+		healthAggregator.RegisterReporter(healthName, &health.HealthReport{Ready: true}, 0)
+		s.reportHealthLocked()
+	}
+	return s
+}
+
+// Go runs the named subsystem in a new goroutine, restarting it whenever it
+// fails.
+func (s *Supervisor) Go(name string, run func() error) {
+	go s.Supervise(name, run)
+}
+
+// Supervise runs the named subsystem, restarting it whenever it fails.  It
+// only returns, with the subsystem's last error, if the Supervisor gives up
+// on the subsystem.
+func (s *Supervisor) Supervise(name string, run func() error) error {
+	logCxt := log.WithField("subsystem", name)
+	numFailures := 0
+	for {
+		start := s.now()
+		err := callWithRecover(run)
+		if err == nil {
+			err = ErrStopped
+		}
+		if s.now().Sub(start) >= s.config.StableAfter {
+			numFailures = 0
+		}
+		numFailures++
+		s.setDown(name, true)
+		if s.config.MaxRestarts > 0 && numFailures > s.config.MaxRestarts {
+			logCxt.WithError(err).WithField("numFailures", numFailures).Error(
+				"Subsystem failed too many times, giving up")
+			if s.config.OnGiveUp != nil {
+				s.config.OnGiveUp(name, err)
+			}
+			return err
+		}
+		delay := s.delay(numFailures)
+		logCxt.WithError(err).WithFields(log.Fields{
+			"numFailures": numFailures,
+			"restartIn":   delay,
+		}).Warn("Subsystem failed, restarting it")
+		s.sleep(delay)
+		s.setDown(name, false)
+	}
+}
+
+// delay calculates the delay after the given number of consecutive failures.
+func (s *Supervisor) delay(numFailures int) time.Duration {
+	delay := s.config.InitialDelay
+	for i := 1; i < numFailures && delay < s.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.config.MaxDelay {
+		delay = s.config.MaxDelay
+	}
+	return delay
+}
+
+// Down returns the number of subsystems that aren't currently running.
+func (s *Supervisor) Down() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.down)
+}
+
+func (s *Supervisor) setDown(name string, down bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if down {
+		s.down[name] = true
+	} else {
+		delete(s.down, name)
+	}
+	s.reportHealthLocked()
+}
+
+func (s *Supervisor) reportHealthLocked() {
+	if s.healthAggregator == nil {
+		return
+	}
+	s.healthAggregator.Report(healthName, &health.HealthReport{
+		Live:  true,
+		Ready: len(s.down) == 0,
+	})
+}
+
+func callWithRecover(run func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithField("panic", r).Errorf("Recovered from panic in subsystem:\n%s",
+				debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return run()
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package supervisor_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/supervisor"
+
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/health"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Supervisor", func() {
+	var supervisor *Supervisor
+	var aggregator *health.HealthAggregator
+	var mutex sync.Mutex
+	var gaveUp []string
+	var now time.Time
+	var sleeps []time.Duration
+	// sleeping, if non-nil, receives each delay that the Supervisor sleeps
+	// for and blocks the Supervisor until the test receives it.
+	var sleeping chan time.Duration
+	errFailed := errors.New("failed")
+
+	BeforeEach(func() {
+		gaveUp = nil
+		now = time.Now()
+		sleeps = nil
+		sleeping = nil
+		aggregator = health.NewHealthAggregator()
+		supervisor = New(Config{
+			InitialDelay: 10 * time.Millisecond,
+			MaxDelay:     40 * time.Millisecond,
+			StableAfter:  time.Minute,
+			MaxRestarts:  3,
+			OnGiveUp: func(name string, err error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				gaveUp = append(gaveUp, name)
+			},
+			NowOverride: func() time.Time {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return now
+			},
+			SleepOverride: func(d time.Duration) {
+				mutex.Lock()
+				sleeps = append(sleeps, d)
+				mutex.Unlock()
+				if sleeping != nil {
+					sleeping <- d
+				}
+			},
+		}, aggregator)
+	})
+
+	It("should start ready", func() {
+		Expect(aggregator.Summary().Ready).To(BeTrue())
+		Expect(supervisor.Down()).To(BeZero())
+	})
+	It("should restart a failing subsystem until it gives up", func() {
+		numRuns := 0
+		err := supervisor.Supervise("test", func() error {
+			numRuns++
+			return errFailed
+		})
+		Expect(err).To(Equal(errFailed))
+		Expect(numRuns).To(Equal(4))
+		Expect(gaveUp).To(Equal([]string{"test"}))
+		Expect(aggregator.Summary().Ready).To(BeFalse())
+	})
+	It("should keep a subsystem that recovers running", func() {
+		sleeping = make(chan time.Duration)
+		started := make(chan int)
+		done := make(chan bool)
+		numRuns := 0
+		supervisor.Go("test", func() error {
+			numRuns++
+			started <- numRuns
+			if numRuns < 3 {
+				return errFailed
+			}
+			<-done
+			return nil
+		})
+		for run := 1; run < 3; run++ {
+			Eventually(started).Should(Receive(Equal(run)))
+			Eventually(sleeping).Should(Receive())
+			Expect(supervisor.Down()).To(Equal(1))
+			Expect(aggregator.Summary().Ready).To(BeFalse())
+		}
+		Eventually(started).Should(Receive(Equal(3)))
+		Expect(supervisor.Down()).To(BeZero())
+		Expect(aggregator.Summary()).To(Equal(&health.HealthReport{Live: true, Ready: true}))
+
+		close(done)
+		Eventually(sleeping).Should(Receive())
+		Expect(supervisor.Down()).To(Equal(1))
+	})
+	It("should treat a panic as a failure", func() {
+		numRuns := 0
+		err := supervisor.Supervise("test", func() error {
+			numRuns++
+			panic("oops")
+		})
+		Expect(err).To(MatchError("panic: oops"))
+		Expect(numRuns).To(Equal(4))
+	})
+	It("should treat returning as a failure", func() {
+		err := supervisor.Supervise("test", func() error { return nil })
+		Expect(err).To(Equal(ErrStopped))
+	})
+	It("should back off between restarts", func() {
+		supervisor.Supervise("test", func() error { return errFailed })
+		Expect(sleeps).To(Equal([]time.Duration{
+			10 * time.Millisecond,
+			20 * time.Millisecond,
+			40 * time.Millisecond,
+		}))
+	})
+	It("should reset the back off after a subsystem has been stable", func() {
+		numRuns := 0
+		supervisor.Supervise("test", func() error {
+			numRuns++
+			if numRuns == 3 {
+				mutex.Lock()
+				now = now.Add(time.Minute)
+				mutex.Unlock()
+			}
+			return errFailed
+		})
+		Expect(numRuns).To(Equal(6))
+		Expect(sleeps).To(Equal([]time.Duration{
+			10 * time.Millisecond,
+			20 * time.Millisecond,
+			10 * time.Millisecond,
+			20 * time.Millisecond,
+			40 * time.Millisecond,
+		}))
+	})
+})
@@ -0,0 +1,393 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The syncclient package contains the client side of the sync proxy
+// protocol (see the syncproto package).  The SyncerClient implements the
+// libcalico-go Syncer API so that it can stand in for the datastore's own
+// Syncer.
+package syncclient
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/syncproto"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"golang.org/x/net/context"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+var errStopped = errors.New("client stopped")
+
+type Options struct {
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// MinReconnectDelay and MaxReconnectDelay bound the time for which we
+	// avoid a server after a connection to it fails.  The delay doubles
+	// with each consecutive failure and is jittered.
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+}
+
+func (o *Options) withDefaults() *Options {
+	opts := Options{}
+	if o != nil {
+		opts = *o
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 10 * time.Second
+	}
+	if opts.ReadTimeout == 0 {
+		// Comfortably longer than the server's ping interval.
+		opts.ReadTimeout = 30 * time.Second
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = 10 * time.Second
+	}
+	if opts.MinReconnectDelay == 0 {
+		opts.MinReconnectDelay = time.Second
+	}
+	if opts.MaxReconnectDelay == 0 {
+		opts.MaxReconnectDelay = 30 * time.Second
+	}
+	return &opts
+}
+
+// SyncerClient receives datastore updates from one of a list of sync proxy
+// servers and passes them to its callbacks.
+//
+// Each client prefers the servers in an order that is determined by hashing
+// its hostname with the servers' addresses (rendezvous hashing), so that
+// the clients spread evenly over the servers and each client keeps going
+// back to the same server.  If a server sheds the connection, or the
+// connection fails, the client moves on to its next server, and so the
+// load of a failed server is spread evenly too.
+//
+// After reconnecting, the new server sends a complete snapshot; the client
+// sends deletions for any keys that it reported before but that aren't in
+// the snapshot.
+type SyncerClient struct {
+	addrs     []string
+	hostname  string
+	version   string
+	info      string
+	callbacks api.SyncerCallbacks
+	options   *Options
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// knownKeys contains the keys that we've reported and not deleted.
+	knownKeys map[string]bool
+	// backoffUntil maps from server address to the time before which we
+	// won't reconnect to it.
+	backoffUntil map[string]time.Time
+	// consecutiveFailures counts the failed connection attempts since we
+	// last got in sync.
+	consecutiveFailures uint
+}
+
+func New(
+	addrs []string,
+	hostname, version, info string,
+	callbacks api.SyncerCallbacks,
+	options *Options,
+) *SyncerClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &SyncerClient{
+		addrs:        PreferenceOrder(hostname, addrs),
+		hostname:     hostname,
+		version:      version,
+		info:         info,
+		callbacks:    callbacks,
+		options:      options.withDefaults(),
+		ctx:          ctx,
+		cancel:       cancel,
+		knownKeys:    map[string]bool{},
+		backoffUntil: map[string]time.Time{},
+	}
+}
+
+// PreferenceOrder returns the addresses in the order that the client with
+// the given hostname should try them.
+func PreferenceOrder(hostname string, addrs []string) []string {
+	weights := map[string]uint64{}
+	for _, addr := range addrs {
+		h := fnv.New64a()
+		h.Write([]byte(hostname + "/" + addr))
+		weights[addr] = h.Sum64()
+	}
+	ordered := append([]string(nil), addrs...)
+	sort.Sort(byWeight{ordered, weights})
+	return ordered
+}
+
+type byWeight struct {
+	addrs   []string
+	weights map[string]uint64
+}
+
+func (b byWeight) Len() int           { return len(b.addrs) }
+func (b byWeight) Swap(i, j int)      { b.addrs[i], b.addrs[j] = b.addrs[j], b.addrs[i] }
+func (b byWeight) Less(i, j int) bool { return b.weights[b.addrs[i]] > b.weights[b.addrs[j]] }
+
+func (s *SyncerClient) Start() {
+	go s.loop()
+}
+
+// Stop closes the connection and stops the background thread.  It is only
+// used by the tests.
+func (s *SyncerClient) Stop() {
+	s.cancel()
+}
+
+func (s *SyncerClient) loop() {
+	s.callbacks.OnStatusUpdated(api.WaitForDatastore)
+	for s.ctx.Err() == nil {
+		addr, wait := s.nextAddr(time.Now())
+		if addr == "" {
+			log.WithField("wait", wait).Info(
+				"All sync servers are backing off, waiting")
+			s.sleep(wait)
+			continue
+		}
+		logCxt := log.WithField("address", addr)
+		logCxt.Info("Connecting to sync server")
+		retryAfter, err := s.connectAndSync(addr)
+		if err == errStopped {
+			return
+		}
+		if retryAfter == 0 {
+			retryAfter = s.reconnectDelay()
+		}
+		logCxt.WithError(err).WithField("retryAfter", retryAfter).Warn(
+			"Connection to sync server ended")
+		s.backoffUntil[addr] = time.Now().Add(retryAfter)
+	}
+}
+
+// nextAddr returns the most preferred server that isn't backing off or, if
+// they all are, the time until the first one stops backing off.
+func (s *SyncerClient) nextAddr(now time.Time) (string, time.Duration) {
+	var wait time.Duration
+	for i, addr := range s.addrs {
+		remaining := s.backoffUntil[addr].Sub(now)
+		if remaining <= 0 {
+			return addr, 0
+		}
+		if i == 0 || remaining < wait {
+			wait = remaining
+		}
+	}
+	return "", wait
+}
+
+// reconnectDelay returns the jittered, exponentially-increasing time to
+// avoid a server for after a failure.
+func (s *SyncerClient) reconnectDelay() time.Duration {
+	delay := s.options.MinReconnectDelay
+	for i := uint(0); i < s.consecutiveFailures && delay < s.options.MaxReconnectDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.options.MaxReconnectDelay {
+		delay = s.options.MaxReconnectDelay
+	}
+	s.consecutiveFailures++
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// connectAndSync connects to the server and processes its messages until
+// the connection fails.  If the server sheds the connection, returns the
+// time after which it asked us to retry.
+func (s *SyncerClient) connectAndSync(addr string) (time.Duration, error) {
+	conn, err := net.DialTimeout("tcp", addr, s.options.DialTimeout)
+	if err != nil {
+		return 0, err
+	}
+	connDone := make(chan struct{})
+	defer close(connDone)
+	go func() {
+		// Unblock the reads if we're stopped.
+		select {
+		case <-s.ctx.Done():
+		case <-connDone:
+		}
+		conn.Close()
+	}()
+
+	c := &connection{
+		conn:    conn,
+		encoder: gob.NewEncoder(conn),
+		decoder: gob.NewDecoder(conn),
+		options: s.options,
+	}
+	err = c.send(syncproto.MsgClientHello{
+		Hostname: s.hostname,
+		Version:  s.version,
+		Info:     s.info,
+	})
+	if err != nil {
+		return 0, s.checkStopped(err)
+	}
+	msg, err := c.receive()
+	if err != nil {
+		return 0, s.checkStopped(err)
+	}
+	hello, ok := msg.(syncproto.MsgServerHello)
+	if !ok {
+		return 0, fmt.Errorf("unexpected message from server: %#v", msg)
+	}
+	log.WithFields(log.Fields{
+		"address": addr,
+		"version": hello.Version,
+	}).Info("Connected to sync server")
+
+	// keysInSnapshot records the keys that the server sends until it's in
+	// sync; any other keys that we know about were deleted while we were
+	// disconnected.
+	keysInSnapshot := map[string]bool{}
+	for {
+		msg, err := c.receive()
+		if err != nil {
+			return 0, s.checkStopped(err)
+		}
+		switch msg := msg.(type) {
+		case syncproto.MsgSyncStatus:
+			if msg.SyncStatus == api.InSync && keysInSnapshot != nil {
+				s.deleteStaleKeys(keysInSnapshot)
+				keysInSnapshot = nil
+				s.consecutiveFailures = 0
+			}
+			s.callbacks.OnStatusUpdated(msg.SyncStatus)
+		case syncproto.MsgKVs:
+			s.handleKVs(msg.KVs, keysInSnapshot)
+		case syncproto.MsgPing:
+			err := c.send(syncproto.MsgPong{PingTimestamp: msg.Timestamp})
+			if err != nil {
+				return 0, s.checkStopped(err)
+			}
+		case syncproto.MsgDisconnect:
+			log.WithFields(log.Fields{
+				"address":    addr,
+				"reason":     msg.Reason,
+				"retryAfter": msg.RetryAfter,
+			}).Info("Sync server asked us to connect elsewhere")
+			return msg.RetryAfter, errors.New("disconnected by server: " + msg.Reason)
+		default:
+			log.WithField("msg", msg).Warn("Ignoring unknown message from sync server")
+		}
+	}
+}
+
+func (s *SyncerClient) handleKVs(kvs []syncproto.SerializedUpdate, keysInSnapshot map[string]bool) {
+	var updates []api.Update
+	for _, kv := range kvs {
+		update, err := kv.ToUpdate()
+		if err == syncproto.ErrUnknownKey {
+			log.WithField("key", kv.Key).Debug("Ignoring unknown key")
+			continue
+		} else if err != nil {
+			log.WithError(err).WithField("key", kv.Key).Warn(
+				"Failed to parse value, treating as deletion")
+		}
+		if keysInSnapshot != nil {
+			keysInSnapshot[kv.Key] = true
+		}
+		// The server's update types are relative to what it has sent on
+		// this connection; correct them for what we've reported.
+		if update.Value == nil {
+			if !s.knownKeys[kv.Key] {
+				continue
+			}
+			delete(s.knownKeys, kv.Key)
+			update.UpdateType = api.UpdateTypeKVDeleted
+		} else if s.knownKeys[kv.Key] {
+			update.UpdateType = api.UpdateTypeKVUpdated
+		} else {
+			s.knownKeys[kv.Key] = true
+			update.UpdateType = api.UpdateTypeKVNew
+		}
+		updates = append(updates, update)
+	}
+	if len(updates) > 0 {
+		s.callbacks.OnUpdates(updates)
+	}
+}
+
+// deleteStaleKeys sends deletions for the keys that we know about but that
+// weren't in the server's snapshot.
+func (s *SyncerClient) deleteStaleKeys(keysInSnapshot map[string]bool) {
+	var staleKeys []syncproto.SerializedUpdate
+	for key := range s.knownKeys {
+		if !keysInSnapshot[key] {
+			staleKeys = append(staleKeys, syncproto.SerializedUpdate{Key: key})
+		}
+	}
+	if len(staleKeys) == 0 {
+		return
+	}
+	log.WithField("numKeys", len(staleKeys)).Info(
+		"Deleting keys that were removed while we were disconnected")
+	sort.Sort(byKey(staleKeys))
+	s.handleKVs(staleKeys, nil)
+}
+
+type byKey []syncproto.SerializedUpdate
+
+func (b byKey) Len() int           { return len(b) }
+func (b byKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byKey) Less(i, j int) bool { return b[i].Key < b[j].Key }
+
+func (s *SyncerClient) checkStopped(err error) error {
+	if s.ctx.Err() != nil {
+		return errStopped
+	}
+	return err
+}
+
+func (s *SyncerClient) sleep(d time.Duration) {
+	select {
+	case <-s.ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// connection wraps a connection to a server with the message encoding and
+// timeouts.
+type connection struct {
+	conn    net.Conn
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+	options *Options
+}
+
+func (c *connection) send(msg interface{}) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout))
+	return c.encoder.Encode(&syncproto.Envelope{Message: msg})
+}
+
+func (c *connection) receive() (interface{}, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.options.ReadTimeout))
+	var envelope syncproto.Envelope
+	if err := c.decoder.Decode(&envelope); err != nil {
+		return nil, err
+	}
+	return envelope.Message, nil
+}
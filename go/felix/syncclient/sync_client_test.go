@@ -0,0 +1,282 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncclient_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/syncclient"
+
+	"encoding/gob"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/syncproto"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"net"
+	"sync"
+	"time"
+)
+
+var _ = Describe("PreferenceOrder", func() {
+	addrs := []string{"10.0.0.1:5473", "10.0.0.2:5473", "10.0.0.3:5473", "10.0.0.4:5473"}
+
+	It("should be a stable permutation of the addresses", func() {
+		order := PreferenceOrder("host1", addrs)
+		Expect(order).To(ConsistOf(addrs))
+		Expect(PreferenceOrder("host1", []string{addrs[3], addrs[1], addrs[2], addrs[0]})).To(Equal(order))
+	})
+	It("should spread hosts over the servers", func() {
+		firstChoices := map[string]int{}
+		for i := 0; i < 1000; i++ {
+			firstChoices[PreferenceOrder(fmt.Sprintf("host%d", i), addrs)[0]]++
+		}
+		Expect(firstChoices).To(HaveLen(4))
+		for _, count := range firstChoices {
+			Expect(count).To(BeNumerically(">", 150))
+		}
+	})
+})
+
+var _ = Describe("SyncerClient", func() {
+	var (
+		servers   map[string]*mockServer
+		order     []string
+		callbacks *mockCallbacks
+		client    *SyncerClient
+	)
+
+	configUpdate := func(name, value string, updateType api.UpdateType) api.Update {
+		return api.Update{
+			KVPair:     model.KVPair{Key: model.GlobalConfigKey{Name: name}, Value: value},
+			UpdateType: updateType,
+		}
+	}
+	configKV := func(name, value string) syncproto.SerializedUpdate {
+		return syncproto.SerializedUpdate{
+			Key:        "/calico/v1/config/" + name,
+			Value:      []byte(value),
+			UpdateType: api.UpdateTypeKVNew,
+		}
+	}
+	sendSnapshot := func(conn *serverConn, kvs ...syncproto.SerializedUpdate) {
+		conn.send(syncproto.MsgSyncStatus{SyncStatus: api.ResyncInProgress})
+		conn.send(syncproto.MsgKVs{KVs: kvs})
+		conn.send(syncproto.MsgSyncStatus{SyncStatus: api.InSync})
+	}
+
+	BeforeEach(func() {
+		servers = map[string]*mockServer{}
+		var addrs []string
+		for i := 0; i < 2; i++ {
+			server := newMockServer()
+			servers[server.addr] = server
+			addrs = append(addrs, server.addr)
+		}
+		order = PreferenceOrder("host1", addrs)
+		callbacks = &mockCallbacks{}
+		client = New(addrs, "host1", "v2.0.0", "felix", callbacks, &Options{
+			ReadTimeout:       time.Second,
+			MinReconnectDelay: 10 * time.Second,
+		})
+		client.Start()
+	})
+	AfterEach(func() {
+		client.Stop()
+		for _, server := range servers {
+			server.close()
+		}
+	})
+
+	Describe("connected to the preferred server", func() {
+		var conn *serverConn
+		BeforeEach(func() {
+			Eventually(servers[order[0]].conns).Should(Receive(&conn))
+			sendSnapshot(conn, configKV("A", "a1"), configKV("B", "b1"))
+			Eventually(callbacks.getStatuses).Should(Equal([]api.SyncStatus{
+				api.WaitForDatastore, api.ResyncInProgress, api.InSync,
+			}))
+		})
+
+		It("should send its hello", func() {
+			Expect(conn.hello).To(Equal(syncproto.MsgClientHello{
+				Hostname: "host1",
+				Version:  "v2.0.0",
+				Info:     "felix",
+			}))
+		})
+		It("should pass on the snapshot and updates", func() {
+			conn.send(syncproto.MsgKVs{KVs: []syncproto.SerializedUpdate{
+				configKV("A", "a2"),
+				{Key: "/calico/v1/config/B", UpdateType: api.UpdateTypeKVDeleted},
+			}})
+			Eventually(callbacks.getUpdates).Should(Equal([]api.Update{
+				configUpdate("A", "a1", api.UpdateTypeKVNew),
+				configUpdate("B", "b1", api.UpdateTypeKVNew),
+				configUpdate("A", "a2", api.UpdateTypeKVUpdated),
+				{
+					KVPair:     model.KVPair{Key: model.GlobalConfigKey{Name: "B"}},
+					UpdateType: api.UpdateTypeKVDeleted,
+				},
+			}))
+		})
+		It("should answer pings", func() {
+			ts := time.Unix(1234, 0).UTC()
+			conn.send(syncproto.MsgPing{Timestamp: ts})
+			Expect(conn.receive()).To(Equal(syncproto.MsgPong{PingTimestamp: ts}))
+		})
+
+		Describe("after the server sheds the connection", func() {
+			var conn2 *serverConn
+			BeforeEach(func() {
+				conn.send(syncproto.MsgDisconnect{Reason: "overloaded", RetryAfter: time.Minute})
+				Eventually(servers[order[1]].conns).Should(Receive(&conn2))
+				callbacks.reset()
+			})
+
+			It("should reconcile with the new server's snapshot", func() {
+				sendSnapshot(conn2, configKV("B", "b1"), configKV("C", "c1"))
+				Eventually(callbacks.getStatuses).Should(Equal([]api.SyncStatus{
+					api.ResyncInProgress, api.InSync,
+				}))
+				Expect(callbacks.getUpdates()).To(Equal([]api.Update{
+					configUpdate("B", "b1", api.UpdateTypeKVUpdated),
+					configUpdate("C", "c1", api.UpdateTypeKVNew),
+					{
+						KVPair:     model.KVPair{Key: model.GlobalConfigKey{Name: "A"}},
+						UpdateType: api.UpdateTypeKVDeleted,
+					},
+				}))
+			})
+			It("should not go back to the first server before its retry time", func() {
+				conn2.close()
+				Consistently(servers[order[0]].conns, "200ms").ShouldNot(Receive())
+			})
+		})
+	})
+
+	It("should fail over if the server goes silent", func() {
+		var conn *serverConn
+		Eventually(servers[order[0]].conns).Should(Receive(&conn))
+		Eventually(servers[order[1]].conns, "3s").Should(Receive())
+	})
+})
+
+// mockServer accepts connections, does the handshake and then passes them
+// to the test.
+type mockServer struct {
+	listener net.Listener
+	addr     string
+	conns    chan *serverConn
+}
+
+func newMockServer() *mockServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	s := &mockServer{
+		listener: listener,
+		addr:     listener.Addr().String(),
+		conns:    make(chan *serverConn, 10),
+	}
+	go s.accept()
+	return s
+}
+
+func (s *mockServer) accept() {
+	defer GinkgoRecover()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &serverConn{
+			conn:    conn,
+			encoder: gob.NewEncoder(conn),
+			decoder: gob.NewDecoder(conn),
+		}
+		c.hello = c.receive().(syncproto.MsgClientHello)
+		c.send(syncproto.MsgServerHello{Version: "test"})
+		s.conns <- c
+	}
+}
+
+func (s *mockServer) close() {
+	s.listener.Close()
+	for {
+		select {
+		case c := <-s.conns:
+			c.close()
+		default:
+			return
+		}
+	}
+}
+
+type serverConn struct {
+	conn    net.Conn
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+	hello   syncproto.MsgClientHello
+}
+
+func (c *serverConn) send(msg interface{}) {
+	Expect(c.encoder.Encode(&syncproto.Envelope{Message: msg})).To(Succeed())
+}
+
+func (c *serverConn) receive() interface{} {
+	var envelope syncproto.Envelope
+	Expect(c.decoder.Decode(&envelope)).To(Succeed())
+	return envelope.Message
+}
+
+func (c *serverConn) close() {
+	c.conn.Close()
+}
+
+type mockCallbacks struct {
+	mutex    sync.Mutex
+	statuses []api.SyncStatus
+	updates  []api.Update
+}
+
+func (c *mockCallbacks) OnStatusUpdated(status api.SyncStatus) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.statuses = append(c.statuses, status)
+}
+
+func (c *mockCallbacks) OnUpdates(updates []api.Update) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.updates = append(c.updates, updates...)
+}
+
+func (c *mockCallbacks) getStatuses() []api.SyncStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]api.SyncStatus(nil), c.statuses...)
+}
+
+func (c *mockCallbacks) getUpdates() []api.Update {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]api.Update(nil), c.updates...)
+}
+
+func (c *mockCallbacks) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.statuses = nil
+	c.updates = nil
+}
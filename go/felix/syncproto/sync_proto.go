@@ -0,0 +1,155 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The syncproto package defines the protocol between Felix and a sync proxy,
+// which watches the datastore on behalf of many Felix instances and fans
+// out the updates to them.  This lets a large cluster scale without each
+// node loading the datastore.
+//
+// The protocol runs over TCP.  Each message is a gob-encoded Envelope:
+//
+//   - the client sends MsgClientHello and the server replies with
+//     MsgServerHello
+//   - the server then sends the current snapshot as MsgKVs, bracketed by
+//     MsgSyncStatus messages, just like a libcalico-go Syncer, followed by
+//     MsgKVs as the datastore changes
+//   - the server sends MsgPing periodically and the client replies with
+//     MsgPong; either side may treat silence as a failed connection
+//   - a server that is overloaded may send MsgDisconnect before closing
+//     the connection, asking the client to connect elsewhere.
+package syncproto
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"time"
+)
+
+const DefaultPort = 5473
+
+var ErrUnknownKey = errors.New("unknown key")
+
+type Envelope struct {
+	Message interface{}
+}
+
+type MsgClientHello struct {
+	Hostname string
+	Info     string
+	Version  string
+}
+
+type MsgServerHello struct {
+	Version string
+}
+
+type MsgSyncStatus struct {
+	SyncStatus api.SyncStatus
+}
+
+type MsgPing struct {
+	Timestamp time.Time
+}
+
+type MsgPong struct {
+	PingTimestamp time.Time
+}
+
+type MsgKVs struct {
+	KVs []SerializedUpdate
+}
+
+// MsgDisconnect is sent by a server that is shedding load, just before it
+// closes the connection.  The client should connect to another server and
+// not come back to this one until RetryAfter has passed.
+type MsgDisconnect struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func init() {
+	gob.Register(MsgClientHello{})
+	gob.Register(MsgServerHello{})
+	gob.Register(MsgSyncStatus{})
+	gob.Register(MsgPing{})
+	gob.Register(MsgPong{})
+	gob.Register(MsgKVs{})
+	gob.Register(MsgDisconnect{})
+}
+
+// SerializedUpdate is an api.Update in the datastore's own encoding: the
+// key's default path and the serialized value, which is nil for a
+// deletion.
+type SerializedUpdate struct {
+	Key        string
+	Value      []byte
+	Revision   string
+	TTL        time.Duration
+	UpdateType api.UpdateType
+}
+
+func SerializeUpdate(u api.Update) (SerializedUpdate, error) {
+	path, err := model.KeyToDefaultPath(u.Key)
+	if err != nil {
+		return SerializedUpdate{}, err
+	}
+	serialized := SerializedUpdate{
+		Key:        path,
+		TTL:        u.TTL,
+		UpdateType: u.UpdateType,
+	}
+	if u.Revision != nil {
+		serialized.Revision = fmt.Sprint(u.Revision)
+	}
+	if u.Value != nil {
+		serialized.Value, err = model.SerializeValue(&u.KVPair)
+		if err != nil {
+			return SerializedUpdate{}, err
+		}
+	}
+	return serialized, nil
+}
+
+// ToUpdate parses the update.  Values that fail to parse are returned as
+// deletions, along with the error, to match the behaviour of the datastore
+// syncers.
+func (s SerializedUpdate) ToUpdate() (api.Update, error) {
+	key := model.KeyFromDefaultPath(s.Key)
+	if key == nil {
+		return api.Update{}, ErrUnknownKey
+	}
+	update := api.Update{
+		KVPair: model.KVPair{
+			Key: key,
+			TTL: s.TTL,
+		},
+		UpdateType: s.UpdateType,
+	}
+	if s.Revision != "" {
+		update.Revision = s.Revision
+	}
+	if s.Value == nil {
+		return update, nil
+	}
+	value, err := model.ParseValue(key, s.Value)
+	if err != nil {
+		update.UpdateType = api.UpdateTypeKVDeleted
+		return update, err
+	}
+	update.Value = value
+	return update, nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncproto_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/syncproto"
+
+	"bytes"
+	"encoding/gob"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"time"
+)
+
+var _ = Describe("SerializedUpdate", func() {
+	configKey := model.GlobalConfigKey{Name: "LogSeverityScreen"}
+
+	It("should round-trip an update", func() {
+		update := api.Update{
+			KVPair:     model.KVPair{Key: configKey, Value: "DEBUG", Revision: 1234},
+			UpdateType: api.UpdateTypeKVNew,
+		}
+		serialized, err := SerializeUpdate(update)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(serialized).To(Equal(SerializedUpdate{
+			Key:        "/calico/v1/config/LogSeverityScreen",
+			Value:      []byte("DEBUG"),
+			Revision:   "1234",
+			UpdateType: api.UpdateTypeKVNew,
+		}))
+		Expect(serialized.ToUpdate()).To(Equal(api.Update{
+			KVPair:     model.KVPair{Key: configKey, Value: "DEBUG", Revision: "1234"},
+			UpdateType: api.UpdateTypeKVNew,
+		}))
+	})
+	It("should round-trip a deletion", func() {
+		update := api.Update{
+			KVPair:     model.KVPair{Key: configKey},
+			UpdateType: api.UpdateTypeKVDeleted,
+		}
+		serialized, err := SerializeUpdate(update)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(serialized.Value).To(BeNil())
+		Expect(serialized.ToUpdate()).To(Equal(update))
+	})
+	It("should reject an unknown key", func() {
+		_, err := SerializedUpdate{Key: "/calico/v1/unknown"}.ToUpdate()
+		Expect(err).To(Equal(ErrUnknownKey))
+	})
+	It("should return a bad value as a deletion", func() {
+		update, err := SerializedUpdate{
+			Key:        "/calico/v1/policy/profile/prof1/rules",
+			Value:      []byte("{bad json"),
+			UpdateType: api.UpdateTypeKVNew,
+		}.ToUpdate()
+		Expect(err).To(HaveOccurred())
+		Expect(update).To(Equal(api.Update{
+			KVPair: model.KVPair{
+				Key: model.ProfileRulesKey{ProfileKey: model.ProfileKey{Name: "prof1"}},
+			},
+			UpdateType: api.UpdateTypeKVDeleted,
+		}))
+	})
+})
+
+var _ = Describe("Envelope", func() {
+	It("should gob-encode all the messages", func() {
+		msgs := []interface{}{
+			MsgClientHello{Hostname: "host1", Info: "felix", Version: "v2.0.0"},
+			MsgServerHello{Version: "v0.1.0"},
+			MsgSyncStatus{SyncStatus: api.InSync},
+			MsgPing{Timestamp: time.Unix(1234, 0).UTC()},
+			MsgPong{PingTimestamp: time.Unix(1234, 0).UTC()},
+			MsgKVs{KVs: []SerializedUpdate{{Key: "/calico/v1/Ready", Value: []byte("true")}}},
+			MsgDisconnect{Reason: "overloaded", RetryAfter: time.Minute},
+		}
+		var buf bytes.Buffer
+		encoder := gob.NewEncoder(&buf)
+		for _, msg := range msgs {
+			Expect(encoder.Encode(&Envelope{Message: msg})).To(Succeed())
+		}
+		decoder := gob.NewDecoder(&buf)
+		for _, msg := range msgs {
+			var envelope Envelope
+			Expect(decoder.Decode(&envelope)).To(Succeed())
+			Expect(envelope.Message).To(Equal(msg))
+		}
+	})
+})
@@ -0,0 +1,269 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The threatfeed package keeps the deny IP sets that rules.ThreatFeedChain
+// matches on up to date with external lists of malicious IPs and CIDRs.
+// Each feed is fetched periodically from its Source and its entries
+// replace the contents of the feed's IP sets, one per IP version.
+//
+// If a fetch fails, the IP sets keep their previous contents; a feed that
+// keeps failing makes Felix report itself as not ready.
+package threatfeed
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/cmderrors"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"github.com/projectcalico/felix/go/felix/health"
+	"github.com/projectcalico/felix/go/felix/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	refreshFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_threat_feed_refresh_failures",
+		Help: "Number of threat feed refreshes that failed.",
+	})
+	entriesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_threat_feed_entries_dropped",
+		Help: "Number of threat feed entries that were dropped because the feed exceeded its maximum size.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(refreshFailures)
+	prometheus.MustRegister(entriesDropped)
+}
+
+const (
+	healthName = "threat_feeds"
+	// unreadyAfterFailures is the number of consecutive failed refreshes
+	// of a feed after which we report ourselves as not ready.
+	unreadyAfterFailures = 3
+)
+
+// Feed is a named source of IPs and CIDRs to deny.
+type Feed struct {
+	Name   string
+	Source Source
+}
+
+// Config holds the tunable parameters of the Client.
+type Config struct {
+	Feeds []Feed
+	// IPVersions are the IP versions whose IP sets are maintained.
+	IPVersions []uint8
+	// RefreshInterval is how often the feeds are fetched.
+	RefreshInterval time.Duration
+	// MaxEntries bounds the size of each IP set.  Entries beyond the limit
+	// are dropped, in feed order.
+	MaxEntries int
+}
+
+// FeedStatus reports the outcome of a feed's recent refreshes.
+type FeedStatus struct {
+	LastSuccess         time.Time
+	ConsecutiveFailures int
+	NumEntries          int
+}
+
+type Client struct {
+	newCmd           cmdshim.NewCmd
+	config           Config
+	healthAggregator *health.HealthAggregator
+
+	status map[string]*FeedStatus
+}
+
+// New creates a Client.  healthAggregator may be nil, if health reporting
+// is disabled.
+func New(config Config, healthAggregator *health.HealthAggregator) *Client {
+	return NewWithCmdShim(config, healthAggregator, cmdshim.NewRealCmd)
+}
+
+// NewWithCmdShim is a test constructor that allows for shimming exec.Command.
+func NewWithCmdShim(config Config, healthAggregator *health.HealthAggregator, shim cmdshim.NewCmd) *Client {
+	status := map[string]*FeedStatus{}
+	for _, feed := range config.Feeds {
+		status[feed.Name] = &FeedStatus{}
+	}
+	c := &Client{
+		newCmd:           shim,
+		config:           config,
+		healthAggregator: healthAggregator,
+		status:           status,
+	}
+	if healthAggregator != nil {
+		healthAggregator.RegisterReporter(healthName, &health.HealthReport{Ready: true}, 0)
+		c.reportHealth()
+	}
+	return c
+}
+
+// Run refreshes the feeds now and then every RefreshInterval.  It never
+// returns.
+func (c *Client) Run() {
+	ticker := time.NewTicker(c.config.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		c.Refresh()
+		<-ticker.C
+	}
+}
+
+// Refresh fetches each feed and updates its IP sets.
+func (c *Client) Refresh() {
+	for _, feed := range c.config.Feeds {
+		logCxt := log.WithField("feed", feed.Name)
+		status := c.status[feed.Name]
+		numEntries, err := c.refreshFeed(feed)
+		if err != nil {
+			logCxt.WithError(err).Warn("Failed to refresh threat feed")
+			refreshFailures.Inc()
+			status.ConsecutiveFailures++
+			continue
+		}
+		logCxt.WithField("numEntries", numEntries).Debug("Refreshed threat feed")
+		status.LastSuccess = time.Now()
+		status.ConsecutiveFailures = 0
+		status.NumEntries = numEntries
+	}
+	c.reportHealth()
+}
+
+// Status returns the status of the named feed, or nil if there's no such
+// feed.
+func (c *Client) Status(name string) *FeedStatus {
+	return c.status[name]
+}
+
+func (c *Client) refreshFeed(feed Feed) (int, error) {
+	reader, err := feed.Source.Fetch()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	entries, err := parseEntries(reader)
+	if err != nil {
+		return 0, err
+	}
+	numEntries := 0
+	for _, ipVersion := range c.config.IPVersions {
+		members := entries[ipVersion]
+		if len(members) > c.config.MaxEntries {
+			log.WithFields(log.Fields{
+				"feed":       feed.Name,
+				"ipVersion":  ipVersion,
+				"numEntries": len(members),
+				"maxEntries": c.config.MaxEntries,
+			}).Warn("Threat feed too large, dropping excess entries")
+			entriesDropped.Add(float64(len(members) - c.config.MaxEntries))
+			members = members[:c.config.MaxEntries]
+		}
+		if err := c.replaceIPSet(rules.ThreatFeedIPSetName(feed.Name, ipVersion), ipVersion, members); err != nil {
+			return 0, err
+		}
+		numEntries += len(members)
+	}
+	return numEntries, nil
+}
+
+// replaceIPSet atomically replaces the contents of the named IP set, by
+// filling a temporary IP set and swapping it in.
+func (c *Client) replaceIPSet(name string, ipVersion uint8, members []string) error {
+	family := "inet"
+	if ipVersion == 6 {
+		family = "inet6"
+	}
+	tmpName := name + "-tmp"
+	var buf bytes.Buffer
+	for _, setName := range []string{name, tmpName} {
+		fmt.Fprintf(&buf, "create %s hash:net family %s maxelem %d -exist\n",
+			setName, family, c.config.MaxEntries)
+	}
+	fmt.Fprintf(&buf, "flush %s\n", tmpName)
+	for _, member := range members {
+		fmt.Fprintf(&buf, "add %s %s\n", tmpName, member)
+	}
+	fmt.Fprintf(&buf, "swap %s %s\n", tmpName, name)
+	fmt.Fprintf(&buf, "destroy %s\n", tmpName)
+
+	cmd := c.newCmd("ipset", "restore")
+	cmd.SetStdin(&buf)
+	output, err := cmd.CombinedOutput()
+	if err := cmderrors.Record("ipset", name, output, err); err != nil {
+		log.WithFields(log.Fields{
+			"name":   name,
+			"output": string(output),
+		}).WithError(err).Warn("Failed to update threat feed IP set")
+		return err
+	}
+	return nil
+}
+
+func (c *Client) reportHealth() {
+	if c.healthAggregator == nil {
+		return
+	}
+	ready := true
+	for _, status := range c.status {
+		if status.ConsecutiveFailures >= unreadyAfterFailures {
+			ready = false
+			break
+		}
+	}
+	c.healthAggregator.Report(healthName, &health.HealthReport{Live: true, Ready: ready})
+}
+
+// parseEntries parses the feed, returning its entries as CIDRs, grouped by
+// IP version.  Invalid entries are logged and skipped.
+func parseEntries(reader io.Reader) (map[uint8][]string, error) {
+	entries := map[uint8][]string{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			if strings.Contains(line, ":") {
+				line += "/128"
+			} else {
+				line += "/32"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(line)
+		if err != nil {
+			log.WithField("entry", line).Warn("Ignoring invalid threat feed entry")
+			continue
+		}
+		ipVersion := uint8(6)
+		if cidr.IP.To4() != nil {
+			ipVersion = 4
+		}
+		entries[ipVersion] = append(entries[ipVersion], cidr.String())
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threatfeed_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/threatfeed"
+
+	"errors"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/health"
+)
+
+var _ = Describe("Client", func() {
+	var client *Client
+	var source *fakeSource
+	var cmdRec *cmdshim.Recorder
+	var aggregator *health.HealthAggregator
+
+	BeforeEach(func() {
+		source = &fakeSource{feed: "10.0.0.1\n# A comment\n\n10.1.0.0/16 # inline comment\nfd00::1\nbogus\n"}
+		cmdRec = &cmdshim.Recorder{}
+		aggregator = health.NewHealthAggregator()
+		client = NewWithCmdShim(Config{
+			Feeds:           []Feed{{Name: "bad", Source: source}},
+			IPVersions:      []uint8{4, 6},
+			RefreshInterval: time.Minute,
+			MaxEntries:      10,
+		}, aggregator, cmdRec.NewCmd)
+	})
+
+	It("should replace the IP sets with the feed's entries", func() {
+		client.Refresh()
+		Expect(cmdRec.Commands()).To(Equal([]string{"ipset restore", "ipset restore"}))
+		Expect(cmdRec.Stdins()).To(Equal([]string{
+			"create cali4-tf-bad hash:net family inet maxelem 10 -exist\n" +
+				"create cali4-tf-bad-tmp hash:net family inet maxelem 10 -exist\n" +
+				"flush cali4-tf-bad-tmp\n" +
+				"add cali4-tf-bad-tmp 10.0.0.1/32\n" +
+				"add cali4-tf-bad-tmp 10.1.0.0/16\n" +
+				"swap cali4-tf-bad-tmp cali4-tf-bad\n" +
+				"destroy cali4-tf-bad-tmp\n",
+			"create cali6-tf-bad hash:net family inet6 maxelem 10 -exist\n" +
+				"create cali6-tf-bad-tmp hash:net family inet6 maxelem 10 -exist\n" +
+				"flush cali6-tf-bad-tmp\n" +
+				"add cali6-tf-bad-tmp fd00::1/128\n" +
+				"swap cali6-tf-bad-tmp cali6-tf-bad\n" +
+				"destroy cali6-tf-bad-tmp\n",
+		}))
+		Expect(client.Status("bad").NumEntries).To(Equal(3))
+		Expect(client.Status("bad").LastSuccess).NotTo(BeZero())
+	})
+
+	It("should bound the size of the IP sets", func() {
+		source.feed = strings.Repeat("10.0.0.1\n", 15)
+		client.Refresh()
+		Expect(strings.Count(cmdRec.Stdins()[0], "add ")).To(Equal(10))
+		Expect(client.Status("bad").NumEntries).To(Equal(10))
+	})
+
+	It("should leave the IP sets alone if the fetch fails", func() {
+		source.err = errors.New("connection refused")
+		client.Refresh()
+		Expect(cmdRec.Stdins()).To(BeEmpty())
+		Expect(client.Status("bad").ConsecutiveFailures).To(Equal(1))
+	})
+
+	It("should report a failing ipset restore", func() {
+		cmdRec.Output = "ipset v6.29: Error in line 1"
+		cmdRec.FailAll = true
+		client.Refresh()
+		Expect(client.Status("bad").ConsecutiveFailures).To(Equal(1))
+	})
+
+	It("should report not ready after repeated failures", func() {
+		Expect(aggregator.Summary().Ready).To(BeTrue())
+		source.err = errors.New("connection refused")
+		for i := 0; i < 3; i++ {
+			client.Refresh()
+		}
+		Expect(aggregator.Summary().Ready).To(BeFalse())
+		source.err = nil
+		client.Refresh()
+		Expect(aggregator.Summary().Ready).To(BeTrue())
+	})
+})
+
+var _ = Describe("NewSource", func() {
+	It("should return an HTTP source for a URL", func() {
+		source, err := NewSource("https://example.com/feed.txt")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source.(*HTTPSource).URL).To(Equal("https://example.com/feed.txt"))
+	})
+	It("should return a file source for a path", func() {
+		Expect(NewSource("/etc/calico/feed.txt")).To(Equal(&FileSource{Path: "/etc/calico/feed.txt"}))
+	})
+	It("should reject anything else", func() {
+		_, err := NewSource("feed.txt")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+type fakeSource struct {
+	feed string
+	err  error
+}
+
+func (s *fakeSource) Fetch() (io.ReadCloser, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return ioutil.NopCloser(strings.NewReader(s.feed)), nil
+}
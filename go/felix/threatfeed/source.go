@@ -0,0 +1,79 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threatfeed
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Source is where a feed's entries come from.  Fetch returns the feed in
+// the usual plain-text format: one IP or CIDR per line, with blank lines
+// and "#" comments ignored.
+type Source interface {
+	Fetch() (io.ReadCloser, error)
+}
+
+// fetchTimeout bounds each HTTP fetch so that a hung server can't stall
+// the refresh of the other feeds.
+const fetchTimeout = 30 * time.Second
+
+// HTTPSource fetches the feed from an HTTP or HTTPS URL.
+type HTTPSource struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *HTTPSource) Fetch() (io.ReadCloser, error) {
+	resp, err := s.Client.Get(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected HTTP status %v", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// FileSource reads the feed from a local file, which some other process,
+// such as a cron job, keeps up to date.
+type FileSource struct {
+	Path string
+}
+
+func (s *FileSource) Fetch() (io.ReadCloser, error) {
+	return os.Open(s.Path)
+}
+
+// NewSource returns the Source for the given HTTP(S) URL or absolute file
+// path.
+func NewSource(spec string) (Source, error) {
+	switch {
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &HTTPSource{
+			URL:    spec,
+			Client: &http.Client{Timeout: fetchTimeout},
+		}, nil
+	case strings.HasPrefix(spec, "/"):
+		return &FileSource{Path: spec}, nil
+	}
+	return nil, errors.New("threat feed source must be an HTTP(S) URL or an absolute path")
+}
@@ -0,0 +1,342 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The throttle package limits the rate at which churn from a single source,
+// such as a flapping endpoint or an IP set whose members are churning, is
+// passed on to the dataplane driver.
+//
+// Each source gets a token bucket.  While a source has tokens, its updates
+// pass straight through.  Once it runs out, its updates are held back and
+// each new update is merged into the held one: an endpoint update replaces
+// the previous one and IP set deltas are combined.  Held updates are
+// released as the bucket refills, so a pathological source gets a steady
+// trickle of its latest state through while the other sources carry on.
+//
+// Holding back an endpoint update is only safe while the policies and
+// profiles that the endpoint's old state refers to are still programmed, so
+// all held updates are released before any policy, profile or IP set is
+// removed, and before the InSync message.  A convergence.RevisionMarker is
+// held back while any updates are, so that it doesn't claim that the
+// dataplane has caught up with a revision before it has.
+package throttle
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/convergence"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"sort"
+	"time"
+)
+
+var (
+	updatesHeld = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_throttle_updates_held",
+		Help: "Number of dataplane updates that were held back because their source was rate limited.",
+	})
+	updatesMerged = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_throttle_updates_merged",
+		Help: "Number of held dataplane updates that were merged into a later update, or dropped by a removal.",
+	})
+	updatesPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "felix_throttle_updates_pending",
+		Help: "Number of dataplane updates that are currently held back.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(updatesHeld)
+	prometheus.MustRegister(updatesMerged)
+	prometheus.MustRegister(updatesPending)
+}
+
+type Config struct {
+	// Rate is the sustained number of updates per second that are passed
+	// on for each source.  If zero, updates are never held back.
+	Rate float64
+	// Burst is the number of updates that a source can send in quick
+	// succession before it is limited.  Defaults to 1.
+	Burst int
+}
+
+// sourceKey identifies a source of updates.  The kind separates the
+// namespaces of the different types of ID.
+type sourceKey struct {
+	kind string
+	id   string
+}
+
+type source struct {
+	tokens     float64
+	lastRefill time.Time
+
+	// pending is the held update, or nil.  For an IP set, the held deltas
+	// are kept as the pending added and removed members instead.
+	pending        interface{}
+	ipSetID        string
+	pendingAdds    map[string]bool
+	pendingRemoves map[string]bool
+}
+
+func (s *source) hasPending() bool {
+	return s.pending != nil || s.pendingAdds != nil
+}
+
+// Limiter throttles a stream of updates from the calculation graph, passing
+// the updates that it lets through to its output function in order.  It is
+// not safe for concurrent use; it's driven from the goroutine that sends
+// updates to the dataplane driver.
+type Limiter struct {
+	config Config
+	output func(msg interface{})
+
+	sources map[sourceKey]*source
+	// pendingOrder lists the sources with held updates, in the order that
+	// they were first held, so that they're released fairly.
+	pendingOrder []sourceKey
+	// pendingMarker is the latest revision marker, held until there are
+	// no held updates, or nil.
+	pendingMarker *convergence.RevisionMarker
+}
+
+func New(config Config, output func(msg interface{})) *Limiter {
+	if config.Burst < 1 {
+		config.Burst = 1
+	}
+	return &Limiter{
+		config:  config,
+		output:  output,
+		sources: map[sourceKey]*source{},
+	}
+}
+
+// OnUpdate handles an update from the calculation graph at time now.
+func (l *Limiter) OnUpdate(msg interface{}, now time.Time) {
+	if l.config.Rate <= 0 {
+		l.output(msg)
+		return
+	}
+	switch msg := msg.(type) {
+	case *proto.WorkloadEndpointUpdate:
+		l.onSourceUpdate(sourceKey{"workload", workloadID(msg.Id)}, msg, now)
+	case *proto.WorkloadEndpointRemove:
+		l.onSourceRemove(sourceKey{"workload", workloadID(msg.Id)}, msg)
+	case *proto.HostEndpointUpdate:
+		l.onSourceUpdate(sourceKey{"host", msg.Id.EndpointId}, msg, now)
+	case *proto.HostEndpointRemove:
+		l.onSourceRemove(sourceKey{"host", msg.Id.EndpointId}, msg)
+	case *proto.IPSetDeltaUpdate:
+		l.onSourceUpdate(sourceKey{"ipset", msg.Id}, msg, now)
+	case *proto.IPSetUpdate:
+		// A full update supersedes any held deltas.
+		l.onSourceRemove(sourceKey{"ipset", msg.Id}, msg)
+	case *proto.IPSetRemove:
+		l.onSourceRemove(sourceKey{"ipset", msg.Id}, msg)
+	case *proto.ActivePolicyRemove, *proto.ActiveProfileRemove, *proto.InSync:
+		l.FlushAll()
+		l.output(msg)
+	case *convergence.RevisionMarker:
+		if len(l.pendingOrder) > 0 {
+			l.pendingMarker = msg
+			return
+		}
+		l.pendingMarker = nil
+		l.output(msg)
+	default:
+		l.output(msg)
+	}
+}
+
+func (l *Limiter) onSourceUpdate(key sourceKey, msg interface{}, now time.Time) {
+	src := l.sources[key]
+	if src == nil {
+		src = &source{tokens: float64(l.config.Burst), lastRefill: now}
+		l.sources[key] = src
+	}
+	l.refill(src, now)
+	if !src.hasPending() && src.tokens >= 1 {
+		src.tokens--
+		l.output(msg)
+		return
+	}
+	updatesHeld.Inc()
+	if src.hasPending() {
+		updatesMerged.Inc()
+	} else {
+		log.WithField("source", key).Debug("Source rate limited, holding back its updates")
+		l.pendingOrder = append(l.pendingOrder, key)
+		updatesPending.Inc()
+	}
+	if delta, ok := msg.(*proto.IPSetDeltaUpdate); ok {
+		mergeDelta(src, delta)
+	} else {
+		src.pending = msg
+	}
+}
+
+// onSourceRemove passes on an update that supersedes any held update from
+// the source and then forgets the source.
+func (l *Limiter) onSourceRemove(key sourceKey, msg interface{}) {
+	if src := l.sources[key]; src != nil {
+		if src.hasPending() {
+			updatesMerged.Inc()
+			updatesPending.Dec()
+			l.removeFromPendingOrder(key)
+		}
+		delete(l.sources, key)
+	}
+	l.output(msg)
+	l.maybeReleaseMarker()
+}
+
+// Flush releases the held updates whose sources have earned a token by time
+// now, and forgets the sources that have been idle long enough to refill
+// their buckets.
+func (l *Limiter) Flush(now time.Time) {
+	var stillPending []sourceKey
+	for _, key := range l.pendingOrder {
+		src := l.sources[key]
+		l.refill(src, now)
+		if src.tokens < 1 {
+			stillPending = append(stillPending, key)
+			continue
+		}
+		src.tokens--
+		l.release(src)
+	}
+	l.pendingOrder = stillPending
+	l.maybeReleaseMarker()
+	for key, src := range l.sources {
+		if src.hasPending() {
+			continue
+		}
+		l.refill(src, now)
+		if src.tokens >= float64(l.config.Burst) {
+			delete(l.sources, key)
+		}
+	}
+}
+
+// FlushAll releases all the held updates, regardless of rate.
+func (l *Limiter) FlushAll() {
+	for _, key := range l.pendingOrder {
+		l.release(l.sources[key])
+	}
+	l.pendingOrder = nil
+	l.maybeReleaseMarker()
+}
+
+// maybeReleaseMarker releases the held revision marker once there are no
+// held updates ahead of it.
+func (l *Limiter) maybeReleaseMarker() {
+	if l.pendingMarker == nil || len(l.pendingOrder) > 0 {
+		return
+	}
+	marker := l.pendingMarker
+	l.pendingMarker = nil
+	l.output(marker)
+}
+
+// NextRelease returns the time at which the next held update is due to be
+// released, and false if there are no held updates.
+func (l *Limiter) NextRelease() (time.Time, bool) {
+	var next time.Time
+	found := false
+	for _, key := range l.pendingOrder {
+		src := l.sources[key]
+		missing := 1 - src.tokens
+		due := src.lastRefill
+		if missing > 0 {
+			due = due.Add(time.Duration(missing / l.config.Rate * float64(time.Second)))
+		}
+		if !found || due.Before(next) {
+			next = due
+			found = true
+		}
+	}
+	return next, found
+}
+
+// NumPending returns the number of sources with held updates.
+func (l *Limiter) NumPending() int {
+	return len(l.pendingOrder)
+}
+
+func (l *Limiter) refill(src *source, now time.Time) {
+	elapsed := now.Sub(src.lastRefill)
+	if elapsed <= 0 {
+		return
+	}
+	src.tokens += elapsed.Seconds() * l.config.Rate
+	if src.tokens > float64(l.config.Burst) {
+		src.tokens = float64(l.config.Burst)
+	}
+	src.lastRefill = now
+}
+
+func (l *Limiter) release(src *source) {
+	msg := src.pending
+	if src.pendingAdds != nil {
+		msg = deltaFromPending(src)
+	}
+	src.pending = nil
+	src.pendingAdds = nil
+	src.pendingRemoves = nil
+	updatesPending.Dec()
+	l.output(msg)
+}
+
+func (l *Limiter) removeFromPendingOrder(key sourceKey) {
+	for i, k := range l.pendingOrder {
+		if k == key {
+			l.pendingOrder = append(l.pendingOrder[:i], l.pendingOrder[i+1:]...)
+			return
+		}
+	}
+}
+
+// mergeDelta merges an IP set delta into the source's held members; the
+// latest change to each member wins.
+func mergeDelta(src *source, delta *proto.IPSetDeltaUpdate) {
+	if src.pendingAdds == nil {
+		src.ipSetID = delta.Id
+		src.pendingAdds = map[string]bool{}
+		src.pendingRemoves = map[string]bool{}
+	}
+	for _, member := range delta.RemovedMembers {
+		delete(src.pendingAdds, member)
+		src.pendingRemoves[member] = true
+	}
+	for _, member := range delta.AddedMembers {
+		delete(src.pendingRemoves, member)
+		src.pendingAdds[member] = true
+	}
+}
+
+func deltaFromPending(src *source) *proto.IPSetDeltaUpdate {
+	delta := &proto.IPSetDeltaUpdate{Id: src.ipSetID}
+	for member := range src.pendingAdds {
+		delta.AddedMembers = append(delta.AddedMembers, member)
+	}
+	for member := range src.pendingRemoves {
+		delta.RemovedMembers = append(delta.RemovedMembers, member)
+	}
+	sort.Strings(delta.AddedMembers)
+	sort.Strings(delta.RemovedMembers)
+	return delta
+}
+
+func workloadID(id *proto.WorkloadEndpointID) string {
+	return id.OrchestratorId + "/" + id.WorkloadId + "/" + id.EndpointId
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package throttle_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/throttle"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/convergence"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"time"
+)
+
+var _ = Describe("Limiter", func() {
+	var limiter *Limiter
+	var output []interface{}
+	var now time.Time
+
+	wepID := &proto.WorkloadEndpointID{
+		OrchestratorId: "k8s",
+		WorkloadId:     "pod1",
+		EndpointId:     "eth0",
+	}
+	wepUpdate := func(name string) *proto.WorkloadEndpointUpdate {
+		return &proto.WorkloadEndpointUpdate{
+			Id:       wepID,
+			Endpoint: &proto.WorkloadEndpoint{Name: name},
+		}
+	}
+	otherWepUpdate := &proto.WorkloadEndpointUpdate{
+		Id: &proto.WorkloadEndpointID{
+			OrchestratorId: "k8s",
+			WorkloadId:     "pod2",
+			EndpointId:     "eth0",
+		},
+		Endpoint: &proto.WorkloadEndpoint{Name: "other"},
+	}
+
+	BeforeEach(func() {
+		output = nil
+		now = time.Now()
+		limiter = New(Config{Rate: 1, Burst: 2}, func(msg interface{}) {
+			output = append(output, msg)
+		})
+	})
+
+	It("should pass through a burst of updates", func() {
+		limiter.OnUpdate(wepUpdate("a"), now)
+		limiter.OnUpdate(wepUpdate("b"), now)
+		Expect(output).To(Equal([]interface{}{wepUpdate("a"), wepUpdate("b")}))
+		Expect(limiter.NumPending()).To(Equal(0))
+	})
+
+	It("should pass through everything if disabled", func() {
+		limiter = New(Config{}, func(msg interface{}) {
+			output = append(output, msg)
+		})
+		for _, name := range []string{"a", "b", "c", "d"} {
+			limiter.OnUpdate(wepUpdate(name), now)
+		}
+		Expect(output).To(HaveLen(4))
+	})
+
+	Describe("after a source has used its burst", func() {
+		BeforeEach(func() {
+			limiter.OnUpdate(wepUpdate("a"), now)
+			limiter.OnUpdate(wepUpdate("b"), now)
+			output = nil
+			limiter.OnUpdate(wepUpdate("c"), now)
+			limiter.OnUpdate(wepUpdate("d"), now)
+		})
+
+		It("should hold back the latest update", func() {
+			Expect(output).To(BeEmpty())
+			Expect(limiter.NumPending()).To(Equal(1))
+			next, ok := limiter.NextRelease()
+			Expect(ok).To(BeTrue())
+			Expect(next).To(Equal(now.Add(time.Second)))
+		})
+		It("should not release it before the bucket refills", func() {
+			limiter.Flush(now.Add(500 * time.Millisecond))
+			Expect(output).To(BeEmpty())
+		})
+		It("should release only the latest update once the bucket refills", func() {
+			limiter.Flush(now.Add(time.Second))
+			Expect(output).To(Equal([]interface{}{wepUpdate("d")}))
+			Expect(limiter.NumPending()).To(Equal(0))
+			_, ok := limiter.NextRelease()
+			Expect(ok).To(BeFalse())
+		})
+		It("should keep limiting after a release", func() {
+			limiter.Flush(now.Add(time.Second))
+			output = nil
+			limiter.OnUpdate(wepUpdate("e"), now.Add(time.Second))
+			Expect(output).To(BeEmpty())
+		})
+		It("should not limit other sources", func() {
+			limiter.OnUpdate(otherWepUpdate, now)
+			Expect(output).To(Equal([]interface{}{otherWepUpdate}))
+		})
+		It("should hold back a revision marker until the held update is released", func() {
+			marker := &convergence.RevisionMarker{Revision: "10"}
+			limiter.OnUpdate(marker, now)
+			Expect(output).To(BeEmpty())
+			limiter.Flush(now.Add(time.Second))
+			Expect(output).To(Equal([]interface{}{wepUpdate("d"), marker}))
+		})
+		It("should release a held revision marker if the endpoint is removed", func() {
+			marker := &convergence.RevisionMarker{Revision: "10"}
+			limiter.OnUpdate(marker, now)
+			remove := &proto.WorkloadEndpointRemove{Id: wepID}
+			limiter.OnUpdate(remove, now)
+			Expect(output).To(Equal([]interface{}{remove, marker}))
+		})
+		It("should drop the held update if the endpoint is removed", func() {
+			remove := &proto.WorkloadEndpointRemove{Id: wepID}
+			limiter.OnUpdate(remove, now)
+			Expect(output).To(Equal([]interface{}{remove}))
+			limiter.Flush(now.Add(time.Hour))
+			Expect(output).To(Equal([]interface{}{remove}))
+		})
+		It("should release the held update before a policy removal", func() {
+			remove := &proto.ActivePolicyRemove{Id: &proto.PolicyID{Tier: "default", Name: "p"}}
+			limiter.OnUpdate(remove, now)
+			Expect(output).To(Equal([]interface{}{wepUpdate("d"), remove}))
+		})
+		It("should release the held update before InSync", func() {
+			limiter.OnUpdate(&proto.InSync{}, now)
+			Expect(output).To(Equal([]interface{}{wepUpdate("d"), &proto.InSync{}}))
+		})
+		It("should pass through a policy update", func() {
+			update := &proto.ActivePolicyUpdate{Id: &proto.PolicyID{Tier: "default", Name: "p"}}
+			limiter.OnUpdate(update, now)
+			Expect(output).To(Equal([]interface{}{update}))
+		})
+	})
+
+	Describe("with a churning IP set", func() {
+		BeforeEach(func() {
+			limiter = New(Config{Rate: 1, Burst: 1}, func(msg interface{}) {
+				output = append(output, msg)
+			})
+			limiter.OnUpdate(&proto.IPSetDeltaUpdate{Id: "s", AddedMembers: []string{"10.0.0.1"}}, now)
+			output = nil
+			limiter.OnUpdate(&proto.IPSetDeltaUpdate{
+				Id:             "s",
+				AddedMembers:   []string{"10.0.0.2", "10.0.0.3"},
+				RemovedMembers: []string{"10.0.0.1"},
+			}, now)
+			limiter.OnUpdate(&proto.IPSetDeltaUpdate{
+				Id:             "s",
+				AddedMembers:   []string{"10.0.0.1"},
+				RemovedMembers: []string{"10.0.0.3"},
+			}, now)
+		})
+
+		It("should merge the deltas", func() {
+			Expect(output).To(BeEmpty())
+			limiter.Flush(now.Add(time.Second))
+			Expect(output).To(Equal([]interface{}{&proto.IPSetDeltaUpdate{
+				Id:             "s",
+				AddedMembers:   []string{"10.0.0.1", "10.0.0.2"},
+				RemovedMembers: []string{"10.0.0.3"},
+			}}))
+		})
+		It("should drop the deltas in favour of a full update", func() {
+			update := &proto.IPSetUpdate{Id: "s", Members: []string{"10.0.0.4"}}
+			limiter.OnUpdate(update, now)
+			limiter.Flush(now.Add(time.Second))
+			Expect(output).To(Equal([]interface{}{update}))
+		})
+		It("should drop the deltas if the IP set is removed", func() {
+			remove := &proto.IPSetRemove{Id: "s"}
+			limiter.OnUpdate(remove, now)
+			limiter.Flush(now.Add(time.Second))
+			Expect(output).To(Equal([]interface{}{remove}))
+		})
+	})
+})
@@ -0,0 +1,115 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// traceMarker starts the part of a kernel log line that TRACE wrote.
+const traceMarker = "TRACE: "
+
+// Event is one rule (or chain policy) that a traced packet hit, decoded
+// from a kernel log line such as
+//
+//	TRACE: filter:cali-tw-cali1234:rule:3 IN=eth0 OUT=cali1234 SRC=10.0.0.2 DST=10.0.0.1 ... PROTO=TCP SPT=40000 DPT=80
+type Event struct {
+	Table string `json:"table"`
+	Chain string `json:"chain"`
+	// Type is "rule" if the packet matched a rule, "return" if it fell off
+	// the end of a chain that we created, or "policy" if it fell off the
+	// end of a built-in chain.
+	Type string `json:"type"`
+	// RuleNum is the 1-based position of the rule, or of the end of the
+	// chain, in the chain.
+	RuleNum int `json:"rule_num"`
+
+	In       string `json:"in,omitempty"`
+	Out      string `json:"out,omitempty"`
+	Src      string `json:"src,omitempty"`
+	Dst      string `json:"dst,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	SrcPort  string `json:"src_port,omitempty"`
+	DstPort  string `json:"dst_port,omitempty"`
+}
+
+// ParseEvent decodes a kernel log line that TRACE wrote.  Any prefix, such
+// as a syslog timestamp, is skipped.  It returns false if the line wasn't
+// written by TRACE.
+func ParseEvent(line string) (*Event, bool) {
+	start := strings.Index(line, traceMarker)
+	if start < 0 {
+		return nil, false
+	}
+	fields := strings.Fields(line[start+len(traceMarker):])
+	if len(fields) == 0 {
+		return nil, false
+	}
+	// The chain name is in the middle so that any colons in it don't
+	// matter.
+	location := strings.Split(fields[0], ":")
+	if len(location) < 4 {
+		return nil, false
+	}
+	ruleNum, err := strconv.Atoi(location[len(location)-1])
+	if err != nil {
+		return nil, false
+	}
+	event := &Event{
+		Table:   location[0],
+		Chain:   strings.Join(location[1:len(location)-2], ":"),
+		Type:    location[len(location)-2],
+		RuleNum: ruleNum,
+	}
+	for _, field := range fields[1:] {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "IN":
+			event.In = parts[1]
+		case "OUT":
+			event.Out = parts[1]
+		case "SRC":
+			event.Src = parts[1]
+		case "DST":
+			event.Dst = parts[1]
+		case "PROTO":
+			event.Protocol = parts[1]
+		case "SPT":
+			event.SrcPort = parts[1]
+		case "DPT":
+			event.DstPort = parts[1]
+		}
+	}
+	return event, true
+}
+
+// ReadEvents collects the TRACE events from a kernel log, such as the
+// output of dmesg, skipping the lines that TRACE didn't write.
+func ReadEvents(r io.Reader) ([]*Event, error) {
+	var events []*Event
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if event, ok := ParseEvent(scanner.Text()); ok {
+			events = append(events, event)
+		}
+	}
+	return events, scanner.Err()
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/trace"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strings"
+)
+
+const kernelLog = `[12345.678901] cali1234: link up
+[12345.700000] TRACE: raw:PREROUTING:policy:3 IN=eth0 OUT= MAC=00:11:22:33:44:55 SRC=10.0.0.2 DST=10.0.0.1 LEN=60 TTL=64 ID=1 DF PROTO=TCP SPT=40000 DPT=80 SEQ=1 ACK=0 WINDOW=29200 SYN URGP=0
+[12345.700001] TRACE: filter:cali-tw-cali1234:rule:2 IN=eth0 OUT=cali1234 SRC=10.0.0.2 DST=10.0.0.1 LEN=60 PROTO=TCP SPT=40000 DPT=80
+[12345.700002] TRACE: filter:cali-pi-default/allow-web:return:4 IN=eth0 OUT=cali1234 SRC=10.0.0.2 DST=10.0.0.1 LEN=60 PROTO=TCP SPT=40000 DPT=80
+`
+
+var _ = Describe("Trace events", func() {
+	It("should parse a TRACE line", func() {
+		event, ok := ParseEvent("Oct 16 10:00:00 host kernel: [1.0] TRACE: filter:cali-tw-cali1234:rule:2 " +
+			"IN=eth0 OUT=cali1234 SRC=10.0.0.2 DST=10.0.0.1 LEN=60 PROTO=TCP SPT=40000 DPT=80")
+		Expect(ok).To(BeTrue())
+		Expect(event).To(Equal(&Event{
+			Table:    "filter",
+			Chain:    "cali-tw-cali1234",
+			Type:     "rule",
+			RuleNum:  2,
+			In:       "eth0",
+			Out:      "cali1234",
+			Src:      "10.0.0.2",
+			Dst:      "10.0.0.1",
+			Protocol: "TCP",
+			SrcPort:  "40000",
+			DstPort:  "80",
+		}))
+	})
+	It("should ignore other lines", func() {
+		_, ok := ParseEvent("[1.0] cali1234: link up")
+		Expect(ok).To(BeFalse())
+		_, ok = ParseEvent("[1.0] TRACE: filter:FORWARD")
+		Expect(ok).To(BeFalse())
+		_, ok = ParseEvent("[1.0] TRACE: filter:FORWARD:rule:x")
+		Expect(ok).To(BeFalse())
+	})
+	It("should collect the events from a log", func() {
+		events, err := ReadEvents(strings.NewReader(kernelLog))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events).To(HaveLen(3))
+		Expect(events[0].Chain).To(Equal("PREROUTING"))
+		Expect(events[0].Type).To(Equal("policy"))
+		Expect(events[0].Out).To(Equal(""))
+		Expect(events[2].Chain).To(Equal("cali-pi-default/allow-web"))
+		Expect(events[2].RuleNum).To(Equal(4))
+	})
+})
@@ -0,0 +1,253 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The trace package helps to follow a packet through the dataplane.  A
+// Tracer temporarily inserts TRACE rules, scoped to a 5-tuple, at the top of
+// the raw table's PREROUTING and OUTPUT chains; the kernel then logs every
+// rule that the matching packets hit.  ParseEvent and ReadEvents decode the
+// resulting kernel log lines, which the debug server can map back to the
+// endpoints and policies that the chains came from.
+//
+// Like the capture package's rules, the TRACE rules are inserted with the
+// iptables binaries and they are removed again when the trace expires.
+package trace
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxActiveTraces bounds the number of traces that can run at once; TRACE
+// is expensive and floods the kernel log.
+const MaxActiveTraces = 4
+
+var (
+	ErrTooManyTraces = errors.New("too many traces are active")
+	ErrUnknownTrace  = errors.New("no such trace")
+)
+
+// traceChains are the raw-table chains that the TRACE rules are inserted
+// into; between them, they see every packet that reaches the host.
+var traceChains = []string{"PREROUTING", "OUTPUT"}
+
+// Tuple selects the packets to trace.  Empty fields match anything.
+type Tuple struct {
+	Protocol string `json:"protocol,omitempty"`
+	SrcIP    string `json:"src_ip,omitempty"`
+	DstIP    string `json:"dst_ip,omitempty"`
+	SrcPort  uint16 `json:"src_port,omitempty"`
+	DstPort  uint16 `json:"dst_port,omitempty"`
+}
+
+// Validate checks that the tuple can be turned into an iptables match.
+func (t Tuple) Validate() error {
+	ipVersion := 0
+	for _, addr := range []string{t.SrcIP, t.DstIP} {
+		if addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", addr)
+		}
+		version := 6
+		if ip.To4() != nil {
+			version = 4
+		}
+		if ipVersion != 0 && version != ipVersion {
+			return errors.New("source and destination IPs have different versions")
+		}
+		ipVersion = version
+	}
+	switch t.Protocol {
+	case "tcp", "udp", "sctp":
+	case "", "icmp", "icmpv6":
+		if t.SrcPort != 0 || t.DstPort != 0 {
+			return errors.New("ports require a protocol of tcp, udp or sctp")
+		}
+	default:
+		return fmt.Errorf("unsupported protocol %q", t.Protocol)
+	}
+	return nil
+}
+
+// binaries returns the iptables binaries that the tuple's rules are
+// inserted with, according to the version of its IPs.
+func (t Tuple) binaries() []string {
+	for _, addr := range []string{t.SrcIP, t.DstIP} {
+		if addr == "" {
+			continue
+		}
+		if net.ParseIP(addr).To4() != nil {
+			return []string{"iptables"}
+		}
+		return []string{"ip6tables"}
+	}
+	return []string{"iptables", "ip6tables"}
+}
+
+// matchArgs returns the iptables match arguments for the tuple.
+func (t Tuple) matchArgs() []string {
+	var args []string
+	if t.Protocol != "" {
+		args = append(args, "--protocol", t.Protocol)
+	}
+	if t.SrcIP != "" {
+		args = append(args, "--source", t.SrcIP)
+	}
+	if t.DstIP != "" {
+		args = append(args, "--destination", t.DstIP)
+	}
+	if t.SrcPort != 0 || t.DstPort != 0 {
+		args = append(args, "--match", t.Protocol)
+	}
+	if t.SrcPort != 0 {
+		args = append(args, "--source-port", strconv.Itoa(int(t.SrcPort)))
+	}
+	if t.DstPort != 0 {
+		args = append(args, "--destination-port", strconv.Itoa(int(t.DstPort)))
+	}
+	return args
+}
+
+// Trace is a trace that's active.
+type Trace struct {
+	ID      int       `json:"id"`
+	Tuple   Tuple     `json:"tuple"`
+	Expires time.Time `json:"expires"`
+
+	timer *time.Timer
+}
+
+type Tracer struct {
+	newCmd      cmdshim.NewCmd
+	maxDuration time.Duration
+
+	mutex  sync.Mutex
+	nextID int
+	active map[int]*Trace
+}
+
+func New(maxDuration time.Duration) *Tracer {
+	return NewWithCmdShim(maxDuration, cmdshim.NewRealCmd)
+}
+
+// NewWithCmdShim is a test constructor that allows for shimming exec.Command.
+func NewWithCmdShim(maxDuration time.Duration, shim cmdshim.NewCmd) *Tracer {
+	return &Tracer{
+		newCmd:      shim,
+		maxDuration: maxDuration,
+		nextID:      1,
+		active:      map[int]*Trace{},
+	}
+}
+
+// Start inserts the TRACE rules for the tuple and schedules their removal
+// after the given duration.
+func (t *Tracer) Start(tuple Tuple, duration time.Duration) (*Trace, error) {
+	if err := tuple.Validate(); err != nil {
+		return nil, err
+	}
+	if duration <= 0 || duration > t.maxDuration {
+		return nil, fmt.Errorf("duration must be positive and at most %v", t.maxDuration)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.active) >= MaxActiveTraces {
+		return nil, ErrTooManyTraces
+	}
+	if err := t.updateRules("--insert", tuple); err != nil {
+		// Remove any rules that we did manage to insert.
+		t.updateRules("--delete", tuple)
+		return nil, err
+	}
+	trace := &Trace{
+		ID:      t.nextID,
+		Tuple:   tuple,
+		Expires: time.Now().Add(duration),
+	}
+	t.nextID++
+	t.active[trace.ID] = trace
+	trace.timer = time.AfterFunc(duration, func() {
+		if err := t.Stop(trace.ID); err != nil && err != ErrUnknownTrace {
+			log.WithError(err).WithField("id", trace.ID).Warn("Failed to remove expired trace")
+		}
+	})
+	log.WithFields(log.Fields{
+		"id":       trace.ID,
+		"tuple":    tuple,
+		"duration": duration,
+	}).Info("Started packet trace")
+	return trace, nil
+}
+
+// Stop removes the TRACE rules of the given trace before it expires.
+func (t *Tracer) Stop(id int) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	trace := t.active[id]
+	if trace == nil {
+		return ErrUnknownTrace
+	}
+	trace.timer.Stop()
+	delete(t.active, id)
+	log.WithField("id", id).Info("Stopping packet trace")
+	return t.updateRules("--delete", trace.Tuple)
+}
+
+// Active returns the active traces, in order of ID.
+func (t *Tracer) Active() []*Trace {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	traces := []*Trace{}
+	for _, trace := range t.active {
+		traces = append(traces, trace)
+	}
+	sort.Sort(tracesByID(traces))
+	return traces
+}
+
+type tracesByID []*Trace
+
+func (t tracesByID) Len() int           { return len(t) }
+func (t tracesByID) Less(i, j int) bool { return t[i].ID < t[j].ID }
+func (t tracesByID) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// updateRules inserts or deletes the tuple's TRACE rule in each of the
+// trace chains.  It carries on after a failure, so that a delete removes as
+// many rules as it can, and returns the first error.
+func (t *Tracer) updateRules(op string, tuple Tuple) error {
+	var firstErr error
+	for _, binary := range tuple.binaries() {
+		for _, chain := range traceChains {
+			args := append([]string{"--wait", "--table", "raw", op, chain}, tuple.matchArgs()...)
+			args = append(args, "--jump", "TRACE")
+			output, err := t.newCmd(binary, args...).CombinedOutput()
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("%s %s failed: %v: %s",
+					binary, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+			}
+		}
+	}
+	return firstErr
+}
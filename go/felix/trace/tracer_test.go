@@ -0,0 +1,119 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/trace"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/cmdshim"
+	"time"
+)
+
+var _ = DescribeTable("Tuple validation",
+	func(tuple Tuple, valid bool) {
+		if valid {
+			Expect(tuple.Validate()).To(Succeed())
+		} else {
+			Expect(tuple.Validate()).NotTo(Succeed())
+		}
+	},
+	Entry("empty", Tuple{}, true),
+	Entry("full", Tuple{Protocol: "tcp", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 1, DstPort: 2}, true),
+	Entry("IPv6", Tuple{SrcIP: "fd00::1", DstIP: "fd00::2"}, true),
+	Entry("mixed versions", Tuple{SrcIP: "10.0.0.1", DstIP: "fd00::2"}, false),
+	Entry("bad IP", Tuple{SrcIP: "10.0.0"}, false),
+	Entry("port without protocol", Tuple{DstPort: 80}, false),
+	Entry("port with ICMP", Tuple{Protocol: "icmp", DstPort: 80}, false),
+	Entry("unknown protocol", Tuple{Protocol: "gre"}, false),
+)
+
+var _ = Describe("Tracer", func() {
+	var tracer *Tracer
+	var cmdRec *cmdshim.Recorder
+	BeforeEach(func() {
+		cmdRec = &cmdshim.Recorder{FailingCmds: map[string]bool{}}
+		tracer = NewWithCmdShim(time.Minute, cmdRec.NewCmd)
+	})
+
+	It("should insert and remove the TRACE rules", func() {
+		trace, err := tracer.Start(Tuple{
+			Protocol: "tcp",
+			SrcIP:    "10.0.0.1",
+			DstIP:    "10.0.0.2",
+			DstPort:  80,
+		}, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(trace.ID).To(Equal(1))
+		Expect(tracer.Active()).To(Equal([]*Trace{trace}))
+		Expect(cmdRec.Commands()).To(Equal([]string{
+			"iptables --wait --table raw --insert PREROUTING --protocol tcp --source 10.0.0.1 " +
+				"--destination 10.0.0.2 --match tcp --destination-port 80 --jump TRACE",
+			"iptables --wait --table raw --insert OUTPUT --protocol tcp --source 10.0.0.1 " +
+				"--destination 10.0.0.2 --match tcp --destination-port 80 --jump TRACE",
+		}))
+
+		Expect(tracer.Stop(trace.ID)).To(Succeed())
+		Expect(tracer.Active()).To(BeEmpty())
+		Expect(cmdRec.Commands()[2:]).To(Equal([]string{
+			"iptables --wait --table raw --delete PREROUTING --protocol tcp --source 10.0.0.1 " +
+				"--destination 10.0.0.2 --match tcp --destination-port 80 --jump TRACE",
+			"iptables --wait --table raw --delete OUTPUT --protocol tcp --source 10.0.0.1 " +
+				"--destination 10.0.0.2 --match tcp --destination-port 80 --jump TRACE",
+		}))
+		Expect(tracer.Stop(trace.ID)).To(Equal(ErrUnknownTrace))
+	})
+	It("should trace both IP versions if the tuple has no IPs", func() {
+		_, err := tracer.Start(Tuple{Protocol: "udp", DstPort: 53}, time.Minute)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cmdRec.Commands()).To(HaveLen(4))
+		Expect(cmdRec.Commands()[2]).To(HavePrefix("ip6tables "))
+	})
+	It("should remove the rules when the trace expires", func() {
+		_, err := tracer.Start(Tuple{DstIP: "fd00::1"}, 10*time.Millisecond)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(tracer.Active).Should(BeEmpty())
+		Expect(cmdRec.Commands()).To(ConsistOf(
+			"ip6tables --wait --table raw --insert PREROUTING --destination fd00::1 --jump TRACE",
+			"ip6tables --wait --table raw --insert OUTPUT --destination fd00::1 --jump TRACE",
+			"ip6tables --wait --table raw --delete PREROUTING --destination fd00::1 --jump TRACE",
+			"ip6tables --wait --table raw --delete OUTPUT --destination fd00::1 --jump TRACE",
+		))
+	})
+	It("should clean up after a failed insert", func() {
+		cmdRec.FailingCmds["iptables --wait --table raw --insert OUTPUT --source 10.0.0.1 --jump TRACE"] = true
+		_, err := tracer.Start(Tuple{SrcIP: "10.0.0.1"}, time.Minute)
+		Expect(err).To(HaveOccurred())
+		Expect(tracer.Active()).To(BeEmpty())
+		Expect(cmdRec.Commands()).To(ContainElement(
+			"iptables --wait --table raw --delete PREROUTING --source 10.0.0.1 --jump TRACE"))
+	})
+	It("should limit the number of active traces", func() {
+		for i := 0; i < MaxActiveTraces; i++ {
+			_, err := tracer.Start(Tuple{}, time.Minute)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		_, err := tracer.Start(Tuple{}, time.Minute)
+		Expect(err).To(Equal(ErrTooManyTraces))
+		Expect(tracer.Active()).To(HaveLen(MaxActiveTraces))
+	})
+	It("should reject a duration over the maximum", func() {
+		_, err := tracer.Start(Tuple{}, time.Hour)
+		Expect(err).To(HaveOccurred())
+		Expect(cmdRec.Commands()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,186 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The watchdog package detects long-running loops, such as the calculation
+// graph's, that have stopped making progress.
+//
+// Each loop registers with the Watchdog and then calls CheckIn() every time
+// round, including on a timer while it's idle, so that a loop that checks
+// in is known to be turning.  If a loop goes longer than its timeout without
+// checking in, the Watchdog treats it as wedged: it logs the stacks of all
+// goroutines, which show where the loop is stuck, reports itself not ready
+// to the health aggregator, if there is one, and, if configured to, calls
+// its OnWedged callback, which typically shuts Felix down.  If the loop
+// checks in again, it's treated as having recovered.
+package watchdog
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/health"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthName = "watchdog"
+
+	defaultCheckInterval = time.Second
+	// maxStackDumpSize caps the size of the goroutine dump that we log.
+	maxStackDumpSize = 1024 * 1024
+)
+
+type Config struct {
+	// CheckInterval is how often the Watchdog checks the loops.  Defaults
+	// to 1s.
+	CheckInterval time.Duration
+	// OnWedged, if non-nil, is called, from the Watchdog's goroutine,
+	// when a loop first wedges.
+	OnWedged func(name string)
+}
+
+// Loop is a registered loop.  A nil *Loop is valid and ignores check-ins,
+// so that a component can be run without a watchdog.
+type Loop struct {
+	name    string
+	timeout time.Duration
+
+	// lastCheckIn is the time of the last check-in, in Unix nanoseconds.
+	// It's accessed atomically so that checking in is cheap.
+	lastCheckIn int64
+
+	// wedged is only accessed with the Watchdog's mutex held.
+	wedged bool
+}
+
+// CheckIn records that the loop is making progress.
+func (l *Loop) CheckIn() {
+	if l == nil {
+		return
+	}
+	atomic.StoreInt64(&l.lastCheckIn, time.Now().UnixNano())
+}
+
+// IdleInterval is how often the loop should check in while it has no work,
+// to leave plenty of margin before its timeout.  It returns 0 for a nil
+// Loop.
+func (l *Loop) IdleInterval() time.Duration {
+	if l == nil {
+		return 0
+	}
+	return l.timeout / 4
+}
+
+// Watchdog tracks the check-ins of the registered loops.  It is safe for
+// concurrent use.
+type Watchdog struct {
+	config           Config
+	healthAggregator *health.HealthAggregator
+
+	mutex sync.Mutex
+	loops []*Loop
+}
+
+// New creates a Watchdog.  If healthAggregator is non-nil, the Watchdog
+// reports itself not ready to it while any loop is wedged.
+func New(config Config, healthAggregator *health.HealthAggregator) *Watchdog {
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = defaultCheckInterval
+	}
+	w := &Watchdog{
+		config:           config,
+		healthAggregator: healthAggregator,
+	}
+	if healthAggregator != nil {
+		healthAggregator.RegisterReporter(healthName, &health.HealthReport{Ready: true}, 0)
+		healthAggregator.Report(healthName, &health.HealthReport{Live: true, Ready: true})
+	}
+	return w
+}
+
+// Register registers a loop that must check in at least once every timeout.
+// The loop counts as having checked in when it registers.
+func (w *Watchdog) Register(name string, timeout time.Duration) *Loop {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	loop := &Loop{name: name, timeout: timeout}
+	loop.CheckIn()
+	w.loops = append(w.loops, loop)
+	return loop
+}
+
+// Start starts the Watchdog's goroutine, which checks the loops every
+// CheckInterval.
+func (w *Watchdog) Start() {
+	go func() {
+		for range time.Tick(w.config.CheckInterval) {
+			w.Check()
+		}
+	}()
+}
+
+// Check checks whether any loop has wedged, or recovered, since the last
+// check.  It returns the names of the loops that are currently wedged.
+func (w *Watchdog) Check() []string {
+	w.mutex.Lock()
+	now := time.Now()
+	var wedged, newlyWedged []string
+	changed := false
+	for _, loop := range w.loops {
+		sinceCheckIn := now.Sub(time.Unix(0, atomic.LoadInt64(&loop.lastCheckIn)))
+		logCxt := log.WithFields(log.Fields{
+			"loop":         loop.name,
+			"sinceCheckIn": sinceCheckIn,
+			"timeout":      loop.timeout,
+		})
+		if sinceCheckIn <= loop.timeout {
+			if loop.wedged {
+				logCxt.Warn("Loop is making progress again")
+				loop.wedged = false
+				changed = true
+			}
+			continue
+		}
+		wedged = append(wedged, loop.name)
+		if !loop.wedged {
+			logCxt.Errorf("Loop has stopped making progress; goroutine stacks:\n%s",
+				allStacks())
+			loop.wedged = true
+			changed = true
+			newlyWedged = append(newlyWedged, loop.name)
+		}
+	}
+	if changed && w.healthAggregator != nil {
+		w.healthAggregator.Report(healthName, &health.HealthReport{
+			Live:  true,
+			Ready: len(wedged) == 0,
+		})
+	}
+	w.mutex.Unlock()
+
+	// Call the callback without the lock held, in case it calls back into
+	// the Watchdog.
+	if w.config.OnWedged != nil {
+		for _, name := range newlyWedged {
+			w.config.OnWedged(name)
+		}
+	}
+	return wedged
+}
+
+func allStacks() []byte {
+	buf := make([]byte, maxStackDumpSize)
+	return buf[:runtime.Stack(buf, true)]
+}
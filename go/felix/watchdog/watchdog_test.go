@@ -0,0 +1,87 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watchdog_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/watchdog"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/health"
+	"time"
+)
+
+var _ = Describe("Watchdog", func() {
+	var watchdog *Watchdog
+	var aggregator *health.HealthAggregator
+	var wedgedCalls []string
+	var loop *Loop
+
+	BeforeEach(func() {
+		wedgedCalls = nil
+		aggregator = health.NewHealthAggregator()
+		watchdog = New(Config{
+			OnWedged: func(name string) {
+				wedgedCalls = append(wedgedCalls, name)
+			},
+		}, aggregator)
+		loop = watchdog.Register("test", 50*time.Millisecond)
+	})
+
+	It("should start ready", func() {
+		Expect(watchdog.Check()).To(BeEmpty())
+		Expect(aggregator.Summary().Ready).To(BeTrue())
+	})
+	It("should leave a loop that checks in alone", func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			loop.CheckIn()
+			Expect(watchdog.Check()).To(BeEmpty())
+		}
+		Expect(wedgedCalls).To(BeEmpty())
+	})
+	It("should escalate once when a loop stops checking in", func() {
+		time.Sleep(60 * time.Millisecond)
+		Expect(watchdog.Check()).To(Equal([]string{"test"}))
+		Expect(aggregator.Summary().Ready).To(BeFalse())
+		Expect(aggregator.Summary().Live).To(BeTrue())
+		Expect(watchdog.Check()).To(Equal([]string{"test"}))
+		Expect(wedgedCalls).To(Equal([]string{"test"}))
+	})
+	It("should recover when the loop checks in again", func() {
+		time.Sleep(60 * time.Millisecond)
+		watchdog.Check()
+		loop.CheckIn()
+		Expect(watchdog.Check()).To(BeEmpty())
+		Expect(aggregator.Summary().Ready).To(BeTrue())
+	})
+	It("should only report the wedged loop", func() {
+		other := watchdog.Register("other", time.Hour)
+		time.Sleep(60 * time.Millisecond)
+		other.CheckIn()
+		Expect(watchdog.Check()).To(Equal([]string{"test"}))
+	})
+	It("should suggest an idle interval well inside the timeout", func() {
+		Expect(loop.IdleInterval()).To(Equal(12500 * time.Microsecond))
+	})
+})
+
+var _ = Describe("nil Loop", func() {
+	It("should ignore check-ins", func() {
+		var loop *Loop
+		loop.CheckIn()
+		Expect(loop.IdleInterval()).To(BeZero())
+	})
+})
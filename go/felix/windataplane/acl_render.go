@@ -0,0 +1,267 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package windataplane
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/set"
+	"math"
+	"net"
+	"sort"
+	"strings"
+)
+
+var ErrTooManyRules = errors.New("endpoint needs more ACL rules than HNS priorities allow")
+
+var protocolNameToNumber = map[string]uint16{
+	"icmp":    1,
+	"tcp":     6,
+	"udp":     17,
+	"gre":     47,
+	"esp":     50,
+	"ah":      51,
+	"icmpv6":  58,
+	"sctp":    132,
+	"udplite": 136,
+}
+
+// policyStore holds the active policies, profiles and IP sets, which are
+// needed to render an endpoint's ACL rules.
+type policyStore struct {
+	policies map[proto.PolicyID]*proto.Policy
+	profiles map[proto.ProfileID]*proto.Profile
+	// ipSets maps from IP set ID to the set of member strings.
+	ipSets map[string]set.Set
+}
+
+func newPolicyStore() *policyStore {
+	return &policyStore{
+		policies: map[proto.PolicyID]*proto.Policy{},
+		profiles: map[proto.ProfileID]*proto.Profile{},
+		ipSets:   map[string]set.Set{},
+	}
+}
+
+// EndpointACLRules renders the complete list of ACL rules for the given
+// endpoint.
+//
+// HNS evaluates an endpoint's rules in priority order and has no equivalent
+// of Calico's tiers, so "next-tier" rules can't be represented.  Hence, the
+// rules are built from the first tier that has any policies, followed by a
+// rule that blocks all other traffic.  If no tier has any policies, the
+// endpoint's profiles are used instead.  Rules that use matches that HNS
+// doesn't support (negated matches, ICMP type and IPv6) are skipped.
+func (s *policyStore) EndpointACLRules(ep *proto.WorkloadEndpoint) ([]*ACLRule, error) {
+	var rules []*ACLRule
+	for _, dir := range []ACLDirection{ACLDirectionIn, ACLDirectionOut} {
+		rules = append(rules, s.directionACLRules(ep, dir)...)
+	}
+	if len(rules) > int(math.MaxUint16-FirstRulePriority) {
+		return nil, ErrTooManyRules
+	}
+	for i, rule := range rules {
+		rule.Priority = FirstRulePriority + uint16(i)
+	}
+	return rules, nil
+}
+
+func (s *policyStore) directionACLRules(ep *proto.WorkloadEndpoint, dir ACLDirection) []*ACLRule {
+	var aclRules []*ACLRule
+	for _, tier := range ep.Tiers {
+		if len(tier.Policies) == 0 {
+			continue
+		}
+		for _, name := range tier.Policies {
+			policy := s.policies[proto.PolicyID{Tier: tier.Name, Name: name}]
+			if policy == nil {
+				continue
+			}
+			rules := policy.InboundRules
+			if dir == ACLDirectionOut {
+				rules = policy.OutboundRules
+			}
+			idPrefix := fmt.Sprintf("policy-%s/%s", tier.Name, name)
+			aclRules = append(aclRules, s.rulesToACLRules(idPrefix, rules, dir)...)
+		}
+		return append(aclRules, blockAllRule("tier-"+tier.Name, dir))
+	}
+	for _, name := range ep.ProfileIds {
+		profile := s.profiles[proto.ProfileID{Name: name}]
+		if profile == nil {
+			continue
+		}
+		rules := profile.InboundRules
+		if dir == ACLDirectionOut {
+			rules = profile.OutboundRules
+		}
+		aclRules = append(aclRules, s.rulesToACLRules("profile-"+name, rules, dir)...)
+	}
+	return append(aclRules, blockAllRule("profiles", dir))
+}
+
+func blockAllRule(idPrefix string, dir ACLDirection) *ACLRule {
+	return &ACLRule{
+		ID:        fmt.Sprintf("%s-%v-block-all", idPrefix, dir),
+		Protocol:  ProtocolAny,
+		Action:    ACLActionBlock,
+		Direction: dir,
+	}
+}
+
+func (s *policyStore) rulesToACLRules(idPrefix string, rules []*proto.Rule, dir ACLDirection) []*ACLRule {
+	var aclRules []*ACLRule
+	for i, rule := range rules {
+		id := fmt.Sprintf("%s-%v-%d", idPrefix, dir, i)
+		logCxt := log.WithFields(log.Fields{"id": id, "rule": rule})
+		aclRule, err := s.ruleToACLRule(rule, dir)
+		if err != nil {
+			logCxt.WithError(err).Warn("Skipping rule that can't be rendered to HNS")
+			continue
+		}
+		if aclRule == nil {
+			logCxt.Debug("Skipping rule that can't match any traffic")
+			continue
+		}
+		aclRule.ID = id
+		aclRules = append(aclRules, aclRule)
+	}
+	return aclRules
+}
+
+// ruleToACLRule converts a single rule.  It returns nil, with no error, if the
+// rule can't match any IPv4 traffic.
+func (s *policyStore) ruleToACLRule(rule *proto.Rule, dir ACLDirection) (*ACLRule, error) {
+	if rule.IpVersion == proto.IPVersion_IPV6 {
+		return nil, nil
+	}
+	if rule.NotProtocol != nil ||
+		rule.NotSrcNet != "" || rule.NotDstNet != "" ||
+		len(rule.NotSrcPorts) > 0 || len(rule.NotDstPorts) > 0 ||
+		len(rule.NotSrcIpSetIds) > 0 || len(rule.NotDstIpSetIds) > 0 {
+		return nil, errors.New("negated matches are not supported")
+	}
+	if rule.Icmp != nil || rule.NotIcmp != nil {
+		return nil, errors.New("ICMP type matches are not supported")
+	}
+
+	aclRule := &ACLRule{Direction: dir}
+	switch rule.Action {
+	case "", "allow":
+		aclRule.Action = ACLActionAllow
+	case "deny":
+		aclRule.Action = ACLActionBlock
+	default:
+		return nil, fmt.Errorf("action %q is not supported", rule.Action)
+	}
+
+	aclRule.Protocol = ProtocolAny
+	if rule.Protocol != nil {
+		switch p := rule.Protocol.NumberOrName.(type) {
+		case *proto.Protocol_Number:
+			aclRule.Protocol = uint16(p.Number)
+		case *proto.Protocol_Name:
+			num, ok := protocolNameToNumber[p.Name]
+			if !ok {
+				return nil, fmt.Errorf("unknown protocol %q", p.Name)
+			}
+			aclRule.Protocol = num
+		}
+	}
+
+	srcAddrs, ok := s.addressesForMatch(rule.SrcNet, rule.SrcIpSetIds)
+	if !ok {
+		return nil, nil
+	}
+	dstAddrs, ok := s.addressesForMatch(rule.DstNet, rule.DstIpSetIds)
+	if !ok {
+		return nil, nil
+	}
+	srcPorts := portRangesToString(rule.SrcPorts)
+	dstPorts := portRangesToString(rule.DstPorts)
+
+	// HNS rules are expressed relative to the endpoint; for inbound
+	// traffic, the endpoint is the destination.
+	if dir == ACLDirectionIn {
+		aclRule.RemoteAddresses, aclRule.RemotePorts = srcAddrs, srcPorts
+		aclRule.LocalAddresses, aclRule.LocalPorts = dstAddrs, dstPorts
+	} else {
+		aclRule.LocalAddresses, aclRule.LocalPorts = srcAddrs, srcPorts
+		aclRule.RemoteAddresses, aclRule.RemotePorts = dstAddrs, dstPorts
+	}
+	return aclRule, nil
+}
+
+// addressesForMatch calculates the HNS address list for a CIDR match combined
+// with a list of IP set matches.  Since HNS has no IP sets, the IP sets are
+// expanded into their members, which are filtered to those that are in all
+// the IP sets and the CIDR.  Returns false if no IPv4 address can match.
+func (s *policyStore) addressesForMatch(cidr string, ipSetIDs []string) (string, bool) {
+	var ipNet *net.IPNet
+	if cidr != "" {
+		var err error
+		_, ipNet, err = net.ParseCIDR(cidr)
+		if err != nil || ipNet.IP.To4() == nil {
+			return "", false
+		}
+	}
+	if len(ipSetIDs) == 0 {
+		return cidr, true
+	}
+	for _, id := range ipSetIDs {
+		if s.ipSets[id] == nil {
+			log.WithField("id", id).Warn("Rule references unknown IP set")
+			return "", false
+		}
+	}
+
+	var members []string
+	s.ipSets[ipSetIDs[0]].Iter(func(item interface{}) error {
+		member := item.(string)
+		ip := net.ParseIP(member)
+		if ip == nil || ip.To4() == nil {
+			return nil
+		}
+		if ipNet != nil && !ipNet.Contains(ip) {
+			return nil
+		}
+		for _, id := range ipSetIDs[1:] {
+			if !s.ipSets[id].Contains(member) {
+				return nil
+			}
+		}
+		members = append(members, member)
+		return nil
+	})
+	if len(members) == 0 {
+		return "", false
+	}
+	sort.Strings(members)
+	return strings.Join(members, ","), true
+}
+
+func portRangesToString(ranges []*proto.PortRange) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		if r.First == r.Last {
+			parts[i] = fmt.Sprintf("%d", r.First)
+		} else {
+			parts[i] = fmt.Sprintf("%d-%d", r.First, r.Last)
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package windataplane
+
+import "fmt"
+
+type ACLAction string
+
+const (
+	ACLActionAllow ACLAction = "Allow"
+	ACLActionBlock ACLAction = "Block"
+)
+
+type ACLDirection string
+
+const (
+	ACLDirectionIn  ACLDirection = "In"
+	ACLDirectionOut ACLDirection = "Out"
+)
+
+const (
+	// ProtocolAny is the HNS protocol number that matches all protocols.
+	ProtocolAny uint16 = 256
+
+	// FirstRulePriority is the priority of the first ACL rule that we
+	// program.  HNS evaluates rules in ascending order of priority.
+	FirstRulePriority uint16 = 1000
+)
+
+// ACLRule is our model of an HNS ACL policy.  Addresses and ports are
+// comma-separated lists, as expected by HNS; an empty list matches
+// everything.
+type ACLRule struct {
+	ID              string
+	Protocol        uint16
+	Action          ACLAction
+	Direction       ACLDirection
+	LocalAddresses  string
+	RemoteAddresses string
+	LocalPorts      string
+	RemotePorts     string
+	Priority        uint16
+}
+
+func (r *ACLRule) String() string {
+	return fmt.Sprintf("%v %v %s proto=%d local=%q:%q remote=%q:%q prio=%d",
+		r.Direction, r.Action, r.ID, r.Protocol,
+		r.LocalAddresses, r.LocalPorts, r.RemoteAddresses, r.RemotePorts,
+		r.Priority)
+}
+
+// HNSAPI is the subset of the Windows Host Networking Service API that the
+// dataplane uses.
+type HNSAPI interface {
+	// ApplyACLRules replaces all the ACL rules on the named HNS endpoint.
+	ApplyACLRules(endpointName string, rules []*ACLRule) error
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package windataplane
+
+import (
+	"github.com/Microsoft/hcsshim"
+)
+
+// NewHNS returns an HNSAPI that makes calls to the real Host Networking
+// Service.
+func NewHNS() HNSAPI {
+	return hnsShim{}
+}
+
+type hnsShim struct{}
+
+func (hnsShim) ApplyACLRules(endpointName string, rules []*ACLRule) error {
+	endpoint, err := hcsshim.GetHNSEndpointByName(endpointName)
+	if err != nil {
+		return err
+	}
+	policies := make([]*hcsshim.ACLPolicy, len(rules))
+	for i, rule := range rules {
+		policies[i] = &hcsshim.ACLPolicy{
+			Type:            hcsshim.ACL,
+			Id:              rule.ID,
+			Protocol:        rule.Protocol,
+			Action:          hcsshim.ActionType(rule.Action),
+			Direction:       hcsshim.DirectionType(rule.Direction),
+			LocalAddresses:  rule.LocalAddresses,
+			RemoteAddresses: rule.RemoteAddresses,
+			LocalPorts:      rule.LocalPorts,
+			RemotePorts:     rule.RemotePorts,
+			RuleType:        hcsshim.Switch,
+			Priority:        rule.Priority,
+		}
+	}
+	return endpoint.ApplyACLPolicy(policies...)
+}
@@ -0,0 +1,310 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The windataplane package implements a dataplane driver for Windows hosts,
+// which programs Felix's policy model as ACL rules on the workloads' Host
+// Networking Service (HNS) endpoints.
+//
+// The driver runs in-process; it implements the same message-based
+// interface as the external drivers (see the dataplane package).  It
+// supports workload endpoints only.
+package windataplane
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/felix/go/felix/backoff"
+	"github.com/projectcalico/felix/go/felix/health"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"github.com/projectcalico/felix/go/felix/set"
+	"github.com/projectcalico/felix/go/felix/statusrep"
+	"time"
+)
+
+// backoffName identifies the driver's backoff manager in the log and health
+// reports.
+const backoffName = "windows_dataplane"
+
+type Config struct {
+	// ReportingInterval is the interval at which the driver sends process
+	// status updates.  It is also the interval at which we check for failed
+	// updates to retry; each update is only retried once its backoff has
+	// expired.
+	ReportingInterval time.Duration
+	// Backoff controls the backoff of failed updates.  The initial delay
+	// defaults to ReportingInterval.
+	Backoff backoff.Config
+	// HealthAggregator, if non-nil, receives the health of the updates.
+	HealthAggregator *health.HealthAggregator
+}
+
+type WindowsDataplane struct {
+	toDataplane   chan interface{}
+	fromDataplane chan interface{}
+
+	config Config
+	hns    HNSAPI
+
+	endpoints       map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint
+	policyStore     *policyStore
+	dirtyEndpoints  set.Set
+	datastoreInSync bool
+
+	statusCalc *statusrep.EndpointStatusCalculator
+	startTime  time.Time
+
+	backoffs *backoff.Manager
+}
+
+func NewWinDataplaneDriver(hns HNSAPI, config Config) *WindowsDataplane {
+	backoffConfig := config.Backoff
+	if backoffConfig.InitialDelay == 0 {
+		backoffConfig.InitialDelay = config.ReportingInterval
+	}
+	d := &WindowsDataplane{
+		toDataplane:    make(chan interface{}, 100),
+		fromDataplane:  make(chan interface{}, 100),
+		config:         config,
+		hns:            hns,
+		endpoints:      map[proto.WorkloadEndpointID]*proto.WorkloadEndpoint{},
+		policyStore:    newPolicyStore(),
+		dirtyEndpoints: set.New(),
+		startTime:      time.Now(),
+		backoffs:       backoff.NewManager(backoffName, backoffConfig, config.HealthAggregator),
+	}
+	d.statusCalc = statusrep.NewEndpointStatusCalculator(func(msg interface{}) {
+		d.fromDataplane <- msg
+	})
+	return d
+}
+
+func (d *WindowsDataplane) Start() {
+	go d.loop()
+}
+
+func (d *WindowsDataplane) SendMessage(msg interface{}) error {
+	d.toDataplane <- msg
+	return nil
+}
+
+func (d *WindowsDataplane) RecvMessage() (interface{}, error) {
+	return <-d.fromDataplane, nil
+}
+
+func (d *WindowsDataplane) loop() {
+	log.Info("Windows dataplane driver running")
+	reportTicker := time.NewTicker(d.config.ReportingInterval)
+	d.reportProcessStatus()
+	for {
+		select {
+		case msg := <-d.toDataplane:
+			d.onUpdate(msg)
+			// Process any other pending updates before we apply, so that
+			// we batch up changes.
+		batchLoop:
+			for {
+				select {
+				case msg := <-d.toDataplane:
+					d.onUpdate(msg)
+				default:
+					break batchLoop
+				}
+			}
+			if d.datastoreInSync {
+				d.apply()
+			}
+		case <-reportTicker.C:
+			d.reportProcessStatus()
+			if d.datastoreInSync && d.dirtyEndpoints.Len() > 0 {
+				log.Info("Retrying failed endpoint updates")
+				d.apply()
+			}
+		}
+	}
+}
+
+func (d *WindowsDataplane) onUpdate(msg interface{}) {
+	log.WithField("msg", msg).Debug("Dataplane update")
+	store := d.policyStore
+	switch msg := msg.(type) {
+	case *proto.InSync:
+		log.Info("Datastore in sync, applying dataplane updates")
+		d.datastoreInSync = true
+	case *proto.IPSetUpdate:
+		members := set.New()
+		for _, m := range msg.Members {
+			members.Add(m)
+		}
+		store.ipSets[msg.Id] = members
+		d.markEndpointsDirty(func(rule *proto.Rule) bool { return ruleUsesIPSet(rule, msg.Id) })
+	case *proto.IPSetDeltaUpdate:
+		members := store.ipSets[msg.Id]
+		if members == nil {
+			log.WithField("id", msg.Id).Panic("Delta update for unknown IP set")
+		}
+		for _, m := range msg.AddedMembers {
+			members.Add(m)
+		}
+		for _, m := range msg.RemovedMembers {
+			members.Discard(m)
+		}
+		d.markEndpointsDirty(func(rule *proto.Rule) bool { return ruleUsesIPSet(rule, msg.Id) })
+	case *proto.IPSetRemove:
+		delete(store.ipSets, msg.Id)
+	case *proto.ActivePolicyUpdate:
+		store.policies[*msg.Id] = msg.Policy
+		d.markPolicyUsersDirty(*msg.Id)
+	case *proto.ActivePolicyRemove:
+		delete(store.policies, *msg.Id)
+		d.markPolicyUsersDirty(*msg.Id)
+	case *proto.ActiveProfileUpdate:
+		store.profiles[*msg.Id] = msg.Profile
+		d.markProfileUsersDirty(*msg.Id)
+	case *proto.ActiveProfileRemove:
+		delete(store.profiles, *msg.Id)
+		d.markProfileUsersDirty(*msg.Id)
+	case *proto.WorkloadEndpointUpdate:
+		d.endpoints[*msg.Id] = msg.Endpoint
+		d.markEndpointDirty(*msg.Id)
+		d.statusCalc.OnEndpointUpdate(msg.Id)
+	case *proto.WorkloadEndpointRemove:
+		// HNS removes the ACLs along with the endpoint so we only need
+		// to update our state.
+		delete(d.endpoints, *msg.Id)
+		d.dirtyEndpoints.Discard(*msg.Id)
+		d.statusCalc.OnEndpointRemove(msg.Id)
+	case *proto.HostEndpointUpdate:
+		log.WithField("id", msg.Id).Warn(
+			"Host endpoints are not supported on Windows, ignoring")
+	default:
+		log.WithField("msg", msg).Debug("Ignoring unsupported update")
+	}
+}
+
+func (d *WindowsDataplane) markPolicyUsersDirty(id proto.PolicyID) {
+	for epID, ep := range d.endpoints {
+		for _, tier := range ep.Tiers {
+			for _, name := range tier.Policies {
+				if tier.Name == id.Tier && name == id.Name {
+					d.markEndpointDirty(epID)
+				}
+			}
+		}
+	}
+}
+
+func (d *WindowsDataplane) markProfileUsersDirty(id proto.ProfileID) {
+	for epID, ep := range d.endpoints {
+		for _, name := range ep.ProfileIds {
+			if name == id.Name {
+				d.markEndpointDirty(epID)
+			}
+		}
+	}
+}
+
+// markEndpointsDirty marks dirty any endpoint that uses a policy or profile
+// with a rule that matches the given predicate.
+func (d *WindowsDataplane) markEndpointsDirty(pred func(rule *proto.Rule) bool) {
+	anyMatch := func(ruleLists ...[]*proto.Rule) bool {
+		for _, rules := range ruleLists {
+			for _, rule := range rules {
+				if pred(rule) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for id, policy := range d.policyStore.policies {
+		if anyMatch(policy.InboundRules, policy.OutboundRules) {
+			d.markPolicyUsersDirty(id)
+		}
+	}
+	for id, profile := range d.policyStore.profiles {
+		if anyMatch(profile.InboundRules, profile.OutboundRules) {
+			d.markProfileUsersDirty(id)
+		}
+	}
+}
+
+func ruleUsesIPSet(rule *proto.Rule, id string) bool {
+	for _, ids := range [][]string{
+		rule.SrcIpSetIds, rule.DstIpSetIds,
+		rule.NotSrcIpSetIds, rule.NotDstIpSetIds,
+	} {
+		for _, ipSetID := range ids {
+			if ipSetID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// markEndpointDirty queues the endpoint to be reprogrammed.  Since the
+// endpoint has changed, any backoff from an earlier failure no longer applies.
+func (d *WindowsDataplane) markEndpointDirty(id interface{}) {
+	d.dirtyEndpoints.Add(id)
+	d.backoffs.Forget(endpointKey(id))
+}
+
+// endpointKey returns the key of the endpoint's updates in the backoff
+// manager.
+func endpointKey(id interface{}) string {
+	return fmt.Sprintf("%#v", id)
+}
+
+// apply programs the ACL rules for each dirty endpoint.  Endpoints that fail
+// are left dirty so that they are retried once their backoff expires.
+func (d *WindowsDataplane) apply() {
+	failedEndpoints := set.New()
+	d.dirtyEndpoints.Iter(func(item interface{}) error {
+		id := item.(proto.WorkloadEndpointID)
+		ep := d.endpoints[id]
+		logCxt := log.WithFields(log.Fields{"id": id, "name": ep.Name})
+		err := d.backoffs.Apply(endpointKey(id), func() error {
+			rules, err := d.policyStore.EndpointACLRules(ep)
+			if err != nil {
+				return err
+			}
+			logCxt.WithField("numRules", len(rules)).Info("Applying ACL rules to endpoint")
+			return d.hns.ApplyACLRules(ep.Name, rules)
+		})
+		if err == backoff.ErrBackingOff {
+			// Nothing has changed since the last attempt.
+			failedEndpoints.Add(id)
+			return nil
+		}
+		if err != nil {
+			logCxt.WithError(err).Error("Failed to apply ACL rules to endpoint")
+			failedEndpoints.Add(id)
+		}
+		d.statusCalc.OnPolicyProgrammed(&id, err)
+		// HNS endpoints have no separate oper state; if HNS accepted the
+		// rules, the endpoint exists.
+		d.statusCalc.OnIfaceStateUpdate(&id, err == nil)
+		return nil
+	})
+	d.dirtyEndpoints = failedEndpoints
+	d.statusCalc.Flush()
+}
+
+func (d *WindowsDataplane) reportProcessStatus() {
+	now := time.Now()
+	d.fromDataplane <- &proto.ProcessStatusUpdate{
+		IsoTimestamp: now.UTC().Format(time.RFC3339),
+		Uptime:       now.Sub(d.startTime).Seconds(),
+	}
+}
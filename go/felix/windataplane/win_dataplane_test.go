@@ -0,0 +1,258 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package windataplane_test
+
+import (
+	. "github.com/projectcalico/felix/go/felix/windataplane"
+
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/projectcalico/felix/go/felix/proto"
+	"sync"
+	"time"
+)
+
+type mockHNS struct {
+	lock     sync.Mutex
+	rules    map[string][]*ACLRule
+	failNext bool
+}
+
+func (h *mockHNS) ApplyACLRules(endpointName string, rules []*ACLRule) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.failNext {
+		h.failNext = false
+		return errors.New("HNS failure")
+	}
+	h.rules[endpointName] = rules
+	return nil
+}
+
+func (h *mockHNS) RulesFor(endpointName string) []*ACLRule {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.rules[endpointName]
+}
+
+var (
+	wlEPID = proto.WorkloadEndpointID{
+		OrchestratorId: "k8s",
+		WorkloadId:     "pod-1",
+		EndpointId:     "eth0",
+	}
+	polID = proto.PolicyID{Tier: "default", Name: "pol-1"}
+)
+
+func blockAll(id string, dir ACLDirection, prio uint16) *ACLRule {
+	return &ACLRule{
+		ID:        id,
+		Protocol:  ProtocolAny,
+		Action:    ACLActionBlock,
+		Direction: dir,
+		Priority:  prio,
+	}
+}
+
+var _ = Describe("WindowsDataplane", func() {
+	var hns *mockHNS
+	var dp *WindowsDataplane
+
+	// recvStatus returns the next endpoint status message, skipping
+	// process status updates.
+	recvStatus := func() interface{} {
+		for {
+			msg, err := dp.RecvMessage()
+			Expect(err).NotTo(HaveOccurred())
+			if _, ok := msg.(*proto.ProcessStatusUpdate); !ok {
+				return msg
+			}
+		}
+	}
+	wlUpdate := func(profiles []string, policies []string) *proto.WorkloadEndpointUpdate {
+		ep := &proto.WorkloadEndpoint{
+			Name:       "hns-ep-1",
+			ProfileIds: profiles,
+		}
+		if policies != nil {
+			ep.Tiers = []*proto.TierInfo{{Name: "default", Policies: policies}}
+		}
+		return &proto.WorkloadEndpointUpdate{Id: &wlEPID, Endpoint: ep}
+	}
+	statusUpdate := func(status string) *proto.WorkloadEndpointStatusUpdate {
+		return &proto.WorkloadEndpointStatusUpdate{
+			Id:     &wlEPID,
+			Status: &proto.EndpointStatus{Status: status},
+		}
+	}
+
+	epRules := func() []*ACLRule {
+		return hns.RulesFor("hns-ep-1")
+	}
+
+	BeforeEach(func() {
+		hns = &mockHNS{rules: map[string][]*ACLRule{}}
+		dp = NewWinDataplaneDriver(hns, Config{ReportingInterval: time.Hour})
+		dp.Start()
+	})
+
+	It("should send a process status update at start of day", func() {
+		msg, err := dp.RecvMessage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg).To(BeAssignableToTypeOf(&proto.ProcessStatusUpdate{}))
+	})
+
+	It("should not program anything before in-sync", func() {
+		dp.SendMessage(wlUpdate(nil, nil))
+		Consistently(epRules, "50ms").Should(BeNil())
+	})
+
+	Describe("after in-sync, with a policy", func() {
+		BeforeEach(func() {
+			dp.SendMessage(&proto.IPSetUpdate{
+				Id:      "ipset-1",
+				Members: []string{"10.0.0.2", "10.0.0.1", "10.1.0.1", "fe80::1"},
+			})
+			dp.SendMessage(&proto.ActivePolicyUpdate{
+				Id: &polID,
+				Policy: &proto.Policy{
+					InboundRules: []*proto.Rule{
+						{
+							Action:      "allow",
+							Protocol:    &proto.Protocol{&proto.Protocol_Name{"tcp"}},
+							SrcNet:      "10.0.0.0/16",
+							SrcIpSetIds: []string{"ipset-1"},
+							DstPorts: []*proto.PortRange{
+								{First: 80, Last: 80},
+								{First: 8080, Last: 8081},
+							},
+						},
+						// Unsupported, should be skipped.
+						{Action: "allow", NotSrcNet: "10.0.0.0/8"},
+						{Action: "allow", IpVersion: proto.IPVersion_IPV6},
+					},
+					OutboundRules: []*proto.Rule{
+						{
+							Action:   "deny",
+							Protocol: &proto.Protocol{&proto.Protocol_Number{17}},
+							DstNet:   "10.2.0.0/16",
+							SrcPorts: []*proto.PortRange{{First: 53, Last: 53}},
+						},
+					},
+				},
+			})
+			dp.SendMessage(&proto.InSync{})
+		})
+
+		It("should render policy to ACL rules", func() {
+			dp.SendMessage(wlUpdate([]string{"prof-1"}, []string{"pol-1"}))
+			Eventually(epRules).Should(Equal([]*ACLRule{
+				{
+					ID:              "policy-default/pol-1-In-0",
+					Protocol:        6,
+					Action:          ACLActionAllow,
+					Direction:       ACLDirectionIn,
+					RemoteAddresses: "10.0.0.1,10.0.0.2",
+					LocalPorts:      "80,8080-8081",
+					Priority:        1000,
+				},
+				blockAll("tier-default-In-block-all", ACLDirectionIn, 1001),
+				{
+					ID:              "policy-default/pol-1-Out-0",
+					Protocol:        17,
+					Action:          ACLActionBlock,
+					Direction:       ACLDirectionOut,
+					RemoteAddresses: "10.2.0.0/16",
+					LocalPorts:      "53",
+					Priority:        1002,
+				},
+				blockAll("tier-default-Out-block-all", ACLDirectionOut, 1003),
+			}))
+			Expect(recvStatus()).To(Equal(statusUpdate("up")))
+		})
+		It("should fall back to profiles if there are no policies", func() {
+			dp.SendMessage(&proto.ActiveProfileUpdate{
+				Id: &proto.ProfileID{Name: "prof-1"},
+				Profile: &proto.Profile{
+					InboundRules: []*proto.Rule{{Action: "allow"}},
+				},
+			})
+			dp.SendMessage(wlUpdate([]string{"prof-1"}, nil))
+			Eventually(epRules).Should(Equal([]*ACLRule{
+				{
+					ID:        "profile-prof-1-In-0",
+					Protocol:  ProtocolAny,
+					Action:    ACLActionAllow,
+					Direction: ACLDirectionIn,
+					Priority:  1000,
+				},
+				blockAll("profiles-In-block-all", ACLDirectionIn, 1001),
+				blockAll("profiles-Out-block-all", ACLDirectionOut, 1002),
+			}))
+		})
+		It("should skip a rule whose IP sets match nothing", func() {
+			dp.SendMessage(&proto.IPSetDeltaUpdate{
+				Id:             "ipset-1",
+				RemovedMembers: []string{"10.0.0.1", "10.0.0.2"},
+			})
+			dp.SendMessage(wlUpdate(nil, []string{"pol-1"}))
+			Eventually(epRules).Should(HaveLen(3))
+			Expect(epRules()[0].ID).To(Equal("tier-default-In-block-all"))
+		})
+
+		Describe("with a programmed endpoint", func() {
+			BeforeEach(func() {
+				dp.SendMessage(wlUpdate(nil, []string{"pol-1"}))
+				Expect(recvStatus()).To(Equal(statusUpdate("up")))
+			})
+
+			It("should reprogram the endpoint when an IP set changes", func() {
+				dp.SendMessage(&proto.IPSetDeltaUpdate{
+					Id:           "ipset-1",
+					AddedMembers: []string{"10.0.0.3"},
+				})
+				Eventually(func() string {
+					return epRules()[0].RemoteAddresses
+				}).Should(Equal("10.0.0.1,10.0.0.2,10.0.0.3"))
+			})
+			It("should report an error if HNS fails", func() {
+				hns.lock.Lock()
+				hns.failNext = true
+				hns.lock.Unlock()
+				dp.SendMessage(&proto.ActivePolicyUpdate{Id: &polID, Policy: &proto.Policy{}})
+				Expect(recvStatus()).To(Equal(statusUpdate("error")))
+			})
+			It("should apply a new update straight away after a failure", func() {
+				hns.lock.Lock()
+				hns.failNext = true
+				hns.lock.Unlock()
+				dp.SendMessage(&proto.ActivePolicyUpdate{Id: &polID, Policy: &proto.Policy{}})
+				Expect(recvStatus()).To(Equal(statusUpdate("error")))
+				// The retry interval is an hour, so this is only
+				// programmed if the update resets the backoff.
+				dp.SendMessage(&proto.ActivePolicyUpdate{Id: &polID, Policy: &proto.Policy{
+					InboundRules: []*proto.Rule{{Action: "allow"}},
+				}})
+				Expect(recvStatus()).To(Equal(statusUpdate("up")))
+			})
+			It("should report removal of the endpoint", func() {
+				dp.SendMessage(&proto.WorkloadEndpointRemove{Id: &wlEPID})
+				dp.SendMessage(&proto.InSync{})
+				Expect(recvStatus()).To(Equal(&proto.WorkloadEndpointStatusRemove{Id: &wlEPID}))
+			})
+		})
+	})
+})
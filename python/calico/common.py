@@ -32,7 +32,7 @@ from types import StringTypes
 import netaddr
 import netaddr.core
 from netaddr.strategy import eui48
-from calico.felix.futils import IPV4, IP_TYPE_TO_VERSION
+from calico.felix.futils import IPV4, IP_TYPE_TO_VERSION, workload_iface_prefix
 
 from calico.datamodel_v1 import TieredPolicyId, LABEL_CHARS
 
@@ -50,6 +50,13 @@ FORMAT_STRING_GEVENT = '%(asctime)s [%(levelname)s][%(process)s/%(tid)d] %(name)
 # string used by the logger.
 SYSLOG_FORMAT_STRING = '{excname}[%(process)s]: %(module)s@%(lineno)d %(message)s'
 
+# Host endpoint name that matches every host interface not claimed by another
+# host endpoint.
+WILDCARD_IFACE_NAME = "*"
+
+# Maximum length of a Linux interface name.
+MAX_IFACE_NAME_LEN = 15
+
 # White-list for the --protocol match criteria.  We allow the guaranteed
 # string shortcuts as well as int/string versions of the raw IDs.  We disallow
 # 0 because the kernel cannot match on it directly.
@@ -57,6 +64,16 @@ KERNEL_PROTOCOLS = set(["tcp", "udp", "icmp", "icmpv6", "sctp", "udplite"])
 KERNEL_PROTOCOLS.update(xrange(1, 256))
 KERNEL_PROTOCOLS.update(intern(str(p)) for p in xrange(1, 256))
 
+# Protocols that we accept by name but render by number, since iptables
+# resolves names using /etc/protocols, which doesn't always list them.  These
+# are the tunnel protocols used by VPNs: GRE, and IPsec's ESP and AH.
+PROTOCOL_NUMBERS_BY_NAME = {
+    "gre": "47",
+    "esp": "50",
+    "ah": "51",
+}
+KERNEL_PROTOCOLS.update(PROTOCOL_NUMBERS_BY_NAME)
+
 # Protocols that support a port match in iptables.  We allow the name and
 # protocol number.
 KERNEL_PORT_PROTOCOLS = set([
@@ -77,8 +94,18 @@ NEGATABLE_MATCH_KEYS = [
     "dst_ports",
     "icmp_type",
     "icmp_code",
+    "pkt_type",
 ]
 
+# Link-layer packet types that a rule can match with "pkt_type".
+KNOWN_PKT_TYPES = set(["unicast", "broadcast", "multicast"])
+
+# The ranges of multicast group addresses, by IP version.
+MULTICAST_CIDRS = {
+    4: netaddr.IPNetwork("224.0.0.0/4"),
+    6: netaddr.IPNetwork("ff00::/8"),
+}
+
 # Valid keys for a rule JSON dict.
 KNOWN_RULE_KEYS = set(
     [
@@ -169,6 +196,15 @@ def canonicalise_cidr(cidr, version):
     return intern(str(nw))
 
 
+def is_multicast_cidr(cidr):
+    """
+    Returns true if the given CIDR only contains multicast group
+    addresses.
+    """
+    nw = netaddr.IPNetwork(cidr)
+    return nw in MULTICAST_CIDRS[nw.version]
+
+
 def canonicalise_mac(mac):
     # Use the Unix dialect, which uses ':' for its separator instead of
     # '-'.  This fits best with what iptables is expecting.
@@ -335,8 +371,8 @@ def validate_endpoint(config, combined_id, endpoint):
         issues.append("Missing 'name' field.")
     elif (isinstance(endpoint['name'], StringTypes)
             and combined_id.host == config.HOSTNAME
-            and not any(endpoint["name"].startswith(prefix)
-                        for prefix in config.IFACE_PREFIX)):
+            and not workload_iface_prefix(endpoint["name"],
+                                          config.IFACE_PREFIX)):
         # Only test the interface for local endpoints - remote hosts may have
         # a different interface prefix.
         issues.append("Interface %r does not start with any of %r." %
@@ -387,10 +423,27 @@ def validate_host_endpoint(config, combined_id, endpoint):
     # interface or at least one expected IP address.
     expected_ip_present = (endpoint.get("expected_ipv4_addrs") or
                            endpoint.get("expected_ipv6_addrs"))
-    name_present = "name" in endpoint
+    name_present = "name" in endpoint or endpoint.get("interface_names")
     if not name_present and not expected_ip_present:
         issues.append("'name' or 'expected_ipvx_addr' must be present.")
 
+    # A host endpoint may cover several interfaces, such as the members of a
+    # bond, as long as it isn't a wildcard.
+    if "interface_names" in endpoint:
+        iface_names = endpoint["interface_names"]
+        if not isinstance(iface_names, list):
+            issues.append("'interface_names' should be a list.")
+        else:
+            for iface_name in iface_names:
+                if (not isinstance(iface_name, StringTypes) or
+                        not iface_name or
+                        len(iface_name) > MAX_IFACE_NAME_LEN or
+                        iface_name == WILDCARD_IFACE_NAME):
+                    issues.append("Invalid interface name %r." % iface_name)
+            if iface_names and endpoint.get("name") == WILDCARD_IFACE_NAME:
+                issues.append("'interface_names' cannot be combined with "
+                              "the wildcard name %r." % WILDCARD_IFACE_NAME)
+
     # Check the expected addr fields are valid IPs, if present.
     for key, version in [("expected_ipv4_addrs", 4),
                          ("expected_ipv6_addrs", 6)]:
@@ -727,6 +780,8 @@ def _validate_rule_match_criteria(rule, issues, neg_pfx):
         issues.append("Invalid %s %s in rule %s" %
                       (protocol_key, maybe_neg_proto, rule))
     elif maybe_neg_proto is not None:
+        maybe_neg_proto = PROTOCOL_NUMBERS_BY_NAME.get(maybe_neg_proto,
+                                                       maybe_neg_proto)
         maybe_neg_proto = intern(str(maybe_neg_proto))
         rule[protocol_key] = str(maybe_neg_proto)
 
@@ -771,6 +826,22 @@ def _validate_rule_match_criteria(rule, issues, neg_pfx):
                     issues.append("Invalid port %s (%s) in rule %s." %
                                   (port, error, rule))
 
+    pkt_type = rule.get(neg_pfx + "pkt_type")
+    if pkt_type is not None:
+        if pkt_type not in KNOWN_PKT_TYPES:
+            issues.append("Invalid packet type in rule %s." % rule)
+        elif pkt_type == "broadcast" and ip_version == 6:
+            issues.append("IPv6 has no broadcast packets, in rule %s." %
+                          rule)
+        elif (pkt_type == "multicast" and not neg_pfx and
+                rule.get("dst_net") and
+                validate_cidr(rule["dst_net"], ip_version) and
+                not is_multicast_cidr(rule["dst_net"])):
+            # The group is given by the destination, which must be a
+            # multicast address for the rule to ever match.
+            issues.append("Multicast rule with non-multicast destination "
+                          "in rule %s." % rule)
+
     action = rule.get(neg_pfx + 'action')
     if (action is not None and
             action not in KNOWN_ACTIONS):
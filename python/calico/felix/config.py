@@ -32,12 +32,28 @@ import re
 from calico import common
 
 # Logger
+from calico.felix.frules import FELIX_PREFIX
 from calico.felix.futils import find_set_bits
 
 log = logging.getLogger(__name__)
 
 FELIX_IPT_GENERATOR_PLUGIN_NAME = "calico.felix.iptables_generator"
 
+# Number of bits of the IptablesMarkMask that we need when KubeIPVSSupport is
+# enabled, which uses an extra bit.  See _finish_update().
+MIN_MARK_BITS_IPVS = 4
+
+# The hooks of the filter table that felix programs, by the names used in
+# config: the kernel chains of the same names, which jump to the felix chains.
+FILTER_HOOKS = ("input", "output", "forward")
+
+# The positions, relative to the jump to felix's chain in the kernel chain, at
+# which UserChainHooks can jump to a user chain.
+USER_CHAIN_POSITIONS = ("before", "after")
+
+# Chain names that iptables accepts: at most 28 characters, and no whitespace.
+USER_CHAIN_RE = re.compile(r'^[^\s]{1,28}$')
+
 # Convert log level names into python log levels.
 LOGLEVELS = {"none":      None,
              "debug":     logging.DEBUG,
@@ -74,16 +90,19 @@ class ConfigParameter(object):
     """
     def __init__(self, name, description, default, value_is_int=False,
                  value_is_bool=False, value_is_int_list=False,
-                 value_is_str_list=False):
+                 value_is_str_list=False, live=False):
         """
         Create a configuration parameter.
         :param str description: Description for logging
         :param str default: Default value
         :param bool value_is_int: Integer value?
+        :param bool live: Can the value be changed without restarting?
         """
         self.description = description
         self.name = name
+        self.default = default
         self.value = default
+        self.live = live
         self.value_is_int = value_is_int
         self.value_is_bool = value_is_bool
         self.value_is_int_list = value_is_int_list
@@ -168,20 +187,98 @@ class Config(object):
                            30, value_is_int=True)
         self.add_parameter("PeriodicResyncInterval",
                            "How often to do cleanups, seconds",
-                           60 * 60, value_is_int=True)
+                           60 * 60, value_is_int=True, live=True)
         self.add_parameter("HostInterfacePollInterval",
                            "How often (in seconds) to poll for updates to "
                            "host endpoint IP addresses, or 0 to disable.", 10,
                            value_is_int=True)
+        self.add_parameter("NeighborGCInterval",
+                           "How often (in seconds) to garbage collect the "
+                           "workloads' permanent ARP entries, or 0 to "
+                           "disable.", 600, value_is_int=True)
         self.add_parameter("IptablesRefreshInterval",
                            "How often to refresh iptables state, in seconds",
-                           60, value_is_int=True)
+                           60, value_is_int=True, live=True)
         self.add_parameter("MetadataAddr", "Metadata IP address or hostname",
                            "127.0.0.1")
         self.add_parameter("MetadataPort", "Metadata Port",
                            8775, value_is_int=True)
         self.add_parameter("InterfacePrefix", "Interface name prefix",
                            ["cali"], value_is_str_list=True)
+        self.add_parameter("InterfaceExclude",
+                           "Comma-separated list of interfaces that Felix "
+                           "must never manage, even if they match "
+                           "InterfacePrefix.  A trailing '+' matches any "
+                           "interface whose name starts with the rest of the "
+                           "entry, for example 'docker+'.",
+                           [], value_is_str_list=True)
+        self.add_parameter("DropInvalidConntrack",
+                           "Comma-separated list of the points at which to "
+                           "drop packets that conntrack classifies as "
+                           "INVALID; any of 'input', 'output' and 'forward', "
+                           "or 'none'.  Hosts with asymmetric routing, where "
+                           "conntrack only sees one direction of a flow, need "
+                           "to turn this off.",
+                           list(FILTER_HOOKS), value_is_str_list=True)
+        self.add_parameter("ConntrackBypassEnabled",
+                           "Whether to accept the packets of established "
+                           "workload flows without checking policy again.  "
+                           "If it's off, only the replies of established "
+                           "flows skip policy, so that policy changes apply "
+                           "to existing connections.",
+                           True, value_is_bool=True)
+        self.add_parameter("VerdictCacheEnabled",
+                           "Whether to record, in a connmark, that a "
+                           "workload flow was accepted by policy, so that "
+                           "its later packets are accepted without checking "
+                           "policy again.  The Go side of felix removes the "
+                           "marked flows when policy changes.  This only "
+                           "makes a difference if ConntrackBypassEnabled is "
+                           "off.",
+                           False, value_is_bool=True)
+        self.add_parameter("FlowLogsEnabled",
+                           "Whether workload endpoints' chains send the "
+                           "packets that get a policy verdict to NFLOG, "
+                           "where the Go side of felix collects them into "
+                           "flow logs.",
+                           False, value_is_bool=True)
+        self.add_parameter("AntiSpoofingEnabled",
+                           "Whether to drop traffic from a workload whose "
+                           "source address isn't one of the workload's own "
+                           "addresses or allowed source prefixes, in "
+                           "addition to the kernel's reverse path filter.",
+                           False, value_is_bool=True)
+        self.add_parameter("DropWorkloadRouterAdvertisements",
+                           "Whether to drop IPv6 router advertisements from "
+                           "workload interfaces, so that a workload can't "
+                           "act as a rogue router for the host and, through "
+                           "it, the other workloads.  The host's own router "
+                           "advertisements are still allowed.",
+                           False, value_is_bool=True)
+        self.add_parameter("DropWorkloadDHCPServers",
+                           "Whether to drop DHCP and DHCPv6 server messages "
+                           "from workload interfaces, so that a workload "
+                           "can't hand out addresses as a rogue DHCP server. "
+                           "DHCP servers running on the host are still "
+                           "allowed.",
+                           False, value_is_bool=True)
+        self.add_parameter("UserChainHooks",
+                           "Comma-separated list of chains, which felix "
+                           "doesn't manage, to jump to from the kernel "
+                           "chains, as entries of the form "
+                           "'<hook>:<position>:<chain>', where <hook> is one "
+                           "of 'input', 'output' and 'forward' and <position> "
+                           "is 'before' or 'after' the jump to felix's "
+                           "chain.  Felix creates each chain if it doesn't "
+                           "exist but never modifies its rules, so "
+                           "administrators can add their own rules there.",
+                           [], value_is_str_list=True)
+        self.add_parameter("PortScanInterfaces",
+                           "Comma-separated list of host interfaces on which "
+                           "the Go side of felix detects port scans.  Their "
+                           "host endpoints' chains pass the packets that "
+                           "they're about to drop to its detection chain.",
+                           [], value_is_str_list=True)
         self.add_parameter("DefaultEndpointToHostAction",
                            "Action to take for packets that arrive from"
                            "an endpoint to the host.", "DROP")
@@ -210,11 +307,14 @@ class Config(object):
         self.add_parameter("LogFilePath",
                            "Path to log file", "/var/log/calico/felix.log")
         self.add_parameter("LogSeverityFile",
-                           "Log severity for logging to file", "INFO")
+                           "Log severity for logging to file", "INFO",
+                           live=True)
         self.add_parameter("LogSeveritySys",
-                           "Log severity for logging to syslog", "ERROR")
+                           "Log severity for logging to syslog", "ERROR",
+                           live=True)
         self.add_parameter("LogSeverityScreen",
-                           "Log severity for logging to screen", "ERROR")
+                           "Log severity for logging to screen", "ERROR",
+                           live=True)
         self.add_parameter("IpInIpEnabled",
                            "IP-in-IP device support enabled", False,
                            value_is_bool=True)
@@ -277,6 +377,24 @@ class Config(object):
                            "attempt to detect whether the system supports "
                            "IPv6 and use it if it does.",
                            "auto")
+        self.add_parameter("KubeIPVSSupport",
+                           "Whether to adjust the global rules for hosts "
+                           "where kube-proxy runs in IPVS mode.  If 'true', "
+                           "service traffic is identified by the addresses of "
+                           "the kube-ipvs0 device, rather than by interface, "
+                           "so that endpoint policy is still applied to it; "
+                           "if 'auto', Felix does so if the kube-ipvs0 device "
+                           "exists at start of day.  Requires a fourth bit in "
+                           "the IptablesMarkMask.",
+                           "false")
+        self.add_parameter("ChainAcceptAction",
+                           "What the top-level felix INPUT, OUTPUT and "
+                           "FORWARD chains do with packets that they allow; "
+                           "one of: ACCEPT, RETURN.  With RETURN, they set the "
+                           "accept mark bit and return the packet to the "
+                           "kernel chain, so that other iptables users can "
+                           "see allowed traffic and make the final decision.",
+                           "ACCEPT")
         self.add_parameter("ChainInsertMode",
                            "Whether to insert the felix chains or append them."
                            "one of: insert, append. Defaults to insert.",
@@ -320,9 +438,40 @@ class Config(object):
             self.parameters["IptablesRefreshInterval"].value
         self.HOST_IF_POLL_INTERVAL_SECS = \
             self.parameters["HostInterfacePollInterval"].value
+        self.NEIGHBOR_GC_INTERVAL_SECS = \
+            self.parameters["NeighborGCInterval"].value
         self.METADATA_IP = self.parameters["MetadataAddr"].value
         self.METADATA_PORT = self.parameters["MetadataPort"].value
         self.IFACE_PREFIX = self.parameters["InterfacePrefix"].value
+        self.IFACE_EXCLUDE = [
+            pattern for pattern in self.parameters["InterfaceExclude"].value
+            if pattern
+        ]
+        self.DROP_INVALID_CONNTRACK = set(
+            point.lower()
+            for point in self.parameters["DropInvalidConntrack"].value
+            if point and point.lower() != "none"
+        )
+        self.CONNTRACK_BYPASS_ENABLED = \
+            self.parameters["ConntrackBypassEnabled"].value
+        self.VERDICT_CACHE_ENABLED = \
+            self.parameters["VerdictCacheEnabled"].value
+        self.FLOW_LOGS_ENABLED = self.parameters["FlowLogsEnabled"].value
+        self.ANTI_SPOOFING_ENABLED = \
+            self.parameters["AntiSpoofingEnabled"].value
+        self.DROP_WORKLOAD_ROUTER_ADVERTS = \
+            self.parameters["DropWorkloadRouterAdvertisements"].value
+        self.DROP_WORKLOAD_DHCP_SERVERS = \
+            self.parameters["DropWorkloadDHCPServers"].value
+        self.USER_CHAIN_HOOKS = [
+            tuple(hook.split(":", 2))
+            for hook in self.parameters["UserChainHooks"].value
+            if hook
+        ]
+        self.PORT_SCAN_INTERFACES = [
+            iface for iface in self.parameters["PortScanInterfaces"].value
+            if iface
+        ]
         self.DEFAULT_INPUT_CHAIN_ACTION = \
             self.parameters["DefaultEndpointToHostAction"].value
         self.LOGFILE = self.parameters["LogFilePath"].value
@@ -354,6 +503,10 @@ class Config(object):
         self.IGNORE_LOOSE_RPF = self.parameters["IgnoreLooseRPF"].value
         self.IPV6_SUPPORT = self.parameters["Ipv6Support"].value.lower()
         self.CHAIN_INSERT_MODE = self.parameters["ChainInsertMode"].value
+        self.CHAIN_ACCEPT_ACTION = \
+            self.parameters["ChainAcceptAction"].value.upper()
+        self.KUBE_IPVS_SUPPORT = \
+            self.parameters["KubeIPVSSupport"].value.lower()
 
         self._validate_cfg(final=final)
 
@@ -363,11 +516,30 @@ class Config(object):
         # From least to most significant bits of the mask we use them for:
         # - signalling that a profile accepted a packet
         # - signalling that a packet should move to the next policy tier.
+        # - signalling that a packet is to or from an endpoint.
+        # - signalling that a packet is for an IPVS service, if the mask has
+        #   a spare bit; otherwise, IPVS support can't be enabled.
+        # - if the verdict cache is enabled, the connmarks that record that
+        #   a flow was accepted to and from an endpoint.  The Go side of
+        #   felix allocates the same bits, so that it can invalidate them.
         mark_mask = self.IPTABLES_MARK_MASK
         set_bits = find_set_bits(mark_mask)
         self.IPTABLES_MARK_ACCEPT = "0x%x" % next(set_bits)
         self.IPTABLES_MARK_NEXT_TIER = "0x%x" % next(set_bits)
         self.IPTABLES_MARK_ENDPOINTS = "0x%x" % next(set_bits)
+        ipvs_bit = next(set_bits, None)
+        self.IPTABLES_MARK_IPVS = "0x%x" % ipvs_bit if ipvs_bit else None
+        self.IPTABLES_MARK_VERDICT_CACHE_IN = None
+        self.IPTABLES_MARK_VERDICT_CACHE_OUT = None
+        if self.VERDICT_CACHE_ENABLED:
+            in_bit = next(set_bits, None)
+            out_bit = next(set_bits, None)
+            if in_bit and out_bit:
+                self.IPTABLES_MARK_VERDICT_CACHE_IN = "0x%x" % in_bit
+                self.IPTABLES_MARK_VERDICT_CACHE_OUT = "0x%x" % out_bit
+            else:
+                log.warning("Not enough mark bits left for the verdict "
+                            "cache; verdicts won't be cached")
 
         for plugin in self.plugins.itervalues():
             # Plugins don't get loaded and registered until we've read config
@@ -429,6 +601,36 @@ class Config(object):
 
         self._finish_update(final=True)
 
+    def requires_restart(self, changed_names):
+        """
+        Checks whether a set of changed parameters can be applied live.
+
+        :param changed_names: Names of the parameters that have changed.
+        :returns: True if any of the parameters can only be changed by
+                  restarting Felix.
+        """
+        for name in changed_names:
+            parameter = self.parameters.get(name)
+            if parameter is None or not parameter.live:
+                log.info("Parameter %s changed, restart required", name)
+                return True
+        return False
+
+    def apply_live_update(self, config_dict):
+        """
+        Applies a config update from the driver in which only live
+        parameters have changed.  Live parameters that are missing from
+        the update revert to their defaults.
+
+        :param config_dict: Dictionary of config parameters
+        :raises ConfigException
+        """
+        log.info("Applying live config update: %s", config_dict)
+        for name, parameter in self.parameters.iteritems():
+            if parameter.live:
+                parameter.set(config_dict.get(name, parameter.default))
+        self._finish_update(final=True)
+
     def _validate_cfg(self, final=True):
         """
         Firewall that the config is not invalid. Called twice to let plugins
@@ -483,6 +685,27 @@ class Config(object):
             self.IP_IN_IP_ADDR = self._validate_addr("IpInIpTunnelAddr",
                                                      self.IP_IN_IP_ADDR)
 
+        for pattern in self.IFACE_EXCLUDE:
+            if not re.match(r"^[a-zA-Z0-9_.-]{1,15}\+?$", pattern):
+                raise ConfigException("Invalid interface name pattern",
+                                      self.parameters["InterfaceExclude"])
+
+        if not self.DROP_INVALID_CONNTRACK.issubset(FILTER_HOOKS):
+            raise ConfigException("Invalid field value",
+                                  self.parameters["DropInvalidConntrack"])
+
+        for user_chain_hook in self.USER_CHAIN_HOOKS:
+            if (len(user_chain_hook) != 3 or
+                    user_chain_hook[0] not in FILTER_HOOKS or
+                    user_chain_hook[1] not in USER_CHAIN_POSITIONS or
+                    not USER_CHAIN_RE.match(user_chain_hook[2]) or
+                    user_chain_hook[2].startswith(FELIX_PREFIX) or
+                    user_chain_hook[2].upper() in ("INPUT", "OUTPUT",
+                                                   "FORWARD", "ACCEPT",
+                                                   "DROP", "RETURN")):
+                raise ConfigException("Invalid field value",
+                                      self.parameters["UserChainHooks"])
+
         if self.DEFAULT_INPUT_CHAIN_ACTION not in ("DROP", "RETURN", "ACCEPT"):
             raise ConfigException(
                 "Invalid field value",
@@ -524,6 +747,14 @@ class Config(object):
                         "defaulting to 0xff000000")
             self.IPTABLES_MARK_MASK = 0xff000000
 
+        if (self.KUBE_IPVS_SUPPORT == "true" and
+                len(list(find_set_bits(self.IPTABLES_MARK_MASK))) <
+                MIN_MARK_BITS_IPVS):
+            log.warning("Iptables mark mask contains fewer than %s bits, "
+                        "which KubeIPVSSupport requires, defaulting to "
+                        "0xff000000", MIN_MARK_BITS_IPVS)
+            self.IPTABLES_MARK_MASK = 0xff000000
+
         if not 0 < self.PROM_METRICS_DRIVER_PORT < 65536:
             log.warning("Prometheus port out-of-range, "
                         "defaulting to 9092")
@@ -542,6 +773,17 @@ class Config(object):
                         "defaulting to 'auto'", self.IPV6_SUPPORT)
             self.IPV6_SUPPORT = "auto"
 
+        if self.KUBE_IPVS_SUPPORT not in ("true", "false", "auto"):
+            log.warning("Unrecognized value for KubeIPVSSupport (%s), "
+                        "defaulting to 'auto'", self.KUBE_IPVS_SUPPORT)
+            self.KUBE_IPVS_SUPPORT = "auto"
+
+        if self.CHAIN_ACCEPT_ACTION not in ("ACCEPT", "RETURN"):
+            raise ConfigException(
+                "Invalid field value",
+                self.parameters["ChainAcceptAction"]
+            )
+
         if self.CHAIN_INSERT_MODE not in ("insert", "append"):
             raise ConfigException(
                 "Invalid field value",
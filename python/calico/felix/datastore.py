@@ -306,27 +306,37 @@ class DatastoreReader(TimedGreenlet):
         On the first call, responds to the driver synchronously with a
         config response.
 
-        If the config has changed since a previous call, triggers Felix
-        to die.
+        If the config has changed since a previous call, applies the change
+        live if only live parameters (such as log levels) have changed.
+        Otherwise, triggers Felix to die.
         """
         global_config = dict(msg.config)
         host_config = dict(msg.config)
         _log.info("Config loaded by driver: %s", msg.config)
         if self.configured.is_set():
-            # We've already been configured.  We don't yet support
-            # dynamic config update so instead we check if the config
-            # has changed and die if it has.
+            # We've already been configured.  Check if the config has
+            # changed and, if it has, whether we can apply the change
+            # without restarting.
             _log.info("Checking configuration for changes...")
             if (host_config != self.last_host_config or
                     global_config != self.last_global_config):
-                _log.warning("Felix configuration has changed, "
-                             "felix must restart.")
                 _log.info("Old host config: %s", self.last_host_config)
                 _log.info("New host config: %s", host_config)
                 _log.info("Old global config: %s",
                           self.last_global_config)
                 _log.info("New global config: %s", global_config)
-                die_and_restart()
+                old_config = self.last_global_config
+                changed = set(k for k in set(old_config) | set(global_config)
+                              if old_config.get(k) != global_config.get(k))
+                if self._config.requires_restart(changed):
+                    _log.warning("Felix configuration has changed, "
+                                 "felix must restart.")
+                    die_and_restart()
+                else:
+                    _log.info("Applying live config changes: %s", changed)
+                    self._config.apply_live_update(msg.config)
+                    self.last_host_config = host_config.copy()
+                    self.last_global_config = global_config.copy()
         else:
             # First time loading the config.  Report it to the config
             # object.  Take copies because report_etcd_config is
@@ -405,6 +415,11 @@ class DatastoreReader(TimedGreenlet):
             "ipv4_nets": msg.endpoint.ipv4_nets,
             "ipv6_nets": msg.endpoint.ipv6_nets,
             "tiers": convert_pb_tiers(msg.endpoint.tiers),
+            "ingress_bandwidth": msg.endpoint.ingress_bandwidth or None,
+            "egress_bandwidth": msg.endpoint.egress_bandwidth or None,
+            "max_connection_rate": msg.endpoint.max_connection_rate or None,
+            "allowed_source_prefixes":
+                list(msg.endpoint.allowed_source_prefixes),
         }
         self.splitter.on_endpoint_update(combined_id, endpoint)
 
@@ -430,6 +445,7 @@ class DatastoreReader(TimedGreenlet):
         _stats.increment("Host endpoint created/updated")
         endpoint = {
             "name": msg.endpoint.name or None,
+            "interface_names": list(msg.endpoint.interface_names),
             "profile_ids": msg.endpoint.profile_ids,
             "expected_ipv4_addrs": msg.endpoint.expected_ipv4_addrs,
             "expected_ipv6_addrs": msg.endpoint.expected_ipv6_addrs,
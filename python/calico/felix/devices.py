@@ -148,7 +148,9 @@ def list_ips_by_iface(ip_type):
     ips_by_iface = defaultdict(set)
     iface_name = None
     for line in data.splitlines():
-        m = re.match(r"^\d+: ([^:]+):", line)
+        # Stacked devices, such as VLAN subinterfaces, are listed as
+        # "<name>@<parent>"; we only want the name.
+        m = re.match(r"^\d+: ([^:@]+)(?:@[^:]*)?:", line)
         if m:
             iface_name = m.group(1)
         else:
@@ -338,6 +340,53 @@ def set_routes(ip_type, ips, interface, mac=None, reset_arp=False):
             futils.check_call(['arp', '-s', ip, mac, '-i', interface])
 
 
+def list_permanent_neighbors(ip_type):
+    """
+    List the permanent neighbor (ARP or NDP) entries, such as those that
+    add_route programs for workloads.
+
+    :param ip_type: Type of IP (IPV4 or IPV6)
+    :returns: dict mapping (IP, interface name) to the MAC address of each
+              permanent entry.
+    :raises FailedSystemCall
+    """
+    ip_cmd = ["ip", "-6"] if ip_type == futils.IPV6 else ["ip", "-4"]
+    data = futils.check_call(
+        ip_cmd + ["neigh", "show", "nud", "permanent"]).stdout
+    neighbors = {}
+    for line in data.splitlines():
+        # Example: "10.65.0.2 dev cali1234 lladdr aa:bb:cc:dd:ee:ff PERMANENT"
+        m = re.match(r"^(\S+) dev (\S+) lladdr (\S+)", line)
+        if m:
+            neighbors[(m.group(1), m.group(2))] = m.group(3)
+    _log.debug("Found permanent neighbor entries: %s", neighbors)
+    return neighbors
+
+
+def add_neighbor(ip, mac, interface):
+    """
+    Add (or replace) the permanent ARP entry for an IPv4 address on an
+    interface.
+
+    :param str ip: IP address
+    :param str mac: MAC address
+    :param str interface: Interface name
+    :raises FailedSystemCall
+    """
+    futils.check_call(['arp', '-s', ip, mac, '-i', interface])
+
+
+def del_neighbor(ip, interface):
+    """
+    Delete the ARP entry for an IPv4 address on an interface.
+
+    :param str ip: IP address
+    :param str interface: Interface name
+    :raises FailedSystemCall
+    """
+    futils.check_call(['arp', '-d', ip, '-i', interface])
+
+
 def interface_up(if_name):
     """
     Checks whether a given interface is up.
@@ -427,8 +476,9 @@ class RTNetlinkError(Exception):
 
 
 class InterfaceWatcher(Actor):
-    def __init__(self, update_splitter):
+    def __init__(self, config, update_splitter):
         super(InterfaceWatcher, self).__init__()
+        self.config = config
         self.update_splitter = update_splitter
         self.interfaces = {}
 
@@ -511,6 +561,13 @@ class InterfaceWatcher(Actor):
                         operstate, = struct.unpack("=B", rta_data[:1])
                         _log.debug("IFLA_OPERSTATE: %s", operstate)
 
+                if ifname and futils.iface_is_excluded(
+                        ifname, self.config.IFACE_EXCLUDE):
+                    # Another component owns the interface; don't tell the
+                    # other actors about it.
+                    _log.debug("Ignoring excluded interface %s", ifname)
+                    continue
+
                 if (ifname and
                         (msg_type == RTM_DELLINK or operstate != IF_OPER_UP)):
                     # The interface is down; make sure the other actors know
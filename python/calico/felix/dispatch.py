@@ -26,7 +26,7 @@ from calico.felix.frules import (
     CHAIN_TO_PREFIX, CHAIN_FROM_PREFIX, interface_to_chain_suffix,
     WORKLOAD_DISPATCH_CHAINS,
     HOST_DISPATCH_CHAINS)
-from calico.felix.futils import find_longest_prefix
+from calico.felix.futils import find_longest_prefix, iface_is_excluded
 
 _log = logging.getLogger(__name__)
 
@@ -174,6 +174,15 @@ class _DispatchChains(Actor):
         root_to_deps = dependencies[self.chain_to_root]
         root_from_deps = dependencies[self.chain_from_root]
 
+        # Another component owns the excluded interfaces; the top-level
+        # chains return their packets before they get here.
+        excluded = set(iface for iface in ifaces
+                       if iface_is_excluded(iface, self.config.IFACE_EXCLUDE))
+        if excluded:
+            _log.debug("Not dispatching to excluded interfaces: %s",
+                       sorted(excluded))
+            ifaces = ifaces - excluded
+
         # Separate the interface names by their prefixes so we can count them
         # and decide whether to program a leaf chain or not.
         interfaces_by_prefix = defaultdict(set)
@@ -24,22 +24,24 @@ import logging
 
 import gevent
 import sys
+from netaddr import AddrFormatError, IPNetwork
 from netaddr.ip.sets import IPSet
 
 from calico.calcollections import MultiDict
-from calico.common import nat_key
+from calico.common import nat_key, WILDCARD_IFACE_NAME
 from calico.datamodel_v1 import (
     ENDPOINT_STATUS_UP, ENDPOINT_STATUS_DOWN, ENDPOINT_STATUS_ERROR,
     WloadEndpointId, ResolvedHostEndpointId, TieredPolicyId)
-from calico.felix import devices, futils
+from calico.felix import devices, futils, qos
 from calico.felix.actor import actor_message, TimedGreenlet
 from calico.felix.futils import FailedSystemCall
-from calico.felix.futils import IPV4, IP_TYPE_TO_VERSION
+from calico.felix.futils import IPV4, IP_TYPE_TO_VERSION, StatCounter
 from calico.felix.refcount import ReferenceManager, RefCountedActor, RefHelper
 from calico.felix.profilerules import RulesManager
 from calico.felix.frules import interface_to_chain_suffix
 
 _log = logging.getLogger(__name__)
+_neighbor_stats = StatCounter("Neighbor GC counters")
 
 
 class EndpointManager(ReferenceManager):
@@ -98,9 +100,21 @@ class EndpointManager(ReferenceManager):
         self._iface_poll_greenlet = TimedGreenlet(self._interface_poll_loop)
         self._iface_poll_greenlet.link_exception(self._on_worker_died)
 
+        # The (IP, interface name) keys of the permanent ARP entries that
+        # were stale or missing at the last neighbor GC.  See
+        # _gc_neighbors().
+        self._stale_neighbors = set()
+        self._missing_neighbors = set()
+        self._neighbor_gc_greenlet = TimedGreenlet(self._neighbor_gc_loop)
+        self._neighbor_gc_greenlet.link_exception(self._on_worker_died)
+
     def _on_actor_started(self):
         _log.info("Endpoint manager started, spawning interface poll worker.")
         self._iface_poll_greenlet.start()
+        # Only IPv4 workloads get permanent neighbor (ARP) entries.
+        if (self.ip_type == IPV4 and
+                self.config.NEIGHBOR_GC_INTERVAL_SECS > 0):
+            self._neighbor_gc_greenlet.start()
 
     def _create(self, combined_id):
         """
@@ -344,13 +358,15 @@ class EndpointManager(ReferenceManager):
         :param known_interfaces:
         :return:
         """
-        # We only care about host interfaces, not workload ones.
-        exclude_prefixes = self.config.IFACE_PREFIX
+        # We only care about host interfaces, not workload or excluded ones.
         # Get the IPs for each interface.
         ips_by_iface = devices.list_ips_by_iface(self.ip_type)
         for iface, ips in ips_by_iface.items():
-            ignore_iface = any(iface.startswith(prefix)
-                             for prefix in exclude_prefixes)
+            ignore_iface = (
+                futils.workload_iface_prefix(iface,
+                                             self.config.IFACE_PREFIX) or
+                futils.iface_is_excluded(iface, self.config.IFACE_EXCLUDE)
+            )
             if ignore_iface:
                 # Ignore non-host interfaces.
                 ips_by_iface.pop(iface)
@@ -370,6 +386,88 @@ class EndpointManager(ReferenceManager):
         # Update our cache of known interfaces for the next loop.
         return ips_by_iface
 
+    def _neighbor_gc_loop(self):
+        """Greenlet: Periodically triggers a GC of the neighbor table.
+
+        Sends the EndpointManager the _gc_neighbors() message.
+        """
+        while True:
+            gevent.sleep(self.config.NEIGHBOR_GC_INTERVAL_SECS)
+            self._gc_neighbors(async=True)
+
+    @actor_message()
+    def _gc_neighbors(self):
+        """Garbage collects the permanent ARP entries of workloads.
+
+        Removes the entries on workload interfaces that no active endpoint
+        wants, for example those of endpoints whose interface was reused or
+        that were deleted while Felix wasn't running, and restores the
+        entries that active endpoints want but that are missing.  Other
+        interfaces' entries are left alone.
+
+        The LocalEndpoint actors program the entries asynchronously, so an
+        entry that looks wrong may just be part-way through an update; we
+        only fix an entry if it was also wrong at the previous GC.
+        """
+        if not self._data_model_in_sync:
+            _log.debug("Not in sync with the datamodel, skipping neighbor GC")
+            return
+        wanted = {}
+        for ep_id in self.local_endpoint_ids:
+            ep = self.endpoints_by_id.get(ep_id)
+            if (not isinstance(ep_id, WloadEndpointId) or not ep or
+                    not ep.get("mac") or
+                    ep.get("state", "active") != "active"):
+                continue
+            for ip in workload_route_ips(ep, self.ip_type):
+                wanted[(ip, ep["name"])] = ep["mac"]
+        try:
+            actual = devices.list_permanent_neighbors(self.ip_type)
+        except FailedSystemCall:
+            _log.exception("Failed to list neighbor entries, skipping GC")
+            _neighbor_stats.increment("GC failures")
+            return
+
+        stale = set()
+        for key in actual:
+            iface = key[1]
+            if (key not in wanted and
+                    futils.workload_iface_prefix(iface,
+                                                 self.config.IFACE_PREFIX) and
+                    not futils.iface_is_excluded(iface,
+                                                 self.config.IFACE_EXCLUDE)):
+                stale.add(key)
+        missing = set(key for key, mac in wanted.iteritems()
+                      if actual.get(key, "").lower() != mac.lower())
+        _log.debug("Neighbor GC found stale entries %s and missing "
+                   "entries %s", stale, missing)
+
+        for ip, iface in stale & self._stale_neighbors:
+            _log.info("Removing stale ARP entry for %s on %s", ip, iface)
+            try:
+                devices.del_neighbor(ip, iface)
+            except FailedSystemCall:
+                _log.warning("Failed to remove stale ARP entry for %s on "
+                             "%s", ip, iface)
+                _neighbor_stats.increment("GC failures")
+            else:
+                _neighbor_stats.increment("Stale entries removed")
+        for ip, iface in missing & self._missing_neighbors:
+            if not devices.interface_exists(iface):
+                # The endpoint's interface hasn't been created yet.
+                continue
+            _log.info("Restoring missing ARP entry for %s on %s", ip, iface)
+            try:
+                devices.add_neighbor(ip, wanted[(ip, iface)], iface)
+            except FailedSystemCall:
+                _log.warning("Failed to restore ARP entry for %s on %s",
+                             ip, iface)
+                _neighbor_stats.increment("GC failures")
+            else:
+                _neighbor_stats.increment("Missing entries restored")
+        self._stale_neighbors = stale
+        self._missing_neighbors = missing
+
     @actor_message()
     def _on_iface_ips_update(self, iface_name, ip_addrs):
         """Message sent by _poll_interface_ips when it detects a change.
@@ -394,6 +492,12 @@ class EndpointManager(ReferenceManager):
         Host interfaces that have matching IPs get combined with interface
         name learned from the kernel and updated via on_endpoint_update().
 
+        A host endpoint may also list several interfaces explicitly (for
+        example, the members of a bond) or use the wildcard name "*" to
+        cover every host interface that no other host endpoint claims.  Each
+        interface is resolved separately so that it gets its own chains;
+        the policy chains themselves are shared.
+
         In the case where multiple interfaces have the same IP address,
         a copy of the host endpoint will be resolved with each interface.
         """
@@ -404,24 +508,55 @@ class EndpointManager(ReferenceManager):
         for iface, ips in self.host_ep_ips_by_iface.iteritems():
             for ip in ips:
                 iface_names_by_ip[ip].add(iface)
-        # Iterate over the host endpoints, looking for corresponding IPs.
         resolved_ifaces = {}
         iface_name_to_id = {}
+
+        def resolve(combined_id, host_ep, iface_name):
+            # Check for conflicting matches.
+            prev_match = iface_name_to_id.get(iface_name)
+            if prev_match == combined_id:
+                # Already matched this interface, for example by a different
+                # IP address.
+                return
+            elif prev_match is not None:
+                # Already matched a different endpoint.  First match wins.
+                _log.warn("Interface %s matched with multiple entries in "
+                          "datamodel; using %s", iface_name, prev_match)
+                return
+            iface_name_to_id[iface_name] = combined_id
+            # Since it's possible for an endpoint to match multiple
+            # interfaces, we add the interface name into the ID to
+            # disambiguate.
+            resolved_id = combined_id.resolve(iface_name)
+            resolved_data = host_ep.copy()
+            resolved_data.pop("interface_names", None)
+            resolved_data["name"] = iface_name
+            resolved_ifaces[resolved_id] = resolved_data
+
         # For repeatability, we sort the endpoint data.  We don't care what
         # the sort order is, only that it's stable so we just use the repr()
         # of the ID.
+        host_eps = sorted(self.host_eps_by_id.iteritems(),
+                          key=lambda h: repr(h[0]))
         addrs_key = "expected_ipv%s_addrs" % self.ip_version
-        for combined_id, host_ep in sorted(self.host_eps_by_id.iteritems(),
-                                           key=lambda h: repr(h[0])):
+        # Explicitly-named interfaces take precedence over IP matches, which,
+        # in turn, take precedence over the wildcard.
+        for combined_id, host_ep in host_eps:
             _log.debug("Examining: %s = %s", combined_id, host_ep)
-            if host_ep.get("name") is not None:
-                # This interface has an explicit name in the data so it's
+            iface_names = list(host_ep.get("interface_names") or [])
+            if host_ep.get("name") not in (None, WILDCARD_IFACE_NAME):
+                iface_names.insert(0, host_ep["name"])
+            if iface_names:
+                # This endpoint has explicit names in the data so it's
                 # already resolved.
-                _log.debug("Host endpoint has explicit name: %s.",
-                           host_ep["name"])
-                resolved_id = combined_id.resolve(host_ep["name"])
-                resolved_ifaces[resolved_id] = host_ep
-            elif addrs_key in host_ep:
+                _log.debug("Host endpoint has explicit names: %s.",
+                           iface_names)
+                for iface_name in iface_names:
+                    resolve(combined_id, host_ep, iface_name)
+        for combined_id, host_ep in host_eps:
+            if (host_ep.get("name") is None and
+                    not host_ep.get("interface_names") and
+                    addrs_key in host_ep):
                 # No explicit name, look for an interface with a matching IP.
                 expected_ips = IPSet(host_ep[addrs_key])
                 for ip, iface_names in sorted(iface_names_by_ip.iteritems()):
@@ -433,29 +568,15 @@ class EndpointManager(ReferenceManager):
                         _log.debug("Host endpoint %s matches interfaces: %s",
                                    combined_id, iface_names)
                         for iface_name in sorted(iface_names):
-                            # Check for conflicting matches.
-                            prev_match = iface_name_to_id.get(iface_name)
-                            if prev_match == combined_id:
-                                # Already matched this interface by a different
-                                # IP address.
-                                continue
-                            elif prev_match is not None:
-                                # Already matched a different interface.
-                                # First match wins.
-                                _log.warn("Interface %s matched with multiple "
-                                          "entries in datamodel; using %s",
-                                          iface_name, prev_match)
-                                continue
-                            else:
-                                # Else, this is the first match, record it.
-                                iface_name_to_id[iface_name] = combined_id
-                            # Got a match.  Since it's possible to match
-                            # multiple interfaces by IP, we add the interface
-                            # name into the ID to disambiguate.
-                            resolved_id = combined_id.resolve(iface_name)
-                            resolved_data = host_ep.copy()
-                            resolved_data["name"] = iface_name
-                            resolved_ifaces[resolved_id] = resolved_data
+                            resolve(combined_id, host_ep, iface_name)
+        for combined_id, host_ep in host_eps:
+            if host_ep.get("name") == WILDCARD_IFACE_NAME:
+                # Wildcard; claim every host interface that's left.  The
+                # poller has already filtered out workload and excluded
+                # interfaces.
+                for iface_name in sorted(self.host_ep_ips_by_iface):
+                    if iface_name not in iface_name_to_id:
+                        resolve(combined_id, host_ep, iface_name)
         # Fire in deletions for interfaces that no longer resolve.
         for resolved_id in self.resolved_host_eps.keys():
             if resolved_id not in resolved_ifaces:
@@ -704,7 +825,15 @@ class LocalEndpoint(RefCountedActor):
         if not self._device_in_sync and self._iface_name:
             # Try to update the device configuration.  If successful, will set
             # the _device_in_sync flag.
-            if self._admin_up and self._device_is_up:
+            if futils.iface_is_excluded(self._iface_name,
+                                        self.config.IFACE_EXCLUDE):
+                # Another component owns the interface; leave its routes and
+                # sysctls alone.
+                _log.warning("Interface %s for %s is excluded by "
+                             "InterfaceExclude, not configuring it.",
+                             self._iface_name, self.combined_id)
+                self._device_in_sync = True
+            elif self._admin_up and self._device_is_up:
                 # Endpoint is supposed to be live, try to configure it.
                 _log.debug("Device is out-of-sync, trying to configure it")
                 self._configure_interface()
@@ -867,9 +996,28 @@ class LocalEndpoint(RefCountedActor):
                               pending_endpoint.get(self.nets_key, []))
                 if old_ips != new_ips:
                     # IP addresses have changed, need to update the routing
-                    # table.
+                    # table, and the source address check.
                     _log.debug("IP addresses changed, need to update routing")
                     self._device_in_sync = False
+                    if self.config.ANTI_SPOOFING_ENABLED:
+                        self._iptables_in_sync = False
+                if (self.endpoint.get("allowed_source_prefixes") !=
+                        pending_endpoint.get("allowed_source_prefixes")):
+                    _log.debug("Allowed source prefixes changed, need to "
+                               "update routing")
+                    self._device_in_sync = False
+                    if self.config.ANTI_SPOOFING_ENABLED:
+                        self._iptables_in_sync = False
+                for key in ("ingress_bandwidth", "egress_bandwidth"):
+                    if self.endpoint.get(key) != pending_endpoint.get(key):
+                        _log.debug("Bandwidth limits changed, need to "
+                                   "update the device.")
+                        self._device_in_sync = False
+                if (self.endpoint.get("max_connection_rate") !=
+                        pending_endpoint.get("max_connection_rate")):
+                    _log.debug("Connection rate limit changed, need to "
+                               "update iptables.")
+                    self._iptables_in_sync = False
                 new_nat_mappings = pending_endpoint.get(self.nat_key, [])
                 if old_nat_mappings != new_nat_mappings:
                     _log.debug("NAT mappings have changed, refreshing.")
@@ -1008,10 +1156,31 @@ class LocalEndpoint(RefCountedActor):
 
 class WorkloadEndpoint(LocalEndpoint):
 
+    def __init__(self, *args, **kwargs):
+        super(WorkloadEndpoint, self).__init__(*args, **kwargs)
+        # Whether we've set bandwidth limits on the interface, so we know to
+        # remove them.
+        self._bandwidth_limited = False
+
+    def _owns_iface(self):
+        """
+        :returns True if the interface has one of our workload prefixes, and
+                 hence its routes are ours to manage.
+        """
+        return bool(futils.workload_iface_prefix(self._iface_name,
+                                                 self.config.IFACE_PREFIX))
+
     def _configure_interface(self):
         """
         Applies sysctls and routes to the interface.
         """
+        if not self._owns_iface():
+            _log.warning("Interface %s for %s does not match any of the "
+                         "workload prefixes %s; not programming routes.",
+                         self._iface_name, self.combined_id,
+                         self.config.IFACE_PREFIX)
+            self._device_in_sync = True
+            return
         try:
             if self.ip_type == IPV4:
                 devices.configure_interface_ipv4(self._iface_name)
@@ -1021,15 +1190,12 @@ class WorkloadEndpoint(LocalEndpoint):
                 devices.configure_interface_ipv6(self._iface_name, ipv6_gw)
                 reset_arp = False
 
-            ips = set()
-            for ip in self.endpoint.get(self.nets_key, []):
-                ips.add(futils.net_to_ip(ip))
-            for nat_map in self.endpoint.get(nat_key(self.ip_type), []):
-                ips.add(nat_map['ext_ip'])
+            ips = workload_route_ips(self.endpoint, self.ip_type)
             devices.set_routes(self.ip_type, ips,
                                self._iface_name,
                                self.endpoint.get("mac"),
                                reset_arp=reset_arp)
+            self._configure_bandwidth_limits()
 
         except (IOError, FailedSystemCall) as e:
             if not devices.interface_exists(self._iface_name):
@@ -1057,8 +1223,15 @@ class WorkloadEndpoint(LocalEndpoint):
         """
         Removes routes from the interface.
         """
+        if not self._owns_iface():
+            _log.info("Interface %s for %s is not a workload interface; "
+                      "leaving its routes alone.", self._iface_name,
+                      self.combined_id)
+            self._device_in_sync = True
+            return
         try:
             devices.set_routes(self.ip_type, set(), self._iface_name, None)
+            self._remove_bandwidth_limits()
         except FailedSystemCall as e:
             if "Cannot find device" in e.stderr:
                 # Deleted under our feet - so the rules are gone.
@@ -1087,6 +1260,44 @@ class WorkloadEndpoint(LocalEndpoint):
             _log.info("Interface %s deconfigured", self._iface_name)
             super(WorkloadEndpoint, self)._deconfigure_interface()
 
+    def _configure_bandwidth_limits(self):
+        """
+        Sets the endpoint's bandwidth limits on the interface.  The limits
+        aren't IP-version specific so only the IPv4 endpoint programs them.
+        We reapply limits every time, which resyncs them if they've been
+        lost, for example, because the interface was recreated.
+        """
+        if self.ip_type != IPV4:
+            return
+        ingress_bps = self.endpoint.get("ingress_bandwidth")
+        egress_bps = self.endpoint.get("egress_bandwidth")
+        if not (ingress_bps or egress_bps or self._bandwidth_limited):
+            return
+        try:
+            qos.set_bandwidth_limits(self._iface_name, ingress_bps, egress_bps)
+        except FailedSystemCall as e:
+            # Don't fail the rest of the interface configuration; the
+            # workload is still usable without its limits.
+            _log.error("Failed to set bandwidth limits on %s for %s: %r",
+                       self._iface_name, self.combined_id, e.stderr)
+        else:
+            self._bandwidth_limited = bool(ingress_bps or egress_bps)
+
+    def _remove_bandwidth_limits(self):
+        """
+        Removes the endpoint's bandwidth limits from the interface, if we
+        set any.
+        """
+        if self.ip_type != IPV4 or not self._bandwidth_limited:
+            return
+        try:
+            qos.remove_bandwidth_limits(self._iface_name)
+        except FailedSystemCall as e:
+            _log.error("Failed to remove bandwidth limits from %s for %s: "
+                       "%r", self._iface_name, self.combined_id, e.stderr)
+        else:
+            self._bandwidth_limited = False
+
     def _endpoint_updates(self):
         updates, deps = self.iptables_generator.endpoint_updates(
             IP_TYPE_TO_VERSION[self.ip_type],
@@ -1094,7 +1305,9 @@ class WorkloadEndpoint(LocalEndpoint):
             self._suffix,
             self._mac,
             self.endpoint["profile_ids"],
-            self._pol_ids_by_tier)
+            self._pol_ids_by_tier,
+            max_connection_rate=self.endpoint.get("max_connection_rate"),
+            source_nets=workload_source_nets(self.endpoint, self.ip_type))
         return updates, deps
 
 
@@ -1107,3 +1320,63 @@ class HostEndpoint(LocalEndpoint):
             profile_ids=self.endpoint["profile_ids"],
             pol_ids_by_tier=self._pol_ids_by_tier,
         )
+
+
+def workload_route_ips(endpoint, ip_type):
+    """
+    :returns the set of addresses, of the given IP type, that are routed to
+             a workload endpoint: its own addresses, its NAT external
+             addresses and its single-address allowed source prefixes.  On
+             IPv4, each of them also gets a permanent ARP entry.
+    """
+    nets_key = "ipv4_nets" if ip_type == IPV4 else "ipv6_nets"
+    ips = set()
+    for ip in endpoint.get(nets_key, []):
+        ips.add(futils.net_to_ip(ip))
+    for nat_map in endpoint.get(nat_key(ip_type), []):
+        ips.add(nat_map['ext_ip'])
+    ips |= allowed_source_ips(endpoint, ip_type)
+    return ips
+
+
+def workload_source_nets(endpoint, ip_type):
+    """
+    :returns the list of CIDRs, of the given IP type, that a workload
+             endpoint may send traffic from: its own addresses and all of its
+             allowed source prefixes, in order.  Invalid prefixes are
+             skipped.
+    """
+    nets_key = "ipv4_nets" if ip_type == IPV4 else "ipv6_nets"
+    nets = list(endpoint.get(nets_key, []))
+    for prefix in endpoint.get("allowed_source_prefixes") or []:
+        try:
+            net = IPNetwork(prefix)
+        except (AddrFormatError, ValueError):
+            _log.warning("Ignoring invalid allowed source prefix %s for "
+                         "interface %s", prefix, endpoint.get("name"))
+            continue
+        if net.version == IP_TYPE_TO_VERSION[ip_type]:
+            nets.append(str(net))
+    return nets
+
+
+def allowed_source_ips(endpoint, ip_type):
+    """
+    :returns the set of single addresses, of the given IP type, among the
+             endpoint's allowed source prefixes, such as a virtual IP that
+             it shares with other workloads for failover.  Only single
+             addresses are routed; set_routes can't program a route to a
+             wider CIDR.  If several local workloads share an address, the
+             last one to be programmed gets the route.
+    """
+    ips = set()
+    for prefix in endpoint.get("allowed_source_prefixes") or []:
+        try:
+            net = IPNetwork(prefix)
+        except (AddrFormatError, ValueError):
+            _log.warning("Ignoring invalid allowed source prefix %s for "
+                         "interface %s", prefix, endpoint.get("name"))
+            continue
+        if net.version == IP_TYPE_TO_VERSION[ip_type] and net.size == 1:
+            ips.add(str(net.ip))
+    return ips
@@ -61,7 +61,9 @@ from calico.felix.config import Config
 from calico.felix.futils import IPV4, IPV6
 from calico.felix.devices import InterfaceWatcher
 from calico.felix.endpoint import EndpointManager
-from calico.felix.ipsets import IpsetManager, IpsetActor, HOSTS_IPSET_V4
+from calico.felix.ipsets import (IpsetManager, IpsetActor, HOSTS_IPSET_V4,
+                                  IPVS_SERVICES_IPSETS)
+from calico.felix.ipvs import IpvsAddressWatcher, detect_kube_ipvs
 from calico.felix.masq import MasqueradeManager
 from calico.felix.fipmanager import FloatingIPManager
 from calico.felix.datastore import DatastoreAPI
@@ -220,10 +222,26 @@ def _main_greenlet():
             v6_raw_updater = None
             v6_if_dispatch_chains = None
 
+        # Determine whether kube-proxy is running in IPVS mode.
+        ipvs_enabled, ipvs_reason = detect_kube_ipvs(config)
+        if ipvs_enabled:
+            ipvs_ipset_actors = {
+                IPV4: IpsetActor(IPVS_SERVICES_IPSETS[IPV4]),
+            }
+            if v6_enabled:
+                ipvs_ipset_actors[IPV6] = IpsetActor(
+                    IPVS_SERVICES_IPSETS[IPV6]
+                )
+            ipvs_watcher = IpvsAddressWatcher(config, ipvs_ipset_actors)
+            actors_to_start += ipvs_ipset_actors.values()
+            actors_to_start.append(ipvs_watcher)
+        else:
+            _log.info("IPVS support disabled: %s.", ipvs_reason)
+
         cleanup_mgr = CleanupManager(config, cleanup_updaters, cleanup_ip_mgrs)
         managers.append(cleanup_mgr)
         update_splitter = UpdateSplitter(managers)
-        iface_watcher = InterfaceWatcher(update_splitter)
+        iface_watcher = InterfaceWatcher(config, update_splitter)
         actors_to_start += [
             cleanup_mgr,
             iface_watcher,
@@ -247,13 +265,14 @@ def _main_greenlet():
         # top-level chains.
         v4_if_dispatch_chains.configure_iptables(async=False)
         install_global_rules(config, v4_filter_updater, v4_nat_updater,
-                             ip_version=4)
+                             ip_version=4, ipvs_enabled=ipvs_enabled)
         if v6_enabled:
             # Dispatch chain needs to make its configuration before we insert
             # the top-level chains.
             v6_if_dispatch_chains.configure_iptables(async=False)
             install_global_rules(config, v6_filter_updater, v6_nat_updater,
-                                 ip_version=6, raw_updater=v6_raw_updater)
+                                 ip_version=6, raw_updater=v6_raw_updater,
+                                 ipvs_enabled=ipvs_enabled)
 
         # Start polling for updates. These kicks make the actors poll
         # indefinitely.
@@ -18,7 +18,7 @@ felix.fiptables
 
 IP tables management functions.
 """
-from collections import defaultdict
+from collections import defaultdict, OrderedDict
 import copy
 import logging
 import random
@@ -42,6 +42,8 @@ _log = logging.getLogger(__name__)
 _correlators = ("ipt-%s" % ii for ii in itertools.count())
 MAX_IPT_RETRIES = 10
 MAX_IPT_BACKOFF = 0.2
+# How often to check whether periodic refresh has been re-enabled, in seconds.
+REFRESH_DISABLED_POLL_INTERVAL = 10
 
 
 class IptablesUpdater(Actor):
@@ -120,7 +122,7 @@ class IptablesUpdater(Actor):
         super(IptablesUpdater, self).__init__(qualifier="v%d-%s" %
                                                         (ip_version, table))
         self.table = table
-        self.refresh_interval = config.REFRESH_INTERVAL
+        self.config = config
         self.iptables_generator = config.plugins["iptables_generator"]
         self.chain_insert_mode = config.CHAIN_INSERT_MODE
         self.ip_version = ip_version
@@ -147,8 +149,11 @@ class IptablesUpdater(Actor):
         self._programmed_chain_contents = {}
         """Map from chain name to chain contents, only contains chains that
         have been explicitly programmed."""
-        self._inserted_rule_fragments = set()
-        """Special-case rule fragments that we've explicitly inserted."""
+        self._inserted_rule_fragments = OrderedDict()
+        """Special-case rule fragments that we've explicitly inserted, in
+        the order that we (last) inserted them, which is the order in which
+        we re-insert them on refresh so that they keep their relative
+        positions."""
         self._removed_rule_fragments = set()
         """Special-case rule fragments that we've explicitly removed.
         We need to cache this to defend against other processes accidentally
@@ -156,6 +161,9 @@ class IptablesUpdater(Actor):
         self._missing_chain_overrides = {}
         """Overrides for chain contents when we need to program a chain but
         it's missing."""
+        self._unmanaged_chains = set()
+        """Chains that we make sure exist but whose contents belong to
+        someone else, see ensure_chain_exists()."""
 
         self._required_chains = defaultdict(set)
         """Map from chain name to the set of names of chains that it
@@ -182,12 +190,10 @@ class IptablesUpdater(Actor):
         self._reset_batched_work()
         self._load_chain_names_from_iptables(async=True)
 
-        # Optionally, start periodic refresh timer.
-        if self.refresh_interval > 0:
-            _log.info("Periodic iptables refresh enabled, starting "
-                      "resync greenlet")
-            refresh_greenlet = gevent.spawn(self._periodic_refresh)
-            refresh_greenlet.link_exception(self._on_worker_died)
+        # Start the periodic refresh timer.  The refresh interval can be
+        # changed live so the greenlet runs even if refresh is disabled.
+        refresh_greenlet = gevent.spawn(self._periodic_refresh)
+        refresh_greenlet.link_exception(self._on_worker_died)
 
     @property
     def _explicitly_prog_chains(self):
@@ -297,7 +303,8 @@ class IptablesUpdater(Actor):
         """
         self._stats.increment("Rule inserts")
         _log.info("Inserting rule %r", rule_fragment)
-        self._inserted_rule_fragments.add(rule_fragment)
+        self._inserted_rule_fragments.pop(rule_fragment, None)
+        self._inserted_rule_fragments[rule_fragment] = True
         self._removed_rule_fragments.discard(rule_fragment)
         if self.chain_insert_mode == "insert":
             self._insert_rule(rule_fragment)
@@ -385,7 +392,7 @@ class IptablesUpdater(Actor):
         """
         _log.info("Removing rule %r", rule_fragment)
         self._stats.increment("Rule removals")
-        self._inserted_rule_fragments.discard(rule_fragment)
+        self._inserted_rule_fragments.pop(rule_fragment, None)
         self._removed_rule_fragments.add(rule_fragment)
         self._remove_rule(rule_fragment)
 
@@ -429,6 +436,46 @@ class IptablesUpdater(Actor):
                 _log.log(log_level, "%s instances of rule %r removed",
                          num_instances, rule_fragment)
 
+    @actor_message(needs_own_batch=True)
+    def ensure_chain_exists(self, chain_name):
+        """
+        Creates the given chain if it doesn't already exist, without
+        touching its contents if it does.
+
+        This is for chains that belong to someone else, such as the
+        administrator's chains that we jump to from the kernel chains (see
+        UserChainHooks) or the Go side of Felix's chains (see
+        frules.GO_CHAIN_PREFIX), which must exist for the jump to be valid.
+        We never flush, stub out or delete them.
+
+        :param chain_name: name of the chain, which must not have our
+            prefix.
+        """
+        assert not chain_name.startswith(FELIX_PREFIX), \
+            "Unmanaged chain %s has our prefix" % chain_name
+        self._unmanaged_chains.add(chain_name)
+        self._create_chain(chain_name)
+
+    def _create_chain(self, chain_name, log_level=logging.INFO):
+        """
+        Execute the iptables command to create the given chain, if it
+        doesn't exist.
+
+        Note: iptables-restore flushes any chain that its input declares,
+        so we have to use the iptables command instead.
+        """
+        try:
+            futils.check_call([self._iptables_cmd,
+                               "--table", self.table,
+                               "--new-chain", chain_name])
+        except FailedSystemCall:
+            # Most likely, the chain already exists; if not, we'll find out
+            # when we try to jump to it.
+            _log.log(log_level, "Failed to create chain %s, assuming it "
+                                "already exists.", chain_name)
+        else:
+            _log.log(log_level, "Created chain %s.", chain_name)
+
     @actor_message()
     def delete_chains(self, chain_names, callback=None):
         """
@@ -527,9 +574,16 @@ class IptablesUpdater(Actor):
 
     def _periodic_refresh(self):
         while True:
+            refresh_interval = self.config.REFRESH_INTERVAL
+            if refresh_interval <= 0:
+                # Refresh disabled; check back later in case it gets
+                # re-enabled.
+                gevent.sleep(REFRESH_DISABLED_POLL_INTERVAL)
+                continue
             # Jitter our sleep times by 20%.
-            gevent.sleep(self.refresh_interval * (1 + random.random() * 0.2))
-            self.refresh_iptables(async=True)
+            gevent.sleep(refresh_interval * (1 + random.random() * 0.2))
+            if self.config.REFRESH_INTERVAL > 0:
+                self.refresh_iptables(async=True)
 
     def _on_worker_died(self, watch_greenlet):
         """
@@ -603,7 +657,10 @@ class IptablesUpdater(Actor):
                 _log.info("Transaction included a refresh, re-applying our "
                           "inserts and deletions.")
                 try:
-                    for fragment in self._inserted_rule_fragments:
+                    for chain_name in self._unmanaged_chains:
+                        self._create_chain(chain_name,
+                                           log_level=logging.DEBUG)
+                    for fragment in self._inserted_rule_fragments.keys():
                         if self.chain_insert_mode == "insert":
                             self._insert_rule(fragment, log_level=logging.DEBUG)
                         else:
@@ -78,6 +78,11 @@ kernel chain:
 
 The top-level felix-XXX chains are static and configured at start-of-day.
 
+Ahead of each felix-XXX jump in the filter and nat tables, we also insert a
+jump to the chain of the same name with the Go side of Felix's prefix (for
+example, cali-FORWARD), in which the Go side programs its host-wide rules,
+such as port forwarding.
+
 The felix-FORWARD chain sends packet that arrive from a local workload to
 the felix-FROM-ENDPOINT chain, which applies inbound policy.  Packets that
 are denied by policy are dropped immediately.  However, accepted packets
@@ -127,7 +132,7 @@ import netaddr
 from calico.felix import devices
 from calico.felix import futils
 from calico.felix.futils import FailedSystemCall
-from calico.felix.ipsets import HOSTS_IPSET_V4
+from calico.felix.ipsets import HOSTS_IPSET_V4, IPVS_SERVICES_IPSETS
 
 _log = logging.getLogger(__name__)
 
@@ -203,9 +208,16 @@ HOST_DISPATCH_CHAINS = {
 CHAIN_FAILSAFE_IN = FELIX_PREFIX + "FAILSAFE-IN"
 CHAIN_FAILSAFE_OUT = FELIX_PREFIX + "FAILSAFE-OUT"
 
+# IPv6 chain that accepts the ICMPv6 messages that IPv6 needs to work, ahead
+# of host endpoint policy.
+CHAIN_ICMPV6_ND = FELIX_PREFIX + "ICMPV6-ND"
+
 # Per-endpoint/interface chain prefixes.
 CHAIN_TO_PREFIX = FELIX_PREFIX + "to-"
 CHAIN_FROM_PREFIX = FELIX_PREFIX + "from-"
+# Workload chain that checks the source address of traffic from the
+# workload, when AntiSpoofingEnabled is set.
+CHAIN_SOURCE_PREFIX = FELIX_PREFIX + "src-"
 
 # Top-level felix chains.
 CHAIN_PREROUTING = FELIX_PREFIX + "PREROUTING"
@@ -216,6 +228,16 @@ CHAIN_FORWARD = FELIX_PREFIX + "FORWARD"
 CHAIN_FIP_DNAT = FELIX_PREFIX + 'FIP-DNAT'
 CHAIN_FIP_SNAT = FELIX_PREFIX + 'FIP-SNAT'
 
+# The Go side of Felix programs the host-wide chains that it renders, such
+# as the port forwarding chains, under its own prefix.  It hooks them into
+# a dispatch chain per kernel chain, named after the kernel chain, which we
+# jump to from the filter and nat kernel chains ahead of our own chains.
+GO_CHAIN_PREFIX = "cali-"
+
+# The Go side's port scan detection chain.  Host endpoint chains jump to it
+# just before they drop a packet, when PortScanInterfaces is set.
+CHAIN_PORT_SCAN = GO_CHAIN_PREFIX + "portscan"
+
 
 def load_nf_conntrack():
     """
@@ -237,7 +259,7 @@ def load_nf_conntrack():
 
 
 def install_global_rules(config, filter_updater, nat_updater, ip_version,
-                         raw_updater=None):
+                         raw_updater=None, ipvs_enabled=False):
     """
     Set up global iptables rules. These are rules that do not change with
     endpoint, and are expected never to change (such as the rules that send all
@@ -247,6 +269,9 @@ def install_global_rules(config, filter_updater, nat_updater, ip_version,
 
     - ensures that all the required global tables are present;
     - applies any changes required.
+
+    If ipvs_enabled is True, the rules also apply workload policy to traffic
+    that kube-proxy's IPVS mode forwards to and from workloads.
     """
 
     # If enabled, create the IP-in-IP device, but only for IPv4
@@ -324,12 +349,11 @@ def install_global_rules(config, filter_updater, nat_updater, ip_version,
                                 CHAIN_OUTPUT: output_deps},
                                async=False)
 
-    nat_updater.ensure_rule_inserted(
-        "PREROUTING --jump %s" % CHAIN_PREROUTING, async=False)
-    nat_updater.ensure_rule_inserted(
-        "POSTROUTING --jump %s" % CHAIN_POSTROUTING, async=False)
-    nat_updater.ensure_rule_inserted(
-        "OUTPUT --jump %s" % CHAIN_OUTPUT, async=False)
+    for kernel_chain, felix_chain in (("PREROUTING", CHAIN_PREROUTING),
+                                      ("POSTROUTING", CHAIN_POSTROUTING),
+                                      ("OUTPUT", CHAIN_OUTPUT)):
+        _insert_kernel_chain_jumps(config, nat_updater, kernel_chain,
+                                   felix_chain, user_hooks=False)
 
     # Now the filter table. This needs to have felix-FORWARD and felix-INPUT
     # chains, which we must create before adding any rules that send to them.
@@ -339,11 +363,21 @@ def install_global_rules(config, filter_updater, nat_updater, ip_version,
     else:
         hosts_set_name = None
 
+    if ipvs_enabled:
+        ip_type = futils.IPV4 if ip_version == 4 else futils.IPV6
+        ipvs_ipset = IPVS_SERVICES_IPSETS[ip_type]
+        ipvs_set_name = ipvs_ipset.set_name
+        ipvs_ipset.ensure_exists()
+    else:
+        ipvs_set_name = None
+
     input_chain, input_deps = (
-        iptables_generator.filter_input_chain(ip_version, hosts_set_name)
+        iptables_generator.filter_input_chain(ip_version, hosts_set_name,
+                                              ipvs_set_name)
     )
     output_chain, output_deps = (
-        iptables_generator.filter_output_chain(ip_version)
+        iptables_generator.filter_output_chain(ip_version,
+                                               ipvs_enabled=ipvs_enabled)
     )
     forward_chain, forward_deps = (
         iptables_generator.filter_forward_chain(ip_version)
@@ -355,32 +389,77 @@ def install_global_rules(config, filter_updater, nat_updater, ip_version,
         iptables_generator.failsafe_out_chain()
     )
 
-    filter_updater.rewrite_chains(
-        {
-            CHAIN_FORWARD: forward_chain,
-            CHAIN_INPUT: input_chain,
-            CHAIN_OUTPUT: output_chain,
-            CHAIN_FAILSAFE_IN: failsafe_in_chain,
-            CHAIN_FAILSAFE_OUT: failsafe_out_chain,
-        },
-        {
-            CHAIN_FORWARD: forward_deps,
-            CHAIN_INPUT: input_deps,
-            CHAIN_OUTPUT: output_deps,
-            CHAIN_FAILSAFE_IN: failsafe_in_deps,
-            CHAIN_FAILSAFE_OUT: failsafe_out_deps,
-        },
-        async=False)
-
-    filter_updater.ensure_rule_inserted(
-        "INPUT --jump %s" % CHAIN_INPUT,
-        async=False)
-    filter_updater.ensure_rule_inserted(
-        "OUTPUT --jump %s" % CHAIN_OUTPUT,
-        async=False)
-    filter_updater.ensure_rule_inserted(
-        "FORWARD --jump %s" % CHAIN_FORWARD,
-        async=False)
+    filter_chains = {
+        CHAIN_FORWARD: forward_chain,
+        CHAIN_INPUT: input_chain,
+        CHAIN_OUTPUT: output_chain,
+        CHAIN_FAILSAFE_IN: failsafe_in_chain,
+        CHAIN_FAILSAFE_OUT: failsafe_out_chain,
+    }
+    filter_deps = {
+        CHAIN_FORWARD: forward_deps,
+        CHAIN_INPUT: input_deps,
+        CHAIN_OUTPUT: output_deps,
+        CHAIN_FAILSAFE_IN: failsafe_in_deps,
+        CHAIN_FAILSAFE_OUT: failsafe_out_deps,
+    }
+    if ip_version == 6:
+        # IPv6 host endpoint chains jump to this chain so that host
+        # protection doesn't break neighbor discovery.
+        icmpv6_nd_chain, icmpv6_nd_deps = (
+            iptables_generator.icmpv6_nd_chain()
+        )
+        filter_chains[CHAIN_ICMPV6_ND] = icmpv6_nd_chain
+        filter_deps[CHAIN_ICMPV6_ND] = icmpv6_nd_deps
+
+    filter_updater.rewrite_chains(filter_chains, filter_deps, async=False)
+
+    if config.PORT_SCAN_INTERFACES:
+        # Host endpoint chains jump to the Go side's port scan chain.  It
+        # can't be one of their deps, since we'd stub it out with a DROP
+        # rule until it exists, so create it here instead.
+        filter_updater.ensure_chain_exists(CHAIN_PORT_SCAN, async=False)
+
+    for kernel_chain, felix_chain in (("INPUT", CHAIN_INPUT),
+                                      ("OUTPUT", CHAIN_OUTPUT),
+                                      ("FORWARD", CHAIN_FORWARD)):
+        _insert_kernel_chain_jumps(config, filter_updater, kernel_chain,
+                                   felix_chain)
+
+
+def _insert_kernel_chain_jumps(config, updater, kernel_chain, felix_chain,
+                               user_hooks=True):
+    """
+    Inserts the jumps from the given kernel chain to the Go side's dispatch
+    chain (see GO_CHAIN_PREFIX) and then to the felix chain, along with the
+    jumps to any user chains that UserChainHooks puts before or after them.
+    UserChainHooks only applies to the filter table, so the nat table passes
+    user_hooks=False.
+
+    The Go side's chain and the user chains belong to someone else: we
+    create them if they don't exist, so that the jumps are valid, but never
+    touch their rules.
+    """
+    hook = kernel_chain.lower()
+    user_chains = dict((position, []) for position in ("before", "after"))
+    for user_hook, position, user_chain in config.USER_CHAIN_HOOKS:
+        if user_hooks and user_hook == hook:
+            _log.info("Hooking user chain %s %s felix chain in %s",
+                      user_chain, position, kernel_chain)
+            updater.ensure_chain_exists(user_chain, async=False)
+            user_chains[position].append(user_chain)
+    go_chain = GO_CHAIN_PREFIX + kernel_chain
+    updater.ensure_chain_exists(go_chain, async=False)
+    targets = (user_chains["before"] + [go_chain, felix_chain] +
+               user_chains["after"])
+    fragments = ["%s --jump %s" % (kernel_chain, target)
+                 for target in targets]
+    if config.CHAIN_INSERT_MODE == "insert":
+        # Each insert goes to the top of the chain, so insert the jumps in
+        # reverse to leave them in order.
+        fragments.reverse()
+    for fragment in fragments:
+        updater.ensure_rule_inserted(fragment, async=False)
 
 
 def _configure_ipip_device(config):
@@ -417,9 +496,8 @@ def interface_to_chain_suffix(config, iface_name):
     :param iface_name: The interface name
     :returns string: the suffix (shortened if necessary)
     """
-    for prefix in sorted(config.IFACE_PREFIX, reverse=True):
-        if iface_name.startswith(prefix):
-            iface_name = iface_name[len(prefix):]
-            break
+    prefix = futils.workload_iface_prefix(iface_name, config.IFACE_PREFIX)
+    if prefix:
+        iface_name = iface_name[len(prefix):]
     iface_name = futils.uniquely_shorten(iface_name, 16)
     return iface_name
@@ -21,6 +21,7 @@ felix.futils
 
 Felix utilities.
 """
+import base64
 import collections
 import functools
 import hashlib
@@ -408,6 +409,26 @@ def uniquely_shorten(string, length):
     return SHORTENED_PREFIX + hash_text[:length-len(SHORTENED_PREFIX)]
 
 
+def length_limited_id(prefix, suffix, max_length):
+    """
+    Returns prefix followed by suffix if that fits within max_length.
+    Otherwise, and if the suffix starts with SHORTENED_PREFIX, replaces the
+    suffix with SHORTENED_PREFIX followed by a truncated hash of it.
+
+    This matches the Go side's hashutils.GetLengthLimitedID(), so that the
+    IDs that it parses back out of our rules are the ones it would have
+    rendered.
+    """
+    if (len(prefix) + len(suffix) <= max_length and
+            not suffix.startswith(SHORTENED_PREFIX)):
+        return prefix + suffix
+
+    hash_text = base64.urlsafe_b64encode(
+        hashlib.sha224(suffix).digest()).rstrip("=")
+    chars_left = max_length - len(prefix) - len(SHORTENED_PREFIX)
+    return prefix + SHORTENED_PREFIX + hash_text[:chars_left]
+
+
 _registered_diags = []
 
 
@@ -640,6 +661,39 @@ def find_longest_prefix(strs):
     return longest_prefix
 
 
+def iface_is_excluded(iface_name, patterns):
+    """Checks whether an interface matches one of the configured exclusions.
+
+    The patterns use iptables' interface syntax: a trailing "+" matches any
+    interface whose name starts with the rest of the pattern; otherwise the
+    name must match exactly.
+    :param str iface_name: Interface name.
+    :param list[str] patterns: Exclusion patterns, from InterfaceExclude.
+    :returns True if the interface is excluded."""
+    for pattern in patterns:
+        if pattern.endswith("+"):
+            if iface_name.startswith(pattern[:-1]):
+                return True
+        elif iface_name == pattern:
+            return True
+    return False
+
+
+def workload_iface_prefix(iface_name, prefixes):
+    """Finds the workload interface prefix that owns an interface.
+
+    If several prefixes match, the longest wins, so that, for example, "tap"
+    and "tapx" can be configured side-by-side.
+    :param str iface_name: Interface name.
+    :param list[str] prefixes: Workload prefixes, from InterfacePrefix.
+    :returns the matching prefix or None if the interface is not a workload
+             interface."""
+    for prefix in sorted(prefixes, key=len, reverse=True):
+        if prefix and iface_name.startswith(prefix):
+            return prefix
+    return None
+
+
 def report_usage_and_get_warnings(calico_version, hostname, cluster_guid, cluster_size, cluster_type):
     """Reports the cluster's guid, size and version to projectcalico.org.
     Logs out of date calico versions, to the standard log file.
@@ -574,6 +574,17 @@ HOSTS_IPSET_V4 = Ipset(FELIX_PFX + "calico-hosts-4",
                        FELIX_PFX + "calico-hosts-4-tmp",
                        "inet")
 
+# For kube-proxy's IPVS mode, global ipsets that contain the service addresses
+# that are assigned to the kube-ipvs0 device.
+IPVS_SERVICES_IPSETS = {
+    IPV4: Ipset(FELIX_PFX + "ipvs-services-4",
+                FELIX_PFX + "ipvs-services-4-tmp",
+                "inet"),
+    IPV6: Ipset(FELIX_PFX + "ipvs-services-6",
+                FELIX_PFX + "ipvs-services-6-tmp",
+                "inet6"),
+}
+
 
 def tag_to_ipset_name(ip_type, tag, tmp=False):
     """
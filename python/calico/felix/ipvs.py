@@ -0,0 +1,132 @@
+# -*- coding: utf-8 -*-
+# Copyright (c) 2016 Tigera, Inc. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""
+felix.ipvs
+~~~~~~~~~~
+
+Support for hosts where kube-proxy runs in IPVS mode.
+
+IPVS accepts service traffic in the INPUT chain, since the service addresses
+are local (they're assigned to the kube-ipvs0 device), and then forwards it
+to the backend via the OUTPUT chain.  The traffic therefore skips the FORWARD
+chain, where we normally apply endpoint policy.  Instead, the global INPUT and
+OUTPUT chains pick out service traffic by matching on an ipset of the
+addresses of kube-ipvs0, which the IpvsAddressWatcher keeps up to date.
+"""
+import logging
+import sys
+
+import gevent
+
+from calico.felix import devices
+from calico.felix.actor import Actor, TimedGreenlet
+from calico.felix.futils import FailedSystemCall
+
+_log = logging.getLogger(__name__)
+
+# The dummy device that kube-proxy assigns the service addresses to.
+KUBE_IPVS_IFACE = "kube-ipvs0"
+
+# Poll interval to use if host interface polling is disabled.  Unlike host
+# endpoint IPs, the service addresses change all the time so we can't get
+# away with only reading them once.
+DEFAULT_POLL_INTERVAL_SECS = 10
+
+
+def detect_kube_ipvs(config):
+    """Decides whether to enable IPVS support, based on KubeIPVSSupport.
+
+    :returns tuple[bool,str]: enabled, reason for it being disabled or None.
+    """
+    if config.KUBE_IPVS_SUPPORT == "true":
+        return True, None
+    if config.KUBE_IPVS_SUPPORT == "false":
+        return False, "KubeIPVSSupport is 'false'"
+    if config.IPTABLES_MARK_IPVS is None:
+        return False, "IptablesMarkMask has no spare bit"
+    if devices.interface_exists(KUBE_IPVS_IFACE):
+        return True, None
+    return False, "%s device not found" % KUBE_IPVS_IFACE
+
+
+class IpvsAddressWatcher(Actor):
+    """
+    Polls the addresses of the kube-ipvs0 device, copying them to the IPVS
+    services ipsets.
+    """
+    def __init__(self, config, ipset_actors):
+        """
+        :param ipset_actors: dict mapping from IP type (futils.IPV4 or
+               futils.IPV6) to the IpsetActor of the IP type's IPVS services
+               ipset.
+        """
+        super(IpvsAddressWatcher, self).__init__()
+        self.config = config
+        self.ipset_actors = ipset_actors
+        self._poll_greenlet = TimedGreenlet(self._poll_loop)
+        self._poll_greenlet.link_exception(self._on_worker_died)
+
+    def _on_actor_started(self):
+        _log.info("IPVS address watcher started, spawning poll worker.")
+        self._poll_greenlet.start()
+
+    def _poll_loop(self):
+        """Greenlet: polls the addresses of the kube-ipvs0 device."""
+        interval = self.config.HOST_IF_POLL_INTERVAL_SECS
+        if interval <= 0:
+            interval = DEFAULT_POLL_INTERVAL_SECS
+        known_ips = {}
+        while True:
+            known_ips = self._poll_addresses(known_ips)
+            gevent.sleep(interval)
+
+    def _poll_addresses(self, known_ips):
+        """Does a single poll of the device's addresses, updating the ipsets
+        of the IP types whose addresses have changed.
+
+        :param known_ips: dict mapping from IP type to the set of addresses
+               found by the previous poll.
+        :returns: the dict for the next poll.
+        """
+        new_ips = {}
+        for ip_type, ipset_actor in self.ipset_actors.iteritems():
+            try:
+                ips = self._read_addresses(ip_type)
+            except FailedSystemCall:
+                # Most likely the device went away while we were reading it;
+                # leave the ipset alone until the next poll.
+                _log.warning("Failed to read %s addresses of %s",
+                             ip_type, KUBE_IPVS_IFACE)
+                new_ips[ip_type] = known_ips.get(ip_type)
+                continue
+            if ips != known_ips.get(ip_type):
+                _log.info("IPVS service addresses (%s) changed: %s",
+                          ip_type, ips)
+                ipset_actor.replace_members(ips, async=True)
+            new_ips[ip_type] = ips
+        return new_ips
+
+    def _read_addresses(self, ip_type):
+        if not devices.interface_exists(KUBE_IPVS_IFACE):
+            return set()
+        ips = devices.list_interface_ips(ip_type, KUBE_IPVS_IFACE)
+        return set(str(ip) for ip in ips if not ip.is_link_local())
+
+    def _on_worker_died(self, watch_greenlet):
+        """
+        Greenlet: spawned by the gevent Hub if our worker thread dies.
+        """
+        _log.critical("Worker greenlet died: %s; exiting.", watch_greenlet)
+        sys.exit(1)
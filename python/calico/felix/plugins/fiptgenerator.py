@@ -41,19 +41,21 @@ import itertools
 
 import syslog
 
-from calico.common import KNOWN_RULE_KEYS
+from calico.common import KERNEL_PORT_PROTOCOLS, KNOWN_RULE_KEYS
 from calico.datamodel_v1 import TieredPolicyId
 from calico.felix import futils
 from calico.felix.fplugin import FelixPlugin
 from calico.felix.profilerules import UnsupportedICMPType
 from calico.felix.frules import (CHAIN_TO_ENDPOINT, CHAIN_FROM_ENDPOINT,
                                  CHAIN_TO_PREFIX, CHAIN_FROM_PREFIX,
+                                 CHAIN_SOURCE_PREFIX,
                                  CHAIN_PREROUTING, CHAIN_POSTROUTING,
                                  CHAIN_INPUT, CHAIN_FORWARD,
                                  FELIX_PREFIX, CHAIN_FIP_DNAT, CHAIN_FIP_SNAT,
                                  CHAIN_TO_IFACE, CHAIN_FROM_IFACE,
                                  CHAIN_OUTPUT, CHAIN_FAILSAFE_IN,
-                                 CHAIN_FAILSAFE_OUT)
+                                 CHAIN_FAILSAFE_OUT, CHAIN_ICMPV6_ND,
+                                 CHAIN_PORT_SCAN)
 
 CHAIN_PROFILE_PREFIX = FELIX_PREFIX + "p-"
 
@@ -63,10 +65,31 @@ _log = logging.getLogger(__name__)
 # 2 entries.
 MAX_MULTIPORT_ENTRIES = 15
 
+# ICMPv6 types that IPv6 needs in order to work at all, which we accept ahead
+# of host endpoint policy:
+#
+# - 2: packet too big, without which path MTU discovery fails.
+# - 133: router solicitation.
+# - 134: router advertisement.
+# - 135: neighbor solicitation.
+# - 136: neighbor advertisement.
+ICMPV6_PACKET_TOO_BIG = 2
+ICMPV6_ND_TYPES = [133, 134, 135, 136]
+
+# Matches the target of a rule fragment that accepts the packet.
+_ACCEPT_RE = re.compile(r"--jump ACCEPT(?=\s|$)")
+
 # The default syslog level that packets get logged at when using the log
 # action.
 DEFAULT_PACKET_LOG_LEVEL = syslog.LOG_NOTICE
 
+# The NFLOG groups that the endpoint chains send flow log packets to, for
+# traffic to and from endpoints respectively, and the longest prefix that
+# NFLOG allows.  They must match the Go side's, which reads the groups.
+NFLOG_INBOUND_GROUP = 1
+NFLOG_OUTBOUND_GROUP = 2
+MAX_NFLOG_PREFIX_LENGTH = 63
+
 
 class FelixIptablesGenerator(FelixPlugin):
     """
@@ -76,15 +99,27 @@ class FelixIptablesGenerator(FelixPlugin):
     def __init__(self):
         self.IFACE_PREFIX = None
         self.IFACE_MATCH = None
+        self.IFACE_EXCLUDE = None
         self.DEFAULT_INPUT_CHAIN_ACTION = None
         self.METADATA_IP = None
         self.METADATA_PORT = None
         self.IPTABLES_MARK_ACCEPT = None
         self.IPTABLES_MARK_NEXT_TIER = None
         self.IPTABLES_MARK_ENDPOINTS = None
+        self.IPTABLES_MARK_IPVS = None
+        self.IPTABLES_MARK_VERDICT_CACHE_IN = None
+        self.IPTABLES_MARK_VERDICT_CACHE_OUT = None
         self.FAILSAFE_INBOUND_PORTS = None
         self.FAILSAFE_OUTBOUND_PORTS = None
         self.ACTION_ON_DROP = None
+        self.DROP_INVALID_CONNTRACK = None
+        self.CONNTRACK_BYPASS_ENABLED = None
+        self.CHAIN_ACCEPT_ACTION = None
+        self.DROP_WORKLOAD_ROUTER_ADVERTS = None
+        self.DROP_WORKLOAD_DHCP_SERVERS = None
+        self.PORT_SCAN_INTERFACES = None
+        self.FLOW_LOGS_ENABLED = None
+        self.ANTI_SPOOFING_ENABLED = None
 
     def store_and_validate_config(self, config):
         # We don't have any plugin specific parameters, but we need to save
@@ -94,15 +129,30 @@ class FelixIptablesGenerator(FelixPlugin):
 
         self.IFACE_PREFIX = config.IFACE_PREFIX
         self.IFACE_MATCH = [prefix + "+" for prefix in self.IFACE_PREFIX]
+        self.IFACE_EXCLUDE = config.IFACE_EXCLUDE
         self.METADATA_IP = config.METADATA_IP
         self.METADATA_PORT = config.METADATA_PORT
         self.DEFAULT_INPUT_CHAIN_ACTION = config.DEFAULT_INPUT_CHAIN_ACTION
         self.IPTABLES_MARK_ACCEPT = config.IPTABLES_MARK_ACCEPT
         self.IPTABLES_MARK_NEXT_TIER = config.IPTABLES_MARK_NEXT_TIER
         self.IPTABLES_MARK_ENDPOINTS = config.IPTABLES_MARK_ENDPOINTS
+        self.IPTABLES_MARK_IPVS = config.IPTABLES_MARK_IPVS
+        self.IPTABLES_MARK_VERDICT_CACHE_IN = \
+            config.IPTABLES_MARK_VERDICT_CACHE_IN
+        self.IPTABLES_MARK_VERDICT_CACHE_OUT = \
+            config.IPTABLES_MARK_VERDICT_CACHE_OUT
         self.FAILSAFE_INBOUND_PORTS = config.FAILSAFE_INBOUND_PORTS
         self.FAILSAFE_OUTBOUND_PORTS = config.FAILSAFE_OUTBOUND_PORTS
         self.ACTION_ON_DROP = config.ACTION_ON_DROP
+        self.DROP_INVALID_CONNTRACK = config.DROP_INVALID_CONNTRACK
+        self.CONNTRACK_BYPASS_ENABLED = config.CONNTRACK_BYPASS_ENABLED
+        self.CHAIN_ACCEPT_ACTION = config.CHAIN_ACCEPT_ACTION
+        self.DROP_WORKLOAD_ROUTER_ADVERTS = \
+            config.DROP_WORKLOAD_ROUTER_ADVERTS
+        self.DROP_WORKLOAD_DHCP_SERVERS = config.DROP_WORKLOAD_DHCP_SERVERS
+        self.PORT_SCAN_INTERFACES = config.PORT_SCAN_INTERFACES
+        self.FLOW_LOGS_ENABLED = config.FLOW_LOGS_ENABLED
+        self.ANTI_SPOOFING_ENABLED = config.ANTI_SPOOFING_ENABLED
         self.LOG_PREFIX = config.LOG_PREFIX
 
     def raw_rpfilter_failed_chain(self, ip_version):
@@ -202,7 +252,8 @@ class FelixIptablesGenerator(FelixPlugin):
 
         return chain, deps
 
-    def filter_input_chain(self, ip_version, hosts_set_name=None):
+    def filter_input_chain(self, ip_version, hosts_set_name=None,
+                           ipvs_set_name=None):
         """
         Generate the IPv4/IPv6 FILTER felix-INPUT chains.
 
@@ -214,6 +265,12 @@ class FelixIptablesGenerator(FelixPlugin):
         required as any existing chain will be overwritten.
 
         :param ip_version.  Whether this is the IPv4 or IPv6 FILTER table.
+        :param ipvs_set_name.  If set, the name of the ipset of IPVS service
+               addresses.  Traffic to those addresses is marked so that the
+               OUTPUT chain applies the destination's endpoint policy once
+               IPVS has forwarded it.  Traffic from workloads to them is
+               subject to the workload's policy, rather than being treated
+               as traffic to the host.
         :returns Tuple: list of rules, set of deps.
         """
 
@@ -246,11 +303,16 @@ class FelixIptablesGenerator(FelixPlugin):
                 None)
             )
 
+        chain.extend(self._excluded_iface_rules(CHAIN_INPUT,
+                                                "--in-interface"))
+        chain.extend(self._rogue_server_rules(ip_version, CHAIN_INPUT))
+
         # Allow established connections via the conntrack table.
-        chain.extend(self.drop_rules(ip_version,
-                                     CHAIN_INPUT,
-                                     "--match conntrack --ctstate INVALID",
-                                     None))
+        if "input" in self.DROP_INVALID_CONNTRACK:
+            chain.extend(self.drop_rules(ip_version,
+                                         CHAIN_INPUT,
+                                         "--match conntrack --ctstate INVALID",
+                                         None))
         chain.append("--append %s --match conntrack "
                      "--ctstate RELATED,ESTABLISHED --jump ACCEPT" %
                      CHAIN_INPUT)
@@ -258,6 +320,17 @@ class FelixIptablesGenerator(FelixPlugin):
             "--append {chain} --jump MARK --set-mark 0/{mark}".format(
                 chain=CHAIN_INPUT, mark=self.IPTABLES_MARK_ENDPOINTS)
         )
+        if ipvs_set_name:
+            chain.append(
+                "--append {chain} --jump MARK --set-mark 0/{mark}".format(
+                    chain=CHAIN_INPUT, mark=self.IPTABLES_MARK_IPVS)
+            )
+            chain.append(
+                "--append {chain} --match set --match-set {set} dst "
+                "--jump MARK --set-mark {mark}/{mark}".format(
+                    chain=CHAIN_INPUT, set=ipvs_set_name,
+                    mark=self.IPTABLES_MARK_IPVS)
+            )
         for iface_match in self.IFACE_MATCH:
             chain.append(
                 "--append {chain} --in-interface {iface} "
@@ -274,6 +347,23 @@ class FelixIptablesGenerator(FelixPlugin):
         )
         deps.add(CHAIN_FROM_IFACE)
 
+        if ipvs_set_name:
+            # Traffic from a workload to an IPVS service is really heading
+            # for another endpoint so apply the workload's policy and, if it
+            # RETURNs, accept it, whatever DefaultEndpointToHostAction says.
+            chain.append(
+                "--append {chain} --match mark --mark {mark}/{mark} "
+                "--jump {target}".format(
+                    chain=CHAIN_INPUT, mark=self.IPTABLES_MARK_IPVS,
+                    target=CHAIN_FROM_ENDPOINT)
+            )
+            chain.append(
+                "--append {chain} --match mark --mark {mark}/{mark} "
+                "--jump ACCEPT".format(
+                    chain=CHAIN_INPUT, mark=self.IPTABLES_MARK_IPVS)
+            )
+            deps.add(CHAIN_FROM_ENDPOINT)
+
         # To act as a router for IPv6, we have to accept various types of
         # ICMPv6 messages, as follows:
         #
@@ -344,9 +434,10 @@ class FelixIptablesGenerator(FelixPlugin):
                     (CHAIN_INPUT, self.DEFAULT_INPUT_CHAIN_ACTION)
                 )
 
-        return chain, deps
+        return self._apply_accept_action(chain), deps
 
-    def filter_output_chain(self, ip_version, hosts_set_name=None):
+    def filter_output_chain(self, ip_version, hosts_set_name=None,
+                            ipvs_enabled=False):
         """
         Generate the IPv4/IPv6 FILTER felix-OUTPUT chains.
 
@@ -358,20 +449,44 @@ class FelixIptablesGenerator(FelixPlugin):
         required as any existing chain will be overwritten.
 
         :param ip_version.  Whether this is the IPv4 or IPv6 FILTER table.
+        :param ipvs_enabled.  If True, apply workload policy to the traffic
+               that IPVS forwards to workloads, as marked by the felix-INPUT
+               chain.
         :returns Tuple: list of rules, set of deps.
         """
 
-        chain = []
+        chain = self._excluded_iface_rules(CHAIN_OUTPUT, "--out-interface")
         deps = set()
 
         # Allow established connections via the conntrack table.
-        chain.extend(self.drop_rules(ip_version,
-                                     CHAIN_OUTPUT,
-                                     "--match conntrack --ctstate INVALID",
-                                     None))
+        if "output" in self.DROP_INVALID_CONNTRACK:
+            chain.extend(self.drop_rules(ip_version,
+                                         CHAIN_OUTPUT,
+                                         "--match conntrack --ctstate INVALID",
+                                         None))
         chain.append("--append %s --match conntrack "
                      "--ctstate RELATED,ESTABLISHED --jump ACCEPT" %
                      CHAIN_OUTPUT)
+        if ipvs_enabled:
+            # IPVS forwards service traffic to workloads from the OUTPUT
+            # chain rather than the FORWARD chain.
+            for iface_match in self.IFACE_MATCH:
+                chain.append(
+                    "--append {chain} --out-interface {iface} "
+                    "--match mark --mark {mark}/{mark} "
+                    "--jump {target}".format(
+                        chain=CHAIN_OUTPUT, iface=iface_match,
+                        mark=self.IPTABLES_MARK_IPVS,
+                        target=CHAIN_TO_ENDPOINT)
+                )
+                chain.append(
+                    "--append {chain} --out-interface {iface} "
+                    "--match mark --mark {mark}/{mark} "
+                    "--jump ACCEPT".format(
+                        chain=CHAIN_OUTPUT, iface=iface_match,
+                        mark=self.IPTABLES_MARK_IPVS)
+                )
+            deps.add(CHAIN_TO_ENDPOINT)
         chain.append(
             "--append {chain} --jump MARK --set-mark 0/{mark}".format(
                 chain=CHAIN_OUTPUT, mark=self.IPTABLES_MARK_ENDPOINTS)
@@ -392,7 +507,7 @@ class FelixIptablesGenerator(FelixPlugin):
         )
         deps.add(CHAIN_TO_IFACE)
 
-        return chain, deps
+        return self._apply_accept_action(chain), deps
 
     def filter_forward_chain(self, ip_version):
         """
@@ -408,26 +523,36 @@ class FelixIptablesGenerator(FelixPlugin):
         :param ip_version.  Whether this is the IPv4 or IPv6 FILTER table.
         :returns Tuple: list of rules, set of deps.
         """
-        forward_chain = []
+        forward_chain = self._excluded_iface_rules(CHAIN_FORWARD,
+                                                   "--in-interface",
+                                                   "--out-interface")
+        forward_chain.extend(self._rogue_server_rules(ip_version,
+                                                      CHAIN_FORWARD))
         for iface_match in self.IFACE_MATCH:
-            forward_chain.extend(self.drop_rules(
-                ip_version, CHAIN_FORWARD,
-                "--in-interface %s --match conntrack --ctstate "
-                "INVALID" % iface_match, None))
-            forward_chain.extend(
-                self.drop_rules(
+            if "forward" in self.DROP_INVALID_CONNTRACK:
+                forward_chain.extend(self.drop_rules(
                     ip_version, CHAIN_FORWARD,
-                    "--out-interface %s --match conntrack --ctstate "
+                    "--in-interface %s --match conntrack --ctstate "
                     "INVALID" % iface_match, None))
+                forward_chain.extend(
+                    self.drop_rules(
+                        ip_version, CHAIN_FORWARD,
+                        "--out-interface %s --match conntrack --ctstate "
+                        "INVALID" % iface_match, None))
+            # First, a pair of conntrack rules, which accept established
+            # flows to/from workload interfaces.  With the bypass disabled,
+            # only replies skip policy; the packets in the original
+            # direction go through the endpoint chains every time.
+            established = "--ctstate RELATED,ESTABLISHED"
+            if not self.CONNTRACK_BYPASS_ENABLED:
+                established += " --ctdir REPLY"
             forward_chain.extend([
-                # First, a pair of conntrack rules, which accept established
-                # flows to/from workload interfaces.
                 "--append %s --in-interface %s --match conntrack "
-                "--ctstate RELATED,ESTABLISHED --jump ACCEPT" %
-                (CHAIN_FORWARD, iface_match),
+                "%s --jump ACCEPT" %
+                (CHAIN_FORWARD, iface_match, established),
                 "--append %s --out-interface %s --match conntrack "
-                "--ctstate RELATED,ESTABLISHED --jump ACCEPT" %
-                (CHAIN_FORWARD, iface_match),
+                "%s --jump ACCEPT" %
+                (CHAIN_FORWARD, iface_match, established),
             ])
 
         for iface_match in self.IFACE_MATCH:
@@ -458,7 +583,85 @@ class FelixIptablesGenerator(FelixPlugin):
                 (CHAIN_FORWARD, iface_match),
             ])
 
-        return forward_chain, set([CHAIN_FROM_ENDPOINT, CHAIN_TO_ENDPOINT])
+        return (self._apply_accept_action(forward_chain),
+                set([CHAIN_FROM_ENDPOINT, CHAIN_TO_ENDPOINT]))
+
+    def _rogue_server_rules(self, ip_version, chain_name):
+        """
+        Generates the rules that drop the router advertisements and DHCP
+        server messages that workloads aren't allowed to send, according to
+        DropWorkloadRouterAdvertisements and DropWorkloadDHCPServers.
+
+        These come before the conntrack rules and any policy, so that
+        nothing can allow them.  Only traffic from workload interfaces is
+        matched; the host's own advertisements and DHCP replies go through
+        the OUTPUT chain.
+
+        :param ip_version.  Whether these are for the IPv4 or IPv6 iptables.
+        :param chain_name: the chain that the rules will be appended to.
+        :returns list: iptables fragments.
+        """
+        rule_specs = []
+        if self.DROP_WORKLOAD_ROUTER_ADVERTS and ip_version == 6:
+            rule_specs.append(("--protocol ipv6-icmp --icmpv6-type 134",
+                               "Drop router advertisements from workloads"))
+        if self.DROP_WORKLOAD_DHCP_SERVERS:
+            if ip_version == 4:
+                dhcp_server_ports = "--sport 67 --dport 68"
+            else:
+                dhcp_server_ports = "--sport 547 --dport 546"
+            rule_specs.append(("--protocol udp " + dhcp_server_ports,
+                               "Drop DHCP server messages from workloads"))
+        rules = []
+        for iface_match in self.IFACE_MATCH:
+            for rule_spec, comment in rule_specs:
+                rules.extend(self.drop_rules(
+                    ip_version, chain_name,
+                    "--in-interface %s %s" % (iface_match, rule_spec),
+                    comment))
+        return rules
+
+    def _apply_accept_action(self, chain):
+        """
+        Rewrites the rules in one of the top-level filter chains that accept
+        packets according to ChainAcceptAction.  With "RETURN", instead of
+        accepting the packet, each rule sets the accept mark and returns it
+        to the kernel chain, so that other iptables users that come after
+        us can still see the traffic and make the final decision, using the
+        mark to tell that Calico allowed it.
+
+        :param chain: list of iptables fragments.
+        :returns list: iptables fragments.
+        """
+        if self.CHAIN_ACCEPT_ACTION == "ACCEPT":
+            return chain
+        set_mark = "--jump MARK --set-mark {mark}/{mark}".format(
+            mark=self.IPTABLES_MARK_ACCEPT)
+        rewritten = []
+        for fragment in chain:
+            if _ACCEPT_RE.search(fragment):
+                rewritten.append(_ACCEPT_RE.sub(set_mark, fragment))
+                rewritten.append(_ACCEPT_RE.sub("--jump RETURN", fragment))
+            else:
+                rewritten.append(fragment)
+        return rewritten
+
+    def _excluded_iface_rules(self, chain_name, *iface_options):
+        """
+        Generate the rules that return packets to or from the interfaces
+        that InterfaceExclude covers, so that none of Felix's other rules in
+        the chain apply to them.
+
+        :param chain_name: Chain to append the rules to.
+        :param iface_options: The interface options to match on,
+               "--in-interface" and/or "--out-interface".
+        :returns list: iptables fragments.
+        """
+        return [
+            "--append %s %s %s --jump RETURN" % (chain_name, option, pattern)
+            for pattern in self.IFACE_EXCLUDE
+            for option in iface_options
+        ]
 
     def endpoint_chain_names(self, endpoint_suffix):
         """
@@ -472,7 +675,10 @@ class FelixIptablesGenerator(FelixPlugin):
         """
         to_chain_name = (CHAIN_TO_PREFIX + endpoint_suffix)
         from_chain_name = (CHAIN_FROM_PREFIX + endpoint_suffix)
-        return set([to_chain_name, from_chain_name])
+        chain_names = set([to_chain_name, from_chain_name])
+        if self.ANTI_SPOOFING_ENABLED:
+            chain_names.add(CHAIN_SOURCE_PREFIX + endpoint_suffix)
+        return chain_names
 
     def host_endpoint_updates(self, ip_version, endpoint_id, suffix,
                               profile_ids, pol_ids_by_tier):
@@ -486,11 +692,17 @@ class FelixIptablesGenerator(FelixPlugin):
             to_direction="outbound",
             from_direction="inbound",
             with_failsafe=True,
+            detect_port_scans=bool(self.PORT_SCAN_INTERFACES),
+            cache_verdicts=False,
+            log_flows=False,
         )
 
     def endpoint_updates(self, ip_version, endpoint_id, suffix, mac,
                          profile_ids, pol_ids_by_tier, to_direction="inbound",
-                         from_direction="outbound", with_failsafe=False):
+                         from_direction="outbound", with_failsafe=False,
+                         max_connection_rate=None, detect_port_scans=False,
+                         cache_verdicts=True, log_flows=True,
+                         source_nets=None):
         """
         Generate a set of iptables updates that will program all of the chains
         needed for a given endpoint.
@@ -509,12 +721,39 @@ class FelixIptablesGenerator(FelixPlugin):
         endpoint
         :param OrderedDict pol_ids_by_tier: ordered dict mapping tier name
                to list of profiles.
+        :param max_connection_rate: If set, the maximum rate, per second, at
+               which the endpoint may open new connections.
+        :param detect_port_scans: If set, the from chain passes the packets
+               that it's about to drop to the port scan detection chain.
+        :param cache_verdicts: If set, and the verdict cache is enabled,
+               the chains record accepted flows in a connmark and accept
+               the flows that they've already accepted.
+        :param log_flows: If set, and flow logs are enabled, the chains send
+               the packets that get a policy verdict to NFLOG.
+        :param source_nets: If set, and anti-spoofing is enabled, the CIDRs
+               that the endpoint may send traffic from.  The from chain
+               jumps to a third chain, CHAIN_SOURCE_PREFIX + suffix, which
+               drops traffic from any other source.
 
         :returns Tuple: updates, deps
         """
 
         to_chain_name = (CHAIN_TO_PREFIX + suffix)
         from_chain_name = (CHAIN_FROM_PREFIX + suffix)
+        if cache_verdicts:
+            to_verdict_mark = self.IPTABLES_MARK_VERDICT_CACHE_IN
+            from_verdict_mark = self.IPTABLES_MARK_VERDICT_CACHE_OUT
+        else:
+            to_verdict_mark = from_verdict_mark = None
+        if source_nets is not None and self.ANTI_SPOOFING_ENABLED:
+            source_chain_name = CHAIN_SOURCE_PREFIX + suffix
+        else:
+            source_chain_name = None
+        if log_flows and self.FLOW_LOGS_ENABLED:
+            to_nflog_group = NFLOG_INBOUND_GROUP
+            from_nflog_group = NFLOG_OUTBOUND_GROUP
+        else:
+            to_nflog_group = from_nflog_group = None
 
         to_chain, to_deps = self._build_to_or_from_chain(
             ip_version,
@@ -524,6 +763,8 @@ class FelixIptablesGenerator(FelixPlugin):
             to_chain_name,
             to_direction,
             with_failsafe=with_failsafe,
+            verdict_mark=to_verdict_mark,
+            nflog_group=to_nflog_group,
         )
         from_chain, from_deps = self._build_to_or_from_chain(
             ip_version,
@@ -534,12 +775,63 @@ class FelixIptablesGenerator(FelixPlugin):
             from_direction,
             expected_mac=mac,
             with_failsafe=with_failsafe,
+            max_connection_rate=max_connection_rate,
+            detect_port_scans=detect_port_scans,
+            verdict_mark=from_verdict_mark,
+            nflog_group=from_nflog_group,
+            source_chain=source_chain_name,
         )
 
         updates = {to_chain_name: to_chain, from_chain_name: from_chain}
         deps = {to_chain_name: to_deps, from_chain_name: from_deps}
+        if source_chain_name:
+            updates[source_chain_name] = self._source_chain(
+                ip_version, source_chain_name, source_nets)
+            deps[source_chain_name] = set()
         return updates, deps
 
+    def _source_chain(self, ip_version, chain_name, source_nets):
+        """
+        Generates the chain that returns traffic from the given source nets
+        and drops everything else, so that a workload can't send traffic
+        from another workload's address even if the reverse path filter is
+        disabled.
+
+        :returns list: iptables fragments.
+        """
+        chain = [
+            "--append %s --source %s --jump RETURN" % (chain_name, net)
+            for net in source_nets
+        ]
+        chain.extend(self.drop_rules(
+            ip_version, chain_name, None,
+            "Drop if source address is not the endpoint's"))
+        return chain
+
+    def _connection_rate_rules(self, ip_version, chain_name,
+                               max_connection_rate):
+        """
+        Generates the rules that drop new connections from an endpoint once
+        it exceeds its connection rate limit.
+
+        The hashlimit match keeps one bucket for the whole endpoint, named
+        after the endpoint's chain.  Bursts of up to a second's worth of
+        connections are allowed.
+
+        :returns list: iptables fragments.
+        """
+        # Older kernels limit hashlimit names to 15 characters.
+        hashlimit_name = futils.uniquely_shorten(chain_name, 15)
+        return self.drop_rules(
+            ip_version, chain_name,
+            "--match conntrack --ctstate NEW "
+            "--match hashlimit --hashlimit-above %(rate)s/sec "
+            "--hashlimit-burst %(rate)s --hashlimit-name %(name)s" % {
+                "rate": max_connection_rate,
+                "name": hashlimit_name,
+            },
+            "Connection rate limit exceeded")
+
     def failsafe_in_chain(self):
         updates = []
         for port in self.FAILSAFE_INBOUND_PORTS:
@@ -558,6 +850,33 @@ class FelixIptablesGenerator(FelixPlugin):
         deps = set()
         return updates, deps
 
+    def icmpv6_nd_chain(self):
+        """
+        Generate the felix-ICMPV6-ND chain, which accepts the minimal set of
+        ICMPv6 messages that IPv6 needs: router and neighbor discovery, and
+        packet too big.  IPv6 host endpoint chains jump to it before any
+        policy so that enabling host protection doesn't break IPv6 on the
+        host.
+
+        Neighbor discovery messages are only valid with a hop limit of 255
+        (RFC 4861), which can't be spoofed from off-link, so we match on that
+        too.
+
+        :returns Tuple: list of rules, set of deps.
+        """
+        updates = [
+            "--append %s --protocol ipv6-icmp "
+            "--match icmp6 --icmpv6-type %s --jump ACCEPT" %
+            (CHAIN_ICMPV6_ND, ICMPV6_PACKET_TOO_BIG)
+        ]
+        for icmp_type in ICMPV6_ND_TYPES:
+            updates.append("--append %s --protocol ipv6-icmp "
+                           "--match icmp6 --icmpv6-type %s "
+                           "--match hl --hl-eq 255 --jump ACCEPT" %
+                           (CHAIN_ICMPV6_ND, icmp_type))
+        deps = set()
+        return updates, deps
+
     def profile_chain_names(self, profile_id):
         """
         Returns the set of chains belonging to a given profile.  This is used
@@ -692,7 +1011,10 @@ class FelixIptablesGenerator(FelixPlugin):
 
     def _build_to_or_from_chain(self, ip_version, endpoint_id, profile_ids,
                                 prof_ids_by_tier, chain_name, direction,
-                                expected_mac=None, with_failsafe=False):
+                                expected_mac=None, with_failsafe=False,
+                                max_connection_rate=None,
+                                detect_port_scans=False, verdict_mark=None,
+                                nflog_group=None, source_chain=None):
         """
         Generate the necessary set of iptables fragments for a to or from
         chain for a given endpoint.
@@ -706,6 +1028,23 @@ class FelixIptablesGenerator(FelixPlugin):
         :param expected_mac: The expected source MAC address.   If not None
         then the chain will explicitly drop any packets that do not have this
         expected source MAC address.
+        :param max_connection_rate: If set, the chain drops new connections
+        beyond this many per second, before applying policy, so that an
+        endpoint can't fill the host's conntrack table.
+        :param detect_port_scans: If set, the chain jumps to the Go side's
+        port scan detection chain before each of the rules that drop packets
+        that policy didn't allow, so that probes of closed ports count
+        towards the port scan limit.  The detection chain isn't a dep, since
+        it isn't ours; frules creates it.
+        :param verdict_mark: If set, the connmark bit that records that the
+        chain accepted the packet's flow.  Packets of flows that already have
+        it are accepted without checking policy.
+        :param nflog_group: If set, the NFLOG group that the chain sends the
+        first packet of each accepted flow, and each dropped packet, to, with
+        a prefix that identifies the policy or profile that decided.
+        :param source_chain: If set, the chain that drops packets with a
+        source address that the endpoint may not use, which the chain jumps
+        to straight after the MAC check.
 
         :returns Tuple: chain, deps.   Chain is a list of fragments that can
         be submitted to iptables to program the requested chain.  Deps is a
@@ -724,6 +1063,12 @@ class FelixIptablesGenerator(FelixPlugin):
                 }
             ]
             deps = {failsafe_chain}
+            if ip_version == 6:
+                # Then accept the ICMPv6 messages that IPv6 relies on, which
+                # policy would otherwise be likely to drop.
+                chain.append("--append %s --jump %s" %
+                             (chain_name, CHAIN_ICMPV6_ND))
+                deps.add(CHAIN_ICMPV6_ND)
         else:
             chain = []
             deps = set()
@@ -743,6 +1088,21 @@ class FelixIptablesGenerator(FelixPlugin):
                 chain_name,
                 "--match mac ! --mac-source %s" % expected_mac,
                 "Incorrect source MAC"))
+        if source_chain:
+            chain.append("--append %s --jump %s" % (chain_name, source_chain))
+            deps.add(source_chain)
+        if verdict_mark:
+            chain.append(
+                '--append %(chain)s --match connmark --mark %(mark)s/%(mark)s '
+                '--match comment --comment "Accept flows with a cached '
+                'verdict" --jump RETURN' % {
+                    'chain': chain_name,
+                    'mark': verdict_mark,
+                }
+            )
+        if max_connection_rate:
+            chain.extend(self._connection_rate_rules(ip_version, chain_name,
+                                                     max_connection_rate))
 
         # Tiered policies come first.
         # Each tier must either accept the packet outright or pass it to the
@@ -771,6 +1131,15 @@ class FelixIptablesGenerator(FelixPlugin):
                                  "mark": self.IPTABLES_MARK_NEXT_TIER,
                                  "pol_chain": policy_chain,
                              })
+                if isinstance(pol_id, TieredPolicyId):
+                    pol_name = pol_id.policy_id
+                else:
+                    pol_name = pol_id
+                chain.extend(self._accept_nflog_rules(
+                    chain_name, nflog_group,
+                    "policy/%s/%s" % (tier, pol_name)))
+                chain.extend(self._cache_verdict_rules(chain_name,
+                                                       verdict_mark))
                 # If the policy accepted the packet, it sets the Accept
                 # MARK==1. Immediately RETURN the packet to signal that it's
                 # been accepted.
@@ -784,6 +1153,18 @@ class FelixIptablesGenerator(FelixPlugin):
                                  "mark": self.IPTABLES_MARK_ACCEPT,
                              })
 
+            if detect_port_scans:
+                chain.append("--append %(chain)s "
+                             "--match mark --mark 0/%(mark)s "
+                             "--jump %(scan_chain)s" %
+                             {
+                                 "chain": chain_name,
+                                 "mark": self.IPTABLES_MARK_NEXT_TIER,
+                                 "scan_chain": CHAIN_PORT_SCAN,
+                             })
+            chain.extend(self._drop_nflog_rules(
+                chain_name, nflog_group, "tier/%s" % tier,
+                "--match mark --mark 0/%s" % self.IPTABLES_MARK_NEXT_TIER))
             chain.extend(self.drop_rules(
                 ip_version,
                 chain_name,
@@ -804,6 +1185,9 @@ class FelixIptablesGenerator(FelixPlugin):
             policy_chain = self._profile_to_chain_name(direction, profile_id)
             deps.add(policy_chain)
             chain.append("--append %s --jump %s" % (chain_name, policy_chain))
+            chain.extend(self._accept_nflog_rules(
+                chain_name, nflog_group, "profile/%s" % profile_id))
+            chain.extend(self._cache_verdict_rules(chain_name, verdict_mark))
             # If the profile accepted the packet, it sets Accept MARK==1.
             # Immediately RETURN the packet to signal that it's been accepted.
             chain.append(
@@ -816,6 +1200,11 @@ class FelixIptablesGenerator(FelixPlugin):
             )
 
         # Default drop rule.
+        if detect_port_scans:
+            chain.append("--append %s --jump %s" %
+                         (chain_name, CHAIN_PORT_SCAN))
+        chain.extend(self._drop_nflog_rules(chain_name, nflog_group,
+                                            "profiles"))
         chain.extend(
             self.drop_rules(
                 ip_version,
@@ -826,6 +1215,60 @@ class FelixIptablesGenerator(FelixPlugin):
         )
         return chain, deps
 
+    def _accept_nflog_rules(self, chain_name, nflog_group, rule_id):
+        """
+        Generates the rule that sends the first packet of each flow that
+        the given policy or profile accepted to NFLOG.  The rest of the flow
+        is accounted for by conntrack.
+
+        :returns list: iptables fragments; empty if nflog_group is None.
+        """
+        if nflog_group is None:
+            return []
+        return [
+            '--append %(chain)s --match mark --mark %(mark)s/%(mark)s '
+            '--match conntrack --ctstate NEW %(nflog)s' % {
+                'chain': chain_name,
+                'mark': self.IPTABLES_MARK_ACCEPT,
+                'nflog': _nflog_action(nflog_group, "A", rule_id),
+            }
+        ]
+
+    def _drop_nflog_rules(self, chain_name, nflog_group, rule_id,
+                          rule_spec=None):
+        """
+        Generates the rule that sends the packets that the following drop
+        rule is about to drop to NFLOG.
+
+        :returns list: iptables fragments; empty if nflog_group is None.
+        """
+        if nflog_group is None:
+            return []
+        return [
+            " ".join(p for p in [
+                "--append", chain_name, rule_spec,
+                _nflog_action(nflog_group, "D", rule_id)
+            ] if p is not None)
+        ]
+
+    def _cache_verdict_rules(self, chain_name, verdict_mark):
+        """
+        Generates the rule that records, in the packet's connmark, that a
+        policy or profile accepted its flow.
+
+        :returns list: iptables fragments; empty if verdict_mark is None.
+        """
+        if not verdict_mark:
+            return []
+        return [
+            '--append %(chain)s --match mark --mark %(mark)s/%(mark)s '
+            '--jump CONNMARK --set-mark %(verdict)s/%(verdict)s' % {
+                'chain': chain_name,
+                'mark': self.IPTABLES_MARK_ACCEPT,
+                'verdict': verdict_mark,
+            }
+        ]
+
     def _profile_to_chain_name(self, inbound_or_outbound, profile_id):
         """
         Returns the name of the chain to use for a given profile (and
@@ -1016,8 +1459,10 @@ class FelixIptablesGenerator(FelixPlugin):
                 ports = rule.get(ports_key)
                 if ports:  # Ignore empty list.
                     # Can only match if the (non-negated) is set to a supported
-                    # value.
-                    assert proto in ["tcp", "udp"], \
+                    # value.  The multiport match supports the same protocols
+                    # as validation allows: TCP, UDP, UDPLite, SCTP and DCCP,
+                    # by name or number, for both IPv4 and IPv6.
+                    assert proto in KERNEL_PORT_PROTOCOLS, \
                         "Protocol %s not supported with %s (%s)" % \
                         (proto, ports_key, rule)
                     if neg_pfx == '':
@@ -1071,6 +1516,22 @@ class FelixIptablesGenerator(FelixPlugin):
                     append("--match icmp6",
                            neg_pfx, "--icmpv6-type", icmp_filter)
 
+            # Link-layer packet type, which lets a rule match multicast or
+            # broadcast traffic as a whole; a rule for particular multicast
+            # groups uses a multicast dst_net as well.
+            pkt_type = rule.get(neg_pfx + "pkt_type")
+            if pkt_type is not None:
+                if pkt_type == "broadcast" and ip_version == 6:
+                    # IPv6 has no broadcasts.  Treat a positive match as
+                    # impossible, like a CIDR for the other IP version, and
+                    # a negative match as always true.
+                    if not neg_pfx:
+                        _log.debug("Rule matches broadcasts but rendering "
+                                   "for IPv6, skipping.")
+                        return []
+                else:
+                    append("--match pkttype", neg_pfx, "--pkt-type", pkt_type)
+
         action = rule.get("action", "allow")
         extra_rules = []
         if action in {"allow", "next-tier"}:
@@ -1146,3 +1607,15 @@ class FelixIptablesGenerator(FelixPlugin):
         assert (ports_str.count(",") + ports_str.count(":") + 1) <= 15, \
             "Too many ports (%s)" % ports_str
         return ports_str
+
+
+def _nflog_action(group, action, rule_id):
+    """
+    Returns the NFLOG target for the given verdict, with the prefix
+    "<action>|<rule ID>" that the Go side's flow log collector parses.
+    Long rule IDs are hashed to fit, in the same way as the Go side.
+    """
+    prefix = futils.length_limited_id(action + "|", rule_id,
+                                      MAX_NFLOG_PREFIX_LENGTH)
+    return '--jump NFLOG --nflog-group %s --nflog-prefix "%s"' % (group,
+                                                                  prefix)
@@ -0,0 +1,129 @@
+# -*- coding: utf-8 -*-
+# Copyright (c) 2014-2016 Tigera, Inc. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""
+felix.qos
+~~~~~~~~~
+
+Per-endpoint bandwidth limits, enforced with tc on workload interfaces.
+
+Felix sits on the host side of each workload interface, so the directions
+are reversed: traffic into the workload leaves the host through the
+interface's root qdisc, which we replace with a token bucket filter, and
+traffic out of the workload arrives on the interface's ingress hook, where
+we police it.  The ingress policer uses a clsact qdisc, which it shares with
+the BPF dataplane's programs; those use preference 1, we use preference 2.
+"""
+import logging
+
+from calico.felix import futils
+from calico.felix.futils import FailedSystemCall
+
+_log = logging.getLogger(__name__)
+
+# Preference of our policing filter on the clsact ingress hook.
+POLICE_FILTER_PREF = "2"
+
+# Smallest burst that we allow, in bytes.  tbf needs a burst of at least one
+# packet; we allow for a few more so that the limit is accurate.
+MIN_BURST_BYTES = 16 * 1024
+
+# The tbf queue is sized to hold this much traffic before dropping.
+TBF_LATENCY = "25ms"
+
+# tc errors that mean there was nothing to remove.
+_NOTHING_TO_REMOVE_ERRORS = ("No such file or directory",
+                             "Cannot find device",
+                             "Invalid handle")
+
+
+def burst_bytes(bps):
+    """
+    :param int bps: Rate in bits per second.
+    :returns int: The burst size to use for the rate: 10ms worth of
+        traffic, which covers the kernel's timer granularity.
+    """
+    return max(bps // 8 // 100, MIN_BURST_BYTES)
+
+
+def set_bandwidth_limits(interface, ingress_bps, egress_bps):
+    """
+    Sets, or removes, the bandwidth limits on a workload interface.
+    Idempotent, so it can be used to resync the limits.
+
+    :param str interface: Name of the workload interface.
+    :param int ingress_bps: Limit on traffic into the workload, in bits per
+        second, or None for no limit.
+    :param int egress_bps: Limit on traffic out of the workload, in bits per
+        second, or None for no limit.
+    :raises FailedSystemCall: if a tc command fails.
+    """
+    if ingress_bps:
+        _log.info("Limiting traffic to %s to %s bit/s", interface,
+                  ingress_bps)
+        futils.check_call(["tc", "qdisc", "replace", "dev", interface,
+                           "root", "tbf",
+                           "rate", "%dbit" % ingress_bps,
+                           "burst", "%db" % burst_bytes(ingress_bps),
+                           "latency", TBF_LATENCY])
+    else:
+        # Only remove a tbf, so that we don't delete a root qdisc that
+        # belongs to someone else.
+        qdiscs = futils.check_call(["tc", "qdisc", "show", "dev", interface,
+                                    "root"]).stdout
+        if "qdisc tbf" in qdiscs:
+            _log.info("Removing limit on traffic to %s", interface)
+            _tc_del(["qdisc", "del", "dev", interface, "root"])
+
+    if egress_bps:
+        _log.info("Limiting traffic from %s to %s bit/s", interface,
+                  egress_bps)
+        futils.check_call(["tc", "qdisc", "replace", "dev", interface,
+                           "clsact"])
+        futils.check_call(["tc", "filter", "replace", "dev", interface,
+                           "ingress", "pref", POLICE_FILTER_PREF,
+                           "handle", "1", "matchall",
+                           "action", "police",
+                           "rate", "%dbit" % egress_bps,
+                           "burst", "%db" % burst_bytes(egress_bps),
+                           "conform-exceed", "drop"])
+    else:
+        _log.debug("Removing any limit on traffic from %s", interface)
+        _tc_del(["filter", "del", "dev", interface, "ingress",
+                 "pref", POLICE_FILTER_PREF])
+
+
+def remove_bandwidth_limits(interface):
+    """
+    Removes any bandwidth limits from a workload interface.  It is not an
+    error if the interface no longer exists.
+
+    :param str interface: Name of the workload interface.
+    :raises FailedSystemCall: if a tc command fails for another reason.
+    """
+    try:
+        set_bandwidth_limits(interface, None, None)
+    except FailedSystemCall as e:
+        if "Cannot find device" not in e.stderr:
+            raise
+        _log.debug("Interface %s already gone", interface)
+
+
+def _tc_del(args):
+    try:
+        futils.check_call(["tc"] + args)
+    except FailedSystemCall as e:
+        if not any(err in e.stderr for err in _NOTHING_TO_REMOVE_ERRORS):
+            raise
+        _log.debug("Nothing to remove: %s", e.stderr)
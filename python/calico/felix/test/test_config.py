@@ -250,6 +250,15 @@ class TestConfig(unittest.TestCase):
         self.assertEqual(config.LOGFILE, None)
         self.assertEqual(config.DRIVERLOGFILE, None)
 
+    def test_requires_restart(self):
+        config = Config()
+        self.assertFalse(config.requires_restart([]))
+        self.assertFalse(config.requires_restart(["LogSeverityScreen",
+                                                  "IptablesRefreshInterval"]))
+        self.assertTrue(config.requires_restart(["LogSeverityScreen",
+                                                 "InterfacePrefix"]))
+        self.assertTrue(config.requires_restart(["UnknownParam"]))
+
     @skip("golang rewrite")
     def test_no_metadata(self):
         # Metadata can be excluded by explicitly saying "none"
@@ -511,6 +520,38 @@ class TestConfig(unittest.TestCase):
         self.assertEqual(config.IPTABLES_MARK_NEXT_TIER, "0x8")
         self.assertEqual(config.IPTABLES_MARK_ENDPOINTS, "0x10")
 
+    @skip("golang rewrite")
+    def test_ipvs_mark_bit(self):
+        """
+        Test that the IPVS mark uses the next bit of the mask, if there is
+        one.
+        """
+        cfg_dict = {"InterfacePrefix": "blah",
+                    "IptablesMarkMask": "60"}
+        config = load_config("felix_missing.cfg", host_dict=cfg_dict)
+
+        self.assertEqual(config.IPTABLES_MARK_MASK, 0x0000003c)
+        self.assertEqual(config.IPTABLES_MARK_IPVS, "0x20")
+
+        cfg_dict["IptablesMarkMask"] = "28"
+        config = load_config("felix_missing.cfg", host_dict=cfg_dict)
+
+        self.assertEqual(config.IPTABLES_MARK_IPVS, None)
+
+    @skip("golang rewrite")
+    def test_too_few_mark_bits_ipvs(self):
+        """
+        Test that the mark masks are defaulted when KubeIPVSSupport is
+        enabled and the mask has fewer bits than it needs.
+        """
+        cfg_dict = { "InterfacePrefix": "blah",
+                     "IptablesMarkMask": "28",
+                     "KubeIPVSSupport": "true" }
+        config = load_config("felix_missing.cfg", host_dict=cfg_dict)
+
+        self.assertEqual(config.IPTABLES_MARK_MASK, 0xff000000)
+        self.assertEqual(config.IPTABLES_MARK_IPVS, "0x8000000")
+
     @skip("golang rewrite")
     def test_too_many_mark_bits(self):
         """
@@ -733,3 +774,103 @@ class TestConfig(unittest.TestCase):
         config = load_config("felix_interface_prefix.cfg",
                              host_dict=cfg_dict)
         self.assertEqual(config.IFACE_PREFIX, ['foo', 'bar'])
+
+    def test_interface_exclude(self):
+        config = load_config("felix_missing.cfg")
+        self.assertEqual(config.IFACE_EXCLUDE, [])
+
+        cfg_dict = {"InterfaceExclude": "docker+, veth1234"}
+        config = load_config("felix_missing.cfg", host_dict=cfg_dict)
+        self.assertEqual(config.IFACE_EXCLUDE, ['docker+', 'veth1234'])
+
+        cfg_dict = {"InterfaceExclude": "docker+,bad/name"}
+        self.assertRaises(ConfigException, load_config,
+                          "felix_missing.cfg", host_dict=cfg_dict)
+
+    def test_drop_workload_rogue_servers(self):
+        config = load_config("felix_missing.cfg")
+        self.assertFalse(config.DROP_WORKLOAD_ROUTER_ADVERTS)
+        self.assertFalse(config.DROP_WORKLOAD_DHCP_SERVERS)
+
+        cfg_dict = {"DropWorkloadRouterAdvertisements": "true",
+                    "DropWorkloadDHCPServers": "true"}
+        config = load_config("felix_missing.cfg", host_dict=cfg_dict)
+        self.assertTrue(config.DROP_WORKLOAD_ROUTER_ADVERTS)
+        self.assertTrue(config.DROP_WORKLOAD_DHCP_SERVERS)
+
+    def test_user_chain_hooks(self):
+        config = load_config("felix_missing.cfg")
+        self.assertEqual(config.USER_CHAIN_HOOKS, [])
+
+        cfg_dict = {"UserChainHooks":
+                    "input:after:admin-in, forward:before:admin-fwd"}
+        config = load_config("felix_missing.cfg", host_dict=cfg_dict)
+        self.assertEqual(config.USER_CHAIN_HOOKS,
+                         [("input", "after", "admin-in"),
+                          ("forward", "before", "admin-fwd")])
+
+        for hooks in ["input:admin-in",
+                      "prerouting:after:admin-in",
+                      "input:during:admin-in",
+                      "input:after:felix-INPUT",
+                      "input:after:ACCEPT",
+                      "input:after:a-very-long-chain-name-for-iptables"]:
+            cfg_dict = {"UserChainHooks": hooks}
+            self.assertRaises(ConfigException, load_config,
+                              "felix_missing.cfg", host_dict=cfg_dict)
+
+    def test_chain_accept_action(self):
+        config = load_config("felix_missing.cfg")
+        self.assertEqual(config.CHAIN_ACCEPT_ACTION, "ACCEPT")
+
+        cfg_dict = {"ChainAcceptAction": "return"}
+        config = load_config("felix_missing.cfg", host_dict=cfg_dict)
+        self.assertEqual(config.CHAIN_ACCEPT_ACTION, "RETURN")
+
+        cfg_dict = {"ChainAcceptAction": "DROP"}
+        self.assertRaises(ConfigException, load_config,
+                          "felix_missing.cfg", host_dict=cfg_dict)
+
+    def test_conntrack_bypass(self):
+        config = load_config("felix_missing.cfg")
+        self.assertTrue(config.CONNTRACK_BYPASS_ENABLED)
+
+        cfg_dict = {"ConntrackBypassEnabled": "false"}
+        config = load_config("felix_missing.cfg", host_dict=cfg_dict)
+        self.assertFalse(config.CONNTRACK_BYPASS_ENABLED)
+
+    def test_verdict_cache_marks(self):
+        config = load_config("felix_missing.cfg")
+        self.assertFalse(config.VERDICT_CACHE_ENABLED)
+        self.assertEqual(config.IPTABLES_MARK_VERDICT_CACHE_IN, None)
+        self.assertEqual(config.IPTABLES_MARK_VERDICT_CACHE_OUT, None)
+
+        cfg_dict = {"VerdictCacheEnabled": "true"}
+        config = load_config("felix_missing.cfg", host_dict=cfg_dict)
+        self.assertEqual(config.IPTABLES_MARK_VERDICT_CACHE_IN, "0x10000000")
+        self.assertEqual(config.IPTABLES_MARK_VERDICT_CACHE_OUT, "0x20000000")
+
+        # With no bits to spare, verdicts aren't cached.
+        cfg_dict = {"VerdictCacheEnabled": "true",
+                    "IptablesMarkMask": "0x1f000000"}
+        config = load_config("felix_missing.cfg", host_dict=cfg_dict)
+        self.assertEqual(config.IPTABLES_MARK_VERDICT_CACHE_IN, None)
+        self.assertEqual(config.IPTABLES_MARK_VERDICT_CACHE_OUT, None)
+
+    def test_drop_invalid_conntrack(self):
+        config = load_config("felix_missing.cfg")
+        self.assertEqual(config.DROP_INVALID_CONNTRACK,
+                         set(["input", "output", "forward"]))
+
+        cfg_dict = {"DropInvalidConntrack": "Input, forward"}
+        config = load_config("felix_missing.cfg", host_dict=cfg_dict)
+        self.assertEqual(config.DROP_INVALID_CONNTRACK,
+                         set(["input", "forward"]))
+
+        cfg_dict = {"DropInvalidConntrack": "none"}
+        config = load_config("felix_missing.cfg", host_dict=cfg_dict)
+        self.assertEqual(config.DROP_INVALID_CONNTRACK, set())
+
+        cfg_dict = {"DropInvalidConntrack": "input,prerouting"}
+        self.assertRaises(ConfigException, load_config,
+                          "felix_missing.cfg", host_dict=cfg_dict)
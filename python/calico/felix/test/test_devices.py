@@ -344,6 +344,9 @@ class TestDevices(unittest.TestCase):
             "    inet 10.0.3.1/24 brd 10.0.3.255 scope global lxcbr0\n"
             "       valid_lft forever preferred_lft forever\n"
             "    inet 10.0.3.2/24 brd 10.0.3.255 scope global lxcbr0\n"
+            "       valid_lft forever preferred_lft forever\n"
+            "7: eth1.100@eth1: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP group default qlen 1000\n"
+            "    inet 10.100.0.5/24 brd 10.100.0.255 scope global eth1.100\n"
             "       valid_lft forever preferred_lft forever\n",
             ""
         )
@@ -359,6 +362,7 @@ class TestDevices(unittest.TestCase):
                 "eth1": {IPAddress("172.16.171.5")},
                 "docker0": {IPAddress("172.17.0.1")},
                 "lxcbr0": {IPAddress("10.0.3.1"), IPAddress("10.0.3.2")},
+                "eth1.100": {IPAddress("10.100.0.5")},
             }
         )
         
@@ -391,6 +395,25 @@ class TestDevices(unittest.TestCase):
             }
         )
 
+    def test_list_permanent_neighbors(self):
+        retval = futils.CommandOutput(
+            "10.65.0.2 dev cali1234 lladdr aa:bb:cc:dd:ee:ff PERMANENT\n"
+            "10.65.0.3 dev cali5678 lladdr 11:22:33:44:55:66 PERMANENT\n",
+            ""
+        )
+        with mock.patch('calico.felix.futils.check_call',
+                        return_value=retval) as m_check_call:
+            neighbors = devices.list_permanent_neighbors(futils.IPV4)
+        m_check_call.assert_called_once_with(
+            ["ip", "-4", "neigh", "show", "nud", "permanent"])
+        self.assertEqual(
+            neighbors,
+            {
+                ("10.65.0.2", "cali1234"): "aa:bb:cc:dd:ee:ff",
+                ("10.65.0.3", "cali5678"): "11:22:33:44:55:66",
+            }
+        )
+
     def test_set_interface_ips(self):
         with mock.patch('calico.felix.futils.check_call',
                         autospec=True) as m_check_call:
@@ -206,6 +206,36 @@ class TestWorkloadDispatchChains(BaseTestCase):
             from_chain_names
         )
 
+    def test_excluded_ifaces(self):
+        """
+        Tests that excluded interfaces get no dispatch rules.
+        """
+        self.config = load_config("felix_default.cfg", global_dict={
+            "MetadataPort": "8775",
+            "InterfaceExclude": "tapexcl+"})
+        d = self.dispatch_chain()
+
+        ifaces = {'tapabcdef', 'tapexcl1'}
+        d.apply_snapshot(ifaces, async=True)
+        self.step_actor(d)
+
+        from_updates = [
+            '--append felix-FROM-ENDPOINT --in-interface tapabcdef --goto felix-from-abcdef',
+            '--append felix-FROM-ENDPOINT --jump DROP -m comment --comment "From unknown endpoint"',
+        ]
+        to_updates = [
+            '--append felix-TO-ENDPOINT --out-interface tapabcdef --goto felix-to-abcdef',
+            '--append felix-TO-ENDPOINT --jump DROP -m comment --comment "To unknown endpoint"',
+        ]
+        args = self.iptables_updater.rewrite_chains.call_args
+        self.assert_iptables_update(
+            args,
+            to_updates,
+            from_updates,
+            set(['felix-to-abcdef']),
+            set(['felix-from-abcdef'])
+        )
+
     def test_applying_snapshot_dirty(self):
         """
         Tests that a snapshot can be applied to an actor that used to have
@@ -504,6 +534,27 @@ class TestHostDispatchChains(BaseTestCase):
                 '--append felix-TO-IF-PFX-b --jump RETURN --match comment --comment "Unknown interface, return"']
         })
 
+    def test_vlan_subinterfaces(self):
+        """
+        VLAN subinterfaces of a trunked NIC get their own dispatch rules,
+        separate from the parent's, so policy can differ per VLAN.
+        """
+        d = self.dispatch_chain()
+        ifaces = {'eth0', 'eth0.100', 'eth0.200'}
+        _, _, updates, new_leaf_chains = d._calculate_update(ifaces)
+        for chain_name, chain_updates in updates.items():
+            chain_updates[:] = sorted(chain_updates[:-1]) + chain_updates[-1:]
+        self.assertEqual(new_leaf_chains, set(['felix-FROM-IF-PFX-.',
+                                               'felix-TO-IF-PFX-.']))
+        self.assertEqual(updates['felix-FROM-HOST-IF'], [
+            '--append felix-FROM-HOST-IF --in-interface eth0 --goto felix-from-eth0',
+            '--append felix-FROM-HOST-IF --in-interface eth0.+ --goto felix-FROM-IF-PFX-.',
+            '--append felix-FROM-HOST-IF --jump RETURN --match comment --comment "Unknown interface, return"'])
+        self.assertEqual(updates['felix-FROM-IF-PFX-.'], [
+            '--append felix-FROM-IF-PFX-. --in-interface eth0.100 --goto felix-from-eth0.100',
+            '--append felix-FROM-IF-PFX-. --in-interface eth0.200 --goto felix-from-eth0.200',
+            '--append felix-FROM-IF-PFX-. --jump RETURN --match comment --comment "Unknown interface, return"'])
+
     def test_applying_empty_snapshot(self):
         """
         Tests that an empty snapshot can be applied to an actor that used to
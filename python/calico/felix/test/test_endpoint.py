@@ -88,9 +88,61 @@ class TestEndpointManager(BaseTestCase):
         self.assertRaises(RuntimeError, self.mgr._create, HOST_ENDPOINT_ID)
 
     def test_on_actor_started(self):
-        with mock.patch.object(self.mgr, "_iface_poll_greenlet") as m_glet:
+        with mock.patch.object(self.mgr, "_iface_poll_greenlet") as m_glet,\
+                mock.patch.object(self.mgr,
+                                  "_neighbor_gc_greenlet") as m_gc_glet:
             self.mgr._on_actor_started()
             m_glet.start.assert_called_once_with()
+            m_gc_glet.start.assert_called_once_with()
+
+    def test_gc_neighbors(self):
+        self.mgr._data_model_in_sync = True
+        self.mgr.config.IFACE_PREFIX = ["tap"]
+        self.mgr.local_endpoint_ids.add(ENDPOINT_ID)
+        self.mgr.endpoints_by_id[ENDPOINT_ID] = {
+            "name": "tap1234",
+            "mac": "aa:bb:cc:dd:ee:ff",
+            "ipv4_nets": ["10.0.0.1/32", "10.0.0.2/32"],
+        }
+        actual = {
+            ("10.0.0.1", "tap1234"): "aa:bb:cc:dd:ee:ff",
+            ("10.0.0.9", "tap1234"): "aa:bb:cc:dd:ee:ff",
+            ("10.0.0.9", "tapdead"): "11:22:33:44:55:66",
+            ("192.168.0.1", "eth0"): "11:22:33:44:55:66",
+        }
+        with mock.patch("calico.felix.devices.list_permanent_neighbors",
+                        autospec=True, return_value=actual),\
+                mock.patch("calico.felix.devices.interface_exists",
+                           autospec=True, return_value=True),\
+                mock.patch("calico.felix.devices.add_neighbor",
+                           autospec=True) as m_add,\
+                mock.patch("calico.felix.devices.del_neighbor",
+                           autospec=True) as m_del:
+            # The first pass only notes what looks wrong, since the
+            # endpoints may be part-way through programming it.
+            self.mgr._gc_neighbors(async=True)
+            self.step_actor(self.mgr)
+            self.assertFalse(m_add.called)
+            self.assertFalse(m_del.called)
+
+            # The second pass fixes the entries that are still wrong, and
+            # leaves the non-workload interface alone.
+            self.mgr._gc_neighbors(async=True)
+            self.step_actor(self.mgr)
+            m_add.assert_called_once_with("10.0.0.2", "aa:bb:cc:dd:ee:ff",
+                                          "tap1234")
+            self.assertEqual(
+                sorted(m_del.mock_calls),
+                [mock.call("10.0.0.9", "tap1234"),
+                 mock.call("10.0.0.9", "tapdead")]
+            )
+
+    def test_gc_neighbors_not_in_sync(self):
+        with mock.patch("calico.felix.devices.list_permanent_neighbors",
+                        autospec=True) as m_list:
+            self.mgr._gc_neighbors(async=True)
+            self.step_actor(self.mgr)
+        self.assertFalse(m_list.called)
 
     @skip("golang rewrite")
     def test_on_started(self):
@@ -411,6 +463,58 @@ class TestEndpointManager(BaseTestCase):
             {"expected_ipv4_addrs": ["10.0.0.1", "10.0.0.2"], "name": "eth1"}
         )
 
+    def test_resolve_host_eps_interface_names(self):
+        ep1 = {"name": "bond0", "interface_names": ["eth0", "eth1"]}
+        self.mgr.host_eps_by_id[HostEndpointId("hostname", "ep1")] = ep1
+        with mock.patch.object(self.mgr, "on_endpoint_update") as m_on_ep_upd:
+            self.mgr._resolve_host_eps()
+        # Each interface resolves separately, so it gets its own chains.
+        self.assertEqual(
+            sorted(m_on_ep_upd.mock_calls),
+            sorted([
+                mock.call(ResolvedHostEndpointId("hostname", "ep1", iface),
+                          {"name": iface})
+                for iface in ["bond0", "eth0", "eth1"]
+            ])
+        )
+
+    def test_resolve_host_eps_wildcard(self):
+        self.mgr.host_ep_ips_by_iface = {
+            "eth0": set(["10.0.0.1"]),
+            "eth1": set(["10.0.0.2"]),
+            "eth2": set(["10.0.0.3"]),
+        }
+        self.mgr.host_eps_by_id = {
+            HostEndpointId("hostname", "all"): {"name": "*"},
+            HostEndpointId("hostname", "named"): {"name": "eth0"},
+            HostEndpointId("hostname", "by-ip"): {
+                "name": None,
+                "expected_ipv4_addrs": ["10.0.0.2"],
+            },
+        }
+        with mock.patch.object(self.mgr, "on_endpoint_update") as m_on_ep_upd:
+            self.mgr._resolve_host_eps()
+        # The wildcard only picks up the interface that nothing else claims.
+        self.assertEqual(
+            sorted(m_on_ep_upd.mock_calls),
+            sorted([
+                mock.call(ResolvedHostEndpointId("hostname", "named", "eth0"),
+                          {"name": "eth0"}),
+                mock.call(ResolvedHostEndpointId("hostname", "by-ip", "eth1"),
+                          {"name": "eth1",
+                           "expected_ipv4_addrs": ["10.0.0.2"]}),
+                mock.call(ResolvedHostEndpointId("hostname", "all", "eth2"),
+                          {"name": "eth2"}),
+            ])
+        )
+
+        # When the interface goes away, so does the wildcard's endpoint.
+        del self.mgr.host_ep_ips_by_iface["eth2"]
+        with mock.patch.object(self.mgr, "on_endpoint_update") as m_on_ep_upd:
+            self.mgr._resolve_host_eps()
+        m_on_ep_upd.assert_called_once_with(
+            ResolvedHostEndpointId("hostname", "all", "eth2"), None)
+
     def test_other_host_ep_ignored(self):
         ep1 = {"expected_ipv4_addrs": ["10.0.0.1"]}
         self.mgr.on_host_ep_update(HostEndpointId("otherhost", "ep1"),
@@ -502,6 +606,16 @@ class TestEndpointManager(BaseTestCase):
             m_on_ip_upd.assert_called_once_with("eth0",
                                                 None,
                                                 async=True)
+            m_on_ip_upd.reset_mock()
+
+            # Excluded interfaces are skipped too.
+            self.mgr.config.IFACE_EXCLUDE = ["docker+"]
+            m_list_ips.return_value = {
+                "docker0": [IPAddress("172.17.0.1")],
+            }
+            known_interfaces = self.mgr._poll_interfaces(known_interfaces)
+            self.assertEqual(known_interfaces, {})
+            self.assertFalse(m_on_ip_upd.called)
 
     @mock.patch("gevent.sleep", autospec=True)
     def test_interface_poll_loop(self, m_sleep):
@@ -697,6 +811,66 @@ class TestWorkloadEndpoint(BaseTestCase):
                 set(['1.2.3.5', '5.6.7.8']), 4
             )
 
+    def test_on_endpoint_update_allowed_source_prefixes(self):
+        """Test single-address allowed source prefixes are routed."""
+        combined_id = WloadEndpointId("host_id", "orchestrator_id",
+                                      "workload_id", "endpoint_id")
+        ip_type = futils.IPV4
+        local_ep = self.create_endpoint(combined_id, ip_type)
+
+        iface = "tapabcdef"
+        data = {
+            'state': "active",
+            'endpoint': "endpoint_id",
+            'mac': stub_utils.get_mac(),
+            'name': iface,
+            'ipv4_nets': ["1.2.3.4/32"],
+            'profile_ids': ["prof1"],
+            'allowed_source_prefixes': ["10.0.0.100/32", "10.1.0.0/16",
+                                        "fd00::100/128", "bad"],
+        }
+        with mock.patch('calico.felix.devices.set_routes') as m_set_routes,\
+                mock.patch('calico.felix.devices.configure_interface_ipv4'),\
+                mock.patch('calico.felix.devices.interface_exists') as m_iface_exists,\
+                mock.patch('calico.felix.devices.interface_up') as m_iface_up:
+            m_iface_exists.return_value = True
+            m_iface_up.return_value = True
+            local_ep.on_endpoint_update(data, async=True)
+            self.step_actor(local_ep)
+            m_set_routes.assert_called_once_with(ip_type,
+                                                 set(["1.2.3.4",
+                                                      "10.0.0.100"]),
+                                                 iface,
+                                                 data['mac'],
+                                                 reset_arp=True)
+
+        # Removing the prefixes should remove their routes.
+        data = data.copy()
+        data['allowed_source_prefixes'] = []
+        with mock.patch('calico.felix.devices.set_routes') as m_set_routes,\
+                mock.patch('calico.felix.devices.configure_interface_ipv4'),\
+                mock.patch('calico.felix.devices.remove_conntrack_flows'):
+            local_ep.on_endpoint_update(data, async=True)
+            self.step_actor(local_ep)
+            m_set_routes.assert_called_once_with(ip_type,
+                                                 set(["1.2.3.4"]),
+                                                 iface,
+                                                 data['mac'],
+                                                 reset_arp=True)
+
+    def test_workload_source_nets(self):
+        data = {
+            'ipv4_nets': ["1.2.3.4/32"],
+            'ipv6_nets': ["fd00::4/128"],
+            'allowed_source_prefixes': ["10.0.0.100/32", "10.1.0.0/16",
+                                        "fd00::100/128", "bad"],
+        }
+        # Unlike the routes, the source check allows whole CIDRs.
+        self.assertEqual(endpoint.workload_source_nets(data, futils.IPV4),
+                         ["1.2.3.4/32", "10.0.0.100/32", "10.1.0.0/16"])
+        self.assertEqual(endpoint.workload_source_nets(data, futils.IPV6),
+                         ["fd00::4/128", "fd00::100/128"])
+
     def test_on_endpoint_update_v4_no_mac(self):
         """Test endpoint without MAC makes the right calls to set_routes"""
         combined_id = WloadEndpointId("host_id", "orchestrator_id",
@@ -751,6 +925,150 @@ class TestWorkloadEndpoint(BaseTestCase):
                                                      data['mac'],
                                                      reset_arp=True)
 
+    def test_on_endpoint_update_excluded_iface(self):
+        """Test endpoint on an excluded interface doesn't get routes"""
+        self.config.IFACE_EXCLUDE = ["tapexcl+"]
+        combined_id = WloadEndpointId("host_id", "orchestrator_id",
+                                      "workload_id", "endpoint_id")
+        ip_type = futils.IPV4
+        local_ep = self.create_endpoint(combined_id, ip_type)
+
+        data = {
+            'state': "active",
+            'endpoint': "endpoint_id",
+            'mac': stub_utils.get_mac(),
+            'name': "tapexcl1",
+            'ipv4_nets': ["1.2.3.4/32"],
+            'profile_ids': ["prof1"]
+        }
+        with mock.patch('calico.felix.devices.set_routes') as m_set_routes,\
+                mock.patch('calico.felix.devices.configure_interface_ipv4') as m_conf,\
+                mock.patch('calico.felix.devices.interface_exists') as m_iface_exists,\
+                mock.patch('calico.felix.devices.interface_up') as m_iface_up:
+            m_iface_exists.return_value = True
+            m_iface_up.return_value = True
+
+            local_ep.on_endpoint_update(data, async=True)
+            self.step_actor(local_ep)
+
+            self.assertFalse(m_conf.called)
+            self.assertFalse(m_set_routes.called)
+            self.assertTrue(local_ep._device_in_sync)
+
+    def test_on_endpoint_update_foreign_iface(self):
+        """Test endpoint on a non-workload interface doesn't get routes"""
+        combined_id = WloadEndpointId("host_id", "orchestrator_id",
+                                      "workload_id", "endpoint_id")
+        ip_type = futils.IPV4
+        local_ep = self.create_endpoint(combined_id, ip_type)
+
+        data = {
+            'state': "active",
+            'endpoint': "endpoint_id",
+            'mac': stub_utils.get_mac(),
+            'name': "eth1",
+            'ipv4_nets': ["1.2.3.4/32"],
+            'profile_ids': ["prof1"]
+        }
+        with mock.patch('calico.felix.devices.set_routes') as m_set_routes,\
+                mock.patch('calico.felix.devices.configure_interface_ipv4') as m_conf,\
+                mock.patch('calico.felix.devices.interface_exists') as m_iface_exists,\
+                mock.patch('calico.felix.devices.interface_up') as m_iface_up:
+            m_iface_exists.return_value = True
+            m_iface_up.return_value = True
+
+            local_ep.on_endpoint_update(data, async=True)
+            self.step_actor(local_ep)
+            self.assertFalse(m_conf.called)
+            self.assertFalse(m_set_routes.called)
+            self.assertTrue(local_ep._device_in_sync)
+
+            # Deleting the endpoint must leave the interface's routes alone
+            # too.
+            local_ep.on_endpoint_update(None, async=True)
+            self.step_actor(local_ep)
+            self.assertFalse(m_set_routes.called)
+
+    def test_on_endpoint_update_bandwidth_limits(self):
+        """Test bandwidth limits are set, resynced and removed"""
+        combined_id = WloadEndpointId("host_id", "orchestrator_id",
+                                      "workload_id", "endpoint_id")
+        local_ep = self.create_endpoint(combined_id, futils.IPV4)
+
+        data = {
+            'state': "active",
+            'endpoint': "endpoint_id",
+            'mac': stub_utils.get_mac(),
+            'name': "tapabcdef",
+            'ipv4_nets': ["1.2.3.4/32"],
+            'profile_ids': ["prof1"],
+            'ingress_bandwidth': 10000000,
+        }
+        with mock.patch('calico.felix.devices.set_routes'),\
+                mock.patch('calico.felix.devices.configure_interface_ipv4'),\
+                mock.patch('calico.felix.devices.remove_conntrack_flows'),\
+                mock.patch('calico.felix.devices.interface_exists') as m_iface_exists,\
+                mock.patch('calico.felix.devices.interface_up') as m_iface_up,\
+                mock.patch('calico.felix.qos.set_bandwidth_limits') as m_set_bw,\
+                mock.patch('calico.felix.qos.remove_bandwidth_limits') as m_rem_bw:
+            m_iface_exists.return_value = True
+            m_iface_up.return_value = True
+
+            local_ep.on_endpoint_update(data, async=True)
+            self.step_actor(local_ep)
+            m_set_bw.assert_called_once_with("tapabcdef", 10000000, None)
+            self.assertTrue(local_ep._device_in_sync)
+
+            # Removing the limit from the endpoint removes it from the
+            # interface.
+            m_set_bw.reset_mock()
+            data = data.copy()
+            del data['ingress_bandwidth']
+            local_ep.on_endpoint_update(data, async=True)
+            self.step_actor(local_ep)
+            m_set_bw.assert_called_once_with("tapabcdef", None, None)
+
+            # With no limits, there's nothing to do.
+            m_set_bw.reset_mock()
+            local_ep._configure_bandwidth_limits()
+            self.assertFalse(m_set_bw.called)
+
+            # Deleting a limited endpoint removes the limits.
+            data['egress_bandwidth'] = 1000000
+            local_ep.on_endpoint_update(data, async=True)
+            self.step_actor(local_ep)
+            m_set_bw.assert_called_once_with("tapabcdef", None, 1000000)
+            local_ep.on_endpoint_update(None, async=True)
+            self.step_actor(local_ep)
+            m_rem_bw.assert_called_once_with("tapabcdef")
+
+    def test_on_endpoint_update_bandwidth_limits_v6(self):
+        """Test only the IPv4 endpoint programs bandwidth limits"""
+        combined_id = WloadEndpointId("host_id", "orchestrator_id",
+                                      "workload_id", "endpoint_id")
+        local_ep = self.create_endpoint(combined_id, futils.IPV6)
+
+        data = {
+            'state': "active",
+            'endpoint': "endpoint_id",
+            'mac': stub_utils.get_mac(),
+            'name': "tapabcdef",
+            'ipv6_nets': ["2001::abcd/128"],
+            'profile_ids': ["prof1"],
+            'ingress_bandwidth': 10000000,
+        }
+        with mock.patch('calico.felix.devices.set_routes'),\
+                mock.patch('calico.felix.devices.configure_interface_ipv6'),\
+                mock.patch('calico.felix.devices.interface_exists') as m_iface_exists,\
+                mock.patch('calico.felix.devices.interface_up') as m_iface_up,\
+                mock.patch('calico.felix.qos.set_bandwidth_limits') as m_set_bw:
+            m_iface_exists.return_value = True
+            m_iface_up.return_value = True
+
+            local_ep.on_endpoint_update(data, async=True)
+            self.step_actor(local_ep)
+            self.assertFalse(m_set_bw.called)
+
     def test_on_endpoint_update_v4_no_ips(self):
         """Test that lack of IPs results in correct defaulting"""
         combined_id = WloadEndpointId("host_id", "orchestrator_id",
@@ -1179,7 +1497,9 @@ class TestWorkloadEndpoint(BaseTestCase):
         self.assertEqual(
             self.m_ipt_gen.endpoint_updates.mock_calls,
             [
-                mock.call(4, 'd', '1234', mac, ['prof1'], {}),
+                mock.call(4, 'd', '1234', mac, ['prof1'], {},
+                          max_connection_rate=None,
+                          source_nets=["10.0.0.1"]),
             ]
         )
         self.m_ipt_gen.endpoint_updates.reset_mock()
@@ -1199,7 +1519,9 @@ class TestWorkloadEndpoint(BaseTestCase):
                 mock.call(4, 'd', '1234', mac, ['prof1'],
                           OrderedDict([('t1', [TieredPolicyId('t1','t1_1'),
                                                TieredPolicyId('t1','t1_2')]),
-                                       ('t2', [TieredPolicyId('t2','t2_1')])]))
+                                       ('t2', [TieredPolicyId('t2','t2_1')])]),
+                          max_connection_rate=None,
+                          source_nets=["10.0.0.1"])
             ])
 
     def test_on_interface_update_v6(self):
@@ -1459,6 +1781,7 @@ class TestHostEndpoint(BaseTestCase):
         super(TestHostEndpoint, self).setUp()
         self.config = mock.Mock()
         self.config.IFACE_PREFIX = ["tap"]
+        self.config.IFACE_EXCLUDE = []
         self.m_ipt_gen = Mock(spec=FelixIptablesGenerator)
         self.config.plugins = {"iptables_generator": self.m_ipt_gen}
         self.updates = ({"chain": ["rule"]}, {"chain": set(["deps"])})
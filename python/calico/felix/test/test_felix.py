@@ -176,7 +176,8 @@ class TestBasic(BaseTestCase):
         m_load.assert_called_once_with(async=False)
         m_configure_global_kernel_config.assert_called_once_with(config)
         m_install_globals.assert_called_once_with(mock.ANY, mock.ANY, mock.ANY,
-                                                  ip_version=4)
+                                                  ip_version=4,
+                                                  ipvs_enabled=False)
         m_conntrack.assert_called_once_with()
 
         # Cover the diags dump function.
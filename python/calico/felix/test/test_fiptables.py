@@ -407,6 +407,24 @@ class TestIptablesUpdater(BaseTestCase):
             self.assertTrue(fragment in self.ipt._inserted_rule_fragments)
             self.assertTrue(fragment not in self.ipt._removed_rule_fragments)
 
+    def test_ensure_chain_exists(self):
+        with patch("calico.felix.futils.check_call",
+                   autospec=True) as m_check_call:
+            m_check_call.side_effect = iter([
+                None,
+                FailedSystemCall("Message", [], 1, "",
+                                 "Chain already exists."),
+            ])
+            for _ in range(2):
+                self.ipt.ensure_chain_exists("cali-INPUT", async=True)
+                self.step_actor(self.ipt)
+            self.assertEqual(
+                m_check_call.mock_calls,
+                [call(["iptables", "--table", "filter",
+                       "--new-chain", "cali-INPUT"])] * 2
+            )
+        self.assertEqual(self.ipt._unmanaged_chains, set(["cali-INPUT"]))
+
     def test_ensure_rule_removed(self):
         fragment = "FOO --jump DROP"
         with patch.object(self.ipt, "_execute_iptables") as m_exec:
@@ -464,6 +482,29 @@ class TestIptablesUpdater(BaseTestCase):
             ], fail_log_level=logging.DEBUG)
             self.assertEqual(m_exec.mock_calls, [exp_call])
 
+    def test_refresh_iptables_keeps_insert_order(self):
+        with patch("calico.felix.futils.check_call", autospec=True):
+            self.ipt.ensure_chain_exists("cali-INPUT", async=True)
+            self.step_actor(self.ipt)
+        for fragment in ["INPUT -j cali-INPUT", "INPUT -j felix-INPUT",
+                         "OUTPUT -j felix-OUTPUT", "INPUT -j cali-INPUT"]:
+            self.ipt.ensure_rule_inserted(fragment, async=True)
+        self.step_actor(self.ipt)
+
+        self.ipt.refresh_iptables(async=True)
+        with patch.object(self.ipt, "_insert_rule") as m_insert_rule:
+            with patch.object(self.ipt, "_create_chain") as m_create_chain:
+                self.step_actor(self.ipt)
+        m_create_chain.assert_called_once_with("cali-INPUT",
+                                               log_level=logging.DEBUG)
+        self.assertEqual(
+            m_insert_rule.mock_calls,
+            [call(fragment, log_level=logging.DEBUG)
+             for fragment in ["INPUT -j felix-INPUT",
+                              "OUTPUT -j felix-OUTPUT",
+                              "INPUT -j cali-INPUT"]]
+        )
+
     def test_refresh_iptables(self):
         self.ipt.ensure_rule_inserted("INPUT -j ACCEPT", async=True)
         self.ipt.ensure_rule_inserted("INPUT -j DROP", async=True)
@@ -26,6 +26,7 @@ from pprint import pformat
 from mock import Mock
 
 from calico.datamodel_v1 import TieredPolicyId
+from calico.felix import futils
 from calico.felix.fiptables import IptablesUpdater
 from calico.felix.profilerules import UnsupportedICMPType
 from calico.felix.test.base import BaseTestCase, load_config
@@ -72,7 +73,41 @@ INPUT_CHAINS = {
         '--append felix-INPUT --protocol udp --sport 546 --dport 547 --jump ACCEPT',
         '--append felix-INPUT --protocol udp --dport 53 --jump ACCEPT',
         '--append felix-INPUT --jump felix-FROM-ENDPOINT',
-    ]
+    ],
+    "IPVS": [
+        '--append felix-INPUT --match conntrack --ctstate INVALID --jump DROP',
+        '--append felix-INPUT --match conntrack --ctstate RELATED,ESTABLISHED --jump ACCEPT',
+        '--append felix-INPUT --jump MARK --set-mark 0/0x4000000',
+        '--append felix-INPUT --jump MARK --set-mark 0/0x8000000',
+        '--append felix-INPUT --match set --match-set felix-ipvs-services-4 dst --jump MARK --set-mark 0x8000000/0x8000000',
+        '--append felix-INPUT --in-interface tap+ --jump MARK --set-mark 0x4000000/0x4000000',
+        '--append felix-INPUT --goto felix-FROM-HOST-IF --match mark --mark 0/0x4000000',
+        '--append felix-INPUT --match mark --mark 0x8000000/0x8000000 --jump felix-FROM-ENDPOINT',
+        '--append felix-INPUT --match mark --mark 0x8000000/0x8000000 --jump ACCEPT',
+        '--append felix-INPUT --protocol tcp --destination 123.0.0.1 --dport 1234 --jump ACCEPT',
+        '--append felix-INPUT --protocol udp --sport 68 --dport 67 --jump ACCEPT',
+        '--append felix-INPUT --protocol udp --dport 53 --jump ACCEPT',
+        '--append felix-INPUT --jump DROP -m comment --comment "Drop all packets from endpoints to the host"',
+    ],
+}
+
+OUTPUT_CHAINS = {
+    "Default": [
+        '--append felix-OUTPUT --match conntrack --ctstate INVALID --jump DROP',
+        '--append felix-OUTPUT --match conntrack --ctstate RELATED,ESTABLISHED --jump ACCEPT',
+        '--append felix-OUTPUT --jump MARK --set-mark 0/0x4000000',
+        '--append felix-OUTPUT --out-interface tap+ --jump MARK --set-mark 0x4000000/0x4000000',
+        '--append felix-OUTPUT --goto felix-TO-HOST-IF --match mark --mark 0/0x4000000',
+    ],
+    "IPVS": [
+        '--append felix-OUTPUT --match conntrack --ctstate INVALID --jump DROP',
+        '--append felix-OUTPUT --match conntrack --ctstate RELATED,ESTABLISHED --jump ACCEPT',
+        '--append felix-OUTPUT --out-interface tap+ --match mark --mark 0x8000000/0x8000000 --jump felix-TO-ENDPOINT',
+        '--append felix-OUTPUT --out-interface tap+ --match mark --mark 0x8000000/0x8000000 --jump ACCEPT',
+        '--append felix-OUTPUT --jump MARK --set-mark 0/0x4000000',
+        '--append felix-OUTPUT --out-interface tap+ --jump MARK --set-mark 0x4000000/0x4000000',
+        '--append felix-OUTPUT --goto felix-TO-HOST-IF --match mark --mark 0/0x4000000',
+    ],
 }
 
 IPSET_ID = "s:abcdefg1234567890_-"
@@ -766,6 +801,30 @@ class TestGlobalChains(BaseTestCase):
         self.assertEqual(chain, INPUT_CHAINS["IPIP"])
         self.assertEqual(deps, set(["felix-FROM-HOST-IF"]))
 
+    def test_build_input_chain_ipvs(self):
+        chain, deps = self.iptables_generator.filter_input_chain(
+            ip_version=4,
+            ipvs_set_name="felix-ipvs-services-4")
+        self.maxDiff = None
+        self.assertEqual(chain, INPUT_CHAINS["IPVS"])
+        self.assertEqual(deps, set(["felix-FROM-ENDPOINT",
+                                    "felix-FROM-HOST-IF"]))
+
+    def test_build_output_chain(self):
+        chain, deps = self.iptables_generator.filter_output_chain(
+            ip_version=4)
+        self.assertEqual(chain, OUTPUT_CHAINS["Default"])
+        self.assertEqual(deps, set(["felix-TO-HOST-IF"]))
+
+    def test_build_output_chain_ipvs(self):
+        chain, deps = self.iptables_generator.filter_output_chain(
+            ip_version=4,
+            ipvs_enabled=True)
+        self.maxDiff = None
+        self.assertEqual(chain, OUTPUT_CHAINS["IPVS"])
+        self.assertEqual(deps, set(["felix-TO-ENDPOINT",
+                                    "felix-TO-HOST-IF"]))
+
     def test_build_input_chain_return(self):
         host_dict = {
             "MetadataAddr": "123.0.0.1",
@@ -792,6 +851,149 @@ class TestGlobalChains(BaseTestCase):
         self.assertEqual(deps, set(["felix-FROM-ENDPOINT",
                                     "felix-TO-ENDPOINT"]))
 
+    def test_excluded_ifaces(self):
+        host_dict = {
+            "InterfacePrefix": "tap",
+            "InterfaceExclude": "docker+,tapexcl",
+        }
+        config = load_config("felix_empty.cfg", host_dict=host_dict)
+        generator = config.plugins["iptables_generator"]
+        self.maxDiff = None
+
+        chain, _ = generator.filter_forward_chain(ip_version=4)
+        self.assertEqual(chain[:4], [
+            '--append felix-FORWARD --in-interface docker+ --jump RETURN',
+            '--append felix-FORWARD --out-interface docker+ --jump RETURN',
+            '--append felix-FORWARD --in-interface tapexcl --jump RETURN',
+            '--append felix-FORWARD --out-interface tapexcl --jump RETURN',
+        ])
+        self.assertEqual(chain[4:], TAP_FORWARD_CHAIN)
+
+        chain, _ = generator.filter_input_chain(ip_version=4)
+        self.assertEqual(chain[:2], [
+            '--append felix-INPUT --in-interface docker+ --jump RETURN',
+            '--append felix-INPUT --in-interface tapexcl --jump RETURN',
+        ])
+
+        chain, _ = generator.filter_output_chain(ip_version=4)
+        self.assertEqual(chain[:2], [
+            '--append felix-OUTPUT --out-interface docker+ --jump RETURN',
+            '--append felix-OUTPUT --out-interface tapexcl --jump RETURN',
+        ])
+
+    def test_drop_invalid_conntrack_disabled(self):
+        host_dict = {
+            "InterfacePrefix": "tap",
+            "DropInvalidConntrack": "none",
+        }
+        config = load_config("felix_empty.cfg", host_dict=host_dict)
+        generator = config.plugins["iptables_generator"]
+        for chain, _ in (generator.filter_input_chain(ip_version=4),
+                         generator.filter_output_chain(ip_version=4),
+                         generator.filter_forward_chain(ip_version=4)):
+            for rule in chain:
+                self.assertNotIn("INVALID", rule)
+
+        chain, _ = generator.filter_forward_chain(ip_version=4)
+        self.assertEqual(chain, [rule for rule in TAP_FORWARD_CHAIN
+                                 if "INVALID" not in rule])
+
+    def test_drop_invalid_conntrack_forward_only(self):
+        host_dict = {
+            "InterfacePrefix": "tap",
+            "DropInvalidConntrack": "forward",
+        }
+        config = load_config("felix_empty.cfg", host_dict=host_dict)
+        generator = config.plugins["iptables_generator"]
+        chain, _ = generator.filter_forward_chain(ip_version=4)
+        self.assertEqual(chain, TAP_FORWARD_CHAIN)
+        for chain, _ in (generator.filter_input_chain(ip_version=4),
+                         generator.filter_output_chain(ip_version=4)):
+            for rule in chain:
+                self.assertNotIn("INVALID", rule)
+
+    def test_conntrack_bypass_disabled(self):
+        host_dict = {
+            "InterfacePrefix": "tap",
+            "ConntrackBypassEnabled": "false",
+        }
+        config = load_config("felix_empty.cfg", host_dict=host_dict)
+        generator = config.plugins["iptables_generator"]
+        chain, _ = generator.filter_forward_chain(ip_version=4)
+        self.assertEqual(chain, [
+            rule.replace("RELATED,ESTABLISHED",
+                         "RELATED,ESTABLISHED --ctdir REPLY")
+            for rule in TAP_FORWARD_CHAIN
+        ])
+
+    def test_chain_accept_action_return(self):
+        host_dict = {
+            "InterfacePrefix": "tap",
+            "ChainAcceptAction": "RETURN",
+        }
+        config = load_config("felix_empty.cfg", host_dict=host_dict)
+        generator = config.plugins["iptables_generator"]
+        chain, deps = generator.filter_forward_chain(ip_version=4)
+        self.assertEqual(chain, [
+            '--append felix-FORWARD --in-interface tap+ --match conntrack --ctstate INVALID --jump DROP',
+            '--append felix-FORWARD --out-interface tap+ --match conntrack --ctstate INVALID --jump DROP',
+            '--append felix-FORWARD --in-interface tap+ --match conntrack --ctstate RELATED,ESTABLISHED --jump MARK --set-mark 0x1000000/0x1000000',
+            '--append felix-FORWARD --in-interface tap+ --match conntrack --ctstate RELATED,ESTABLISHED --jump RETURN',
+            '--append felix-FORWARD --out-interface tap+ --match conntrack --ctstate RELATED,ESTABLISHED --jump MARK --set-mark 0x1000000/0x1000000',
+            '--append felix-FORWARD --out-interface tap+ --match conntrack --ctstate RELATED,ESTABLISHED --jump RETURN',
+            '--append felix-FORWARD --jump felix-FROM-ENDPOINT --in-interface tap+',
+            '--append felix-FORWARD --jump felix-TO-ENDPOINT --out-interface tap+',
+            '--append felix-FORWARD --jump MARK --set-mark 0x1000000/0x1000000 --in-interface tap+',
+            '--append felix-FORWARD --jump RETURN --in-interface tap+',
+            '--append felix-FORWARD --jump MARK --set-mark 0x1000000/0x1000000 --out-interface tap+',
+            '--append felix-FORWARD --jump RETURN --out-interface tap+',
+        ])
+        self.assertEqual(deps, set(["felix-FROM-ENDPOINT",
+                                    "felix-TO-ENDPOINT"]))
+        for chain, _ in (generator.filter_input_chain(ip_version=4),
+                         generator.filter_output_chain(ip_version=4)):
+            for rule in chain:
+                self.assertNotIn("--jump ACCEPT", rule)
+
+    def test_drop_workload_rogue_servers(self):
+        host_dict = {
+            "InterfacePrefix": "tap",
+            "DropWorkloadRouterAdvertisements": "true",
+            "DropWorkloadDHCPServers": "true",
+        }
+        config = load_config("felix_empty.cfg", host_dict=host_dict)
+        generator = config.plugins["iptables_generator"]
+
+        chain, _ = generator.filter_input_chain(ip_version=6)
+        self.assertEqual(chain[:2], [
+            '--append felix-INPUT --in-interface tap+ --protocol ipv6-icmp --icmpv6-type 134 --jump DROP -m comment --comment "Drop router advertisements from workloads"',
+            '--append felix-INPUT --in-interface tap+ --protocol udp --sport 547 --dport 546 --jump DROP -m comment --comment "Drop DHCP server messages from workloads"',
+        ])
+        chain, _ = generator.filter_forward_chain(ip_version=6)
+        self.assertEqual(chain[:2], [
+            '--append felix-FORWARD --in-interface tap+ --protocol ipv6-icmp --icmpv6-type 134 --jump DROP -m comment --comment "Drop router advertisements from workloads"',
+            '--append felix-FORWARD --in-interface tap+ --protocol udp --sport 547 --dport 546 --jump DROP -m comment --comment "Drop DHCP server messages from workloads"',
+        ])
+
+        # Router advertisements are IPv6-only.
+        chain, _ = generator.filter_forward_chain(ip_version=4)
+        self.assertEqual(chain, [
+            '--append felix-FORWARD --in-interface tap+ --protocol udp --sport 67 --dport 68 --jump DROP -m comment --comment "Drop DHCP server messages from workloads"',
+        ] + TAP_FORWARD_CHAIN)
+
+        # The host's own are allowed.
+        chain, _ = generator.filter_output_chain(ip_version=6)
+        for rule in chain:
+            self.assertNotIn("134", rule)
+            self.assertNotIn("547", rule)
+
+    def test_drop_workload_rogue_servers_disabled(self):
+        config = load_config("felix_empty.cfg",
+                             host_dict={"InterfacePrefix": "tap"})
+        generator = config.plugins["iptables_generator"]
+        chain, _ = generator.filter_forward_chain(ip_version=6)
+        self.assertEqual(chain, TAP_FORWARD_CHAIN)
+
     def test_forward_chain_multiple_prefixes(self):
         host_dict = {
             "InterfacePrefix": "tap,cali",
@@ -953,6 +1155,54 @@ class TestRules(BaseTestCase):
                 "foo", {"icmp_type": 255}, 4, {},
             )
 
+    def test_port_protocols(self):
+        for ip_version in (4, 6):
+            for protocol in ("sctp", "udplite", "132", "136"):
+                frags = self.iptables_generator.\
+                    _rule_to_iptables_fragments_inner(
+                        "foo",
+                        {"protocol": protocol,
+                         "src_ports": [1],
+                         "!dst_ports": ["2:3"]},
+                        ip_version, {},
+                    )
+                self.assertTrue(frags[0].startswith(
+                    "--append foo --protocol %s "
+                    "--match multiport --source-ports 1 "
+                    "--match multiport ! --destination-ports 2:3 " % protocol
+                ))
+
+    def test_pkt_type(self):
+        frags = self.iptables_generator._rule_to_iptables_fragments_inner(
+            "foo",
+            {"protocol": "udp",
+             "dst_net": "239.1.2.0/24",
+             "pkt_type": "multicast"},
+            4, {},
+        )
+        self.assertTrue(frags[0].startswith(
+            "--append foo --protocol udp --destination 239.1.2.0/24 "
+            "--match pkttype --pkt-type multicast "
+        ))
+        frags = self.iptables_generator._rule_to_iptables_fragments_inner(
+            "foo", {"!pkt_type": "broadcast"}, 4, {},
+        )
+        self.assertTrue(frags[0].startswith(
+            "--append foo --match pkttype ! --pkt-type broadcast "
+        ))
+
+    def test_pkt_type_broadcast_ipv6(self):
+        # IPv6 has no broadcasts so a positive match can never match...
+        frags = self.iptables_generator._rule_to_iptables_fragments_inner(
+            "foo", {"pkt_type": "broadcast"}, 6, {},
+        )
+        self.assertEqual(frags, [])
+        # ...and a negative match always does.
+        frags = self.iptables_generator._rule_to_iptables_fragments_inner(
+            "foo", {"!pkt_type": "broadcast"}, 6, {},
+        )
+        self.assertNotIn("pkttype", frags[0])
+
     def test_bad_protocol_with_ports(self):
         with self.assertRaises(AssertionError):
             self.iptables_generator._rule_to_iptables_fragments_inner(
@@ -1005,6 +1255,197 @@ class TestEndpoint(BaseTestCase):
         self.maxDiff = None
         self.assertEqual(result, expected_result)
 
+    def test_endpoint_rules_connection_rate(self):
+        tiered_policies = OrderedDict()
+        tiered_policies["tier_1"] = ["t1p1", "t1p2"]
+        tiered_policies["tier_2"] = ["t2p1"]
+        updates, _ = self.iptables_generator.endpoint_updates(
+            4, "e1", "abcd", "aa:22:33:44:55:66", ["prof-1", "prof-2"],
+            tiered_policies, max_connection_rate=100)
+
+        self.maxDiff = None
+        # The limit only applies to connections from the endpoint, straight
+        # after the MAC check.
+        self.assertEqual(updates["felix-to-abcd"], TO_ENDPOINT_CHAIN)
+        self.assertEqual(
+            updates["felix-from-abcd"],
+            FROM_ENDPOINT_CHAIN[:2] + [
+                '--append felix-from-abcd --match conntrack --ctstate NEW '
+                '--match hashlimit --hashlimit-above 100/sec '
+                '--hashlimit-burst 100 --hashlimit-name felix-from-abcd '
+                '--jump DROP -m comment --comment '
+                '"Connection rate limit exceeded"',
+            ] + FROM_ENDPOINT_CHAIN[2:]
+        )
+
+    def test_endpoint_rules_flow_logs(self):
+        config = load_config("felix_default.cfg", global_dict={
+            "FlowLogsEnabled": "true",
+        })
+        iptables_generator = config.plugins["iptables_generator"]
+        tiered_policies = OrderedDict()
+        tiered_policies["tier_1"] = [TieredPolicyId("tier_1", "t1p1")]
+        updates, _ = iptables_generator.endpoint_updates(
+            4, "e1", "abcd", None, ["prof-1"], tiered_policies)
+
+        self.maxDiff = None
+        # Packets to the endpoint go to the inbound group.  The first
+        # packet of each accepted flow is logged after the jump that
+        # accepted it, and dropped packets just before the drop.
+        self.assertEqual(updates["felix-to-abcd"], [
+            '--append felix-to-abcd --jump MARK --set-mark 0/0x1000000',
+            '--append felix-to-abcd --jump MARK --set-mark 0/0x2000000 '
+            '--match comment --comment "Start of tier tier_1"',
+            '--append felix-to-abcd --match mark --mark 0/0x2000000 '
+            '--jump felix-p-tier_1/t1p1-i',
+            '--append felix-to-abcd --match mark --mark 0x1000000/0x1000000 '
+            '--match conntrack --ctstate NEW --jump NFLOG --nflog-group 1 '
+            '--nflog-prefix "A|policy/tier_1/t1p1"',
+            '--append felix-to-abcd --match mark --mark 0x1000000/0x1000000 '
+            '--match comment --comment "Return if policy accepted" '
+            '--jump RETURN',
+            '--append felix-to-abcd --match mark --mark 0/0x2000000 '
+            '--jump NFLOG --nflog-group 1 --nflog-prefix "D|tier/tier_1"',
+            '--append felix-to-abcd --match mark --mark 0/0x2000000 '
+            '--jump DROP -m comment '
+            '--comment "Drop if no policy in tier passed"',
+            '--append felix-to-abcd --jump felix-p-prof-1-i',
+            '--append felix-to-abcd --match mark --mark 0x1000000/0x1000000 '
+            '--match conntrack --ctstate NEW --jump NFLOG --nflog-group 1 '
+            '--nflog-prefix "A|profile/prof-1"',
+            '--append felix-to-abcd --match mark --mark 0x1000000/0x1000000 '
+            '--match comment --comment "Profile accepted packet" '
+            '--jump RETURN',
+            '--append felix-to-abcd --jump NFLOG --nflog-group 1 '
+            '--nflog-prefix "D|profiles"',
+            '--append felix-to-abcd --jump DROP -m comment --comment '
+            '"Packet did not match any profile (endpoint e1)"',
+        ])
+        # Packets from the endpoint go to the outbound group.
+        self.assertIn('--append felix-from-abcd --jump NFLOG '
+                      '--nflog-group 2 --nflog-prefix "D|profiles"',
+                      updates["felix-from-abcd"])
+
+        # Long rule IDs are hashed to fit in the prefix.
+        updates, _ = iptables_generator.endpoint_updates(
+            4, "e1", "abcd", None, ["p" * 100], OrderedDict())
+        self.assertIn('--append felix-to-abcd --match mark '
+                      '--mark 0x1000000/0x1000000 --match conntrack '
+                      '--ctstate NEW --jump NFLOG --nflog-group 1 '
+                      '--nflog-prefix "A|%s"' % futils.length_limited_id(
+                          "A|", "profile/" + "p" * 100, 63),
+                      updates["felix-to-abcd"])
+
+        # Only workload endpoints' flows are logged.
+        updates, _ = iptables_generator.host_endpoint_updates(
+            4, "e1", "abcd", ["prof-1"], tiered_policies
+        )
+        for chain in updates.values():
+            self.assertFalse(any("NFLOG" in r for r in chain))
+
+    def test_endpoint_rules_verdict_cache(self):
+        config = load_config("felix_default.cfg", global_dict={
+            "VerdictCacheEnabled": "true",
+        })
+        iptables_generator = config.plugins["iptables_generator"]
+        tiered_policies = OrderedDict()
+        tiered_policies["tier_1"] = ["t1p1"]
+        updates, _ = iptables_generator.endpoint_updates(
+            4, "e1", "abcd", "aa:22:33:44:55:66", ["prof-1"],
+            tiered_policies)
+
+        self.maxDiff = None
+        # Flows that the chain already accepted skip policy, straight after
+        # the MAC check.  Each accept records the verdict before returning.
+        self.assertEqual(updates["felix-from-abcd"][:7], [
+            '--append felix-from-abcd --jump MARK --set-mark 0/0x1000000',
+            '--append felix-from-abcd --match mac ! --mac-source '
+            'aa:22:33:44:55:66 --jump DROP -m comment --comment '
+            '"Incorrect source MAC"',
+            '--append felix-from-abcd --match connmark '
+            '--mark 0x20000000/0x20000000 --match comment '
+            '--comment "Accept flows with a cached verdict" --jump RETURN',
+            '--append felix-from-abcd --jump MARK --set-mark 0/0x2000000 '
+            '--match comment --comment "Start of tier tier_1"',
+            '--append felix-from-abcd '
+            '--match mark --mark 0/0x2000000 --jump felix-p-t1p1-o',
+            '--append felix-from-abcd --match mark '
+            '--mark 0x1000000/0x1000000 '
+            '--jump CONNMARK --set-mark 0x20000000/0x20000000',
+            '--append felix-from-abcd '
+            '--match mark --mark 0x1000000/0x1000000 '
+            '--match comment --comment "Return if policy accepted" '
+            '--jump RETURN',
+        ])
+        # The to chain uses its own mark, so that a flow's verdicts in the
+        # two directions are cached separately.
+        to_chain = updates["felix-to-abcd"]
+        self.assertEqual(to_chain[1],
+                         '--append felix-to-abcd --match connmark '
+                         '--mark 0x10000000/0x10000000 --match comment '
+                         '--comment "Accept flows with a cached verdict" '
+                         '--jump RETURN')
+        profile_jump = to_chain.index(
+            '--append felix-to-abcd --jump felix-p-prof-1-i')
+        self.assertEqual(to_chain[profile_jump + 1],
+                         '--append felix-to-abcd --match mark '
+                         '--mark 0x1000000/0x1000000 '
+                         '--jump CONNMARK --set-mark 0x10000000/0x10000000')
+
+        # Host endpoints' verdicts aren't cached.
+        updates, _ = iptables_generator.host_endpoint_updates(
+            4, "e1", "abcd", ["prof-1"], tiered_policies
+        )
+        for chain in updates.values():
+            self.assertFalse(any("connmark" in r.lower() for r in chain))
+
+    def test_endpoint_rules_anti_spoofing(self):
+        config = load_config("felix_default.cfg", global_dict={
+            "AntiSpoofingEnabled": "true",
+        })
+        iptables_generator = config.plugins["iptables_generator"]
+        tiered_policies = OrderedDict()
+        tiered_policies["tier_1"] = ["t1p1", "t1p2"]
+        tiered_policies["tier_2"] = ["t2p1"]
+        updates, deps = iptables_generator.endpoint_updates(
+            4, "e1", "abcd", "aa:22:33:44:55:66", ["prof-1", "prof-2"],
+            tiered_policies, source_nets=["10.0.0.1/32", "10.1.0.0/16"])
+
+        self.maxDiff = None
+        # The from chain checks the source address straight after the MAC.
+        self.assertEqual(updates["felix-to-abcd"], TO_ENDPOINT_CHAIN)
+        self.assertEqual(
+            updates["felix-from-abcd"],
+            FROM_ENDPOINT_CHAIN[:2] + [
+                '--append felix-from-abcd --jump felix-src-abcd',
+            ] + FROM_ENDPOINT_CHAIN[2:]
+        )
+        self.assertEqual(updates["felix-src-abcd"], [
+            '--append felix-src-abcd --source 10.0.0.1/32 --jump RETURN',
+            '--append felix-src-abcd --source 10.1.0.0/16 --jump RETURN',
+            '--append felix-src-abcd --jump DROP -m comment --comment '
+            '"Drop if source address is not the endpoint\'s"',
+        ])
+        self.assertTrue("felix-src-abcd" in deps["felix-from-abcd"])
+        self.assertEqual(deps["felix-src-abcd"], set())
+        self.assertEqual(iptables_generator.endpoint_chain_names("abcd"),
+                         set(["felix-to-abcd", "felix-from-abcd",
+                              "felix-src-abcd"]))
+
+        # Host endpoints don't get the check.
+        updates, _ = iptables_generator.host_endpoint_updates(
+            4, "e1", "abcd", ["prof-1"], tiered_policies
+        )
+        self.assertEqual(set(updates.keys()),
+                         set(["felix-to-abcd", "felix-from-abcd"]))
+
+    def test_endpoint_rules_anti_spoofing_disabled(self):
+        updates, _ = self.iptables_generator.endpoint_updates(
+            4, "e1", "abcd", "aa:22:33:44:55:66", ["prof-1", "prof-2"],
+            OrderedDict(), source_nets=["10.0.0.1/32"])
+        self.assertEqual(set(updates.keys()),
+                         set(["felix-to-abcd", "felix-from-abcd"]))
+
     def test_host_endpoint_rules(self):
         expected_result = (
             {
@@ -1038,3 +1479,82 @@ class TestEndpoint(BaseTestCase):
         # Log the whole diff if the comparison fails.
         self.maxDiff = None
         self.assertEqual(result, expected_result)
+
+    def test_host_endpoint_rules_ipv6(self):
+        updates, deps = self.iptables_generator.host_endpoint_updates(
+            6, "e1", "abcd", ["prof-1"], OrderedDict()
+        )
+        # The ICMPv6 chain comes straight after the failsafe chain, ahead
+        # of any policy.
+        self.assertEqual(updates["felix-from-abcd"][:2], [
+            '--append felix-from-abcd --jump felix-FAILSAFE-IN',
+            '--append felix-from-abcd --jump felix-ICMPV6-ND',
+        ])
+        self.assertEqual(updates["felix-to-abcd"][:2], [
+            '--append felix-to-abcd --jump felix-FAILSAFE-OUT',
+            '--append felix-to-abcd --jump felix-ICMPV6-ND',
+        ])
+        self.assertTrue("felix-ICMPV6-ND" in deps["felix-from-abcd"])
+        self.assertTrue("felix-ICMPV6-ND" in deps["felix-to-abcd"])
+
+    def test_host_endpoint_rules_port_scan(self):
+        config = load_config("felix_default.cfg", global_dict={
+            "PortScanInterfaces": "eth0",
+        })
+        iptables_generator = config.plugins["iptables_generator"]
+        tiered_policies = OrderedDict()
+        tiered_policies["tier_1"] = ["t1p1"]
+        updates, deps = iptables_generator.host_endpoint_updates(
+            4, "e1", "abcd", ["prof-1"], tiered_policies
+        )
+        # Packets from the host interface jump to the detection chain just
+        # before each of the drops for packets that policy didn't allow.
+        from_chain = updates["felix-from-abcd"]
+        tier_drop = from_chain.index(
+            '--append felix-from-abcd --match mark --mark 0/0x2000000 '
+            '--jump DROP -m comment --comment '
+            '"Drop if no policy in tier passed"')
+        self.assertEqual(from_chain[tier_drop - 1],
+                         '--append felix-from-abcd '
+                         '--match mark --mark 0/0x2000000 '
+                         '--jump cali-portscan')
+        self.assertEqual(from_chain[-2],
+                         '--append felix-from-abcd --jump cali-portscan')
+        self.assertFalse(any("cali-portscan" in r
+                             for r in updates["felix-to-abcd"]))
+        # The chain is the Go side's, so it isn't a dep.
+        self.assertFalse("cali-portscan" in deps["felix-from-abcd"])
+
+    def test_host_endpoint_rules_no_port_scan(self):
+        updates, _ = self.iptables_generator.host_endpoint_updates(
+            4, "e1", "abcd", ["prof-1"], OrderedDict()
+        )
+        for chain in updates.values():
+            self.assertFalse(any("cali-portscan" in r for r in chain))
+
+    def test_workload_endpoint_rules_ipv6(self):
+        updates, deps = self.iptables_generator.endpoint_updates(
+            6, "e1", "abcd", None, ["prof-1"], OrderedDict()
+        )
+        for chain in updates.values():
+            self.assertFalse(any("felix-ICMPV6-ND" in r for r in chain))
+
+    def test_icmpv6_nd_chain(self):
+        updates, deps = self.iptables_generator.icmpv6_nd_chain()
+        self.assertEqual(updates, [
+            '--append felix-ICMPV6-ND --protocol ipv6-icmp '
+            '--match icmp6 --icmpv6-type 2 --jump ACCEPT',
+            '--append felix-ICMPV6-ND --protocol ipv6-icmp '
+            '--match icmp6 --icmpv6-type 133 --match hl --hl-eq 255 '
+            '--jump ACCEPT',
+            '--append felix-ICMPV6-ND --protocol ipv6-icmp '
+            '--match icmp6 --icmpv6-type 134 --match hl --hl-eq 255 '
+            '--jump ACCEPT',
+            '--append felix-ICMPV6-ND --protocol ipv6-icmp '
+            '--match icmp6 --icmpv6-type 135 --match hl --hl-eq 255 '
+            '--jump ACCEPT',
+            '--append felix-ICMPV6-ND --protocol ipv6-icmp '
+            '--match icmp6 --icmpv6-type 136 --match hl --hl-eq 255 '
+            '--jump ACCEPT',
+        ])
+        self.assertEqual(deps, set())
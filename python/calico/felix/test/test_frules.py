@@ -84,15 +84,21 @@ class TestRules(BaseTestCase):
                                   "-j MASQUERADE",
                                   async=False),
                 call("PREROUTING --jump felix-PREROUTING", async=False),
+                call("PREROUTING --jump cali-PREROUTING", async=False),
                 call("POSTROUTING --jump felix-POSTROUTING", async=False),
-                call("OUTPUT --jump felix-OUTPUT", async=False)
+                call("POSTROUTING --jump cali-POSTROUTING", async=False),
+                call("OUTPUT --jump felix-OUTPUT", async=False),
+                call("OUTPUT --jump cali-OUTPUT", async=False)
             ]
         )
 
         m_v4_upd.ensure_rule_inserted.assert_has_calls([
                 call("INPUT --jump felix-INPUT", async=False),
+                call("INPUT --jump cali-INPUT", async=False),
                 call("OUTPUT --jump felix-OUTPUT", async=False),
-                call("FORWARD --jump felix-FORWARD", async=False)
+                call("OUTPUT --jump cali-OUTPUT", async=False),
+                call("FORWARD --jump felix-FORWARD", async=False),
+                call("FORWARD --jump cali-FORWARD", async=False)
             ]
         )
 
@@ -168,15 +174,21 @@ class TestRules(BaseTestCase):
             m_v6_nat_upd.ensure_rule_inserted.mock_calls,
             [
                 call("PREROUTING --jump felix-PREROUTING", async=False),
+                call("PREROUTING --jump cali-PREROUTING", async=False),
                 call("POSTROUTING --jump felix-POSTROUTING", async=False),
+                call("POSTROUTING --jump cali-POSTROUTING", async=False),
                 call("OUTPUT --jump felix-OUTPUT", async=False),
+                call("OUTPUT --jump cali-OUTPUT", async=False),
             ]
         )
 
         m_v6_upd.ensure_rule_inserted.assert_has_calls([
                 call("INPUT --jump felix-INPUT", async=False),
+                call("INPUT --jump cali-INPUT", async=False),
                 call("OUTPUT --jump felix-OUTPUT", async=False),
-                call("FORWARD --jump felix-FORWARD", async=False)
+                call("OUTPUT --jump cali-OUTPUT", async=False),
+                call("FORWARD --jump felix-FORWARD", async=False),
+                call("FORWARD --jump cali-FORWARD", async=False)
             ]
         )
 
@@ -261,14 +273,20 @@ class TestRules(BaseTestCase):
         self.assertEqual(
             m_v4_nat_upd.ensure_rule_inserted.mock_calls,
             [call("PREROUTING --jump felix-PREROUTING", async=False),
+             call("PREROUTING --jump cali-PREROUTING", async=False),
              call("POSTROUTING --jump felix-POSTROUTING", async=False),
-             call("OUTPUT --jump felix-OUTPUT", async=False)]
+             call("POSTROUTING --jump cali-POSTROUTING", async=False),
+             call("OUTPUT --jump felix-OUTPUT", async=False),
+             call("OUTPUT --jump cali-OUTPUT", async=False)]
         )
 
         m_v4_upd.ensure_rule_inserted.assert_has_calls([
                 call("INPUT --jump felix-INPUT", async=False),
+                call("INPUT --jump cali-INPUT", async=False),
                 call("OUTPUT --jump felix-OUTPUT", async=False),
-                call("FORWARD --jump felix-FORWARD", async=False)
+                call("OUTPUT --jump cali-OUTPUT", async=False),
+                call("FORWARD --jump felix-FORWARD", async=False),
+                call("FORWARD --jump cali-FORWARD", async=False)
             ]
         )
 
@@ -399,14 +417,20 @@ class TestRules(BaseTestCase):
         self.assertEqual(
             m_v4_nat_upd.ensure_rule_inserted.mock_calls,
             [call("PREROUTING --jump felix-PREROUTING", async=False),
+             call("PREROUTING --jump cali-PREROUTING", async=False),
              call("POSTROUTING --jump felix-POSTROUTING", async=False),
-             call("OUTPUT --jump felix-OUTPUT", async=False)]
+             call("POSTROUTING --jump cali-POSTROUTING", async=False),
+             call("OUTPUT --jump felix-OUTPUT", async=False),
+             call("OUTPUT --jump cali-OUTPUT", async=False)]
         )
 
         m_v4_upd.ensure_rule_inserted.assert_has_calls([
                 call("INPUT --jump felix-INPUT", async=False),
+                call("INPUT --jump cali-INPUT", async=False),
                 call("OUTPUT --jump felix-OUTPUT", async=False),
-                call("FORWARD --jump felix-FORWARD", async=False)
+                call("OUTPUT --jump cali-OUTPUT", async=False),
+                call("FORWARD --jump felix-FORWARD", async=False),
+                call("FORWARD --jump cali-FORWARD", async=False)
             ]
         )
 
@@ -491,6 +515,92 @@ class TestRules(BaseTestCase):
             async=False
         )
 
+    def test_insert_kernel_chain_jumps_user_chains(self):
+        m_config = Mock()
+        m_config.USER_CHAIN_HOOKS = [
+            ("input", "after", "admin-in"),
+            ("input", "before", "admin-early"),
+            ("forward", "after", "admin-fwd"),
+        ]
+        for insert_mode, expected_fragments in [
+            ("insert", ["INPUT --jump admin-in",
+                        "INPUT --jump felix-INPUT",
+                        "INPUT --jump cali-INPUT",
+                        "INPUT --jump admin-early"]),
+            ("append", ["INPUT --jump admin-early",
+                        "INPUT --jump cali-INPUT",
+                        "INPUT --jump felix-INPUT",
+                        "INPUT --jump admin-in"]),
+        ]:
+            m_config.CHAIN_INSERT_MODE = insert_mode
+            m_v4_upd = Mock(spec=IptablesUpdater)
+            frules._insert_kernel_chain_jumps(m_config, m_v4_upd, "INPUT",
+                                              "felix-INPUT")
+            self.assertEqual(
+                m_v4_upd.ensure_chain_exists.mock_calls,
+                [call("admin-in", async=False),
+                 call("admin-early", async=False),
+                 call("cali-INPUT", async=False)]
+            )
+            self.assertEqual(
+                m_v4_upd.ensure_rule_inserted.mock_calls,
+                [call(fragment, async=False)
+                 for fragment in expected_fragments]
+            )
+
+    def test_insert_kernel_chain_jumps_no_user_chains(self):
+        m_config = Mock()
+        m_config.USER_CHAIN_HOOKS = [("forward", "after", "admin-fwd")]
+        m_config.CHAIN_INSERT_MODE = "insert"
+        m_v4_upd = Mock(spec=IptablesUpdater)
+        frules._insert_kernel_chain_jumps(m_config, m_v4_upd, "OUTPUT",
+                                          "felix-OUTPUT")
+        self.assertEqual(
+            m_v4_upd.ensure_chain_exists.mock_calls,
+            [call("cali-OUTPUT", async=False)]
+        )
+        self.assertEqual(
+            m_v4_upd.ensure_rule_inserted.mock_calls,
+            [call("OUTPUT --jump felix-OUTPUT", async=False),
+             call("OUTPUT --jump cali-OUTPUT", async=False)]
+        )
+
+    def test_insert_kernel_chain_jumps_nat(self):
+        m_config = Mock()
+        m_config.USER_CHAIN_HOOKS = [("output", "before", "admin-out")]
+        m_config.CHAIN_INSERT_MODE = "insert"
+        m_v4_nat_upd = Mock(spec=IptablesUpdater)
+        frules._insert_kernel_chain_jumps(m_config, m_v4_nat_upd, "OUTPUT",
+                                          "felix-OUTPUT", user_hooks=False)
+        self.assertEqual(
+            m_v4_nat_upd.ensure_chain_exists.mock_calls,
+            [call("cali-OUTPUT", async=False)]
+        )
+        self.assertEqual(
+            m_v4_nat_upd.ensure_rule_inserted.mock_calls,
+            [call("OUTPUT --jump felix-OUTPUT", async=False),
+             call("OUTPUT --jump cali-OUTPUT", async=False)]
+        )
+
+    @patch("calico.felix.frules.HOSTS_IPSET_V4", autospec=True)
+    def test_install_global_rules_port_scan(self, m_ipset):
+        for ifaces, expected_calls in [
+            ("eth0", [call("cali-portscan", async=False)]),
+            ("", []),
+        ]:
+            config = load_config("felix_missing.cfg", global_dict={
+                "PortScanInterfaces": ifaces,
+            })
+            m_v4_upd = Mock(spec=IptablesUpdater)
+            m_v4_nat_upd = Mock(spec=IptablesUpdater)
+            frules.install_global_rules(config, m_v4_upd, m_v4_nat_upd,
+                                        ip_version=4)
+            port_scan_calls = [
+                c for c in m_v4_upd.ensure_chain_exists.mock_calls
+                if c[1][0] == "cali-portscan"
+            ]
+            self.assertEqual(port_scan_calls, expected_calls)
+
     def test_install_global_rules_retries_ipip(self):
         m_config = Mock()
         m_config.IFACE_PREFIX = ["tap"]
@@ -553,6 +663,15 @@ class TestRules(BaseTestCase):
         self.assertEqual(
             frules.interface_to_chain_suffix(config, 'tabq0123456'),
             '0123456')
+
+        # The longest matching prefix wins, whatever the configured order.
+        config.IFACE_PREFIX = ['t', 'tapx', 'tap']
+        self.assertEqual(
+            frules.interface_to_chain_suffix(config, 'tapx0123456'),
+            '0123456')
+        self.assertEqual(
+            frules.interface_to_chain_suffix(config, 'eth0'),
+            'eth0')
         self.assertEqual(
             frules.interface_to_chain_suffix(config, 't0123456'),
             '0123456')
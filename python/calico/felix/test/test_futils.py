@@ -123,7 +123,20 @@ class TestFutils(unittest2.TestCase):
                                           "%r but got %r" %
                                           (inp, length, exp, output))
 
-    def test_safe_truncate(self):
+    def test_length_limited_id(self):
+        # The same cases as the Go side's hashutils tests, since the IDs
+        # must match.
+        for prefix, suffix, length, exp in [
+                ("cali-", "foo", 20, "cali-foo"),
+                ("cali-", "123456789012345", 20, "cali-123456789012345"),
+                ("cali-", "1234567890123456", 20, "cali-_yhYZe-HuBbadI7"),
+                ("cali-", "_foo", 20, "cali-_UYWglFdi6DcgwU"),
+                ("cali-", "", 20, "cali-"),
+                ("cali-", "_foo", 64,
+                 "cali-_UYWglFdi6DcgwUlVBxPubqHYEohNh9izeeiP8Q")]:
+            self.assertEqual(futils.length_limited_id(prefix, suffix, length),
+                             exp)
+
         self.assert_safe_truncate("foobarbazb", 10, "foobarbazb")
         # Yes, this gets longer, which is silly.  However, there's no point
         # making the code complicated to handle this case that should never be
@@ -149,6 +162,26 @@ class TestFutils(unittest2.TestCase):
         self.assertEqual(futils.find_longest_prefix(["ab", "cd"]), "")
         self.assertEqual(futils.find_longest_prefix(["tapabcd", "tapacdef"]), "tapa")
 
+    def test_iface_is_excluded(self):
+        patterns = ["docker+", "veth1234"]
+        self.assertTrue(futils.iface_is_excluded("docker0", patterns))
+        self.assertTrue(futils.iface_is_excluded("docker", patterns))
+        self.assertTrue(futils.iface_is_excluded("veth1234", patterns))
+        self.assertFalse(futils.iface_is_excluded("veth12345", patterns))
+        self.assertFalse(futils.iface_is_excluded("cali1234", patterns))
+        self.assertFalse(futils.iface_is_excluded("docker0", []))
+
+    def test_workload_iface_prefix(self):
+        prefixes = ["tap", "tapx", "cali"]
+        self.assertEqual(futils.workload_iface_prefix("tap1234", prefixes),
+                         "tap")
+        self.assertEqual(futils.workload_iface_prefix("tapx1234", prefixes),
+                         "tapx")
+        self.assertEqual(futils.workload_iface_prefix("cali1234", prefixes),
+                         "cali")
+        self.assertEqual(futils.workload_iface_prefix("eth0", prefixes), None)
+        self.assertEqual(futils.workload_iface_prefix("eth0", [""]), None)
+
     @mock.patch("os.path.exists", autospec=True)
     @mock.patch("calico.felix.futils.check_call", autospec=True)
     @mock.patch("calico.felix.futils.Popen", autospec=True)
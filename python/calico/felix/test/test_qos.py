@@ -0,0 +1,102 @@
+# -*- coding: utf-8 -*-
+# Copyright (c) 2014-2016 Tigera, Inc. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+"""
+felix.test.test_qos
+~~~~~~~~~~~~~~~~~~~
+
+Tests for per-endpoint bandwidth limits.
+"""
+import logging
+import mock
+import sys
+
+if sys.version_info < (2, 7):
+    import unittest2 as unittest
+else:
+    import unittest
+
+import calico.felix.futils as futils
+import calico.felix.qos as qos
+from calico.felix.futils import FailedSystemCall
+
+# Logger
+log = logging.getLogger(__name__)
+
+NO_OUTPUT = futils.CommandOutput("", "")
+TBF_OUTPUT = futils.CommandOutput(
+    "qdisc tbf 8001: root refcnt 2 rate 10Mbit burst 16Kb lat 25.0ms\n", "")
+DEFAULT_OUTPUT = futils.CommandOutput(
+    "qdisc noqueue 0: root refcnt 2\n", "")
+
+
+class TestQos(unittest.TestCase):
+    def test_burst_bytes(self):
+        self.assertEqual(qos.burst_bytes(1000), qos.MIN_BURST_BYTES)
+        self.assertEqual(qos.burst_bytes(10 * 1000 * 1000 * 1000), 12500000)
+
+    @mock.patch("calico.felix.futils.check_call", autospec=True,
+                return_value=NO_OUTPUT)
+    def test_set_limits(self, m_check_call):
+        qos.set_bandwidth_limits("cali1234", 10000000, 1000000)
+        self.assertEqual(m_check_call.mock_calls, [
+            mock.call(["tc", "qdisc", "replace", "dev", "cali1234", "root",
+                       "tbf", "rate", "10000000bit", "burst", "16384b",
+                       "latency", "25ms"]),
+            mock.call(["tc", "qdisc", "replace", "dev", "cali1234",
+                       "clsact"]),
+            mock.call(["tc", "filter", "replace", "dev", "cali1234",
+                       "ingress", "pref", "2", "handle", "1", "matchall",
+                       "action", "police", "rate", "1000000bit",
+                       "burst", "16384b", "conform-exceed", "drop"]),
+        ])
+
+    @mock.patch("calico.felix.futils.check_call", autospec=True,
+                return_value=TBF_OUTPUT)
+    def test_remove_limits(self, m_check_call):
+        qos.remove_bandwidth_limits("cali1234")
+        self.assertEqual(m_check_call.mock_calls, [
+            mock.call(["tc", "qdisc", "show", "dev", "cali1234", "root"]),
+            mock.call(["tc", "qdisc", "del", "dev", "cali1234", "root"]),
+            mock.call(["tc", "filter", "del", "dev", "cali1234", "ingress",
+                       "pref", "2"]),
+        ])
+
+    @mock.patch("calico.felix.futils.check_call", autospec=True)
+    def test_remove_leaves_other_root_qdisc(self, m_check_call):
+        def check_call(args):
+            if args[1:3] == ["filter", "del"]:
+                raise FailedSystemCall(
+                    stderr="RTNETLINK answers: No such file or directory")
+            return DEFAULT_OUTPUT
+        m_check_call.side_effect = check_call
+        qos.remove_bandwidth_limits("cali1234")
+        self.assertEqual(m_check_call.mock_calls, [
+            mock.call(["tc", "qdisc", "show", "dev", "cali1234", "root"]),
+            mock.call(["tc", "filter", "del", "dev", "cali1234", "ingress",
+                       "pref", "2"]),
+        ])
+
+    @mock.patch("calico.felix.futils.check_call", autospec=True)
+    def test_remove_iface_gone(self, m_check_call):
+        m_check_call.side_effect = FailedSystemCall(
+            stderr='Cannot find device "cali1234"')
+        qos.remove_bandwidth_limits("cali1234")
+
+    @mock.patch("calico.felix.futils.check_call", autospec=True)
+    def test_remove_failure(self, m_check_call):
+        m_check_call.side_effect = FailedSystemCall(stderr="Operation not "
+                                                           "permitted")
+        self.assertRaises(FailedSystemCall, qos.remove_bandwidth_limits,
+                          "cali1234")
@@ -208,6 +208,42 @@ class TestCommon(unittest.TestCase):
         self.assertEqual(tier["order"], common.INFINITY)
         self.assertGreater(tier["order"], 999999999999999999999999999999999999)
 
+    def test_validate_rules_pkt_type(self):
+        profile_id = "valid_name-ok."
+        rule = {'pkt_type': 'multicast', 'dst_net': '239.1.2.0/24'}
+        rules = {'inbound_rules': [rule],
+                 'outbound_rules': []}
+        common.validate_profile(profile_id, rules)
+
+        rule = {'pkt_type': 'anycast'}
+        rules = {'inbound_rules': [rule],
+                 'outbound_rules': []}
+        with self.assertRaisesRegexp(ValidationFailed,
+                                     "Invalid packet type"):
+            common.validate_profile(profile_id, rules)
+
+        rule = {'pkt_type': 'broadcast', 'ip_version': 6}
+        rules = {'inbound_rules': [rule],
+                 'outbound_rules': []}
+        with self.assertRaisesRegexp(ValidationFailed,
+                                     "IPv6 has no broadcast packets"):
+            common.validate_profile(profile_id, rules)
+
+        rule = {'pkt_type': 'multicast', 'dst_net': '10.0.0.0/8'}
+        rules = {'inbound_rules': [rule],
+                 'outbound_rules': []}
+        with self.assertRaisesRegexp(ValidationFailed,
+                                     "non-multicast destination"):
+            common.validate_profile(profile_id, rules)
+
+    def test_is_multicast_cidr(self):
+        self.assertTrue(common.is_multicast_cidr("239.1.2.3/32"))
+        self.assertTrue(common.is_multicast_cidr("224.0.0.0/4"))
+        self.assertFalse(common.is_multicast_cidr("224.0.0.0/3"))
+        self.assertFalse(common.is_multicast_cidr("10.0.0.1/32"))
+        self.assertTrue(common.is_multicast_cidr("ff02::1/128"))
+        self.assertFalse(common.is_multicast_cidr("fd00::/64"))
+
     @skip("golang rewrite")
     def test_validate_rules(self):
         profile_id = "valid_name-ok."
@@ -300,6 +336,15 @@ class TestCommon(unittest.TestCase):
                  'outbound_rules': []}
         common.validate_profile(profile_id, rules)
 
+        for name, number in [("gre", "47"), ("esp", "50"), ("ah", "51")]:
+            rule = {'protocol': name,
+                    '!protocol': name}
+            rules = {'inbound_rules': [rule],
+                     'outbound_rules': []}
+            common.validate_profile(profile_id, rules)
+            self.assertEqual(rules['inbound_rules'][0]['protocol'], number)
+            self.assertEqual(rules['inbound_rules'][0]['!protocol'], number)
+
         rule = {'protocol': "256"}
         rules = {'inbound_rules': [rule],
                  'outbound_rules': []}
@@ -990,6 +1035,25 @@ class TestValidateHostEndpoint(_BaseTestValidateEndpoint):
     def test_no_exp_ip_canon(self):
         self.do_canonicalisation_test(use_exp_ips=False)
 
+    def test_interface_names(self):
+        ep = self.valid_endpoint(use_exp_ips=False)
+        ep["interface_names"] = ["eth1", "bond0.100"]
+        self.assert_endpoint_valid(ep)
+        # Interface names are enough on their own.
+        self.assert_endpoint_valid({"interface_names": ["eth1"]})
+        # As is the wildcard name.
+        self.assert_endpoint_valid({"name": "*"})
+
+    def test_interface_names_failures(self):
+        self.assert_tweak_invalidates_endpoint(interface_names="eth1")
+        self.assert_tweak_invalidates_endpoint(interface_names=[""])
+        self.assert_tweak_invalidates_endpoint(interface_names=[1])
+        self.assert_tweak_invalidates_endpoint(interface_names=["*"])
+        self.assert_tweak_invalidates_endpoint(
+            interface_names=["a" * 16])
+        self.assert_tweak_invalidates_endpoint(name="*",
+                                               interface_names=["eth1"])
+
     def test_validate_endpoint_failures(self):
         self.assert_tweak_invalidates_endpoint(state="active")
         self.assert_tweak_invalidates_endpoint(state="inactive")